@@ -1,18 +0,0 @@
-#!/bin/bash
-
-cd `dirname $0`
-cat > mapnik_config.go <<EOF
-package mapnik
-
-// THIS FILE IS AUTO GENERATED BY go generate !DO NOT EDIT!
-
-// #cgo CXXFLAGS: $(mapnik-config --cflags)
-// #cgo LDFLAGS: $(mapnik-config --libs) -lboost_system
-import "C"
-
-const (
-	fontPath   = "$(mapnik-config --fonts)"
-	pluginPath = "$(mapnik-config --input-plugins)"
-)
-EOF
-
@@ -0,0 +1,119 @@
+//go:build ignore
+// +build ignore
+
+// configure writes mapnik_config.go with the cgo flags and the default font
+// and plugin paths of the installed Mapnik. It is called by go generate.
+//
+// The flags are taken from mapnik-config. On systems without mapnik-config
+// (e.g. Windows) set MAPNIK_PREFIX to the installation directory of Mapnik,
+// with include/, lib/, lib/mapnik/fonts and lib/mapnik/input. Each value can
+// be overridden with MAPNIK_CXXFLAGS, MAPNIK_LDFLAGS, MAPNIK_FONTS and
+// MAPNIK_PLUGINS.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type config struct {
+	cxxflags, ldflags string
+	fonts, plugins    string
+	dllDir            string
+}
+
+func mapnikConfig(bin string) (config, error) {
+	run := func(arg string) (string, error) {
+		out, err := exec.Command(bin, arg).Output()
+		if err != nil {
+			return "", fmt.Errorf("%s %s: %s", bin, arg, err)
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+	var c config
+	var err error
+	if c.cxxflags, err = run("--cflags"); err != nil {
+		return c, err
+	}
+	if c.ldflags, err = run("--libs"); err != nil {
+		return c, err
+	}
+	c.ldflags += " -lboost_system"
+	if c.fonts, err = run("--fonts"); err != nil {
+		return c, err
+	}
+	if c.plugins, err = run("--input-plugins"); err != nil {
+		return c, err
+	}
+	if prefix, err := run("--prefix"); err == nil {
+		c.dllDir = filepath.Join(prefix, "bin")
+	}
+	return c, nil
+}
+
+func prefixConfig(prefix string) config {
+	return config{
+		cxxflags: "-I" + filepath.Join(prefix, "include"),
+		ldflags:  "-L" + filepath.Join(prefix, "lib") + " -lmapnik",
+		fonts:    filepath.Join(prefix, "lib", "mapnik", "fonts"),
+		plugins:  filepath.Join(prefix, "lib", "mapnik", "input"),
+		dllDir:   filepath.Join(prefix, "bin"),
+	}
+}
+
+func main() {
+	var c config
+	if prefix := os.Getenv("MAPNIK_PREFIX"); prefix != "" {
+		c = prefixConfig(prefix)
+	} else {
+		bin := os.Getenv("MAPNIK_CONFIG")
+		if bin == "" {
+			var err error
+			if bin, err = exec.LookPath("mapnik-config"); err != nil {
+				log.Fatal("mapnik-config not found, set MAPNIK_CONFIG or MAPNIK_PREFIX")
+			}
+		}
+		var err error
+		if c, err = mapnikConfig(bin); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for env, v := range map[string]*string{
+		"MAPNIK_CXXFLAGS": &c.cxxflags,
+		"MAPNIK_LDFLAGS":  &c.ldflags,
+		"MAPNIK_FONTS":    &c.fonts,
+		"MAPNIK_PLUGINS":  &c.plugins,
+	} {
+		if e := os.Getenv(env); e != "" {
+			*v = e
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `package mapnik
+
+// THIS FILE IS AUTO GENERATED BY go generate !DO NOT EDIT!
+
+// #cgo CXXFLAGS: %s
+// #cgo LDFLAGS: %s
+import "C"
+
+const (
+	fontPath   = %q
+	pluginPath = %q
+	dllPath    = %q
+)
+`,
+		// cgo requires forward slashes, also on Windows
+		filepath.ToSlash(c.cxxflags), filepath.ToSlash(c.ldflags),
+		c.fonts, c.plugins, c.dllDir)
+	if err := ioutil.WriteFile("mapnik_config.go", buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !windows
+// +build !windows
+
+package mapnik
+
+// addDLLDir is only required on Windows, other systems find the
+// dependencies of the plugins with the runtime linker.
+func addDLLDir(dir string) {}
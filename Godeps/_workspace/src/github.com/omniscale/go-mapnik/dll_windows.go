@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package mapnik
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// addDLLDir adds dir to the PATH of the process. Windows searches the PATH
+// for DLLs that are loaded at runtime, like the datasource plugins of Mapnik
+// and their dependencies.
+func addDLLDir(dir string) {
+	if dir == "" {
+		return
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return
+	}
+	path := os.Getenv("PATH")
+	for _, p := range filepath.SplitList(path) {
+		if strings.EqualFold(filepath.Clean(p), filepath.Clean(dir)) {
+			return
+		}
+	}
+	os.Setenv("PATH", dir+string(filepath.ListSeparator)+path)
+}
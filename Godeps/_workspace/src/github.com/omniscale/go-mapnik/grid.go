@@ -0,0 +1,67 @@
+package mapnik
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Grid is the hit grid of a single layer, returned by RenderGrid.
+type Grid struct {
+	// Width and Height of the grid in cells.
+	Width, Height int
+	// Cells contains the index in Keys of the feature in each cell, row by
+	// row. -1 for cells without a feature.
+	Cells []int
+	// Keys of all features in the grid, in the order of their first cell.
+	Keys []string
+	// Data contains the requested fields of each feature by key. All values
+	// are converted to strings.
+	Data map[string]map[string]string
+}
+
+// utfGrid is the JSON of an UTFGrid 1.2.
+type utfGrid struct {
+	Grid []string                     `json:"grid"`
+	Keys []string                     `json:"keys"`
+	Data map[string]map[string]string `json:"data"`
+}
+
+// UTFGrid returns g as UTFGrid 1.2 JSON, see
+// https://github.com/mapbox/utfgrid-spec
+func (g *Grid) UTFGrid() ([]byte, error) {
+	// the empty key is always the first, so cells without a feature are
+	// encoded as space
+	u := utfGrid{
+		Grid: make([]string, 0, g.Height),
+		Keys: append([]string{""}, g.Keys...),
+		Data: g.Data,
+	}
+	if len(u.Keys) > maxUTFGridKeys {
+		return nil, errors.New("mapnik: too many features for UTFGrid")
+	}
+	row := make([]rune, g.Width)
+	for y := 0; y < g.Height; y++ {
+		for x := 0; x < g.Width; x++ {
+			row[x] = encodeUTFGridID(g.Cells[y*g.Width+x] + 1)
+		}
+		u.Grid = append(u.Grid, string(row))
+	}
+	return json.Marshal(u)
+}
+
+// maxUTFGridKeys is the number of IDs that can be encoded below the
+// surrogate range U+D800.
+const maxUTFGridKeys = 0xd800 - 32 - 2
+
+// encodeUTFGridID returns the character of id, with 32 added and " and \
+// skipped (see the UTFGrid spec).
+func encodeUTFGridID(id int) rune {
+	id += 32
+	if id >= 34 {
+		id++
+	}
+	if id >= 92 {
+		id++
+	}
+	return rune(id)
+}
@@ -0,0 +1,68 @@
+package mapnik
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestGridUTFGrid(t *testing.T) {
+	g := &Grid{
+		Width:  3,
+		Height: 2,
+		Cells:  []int{-1, 0, 0, 1, 1, -1},
+		Keys:   []string{"1", "2"},
+		Data:   map[string]map[string]string{"1": {"name": "a"}, "2": {"name": "b"}},
+	}
+	b, err := g.UTFGrid()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := utfGrid{}
+	if err := json.Unmarshal(b, &u); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{" !!", "## "}; !reflect.DeepEqual(u.Grid, expected) {
+		t.Errorf("unexpected grid %q", u.Grid)
+	}
+	if expected := []string{"", "1", "2"}; !reflect.DeepEqual(u.Keys, expected) {
+		t.Errorf("unexpected keys %q", u.Keys)
+	}
+	if !reflect.DeepEqual(u.Data, g.Data) {
+		t.Errorf("unexpected data %v", u.Data)
+	}
+
+	for id, r := range map[int]rune{0: ' ', 1: '!', 2: '#', 58: '[', 59: ']', 60: '^'} {
+		if c := encodeUTFGridID(id); c != r {
+			t.Errorf("unexpected char %q for %d", c, id)
+		}
+	}
+}
+
+func TestRenderGrid(t *testing.T) {
+	m := New()
+	if err := m.Load("test/map.xml"); err != nil {
+		t.Fatal(err)
+	}
+	m.Resize(360, 180)
+	m.ZoomTo(-180, -90, 180, 90)
+
+	g, err := m.RenderGrid("layerA", GridOpts{Fields: []string{"__id__"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Width != 90 || g.Height != 45 {
+		t.Fatal("unexpected grid size", g.Width, g.Height)
+	}
+	// cell 47/10 (pixel 188/40, 8/50) is inside the polygon of map.geojson
+	if c := g.Cells[10*g.Width+47]; c < 0 || g.Data[g.Keys[c]]["__id__"] == "" {
+		t.Error("expected feature in cell", c, g.Keys, g.Data)
+	}
+	if c := g.Cells[2*g.Width+2]; c != -1 {
+		t.Error("unexpected feature in cell", c)
+	}
+
+	if _, err := m.RenderGrid("unknown", GridOpts{}); err == nil {
+		t.Error("expected error for unknown layer")
+	}
+}
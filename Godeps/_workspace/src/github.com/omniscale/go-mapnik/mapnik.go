@@ -1,17 +1,20 @@
 // Package mapnik renders beautiful maps with Mapnik.
 package mapnik
 
-//go:generate bash ./configure.bash
+//go:generate go run configure.go
 
 // #include <stdlib.h>
 // #include "mapnik_c_api.h"
 import "C"
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"math"
+	"os"
 	"unsafe"
 )
 
@@ -25,23 +28,78 @@ var (
 )
 
 func init() {
+	addDLLDir(dllPath)
 	// register default datasources path and fonts path like the python bindings do
 	RegisterDatasources(pluginPath)
 	RegisterFonts(fontPath)
 }
 
+func registerLastError() error {
+	return errors.New("mapnik: " + C.GoString(C.mapnik_register_last_error()))
+}
+
 // RegisterDatasources adds path to the Mapnik plugin search path.
-func RegisterDatasources(path string) {
+func RegisterDatasources(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("mapnik: unable to register datasources: %s", err)
+	}
+	// plugins are DLLs on Windows, that are loaded with their dependencies
+	// from the same directory
+	addDLLDir(path)
 	cs := C.CString(path)
 	defer C.free(unsafe.Pointer(cs))
-	C.mapnik_register_datasources(cs)
+	if C.mapnik_register_datasources(cs) != 0 {
+		return registerLastError()
+	}
+	return nil
+}
+
+// RegisterFonts adds path to the Mapnik fonts search path.
+func RegisterFonts(path string) error {
+	return registerFonts(path, false)
+}
+
+// RegisterFontsRecursive adds path and all sub directories to the Mapnik
+// fonts search path.
+func RegisterFontsRecursive(path string) error {
+	return registerFonts(path, true)
 }
 
-// RegisterDatasources adds path to the Mapnik fonts search path.
-func RegisterFonts(path string) {
+func registerFonts(path string, recurse bool) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("mapnik: unable to register fonts: %s", err)
+	}
 	cs := C.CString(path)
 	defer C.free(unsafe.Pointer(cs))
-	C.mapnik_register_fonts(cs)
+	r := C.int(0)
+	if recurse {
+		r = 1
+	}
+	if C.mapnik_register_fonts(cs, r) != 0 {
+		return registerLastError()
+	}
+	return nil
+}
+
+// DatasourceNames returns the names of all registered datasource plugins.
+func DatasourceNames() []string {
+	return stringList(C.mapnik_datasource_names())
+}
+
+// FontNames returns the face names of all registered fonts.
+func FontNames() []string {
+	return stringList(C.mapnik_font_names())
+}
+
+// stringList converts and frees l.
+func stringList(l *C.mapnik_string_list_t) []string {
+	defer C.mapnik_string_list_free(l)
+	n := int(C.mapnik_string_list_size(l))
+	result := make([]string, n)
+	for i := 0; i < n; i++ {
+		result[i] = C.GoString(C.mapnik_string_list_get(l, C.size_t(i)))
+	}
+	return result
 }
 
 // LogSeverity sets the global log level for Mapnik. Requires a Mapnik build with logging enabled.
@@ -55,6 +113,9 @@ type Map struct {
 	width       int
 	height      int
 	layerStatus []bool
+	// pending is closed when the render of a cancelled RenderContext or
+	// RenderImageContext finished
+	pending chan struct{}
 }
 
 // New initializes a new Map.
@@ -72,6 +133,7 @@ func (m *Map) lastError() error {
 
 // Load reads in a Mapnik map XML.
 func (m *Map) Load(stylesheet string) error {
+	m.wait()
 	cs := C.CString(stylesheet)
 	defer C.free(unsafe.Pointer(cs))
 	if C.mapnik_map_load(m.m, cs) != 0 {
@@ -80,8 +142,24 @@ func (m *Map) Load(stylesheet string) error {
 	return nil
 }
 
+// LoadString reads in a Mapnik map XML from memory. Relative paths (shapefiles,
+// images, etc.) are resolved against basePath.
+func (m *Map) LoadString(xml []byte, basePath string) error {
+	m.wait()
+	if len(xml) == 0 {
+		return errors.New("mapnik: empty map XML")
+	}
+	cbp := C.CString(basePath)
+	defer C.free(unsafe.Pointer(cbp))
+	if C.mapnik_map_load_string(m.m, (*C.char)(unsafe.Pointer(&xml[0])), C.size_t(len(xml)), cbp) != 0 {
+		return m.lastError()
+	}
+	return nil
+}
+
 // Resize changes the map size in pixel.
 func (m *Map) Resize(width, height int) {
+	m.wait()
 	C.mapnik_map_resize(m.m, C.uint(width), C.uint(height))
 	m.width = width
 	m.height = height
@@ -89,17 +167,20 @@ func (m *Map) Resize(width, height int) {
 
 // Free deallocates the map.
 func (m *Map) Free() {
+	m.wait()
 	C.mapnik_map_free(m.m)
 	m.m = nil
 }
 
 // SRS returns the projection of the map.
 func (m *Map) SRS() string {
+	m.wait()
 	return C.GoString(C.mapnik_map_get_srs(m.m))
 }
 
 // SetSRS sets the projection of the map as a proj4 string ('+init=epsg:4326', etc).
 func (m *Map) SetSRS(srs string) {
+	m.wait()
 	cs := C.CString(srs)
 	defer C.free(unsafe.Pointer(cs))
 	C.mapnik_map_set_srs(m.m, cs)
@@ -107,11 +188,13 @@ func (m *Map) SetSRS(srs string) {
 
 // ScaleDenominator returns the current scale denominator. Call after Resize and ZoomAll/ZoomTo.
 func (m *Map) ScaleDenominator() float64 {
+	m.wait()
 	return float64(C.mapnik_map_get_scale_denominator(m.m))
 }
 
 // ZoomAll zooms to the maximum extent.
 func (m *Map) ZoomAll() error {
+	m.wait()
 	if C.mapnik_map_zoom_all(m.m) != 0 {
 		return m.lastError()
 	}
@@ -120,18 +203,87 @@ func (m *Map) ZoomAll() error {
 
 // ZoomTo zooms to the given bounding box.
 func (m *Map) ZoomTo(minx, miny, maxx, maxy float64) {
+	m.wait()
 	bbox := C.mapnik_bbox(C.double(minx), C.double(miny), C.double(maxx), C.double(maxy))
 	defer C.mapnik_bbox_free(bbox)
 	C.mapnik_map_zoom_to_box(m.m, bbox)
 }
 
+// ZoomToLonLat zooms to the given WGS84 bounding box. The coordinates are
+// transformed into the SRS of the map. Call after Load or SetSRS.
+func (m *Map) ZoomToLonLat(minLon, minLat, maxLon, maxLat float64) error {
+	p, err := m.Projection()
+	if err != nil {
+		return err
+	}
+	defer p.Free()
+
+	// transform all corners, the bbox might be rotated/skewed in the map SRS
+	corners := []Coord{
+		p.Forward(Coord{minLon, minLat}),
+		p.Forward(Coord{minLon, maxLat}),
+		p.Forward(Coord{maxLon, minLat}),
+		p.Forward(Coord{maxLon, maxLat}),
+	}
+	minx, miny := corners[0].X, corners[0].Y
+	maxx, maxy := minx, miny
+	for _, c := range corners[1:] {
+		minx = math.Min(minx, c.X)
+		miny = math.Min(miny, c.Y)
+		maxx = math.Max(maxx, c.X)
+		maxy = math.Max(maxy, c.Y)
+	}
+	m.ZoomTo(minx, miny, maxx, maxy)
+	return nil
+}
+
+// Coord is a single x/y or lon/lat coordinate.
+type Coord struct {
+	X, Y float64
+}
+
+// Projection transforms coordinates between WGS84 and the SRS of a map.
+type Projection struct {
+	p *C.struct__mapnik_projection_t
+}
+
+// Projection returns a Projection for the current SRS of the map.
+// Call Free after use.
+func (m *Map) Projection() (Projection, error) {
+	m.wait()
+	p := C.mapnik_map_projection(m.m)
+	if p == nil {
+		return Projection{}, m.lastError()
+	}
+	return Projection{p: p}, nil
+}
+
+// Free deallocates the projection.
+func (p Projection) Free() {
+	C.mapnik_projection_free(p.p)
+}
+
+// Forward transforms a WGS84 lon/lat coordinate into the map SRS.
+func (p Projection) Forward(c Coord) Coord {
+	r := C.mapnik_projection_forward(p.p, C.mapnik_coord_t{x: C.double(c.X), y: C.double(c.Y)})
+	return Coord{float64(r.x), float64(r.y)}
+}
+
+// Inverse transforms a coordinate in the map SRS into WGS84 lon/lat.
+func (p Projection) Inverse(c Coord) Coord {
+	r := C.mapnik_projection_inverse(p.p, C.mapnik_coord_t{x: C.double(c.X), y: C.double(c.Y)})
+	return Coord{float64(r.x), float64(r.y)}
+}
+
 func (m *Map) BackgroundColor() color.NRGBA {
+	m.wait()
 	c := color.NRGBA{}
 	C.mapnik_map_background(m.m, (*C.uint8_t)(&c.R), (*C.uint8_t)(&c.G), (*C.uint8_t)(&c.B), (*C.uint8_t)(&c.A))
 	return c
 }
 
 func (m *Map) SetBackgroundColor(c color.NRGBA) {
+	m.wait()
 	C.mapnik_map_set_background(m.m, C.uint8_t(c.R), C.uint8_t(c.G), C.uint8_t(c.B), C.uint8_t(c.A))
 }
 
@@ -206,6 +358,7 @@ func (f SelectorFunc) Select(layername string) Status {
 
 // SelectLayers enables/disables single layers. LayerSelector or SelectorFunc gets called for each layer.
 func (m *Map) SelectLayers(selector LayerSelector) {
+	m.wait()
 	m.storeLayerStatus()
 	n := C.mapnik_map_layer_count(m.m)
 	for i := 0; i < int(n); i++ {
@@ -222,14 +375,181 @@ func (m *Map) SelectLayers(selector LayerSelector) {
 
 // ResetLayer resets all layers to the initial status.
 func (m *Map) ResetLayers() {
+	m.wait()
 	m.resetLayerStatus()
 }
 
+// Feature is a single feature returned by FeaturesAt.
+type Feature struct {
+	// Layer is the name of the layer the feature belongs to.
+	Layer string
+	ID    int64
+	// Attributes of the feature. All values are converted to strings.
+	Attributes map[string]string
+}
+
+// FeaturesAt returns all features at the pixel position x/y of the current
+// map view. Only features of the given layers are returned, or of all active
+// layers if layers is empty. Call after Resize and ZoomAll/ZoomTo.
+func (m *Map) FeaturesAt(x, y int, layers []string) ([]Feature, error) {
+	m.wait()
+	var selected map[string]bool
+	if len(layers) > 0 {
+		selected = make(map[string]bool, len(layers))
+		for _, l := range layers {
+			selected[l] = true
+		}
+	}
+
+	var features []Feature
+	n := C.mapnik_map_layer_count(m.m)
+	for i := 0; i < int(n); i++ {
+		layerName := C.GoString(C.mapnik_map_layer_name(m.m, C.size_t(i)))
+		if selected != nil {
+			if !selected[layerName] {
+				continue
+			}
+		} else if C.mapnik_map_layer_is_active(m.m, C.size_t(i)) == 0 {
+			continue
+		}
+
+		r := C.mapnik_map_query_point(m.m, C.size_t(i), C.double(x), C.double(y))
+		if r == nil {
+			return nil, m.lastError()
+		}
+		features = append(features, queryResultFeatures(r, layerName)...)
+		C.mapnik_query_result_free(r)
+	}
+	return features, nil
+}
+
+func queryResultFeatures(r *C.mapnik_query_result_t, layerName string) []Feature {
+	n := int(C.mapnik_query_result_feature_count(r))
+	features := make([]Feature, 0, n)
+	for fi := 0; fi < n; fi++ {
+		f := Feature{
+			Layer:      layerName,
+			ID:         int64(C.mapnik_query_result_feature_id(r, C.size_t(fi))),
+			Attributes: make(map[string]string),
+		}
+		na := int(C.mapnik_query_result_attribute_count(r, C.size_t(fi)))
+		for ai := 0; ai < na; ai++ {
+			name := C.GoString(C.mapnik_query_result_attribute_name(r, C.size_t(fi), C.size_t(ai)))
+			f.Attributes[name] = C.GoString(C.mapnik_query_result_attribute_value(r, C.size_t(fi), C.size_t(ai)))
+		}
+		features = append(features, f)
+	}
+	return features
+}
+
+// GridOpts defines options for RenderGrid.
+type GridOpts struct {
+	// Key is the attribute that identifies the features of the grid.
+	// Defaults to __id__, the feature ID.
+	Key string
+	// Fields are the attributes included in Grid.Data. __id__ is the
+	// feature ID.
+	Fields []string
+	// Resolution is the size of each grid cell in pixels. Defaults to 4.
+	Resolution int
+	// ScaleFactor of the render, see RenderOpts.
+	ScaleFactor float64
+}
+
+// RenderGrid renders the hit grid of a single layer of the current map view,
+// e.g. for UTFGrid. Requires Mapnik with grid renderer. Call after Resize
+// and ZoomAll/ZoomTo.
+func (m *Map) RenderGrid(layer string, opts GridOpts) (*Grid, error) {
+	m.wait()
+	return m.renderGrid(layer, opts)
+}
+
+// RenderGridContext is like RenderGrid, but returns the error of ctx if ctx
+// is done before the grid is rendered (see RenderContext).
+func (m *Map) RenderGridContext(ctx context.Context, layer string, opts GridOpts) (*Grid, error) {
+	var g *Grid
+	var err error
+	if cerr := m.background(ctx, func() { g, err = m.renderGrid(layer, opts) }); cerr != nil {
+		return nil, cerr
+	}
+	return g, err
+}
+
+func (m *Map) renderGrid(layer string, opts GridOpts) (*Grid, error) {
+	idx := -1
+	n := int(C.mapnik_map_layer_count(m.m))
+	for i := 0; i < n; i++ {
+		if C.GoString(C.mapnik_map_layer_name(m.m, C.size_t(i))) == layer {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("mapnik: unknown layer %s", layer)
+	}
+
+	key := opts.Key
+	if key == "" {
+		key = "__id__"
+	}
+	resolution := opts.Resolution
+	if resolution <= 0 {
+		resolution = 4
+	}
+	scaleFactor := opts.ScaleFactor
+	if scaleFactor == 0.0 {
+		scaleFactor = 1.0
+	}
+
+	ckey := C.CString(key)
+	defer C.free(unsafe.Pointer(ckey))
+	cfields := make([]*C.char, len(opts.Fields)+1)
+	for i, f := range opts.Fields {
+		cfields[i] = C.CString(f)
+		defer C.free(unsafe.Pointer(cfields[i]))
+	}
+
+	g := C.mapnik_map_render_grid(m.m, C.size_t(idx), ckey, &cfields[0], C.size_t(len(opts.Fields)),
+		C.uint(resolution), C.double(scaleFactor))
+	if g == nil {
+		return nil, m.lastError()
+	}
+	defer C.mapnik_grid_free(g)
+
+	grid := &Grid{
+		Width:  int(C.mapnik_grid_width(g)),
+		Height: int(C.mapnik_grid_height(g)),
+		Data:   make(map[string]map[string]string),
+	}
+	grid.Cells = make([]int, grid.Width*grid.Height)
+	if len(grid.Cells) > 0 {
+		cells := (*[1 << 30]C.int32_t)(unsafe.Pointer(C.mapnik_grid_cells(g)))[:len(grid.Cells):len(grid.Cells)]
+		for i, c := range cells {
+			grid.Cells[i] = int(c)
+		}
+	}
+	nk := int(C.mapnik_grid_key_count(g))
+	for ki := 0; ki < nk; ki++ {
+		k := C.GoString(C.mapnik_grid_key(g, C.size_t(ki)))
+		grid.Keys = append(grid.Keys, k)
+		attrs := make(map[string]string)
+		na := int(C.mapnik_grid_attribute_count(g, C.size_t(ki)))
+		for ai := 0; ai < na; ai++ {
+			name := C.GoString(C.mapnik_grid_attribute_name(g, C.size_t(ki), C.size_t(ai)))
+			attrs[name] = C.GoString(C.mapnik_grid_attribute_value(g, C.size_t(ki), C.size_t(ai)))
+		}
+		grid.Data[k] = attrs
+	}
+	return grid, nil
+}
+
 func (m *Map) SetMaxExtent(minx, miny, maxx, maxy float64) {
+	m.wait()
 	C.mapnik_map_set_maximum_extent(m.m, C.double(minx), C.double(miny), C.double(maxx), C.double(maxy))
 }
 
 func (m *Map) ResetMaxExtent() {
+	m.wait()
 	C.mapnik_map_reset_maximum_extent(m.m)
 }
 
@@ -239,17 +559,80 @@ type RenderOpts struct {
 	Scale float64
 	// ScaleFactor renders the map with larger fonts sizes, line width, etc. For printing or retina/hq iamges.
 	ScaleFactor float64
-	// Format for the rendered image ('jpeg80', 'png256', etc. see: https://github.com/mapnik/mapnik/wiki/Image-IO)
+	// Format for the rendered image ('jpeg80', 'png256', 'webp' if Mapnik was compiled with WebP support, etc. see: https://github.com/mapnik/mapnik/wiki/Image-IO)
 	Format string
+	// Variables are available as @name in style expressions. Values need to
+	// be string, int, int64, float64 or bool. Requires Mapnik 3.
+	Variables map[string]interface{}
+}
+
+// variables converts vars for the C API. Returns nil for empty vars.
+// Call mapnik_variables_free after use.
+func variables(vars map[string]interface{}) (*C.mapnik_variables_t, error) {
+	if len(vars) == 0 {
+		return nil, nil
+	}
+	v := C.mapnik_variables()
+	for name, value := range vars {
+		cname := C.CString(name)
+		switch value := value.(type) {
+		case string:
+			cs := C.CString(value)
+			C.mapnik_variables_set_string(v, cname, cs)
+			C.free(unsafe.Pointer(cs))
+		case int:
+			C.mapnik_variables_set_int(v, cname, C.int64_t(value))
+		case int64:
+			C.mapnik_variables_set_int(v, cname, C.int64_t(value))
+		case float64:
+			C.mapnik_variables_set_double(v, cname, C.double(value))
+		case bool:
+			b := C.int(0)
+			if value {
+				b = 1
+			}
+			C.mapnik_variables_set_bool(v, cname, b)
+		default:
+			C.free(unsafe.Pointer(cname))
+			C.mapnik_variables_free(v)
+			return nil, fmt.Errorf("mapnik: unsupported type %T for variable %s", value, name)
+		}
+		C.free(unsafe.Pointer(cname))
+	}
+	return v, nil
 }
 
 // Render returns the map as an encoded image.
 func (m *Map) Render(opts RenderOpts) ([]byte, error) {
+	m.wait()
+	return m.render(opts)
+}
+
+// RenderContext is like Render, but returns the error of ctx if ctx is done
+// before the map is rendered. Mapnik renders can not be interrupted. The
+// render continues in the background and its result is discarded. All
+// methods of the map block until the background render finished, use Busy
+// to check whether the map is still rendering.
+func (m *Map) RenderContext(ctx context.Context, opts RenderOpts) ([]byte, error) {
+	var b []byte
+	var err error
+	if cerr := m.background(ctx, func() { b, err = m.render(opts) }); cerr != nil {
+		return nil, cerr
+	}
+	return b, err
+}
+
+func (m *Map) render(opts RenderOpts) ([]byte, error) {
 	scaleFactor := opts.ScaleFactor
 	if scaleFactor == 0.0 {
 		scaleFactor = 1.0
 	}
-	i := C.mapnik_map_render_to_image(m.m, C.double(opts.Scale), C.double(scaleFactor))
+	vars, err := variables(opts.Variables)
+	if err != nil {
+		return nil, err
+	}
+	defer C.mapnik_variables_free(vars)
+	i := C.mapnik_map_render_to_image(m.m, vars, C.double(opts.Scale), C.double(scaleFactor))
 	if i == nil {
 		return nil, m.lastError()
 	}
@@ -276,32 +659,117 @@ func (m *Map) Render(opts RenderOpts) ([]byte, error) {
 
 // RenderImage returns the map as an unencoded image.Image.
 func (m *Map) RenderImage(opts RenderOpts) (*image.NRGBA, error) {
+	m.wait()
+	img := image.NewNRGBA(image.Rect(0, 0, m.width, m.height))
+	if err := m.renderInto(img, opts); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// RenderImageContext is like RenderImage, but returns the error of ctx if
+// ctx is done before the map is rendered (see RenderContext).
+func (m *Map) RenderImageContext(ctx context.Context, opts RenderOpts) (*image.NRGBA, error) {
+	img := image.NewNRGBA(image.Rect(0, 0, m.width, m.height))
+	var err error
+	if cerr := m.background(ctx, func() { err = m.renderInto(img, opts) }); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// background runs render in a new goroutine and waits till it finished or
+// till ctx is done. The render is pending if ctx is done first.
+func (m *Map) background(ctx context.Context, render func()) error {
+	m.wait()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		render()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		m.pending = done
+		return ctx.Err()
+	}
+}
+
+// Busy returns whether the render of a cancelled RenderContext or
+// RenderImageContext is still running.
+func (m *Map) Busy() bool {
+	if m.pending == nil {
+		return false
+	}
+	select {
+	case <-m.pending:
+		m.pending = nil
+		return false
+	default:
+		return true
+	}
+}
+
+// wait blocks until a pending render finished.
+func (m *Map) wait() {
+	if m.pending != nil {
+		<-m.pending
+		m.pending = nil
+	}
+}
+
+// RenderInto renders the map into the existing img. img needs to be of the
+// same size as the map. With Mapnik 3, the map is rendered directly into the
+// pixels of img. Mapnik 2 and sub-images (with a larger stride) are rendered
+// into an image of Mapnik that is copied into img. This image is kept between
+// calls, so repeated renders of the same size do not allocate new buffers.
+func (m *Map) RenderInto(img *image.NRGBA, opts RenderOpts) error {
+	m.wait()
+	return m.renderInto(img, opts)
+}
+
+func (m *Map) renderInto(img *image.NRGBA, opts RenderOpts) error {
+	if img.Rect.Dx() != m.width || img.Rect.Dy() != m.height {
+		return fmt.Errorf("mapnik: image size %dx%d does not match map size %dx%d",
+			img.Rect.Dx(), img.Rect.Dy(), m.width, m.height)
+	}
 	scaleFactor := opts.ScaleFactor
 	if scaleFactor == 0.0 {
 		scaleFactor = 1.0
 	}
-	i := C.mapnik_map_render_to_image(m.m, C.double(opts.Scale), C.double(scaleFactor))
-	if i == nil {
-		return nil, m.lastError()
+	vars, err := variables(opts.Variables)
+	if err != nil {
+		return err
 	}
-	defer C.mapnik_image_free(i)
-	size := 0
-	raw := C.mapnik_image_to_raw(i, (*C.size_t)(unsafe.Pointer(&size)))
-	b := C.GoBytes(unsafe.Pointer(raw), C.int(size))
-	img := &image.NRGBA{
-		Pix:    b,
-		Stride: int(m.width * 4),
-		Rect:   image.Rect(0, 0, int(m.width), int(m.height)),
+	defer C.mapnik_variables_free(vars)
+	buf := img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y):]
+	if C.mapnik_map_render_into(m.m, vars,
+		(*C.uint8_t)(unsafe.Pointer(&buf[0])), C.size_t(img.Stride),
+		C.double(opts.Scale), C.double(scaleFactor)) != 0 {
+		return m.lastError()
 	}
-	return img, nil
+	return nil
 }
 
 // RenderToFile writes the map as an encoded image to the file system.
 func (m *Map) RenderToFile(opts RenderOpts, path string) error {
+	m.wait()
 	scaleFactor := opts.ScaleFactor
 	if scaleFactor == 0.0 {
 		scaleFactor = 1.0
 	}
+	vars, err := variables(opts.Variables)
+	if err != nil {
+		return err
+	}
+	defer C.mapnik_variables_free(vars)
 	cs := C.CString(path)
 	defer C.free(unsafe.Pointer(cs))
 	var format *C.char
@@ -311,7 +779,7 @@ func (m *Map) RenderToFile(opts RenderOpts, path string) error {
 		format = C.CString("png256")
 	}
 	defer C.free(unsafe.Pointer(format))
-	if C.mapnik_map_render_to_file(m.m, cs, C.double(opts.Scale), C.double(scaleFactor), format) != 0 {
+	if C.mapnik_map_render_to_file(m.m, vars, cs, C.double(opts.Scale), C.double(scaleFactor), format) != 0 {
 		return m.lastError()
 	}
 	return nil
@@ -319,6 +787,7 @@ func (m *Map) RenderToFile(opts RenderOpts, path string) error {
 
 // SetBufferSize sets the pixel buffer at the map image edges where Mapnik should not render any labels.
 func (m *Map) SetBufferSize(s int) {
+	m.wait()
 	C.mapnik_map_set_buffer_size(m.m, C.int(s))
 }
 
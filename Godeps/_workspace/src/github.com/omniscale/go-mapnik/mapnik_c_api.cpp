@@ -3,18 +3,73 @@
 
 #include <mapnik/debug.hpp>
 #include <mapnik/version.hpp>
+#if MAPNIK_VERSION >= 300000
+#include <mapnik/image.hpp>
+#include <mapnik/attribute.hpp>
+#include <mapnik/request.hpp>
+#else
 #include <mapnik/graphics.hpp>
+#endif
 #include <mapnik/color.hpp>
 #include <mapnik/image_util.hpp>
 #include <mapnik/agg_renderer.hpp>
 #include <mapnik/load_map.hpp>
 #include <mapnik/datasource_cache.hpp>
 #include <mapnik/font_engine_freetype.hpp>
+#include <mapnik/projection.hpp>
+#include <mapnik/feature.hpp>
+#include <mapnik/featureset.hpp>
+#include <mapnik/feature_kv_iterator.hpp>
+#include <mapnik/value.hpp>
+#if MAPNIK_VERSION < 300000 || defined(GRID_RENDERER)
+#include <mapnik/grid/grid.hpp>
+#include <mapnik/grid/grid_renderer.hpp>
+#endif
+
+#include <map>
+#include <set>
+#include <stdexcept>
+#include <vector>
+#include <utility>
 
 #include "mapnik_c_api.h"
 
 #include <stdlib.h>
 
+// image_32 was replaced by image_rgba8 in Mapnik 3
+#if MAPNIK_VERSION >= 300000
+typedef mapnik::image_rgba8 mapnik_rgba_image;
+#else
+typedef mapnik::image_32 mapnik_rgba_image;
+#endif
+
+// returns the pixels of im as RGBA bytes
+static inline uint8_t * image_bytes(mapnik_rgba_image & im) {
+#if MAPNIK_VERSION >= 300000
+    return im.bytes();
+#else
+    return im.raw_data();
+#endif
+}
+
+// sets all pixels of im to transparent
+static inline void image_clear(mapnik_rgba_image & im) {
+#if MAPNIK_VERSION >= 300000
+    im.set(0);
+#else
+    im.data().set(0);
+#endif
+}
+
+// getLayer was renamed to get_layer in Mapnik 3
+static inline mapnik::layer & map_layer(mapnik::Map & m, size_t idx) {
+#if MAPNIK_VERSION >= 300000
+    return m.get_layer(idx);
+#else
+    return m.getLayer(idx);
+#endif
+}
+
 #ifdef __cplusplus
 extern "C"
 {
@@ -44,10 +99,10 @@ int mapnik_register_datasources(const char* path) {
     }
 }
 
-int mapnik_register_fonts(const char* path) {
+int mapnik_register_fonts(const char* path, int recurse) {
     mapnik_register_reset_last_error();
     try {
-        mapnik::freetype_engine::register_fonts(path);
+        mapnik::freetype_engine::register_fonts(path, recurse != 0);
         return 0;
     } catch (std::exception const& ex) {
         register_err = new std::string(ex.what());
@@ -62,6 +117,46 @@ const char *mapnik_register_last_error() {
     return NULL;
 }
 
+struct _mapnik_string_list_t {
+    std::vector<std::string> l;
+};
+
+void mapnik_string_list_free(mapnik_string_list_t * l) {
+    if (l) {
+        delete l;
+    }
+}
+
+size_t mapnik_string_list_size(mapnik_string_list_t * l) {
+    if (l) {
+        return l->l.size();
+    }
+    return 0;
+}
+
+const char * mapnik_string_list_get(mapnik_string_list_t * l, size_t idx) {
+    if (l && idx < l->l.size()) {
+        return l->l[idx].c_str();
+    }
+    return NULL;
+}
+
+mapnik_string_list_t * mapnik_datasource_names() {
+    mapnik_string_list_t * l = new mapnik_string_list_t;
+#if MAPNIK_VERSION >= 200200
+    l->l = mapnik::datasource_cache::instance().plugin_names();
+#else
+    l->l = mapnik::datasource_cache::instance()->plugin_names();
+#endif
+    return l;
+}
+
+mapnik_string_list_t * mapnik_font_names() {
+    mapnik_string_list_t * l = new mapnik_string_list_t;
+    l->l = mapnik::freetype_engine::face_names();
+    return l;
+}
+
 void mapnik_logging_set_severity(int level) {
     mapnik::logger::severity_type severity;
     switch (level) {
@@ -84,12 +179,16 @@ void mapnik_logging_set_severity(int level) {
 struct _mapnik_map_t {
     mapnik::Map * m;
     std::string * err;
+    // reused by mapnik_map_render_into, if it can not render into the
+    // buffer of the caller
+    mapnik_rgba_image * i;
 };
 
 mapnik_map_t * mapnik_map(unsigned width, unsigned height) {
     mapnik_map_t * map = new mapnik_map_t;
     map->m = new mapnik::Map(width, height);
     map->err = NULL;
+    map->i = NULL;
     return map;
 }
 
@@ -101,6 +200,9 @@ void mapnik_map_free(mapnik_map_t * m) {
         if (m->err) {
             delete m->err;
         }
+        if (m->i) {
+            delete m->i;
+        }
         delete m;
     }
 }
@@ -148,6 +250,20 @@ int mapnik_map_load(mapnik_map_t * m, const char* stylesheet) {
     return -1;
 }
 
+int mapnik_map_load_string(mapnik_map_t * m, const char* s, size_t len, const char* base_path) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+        try {
+            mapnik::load_map_string(*m->m, std::string(s, len), false, base_path);
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+            return -1;
+        }
+        return 0;
+    }
+    return -1;
+}
+
 int mapnik_map_zoom_all(mapnik_map_t * m) {
     mapnik_map_reset_last_error(m);
     if (m && m->m) {
@@ -204,7 +320,7 @@ void mapnik_map_zoom_to_box(mapnik_map_t * m, mapnik_bbox_t * b) {
 }
 
 struct _mapnik_image_t {
-    mapnik::image_32 *i;
+    mapnik_rgba_image *i;
     std::string * err;
 };
 
@@ -234,17 +350,76 @@ const char *mapnik_image_last_error(mapnik_image_t *i) {
     return NULL;
 }
 
-mapnik_image_t * mapnik_map_render_to_image(mapnik_map_t * m, double scale, double scale_factor) {
+struct _mapnik_variables_t {
+    std::map<std::string, mapnik::value> v;
+};
+
+mapnik_variables_t * mapnik_variables() {
+    return new mapnik_variables_t;
+}
+
+void mapnik_variables_free(mapnik_variables_t * v) {
+    if (v) {
+        delete v;
+    }
+}
+
+void mapnik_variables_set_string(mapnik_variables_t * v, const char * name, const char * value) {
+    if (v) {
+        v->v[name] = mapnik::value(mapnik::value_unicode_string::fromUTF8(value));
+    }
+}
+
+void mapnik_variables_set_int(mapnik_variables_t * v, const char * name, int64_t value) {
+    if (v) {
+        v->v[name] = mapnik::value(static_cast<mapnik::value_integer>(value));
+    }
+}
+
+void mapnik_variables_set_double(mapnik_variables_t * v, const char * name, double value) {
+    if (v) {
+        v->v[name] = mapnik::value(static_cast<mapnik::value_double>(value));
+    }
+}
+
+void mapnik_variables_set_bool(mapnik_variables_t * v, const char * name, int value) {
+    if (v) {
+        v->v[name] = mapnik::value(static_cast<mapnik::value_bool>(value != 0));
+    }
+}
+
+// render m into im, throws on errors
+static void render(mapnik_map_t * m, mapnik_rgba_image & im, mapnik_variables_t * vars, double scale, double scale_factor) {
+#if MAPNIK_VERSION >= 300000
+    // variables are only passed with a request for the current map view
+    mapnik::request req(m->m->width(), m->m->height(), m->m->get_current_extent());
+    req.set_buffer_size(m->m->buffer_size());
+    mapnik::attributes attrs;
+    if (vars) {
+        for (auto const& v : vars->v) {
+            attrs[v.first] = v.second;
+        }
+    }
+    mapnik::agg_renderer<mapnik_rgba_image> ren(*m->m, req, attrs, im, scale_factor);
+#else
+    if (vars && !vars->v.empty()) {
+        throw std::runtime_error("render variables require Mapnik 3");
+    }
+    mapnik::agg_renderer<mapnik_rgba_image> ren(*m->m, im, scale_factor);
+#endif
+    if (scale > 0.0) {
+        ren.apply(scale);
+    } else {
+        ren.apply();
+    }
+}
+
+mapnik_image_t * mapnik_map_render_to_image(mapnik_map_t * m, mapnik_variables_t * vars, double scale, double scale_factor) {
     mapnik_map_reset_last_error(m);
-    mapnik::image_32 * im = new mapnik::image_32(m->m->width(), m->m->height());
+    mapnik_rgba_image * im = new mapnik_rgba_image(m->m->width(), m->m->height());
     if (m && m->m) {
         try {
-            mapnik::agg_renderer<mapnik::image_32> ren(*m->m, *im, scale_factor);
-            if (scale > 0.0) {
-                ren.apply(scale);
-            } else {
-                ren.apply();
-            }
+            render(m, *im, vars, scale, scale_factor);
         } catch (std::exception const& ex) {
             delete im;
             m->err = new std::string(ex.what());
@@ -257,17 +432,57 @@ mapnik_image_t * mapnik_map_render_to_image(mapnik_map_t * m, double scale, doub
     return i;
 }
 
-int mapnik_map_render_to_file(mapnik_map_t * m, const char* filepath, double scale, double scale_factor, const char *format) {
+int mapnik_map_render_into(mapnik_map_t * m, mapnik_variables_t * vars, uint8_t * buf, size_t stride, double scale, double scale_factor) {
     mapnik_map_reset_last_error(m);
     if (m && m->m) {
+        unsigned width = m->m->width();
+        unsigned height = m->m->height();
+        size_t row = width * 4;
         try {
-            mapnik::image_32 buf(m->m->width(), m->m->height());
-            mapnik::agg_renderer<mapnik::image_32> ren(*m->m, buf, scale_factor);
-            if (scale > 0.0) {
-                ren.apply(scale);
+#if MAPNIK_VERSION >= 300000
+            if (stride == row) {
+                // render directly into buf, the image does not own the data
+                mapnik_rgba_image im(width, height, buf);
+                image_clear(im);
+                render(m, im, vars, scale, scale_factor);
+                return 0;
+            }
+#endif
+            if (m->i && (m->i->width() != width || m->i->height() != height)) {
+                delete m->i;
+                m->i = NULL;
+            }
+            if (m->i) {
+                image_clear(*m->i);
             } else {
-                ren.apply();
+                m->i = new mapnik_rgba_image(width, height);
             }
+            render(m, *m->i, vars, scale, scale_factor);
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+            return -1;
+        }
+        // image_32 of Mapnik 2 can not wrap buf and Mapnik images can not
+        // wrap rows with a larger stride (sub-images), copy the rendered rows
+        const uint8_t * raw = image_bytes(*m->i);
+        if (stride == row) {
+            memcpy(buf, raw, row * height);
+        } else {
+            for (unsigned y = 0; y < height; y++) {
+                memcpy(buf + y * stride, raw + y * row, row);
+            }
+        }
+        return 0;
+    }
+    return -1;
+}
+
+int mapnik_map_render_to_file(mapnik_map_t * m, mapnik_variables_t * vars, const char* filepath, double scale, double scale_factor, const char *format) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+        try {
+            mapnik_rgba_image buf(m->m->width(), m->m->height());
+            render(m, buf, vars, scale, scale_factor);
             mapnik::save_to_file(buf, filepath, format);
         } catch (std::exception const& ex) {
             m->err = new std::string(ex.what());
@@ -310,19 +525,61 @@ mapnik_image_blob_t * mapnik_image_to_blob(mapnik_image_t * i, const char *forma
 const uint8_t * mapnik_image_to_raw(mapnik_image_t * i, size_t * size) {
     if (i && i->i) {
         *size = i->i->width() * i->i->height() * 4;
-        return i->i->raw_data();
+        return image_bytes(*i->i);
     }
     return NULL;
 }
 
 mapnik_image_t * mapnik_image_from_raw(const uint8_t * raw, int width, int height) {
     mapnik_image_t * img = new mapnik_image_t;
-    img->i = new mapnik::image_32(width, height);
+    img->i = new mapnik_rgba_image(width, height);
     img->err = NULL;
-    memcpy(img->i->raw_data(), raw, width * height * 4);
+    memcpy(image_bytes(*img->i), raw, width * height * 4);
     return img;
 }
 
+struct _mapnik_projection_t {
+    mapnik::projection * p;
+};
+
+mapnik_projection_t * mapnik_map_projection(mapnik_map_t *m) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+        try {
+            mapnik::projection * p = new mapnik::projection(m->m->srs());
+            mapnik_projection_t * proj = new mapnik_projection_t;
+            proj->p = p;
+            return proj;
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+        }
+    }
+    return NULL;
+}
+
+void mapnik_projection_free(mapnik_projection_t *p) {
+    if (p) {
+        if (p->p) {
+            delete p->p;
+        }
+        delete p;
+    }
+}
+
+mapnik_coord_t mapnik_projection_forward(mapnik_projection_t *p, mapnik_coord_t c) {
+    if (p && p->p) {
+        p->p->forward(c.x, c.y);
+    }
+    return c;
+}
+
+mapnik_coord_t mapnik_projection_inverse(mapnik_projection_t *p, mapnik_coord_t c) {
+    if (p && p->p) {
+        p->p->inverse(c.x, c.y);
+    }
+    return c;
+}
+
 int mapnik_map_layer_count(mapnik_map_t * m) {
     if (m && m->m) {
         return m->m->layer_count();
@@ -332,7 +589,7 @@ int mapnik_map_layer_count(mapnik_map_t * m) {
 
 const char * mapnik_map_layer_name(mapnik_map_t * m, size_t idx) {
     if (m && m->m) {
-        mapnik::layer const& layer = m->m->getLayer(idx);
+        mapnik::layer const& layer = map_layer(*m->m, idx);
         return layer.name().c_str();
     }
     return NULL;
@@ -340,7 +597,7 @@ const char * mapnik_map_layer_name(mapnik_map_t * m, size_t idx) {
 
 int mapnik_map_layer_is_active(mapnik_map_t * m, size_t idx) {
     if (m && m->m) {
-        mapnik::layer const& layer = m->m->getLayer(idx);
+        mapnik::layer const& layer = map_layer(*m->m, idx);
         return layer.active();
     }
     return 0;
@@ -348,11 +605,254 @@ int mapnik_map_layer_is_active(mapnik_map_t * m, size_t idx) {
 
 void mapnik_map_layer_set_active(mapnik_map_t * m, size_t idx, int active) {
     if (m && m->m) {
-        mapnik::layer &layer = m->m->getLayer(idx);
+        mapnik::layer &layer = map_layer(*m->m, idx);
         layer.set_active(active);
     }
 }
 
+typedef std::vector<std::pair<std::string, std::string> > query_attributes;
+
+struct _mapnik_query_result_t {
+    std::vector<int64_t> ids;
+    std::vector<query_attributes> attrs;
+};
+
+mapnik_query_result_t * mapnik_map_query_point(mapnik_map_t * m, size_t idx, double x, double y) {
+    mapnik_map_reset_last_error(m);
+    if (m && m->m) {
+        try {
+            mapnik::featureset_ptr fs = m->m->query_map_point(idx, x, y);
+            mapnik_query_result_t * r = new mapnik_query_result_t;
+            if (!fs) {
+                return r;
+            }
+            mapnik::feature_ptr feat;
+            while ((feat = fs->next())) {
+                query_attributes attrs;
+                mapnik::feature_kv_iterator itr = feat->begin();
+                mapnik::feature_kv_iterator end = feat->end();
+                for (; itr != end; ++itr) {
+#if MAPNIK_VERSION >= 300000
+                    attrs.push_back(std::make_pair(std::get<0>(*itr), std::get<1>(*itr).to_string()));
+#else
+                    attrs.push_back(std::make_pair(boost::get<0>(*itr), boost::get<1>(*itr).to_string()));
+#endif
+                }
+                r->ids.push_back(feat->id());
+                r->attrs.push_back(attrs);
+            }
+            return r;
+        } catch (std::exception const& ex) {
+            m->err = new std::string(ex.what());
+        }
+    }
+    return NULL;
+}
+
+void mapnik_query_result_free(mapnik_query_result_t * r) {
+    if (r) {
+        delete r;
+    }
+}
+
+size_t mapnik_query_result_feature_count(mapnik_query_result_t * r) {
+    if (r) {
+        return r->ids.size();
+    }
+    return 0;
+}
+
+int64_t mapnik_query_result_feature_id(mapnik_query_result_t * r, size_t feature) {
+    if (r && feature < r->ids.size()) {
+        return r->ids[feature];
+    }
+    return 0;
+}
+
+size_t mapnik_query_result_attribute_count(mapnik_query_result_t * r, size_t feature) {
+    if (r && feature < r->attrs.size()) {
+        return r->attrs[feature].size();
+    }
+    return 0;
+}
+
+const char * mapnik_query_result_attribute_name(mapnik_query_result_t * r, size_t feature, size_t attr) {
+    if (r && feature < r->attrs.size() && attr < r->attrs[feature].size()) {
+        return r->attrs[feature][attr].first.c_str();
+    }
+    return NULL;
+}
+
+const char * mapnik_query_result_attribute_value(mapnik_query_result_t * r, size_t feature, size_t attr) {
+    if (r && feature < r->attrs.size() && attr < r->attrs[feature].size()) {
+        return r->attrs[feature][attr].second.c_str();
+    }
+    return NULL;
+}
+
+struct _mapnik_grid_t {
+    size_t width;
+    size_t height;
+    // index in keys for each cell, -1 for cells without feature
+    std::vector<int32_t> cells;
+    std::vector<std::string> keys;
+    std::vector<query_attributes> attrs;
+};
+
+mapnik_grid_t * mapnik_map_render_grid(mapnik_map_t * m, size_t idx, const char * key, const char ** fields, size_t nfields, unsigned int resolution, double scale_factor) {
+    mapnik_map_reset_last_error(m);
+    if (!m || !m->m) {
+        return NULL;
+    }
+#if MAPNIK_VERSION >= 300000 && !defined(GRID_RENDERER)
+    m->err = new std::string("Mapnik was compiled without grid renderer");
+    return NULL;
+#else
+    try {
+        if (idx >= m->m->layers().size()) {
+            throw std::runtime_error("invalid layer index");
+        }
+        if (resolution == 0) {
+            resolution = 1;
+        }
+        unsigned width = m->m->width();
+        unsigned height = m->m->height();
+#if MAPNIK_VERSION >= 300000
+        mapnik::grid grid(width, height, key);
+#else
+        mapnik::grid grid(width, height, key, 1);
+#endif
+        std::set<std::string> attributes;
+        for (size_t i = 0; i < nfields; i++) {
+            grid.add_field(fields[i]);
+            if (mapnik::grid::id_name_ != fields[i]) {
+                attributes.insert(fields[i]);
+            }
+        }
+        if (grid.get_key() != mapnik::grid::id_name_) {
+            attributes.insert(grid.get_key());
+        }
+        mapnik::grid_renderer<mapnik::grid> ren(*m->m, grid, scale_factor);
+        ren.apply(m->m->layers()[idx], attributes);
+
+        mapnik_grid_t * g = new mapnik_grid_t;
+        g->width = (width + resolution - 1) / resolution;
+        g->height = (height + resolution - 1) / resolution;
+        g->cells.reserve(g->width * g->height);
+
+        // the grid contains the feature values, look up their keys
+        mapnik::grid::feature_key_type const& feature_keys = grid.get_feature_keys();
+        std::map<std::string, int32_t> key_idx;
+        for (unsigned y = 0; y < height; y += resolution) {
+#if MAPNIK_VERSION >= 300000
+            mapnik::grid::value_type const * row = grid.data().get_row(y);
+#else
+            mapnik::grid::value_type const * row = grid.data().getRow(y);
+#endif
+            for (unsigned x = 0; x < width; x += resolution) {
+                int32_t cell = -1;
+                mapnik::grid::feature_key_type::const_iterator pos = feature_keys.find(row[x]);
+                if (pos != feature_keys.end() && !pos->second.empty()) {
+                    std::map<std::string, int32_t>::const_iterator k = key_idx.find(pos->second);
+                    if (k == key_idx.end()) {
+                        cell = g->keys.size();
+                        key_idx[pos->second] = cell;
+                        g->keys.push_back(pos->second);
+                    } else {
+                        cell = k->second;
+                    }
+                }
+                g->cells.push_back(cell);
+            }
+        }
+
+        mapnik::grid::feature_type const& features = grid.get_grid_features();
+        for (size_t i = 0; i < g->keys.size(); i++) {
+            query_attributes attrs;
+            mapnik::grid::feature_type::const_iterator f = features.find(g->keys[i]);
+            if (f != features.end()) {
+                mapnik::feature_ptr feat = f->second;
+                for (size_t fi = 0; fi < nfields; fi++) {
+                    std::string name(fields[fi]);
+                    if (name == mapnik::grid::id_name_) {
+                        attrs.push_back(std::make_pair(name, mapnik::value(feat->id()).to_string()));
+                    } else if (feat->has_key(name)) {
+                        attrs.push_back(std::make_pair(name, feat->get(name).to_string()));
+                    }
+                }
+            }
+            g->attrs.push_back(attrs);
+        }
+        return g;
+    } catch (std::exception const& ex) {
+        m->err = new std::string(ex.what());
+    }
+    return NULL;
+#endif
+}
+
+void mapnik_grid_free(mapnik_grid_t * g) {
+    if (g) {
+        delete g;
+    }
+}
+
+size_t mapnik_grid_width(mapnik_grid_t * g) {
+    if (g) {
+        return g->width;
+    }
+    return 0;
+}
+
+size_t mapnik_grid_height(mapnik_grid_t * g) {
+    if (g) {
+        return g->height;
+    }
+    return 0;
+}
+
+const int32_t * mapnik_grid_cells(mapnik_grid_t * g) {
+    if (g && !g->cells.empty()) {
+        return &g->cells[0];
+    }
+    return NULL;
+}
+
+size_t mapnik_grid_key_count(mapnik_grid_t * g) {
+    if (g) {
+        return g->keys.size();
+    }
+    return 0;
+}
+
+const char * mapnik_grid_key(mapnik_grid_t * g, size_t key) {
+    if (g && key < g->keys.size()) {
+        return g->keys[key].c_str();
+    }
+    return NULL;
+}
+
+size_t mapnik_grid_attribute_count(mapnik_grid_t * g, size_t key) {
+    if (g && key < g->attrs.size()) {
+        return g->attrs[key].size();
+    }
+    return 0;
+}
+
+const char * mapnik_grid_attribute_name(mapnik_grid_t * g, size_t key, size_t attr) {
+    if (g && key < g->attrs.size() && attr < g->attrs[key].size()) {
+        return g->attrs[key][attr].first.c_str();
+    }
+    return NULL;
+}
+
+const char * mapnik_grid_attribute_value(mapnik_grid_t * g, size_t key, size_t attr) {
+    if (g && key < g->attrs.size() && attr < g->attrs[key].size()) {
+        return g->attrs[key][attr].second.c_str();
+    }
+    return NULL;
+}
+
 int mapnik_map_background(mapnik_map_t * m, uint8_t *r, uint8_t *g, uint8_t *b, uint8_t *a) {
     if (m && m->m) {
         boost::optional<mapnik::color> const &bg = m->m->background();
@@ -14,7 +14,16 @@ extern "C"
 #endif
 
 MAPNIKCAPICALL int mapnik_register_datasources(const char* path);
-MAPNIKCAPICALL int mapnik_register_fonts(const char* path);
+MAPNIKCAPICALL int mapnik_register_fonts(const char* path, int recurse);
+
+// String list
+typedef struct _mapnik_string_list_t mapnik_string_list_t;
+MAPNIKCAPICALL void mapnik_string_list_free(mapnik_string_list_t * l);
+MAPNIKCAPICALL size_t mapnik_string_list_size(mapnik_string_list_t * l);
+MAPNIKCAPICALL const char * mapnik_string_list_get(mapnik_string_list_t * l, size_t idx);
+
+MAPNIKCAPICALL mapnik_string_list_t * mapnik_datasource_names();
+MAPNIKCAPICALL mapnik_string_list_t * mapnik_font_names();
 
 const int MAPNIK_NONE = 0;
 const int MAPNIK_DEBUG = 1;
@@ -30,6 +39,12 @@ typedef struct _mapnik_bbox_t mapnik_bbox_t;
 MAPNIKCAPICALL mapnik_bbox_t * mapnik_bbox(double minx, double miny, double maxx, double maxy);
 MAPNIKCAPICALL void mapnik_bbox_free(mapnik_bbox_t * b);
 
+// Coord
+typedef struct _mapnik_coord_t {
+    double x;
+    double y;
+} mapnik_coord_t;
+
 
 // Image
 MAPNIKCAPICALL typedef struct _mapnik_image_t mapnik_image_t;
@@ -57,6 +72,7 @@ MAPNIKCAPICALL void mapnik_map_free(mapnik_map_t * m);
 MAPNIKCAPICALL const char * mapnik_map_last_error(mapnik_map_t * m);
 
 MAPNIKCAPICALL int mapnik_map_load(mapnik_map_t * m, const char* stylesheet);
+MAPNIKCAPICALL int mapnik_map_load_string(mapnik_map_t * m, const char* s, size_t len, const char* base_path);
 
 MAPNIKCAPICALL const char * mapnik_map_get_srs(mapnik_map_t * m);
 MAPNIKCAPICALL int mapnik_map_set_srs(mapnik_map_t * m, const char* srs);
@@ -73,14 +89,58 @@ MAPNIKCAPICALL void mapnik_map_zoom_to_box(mapnik_map_t * m, mapnik_bbox_t * b);
 MAPNIKCAPICALL void mapnik_map_set_maximum_extent(mapnik_map_t * m, double x0, double y0, double x1, double y1);
 MAPNIKCAPICALL void mapnik_map_reset_maximum_extent(mapnik_map_t * m);
 
-MAPNIKCAPICALL int mapnik_map_render_to_file(mapnik_map_t * m, const char* filepath, double scale, double scale_factor, const char *format);
-MAPNIKCAPICALL mapnik_image_t * mapnik_map_render_to_image(mapnik_map_t * m, double scale, double scale_factor);
+// Render variables, only supported with Mapnik 3
+typedef struct _mapnik_variables_t mapnik_variables_t;
+
+MAPNIKCAPICALL mapnik_variables_t * mapnik_variables();
+MAPNIKCAPICALL void mapnik_variables_free(mapnik_variables_t * v);
+MAPNIKCAPICALL void mapnik_variables_set_string(mapnik_variables_t * v, const char * name, const char * value);
+MAPNIKCAPICALL void mapnik_variables_set_int(mapnik_variables_t * v, const char * name, int64_t value);
+MAPNIKCAPICALL void mapnik_variables_set_double(mapnik_variables_t * v, const char * name, double value);
+MAPNIKCAPICALL void mapnik_variables_set_bool(mapnik_variables_t * v, const char * name, int value);
+
+MAPNIKCAPICALL int mapnik_map_render_to_file(mapnik_map_t * m, mapnik_variables_t * vars, const char* filepath, double scale, double scale_factor, const char *format);
+MAPNIKCAPICALL mapnik_image_t * mapnik_map_render_to_image(mapnik_map_t * m, mapnik_variables_t * vars, double scale, double scale_factor);
+MAPNIKCAPICALL int mapnik_map_render_into(mapnik_map_t * m, mapnik_variables_t * vars, uint8_t * buf, size_t stride, double scale, double scale_factor);
+
+// Projection
+typedef struct _mapnik_projection_t mapnik_projection_t;
+
+MAPNIKCAPICALL mapnik_projection_t * mapnik_map_projection(mapnik_map_t *m);
+MAPNIKCAPICALL void mapnik_projection_free(mapnik_projection_t *p);
+MAPNIKCAPICALL mapnik_coord_t mapnik_projection_forward(mapnik_projection_t *p, mapnik_coord_t c);
+MAPNIKCAPICALL mapnik_coord_t mapnik_projection_inverse(mapnik_projection_t *p, mapnik_coord_t c);
 
 MAPNIKCAPICALL int mapnik_map_layer_count(mapnik_map_t * m);
 MAPNIKCAPICALL const char * mapnik_map_layer_name(mapnik_map_t * m, size_t idx);
 MAPNIKCAPICALL int mapnik_map_layer_is_active(mapnik_map_t * m, size_t idx);
 MAPNIKCAPICALL void mapnik_map_layer_set_active(mapnik_map_t * m, size_t idx, int active);
 
+// Query
+typedef struct _mapnik_query_result_t mapnik_query_result_t;
+
+MAPNIKCAPICALL mapnik_query_result_t * mapnik_map_query_point(mapnik_map_t * m, size_t idx, double x, double y);
+MAPNIKCAPICALL void mapnik_query_result_free(mapnik_query_result_t * r);
+MAPNIKCAPICALL size_t mapnik_query_result_feature_count(mapnik_query_result_t * r);
+MAPNIKCAPICALL int64_t mapnik_query_result_feature_id(mapnik_query_result_t * r, size_t feature);
+MAPNIKCAPICALL size_t mapnik_query_result_attribute_count(mapnik_query_result_t * r, size_t feature);
+MAPNIKCAPICALL const char * mapnik_query_result_attribute_name(mapnik_query_result_t * r, size_t feature, size_t attr);
+MAPNIKCAPICALL const char * mapnik_query_result_attribute_value(mapnik_query_result_t * r, size_t feature, size_t attr);
+
+// Grid
+typedef struct _mapnik_grid_t mapnik_grid_t;
+
+MAPNIKCAPICALL mapnik_grid_t * mapnik_map_render_grid(mapnik_map_t * m, size_t idx, const char * key, const char ** fields, size_t nfields, unsigned int resolution, double scale_factor);
+MAPNIKCAPICALL void mapnik_grid_free(mapnik_grid_t * g);
+MAPNIKCAPICALL size_t mapnik_grid_width(mapnik_grid_t * g);
+MAPNIKCAPICALL size_t mapnik_grid_height(mapnik_grid_t * g);
+MAPNIKCAPICALL const int32_t * mapnik_grid_cells(mapnik_grid_t * g);
+MAPNIKCAPICALL size_t mapnik_grid_key_count(mapnik_grid_t * g);
+MAPNIKCAPICALL const char * mapnik_grid_key(mapnik_grid_t * g, size_t key);
+MAPNIKCAPICALL size_t mapnik_grid_attribute_count(mapnik_grid_t * g, size_t key);
+MAPNIKCAPICALL const char * mapnik_grid_attribute_name(mapnik_grid_t * g, size_t key, size_t attr);
+MAPNIKCAPICALL const char * mapnik_grid_attribute_value(mapnik_grid_t * g, size_t key, size_t attr);
+
 #ifdef __cplusplus
 }
 #endif
@@ -2,18 +2,44 @@ package mapnik
 
 import (
 	"bytes"
+	"context"
 	"image"
 	"image/color"
 	"image/png"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 )
 
+func TestRegister(t *testing.T) {
+	if err := RegisterDatasources("/does/not/exist"); err == nil {
+		t.Error("missing plugin dir did not return an error")
+	}
+	if err := RegisterFonts("/does/not/exist"); err == nil {
+		t.Error("missing font dir did not return an error")
+	}
+
+	found := false
+	for _, name := range DatasourceNames() {
+		if name == "geojson" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("geojson plugin not registered", DatasourceNames())
+	}
+
+	if len(FontNames()) == 0 {
+		t.Error("no fonts registered")
+	}
+}
+
 func TestMap(t *testing.T) {
 	m := New()
 	if err := m.Load("test/map.xml"); err != nil {
@@ -30,6 +56,126 @@ func TestMap(t *testing.T) {
 	}
 }
 
+func TestRenderInto(t *testing.T) {
+	m := New()
+	if err := m.Load("test/map.xml"); err != nil {
+		t.Fatal(err)
+	}
+	m.ZoomAll()
+
+	ref, err := m.RenderImage(RenderOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, 800, 600))
+	// render twice to check that the reused image is cleared
+	for i := 0; i < 2; i++ {
+		if err := m.RenderInto(img, RenderOpts{}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(img.Pix, ref.Pix) {
+			t.Error("RenderInto differs from RenderImage")
+		}
+	}
+
+	// sub image with larger stride
+	large := image.NewNRGBA(image.Rect(0, 0, 1000, 700))
+	sub := large.SubImage(image.Rect(100, 50, 900, 650)).(*image.NRGBA)
+	if err := m.RenderInto(sub, RenderOpts{}); err != nil {
+		t.Fatal(err)
+	}
+	if sub.At(100, 50) != ref.At(0, 0) || sub.At(899, 649) != ref.At(799, 599) {
+		t.Error("unexpected pixels in sub image")
+	}
+
+	if err := m.RenderInto(image.NewNRGBA(image.Rect(0, 0, 10, 10)), RenderOpts{}); err == nil {
+		t.Error("mismatched image size did not return an error")
+	}
+}
+
+func TestLoadString(t *testing.T) {
+	xml, err := ioutil.ReadFile("test/map.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New()
+	if err := m.LoadString(xml, "test"); err != nil {
+		t.Fatal(err)
+	}
+	m.ZoomAll()
+	if _, err := m.RenderImage(RenderOpts{}); err != nil {
+		t.Fatal(err)
+	}
+
+	m = New()
+	if err := m.LoadString([]byte("<Map><Layer"), "test"); err == nil {
+		t.Error("invalid XML did not return an error")
+	}
+}
+
+func TestRenderVariables(t *testing.T) {
+	m := New()
+	if err := m.Load("test/map.xml"); err != nil {
+		t.Fatal(err)
+	}
+	m.ZoomAll()
+
+	if _, err := m.Render(RenderOpts{Variables: map[string]interface{}{"foo": []string{}}}); err == nil {
+		t.Error("unsupported variable type did not return an error")
+	}
+
+	_, err := m.Render(RenderOpts{Variables: map[string]interface{}{
+		"name": "foo", "id": 42, "size": 1.5, "selected": true,
+	}})
+	// not supported with Mapnik 2
+	if err != nil && strings.Contains(err.Error(), "require Mapnik 3") {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the polygon is only drawn if @name matches
+	m = New()
+	if err := m.LoadString([]byte(`<Map srs="+init=epsg:4326" background-color="steelblue">
+		<Style name="style">
+			<Rule>
+				<Filter>@name = 'foo'</Filter>
+				<PolygonSymbolizer fill="red" />
+			</Rule>
+		</Style>
+		<Layer name="layer" srs="+init=epsg:4326">
+			<StyleName>style</StyleName>
+			<Datasource>
+				<Parameter name="file">map.geojson</Parameter>
+				<Parameter name="type">geojson</Parameter>
+			</Datasource>
+		</Layer>
+	</Map>`), "test"); err != nil {
+		t.Fatal(err)
+	}
+	m.Resize(20, 20)
+	m.ZoomAll()
+	foo, err := m.RenderImage(RenderOpts{Variables: map[string]interface{}{"name": "foo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar, err := m.RenderImage(RenderOpts{Variables: map[string]interface{}{"name": "bar"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(foo.Pix, bar.Pix) {
+		t.Error("images with different variables are equal")
+	}
+	if c := foo.NRGBAAt(10, 10); c != (color.NRGBA{255, 0, 0, 255}) {
+		t.Error("unexpected color for matching variable", c)
+	}
+	if c := bar.NRGBAAt(10, 10); c != (color.NRGBA{70, 130, 180, 255}) {
+		t.Error("unexpected color for other variable", c)
+	}
+}
+
 func TestRenderFile(t *testing.T) {
 	m := New()
 	if err := m.Load("test/map.xml"); err != nil {
@@ -91,6 +237,86 @@ func TestSRS(t *testing.T) {
 	}
 }
 
+func TestProjection(t *testing.T) {
+	m := New()
+	m.SetSRS("+init=epsg:3857")
+	p, err := m.Projection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Free()
+
+	c := p.Forward(Coord{180, 0})
+	if math.Abs(c.X-20037508.34) > 0.01 || math.Abs(c.Y) > 0.01 {
+		t.Error("unexpected forward transformation", c)
+	}
+	c = p.Inverse(Coord{-20037508.34, 0})
+	if math.Abs(c.X+180) > 1e-6 || math.Abs(c.Y) > 1e-6 {
+		t.Error("unexpected inverse transformation", c)
+	}
+
+	m.SetSRS("+init=epsg:invalid")
+	if _, err := m.Projection(); err == nil {
+		t.Error("invalid SRS did not return an error")
+	}
+}
+
+func TestZoomToLonLat(t *testing.T) {
+	m := New()
+	if err := m.Load("test/map.xml"); err != nil {
+		t.Fatal(err)
+	}
+	m.SetSRS("+init=epsg:3857")
+	m.Resize(256, 256)
+	if err := m.ZoomToLonLat(-180, -85.05112878, 180, 85.05112878); err != nil {
+		t.Fatal(err)
+	}
+	// scale of zoom level 0 with 256x256 tiles
+	if s := m.ScaleDenominator(); math.Abs(s-559082264.03) > 1 {
+		t.Error("unexpected scale denominator", s)
+	}
+}
+
+func TestFeaturesAt(t *testing.T) {
+	m := New()
+	if err := m.Load("test/map.xml"); err != nil {
+		t.Fatal(err)
+	}
+	m.Resize(360, 180)
+	m.ZoomTo(-180, -90, 180, 90)
+
+	// 8/52 is inside the polygon of map.geojson
+	features, err := m.FeaturesAt(188, 38, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// layerD is disabled
+	if len(features) != 3 {
+		t.Fatal("unexpected number of features", features)
+	}
+	for i, l := range []string{"layerA", "layerB", "layerC"} {
+		if features[i].Layer != l {
+			t.Error("unexpected layer", features[i])
+		}
+	}
+
+	features, err = m.FeaturesAt(188, 38, []string{"layerD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 1 || features[0].Layer != "layerD" {
+		t.Error("unexpected features", features)
+	}
+
+	features, err = m.FeaturesAt(10, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 0 {
+		t.Error("unexpected features", features)
+	}
+}
+
 func TestBackgroundColor(t *testing.T) {
 	m := New()
 	c := m.BackgroundColor()
@@ -146,6 +372,42 @@ func TestRender(t *testing.T) {
 	}
 }
 
+func TestRenderContext(t *testing.T) {
+	m := New()
+	if err := m.Load("test/map.xml"); err != nil {
+		t.Fatal(err)
+	}
+	m.ZoomAll()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.RenderContext(ctx, RenderOpts{}); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+	if _, err := m.RenderImageContext(ctx, RenderOpts{}); err != context.Canceled {
+		t.Error("expected context.Canceled, got", err)
+	}
+
+	// render in the background, map waits for the render
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	m.Resize(4000, 4000)
+	if _, err := m.RenderContext(ctx, RenderOpts{}); err != nil && err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	img, err := m.RenderImageContext(context.Background(), RenderOpts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Busy() {
+		t.Error("map busy after render")
+	}
+	if img.Rect.Dx() != 4000 || img.Rect.Dy() != 4000 {
+		t.Error("unexpected size of output image: ", img.Rect)
+	}
+	m.Free()
+}
+
 type testSelector struct {
 	status func(string) Status
 }
@@ -0,0 +1,185 @@
+// Package atlas lays out map sheets for map books. Sheets are frames of a
+// coverage grid or of polygons from a GeoJSON file, rendered at a fixed
+// scale.
+package atlas
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Frame is the extent of a single map sheet.
+type Frame struct {
+	// Name of the sheet, the sheet number for grids.
+	Name string
+	BBOX [4]float64
+}
+
+func (f Frame) width() float64  { return f.BBOX[2] - f.BBOX[0] }
+func (f Frame) height() float64 { return f.BBOX[3] - f.BBOX[1] }
+
+// expand returns f enlarged by overlap (fraction of the size of the frame),
+// half of it on each side.
+func (f Frame) expand(overlap float64) Frame {
+	dx := f.width() * overlap / 2
+	dy := f.height() * overlap / 2
+	f.BBOX = [4]float64{f.BBOX[0] - dx, f.BBOX[1] - dy, f.BBOX[2] + dx, f.BBOX[3] + dy}
+	return f
+}
+
+func validBBOX(bbox [4]float64) error {
+	if bbox[0] >= bbox[2] || bbox[1] >= bbox[3] {
+		return fmt.Errorf("invalid bbox %v", bbox)
+	}
+	return nil
+}
+
+// Grid divides bbox into rows×cols frames. Each frame is enlarged by overlap
+// (e.g. 0.1 for 10%), so that neighbouring sheets show the same features at
+// the edges. Frames are numbered row by row, starting at the top left.
+func Grid(bbox [4]float64, rows, cols int, overlap float64) ([]Frame, error) {
+	if err := validBBOX(bbox); err != nil {
+		return nil, err
+	}
+	if rows < 1 || cols < 1 {
+		return nil, fmt.Errorf("invalid grid %dx%d", rows, cols)
+	}
+	w := (bbox[2] - bbox[0]) / float64(cols)
+	h := (bbox[3] - bbox[1]) / float64(rows)
+	frames := make([]Frame, 0, rows*cols)
+	for row := 0; row < rows; row++ {
+		maxy := bbox[3] - float64(row)*h
+		for col := 0; col < cols; col++ {
+			minx := bbox[0] + float64(col)*w
+			f := Frame{
+				Name: strconv.Itoa(len(frames) + 1),
+				BBOX: [4]float64{minx, maxy - h, minx + w, maxy},
+			}
+			frames = append(frames, f.expand(overlap))
+		}
+	}
+	return frames, nil
+}
+
+// PageGrid covers bbox with frames of pages with width×height mm at the
+// scale denominator. Neighbouring frames overlap by overlap (fraction of the
+// page). The grid is centered on bbox. The units of bbox need to be meters.
+func PageGrid(bbox [4]float64, width, height, scale, overlap float64) ([]Frame, error) {
+	if err := validBBOX(bbox); err != nil {
+		return nil, err
+	}
+	if width <= 0 || height <= 0 || scale <= 0 {
+		return nil, fmt.Errorf("invalid page %gx%gmm at 1:%g", width, height, scale)
+	}
+	if overlap < 0 || overlap >= 1 {
+		return nil, fmt.Errorf("overlap %g needs to be between 0 and 1", overlap)
+	}
+	fw := width / 1000 * scale
+	fh := height / 1000 * scale
+	sx := fw * (1 - overlap)
+	sy := fh * (1 - overlap)
+	cols := pages(bbox[2]-bbox[0], fw, sx)
+	rows := pages(bbox[3]-bbox[1], fh, sy)
+
+	// center grid
+	minx := (bbox[0]+bbox[2])/2 - (fw+float64(cols-1)*sx)/2
+	maxy := (bbox[1]+bbox[3])/2 + (fh+float64(rows-1)*sy)/2
+	frames := make([]Frame, 0, rows*cols)
+	for row := 0; row < rows; row++ {
+		y := maxy - float64(row)*sy
+		for col := 0; col < cols; col++ {
+			x := minx + float64(col)*sx
+			frames = append(frames, Frame{
+				Name: strconv.Itoa(len(frames) + 1),
+				BBOX: [4]float64{x, y - fh, x + fw, y},
+			})
+		}
+	}
+	return frames, nil
+}
+
+// pages returns the number of pages with size and step to cover length.
+func pages(length, size, step float64) int {
+	if length <= size {
+		return 1
+	}
+	// small epsilon, so that exact fits do not need an extra page
+	return int(math.Ceil((length-size)/step-1e-9)) + 1
+}
+
+type featureCollection struct {
+	Features []struct {
+		Properties map[string]interface{} `json:"properties"`
+		Geometry   struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+	} `json:"features"`
+}
+
+// LoadFrames reads frames from the bounding boxes of all polygons of a
+// GeoJSON FeatureCollection. Names are taken from the name property, or the
+// number of the feature. Each frame is enlarged by overlap.
+func LoadFrames(r io.Reader, overlap float64) ([]Frame, error) {
+	fc := featureCollection{}
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, fmt.Errorf("invalid GeoJSON: %s", err)
+	}
+	frames := []Frame{}
+	for i, f := range fc.Features {
+		var rings [][][2]float64
+		switch f.Geometry.Type {
+		case "Polygon":
+			if err := json.Unmarshal(f.Geometry.Coordinates, &rings); err != nil {
+				return nil, fmt.Errorf("invalid polygon of feature %d: %s", i+1, err)
+			}
+		case "MultiPolygon":
+			var polygons [][][][2]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &polygons); err != nil {
+				return nil, fmt.Errorf("invalid multipolygon of feature %d: %s", i+1, err)
+			}
+			for _, p := range polygons {
+				rings = append(rings, p...)
+			}
+		default:
+			return nil, fmt.Errorf("feature %d is a %q, frames need to be polygons", i+1, f.Geometry.Type)
+		}
+
+		bbox := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+		for _, ring := range rings {
+			for _, p := range ring {
+				bbox[0] = math.Min(bbox[0], p[0])
+				bbox[1] = math.Min(bbox[1], p[1])
+				bbox[2] = math.Max(bbox[2], p[0])
+				bbox[3] = math.Max(bbox[3], p[1])
+			}
+		}
+		if err := validBBOX(bbox); err != nil {
+			return nil, fmt.Errorf("feature %d: %s", i+1, err)
+		}
+		name := strconv.Itoa(i + 1)
+		if v, ok := f.Properties["name"]; ok && v != nil {
+			name = fmt.Sprint(v)
+		}
+		frames = append(frames, Frame{Name: name, BBOX: bbox}.expand(overlap))
+	}
+	if len(frames) == 0 {
+		return nil, fmt.Errorf("no frames in GeoJSON")
+	}
+	return frames, nil
+}
+
+// PageSize returns the size of the frame in mm at the scale denominator.
+func PageSize(f Frame, scale float64) (width, height float64) {
+	return f.width() / scale * 1000, f.height() / scale * 1000
+}
+
+// PixelSize returns the size of the rendered frame at the scale denominator
+// and the resolution in DPI.
+func PixelSize(f Frame, scale, dpi float64) (width, height int) {
+	w, h := PageSize(f, scale)
+	return int(math.Round(w / 25.4 * dpi)), int(math.Round(h / 25.4 * dpi))
+}
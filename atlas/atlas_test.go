@@ -0,0 +1,176 @@
+package atlas
+
+import (
+	"bytes"
+	"compress/zlib"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGrid(t *testing.T) {
+	frames, err := Grid([4]float64{0, 0, 3000, 2000}, 2, 3, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 6 {
+		t.Fatal("unexpected frames", frames)
+	}
+	// top left first, enlarged by 50m on each side
+	if frames[0].Name != "1" || frames[0].BBOX != [4]float64{-50, 950, 1050, 2050} {
+		t.Error("unexpected first frame", frames[0])
+	}
+	if frames[5].Name != "6" || frames[5].BBOX != [4]float64{1950, -50, 3050, 1050} {
+		t.Error("unexpected last frame", frames[5])
+	}
+
+	if _, err := Grid([4]float64{0, 0, 3000, 2000}, 0, 3, 0); err == nil {
+		t.Error("expected error for empty grid")
+	}
+	if _, err := Grid([4]float64{0, 0, 0, 2000}, 1, 1, 0); err == nil {
+		t.Error("expected error for invalid bbox")
+	}
+}
+
+func TestPageGrid(t *testing.T) {
+	// A4 landscape at 1:10000 is 2970x2100m, with 10% overlap each page
+	// adds 2673m
+	frames, err := PageGrid([4]float64{0, 0, 5000, 2000}, 297, 210, 10000, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatal("unexpected frames", frames)
+	}
+	for _, f := range frames {
+		w, h := PageSize(f, 10000)
+		if round(w) != 297 || round(h) != 210 {
+			t.Errorf("unexpected page size %v %v of %v", w, h, f)
+		}
+	}
+	// centered
+	if round(frames[0].BBOX[0]+frames[1].BBOX[2]) != 5000 || round(frames[0].BBOX[1]+frames[0].BBOX[3]) != 2000 {
+		t.Error("grid not centered", frames)
+	}
+	if round(frames[1].BBOX[0]-frames[0].BBOX[0]) != 2673 {
+		t.Error("unexpected overlap", frames)
+	}
+
+	// exact fit
+	frames, err = PageGrid([4]float64{0, 0, 5940, 2100}, 297, 210, 10000, 0)
+	if err != nil || len(frames) != 2 {
+		t.Error("unexpected frames for exact fit", frames, err)
+	}
+
+	if _, err := PageGrid([4]float64{0, 0, 5000, 2000}, 297, 210, 10000, 1); err == nil {
+		t.Error("expected error for overlap")
+	}
+}
+
+func round(f float64) float64 {
+	v, _ := strconv.ParseFloat(strconv.FormatFloat(f, 'f', 6, 64), 64)
+	return v
+}
+
+func TestLoadFrames(t *testing.T) {
+	frames, err := LoadFrames(strings.NewReader(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"name": "North"}, "geometry": {"type": "Polygon", "coordinates": [[[0, 1000], [1000, 1000], [1000, 2000], [0, 2000], [0, 1000]]]}},
+		{"type": "Feature", "properties": {}, "geometry": {"type": "MultiPolygon", "coordinates": [[[[0, 0], [500, 0], [500, 500], [0, 0]]], [[[600, 600], [1000, 600], [1000, 1000], [600, 600]]]]}}
+	]}`), 0.2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatal("unexpected frames", frames)
+	}
+	if frames[0].Name != "North" || frames[0].BBOX != [4]float64{-100, 900, 1100, 2100} {
+		t.Error("unexpected frame", frames[0])
+	}
+	if frames[1].Name != "2" || frames[1].BBOX != [4]float64{-100, -100, 1100, 1100} {
+		t.Error("unexpected frame", frames[1])
+	}
+
+	for _, tc := range []struct {
+		geojson string
+		err     string
+	}{
+		{`{"features": [{"geometry": {"type": "Point", "coordinates": [0, 0]}}]}`, "frames need to be polygons"},
+		{`{"features": []}`, "no frames"},
+		{`{"features": [`, "invalid GeoJSON"},
+	} {
+		_, err := LoadFrames(strings.NewReader(tc.geojson), 0)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error %q for %s, got %v", tc.err, tc.geojson, err)
+		}
+	}
+}
+
+func TestPixelSize(t *testing.T) {
+	// 1:10000, 254m are 25.4mm
+	w, h := PixelSize(Frame{BBOX: [4]float64{0, 0, 254, 508}}, 10000, 300)
+	if w != 300 || h != 600 {
+		t.Error("unexpected size", w, h)
+	}
+}
+
+func TestPDF(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	img.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	// transparent pixels are white
+	img.Set(1, 0, color.NRGBA{0, 0, 0, 0})
+
+	buf := &bytes.Buffer{}
+	pdf := NewPDF(buf)
+	for _, page := range []Page{
+		{Image: img, Width: 297, Height: 210, Label: "Sheet (1)"},
+		{Image: img, Width: 297, Height: 210},
+	} {
+		if err := pdf.AddPage(page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pdf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	content := buf.Bytes()
+	if !bytes.HasPrefix(content, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(content, []byte("%%EOF\n")) {
+		t.Fatal("invalid PDF header/trailer")
+	}
+	if !bytes.Contains(content, []byte("/Count 2")) || !bytes.Contains(content, []byte("/MediaBox [0 0 841.89 595.28]")) {
+		t.Error("invalid pages")
+	}
+	if !bytes.Contains(content, []byte(`(Sheet \(1\)) Tj`)) {
+		t.Error("missing label")
+	}
+
+	// all xref offsets point to their objects
+	m := regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(content)
+	if m == nil {
+		t.Fatal("missing startxref")
+	}
+	xref, _ := strconv.Atoi(string(m[1]))
+	lines := strings.Split(string(content[xref:]), "\n")
+	if lines[0] != "xref" || lines[1] != "0 10" {
+		t.Fatal("unexpected xref", lines[:2])
+	}
+	for i := 1; i < 10; i++ {
+		off, _ := strconv.Atoi(lines[2+i][:10])
+		if !bytes.HasPrefix(content[off:], []byte(strconv.Itoa(i)+" 0 obj\n")) {
+			t.Errorf("invalid offset of object %d", i)
+		}
+	}
+
+	pixels := regexp.MustCompile(`(?s)/Filter /FlateDecode /Length \d+ >>\nstream\n(.*?)\nendstream`).FindSubmatch(content)
+	zr, err := zlib.NewReader(bytes.NewReader(pixels[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rgb, _ := ioutil.ReadAll(zr)
+	if len(rgb) != 4*2*3 || !bytes.Equal(rgb[:6], []byte{255, 0, 0, 255, 255, 255}) {
+		t.Error("unexpected pixels", rgb)
+	}
+}
@@ -0,0 +1,157 @@
+package atlas
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+)
+
+// Page is a single page of a PDF map book.
+type Page struct {
+	Image image.Image
+	// Width and Height of the page in mm.
+	Width, Height float64
+	// Label is printed at the lower left corner, e.g. the sheet number.
+	Label string
+}
+
+// PDF writes pages of a map book into a single PDF. Pages are written
+// while they are added, so that only one image needs to be in memory.
+type PDF struct {
+	w       *bufio.Writer
+	n       int64
+	offsets []int64 // of each object, by object number - 1
+	pages   []string
+	err     error
+}
+
+// NewPDF starts a new PDF. Close needs to be called after the last page.
+func NewPDF(w io.Writer) *PDF {
+	p := &PDF{w: bufio.NewWriter(w)}
+	p.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	// 1: catalog, 2: pages (written by Close), 3: font, followed by page,
+	// content and image for each page
+	p.object(1)
+	p.printf("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+	p.object(3)
+	p.printf("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>\nendobj\n")
+	return p
+}
+
+func (p *PDF) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+func (p *PDF) write(b []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(b)
+	p.n += int64(n)
+	p.err = err
+}
+
+// object starts the object with number num.
+func (p *PDF) object(num int) {
+	for len(p.offsets) < num {
+		p.offsets = append(p.offsets, 0)
+	}
+	p.offsets[num-1] = p.n
+	p.printf("%d 0 obj\n", num)
+}
+
+func (p *PDF) stream(dict string, content []byte) {
+	if dict != "" {
+		dict += " "
+	}
+	p.printf("<< %s/Length %d >>\nstream\n", dict, len(content))
+	p.write(content)
+	p.printf("\nendstream\nendobj\n")
+}
+
+// AddPage adds a page. The image is embedded lossless and scaled to the
+// page size.
+func (p *PDF) AddPage(page Page) error {
+	pixels, err := rgb(page.Image)
+	if err != nil {
+		return err
+	}
+	obj := 4 + 3*len(p.pages)
+	p.pages = append(p.pages, fmt.Sprintf("%d 0 R", obj))
+	w, h := page.Width/25.4*72, page.Height/25.4*72 // points
+
+	p.object(obj)
+	p.printf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /F1 3 0 R >> /XObject << /Im0 %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+		w, h, obj+2, obj+1)
+
+	content := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q\n", w, h)
+	if page.Label != "" {
+		const size = 9
+		tw := float64(len(page.Label)) * size * 0.6 // approx. width of Helvetica
+		content += fmt.Sprintf("1 1 1 rg 0 0 %.2f %d re f 0 0 0 rg BT /F1 %d Tf 4 4 Td (%s) Tj ET\n",
+			tw+8, size+6, size, pdfEscape(page.Label))
+	}
+	p.object(obj + 1)
+	p.stream("", []byte(content))
+
+	b := page.Image.Bounds()
+	p.object(obj + 2)
+	p.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /FlateDecode",
+		b.Dx(), b.Dy()), pixels)
+	return p.err
+}
+
+// Close writes the page tree and the cross-reference table.
+func (p *PDF) Close() error {
+	p.object(2)
+	p.printf("<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(p.pages, " "), len(p.pages))
+
+	xref := p.n
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, off := range p.offsets {
+		p.printf("%010d 00000 n \n", off)
+	}
+	p.printf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets)+1, xref)
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
+
+// rgb returns the zlib compressed RGB pixels of img. Transparent pixels are
+// blended with white.
+func rgb(img image.Image) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := zlib.NewWriter(buf)
+	bounds := img.Bounds()
+	row := make([]byte, 3*bounds.Dx())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA() // premultiplied
+			i := 3 * (x - bounds.Min.X)
+			row[i] = byte((r + 0xffff - a) >> 8)
+			row[i+1] = byte((g + 0xffff - a) >> 8)
+			row[i+2] = byte((b + 0xffff - a) >> 8)
+		}
+		if _, err := zw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func pdfEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`).Replace(s)
+}
@@ -4,11 +4,10 @@ package builder
 import (
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 
 	"github.com/omniscale/magnacarto/color"
 	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
 	"github.com/omniscale/magnacarto/mml"
 	"github.com/omniscale/magnacarto/mss"
 )
@@ -21,11 +20,39 @@ type Builder struct {
 	locator   config.Locator
 	dumpRules io.Writer
 	deferEval bool
+	baseMML   []string
+	groups    map[string]bool
+	overrides []LayerOverride
+	defines   map[string]string
+	vars      map[string]string
+	variables []mss.Variable
+	dpi       float64
+	inlineDir string
+	metadata  bool
+	// metadata of the last build
+	buildMetadata []Metadata
+
+	removeDeadRules bool
+	mergeRules      bool
+	optimizeReport  io.Writer
+	logger          *logging.Logger
 }
 
 // New returns a Builder
 func New(mw Map) *Builder {
-	return &Builder{dstMap: mw}
+	b := &Builder{dstMap: mw}
+	b.SetLogger(logging.Default())
+	return b
+}
+
+// SetLogger sets the logger for warnings and reports of the build (e.g.
+// missing images or removed rules). Messages are logged with
+// component=builder, also by maps that implement LoggerSetter.
+func (b *Builder) SetLogger(l *logging.Logger) {
+	b.logger = l.With("component", "builder")
+	if s, ok := b.dstMap.(LoggerSetter); ok {
+		s.SetLogger(b.logger)
+	}
 }
 
 // AddMSS adds another mss file to this builder.
@@ -48,37 +75,136 @@ func (b *Builder) SetDumpRulesDest(w io.Writer) {
 	b.dumpRules = w
 }
 
+// EnableDeadRuleElimination removes all rules that never match (see
+// mss.RemoveDeadRules). The number of removed rules is logged for each layer.
+func (b *Builder) EnableDeadRuleElimination() {
+	b.removeDeadRules = true
+}
+
+// EnableRuleMerging merges adjacent rules that only differ in a filter value
+// or their zoom levels (see mss.MergeRules). The number of merged rules is
+// logged for each layer.
+func (b *Builder) EnableRuleMerging() {
+	b.mergeRules = true
+}
+
+// SetOptimizeReportDest writes all rules removed by the optimizer with the
+// reason to w.
+func (b *Builder) SetOptimizeReportDest(w io.Writer) {
+	b.optimizeReport = w
+}
+
+// SetGroupStatus overrides the status of layer groups from the MML.
+func (b *Builder) SetGroupStatus(status map[string]bool) {
+	b.groups = status
+}
+
+// SetDPI sets the resolution of the output. Sizes without unit are pixels
+// at mss.DefaultDPI and are scaled to dpi.
+func (b *Builder) SetDPI(dpi float64) {
+	b.dpi = dpi
+}
+
+// SetVar overrides the MSS variable name with value (see mss.Decoder.SetVar).
+// If any variable is overridden, the final value and the origin of all
+// variables are logged after the build.
+func (b *Builder) SetVar(name, value string) {
+	if b.vars == nil {
+		b.vars = make(map[string]string)
+	}
+	b.vars[name] = value
+}
+
+// Variables returns all MSS variables with their final values and origins.
+// Only valid after Build.
+func (b *Builder) Variables() []mss.Variable {
+	return b.variables
+}
+
+// Define sets a build flag for @if conditions in the MSS and the if option
+// of MML layers.
+func (b *Builder) Define(name, value string) {
+	if b.defines == nil {
+		b.defines = make(map[string]string)
+	}
+	b.defines[name] = value
+}
+
+// BaseMMLFiles returns the MML files of all projects that are extended by the
+// MML. Only valid after Build.
+func (b *Builder) BaseMMLFiles() []string {
+	return b.baseMML
+}
+
 // Build parses MML, MSS files, builds all rules and adds them to the Map.
 func (b *Builder) Build() error {
 	layerNames := []string{}
 	layers := []mml.Layer{}
+	layerZoom := map[string]mss.ZoomRange{}
 
 	if b.mml != "" {
-		r, err := os.Open(b.mml)
-		if err != nil {
-			return err
-		}
-		defer r.Close()
-		mml, err := mml.Parse(r)
+		mml, err := mml.Load(b.mml)
 		if err != nil {
 			return err
 		}
+		b.baseMML = mml.BaseFiles
 		if len(b.mss) == 0 {
-			for _, s := range mml.Stylesheets {
-				b.mss = append(b.mss, filepath.Join(filepath.Dir(b.mml), s))
-			}
+			b.mss = stylesheetFiles(b.mml, mml)
 		}
 
 		for _, l := range mml.Layers {
+			if l.If != "" {
+				ok, err := mss.EvalCondition(l.If, b.defines)
+				if err != nil {
+					return fmt.Errorf("invalid if of layer %s: %s", l.Name, err)
+				}
+				if !ok {
+					continue
+				}
+			}
+			if g, ok := mml.Group(l.Group); ok {
+				active := g.Active
+				if status, ok := b.groups[g.Name]; ok {
+					active = status
+				}
+				if !active {
+					l.Active = false
+				}
+				layerZoom[l.Name] = mss.NewZoomRange(g.MinZoom, g.MaxZoom)
+			}
+			if l.MinZoom > 0 || l.MaxZoom < 30 {
+				z := mss.NewZoomRange(l.MinZoom, l.MaxZoom)
+				if gz, ok := layerZoom[l.Name]; ok {
+					z &= gz
+				}
+				layerZoom[l.Name] = z
+			}
+			if err := b.inlineLayer(&l); err != nil {
+				return err
+			}
 			layers = append(layers, l)
 			layerNames = append(layerNames, l.Name)
 		}
+		if err := b.applyOverrides(layers, layerZoom); err != nil {
+			return err
+		}
 	}
 
 	carto := mss.New()
 	if b.deferEval {
 		carto.EnableDeferredEval()
 	}
+	for name, value := range b.defines {
+		carto.Define(name, value)
+	}
+	if b.dpi != 0 {
+		carto.SetDPI(b.dpi)
+	}
+	for name, value := range b.vars {
+		if err := carto.SetVar(name, value); err != nil {
+			return err
+		}
+	}
 
 	for _, mss := range b.mss {
 		err := carto.ParseFile(mss)
@@ -90,6 +216,12 @@ func (b *Builder) Build() error {
 	if err := carto.Evaluate(); err != nil {
 		return err
 	}
+	b.variables = carto.Variables()
+	if len(b.vars) > 0 {
+		for _, v := range b.variables {
+			b.logger.Info(fmt.Sprintf("variable %s", v))
+		}
+	}
 
 	if b.mml == "" {
 		layerNames = carto.MSS().Layers()
@@ -103,6 +235,31 @@ func (b *Builder) Build() error {
 
 	for _, l := range layers {
 		rules := carto.MSS().LayerRules(l.Name, l.Classes...)
+		z, ok := layerZoom[l.Name]
+		if b.removeDeadRules {
+			if !ok {
+				z = mss.AllZoom
+			}
+			var dead []mss.DeadRule
+			rules, dead = mss.RemoveDeadRules(rules, z)
+			if len(dead) > 0 {
+				b.logger.Info(fmt.Sprintf("removed %d of %d rules of layer %s that never match", len(dead), len(rules)+len(dead), l.Name))
+			}
+			if b.optimizeReport != nil {
+				for _, d := range dead {
+					fmt.Fprintf(b.optimizeReport, "%s: %s\n", l.Name, d)
+				}
+			}
+		} else if ok {
+			rules = limitZoom(rules, z)
+		}
+		if b.mergeRules {
+			var merged int
+			rules, merged = mss.MergeRules(rules)
+			if merged > 0 {
+				b.logger.Info(fmt.Sprintf("merged %d of %d rules of layer %s", merged, len(rules)+merged, l.Name))
+			}
+		}
 
 		if b.dumpRules != nil {
 			for _, r := range rules {
@@ -119,13 +276,57 @@ func (b *Builder) Build() error {
 			m.SetBackgroundColor(bgColor)
 		}
 	}
+	if b.metadata {
+		b.buildMetadata = b.collectMetadata()
+		if m, ok := b.dstMap.(MetadataSetter); ok {
+			m.SetMetadata(b.buildMetadata)
+		}
+	}
 	return nil
 }
 
+// limitZoom returns all rules that are visible within z.
+func limitZoom(rules []mss.Rule, z mss.ZoomRange) []mss.Rule {
+	if z == mss.AllZoom {
+		return rules
+	}
+	result := rules[:0]
+	for _, r := range rules {
+		r.Zoom &= z
+		if r.Zoom != mss.InvalidZoom {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
 type MapOptionsSetter interface {
 	SetBackgroundColor(color.RGBA)
 }
 
+// CartoCompatSetter is implemented by maps that can switch to the symbolizer
+// defaults of carto.
+type CartoCompatSetter interface {
+	SetCartoCompat(bool)
+}
+
+// DebugSetter is implemented by maps that can render debug information, like
+// label collision boxes.
+type DebugSetter interface {
+	SetDebug(bool)
+}
+
+// LoggerSetter is implemented by maps that log warnings during the build.
+type LoggerSetter interface {
+	SetLogger(*logging.Logger)
+}
+
+// MetadataSetter is implemented by maps that can embed build metadata in
+// the output (see Builder.EnableMetadata).
+type MetadataSetter interface {
+	SetMetadata([]Metadata)
+}
+
 type Writer interface {
 	Write(io.Writer) error
 	WriteFiles(basename string) error
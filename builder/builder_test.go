@@ -0,0 +1,326 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+func TestLimitZoom(t *testing.T) {
+	rules := []mss.Rule{
+		{Zoom: mss.NewZoomRange(0, 8)},
+		{Zoom: mss.NewZoomRange(5, 15)},
+		{Zoom: mss.AllZoom},
+	}
+	result := limitZoom(rules, mss.NewZoomRange(10, 30))
+	if len(result) != 2 {
+		t.Fatal("unexpected rules", result)
+	}
+	if result[0].Zoom != mss.NewZoomRange(10, 15) || result[1].Zoom != mss.NewZoomRange(10, 30) {
+		t.Error("unexpected zoom", result[0].Zoom, result[1].Zoom)
+	}
+}
+
+func TestBuildGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"],
+		"groups": [{"name": "labels", "status": "off"}],
+		"Layer": [{"name": "roads", "group": "roads"}, {"name": "places", "group": "labels"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`#roads, #places { line-width: 1; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		status map[string]bool
+		roads  bool
+		places bool
+	}{
+		{nil, true, false},
+		{map[string]bool{"labels": true}, true, true},
+		{map[string]bool{"roads": false}, false, false},
+	} {
+		m := &testMap{}
+		b := New(m)
+		b.SetMML(mmlFile)
+		b.SetGroupStatus(tc.status)
+		if err := b.Build(); err != nil {
+			t.Fatal(err)
+		}
+		if m.layers[0].Active != tc.roads || m.layers[1].Active != tc.places {
+			t.Errorf("unexpected status for %v: %v %v", tc.status, m.layers[0].Active, m.layers[1].Active)
+		}
+	}
+}
+
+func TestBuildLayerZoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"],
+		"groups": [{"name": "labels", "minzoom": 10}],
+		"Layer": [
+			{"name": "roads", "properties": {"minzoom": 5, "maxzoom": 12}},
+			{"name": "places", "group": "labels", "properties": {"maxzoom": 14}}
+		]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`#roads, #places { line-width: 1; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &testMap{}
+	b := New(m)
+	b.SetMML(mmlFile)
+	if err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if z := m.rules[0][0].Zoom; z != mss.NewZoomRange(5, 12) {
+		t.Error("unexpected zoom of roads", z)
+	}
+	if z := m.rules[1][0].Zoom; z != mss.NewZoomRange(10, 14) {
+		t.Error("unexpected zoom of places", z)
+	}
+}
+
+func TestBuildDefines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"],
+		"Layer": [{"name": "roads"}, {"name": "hillshade", "if": "target != mapserver"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`
+#roads, #hillshade { line-width: 1; }
+@if target = mapserver { #roads { line-width: 2; } }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		target string
+		layers int
+		width  float64
+	}{
+		{"mapnik3", 2, 1},
+		{"mapserver", 1, 2},
+	} {
+		m := &testMap{}
+		b := New(m)
+		b.SetMML(mmlFile)
+		b.Define("target", tc.target)
+		if err := b.Build(); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.layers) != tc.layers {
+			t.Fatalf("unexpected layers for %s: %v", tc.target, m.layers)
+		}
+		if w, _ := m.rules[0][0].Properties.GetFloat("line-width"); w != tc.width {
+			t.Errorf("unexpected line-width for %s: %v", tc.target, w)
+		}
+	}
+
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Layer": [{"name": "roads", "if": "target >= 2"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := New(&testMap{})
+	b.SetMML(mmlFile)
+	if err := b.Build(); err == nil || !strings.Contains(err.Error(), "invalid if of layer roads") {
+		t.Error("expected error for invalid if, got", err)
+	}
+}
+
+func TestBuildVars(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"], "Layer": [{"name": "roads"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`
+@width: 1;
+@color: red !default;
+#roads { line-width: @width; line-color: @color; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	logger := logging.New(buf, logging.Info, false)
+
+	m := &testMap{}
+	b := New(m)
+	b.SetLogger(logger)
+	b.SetMML(mmlFile)
+	if err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Error("unexpected report without overrides", buf.String())
+	}
+	if vars := b.Variables(); len(vars) != 2 || vars[0].Origin != mss.VarDefault || vars[1].Origin != mss.VarFile {
+		t.Errorf("unexpected variables %v", vars)
+	}
+
+	m = &testMap{}
+	b = New(m)
+	b.SetLogger(logger)
+	b.SetMML(mmlFile)
+	b.SetVar("width", "4")
+	if err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := m.rules[0][0].Properties.GetFloat("line-width"); w != 4 {
+		t.Errorf("unexpected line-width %v", w)
+	}
+	if !strings.Contains(buf.String(), "variable @width: 4 (override, test.mss:2)") || !strings.Contains(buf.String(), "variable @color: #ff0000 (default, test.mss:3)") {
+		t.Error("unexpected report", buf.String())
+	}
+
+	b = New(&testMap{})
+	b.SetMML(mmlFile)
+	b.SetVar("width", "(")
+	if err := b.Build(); err == nil || !strings.Contains(err.Error(), "invalid value for @width") {
+		t.Error("expected error for invalid var, got", err)
+	}
+}
+
+func TestBuildRemoveDeadRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"],
+		"groups": [{"name": "streets", "minzoom": 10}],
+		"Layer": [{"name": "roads", "group": "streets"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`
+#roads { line-width: 1; }
+#roads[zoom<8] { line-width: 2; }
+#roads[type='a'][type='b'] { line-width: 3; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &testMap{}
+	b := New(m)
+	b.SetMML(mmlFile)
+	b.EnableDeadRuleElimination()
+	report := &bytes.Buffer{}
+	b.SetOptimizeReportDest(report)
+	if err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.rules[0]) != 1 {
+		t.Errorf("unexpected rules %v", m.rules[0])
+	}
+	if !strings.Contains(report.String(), "roads: outside of layer zoom") || !strings.Contains(report.String(), "roads: contradictory filters [type = a] and [type = b]") {
+		t.Error("unexpected report", report.String())
+	}
+}
+
+func TestParseLayerZoom(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		zoom mss.ZoomRange
+	}{
+		{"roads=8-18", mss.NewZoomRange(8, 18)},
+		{"roads=8-", mss.NewZoomRange(8, 30)},
+		{"roads=-18", mss.NewZoomRange(0, 18)},
+		{"roads=12", mss.NewZoomRange(12, 12)},
+	} {
+		o, err := ParseLayerZoom(tc.s)
+		if err != nil {
+			t.Error(tc.s, err)
+			continue
+		}
+		if o.Pattern != "roads" || o.Zoom != tc.zoom || o.Active != nil {
+			t.Errorf("unexpected override for %s: %#v", tc.s, o)
+		}
+	}
+	for _, s := range []string{"roads", "=8-18", "roads=a-18", "roads=18-8", "roads=8-b"} {
+		if _, err := ParseLayerZoom(s); err == nil {
+			t.Error("expected error for", s)
+		}
+	}
+}
+
+func TestLayerOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"], "Layer": [
+		{"name": "admin-0"}, {"name": "admin-1", "status": "off"}, {"name": "landcover"}, {"name": "roads"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`#admin-0, #admin-1, #landcover { line-width: 1; }
+		#roads { line-width: 1; [zoom>=10] { line-width: 2; } }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	enable, disable := true, false
+	m := &testMap{}
+	b := New(m)
+	b.SetMML(mmlFile)
+	zoom, _ := ParseLayerZoom("roads=8-18")
+	for _, o := range []LayerOverride{
+		{Pattern: "*", Active: &disable},
+		{Pattern: "admin*", Active: &enable},
+		{Pattern: "roads", Active: &enable},
+		zoom,
+	} {
+		if err := b.AddLayerOverride(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	for i, active := range []bool{true, true, false, true} {
+		if m.layers[i].Active != active {
+			t.Errorf("unexpected status of %s: %v", m.layers[i].Name, m.layers[i].Active)
+		}
+	}
+	if roads := m.rules[3]; len(roads) != 2 || roads[0].Zoom != mss.NewZoomRange(10, 18) || roads[1].Zoom != mss.NewZoomRange(8, 18) {
+		t.Errorf("unexpected zoom of roads %v", roads)
+	}
+
+	b.AddLayerOverride(LayerOverride{Pattern: "road", Active: &disable})
+	if err := b.Build(); err == nil {
+		t.Error("expected error for unmatched pattern")
+	}
+	if err := b.AddLayerOverride(LayerOverride{Pattern: "[road"}); err == nil {
+		t.Error("expected error for invalid pattern")
+	}
+}
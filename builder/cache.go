@@ -4,15 +4,16 @@ import (
 	"fmt"
 	"hash/fnv"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
 	"gopkg.in/fsnotify.v1"
 
 	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
 	mmlparse "github.com/omniscale/magnacarto/mml"
 )
 
@@ -24,12 +25,76 @@ type MapMaker interface {
 	FileSuffix() string
 }
 
+// Variant are build options for previews of a style.
+type Variant struct {
+	// Debug enables the debug mode of all maps that support it.
+	Debug bool
+	// GroupStatus overrides the status of layer groups.
+	GroupStatus map[string]bool
+	// MSS files are parsed after all stylesheets of the style, e.g. to
+	// override single rules for a preview.
+	MSS []string
+	// Vars override MSS variables (see Builder.SetVar).
+	Vars map[string]string
+}
+
+// VariantMaker returns a MapMaker that builds the variant v of all styles.
+// Styles of each variant are cached separately.
+func VariantMaker(mm MapMaker, v Variant) MapMaker {
+	return variantMaker{MapMaker: mm, variant: v}
+}
+
+type variantMaker struct {
+	MapMaker
+	variant Variant
+}
+
+func (m variantMaker) Type() string {
+	t := m.MapMaker.Type()
+	if m.variant.Debug {
+		t += "+debug"
+	}
+	groups := make([]string, 0, len(m.variant.GroupStatus))
+	for name, active := range m.variant.GroupStatus {
+		groups = append(groups, fmt.Sprintf("%s:%t", name, active))
+	}
+	sort.Strings(groups)
+	for _, g := range groups {
+		t += "+" + g
+	}
+	for _, mss := range m.variant.MSS {
+		t += "+mss:" + mss
+	}
+	vars := make([]string, 0, len(m.variant.Vars))
+	for name, value := range m.variant.Vars {
+		vars = append(vars, name+"="+value)
+	}
+	sort.Strings(vars)
+	for _, v := range vars {
+		t += "+var:" + v
+	}
+	return t
+}
+
+func (m variantMaker) New(locator config.Locator) MapWriter {
+	mw := m.MapMaker.New(locator)
+	if s, ok := mw.(DebugSetter); ok && m.variant.Debug {
+		s.SetDebug(true)
+	}
+	return mw
+}
+
 type style struct {
 	mapMaker   MapMaker
 	mml        string
 	mss        []string
+	baseMML    []string // MML files extended by mml
+	metadata   []Metadata
 	file       string
 	lastUpdate time.Time
+	generation int
+	rebuilding bool
+	failedAt   time.Time
 }
 
 func styleHash(mapType string, mml string, mss []string) uint32 {
@@ -59,17 +124,32 @@ func (s *style) isStale() (bool, error) {
 	if err != nil {
 		return true, err
 	}
-	timestamp := info.ModTime()
+	return s.changedSince(info.ModTime()), nil
+}
 
+// changedSince returns whether the MML or any MSS file changed after timestamp.
+func (s *style) changedSince(timestamp time.Time) bool {
 	if isNewer(s.mml, timestamp) {
-		return true, nil
+		return true
+	}
+	for _, mml := range s.baseMML {
+		if isNewer(mml, timestamp) {
+			return true
+		}
 	}
 	for _, mss := range s.mss {
 		if isNewer(mss, timestamp) {
-			return true, nil
+			return true
+		}
+	}
+	if vm, ok := s.mapMaker.(variantMaker); ok {
+		for _, mss := range vm.variant.MSS {
+			if isNewer(mss, timestamp) {
+				return true
+			}
 		}
 	}
-	return false, nil
+	return false
 }
 
 const stylePrefix = "magnacarto-style-"
@@ -78,25 +158,96 @@ const stylePrefix = "magnacarto-style-"
 // It automatically detects changes to the MSS and MML files and rebuilds
 // styles if requested again.
 type Cache struct {
-	mu        sync.Mutex
-	locator   config.Locator
-	styles    map[uint32]*style
-	deferEval bool
-	destDir   string
+	mu         sync.Mutex
+	locator    config.Locator
+	styles     map[uint32]*style
+	deferEval  bool
+	compat     bool
+	metadata   bool
+	destDir    string
+	observer   CacheObserver
+	hooks      *hookRunner
+	logger     *logging.Logger
+	background bool
+	// number of builds running in the background, signals idle when done
+	building int
+	idle     *sync.Cond
+	// files of replaced styles, removed after retireDelay
+	retired []retiredStyle
+}
+
+type retiredStyle struct {
+	file  string
+	since time.Time
+}
+
+// retireDelay before replaced style files are removed. Requests that
+// started before the style was replaced can still load the old file.
+var retireDelay = time.Minute
+
+// CacheObserver gets notified about cache hits and style builds.
+// Methods can be called concurrently, and while the cache is locked.
+// They should return quickly.
+type CacheObserver interface {
+	CacheHit(mml string)
+	StyleBuild(mml string, duration time.Duration, err error)
 }
 
 func NewCache(locator config.Locator, deferEval bool) *Cache {
-	return &Cache{
+	c := &Cache{
 		locator:   locator,
 		deferEval: deferEval,
 		styles:    make(map[uint32]*style),
+		logger:    logging.Default(),
 	}
+	c.idle = sync.NewCond(&c.mu)
+	return c
 }
 
 func (c *Cache) SetDestination(dest string) {
 	c.destDir = dest
 }
 
+func (c *Cache) SetObserver(o CacheObserver) {
+	c.observer = o
+}
+
+// SetBackgroundRebuild enables background rebuilds of changed styles.
+// StyleFile returns the previous build of a changed style until the new
+// build is ready. Failed builds are logged and the previous build is kept
+// until the style changes again. Styles are always build in the foreground
+// if there is no previous build.
+func (c *Cache) SetBackgroundRebuild(enabled bool) {
+	c.background = enabled
+}
+
+// SetCartoCompat enables the symbolizer defaults of carto for all builders that
+// support it.
+func (c *Cache) SetCartoCompat(enabled bool) {
+	c.compat = enabled
+}
+
+// SetMetadata embeds the build metadata in all styles (see
+// Builder.EnableMetadata).
+func (c *Cache) SetMetadata(enabled bool) {
+	c.metadata = enabled
+}
+
+// SetHooks sets commands that run after each build. Hooks run in the
+// background, one after another.
+func (c *Cache) SetHooks(hooks config.Hooks) {
+	if !hasHooks(hooks) {
+		c.hooks = nil
+		return
+	}
+	c.hooks = newHookRunner(hooks)
+}
+
+// SetLogger sets the logger for builds, cleanups and watchers.
+func (c *Cache) SetLogger(l *logging.Logger) {
+	c.logger = l
+}
+
 // ClearAll removes all cached styles.
 // Needs to be called before shutdown to prevent leaking temp files when used _without_ SetDestination.
 // Will remove all cached styles from cache dir when used _with_ SetDestination.
@@ -108,18 +259,26 @@ func (c *Cache) ClearAll() {
 func (c *Cache) ClearTill(till time.Time) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	for c.building > 0 {
+		c.idle.Wait()
+	}
+
+	for _, r := range c.retired {
+		c.removeStyleFiles(r.file)
+	}
+	c.retired = nil
 
 	if c.destDir != "" {
 		// all in same dir. also remove files with different suffixes (e.g. foo.map.font.lst)
 		files, err := filepath.Glob(filepath.Join(c.destDir, stylePrefix+"*"))
 		if err != nil {
-			log.Println("cleanup error: ", err)
+			c.logger.Warn("cleanup error", "err", err)
 			return
 		}
 		for _, f := range files {
 			if fi, err := os.Stat(f); err == nil && fi.ModTime().Before(till) {
 				if err := os.Remove(f); err != nil {
-					log.Println("cleanup error: ", err)
+					c.logger.Warn("cleanup error", "err", err)
 				}
 			}
 		}
@@ -128,7 +287,7 @@ func (c *Cache) ClearTill(till time.Time) {
 		for _, style := range c.styles {
 			if fi, err := os.Stat(style.file); err == nil && fi.ModTime().Before(till) {
 				if err := os.RemoveAll(filepath.Dir(style.file)); err != nil {
-					log.Println(err)
+					c.logger.Warn("cleanup error", "err", err)
 				}
 			}
 		}
@@ -139,6 +298,30 @@ func (c *Cache) ClearTill(till time.Time) {
 	}
 }
 
+// Evict removes all cached styles that are build with the MSS file mss,
+// e.g. after a temporary override was removed. The style files are removed
+// after retireDelay.
+func (c *Cache) Evict(mss string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for hash, s := range c.styles {
+		files := s.mss
+		if vm, ok := s.mapMaker.(variantMaker); ok {
+			files = append(files[:len(files):len(files)], vm.variant.MSS...)
+		}
+		for _, f := range files {
+			if f == mss {
+				if s.file != "" {
+					c.retired = append(c.retired, retiredStyle{file: s.file, since: now})
+				}
+				delete(c.styles, hash)
+				break
+			}
+		}
+	}
+}
+
 type Update struct {
 	Err  error
 	Time time.Time
@@ -174,6 +357,9 @@ func (c *Cache) Notify(mm MapMaker, mml string, mss []string, done <-chan struct
 		}
 	}
 
+	logger := c.logger.With("watch_id", logging.NewID(), "mml", mml)
+	logger.Debug("watching style", "mss", mss)
+
 	go func() {
 		// dummy event to send initial change message to client
 		watcher.Events <- fsnotify.Event{}
@@ -182,6 +368,9 @@ func (c *Cache) Notify(mm MapMaker, mml string, mss []string, done <-chan struct
 		for {
 			select {
 			case evt := <-watcher.Events:
+				if evt.Name != "" {
+					logger.Debug("file changed", "file", evt.Name, "op", evt.Op)
+				}
 				if evt.Op&fsnotify.Remove == fsnotify.Remove {
 					// atomic save of some editors will trigger remove event,
 					// which will remove the file from the watcher. add back again
@@ -193,15 +382,17 @@ func (c *Cache) Notify(mm MapMaker, mml string, mss []string, done <-chan struct
 						updatec <- Update{Err: err}
 					}
 				}
-				style, err := c.style(mm, mml, mss)
+				style, err := c.style(mm, mml, mss, false, logger)
 				if err != nil {
 					updatec <- Update{Err: err}
 				} else {
 					updatec <- Update{Time: style.lastUpdate}
 				}
 			case err := <-watcher.Errors:
+				logger.Warn("watcher error", "err", err)
 				errc <- err
 			case <-done:
+				logger.Debug("stop watching style")
 				watcher.Close()
 				return
 			}
@@ -212,21 +403,47 @@ func (c *Cache) Notify(mm MapMaker, mml string, mss []string, done <-chan struct
 
 // StyleFile returns the filename of the build result. (Re)builds style if required.
 func (c *Cache) StyleFile(mm MapMaker, mml string, mss []string) (string, error) {
-	style, err := c.style(mm, mml, mss)
+	return c.StyleFileWithLogger(mm, mml, mss, c.logger)
+}
+
+// StyleFileWithLogger is like StyleFile, but logs builds and the warnings of
+// the builder to logger. This can be used to add request IDs to build
+// messages, or to collect the warnings of a single build.
+func (c *Cache) StyleFileWithLogger(mm MapMaker, mml string, mss []string, logger *logging.Logger) (string, error) {
+	style, err := c.style(mm, mml, mss, c.background, logger)
 	if err != nil {
 		return "", err
 	}
 	return style.file, nil
 }
 
-func (c *Cache) style(mm MapMaker, mml string, mss []string) (*style, error) {
+// StyleMetadata returns the build metadata of the style. (Re)builds style if
+// required. Returns nil if metadata is not enabled.
+func (c *Cache) StyleMetadata(mm MapMaker, mml string, mss []string) ([]Metadata, error) {
+	style, err := c.style(mm, mml, mss, c.background, c.logger)
+	if err != nil {
+		return nil, err
+	}
+	return style.metadata, nil
+}
+
+// style returns a copy of the (re)build style. Changed styles are rebuild in
+// the background if background is true and if there is a previous build.
+func (c *Cache) style(mm MapMaker, mml string, mss []string, background bool, logger *logging.Logger) (style, error) {
 	hash := styleHash(mm.Type(), mml, mss)
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if s, ok := c.styles[hash]; ok {
 		stale, err := s.isStale()
 		if err != nil {
-			return nil, err
+			return style{}, err
+		}
+		if stale && background && s.file != "" {
+			// keep failed builds until the style files change again
+			if !s.rebuilding && (s.failedAt.IsZero() || s.changedSince(s.failedAt)) {
+				c.rebuildInBackground(hash, s, len(mss) == 0, logger)
+			}
+			return *s, nil
 		}
 		if stale {
 			if len(mss) == 0 {
@@ -234,20 +451,22 @@ func (c *Cache) style(mm MapMaker, mml string, mss []string) (*style, error) {
 				// refresh mss files
 				s.mss, err = mssFilesFromMML(mml)
 				if err != nil {
-					return nil, err
+					return style{}, err
 				}
 			}
-			if err := c.build(s); err != nil {
-				return nil, err
+			if err := c.build(s, logger); err != nil {
+				return style{}, err
 			}
+		} else if c.observer != nil {
+			c.observer.CacheHit(mml)
 		}
-		return s, nil
+		return *s, nil
 	} else {
 		if len(mss) == 0 {
 			var err error
 			mss, err = mssFilesFromMML(mml)
 			if err != nil {
-				return nil, err
+				return style{}, err
 			}
 		}
 		s = &style{
@@ -255,79 +474,233 @@ func (c *Cache) style(mm MapMaker, mml string, mss []string) (*style, error) {
 			mml:      mml,
 			mss:      mss,
 		}
-		if err := c.build(s); err != nil {
-			return nil, err
+		if err := c.build(s, logger); err != nil {
+			return style{}, err
 		}
 		c.styles[hash] = s
-		return s, nil
+		return *s, nil
 	}
 }
 
-func (c *Cache) build(style *style) error {
+// build (re)builds style. Needs to be called with locked cache.
+func (c *Cache) build(style *style, logger *logging.Logger) error {
+	file, err := c.buildLogged(style, style.generation+1, logger)
+	if err != nil {
+		return err
+	}
+	c.replace(style, file)
+	return nil
+}
+
+// rebuildInBackground rebuilds style (cached as hash) without locking the
+// cache during the build. Needs to be called with locked cache.
+func (c *Cache) rebuildInBackground(hash uint32, s *style, refreshMSS bool, logger *logging.Logger) {
+	s.rebuilding = true
+	next := *s
+	c.building++
+	go func() {
+		var err error
+		var file string
+		if refreshMSS {
+			next.mss, err = mssFilesFromMML(next.mml)
+			if err != nil {
+				logger.Error("style build failed", "mml", next.mml, "err", err)
+			}
+		}
+		if err == nil {
+			file, err = c.buildLogged(&next, next.generation+1, logger)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.building--
+		c.idle.Broadcast()
+		s.rebuilding = false
+		if err != nil {
+			s.failedAt = time.Now()
+			return
+		}
+		if c.styles[hash] != s {
+			// evicted or cleared during the build, the new file was never
+			// returned
+			c.removeStyleFiles(file)
+			return
+		}
+		s.mss = next.mss
+		s.baseMML = next.baseMML
+		s.metadata = next.metadata
+		c.replace(s, file)
+	}()
+}
+
+// replace the file of style with a new build. The old file is retired.
+// Needs to be called with locked cache.
+func (c *Cache) replace(style *style, file string) {
+	now := time.Now()
+	if style.file != "" {
+		c.retired = append(c.retired, retiredStyle{file: style.file, since: now})
+	}
+	style.file = file
+	style.generation++
+	style.lastUpdate = now
+	style.failedAt = time.Time{}
+
+	retired := c.retired[:0]
+	for _, r := range c.retired {
+		if now.Sub(r.since) >= retireDelay {
+			c.removeStyleFiles(r.file)
+		} else {
+			retired = append(retired, r)
+		}
+	}
+	c.retired = retired
+}
+
+// removeStyleFiles removes the files of a single build.
+func (c *Cache) removeStyleFiles(file string) {
+	if c.destDir == "" {
+		// each build is in its own temp dir
+		if err := os.RemoveAll(filepath.Dir(file)); err != nil {
+			c.logger.Warn("cleanup error", "err", err)
+		}
+		return
+	}
+	// also remove files with different suffixes (e.g. foo.map-fonts.lst)
+	files, err := filepath.Glob(file + "*")
+	if err != nil {
+		c.logger.Warn("cleanup error", "err", err)
+		return
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			c.logger.Warn("cleanup error", "err", err)
+		}
+	}
+}
+
+// buildLogged builds style and logs and reports the result.
+func (c *Cache) buildLogged(style *style, generation int, logger *logging.Logger) (string, error) {
+	logger = logger.With("build_id", logging.NewID(), "mml", style.mml, "builder", style.mapMaker.Type())
+	logger.Debug("building style", "mss", style.mss)
+
+	start := time.Now()
+	file, err := c.buildStyle(style, generation, logger)
+	duration := time.Since(start)
+	if c.observer != nil {
+		c.observer.StyleBuild(style.mml, duration, err)
+	}
+	if err != nil {
+		logger.Error("style build failed", "err", err, "duration", duration)
+	} else {
+		logger.Info("rebuild style", "file", file, "mss", style.mss, "duration", duration)
+	}
+	if c.hooks != nil {
+		c.hooks.add(BuildResult{MML: style.mml, Builder: style.mapMaker.Type(), File: file, Err: err}, logger)
+	}
+	return file, err
+}
+
+// buildStyle builds style and returns the file name. Each generation of a
+// style is written to a new file, so that the previous build stays
+// available until it is replaced. Warnings of the builder are logged to
+// logger.
+func (c *Cache) buildStyle(style *style, generation int, logger *logging.Logger) (string, error) {
 	m := style.mapMaker.New(c.locator)
+	if s, ok := m.(CartoCompatSetter); ok && c.compat {
+		s.SetCartoCompat(true)
+	}
 	builder := New(m)
+	builder.SetLogger(logger)
+	target := style.mapMaker.Type()
+	var variantMSS []string
+	if vm, ok := style.mapMaker.(variantMaker); ok {
+		builder.SetGroupStatus(vm.variant.GroupStatus)
+		for name, value := range vm.variant.Vars {
+			builder.SetVar(name, value)
+		}
+		target = vm.MapMaker.Type()
+		variantMSS = vm.variant.MSS
+	}
+	builder.Define("target", target)
 
 	if c.deferEval {
 		builder.EnableDeferredEval()
 	}
+	if c.metadata {
+		builder.EnableMetadata()
+	}
 	builder.SetMML(style.mml)
 	for _, mss := range style.mss {
 		builder.AddMSS(mss)
 	}
+	for _, mss := range variantMSS {
+		builder.AddMSS(mss)
+	}
 
 	if err := builder.Build(); err != nil {
-		return err
+		return "", err
 	}
+	style.baseMML = builder.BaseMMLFiles()
+	style.metadata = builder.Metadata()
 
 	var styleFile string
 	if c.destDir != "" {
 		hash := styleHash(style.mapMaker.Type(), style.mml, style.mss)
-		styleFile = filepath.Join(c.destDir, fmt.Sprintf("magnacarto-style-%d%s", hash, style.mapMaker.FileSuffix()))
+		styleFile = filepath.Join(c.destDir, fmt.Sprintf("%s%d-%d%s", stylePrefix, hash, generation, style.mapMaker.FileSuffix()))
 		if err := m.WriteFiles(styleFile); err != nil {
-			return err
+			return "", err
 		}
 	} else {
 		tmp, err := ioutil.TempDir("", "magnacarto-style")
 		if err != nil {
-			return err
+			return "", err
 		}
 		styleFile = filepath.Join(tmp, "style"+style.mapMaker.FileSuffix())
 		if err := m.WriteFiles(styleFile); err != nil {
 			os.RemoveAll(tmp)
-			return err
+			return "", err
 		}
 	}
-	log.Printf("rebuild style %s as %s with %v\n", style.mml, styleFile, style.mss)
-	style.lastUpdate = time.Now()
-	style.file = styleFile
-	return nil
+	return styleFile, nil
 }
 
 func mssFilesFromMML(mmlFile string) ([]string, error) {
-	r, err := os.Open(mmlFile)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
+	mss, _, err := ProjectFiles(mmlFile)
+	return mss, err
+}
 
-	mml, err := mmlparse.Parse(r)
+// ProjectFiles returns the stylesheets (relative to the working dir) and the
+// extended MML files of mmlFile. These are all files that change the style
+// of the MML, besides mmlFile itself.
+func ProjectFiles(mmlFile string) (stylesheets, baseFiles []string, err error) {
+	mml, err := mmlparse.Load(mmlFile)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return stylesheetFiles(mmlFile, mml), mml.BaseFiles, nil
+}
+
+// stylesheetFiles returns the stylesheets of mml relative to the working dir.
+func stylesheetFiles(mmlFile string, mml *mmlparse.MML) []string {
 	mssFiles := []string{}
 	for _, s := range mml.Stylesheets {
-		mssFiles = append(mssFiles, filepath.Join(filepath.Dir(mmlFile), s))
+		if !filepath.IsAbs(s) {
+			s = filepath.Join(filepath.Dir(mmlFile), s)
+		}
+		mssFiles = append(mssFiles, s)
 	}
-	return mssFiles, nil
+	return mssFiles
 }
 
+// watchMSSFromMML adds the mss files and the extended MML files of mmlFile to
+// the watcher.
 func watchMSSFromMML(watcher *fsnotify.Watcher, mmlFile string) error {
-	mssFiles, err := mssFilesFromMML(mmlFile)
+	stylesheets, baseFiles, err := ProjectFiles(mmlFile)
 	if err != nil {
 		return err
 	}
-	for _, mssFile := range mssFiles {
-		if err := watcher.Add(mssFile); err != nil {
+	for _, f := range append(stylesheets, baseFiles...) {
+		if err := watcher.Add(f); err != nil {
 			return err
 		}
 	}
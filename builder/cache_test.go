@@ -1,11 +1,19 @@
 package builder
 
 import (
+	"bytes"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
 )
 
 func TestIsStale(t *testing.T) {
@@ -16,8 +24,9 @@ func TestIsStale(t *testing.T) {
 	defer os.RemoveAll(dir)
 
 	s := style{
-		mml: filepath.Join(dir, "foo.mml"),
-		mss: []string{filepath.Join(dir, "foo.mss")},
+		mml:     filepath.Join(dir, "foo.mml"),
+		mss:     []string{filepath.Join(dir, "foo.mss")},
+		baseMML: []string{filepath.Join(dir, "base.mml")},
 	}
 
 	f, err := os.Create(s.mml)
@@ -25,6 +34,11 @@ func TestIsStale(t *testing.T) {
 		t.Fatal(err)
 	}
 	f.Close()
+	f, err = os.Create(s.baseMML[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
 	f, err = os.Create(s.mss[0])
 	if err != nil {
 		t.Fatal(err)
@@ -73,4 +87,327 @@ func TestIsStale(t *testing.T) {
 		t.Fatal(stale, err)
 	}
 
+	// touch extended mml file
+	if err := os.Chtimes(s.file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	future = time.Now().Add(time.Minute * 3)
+	if err := os.Chtimes(s.baseMML[0], future, future); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err := s.isStale(); !stale || err != nil {
+		t.Fatal(stale, err)
+	}
+
+}
+
+type testMaker struct{}
+
+func (testMaker) Type() string       { return "test" }
+func (testMaker) FileSuffix() string { return ".txt" }
+func (testMaker) New(config.Locator) MapWriter {
+	return &testMap{}
+}
+
+type testMap struct {
+	layers   []mml.Layer
+	rules    [][]mss.Rule
+	debug    bool
+	metadata []Metadata
+}
+
+func (m *testMap) SetDebug(enable bool)      { m.debug = enable }
+func (m *testMap) SetMetadata(md []Metadata) { m.metadata = md }
+
+func (m *testMap) AddLayer(l mml.Layer, rules []mss.Rule) {
+	m.layers = append(m.layers, l)
+	m.rules = append(m.rules, rules)
+}
+func (m *testMap) Write(w io.Writer) error { return nil }
+func (m *testMap) WriteFiles(basename string) error {
+	return ioutil.WriteFile(basename, []byte("test"), 0644)
+}
+
+type testObserver struct {
+	hits   int
+	builds int
+	errors int
+}
+
+func (o *testObserver) CacheHit(mml string) { o.hits++ }
+func (o *testObserver) StyleBuild(mml string, d time.Duration, err error) {
+	o.builds++
+	if err != nil {
+		o.errors++
+	}
+}
+
+func TestProjectFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	baseFile := filepath.Join(dir, "base.mml")
+	mmlFile := filepath.Join(dir, "project.mml")
+	if err := ioutil.WriteFile(baseFile, []byte(`{"Stylesheet": ["base.mss"], "Layer": [{"name": "roads"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"extends": "base.mml", "Stylesheet": ["style/project.mss", "/abs.mss"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stylesheets, baseFiles, err := ProjectFiles(mmlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(dir, "base.mss"), filepath.Join(dir, "style/project.mss"), "/abs.mss"}
+	if strings.Join(stylesheets, ",") != strings.Join(want, ",") {
+		t.Errorf("unexpected stylesheets %v", stylesheets)
+	}
+	if len(baseFiles) != 1 || filepath.Base(baseFiles[0]) != "base.mml" {
+		t.Errorf("unexpected base files %v", baseFiles)
+	}
+	if _, _, err := ProjectFiles(filepath.Join(dir, "missing.mml")); err == nil {
+		t.Error("missing MML did not return an error")
+	}
+}
+
+func TestCacheObserver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	mssFile := filepath.Join(dir, "test.mss")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"], "Layer": [{"name": "roads"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mssFile, []byte(`#roads { line-width: 1; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache(&config.LookupLocator{}, false)
+	c.SetDestination(dir)
+	o := &testObserver{}
+	c.SetObserver(o)
+	logs := &bytes.Buffer{}
+	c.SetLogger(logging.New(logs, logging.Info, false))
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.StyleFile(testMaker{}, mmlFile, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if o.builds != 1 || o.hits != 2 || o.errors != 0 {
+		t.Errorf("unexpected observations %#v", o)
+	}
+
+	// invalid mss
+	future := time.Now().Add(time.Minute)
+	if err := ioutil.WriteFile(mssFile, []byte(`#roads { line-width: `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(mssFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+	logs.Reset()
+	reqLogger := logging.New(logs, logging.Info, false).With("request_id", "req1")
+	if _, err := c.StyleFileWithLogger(testMaker{}, mmlFile, nil, reqLogger); err == nil {
+		t.Fatal("invalid mss did not return an error")
+	}
+	if o.builds != 2 || o.hits != 2 || o.errors != 1 {
+		t.Errorf("unexpected observations %#v", o)
+	}
+	if l := logs.String(); !strings.Contains(l, "ERROR style build failed request_id=req1 build_id=") {
+		t.Errorf("unexpected log output %q", l)
+	}
+}
+
+func TestCacheBackgroundRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	mssFile := filepath.Join(dir, "test.mss")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"], "Layer": [{"name": "roads"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mssFile, []byte(`#roads { line-width: 1; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache(&config.LookupLocator{}, false)
+	c.SetDestination(dir)
+	c.SetBackgroundRebuild(true)
+	c.SetLogger(nil)
+	o := &testObserver{}
+	c.SetObserver(o)
+
+	waitBuilds := func() {
+		c.mu.Lock()
+		for c.building > 0 {
+			c.idle.Wait()
+		}
+		c.mu.Unlock()
+	}
+	// mark style file as older than the mss
+	touch := func(fname string, age time.Duration) {
+		past := time.Now().Add(-age)
+		if err := os.Chtimes(fname, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first, err := c.StyleFile(testMaker{}, mmlFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.builds != 1 {
+		t.Fatal("first build not in foreground", o.builds)
+	}
+
+	touch(first, 2*time.Minute)
+	touch(mssFile, time.Minute)
+
+	// previous file is returned while rebuilding
+	file, err := c.StyleFile(testMaker{}, mmlFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file != first {
+		t.Error("expected previous style file", file)
+	}
+	waitBuilds()
+	second, err := c.StyleFile(testMaker{}, mmlFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Error("expected new style file")
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Error("previous style file removed too early", err)
+	}
+
+	// failed builds keep the previous style
+	touch(second, 2*time.Minute)
+	if err := ioutil.WriteFile(mssFile, []byte(`#roads { line-width: `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	touch(mssFile, time.Minute)
+	if file, err := c.StyleFile(testMaker{}, mmlFile, nil); err != nil || file != second {
+		t.Fatal(file, err)
+	}
+	waitBuilds()
+	if file, err := c.StyleFile(testMaker{}, mmlFile, nil); err != nil || file != second {
+		t.Fatal(file, err)
+	}
+	waitBuilds()
+	if o.builds != 3 || o.errors != 1 {
+		t.Errorf("failed build not kept %#v", o)
+	}
+
+	c.ClearAll()
+	if files, _ := filepath.Glob(filepath.Join(dir, stylePrefix+"*")); len(files) != 0 {
+		t.Error("style files not removed", files)
+	}
+}
+
+// evictObserver evicts mss after the next build.
+type evictObserver struct {
+	c     *Cache
+	mss   string
+	evict bool
+}
+
+func (o *evictObserver) CacheHit(mml string) {}
+func (o *evictObserver) StyleBuild(mml string, d time.Duration, err error) {
+	if o.evict {
+		o.c.Evict(o.mss)
+	}
+}
+
+func TestCacheEvictWhileRebuilding(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	mssFile := filepath.Join(dir, "test.mss")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"], "Layer": [{"name": "roads"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mssFile, []byte(`#roads { line-width: 1; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache(&config.LookupLocator{}, false)
+	c.SetDestination(dir)
+	c.SetBackgroundRebuild(true)
+	c.SetLogger(nil)
+	o := &evictObserver{c: c, mss: mssFile}
+	c.SetObserver(o)
+	defer c.ClearAll()
+
+	first, err := c.StyleFile(testMaker{}, mmlFile, []string{mssFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(first, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	// the background build is evicted before it replaces the style
+	o.evict = true
+	if file, err := c.StyleFile(testMaker{}, mmlFile, []string{mssFile}); err != nil || file != first {
+		t.Fatal(file, err)
+	}
+	c.mu.Lock()
+	for c.building > 0 {
+		c.idle.Wait()
+	}
+	c.mu.Unlock()
+	o.evict = false
+
+	if files, _ := filepath.Glob(filepath.Join(dir, stylePrefix+"*")); len(files) != 1 || files[0] != first {
+		t.Error("file of evicted build not removed", files)
+	}
+	if len(c.styles) != 0 {
+		t.Error("evicted style still cached", c.styles)
+	}
+}
+
+func TestVariantMaker(t *testing.T) {
+	mm := VariantMaker(testMaker{}, Variant{Debug: true})
+	if mm.Type() == (testMaker{}).Type() {
+		t.Error("debug styles need a separate cache type", mm.Type())
+	}
+	groups := VariantMaker(testMaker{}, Variant{GroupStatus: map[string]bool{"roads": false, "labels": true}})
+	if typ := groups.Type(); typ != "test+labels:true+roads:false" {
+		t.Error("unexpected type", typ)
+	}
+	overrides := VariantMaker(testMaker{}, Variant{MSS: []string{"/tmp/a.mss"}})
+	if typ := overrides.Type(); typ != "test+mss:/tmp/a.mss" {
+		t.Error("unexpected type", typ)
+	}
+	vars := VariantMaker(testMaker{}, Variant{Vars: map[string]string{"width": "2", "color": "red"}})
+	if typ := vars.Type(); typ != "test+var:color=red+var:width=2" {
+		t.Error("unexpected type", typ)
+	}
+	if m := mm.New(&config.LookupLocator{}).(*testMap); !m.debug {
+		t.Error("debug not enabled")
+	}
+	if m := (testMaker{}).New(&config.LookupLocator{}).(*testMap); m.debug {
+		t.Error("debug enabled")
+	}
 }
@@ -0,0 +1,96 @@
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+// BuildResult describes a finished style build for hooks.
+type BuildResult struct {
+	MML     string
+	Builder string
+	// File of the style, empty if the build failed.
+	File string
+	Err  error
+}
+
+func (r BuildResult) env() []string {
+	env := []string{
+		"MAGNACARTO_MML=" + r.MML,
+		"MAGNACARTO_BUILDER=" + r.Builder,
+		"MAGNACARTO_STYLE=" + r.File,
+	}
+	if r.Err != nil {
+		env = append(env, "MAGNACARTO_ERROR="+r.Err.Error())
+	}
+	return env
+}
+
+// RunHooks runs the OnSuccess or OnFailure commands of hooks, depending on
+// the result. Commands run in the shell, with MAGNACARTO_MML,
+// MAGNACARTO_BUILDER, MAGNACARTO_STYLE and MAGNACARTO_ERROR environment
+// variables. RunHooks stops at the first failing command.
+func RunHooks(hooks config.Hooks, result BuildResult, logger *logging.Logger) error {
+	cmds := hooks.OnSuccess
+	if result.Err != nil {
+		cmds = hooks.OnFailure
+	}
+	env := append(os.Environ(), result.env()...)
+	for _, c := range cmds {
+		out, err := shellCommand(c, env).CombinedOutput()
+		out = bytes.TrimSpace(out)
+		if err != nil {
+			logger.Error("hook failed", "mml", result.MML, "cmd", c, "err", err, "output", string(out))
+			return fmt.Errorf("hook '%s' failed: %s", c, err)
+		}
+		logger.Info("hook finished", "mml", result.MML, "cmd", c, "output", string(out))
+	}
+	return nil
+}
+
+func shellCommand(c string, env []string) *exec.Cmd {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", c)
+	} else {
+		cmd = exec.Command("sh", "-c", c)
+	}
+	cmd.Env = env
+	return cmd
+}
+
+func hasHooks(hooks config.Hooks) bool {
+	return len(hooks.OnSuccess) > 0 || len(hooks.OnFailure) > 0
+}
+
+// hookRunner runs hooks one after another in the background.
+type hookRunner struct {
+	hooks config.Hooks
+	queue chan queuedHook
+}
+
+type queuedHook struct {
+	result BuildResult
+	logger *logging.Logger
+}
+
+func newHookRunner(hooks config.Hooks) *hookRunner {
+	r := &hookRunner{hooks: hooks, queue: make(chan queuedHook, 16)}
+	go func() {
+		for h := range r.queue {
+			RunHooks(r.hooks, h.result, h.logger)
+		}
+	}()
+	return r
+}
+
+// add queues the hooks for result. Blocks if too many hooks are pending.
+func (r *hookRunner) add(result BuildResult, logger *logging.Logger) {
+	r.queue <- queuedHook{result: result, logger: logger}
+}
@@ -0,0 +1,51 @@
+package builder
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/omniscale/magnacarto/config"
+)
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires sh")
+	}
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+
+	hooks := config.Hooks{
+		OnSuccess: []string{
+			`echo "ok $MAGNACARTO_BUILDER $MAGNACARTO_STYLE" >> ` + out,
+			`false`,
+			`echo "not reached" >> ` + out,
+		},
+		OnFailure: []string{
+			`echo "failed $MAGNACARTO_MML: $MAGNACARTO_ERROR" >> ` + out,
+		},
+	}
+
+	err = RunHooks(hooks, BuildResult{MML: "foo.mml", Builder: "mapnik3", File: "/tmp/style.xml"}, nil)
+	if err == nil {
+		t.Error("expected error from failing hook")
+	}
+	if err := RunHooks(hooks, BuildResult{MML: "foo.mml", Builder: "mapnik3", Err: errors.New("syntax error")}, nil); err != nil {
+		t.Error(err)
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ok mapnik3 /tmp/style.xml\nfailed foo.mml: syntax error\n" {
+		t.Errorf("unexpected hook output %q", b)
+	}
+}
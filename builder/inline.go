@@ -0,0 +1,276 @@
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/mml"
+)
+
+// SetInlineDir sets the dir for the GeoJSON files of inline datasources.
+// Defaults to magnacarto-inline in the temp dir. Files are named by the hash
+// of their content, so unchanged datasources are only written once.
+func (b *Builder) SetInlineDir(dir string) {
+	b.inlineDir = dir
+}
+
+// inlineLayer replaces the Inline datasource of l with an OGR datasource of
+// a GeoJSON file.
+func (b *Builder) inlineLayer(l *mml.Layer) error {
+	ds, ok := l.Datasource.(mml.Inline)
+	if !ok {
+		return nil
+	}
+	var fc map[string]interface{}
+	var err error
+	if ds.Format == "csv" {
+		fc, err = csvFeatures(ds.Data)
+	} else {
+		fc, err = featureCollection(ds.Data)
+	}
+	if err != nil {
+		return fmt.Errorf("inline datasource of layer %s: %s", l.Name, err)
+	}
+	dir := b.inlineDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "magnacarto-inline")
+	}
+	ogr, err := writeInline(dir, fc)
+	if err != nil {
+		return fmt.Errorf("inline datasource of layer %s: %s", l.Name, err)
+	}
+	ogr.Id = ds.Id
+	ogr.SRID = ds.SRID
+	if l.SRS == "" && ds.SRID == "" {
+		// GeoJSON is always WGS84
+		l.SRS = "+init=epsg:4326"
+	}
+	l.Datasource = ogr
+	return nil
+}
+
+// writeInline writes fc to dir, if it does not exist. The name of the file
+// is also used as OGR layer name.
+func writeInline(dir string, fc map[string]interface{}) (mml.OGR, error) {
+	data, err := json.Marshal(fc)
+	if err != nil {
+		return mml.OGR{}, err
+	}
+	hash := sha256.Sum256(data)
+	name := "inline-" + hex.EncodeToString(hash[:8])
+	fc["name"] = name
+	if data, err = json.Marshal(fc); err != nil {
+		return mml.OGR{}, err
+	}
+
+	fname := filepath.Join(dir, name+".geojson")
+	if _, err := os.Stat(fname); err == nil {
+		return mml.OGR{Filename: fname, Layer: name}, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return mml.OGR{}, err
+	}
+	// write atomically, concurrent builds can write the same file
+	tmp, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return mml.OGR{}, err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return mml.OGR{}, err
+	}
+	return mml.OGR{Filename: fname, Layer: name}, nil
+}
+
+// featureCollection returns the GeoJSON object data as FeatureCollection.
+// Single features and geometries are wrapped.
+func featureCollection(data string) (map[string]interface{}, error) {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &obj); err != nil {
+		return nil, err
+	}
+	switch obj["type"] {
+	case "FeatureCollection":
+		return obj, nil
+	case "Feature":
+	case "Point", "MultiPoint", "LineString", "MultiLineString", "Polygon", "MultiPolygon", "GeometryCollection":
+		obj = map[string]interface{}{"type": "Feature", "geometry": obj, "properties": map[string]interface{}{}}
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON type %v", obj["type"])
+	}
+	return map[string]interface{}{"type": "FeatureCollection", "features": []interface{}{obj}}, nil
+}
+
+// csvFeatures converts CSV with a header row to a FeatureCollection. The
+// geometry is either in a wkt/geometry column, or in lon/lat (or x/y)
+// columns. Like the CSV plugin of Mapnik, numeric values are converted to
+// numbers.
+func csvFeatures(data string) (map[string]interface{}, error) {
+	r := csv.NewReader(strings.NewReader(data))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing CSV header")
+	}
+	header := records[0]
+	wkt, lon, lat := -1, -1, -1
+	for i, h := range header {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "wkt", "geometry", "geom":
+			wkt = i
+		case "lon", "lng", "long", "longitude", "x":
+			lon = i
+		case "lat", "latitude", "y":
+			lat = i
+		}
+	}
+	if wkt < 0 && (lon < 0 || lat < 0) {
+		return nil, fmt.Errorf("CSV needs a wkt column or lon and lat columns, got %v", header)
+	}
+
+	features := []interface{}{}
+	for n, rec := range records[1:] {
+		var geom map[string]interface{}
+		if wkt >= 0 {
+			geom, err = parseWKT(rec[wkt])
+		} else {
+			var x, y float64
+			if x, err = strconv.ParseFloat(strings.TrimSpace(rec[lon]), 64); err == nil {
+				y, err = strconv.ParseFloat(strings.TrimSpace(rec[lat]), 64)
+			}
+			geom = map[string]interface{}{"type": "Point", "coordinates": []float64{x, y}}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("CSV row %d: %s", n+2, err)
+		}
+		props := map[string]interface{}{}
+		for i, v := range rec {
+			if i == wkt || i == lon || i == lat {
+				continue
+			}
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				props[header[i]] = f
+			} else {
+				props[header[i]] = v
+			}
+		}
+		features = append(features, map[string]interface{}{"type": "Feature", "geometry": geom, "properties": props})
+	}
+	return map[string]interface{}{"type": "FeatureCollection", "features": features}, nil
+}
+
+var wktTypes = map[string]string{
+	"POINT":           "Point",
+	"MULTIPOINT":      "MultiPoint",
+	"LINESTRING":      "LineString",
+	"MULTILINESTRING": "MultiLineString",
+	"POLYGON":         "Polygon",
+	"MULTIPOLYGON":    "MultiPolygon",
+}
+
+// parseWKT converts a WKT geometry to a GeoJSON geometry. GeometryCollections
+// and Z/M coordinates are not supported.
+func parseWKT(wkt string) (map[string]interface{}, error) {
+	wkt = strings.TrimSpace(wkt)
+	i := strings.Index(wkt, "(")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid WKT %q", wkt)
+	}
+	typ, ok := wktTypes[strings.ToUpper(strings.TrimSpace(wkt[:i]))]
+	if !ok {
+		return nil, fmt.Errorf("unsupported WKT geometry %q", strings.TrimSpace(wkt[:i]))
+	}
+	coords, rest, err := wktCoords(wkt[i:])
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, fmt.Errorf("invalid WKT %q", wkt)
+	}
+	var c interface{} = coords
+	switch typ {
+	case "Point":
+		if len(coords) != 1 {
+			return nil, fmt.Errorf("invalid WKT %q", wkt)
+		}
+		c = coords[0]
+	case "MultiPoint":
+		// MULTIPOINT ((1 2), (3 4))
+		for i := range coords {
+			if p, ok := coords[i].([]interface{}); ok && len(p) == 1 {
+				coords[i] = p[0]
+			}
+		}
+	}
+	return map[string]interface{}{"type": typ, "coordinates": c}, nil
+}
+
+// wktCoords parses a parenthesized list of coordinates or nested lists, and
+// returns the remaining string.
+func wktCoords(s string) ([]interface{}, string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, fmt.Errorf("expected ( in WKT at %q", s)
+	}
+	s = strings.TrimSpace(s[1:])
+	result := []interface{}{}
+	if strings.HasPrefix(s, "(") {
+		for {
+			nested, rest, err := wktCoords(s)
+			if err != nil {
+				return nil, rest, err
+			}
+			result = append(result, nested)
+			rest = strings.TrimSpace(rest)
+			if strings.HasPrefix(rest, ",") {
+				s = rest[1:]
+				continue
+			}
+			if strings.HasPrefix(rest, ")") {
+				return result, rest[1:], nil
+			}
+			return nil, rest, fmt.Errorf("expected , or ) in WKT at %q", rest)
+		}
+	}
+	end := strings.Index(s, ")")
+	if end < 0 {
+		return nil, s, fmt.Errorf("missing ) in WKT")
+	}
+	for _, p := range strings.Split(s[:end], ",") {
+		fields := strings.Fields(p)
+		if len(fields) != 2 {
+			return nil, s, fmt.Errorf("invalid WKT coordinate %q", strings.TrimSpace(p))
+		}
+		c := make([]float64, 2)
+		for i, f := range fields {
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return nil, s, fmt.Errorf("invalid WKT coordinate %q", strings.TrimSpace(p))
+			}
+			c[i] = v
+		}
+		result = append(result, c)
+	}
+	return result, s[end+1:], nil
+}
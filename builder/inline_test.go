@@ -0,0 +1,129 @@
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/magnacarto/mml"
+)
+
+func TestParseWKT(t *testing.T) {
+	for _, tc := range []struct {
+		wkt      string
+		expected string
+	}{
+		{"POINT(7 50)", `{"coordinates":[7,50],"type":"Point"}`},
+		{"point (7.5 -50)", `{"coordinates":[7.5,-50],"type":"Point"}`},
+		{"MULTIPOINT ((1 2), (3 4))", `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+		{"MULTIPOINT (1 2, 3 4)", `{"coordinates":[[1,2],[3,4]],"type":"MultiPoint"}`},
+		{"LINESTRING (0 0, 1 1)", `{"coordinates":[[0,0],[1,1]],"type":"LineString"}`},
+		{"POLYGON ((0 0, 1 0, 1 1, 0 0), (0.2 0.2, 0.5 0.2, 0.5 0.5, 0.2 0.2))", `{"coordinates":[[[0,0],[1,0],[1,1],[0,0]],[[0.2,0.2],[0.5,0.2],[0.5,0.5],[0.2,0.2]]],"type":"Polygon"}`},
+		{"MULTIPOLYGON (((0 0, 1 0, 1 1, 0 0)), ((5 5, 6 5, 6 6, 5 5)))", `{"coordinates":[[[[0,0],[1,0],[1,1],[0,0]]],[[[5,5],[6,5],[6,6],[5,5]]]],"type":"MultiPolygon"}`},
+	} {
+		geom, err := parseWKT(tc.wkt)
+		if err != nil {
+			t.Errorf("%s: %s", tc.wkt, err)
+			continue
+		}
+		if got, _ := json.Marshal(geom); string(got) != tc.expected {
+			t.Errorf("%s: unexpected geometry %s", tc.wkt, got)
+		}
+	}
+	for _, wkt := range []string{"", "POINT", "POINT (1)", "POINT (1 2, 3 4)", "POINT (1 2", "CIRCLE (1 2)", "LINESTRING ((0 0) x", "POINT Z (1 2 3)", "POINT (1 2) x"} {
+		if _, err := parseWKT(wkt); err == nil {
+			t.Errorf("expected error for %q", wkt)
+		}
+	}
+}
+
+func TestCSVFeatures(t *testing.T) {
+	fc, err := csvFeatures("name,lat,lon,pop\nBonn,50.7,7.1,330000\nKöln, 50.9, 6.9,n/a\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	features := fc["features"].([]interface{})
+	if len(features) != 2 {
+		t.Fatal("unexpected features", features)
+	}
+	expected := map[string]interface{}{
+		"type":       "Feature",
+		"geometry":   map[string]interface{}{"type": "Point", "coordinates": []float64{6.9, 50.9}},
+		"properties": map[string]interface{}{"name": "Köln", "pop": "n/a"},
+	}
+	if !reflect.DeepEqual(features[1], expected) {
+		t.Errorf("unexpected feature %#v", features[1])
+	}
+
+	for _, data := range []string{"", "name,value\na,1\n", "name,lon,lat\na,x,1\n", "wkt\nPOINT(1)\n"} {
+		if _, err := csvFeatures(data); err == nil {
+			t.Errorf("expected error for %q", data)
+		}
+	}
+}
+
+func TestBuildInline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"], "Layer": [
+		{"name": "marker", "Datasource": {"inline": {"type": "Feature", "geometry": {"type": "Point", "coordinates": [7.1, 50.7]}, "properties": {"name": "Bonn"}}}},
+		{"name": "cities", "srs": "+init=epsg:3857", "Datasource": {"type": "csv", "srid": "3857", "inline": "name,x,y\nBonn,790000,6570000\n"}}
+	]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`#marker, #cities { marker-width: 5; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	inlineDir := filepath.Join(dir, "inline")
+	build := func() *testMap {
+		m := &testMap{}
+		b := New(m)
+		b.SetMML(mmlFile)
+		b.SetInlineDir(inlineDir)
+		if err := b.Build(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	m := build()
+	if len(m.layers) != 2 {
+		t.Fatal("unexpected layers", m.layers)
+	}
+	marker, ok := m.layers[0].Datasource.(mml.OGR)
+	if !ok || filepath.Dir(marker.Filename) != inlineDir || marker.Layer == "" || m.layers[0].SRS != "+init=epsg:4326" {
+		t.Fatalf("unexpected layer %#v", m.layers[0])
+	}
+	content, err := ioutil.ReadFile(marker.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := struct {
+		Type     string
+		Name     string
+		Features []struct{ Properties map[string]interface{} }
+	}{}
+	if err := json.Unmarshal(content, &fc); err != nil {
+		t.Fatal(err)
+	}
+	if fc.Type != "FeatureCollection" || fc.Name != marker.Layer || len(fc.Features) != 1 || fc.Features[0].Properties["name"] != "Bonn" {
+		t.Errorf("unexpected GeoJSON %s", content)
+	}
+	if cities := m.layers[1]; cities.SRS != "+init=epsg:3857" || cities.Datasource.(mml.OGR).SRID != "3857" {
+		t.Errorf("unexpected layer %#v", cities)
+	}
+
+	// same files for the next build
+	build()
+	if files, _ := ioutil.ReadDir(inlineDir); len(files) != 2 {
+		t.Error("unexpected inline files", len(files))
+	}
+}
@@ -12,6 +12,22 @@ type XMLMap struct {
 	FontSets   []FontSet   `xml:"FontSet"`
 	Styles     []Style     `xml:"Style"`
 	Layers     []Layer     `xml:"Layer"`
+	XMLNSXI    string      `xml:"xmlns:xi,attr,omitempty"`
+	Includes   []XInclude  `xml:"xi:include"`
+}
+
+// XInclude includes an XMLInclude file into the map. Requires the libxml2
+// XML loader of Mapnik.
+type XInclude struct {
+	Href string `xml:"href,attr"`
+}
+
+// XMLInclude is the root of all included files. Mapnik adds all styles and
+// layers of an Include to the map.
+type XMLInclude struct {
+	XMLName xml.Name `xml:"Include"`
+	Styles  []Style  `xml:"Style"`
+	Layers  []Layer  `xml:"Layer"`
 }
 
 type Parameter struct {
@@ -84,6 +100,7 @@ type PolygonPatternSymbolizer struct {
 	XMLName   xml.Name `xml:"PolygonPatternSymbolizer"`
 	File      *string  `xml:"file,attr"`
 	Alignment *string  `xml:"alignment,attr"`
+	Transform *string  `xml:"transform,attr"`
 }
 
 type BuildingSymbolizer struct {
@@ -120,30 +137,47 @@ type PointSymbolizer struct {
 }
 
 type TextSymbolizer struct {
-	XMLName          xml.Name `xml:"TextSymbolizer"`
-	AllowOverlap     *string  `xml:"allow-overlap,attr"`
-	AvoidEdges       *string  `xml:"avoid-edges,attr"`
-	CharacterSpacing *string  `xml:"character-spacing,attr"`
-	Clip             *string  `xml:"clip,attr"`
-	Dx               *string  `xml:"dx,attr"`
-	Dy               *string  `xml:"dy,attr"`
-	FaceName         *string  `xml:"face-name,attr"`
-	Fill             *string  `xml:"fill,attr"`
-	FontsetName      *string  `xml:"fontset-name,attr"`
-	HaloFill         *string  `xml:"halo-fill,attr"`
-	HaloRadius       *string  `xml:"halo-radius,attr"`
-	LineSpacing      *string  `xml:"line-spacing,attr"`
-	MinimumDistance  *string  `xml:"minimum-distance,attr"`
-	MinimumPadding   *string  `xml:"minimum-padding,attr"`
-	Name             *string  `xml:",chardata"`
-	Opacity          *string  `xml:"opacity,attr"`
-	Placement        *string  `xml:"placement,attr"`
-	Size             *string  `xml:"size,attr"`
-	Spacing          *string  `xml:"spacing,attr"`
-	TextTransform    *string  `xml:"text-transform,attr"`
-	WrapBefore       *string  `xml:"wrap-before,attr"`
-	WrapCharacter    *string  `xml:"wrap-character,attr"`
-	WrapWidth        *string  `xml:"wrap-width,attr"`
+	XMLName                xml.Name `xml:"TextSymbolizer"`
+	AllowOverlap           *string  `xml:"allow-overlap,attr"`
+	AvoidEdges             *string  `xml:"avoid-edges,attr"`
+	CharacterSpacing       *string  `xml:"character-spacing,attr"`
+	Clip                   *string  `xml:"clip,attr"`
+	Dx                     *string  `xml:"dx,attr"`
+	Dy                     *string  `xml:"dy,attr"`
+	FaceName               *string  `xml:"face-name,attr"`
+	Fill                   *string  `xml:"fill,attr"`
+	FontsetName            *string  `xml:"fontset-name,attr"`
+	HaloFill               *string  `xml:"halo-fill,attr"`
+	HaloRadius             *string  `xml:"halo-radius,attr"`
+	LabelPositionTolerance *string  `xml:"label-position-tolerance,attr"`
+	LineSpacing            *string  `xml:"line-spacing,attr"`
+	Margin                 *string  `xml:"margin,attr"`
+	MinimumDistance        *string  `xml:"minimum-distance,attr"`
+	MinimumPadding         *string  `xml:"minimum-padding,attr"`
+	Name                   *string  `xml:",chardata"`
+	Opacity                *string  `xml:"opacity,attr"`
+	Placement              *string  `xml:"placement,attr"`
+	RepeatDistance         *string  `xml:"repeat-distance,attr"`
+	Size                   *string  `xml:"size,attr"`
+	Spacing                *string  `xml:"spacing,attr"`
+	TextTransform          *string  `xml:"text-transform,attr"`
+	WrapBefore             *string  `xml:"wrap-before,attr"`
+	WrapCharacter          *string  `xml:"wrap-character,attr"`
+	WrapWidth              *string  `xml:"wrap-width,attr"`
+}
+
+type DebugSymbolizer struct {
+	XMLName xml.Name `xml:"DebugSymbolizer"`
+	Mode    *string  `xml:"mode,attr"`
+}
+
+type DotSymbolizer struct {
+	XMLName xml.Name `xml:"DotSymbolizer"`
+	CompOp  *string  `xml:"comp-op,attr"`
+	Fill    *string  `xml:"fill,attr"`
+	Height  *string  `xml:"height,attr"`
+	Opacity *string  `xml:"opacity,attr"`
+	Width   *string  `xml:"width,attr"`
 }
 
 type MarkersSymbolizer struct {
@@ -163,34 +197,42 @@ type MarkersSymbolizer struct {
 }
 
 type ShieldSymbolizer struct {
-	XMLName          xml.Name `xml:"ShieldSymbolizer"`
-	AllowOverlap     *string  `xml:"allow-overlap,attr"`
-	AvoidEdges       *string  `xml:"avoid-edges,attr"`
-	CharacterSpacing *string  `xml:"character-spacing,attr"`
-	Clip             *string  `xml:"clip,attr"`
-	Dx               *string  `xml:"dx,attr"`
-	Dy               *string  `xml:"dy,attr"`
-	FaceName         *string  `xml:"face-name,attr"`
-	File             *string  `xml:"file,attr"`
-	Fill             *string  `xml:"fill,attr"`
-	FontsetName      *string  `xml:"fontset-name,attr"`
-	HaloFill         *string  `xml:"halo-fill,attr"`
-	HaloRadius       *string  `xml:"halo-radius,attr"`
-	LineSpacing      *string  `xml:"line-spacing,attr"`
-	MinimumDistance  *string  `xml:"minimum-distance,attr"`
-	MinimumPadding   *string  `xml:"minimum-padding,attr"`
-	Name             *string  `xml:",chardata"`
-	Opacity          *string  `xml:"opacity,attr"`
-	Placement        *string  `xml:"placement,attr"`
-	Size             *string  `xml:"size,attr"`
-	Spacing          *string  `xml:"spacing,attr"`
-	TextDx           *string  `xml:"text-dx,attr"`
-	TextDy           *string  `xml:"text-dy,attr"`
-	TextOpacity      *string  `xml:"text-opacity,attr"`
-	TextTransform    *string  `xml:"text-transform,attr"`
-	WrapBefore       *string  `xml:"wrap-before,attr"`
-	WrapCharacter    *string  `xml:"wrap-character,attr"`
-	WrapWidth        *string  `xml:"wrap-width,attr"`
+	XMLName                xml.Name `xml:"ShieldSymbolizer"`
+	AllowOverlap           *string  `xml:"allow-overlap,attr"`
+	AvoidEdges             *string  `xml:"avoid-edges,attr"`
+	CharacterSpacing       *string  `xml:"character-spacing,attr"`
+	Clip                   *string  `xml:"clip,attr"`
+	Dx                     *string  `xml:"shield-dx,attr"`
+	Dy                     *string  `xml:"shield-dy,attr"`
+	FaceName               *string  `xml:"face-name,attr"`
+	File                   *string  `xml:"file,attr"`
+	Fill                   *string  `xml:"fill,attr"`
+	FontsetName            *string  `xml:"fontset-name,attr"`
+	HaloFill               *string  `xml:"halo-fill,attr"`
+	HaloRadius             *string  `xml:"halo-radius,attr"`
+	HorizontalAlignment    *string  `xml:"horizontal-alignment,attr"`
+	JustifyAlignment       *string  `xml:"justify-alignment,attr"`
+	LabelPositionTolerance *string  `xml:"label-position-tolerance,attr"`
+	LineSpacing            *string  `xml:"line-spacing,attr"`
+	Margin                 *string  `xml:"margin,attr"`
+	MinimumDistance        *string  `xml:"minimum-distance,attr"`
+	MinimumPadding         *string  `xml:"minimum-padding,attr"`
+	Name                   *string  `xml:",chardata"`
+	Opacity                *string  `xml:"opacity,attr"`
+	Placement              *string  `xml:"placement,attr"`
+	RepeatDistance         *string  `xml:"repeat-distance,attr"`
+	Size                   *string  `xml:"size,attr"`
+	Spacing                *string  `xml:"spacing,attr"`
+	TextDx                 *string  `xml:"dx,attr"`
+	TextDy                 *string  `xml:"dy,attr"`
+	TextOpacity            *string  `xml:"text-opacity,attr"`
+	TextTransform          *string  `xml:"text-transform,attr"`
+	Transform              *string  `xml:"transform,attr"`
+	UnlockImage            *string  `xml:"unlock-image,attr"`
+	VerticalAlignment      *string  `xml:"vertical-alignment,attr"`
+	WrapBefore             *string  `xml:"wrap-before,attr"`
+	WrapCharacter          *string  `xml:"wrap-character,attr"`
+	WrapWidth              *string  `xml:"wrap-width,attr"`
 }
 
 type RasterSymbolizer struct {
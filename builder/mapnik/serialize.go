@@ -2,6 +2,7 @@
 package mapnik
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"github.com/omniscale/magnacarto/builder/sql"
 	"github.com/omniscale/magnacarto/color"
 	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
 	"github.com/omniscale/magnacarto/mml"
 	"github.com/omniscale/magnacarto/mss"
 )
@@ -24,13 +26,23 @@ type Map struct {
 	locator        config.Locator
 	autoTypeFilter bool
 	mapnik2        bool
+	cartoCompat    bool
+	debug          bool
+	overviewWarned bool
+	logger         *logging.Logger
 }
 
 type maker struct {
 	mapnik2 bool
 }
 
-func (m maker) Type() string       { return "mapnik" }
+// Type differs for Mapnik 2 and 3, as both are cached separately.
+func (m maker) Type() string {
+	if m.mapnik2 {
+		return "mapnik2"
+	}
+	return "mapnik3"
+}
 func (m maker) FileSuffix() string { return ".xml" }
 func (m maker) New(locator config.Locator) builder.MapWriter {
 	mm := New(locator)
@@ -48,9 +60,15 @@ func New(locator config.Locator) *Map {
 		fontSets: make(map[string]string),
 		XML:      &XMLMap{SRS: "+init=epsg:3857"},
 		locator:  locator,
+		logger:   logging.Default(),
 	}
 }
 
+// SetLogger sets the logger for warnings, like missing images.
+func (m *Map) SetLogger(l *logging.Logger) {
+	m.logger = l
+}
+
 func (m *Map) SetAutoTypeFilter(enable bool) {
 	m.autoTypeFilter = enable
 }
@@ -63,8 +81,47 @@ func (m *Map) SetMapnik2(enable bool) {
 	m.mapnik2 = enable
 }
 
+// SetCartoCompat enables symbolizer defaults of carto. Carto adds a
+// symbolizer for each instance with any property of that symbolizer and
+// leaves missing properties to the Mapnik defaults (e.g. line-color without
+// line-width results in a 1px LineSymbolizer). Magnacarto skips symbolizers
+// without their main property (line-width, polygon-fill, etc.) by default.
+func (m *Map) SetCartoCompat(enable bool) {
+	m.cartoCompat = enable
+}
+
+// SetDebug adds a DebugSymbolizer to all layers, to render the collision
+// boxes of all labels.
+func (m *Map) SetDebug(enable bool) {
+	m.debug = enable
+}
+
+// SetMetadata adds the build metadata as map parameters.
+func (m *Map) SetMetadata(md []builder.Metadata) {
+	for _, item := range md {
+		m.XML.Parameters = append(m.XML.Parameters, Parameter{Name: item.Name, Value: item.Value})
+	}
+}
+
 func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
 	styles := m.newStyles(rules)
+	if l.CompOp != "" {
+		// Mapnik has no comp-op for layers, use comp-op of the group for
+		// all styles without their own comp-op
+		for i := range styles {
+			if styles[i].CompOp == nil {
+				styles[i].CompOp = &l.CompOp
+			}
+		}
+	}
+	if m.debug || l.Debug {
+		mode := "collision"
+		styles = append(styles, Style{
+			Name:       l.Name + "-debug",
+			FilterMode: "first",
+			Rules:      []Rule{{Symbolizers: []interface{}{&DebugSymbolizer{Mode: &mode}}}},
+		})
+	}
 	m.XML.Styles = append(m.XML.Styles, styles...)
 
 	layer := Layer{}
@@ -104,10 +161,7 @@ func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
 }
 
 func (m *Map) Write(w io.Writer) error {
-	e := xml.NewEncoder(w)
-	e.Indent("", "  ")
-	err := e.Encode(m.XML)
-	return err
+	return encodeXML(w, m.XML)
 }
 
 func (m *Map) WriteFiles(basename string) error {
@@ -119,6 +173,92 @@ func (m *Map) WriteFiles(basename string) error {
 	return m.Write(f)
 }
 
+// WriteSplitFiles writes the styles and the layer of each layer into its own
+// file. The basename file includes the layer files with XInclude.
+func (m *Map) WriteSplitFiles(basename string) error {
+	names := make([]string, len(m.XML.Layers))
+	for i, l := range m.XML.Layers {
+		names[i] = l.Name
+	}
+	_, files := builder.SplitFiles(basename, names, ".xml")
+
+	styles := make(map[string]Style, len(m.XML.Styles))
+	for _, s := range m.XML.Styles {
+		styles[s.Name] = s
+	}
+	layers := make([][]byte, len(m.XML.Layers))
+	for i, l := range m.XML.Layers {
+		inc := XMLInclude{Layers: []Layer{l}}
+		for _, name := range l.StyleNames {
+			if s, ok := styles[name]; ok {
+				inc.Styles = append(inc.Styles, s)
+				// add styles of layers with the same name only once
+				delete(styles, name)
+			}
+		}
+		buf := bytes.Buffer{}
+		if err := encodeXML(&buf, inc); err != nil {
+			return err
+		}
+		layers[i] = buf.Bytes()
+	}
+
+	master := *m.XML
+	master.Styles = nil
+	master.Layers = nil
+	master.XMLNSXI = "http://www.w3.org/2001/XInclude"
+	for _, f := range files {
+		master.Includes = append(master.Includes, XInclude{Href: f})
+	}
+	buf := bytes.Buffer{}
+	if err := encodeXML(&buf, master); err != nil {
+		return err
+	}
+	return builder.WriteSplitFiles(basename, buf.Bytes(), files, layers, ".xml")
+}
+
+// LayerStats are the number of Mapnik rules and the size of the XML of a
+// single layer with all its styles.
+type LayerStats struct {
+	Name  string
+	Rules int
+	Size  int
+}
+
+// LayerStats returns the LayerStats of all layers, in the order of the
+// layers. Styles that are used by multiple layers are only counted for the
+// first layer, as in WriteSplitFiles.
+func (m *Map) LayerStats() ([]LayerStats, error) {
+	styles := make(map[string]Style, len(m.XML.Styles))
+	for _, s := range m.XML.Styles {
+		styles[s.Name] = s
+	}
+	result := make([]LayerStats, len(m.XML.Layers))
+	for i, l := range m.XML.Layers {
+		inc := XMLInclude{Layers: []Layer{l}}
+		result[i].Name = l.Name
+		for _, name := range l.StyleNames {
+			if s, ok := styles[name]; ok {
+				inc.Styles = append(inc.Styles, s)
+				result[i].Rules += len(s.Rules)
+				delete(styles, name)
+			}
+		}
+		buf := bytes.Buffer{}
+		if err := encodeXML(&buf, inc); err != nil {
+			return nil, err
+		}
+		result[i].Size = buf.Len()
+	}
+	return result, nil
+}
+
+func encodeXML(w io.Writer, v interface{}) error {
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	return e.Encode(v)
+}
+
 func (m *Map) newDatasource(ds mml.Datasource, rules []mss.Rule) []Parameter {
 	var params []Parameter
 	switch ds := ds.(type) {
@@ -170,8 +310,28 @@ func (m *Map) newDatasource(ds mml.Datasource, rules []mss.Rule) []Parameter {
 			{Name: "srid", Value: ds.SRID},
 			{Name: "extent", Value: ds.Extent},
 			{Name: "band", Value: ds.Band},
+			{Name: "nodata", Value: ds.Nodata},
 			{Name: "type", Value: "gdal"},
 		}
+		if ds.Overview != "" && !m.overviewWarned {
+			m.logger.Warn("gdal overview not supported by Mapnik, GDAL selects the overview for the scale")
+			m.overviewWarned = true
+		}
+	case mml.Contour:
+		// TODO missing file
+		params = []Parameter{
+			{Name: "file", Value: ds.Filename},
+			{Name: "srid", Value: ds.SRID},
+			{Name: "extent", Value: ds.Extent},
+			{Name: "type", Value: "ogr"},
+		}
+		if query := sql.ContourSelect(ds); query != "" {
+			params = append(params, Parameter{Name: "layer_by_sql", Value: query})
+		} else if ds.Layer != "" {
+			params = append(params, Parameter{Name: "layer", Value: ds.Layer})
+		} else {
+			params = append(params, Parameter{Name: "layer_by_index", Value: "0"})
+		}
 	case nil:
 		// datasource might be nil for exports withour mml
 	default:
@@ -248,7 +408,7 @@ func (m *Map) newRule(r mss.Rule) *Rule {
 	}
 
 	result.Filter = fmtFilters(r.Filters)
-	prefixes := mss.SortedPrefixes(r.Properties, []string{"line-", "polygon-", "polygon-pattern-", "text-", "shield-", "marker-", "point-", "building-", "raster-"})
+	prefixes := mss.SortedPrefixes(r.Properties, []string{"line-", "polygon-", "polygon-pattern-", "text-", "shield-", "marker-", "point-", "building-", "raster-", "dot-", "debug-"})
 
 	for _, p := range prefixes {
 		r.Properties.SetDefaultInstance(p.Instance)
@@ -271,8 +431,12 @@ func (m *Map) newRule(r mss.Rule) *Rule {
 			m.addBuildingSymbolizer(result, r)
 		case "raster-":
 			m.addRasterSymbolizer(result, r)
+		case "dot-":
+			m.addDotSymbolizer(result, r)
+		case "debug-":
+			m.addDebugSymbolizer(result, r)
 		default:
-			log.Println("invalid prefix", p)
+			m.logger.Warn(fmt.Sprintf("invalid prefix %s", p))
 		}
 	}
 	r.Properties.SetDefaultInstance("")
@@ -280,9 +444,9 @@ func (m *Map) newRule(r mss.Rule) *Rule {
 }
 
 func (m *Map) addLineSymbolizer(result *Rule, r mss.Rule) {
-	if width, ok := r.Properties.GetFloat("line-width"); ok {
+	if width, ok := r.Properties.GetFloat("line-width"); ok || m.cartoCompat {
 		symb := LineSymbolizer{}
-		symb.Width = fmtFloat(width, true)
+		symb.Width = fmtFloat(width, ok)
 		symb.Clip = fmtBool(r.Properties.GetBool("line-clip"))
 		symb.Color = fmtColor(r.Properties.GetColor("line-color"))
 		symb.Dasharray = fmtPattern(r.Properties.GetFloatList("line-dasharray"))
@@ -300,21 +464,24 @@ func (m *Map) addLineSymbolizer(result *Rule, r mss.Rule) {
 }
 
 func (m *Map) addPolygonSymbolizer(result *Rule, r mss.Rule) {
-	if fill, ok := r.Properties.GetColor("polygon-fill"); ok {
-		symb := PolygonSymbolizer{}
-		symb.Color = fmtColor(fill, true)
-		symb.Opacity = fmtFloat(r.Properties.GetFloat("polygon-opacity"))
-		symb.Gamma = fmtFloat(r.Properties.GetFloat("polygon-gamma"))
-		symb.GammaMethod = fmtString(r.Properties.GetString("polygon-gamma-method"))
-
+	fill, ok := r.Properties.GetColor("polygon-fill")
+	symb := PolygonSymbolizer{}
+	symb.Color = fmtColor(fill, ok)
+	symb.Opacity = fmtFloat(r.Properties.GetFloat("polygon-opacity"))
+	symb.Gamma = fmtFloat(r.Properties.GetFloat("polygon-gamma"))
+	symb.GammaMethod = fmtString(r.Properties.GetString("polygon-gamma-method"))
+
+	// polygon- prefix also matches polygon-pattern- properties, only add a
+	// default symbolizer for actual polygon properties
+	if ok || (m.cartoCompat && (symb.Opacity != nil || symb.Gamma != nil || symb.GammaMethod != nil)) {
 		result.Symbolizers = append(result.Symbolizers, &symb)
 	}
 }
 
 func (m *Map) addTextSymbolizer(result *Rule, r mss.Rule) {
-	if size, ok := r.Properties.GetFloat("text-size"); ok {
+	if size, ok := r.Properties.GetFloat("text-size"); ok || m.cartoCompat {
 		symb := TextSymbolizer{}
-		symb.Size = fmtFloat(size, true)
+		symb.Size = fmtFloat(size, ok)
 		symb.Fill = fmtColor(r.Properties.GetColor("text-fill"))
 		symb.Name = fmtField(r.Properties.GetFieldList("text-name"))
 		symb.Placement = fmtString(r.Properties.GetString("text-placement"))
@@ -339,6 +506,9 @@ func (m *Map) addTextSymbolizer(result *Rule, r mss.Rule) {
 		symb.Spacing = fmtFloat(r.Properties.GetFloat("text-spacing"))
 		// min-distance to other label, does not work with placement-line
 		symb.MinimumDistance = fmtFloat(r.Properties.GetFloat("text-min-distance"))
+		symb.RepeatDistance = fmtFloat(r.Properties.GetFloat("text-repeat-distance"))
+		symb.Margin = fmtFloat(r.Properties.GetFloat("text-margin"))
+		symb.LabelPositionTolerance = fmtFloat(r.Properties.GetFloat("text-label-position-tolerance"))
 		// min-padding to map edge
 		// symb.MinimumPadding = fmtFloat(r.Properties.GetFloat("text-min-padding"))
 
@@ -347,6 +517,9 @@ func (m *Map) addTextSymbolizer(result *Rule, r mss.Rule) {
 
 		if faceNames, ok := r.Properties.GetStringList("text-face-name"); ok {
 			symb.FontsetName = m.fontSetName(faceNames)
+		} else if m.cartoCompat {
+			// carto requires text-face-name
+			return
 		}
 
 		if symb.Name != nil && *symb.Name != "" {
@@ -361,7 +534,7 @@ func (m *Map) addShieldSymbolizer(result *Rule, r mss.Rule) {
 
 		fname := m.locator.Image(shieldFile)
 		if fname == "" {
-			log.Println("missing shield", shieldFile)
+			m.logger.Warn(fmt.Sprintf("missing shield %s", shieldFile))
 		}
 		symb.File = &fname
 
@@ -369,8 +542,11 @@ func (m *Map) addShieldSymbolizer(result *Rule, r mss.Rule) {
 		symb.Fill = fmtColor(r.Properties.GetColor("shield-fill"))
 		symb.Name = fmtField(r.Properties.GetFieldList("shield-name"))
 		symb.Placement = fmtString(r.Properties.GetString("shield-placement"))
-		symb.TextOpacity = fmtFloat(r.Properties.GetFloat("shield-opacity"))
 		symb.Opacity = fmtFloat(r.Properties.GetFloat("shield-opacity"))
+		symb.TextOpacity = fmtFloat(r.Properties.GetFloat("shield-text-opacity"))
+		symb.UnlockImage = fmtBool(r.Properties.GetBool("shield-unlock-image"))
+		symb.Transform = fmtString(r.Properties.GetString("shield-transform"))
+		symb.TextTransform = fmtString(r.Properties.GetString("shield-text-transform"))
 
 		symb.Clip = fmtBool(r.Properties.GetBool("shield-clip"))
 		symb.AllowOverlap = fmtBool(r.Properties.GetBool("shield-allow-overlap"))
@@ -384,19 +560,32 @@ func (m *Map) addShieldSymbolizer(result *Rule, r mss.Rule) {
 		symb.WrapBefore = fmtBool(r.Properties.GetBool("shield-wrap-before"))
 		symb.WrapWidth = fmtFloat(r.Properties.GetFloat("shield-wrap-width"))
 		symb.LineSpacing = fmtFloat(r.Properties.GetFloat("shield-line-spacing"))
+		symb.HorizontalAlignment = fmtString(r.Properties.GetString("shield-horizontal-alignment"))
+		symb.VerticalAlignment = fmtString(r.Properties.GetString("shield-vertical-alignment"))
+		symb.JustifyAlignment = fmtString(r.Properties.GetString("shield-justify-alignment"))
+
+		// shield-dx/dy displace the shield, shield-text-dx/dy the text
+		// within the shield
 		symb.Dx = fmtFloat(r.Properties.GetFloat("shield-dx"))
-		symb.Dy = fmtFloat(r.Properties.GetFloat("shield-dx"))
+		symb.Dy = fmtFloat(r.Properties.GetFloat("shield-dy"))
 		symb.TextDx = fmtFloat(r.Properties.GetFloat("shield-text-dx"))
 		symb.TextDy = fmtFloat(r.Properties.GetFloat("shield-text-dy"))
 
 		symb.Spacing = fmtFloat(r.Properties.GetFloat("shield-spacing"))
+		symb.RepeatDistance = fmtFloat(r.Properties.GetFloat("shield-repeat-distance"))
+		symb.Margin = fmtFloat(r.Properties.GetFloat("shield-margin"))
 		symb.MinimumDistance = fmtFloat(r.Properties.GetFloat("shield-min-distance"))
 		symb.MinimumPadding = fmtFloat(r.Properties.GetFloat("shield-min-padding"))
+		symb.LabelPositionTolerance = fmtFloat(r.Properties.GetFloat("shield-label-position-tolerance"))
 
 		if faceNames, ok := r.Properties.GetStringList("shield-face-name"); ok {
 			symb.FontsetName = m.fontSetName(faceNames)
 		}
 
+		if symb.Name != nil && *symb.Name == "" {
+			// e.g. else value of if([ref], [ref])
+			return
+		}
 		result.Symbolizers = append(result.Symbolizers, &symb)
 	}
 }
@@ -407,7 +596,7 @@ func (m *Map) addMarkerSymbolizer(result *Rule, r mss.Rule) {
 		symb := MarkersSymbolizer{}
 		fname := m.locator.Image(markerFile)
 		if fname == "" {
-			log.Println("missing marker", markerFile)
+			m.logger.Warn(fmt.Sprintf("missing marker %s", markerFile))
 		}
 		symb.File = &fname
 		symb.Height = fmtFloat(r.Properties.GetFloat("marker-height"))
@@ -442,13 +631,15 @@ func (m *Map) addMarkerSymbolizer(result *Rule, r mss.Rule) {
 }
 
 func (m *Map) addPointSymbolizer(result *Rule, r mss.Rule) {
-	if pointFile, ok := r.Properties.GetString("point-file"); ok {
+	if pointFile, ok := r.Properties.GetString("point-file"); ok || m.cartoCompat {
 		symb := PointSymbolizer{}
-		fname := m.locator.Image(pointFile)
-		if fname == "" {
-			log.Println("missing point", pointFile)
+		if ok {
+			fname := m.locator.Image(pointFile)
+			if fname == "" {
+				m.logger.Warn(fmt.Sprintf("missing point %s", pointFile))
+			}
+			symb.File = &fname
 		}
-		symb.File = &fname
 		symb.AllowOverlap = fmtBool(r.Properties.GetBool("point-allow-overlap"))
 		symb.Opacity = fmtFloat(r.Properties.GetFloat("point-opacity"))
 		symb.Transform = fmtString(r.Properties.GetString("point-transform"))
@@ -462,19 +653,43 @@ func (m *Map) addPolygonPatternSymbolizer(result *Rule, r mss.Rule) {
 		symb := PolygonPatternSymbolizer{}
 		fname := m.locator.Image(patFile)
 		if fname == "" {
-			log.Println("missing pattern", patFile)
+			m.logger.Warn(fmt.Sprintf("missing pattern %s", patFile))
 		}
 		symb.File = &fname
 		symb.Alignment = fmtString(r.Properties.GetString("polygon-pattern-alignment"))
+		symb.Transform = fmtString(r.Properties.GetString("polygon-pattern-transform"))
 		result.Symbolizers = append(result.Symbolizers, &symb)
 	}
 }
 
 func (m *Map) addBuildingSymbolizer(result *Rule, r mss.Rule) {
-	if fill, ok := r.Properties.GetColor("building-fill"); ok {
+	if fill, ok := r.Properties.GetColor("building-fill"); ok || m.cartoCompat {
 		symb := BuildingSymbolizer{}
-		symb.Fill = fmtColor(fill, true)
-		symb.Height = fmtFloat(r.Properties.GetFloat("building-height"))
+		symb.Fill = fmtColor(fill, ok)
+		symb.Height = fmtFloatOrField(r.Properties, "building-height")
+		symb.FillOpacity = fmtFloat(r.Properties.GetFloat("building-fill-opacity"))
+		result.Symbolizers = append(result.Symbolizers, &symb)
+	}
+}
+
+func (m *Map) addDebugSymbolizer(result *Rule, r mss.Rule) {
+	if mode, ok := r.Properties.GetString("debug-mode"); ok {
+		result.Symbolizers = append(result.Symbolizers, &DebugSymbolizer{Mode: &mode})
+	}
+}
+
+func (m *Map) addDotSymbolizer(result *Rule, r mss.Rule) {
+	if fill, ok := r.Properties.GetColor("dot-fill"); ok || m.cartoCompat {
+		if m.mapnik2 {
+			m.logger.Warn("dot symbolizer requires Mapnik 3")
+			return
+		}
+		symb := DotSymbolizer{}
+		symb.Fill = fmtColor(fill, ok)
+		symb.Opacity = fmtFloat(r.Properties.GetFloat("dot-opacity"))
+		symb.Width = fmtFloat(r.Properties.GetFloat("dot-width"))
+		symb.Height = fmtFloat(r.Properties.GetFloat("dot-height"))
+		symb.CompOp = fmtString(r.Properties.GetString("dot-comp-op"))
 		result.Symbolizers = append(result.Symbolizers, &symb)
 	}
 }
@@ -532,13 +747,24 @@ func fmtField(vals []interface{}, ok bool) *string {
 		case mss.Field:
 			parts = append(parts, string(v.(mss.Field)))
 		case string:
-			parts = append(parts, "'"+v.(string)+"'")
+			parts = append(parts, "'"+strings.Replace(v.(string), "'", "\\'", -1)+"'")
 		}
 	}
 	r := strings.Join(parts, " + ")
 	return &r
 }
 
+// fmtFloatOrField returns property as float or as field (e.g. [height]).
+func fmtFloatOrField(p *mss.Properties, property string) *string {
+	if v, ok := p.GetFloat(property); ok {
+		return fmtFloat(v, true)
+	}
+	if v, ok := p.GetString(property); ok {
+		return &v
+	}
+	return nil
+}
+
 func fmtPattern(v []float64, ok bool) *string {
 	if !ok {
 		return nil
@@ -591,25 +817,22 @@ func fmtColor(v color.RGBA, ok bool) *string {
 func fmtFilters(filters []mss.Filter) string {
 	parts := []string{}
 	for _, f := range filters {
-		var value string
-		switch v := f.Value.(type) {
-		case nil:
-			value = "null"
-		case string:
-			// TODO quote " in string?!
-			value = `'` + v + `'`
-		case float64:
-			value = string(*fmtFloat(v, true))
-		default:
-			log.Printf("unknown type of filter value: %s", v)
-			value = ""
-		}
 		field := f.Field
 		if len(field) > 2 && field[0] == '"' && field[len(field)-1] == '"' {
 			// strip quotes from field name
 			field = field[1 : len(field)-1]
 		}
-		parts = append(parts, "(["+field+"] "+f.CompOp.String()+" "+value+")")
+		if f.CompOp == mss.IN {
+			// Mapnik 2 has no in operator
+			values := f.Value.([]mss.Value)
+			or := make([]string, len(values))
+			for i, v := range values {
+				or[i] = "([" + field + "] = " + fmtFilterValue(v) + ")"
+			}
+			parts = append(parts, "("+strings.Join(or, " or ")+")")
+			continue
+		}
+		parts = append(parts, "(["+field+"] "+f.CompOp.String()+" "+fmtFilterValue(f.Value)+")")
 	}
 
 	s := strings.Join(parts, " and ")
@@ -619,6 +842,21 @@ func fmtFilters(filters []mss.Filter) string {
 	return s
 }
 
+func fmtFilterValue(v mss.Value) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		// TODO quote " in string?!
+		return `'` + v + `'`
+	case float64:
+		return string(*fmtFloat(v, true))
+	default:
+		log.Printf("unknown type of filter value: %s", v)
+		return ""
+	}
+}
+
 var zoomRanges = []int64{
 	1000000000,
 	500000000,
@@ -0,0 +1,306 @@
+package mapnik
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+func buildXML(t *testing.T, content string, cartoCompat bool) string {
+	d := mss.New()
+	if err := d.ParseString(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(&config.LookupLocator{})
+	m.SetCartoCompat(cartoCompat)
+	m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString}, d.MSS().LayerRules("roads"))
+	buf := &bytes.Buffer{}
+	if err := m.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestCartoCompat(t *testing.T) {
+	for _, tc := range []struct {
+		mss      string
+		defaults []string
+		compat   []string
+	}{
+		{
+			mss:      `#roads { line-color: red; }`,
+			defaults: nil,
+			compat:   []string{`<LineSymbolizer stroke="#ff0000"></LineSymbolizer>`},
+		},
+		{
+			mss:      `#roads { line-width: 2; a/line-dasharray: 2, 2; }`,
+			defaults: []string{`<LineSymbolizer stroke-width="2"></LineSymbolizer>`},
+			compat: []string{
+				`<LineSymbolizer stroke-width="2"></LineSymbolizer>`,
+				`<LineSymbolizer stroke-dasharray="2, 2"></LineSymbolizer>`,
+			},
+		},
+		{
+			// polygon-pattern- properties do not add a PolygonSymbolizer
+			mss:      `#roads { polygon-opacity: 0.5; polygon-pattern-file: url(foo.png); }`,
+			defaults: []string{`<PolygonPatternSymbolizer file=""></PolygonPatternSymbolizer>`},
+			compat: []string{
+				`<PolygonSymbolizer fill-opacity="0.5"></PolygonSymbolizer>`,
+				`<PolygonPatternSymbolizer file=""></PolygonPatternSymbolizer>`,
+			},
+		},
+		{
+			mss:      `#roads { polygon-pattern-file: url(foo.png); }`,
+			defaults: []string{`<PolygonPatternSymbolizer file=""></PolygonPatternSymbolizer>`},
+			compat:   []string{`<PolygonPatternSymbolizer file=""></PolygonPatternSymbolizer>`},
+		},
+		{
+			// carto requires text-face-name
+			mss:      `#roads { text-name: [name]; }`,
+			defaults: nil,
+			compat:   nil,
+		},
+		{
+			mss:      `#roads { text-name: [name]; text-face-name: "Foo"; }`,
+			defaults: nil,
+			compat:   []string{`<TextSymbolizer fontset-name="fontset-1">[name]</TextSymbolizer>`},
+		},
+		{
+			mss:      `#roads { building-height: 5; }`,
+			defaults: nil,
+			compat:   []string{`<BuildingSymbolizer height="5"></BuildingSymbolizer>`},
+		},
+	} {
+		for _, compat := range []bool{false, true} {
+			expected := tc.defaults
+			if compat {
+				expected = tc.compat
+			}
+			xml := buildXML(t, tc.mss, compat)
+			if n := strings.Count(xml, "Symbolizer "); n != len(expected) {
+				t.Errorf("%s (compat=%v): expected %d symbolizers, got %d\n%s", tc.mss, compat, len(expected), n, xml)
+				continue
+			}
+			for _, e := range expected {
+				if !strings.Contains(xml, e) {
+					t.Errorf("%s (compat=%v): %s not found in\n%s", tc.mss, compat, e, xml)
+				}
+			}
+		}
+	}
+}
+
+func TestLabelExpression(t *testing.T) {
+	xml := buildXML(t, `#roads { text-name: if([ref], [ref] + " " + [name] + "'s", [name]); text-size: 10; text-face-name: "Foo"; }`, false)
+	for _, e := range []string{
+		`<Filter>(([ref] != null) and ([ref] != &#39;&#39;))</Filter>`,
+		`size="10">[ref] + &#39; &#39; + [name] + &#39;\&#39;s&#39;</TextSymbolizer>`,
+		`size="10">[name]</TextSymbolizer>`,
+	} {
+		if !strings.Contains(xml, e) {
+			t.Errorf("%s not found in\n%s", e, xml)
+		}
+	}
+}
+
+func TestShieldSymbolizer(t *testing.T) {
+	xml := buildXML(t, `#roads {
+		shield-file: url(shield.svg); shield-name: [ref]; shield-size: 10; shield-face-name: "Foo";
+		shield-text-dx: 2; shield-text-dy: -4; shield-dx: 1; shield-dy: 3; shield-unlock-image: true;
+		shield-placement: line; shield-spacing: 100; shield-min-padding: 2; shield-text-opacity: 0.8;
+	}`, false)
+	for _, e := range []string{
+		`shield-dx="1"`,
+		`shield-dy="3"`,
+		` dx="2"`,
+		` dy="-4"`,
+		`unlock-image="true"`,
+		`placement="line"`,
+		`spacing="100"`,
+		`minimum-padding="2"`,
+		`text-opacity="0.8"`,
+	} {
+		if !strings.Contains(xml, e) {
+			t.Errorf("%s not found in\n%s", e, xml)
+		}
+	}
+}
+
+func TestBuildingSymbolizer(t *testing.T) {
+	xml := buildXML(t, `#roads { building-fill: #eee; building-fill-opacity: 0.8; building-height: [height]; }`, false)
+	if e := `<BuildingSymbolizer fill="#eeeeee" height="[height]" fill-opacity="0.8"></BuildingSymbolizer>`; !strings.Contains(xml, e) {
+		t.Errorf("%s not found in\n%s", e, xml)
+	}
+	xml = buildXML(t, `#roads { building-fill: #eee; building-height: 5; }`, false)
+	if e := `<BuildingSymbolizer fill="#eeeeee" height="5"></BuildingSymbolizer>`; !strings.Contains(xml, e) {
+		t.Errorf("%s not found in\n%s", e, xml)
+	}
+}
+
+func TestDotSymbolizer(t *testing.T) {
+	xml := buildXML(t, `#roads { dot-fill: red; dot-width: 2; dot-height: 2; dot-opacity: 0.5; dot-comp-op: multiply; }`, false)
+	if e := `<DotSymbolizer comp-op="multiply" fill="#ff0000" height="2" opacity="0.5" width="2"></DotSymbolizer>`; !strings.Contains(xml, e) {
+		t.Errorf("%s not found in\n%s", e, xml)
+	}
+}
+
+func TestDebug(t *testing.T) {
+	xml := buildXML(t, `#roads { line-width: 1; debug-mode: vertex; }`, false)
+	if e := `<DebugSymbolizer mode="vertex"></DebugSymbolizer>`; !strings.Contains(xml, e) {
+		t.Errorf("%s not found in\n%s", e, xml)
+	}
+	if strings.Contains(xml, "roads-debug") {
+		t.Errorf("unexpected debug style in\n%s", xml)
+	}
+
+	d := mss.New()
+	if err := d.ParseString(`#roads { line-width: 1; } #water { line-width: 2; }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, debug := range []bool{false, true} {
+		m := New(&config.LookupLocator{})
+		m.SetDebug(debug)
+		m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString, Debug: true}, d.MSS().LayerRules("roads"))
+		m.AddLayer(mml.Layer{Name: "water", Type: mml.LineString}, d.MSS().LayerRules("water"))
+		if len(m.XML.Layers[0].StyleNames) != 2 || m.XML.Layers[0].StyleNames[1] != "roads-debug" {
+			t.Error("missing debug style", m.XML.Layers[0].StyleNames)
+		}
+		if debug != (len(m.XML.Layers[1].StyleNames) == 2) {
+			t.Error("unexpected styles", debug, m.XML.Layers[1].StyleNames)
+		}
+	}
+}
+
+func TestLayerGroupCompOp(t *testing.T) {
+	d := mss.New()
+	if err := d.ParseString(`#roads { line-width: 1; } #roads::fg { line-width: 2; comp-op: plus; }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(&config.LookupLocator{})
+	m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString, CompOp: "multiply"}, d.MSS().LayerRules("roads"))
+	if len(m.XML.Styles) != 2 {
+		t.Fatal("unexpected styles", m.XML.Styles)
+	}
+	for _, s := range m.XML.Styles {
+		if s.CompOp == nil || (*s.CompOp != "multiply" && *s.CompOp != "plus") {
+			t.Errorf("unexpected comp-op for %s: %v", s.Name, s.CompOp)
+		}
+	}
+	if *m.XML.Styles[0].CompOp == *m.XML.Styles[1].CompOp {
+		t.Error("comp-op of style overridden")
+	}
+}
+
+func TestDEMDatasources(t *testing.T) {
+	m := New(&config.LookupLocator{})
+	for _, tc := range []struct {
+		ds       mml.Datasource
+		expected []Parameter
+	}{
+		{mml.GDAL{Filename: "dem.tif", SRID: "3857", Band: "1", Nodata: "-32768"},
+			[]Parameter{{Name: "file", Value: "dem.tif"}, {Name: "srid", Value: "3857"}, {Name: "band", Value: "1"}, {Name: "nodata", Value: "-32768"}, {Name: "type", Value: "gdal"}}},
+		{mml.Contour{Filename: "contours.gpkg", Layer: "contour", ElevationField: "elev"},
+			[]Parameter{{Name: "file", Value: "contours.gpkg"}, {Name: "type", Value: "ogr"}, {Name: "layer", Value: "contour"}}},
+		{mml.Contour{Filename: "contours.gpkg", Layer: "contour", ElevationField: "elev", Interval: "50"},
+			[]Parameter{{Name: "file", Value: "contours.gpkg"}, {Name: "type", Value: "ogr"}, {Name: "layer_by_sql", Value: `SELECT * FROM "contour" WHERE "elev" % 50 = 0`}}},
+		{mml.Contour{Filename: "contours.shp", ElevationField: "elev"},
+			[]Parameter{{Name: "file", Value: "contours.shp"}, {Name: "type", Value: "ogr"}, {Name: "layer_by_index", Value: "0"}}},
+	} {
+		if params := m.newDatasource(tc.ds, nil); !reflect.DeepEqual(params, tc.expected) {
+			t.Errorf("unexpected parameters for %#v: %v", tc.ds, params)
+		}
+	}
+}
+
+func TestMergedRules(t *testing.T) {
+	d := mss.New()
+	if err := d.ParseString(`
+		#roads[type='primary'] { line-width: 2; }
+		#roads[type='secondary'] { line-width: 2; }
+		#roads[type='tertiary'] { line-width: 1; }
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	rules, merged := mss.MergeRules(d.MSS().LayerRules("roads"))
+	if merged != 1 {
+		t.Fatal("unexpected merged rules", rules)
+	}
+	m := New(&config.LookupLocator{})
+	m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString}, rules)
+	if f := m.XML.Styles[0].Rules[1].Filter; f != `(([type] = 'secondary') or ([type] = 'primary'))` {
+		t.Error("unexpected filter", f)
+	}
+}
+
+func TestWriteSplitFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := mss.New()
+	if err := d.ParseString(`#roads { line-width: 1; ::fg { line-width: 2; } } #water { line-width: 2; }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(&config.LookupLocator{})
+	m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString}, d.MSS().LayerRules("roads"))
+	m.AddLayer(mml.Layer{Name: "water", Type: mml.LineString}, d.MSS().LayerRules("water"))
+	if err := m.WriteSplitFiles(filepath.Join(dir, "style.xml")); err != nil {
+		t.Fatal(err)
+	}
+
+	master, err := ioutil.ReadFile(filepath.Join(dir, "style.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(master), "<Style") || !strings.Contains(string(master),
+		`<xi:include href="style-layers/roads.xml"></xi:include>
+  <xi:include href="style-layers/water.xml"></xi:include>`) {
+		t.Errorf("unexpected master\n%s", master)
+	}
+	roads, err := ioutil.ReadFile(filepath.Join(dir, "style-layers", "roads.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(roads), "<Style "); n != 2 || !strings.HasPrefix(string(roads), "<Include>") || strings.Contains(string(roads), "water") {
+		t.Errorf("unexpected layer file\n%s", roads)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	m := New(&config.LookupLocator{})
+	m.SetMetadata([]builder.Metadata{{Name: "magnacarto_version", Value: "0.1"}, {Name: "magnacarto_vars", Value: "water=#a0c8f0"}})
+	buf := &bytes.Buffer{}
+	if err := m.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	e := `<Parameters><Parameter name="magnacarto_version">0.1</Parameter><Parameter name="magnacarto_vars">water=#a0c8f0</Parameter></Parameters>`
+	if xml := strings.Join(strings.Fields(buf.String()), ""); !strings.Contains(xml, strings.Join(strings.Fields(e), "")) {
+		t.Errorf("%s not found in\n%s", e, buf.String())
+	}
+}
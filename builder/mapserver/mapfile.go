@@ -15,6 +15,7 @@ import (
 	"github.com/omniscale/magnacarto/builder/sql"
 	"github.com/omniscale/magnacarto/color"
 	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
 	"github.com/omniscale/magnacarto/mml"
 	"github.com/omniscale/magnacarto/mss"
 )
@@ -38,6 +39,15 @@ type Map struct {
 	pointSymbols   map[string]struct{}
 	locator        config.Locator
 	autoTypeFilter bool
+	dotWarned      bool
+	layerBlocks    []layerBlock
+	logger         *logging.Logger
+}
+
+// layerBlock contains all LAYERs of a single MML layer.
+type layerBlock struct {
+	name   string
+	layers Block
 }
 
 func New(locator config.Locator) *Map {
@@ -72,37 +82,71 @@ func New(locator config.Locator) *Map {
 	return &Map{
 		Map:     mapBlock,
 		locator: locator,
+		logger:  logging.Default(),
 	}
 }
 
+// SetLogger sets the logger for warnings, like missing fonts and symbols.
+func (m *Map) SetLogger(l *logging.Logger) {
+	m.logger = l
+}
+
 func (m *Map) SetBackgroundColor(c color.RGBA) {
 	m.bgColor = &c
 }
 
+// SetMetadata adds the build metadata to the METADATA of the WEB block.
+func (m *Map) SetMetadata(md []builder.Metadata) {
+	for i, item := range m.Map.items {
+		web, ok := item.Value.(Block)
+		if !ok || web.Name != "Web" {
+			continue
+		}
+		for j, item := range web.items {
+			metadata, ok := item.Value.(Block)
+			if !ok || metadata.Name != "Metadata" {
+				continue
+			}
+			for _, entry := range md {
+				// keys are case sensitive, Item uppercases names
+				metadata.Add("", quote(entry.Name)+" "+quote(strings.Replace(entry.Value, `"`, `\"`, -1)))
+			}
+			web.items[j].Value = metadata
+		}
+		m.Map.items[i].Value = web
+	}
+}
+
 func (m *Map) SetAutoTypeFilter(enable bool) {
 	m.autoTypeFilter = enable
 }
 
 func (m *Map) String() string {
+	return m.mapBlock(m.Layers).String()
+}
+
+// mapBlock returns the MAP with layers, without modifying m.Map.
+func (m *Map) mapBlock(layers Block) Block {
+	b := NewBlock(m.Map.Name, append([]Item(nil), m.Map.items...)...)
 	if m.bgColor != nil {
-		m.Map.AddNonNil("ImageColor", fmtColor(*m.bgColor, true))
+		b.AddNonNil("ImageColor", fmtColor(*m.bgColor, true))
 	}
-	m.Map.Add("", m.Layers)
-	m.addSymbols()
-	return m.Map.String()
+	b.Add("", layers)
+	m.addSymbols(&b)
+	return b
 }
 
-func (m *Map) addSymbols() {
+func (m *Map) addSymbols(b *Block) {
 	for fileName, shortName := range m.svgSymbols {
 		s := NewBlock("SYMBOL")
 		s.Add("name", shortName)
-		s.Add("image", fileName)
+		s.Add("image", filepath.ToSlash(fileName))
 		if strings.HasSuffix(fileName, "svg") {
 			s.Add("type", "svg")
 		} else {
 			s.Add("type", "pixmap")
 		}
-		m.Map.Add("", s)
+		b.Add("", s)
 	}
 }
 
@@ -120,9 +164,9 @@ func (m *Map) writeFontsList(filename string) error {
 	for font, shortName := range m.fonts {
 		file := m.locator.Font(font)
 		if file == "" {
-			log.Printf("font '%s' not found", font)
+			m.logger.Warn(fmt.Sprintf("font '%s' not found", font))
 		}
-		fmt.Fprintln(f, shortName, file)
+		fmt.Fprintln(f, shortName, filepath.ToSlash(file))
 	}
 	m.Map.Add("Fontset", "'"+filepath.Base(filename)+"'")
 	return nil
@@ -148,6 +192,30 @@ func (m *Map) WriteFiles(basename string) error {
 	return nil
 }
 
+// WriteSplitFiles writes the LAYERs of each layer into its own file. The
+// basename map file includes the layer files with INCLUDE.
+func (m *Map) WriteSplitFiles(basename string) error {
+	if len(m.fonts) > 0 {
+		if err := m.writeFontsList(basename + "-fonts.lst"); err != nil {
+			return err
+		}
+	}
+	names := make([]string, len(m.layerBlocks))
+	layers := make([][]byte, len(m.layerBlocks))
+	for i, l := range m.layerBlocks {
+		names[i] = l.name
+		layers[i] = []byte(l.layers.String() + "\n")
+	}
+	_, files := builder.SplitFiles(basename, names, ".map")
+
+	includes := Block{}
+	for _, f := range files {
+		includes.Add("Include", quote(f))
+	}
+	master := m.mapBlock(includes).String()
+	return builder.WriteSplitFiles(basename, []byte(master), files, layers, ".map")
+}
+
 type classGroup struct {
 	name    string
 	classes []Block
@@ -158,6 +226,11 @@ func (m *Map) AddLayer(layer mml.Layer, rules []mss.Rule) {
 		return
 	}
 
+	if layer.Type == mml.Raster {
+		m.addRasterLayer(layer, rules)
+		return
+	}
+
 	styles := []classGroup{}
 	style := classGroup{}
 
@@ -169,7 +242,7 @@ func (m *Map) AddLayer(layer mml.Layer, rules []mss.Rule) {
 	} else if layer.Type == mml.Point {
 		t = "POINT"
 	} else {
-		log.Println("unknown geometry type for layer", layer.Name)
+		m.logger.Warn(fmt.Sprintf("unknown geometry type for layer %s", layer.Name))
 		return
 	}
 
@@ -194,9 +267,14 @@ func (m *Map) AddLayer(layer mml.Layer, rules []mss.Rule) {
 		styles = append(styles, style)
 	}
 
+	lb := layerBlock{name: layer.Name}
+
 	for _, style := range styles {
 		l := NewBlock("LAYER")
 		l.Add("name", style.name)
+		if layer.Group != "" {
+			l.Add("Group", quote(layer.Group))
+		}
 
 		z := mss.RulesZoom(rules)
 		if z := z.First(); z > 0 {
@@ -212,15 +290,81 @@ func (m *Map) AddLayer(layer mml.Layer, rules []mss.Rule) {
 			l.Add("status", "OFF")
 		}
 		l.Add("type", t)
+		if layer.CompOp != "" {
+			l.Add("", NewBlock("COMPOSITE", Item{"Compop", quote(layer.CompOp)}))
+		}
 
 		m.addDatasource(&l, layer.Datasource, rules)
 		for _, c := range style.classes {
 			l.Add("", c)
 		}
 		m.Layers.Add("", l)
+		lb.layers.Add("", l)
+	}
+	if len(lb.layers.items) > 0 {
+		m.layerBlocks = append(m.layerBlocks, lb)
 	}
 }
 
+// addRasterLayer adds a single unclassified RASTER LAYER. The raster-
+// properties of the first rule are used for the whole layer.
+func (m *Map) addRasterLayer(layer mml.Layer, rules []mss.Rule) {
+	l := NewBlock("LAYER")
+	l.Add("name", layer.Name)
+	if layer.Group != "" {
+		l.Add("Group", quote(layer.Group))
+	}
+
+	z := mss.RulesZoom(rules)
+	if z := z.First(); z > 0 {
+		l.Add("MaxScaleDenom", zoomRanges[z])
+	}
+	if z := z.Last(); z < 22 {
+		l.Add("MinScaleDenom", zoomRanges[z+1])
+	}
+
+	if layer.Active {
+		l.Add("status", "ON")
+	} else {
+		l.Add("status", "OFF")
+	}
+	l.Add("type", "RASTER")
+
+	props := rules[0].Properties
+	composite := NewBlock("COMPOSITE")
+	if opacity, ok := props.GetFloat("raster-opacity"); ok {
+		composite.Add("Opacity", strconv.Itoa(int(opacity*100+0.5)))
+	}
+	if compOp, ok := props.GetString("raster-comp-op"); ok {
+		composite.Add("Compop", quote(compOp))
+	} else if layer.CompOp != "" {
+		composite.Add("Compop", quote(layer.CompOp))
+	}
+	if len(composite.items) > 0 {
+		l.Add("", composite)
+	}
+	if scaling, ok := props.GetString("raster-scaling"); ok {
+		switch scaling {
+		case "near":
+			l.Add("processing", quote("RESAMPLE=NEAREST"))
+		case "bilinear":
+			l.Add("processing", quote("RESAMPLE=BILINEAR"))
+		default:
+			l.Add("processing", quote("RESAMPLE=AVERAGE"))
+		}
+	}
+	if _, ok := props.GetStopList("raster-colorizer-stops"); ok {
+		m.logger.Warn(fmt.Sprintf("raster-colorizer not supported by MapServer for layer %s", layer.Name))
+	}
+
+	m.addDatasource(&l, layer.Datasource, rules)
+	m.Layers.Add("", l)
+
+	lb := layerBlock{name: layer.Name}
+	lb.layers.Add("", l)
+	m.layerBlocks = append(m.layerBlocks, lb)
+}
+
 /*
 xxFactors and RESOLUTION
 The same line widths, font sizes and some other properties will result in different
@@ -261,7 +405,7 @@ func (m *Map) newClass(r mss.Rule, layerType string) (b *Block, styled bool) {
 		b.Add("Expression", filter)
 	}
 
-	prefixes := mss.SortedPrefixes(r.Properties, []string{"line-", "polygon-", "polygon-pattern-", "text-", "shield-", "marker-", "point-", "building-"})
+	prefixes := mss.SortedPrefixes(r.Properties, []string{"line-", "polygon-", "polygon-pattern-", "text-", "shield-", "marker-", "point-", "building-", "dot-"})
 
 	for _, p := range prefixes {
 		prefixStyled := false
@@ -289,8 +433,13 @@ func (m *Map) newClass(r mss.Rule, layerType string) (b *Block, styled bool) {
 			prefixStyled = m.addPointSymbolizer(b, r)
 		case "building-":
 			prefixStyled = m.addBuildingSymbolizer(b, r)
+		case "dot-":
+			if !m.dotWarned {
+				m.logger.Warn("dot symbolizer not supported by MapServer, use marker-type: ellipse with a small marker-width instead")
+				m.dotWarned = true
+			}
 		default:
-			log.Println("invalid prefix", p)
+			m.logger.Warn(fmt.Sprintf("invalid prefix %s", p))
 		}
 		if prefixStyled {
 			styled = true
@@ -349,6 +498,11 @@ func (m *Map) addPolygonPatternSymbolizer(b *Block, r mss.Rule) (styled bool) {
 	if file, ok := r.Properties.GetString("polygon-pattern-file"); ok {
 		style := NewBlock("STYLE")
 		style.Add("SYMBOL", *m.symbolName(file))
+		if transform, ok := r.Properties.GetString("polygon-pattern-transform"); ok {
+			if size := m.addTransform(&style, transform, 0); size != 0 {
+				style.AddNonNil("Size", fmtFloat(size, true))
+			}
+		}
 		b.Add("", style)
 		return true
 	}
@@ -417,15 +571,11 @@ func (m *Map) addShieldSymbolizer(b *Block, r mss.Rule) (styled bool) {
 			style.AddNonNil("Color", fmtColor(r.Properties.GetColor("shield-fill")))
 			style.AddNonNil("Text", fmtField(r.Properties.GetFieldList("shield-name")))
 
-			style.AddNonNil("Force", fmtBool(r.Properties.GetBool("shield-allow-overlap")))
-
-			style.AddNonNil("MinDistance", fmtFloat(r.Properties.GetFloat("shield-min-distance")))
-			style.AddNonNil("RepeatDistance", fmtFloat(r.Properties.GetFloat("shield-spacing")))
-			style.AddNonNil("Buffer", fmtFloat(r.Properties.GetFloat("shield-min-padding")))
-
 			if color, ok := r.Properties.GetColor("shield-halo-fill"); ok {
 				style.AddNonNil("OutlineColor", fmtColor(color, true))
-				style.AddNonNil("OutlineWidth", fmtFloat(r.Properties.GetFloat("shield-halo-radius")))
+				if radius, ok := r.Properties.GetFloat("shield-halo-radius"); ok {
+					style.AddNonNil("OutlineWidth", fmtFloat(radius*HaloWidthFactor, true))
+				}
 			}
 
 			if faceNames, ok := r.Properties.GetStringList("shield-face-name"); ok {
@@ -435,10 +585,52 @@ func (m *Map) addShieldSymbolizer(b *Block, r mss.Rule) (styled bool) {
 
 			style.Add("Type", "truetype")
 
+			if wrapWidth, ok := r.Properties.GetFloat("shield-wrap-width"); ok {
+				style.AddNonNil("MaxLength", fmtFloat(wrapWidth/shieldSize, true))
+				style.AddNonNil("Wrap", fmtString(r.Properties.GetString("shield-wrap-character")))
+				style.Add("Align", "CENTER")
+			}
+		}
+
+		style.AddNonNil("Force", fmtBool(r.Properties.GetBool("shield-allow-overlap")))
+		if avoidEdges, ok := r.Properties.GetBool("shield-avoid-edges"); ok {
+			style.AddNonNil("Partials", fmtBool(!avoidEdges, true))
+		}
+
+		style.AddNonNil("MinDistance", fmtFloat(r.Properties.GetFloat("shield-min-distance")))
+		if spacing, ok := r.Properties.GetFloat("shield-repeat-distance"); ok {
+			style.AddNonNil("RepeatDistance", fmtFloat(spacing, true))
+		} else {
+			style.AddNonNil("RepeatDistance", fmtFloat(r.Properties.GetFloat("shield-spacing")))
+		}
+		if margin, ok := r.Properties.GetFloat("shield-margin"); ok {
+			style.AddNonNil("Buffer", fmtFloat(margin, true))
+		} else {
+			style.AddNonNil("Buffer", fmtFloat(r.Properties.GetFloat("shield-min-padding")))
 		}
 
 		shield := NewBlock("STYLE")
 		shield.Add("SYMBOL", *m.symbolName(shieldFile))
+		shield.Add("Geomtransform", quote("labelpnt"))
+		shield.AddNonNil("Opacity", fmtFloat(r.Properties.GetFloat("shield-opacity")))
+
+		// The text is placed at the label point and the symbol is offset
+		// relative to the text. Mapnik moves the image with the text, unless
+		// shield-unlock-image is true.
+		dx, _ := r.Properties.GetFloat("shield-dx")
+		dy, _ := r.Properties.GetFloat("shield-dy")
+		textDx, _ := r.Properties.GetFloat("shield-text-dx")
+		textDy, _ := r.Properties.GetFloat("shield-text-dy")
+		if unlock, _ := r.Properties.GetBool("shield-unlock-image"); unlock {
+			dx -= textDx
+			dy -= textDy
+		}
+		if textDx != 0 || textDy != 0 {
+			style.Add("Offset", fmt.Sprintf("%.0f %.0f", textDx, textDy))
+		}
+		if dx != 0 || dy != 0 {
+			shield.Add("Offset", fmt.Sprintf("%.0f %.0f", dx, dy))
+		}
 
 		style.Add("", shield)
 
@@ -454,6 +646,11 @@ func (m *Map) addPointSymbolizer(b *Block, r mss.Rule) (styled bool) {
 		style := NewBlock("STYLE")
 
 		style.Add("SYMBOL", *m.symbolName(pointFile))
+		if transform, ok := r.Properties.GetString("point-transform"); ok {
+			if size := m.addTransform(&style, transform, 0); size != 0 {
+				style.AddNonNil("Size", fmtFloat(size, true))
+			}
+		}
 		style.AddNonNil("Opacity", fmtFloat(r.Properties.GetFloat("point-opacity")))
 		// style.AddNonNil("Force", fmtBool(r.Properties.GetBool("point-allow-overlap")))
 
@@ -480,8 +677,8 @@ func (m *Map) addBuildingSymbolizer(b *Block, r mss.Rule) (styled bool) {
 			Item{"Linecap", "SQUARE"},
 			Item{"Linejoin", "MITER"},
 		))
-		// render roof
-		b.Add("", NewBlock("STYLE",
+		// render roof, building-height is in map units and not supported
+		roof := NewBlock("STYLE",
 			Item{"Width", "1"},
 			Item{"Offset", "-0.5 -3"},
 			Item{"Color", *fmtColor(fill, true)},
@@ -490,7 +687,9 @@ func (m *Map) addBuildingSymbolizer(b *Block, r mss.Rule) (styled bool) {
 			// Item{"Geomtransform", "(buffer([shape], 1))"},
 			Item{"Linecap", "SQUARE"},
 			Item{"Linejoin", "MITER"},
-		))
+		)
+		roof.AddNonNil("Opacity", fmtFloat(r.Properties.GetFloat("building-fill-opacity")))
+		b.Add("", roof)
 		return true
 	}
 	return false
@@ -501,10 +700,20 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 		style := NewBlock("STYLE")
 
 		style.Add("SYMBOL", *m.symbolName(markerFile))
-		style.AddNonNil("Size", fmtFloat(r.Properties.GetFloat("marker-width")))
+		size, _ := r.Properties.GetFloat("marker-width")
+		if transform, ok := r.Properties.GetString("marker-transform"); ok {
+			size = m.addTransform(&style, transform, size)
+		}
+		if size != 0 {
+			style.AddNonNil("Size", fmtFloat(size, true))
+		}
 		style.AddNonNil("Opacity", fmtFloat(r.Properties.GetFloat("marker-opacity")))
 		// style.AddNonNil("Force", fmtBool(r.Properties.GetBool("marker-allow-overlap")))
 
+		if placement, _ := r.Properties.GetString("marker-placement"); isLine && placement == "line" {
+			addMarkerGap(&style, r.Properties)
+		}
+
 		b.Add("", style)
 		return true
 	}
@@ -519,7 +728,7 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 			style.Add("SYMBOL", *m.ellipseSymbol())
 			size = 10.0 // matches arrow of mapnik default size
 		} else {
-			log.Printf("marker-type %s not supported", markerType)
+			m.logger.Warn(fmt.Sprintf("marker-type %s not supported", markerType))
 			return false
 		}
 		// emulate marker-opacity by fading marker-fill
@@ -542,25 +751,12 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 		style.AddNonNil("Width", fmtColor(r.Properties.GetColor("marker-line-width")))
 
 		if transform, ok := r.Properties.GetString("marker-transform"); ok {
-			tr, err := parseTransform(transform)
-			if err != nil {
-				log.Println(err)
-			}
-			if tr.rotate != 0.0 {
-				style.AddNonNil("Angle", fmtFloat(tr.rotate, true))
-			}
-			if tr.scale != 0.0 {
-				size *= tr.scale
-			}
+			size = m.addTransform(&style, transform, size)
 		}
 		style.AddNonNil("Size", fmtFloat(size, true))
 
 		if isLine {
-			if spacing, ok := r.Properties.GetFloat("marker-spacing"); ok {
-				style.AddNonNil("Gap", fmtFloat(-spacing, true))
-			} else {
-				style.AddNonNil("Gap", fmtFloat(-100, true)) // mapnik default
-			}
+			addMarkerGap(&style, r.Properties)
 		}
 
 		b.Add("", style)
@@ -570,6 +766,34 @@ func (m *Map) addMarkerSymbolizer(b *Block, r mss.Rule, isLine bool) (styled boo
 	return false
 }
 
+// addTransform adds the rotation and translation of the SVG transform to
+// style and returns size with the scale of the transform.
+func (m *Map) addTransform(style *Block, transform string, size float64) float64 {
+	tr, err := parseTransform(transform)
+	if err != nil {
+		m.logger.Warn(err.Error())
+	}
+	style.AddNonNil("Angle", tr.angle())
+	if tr.dx != 0 || tr.dy != 0 {
+		style.Add("Offset", fmt.Sprintf("%.0f %.0f", tr.dx, tr.dy))
+	}
+	if tr.scale != 0.0 {
+		size *= tr.scale
+	}
+	return size
+}
+
+// addMarkerGap places the marker along the line. Negative gaps align the
+// symbol to the line direction (like Mapnik marker-placement: line) and
+// ANGLE is relative to the line.
+func addMarkerGap(style *Block, properties *mss.Properties) {
+	if spacing, ok := properties.GetFloat("marker-spacing"); ok {
+		style.AddNonNil("Gap", fmtFloat(-spacing, true))
+	} else {
+		style.AddNonNil("Gap", fmtFloat(-100, true)) // mapnik default
+	}
+}
+
 var sanitizeFontName = regexp.MustCompile("[^-a-zA-Z0-9]")
 var sanitizeSymbolName = regexp.MustCompile("[^-a-zA-Z0-9]")
 
@@ -598,7 +822,7 @@ func (m *Map) symbolName(symbol mss.Value) *string {
 
 	file := m.locator.Image(str)
 	if file == "" {
-		log.Printf("symbol '%s' not found", str)
+		m.logger.Warn(fmt.Sprintf("symbol '%s' not found", str))
 	}
 	if m.svgSymbols == nil {
 		m.svgSymbols = make(map[string]string)
@@ -774,21 +998,21 @@ func (m *Map) addDatasource(block *Block, ds mml.Datasource, rules []mss.Rule) {
 		if fname != "" {
 			// TODO missing file
 			idx := strings.LastIndex(fname, ".") // without suffix
-			block.Add("data", quote(fname[:idx]))
+			block.Add("data", quotePath(fname[:idx]))
 			block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
 		}
 	case mml.SQLite:
 		fname := m.locator.SQLite(ds.Filename)
 		if fname != "" {
 			// TODO missing file
-			block.Add("connection", quote(fname))
+			block.Add("connection", quotePath(fname))
 		}
 		block.Add("data", quote(sqliteSelectString(ds.Query, ds.SRID)))
 		block.Add("connectiontype", "ogr")
 		block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
 	case mml.OGR:
 		// TODO missing file
-		block.Add("connection", quote(ds.Filename))
+		block.Add("connection", quotePath(ds.Filename))
 		// block.Add("data", quote((ds.Query, ds.SRID)))
 		block.Add("connectiontype", "ogr")
 		block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
@@ -803,6 +1027,31 @@ func (m *Map) addDatasource(block *Block, ds mml.Datasource, rules []mss.Rule) {
 	// 		{Name: "table", Value: ds.Query},
 	// 		{Name: "type", Value: "sqlite"},
 	// 	}
+	case mml.GDAL:
+		// TODO missing file
+		block.Add("data", quotePath(ds.Filename))
+		if ds.Band != "" {
+			block.Add("processing", quote("BANDS="+ds.Band))
+		}
+		if ds.Nodata != "" {
+			block.Add("processing", quote("NODATA="+ds.Nodata))
+		}
+		if ds.Overview != "" {
+			block.Add("", NewBlock("connectionoptions", Item{"", quote("OVERVIEW_LEVEL") + " " + quote(ds.Overview)}))
+		}
+		if ds.SRID != "" {
+			block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
+		}
+	case mml.Contour:
+		// TODO missing file
+		block.Add("connection", quotePath(ds.Filename))
+		if query := sql.ContourSelect(ds); query != "" {
+			block.Add("data", quote(strings.Replace(query, `"`, `\"`, -1)))
+		} else if ds.Layer != "" {
+			block.Add("data", quote(ds.Layer))
+		}
+		block.Add("connectiontype", "ogr")
+		block.Add("", NewBlock("projection", Item{"", quote("init=epsg:" + ds.SRID)}))
 	case nil:
 		// datasource might be nil for exports withour mml
 	default:
@@ -881,6 +1130,12 @@ func quote(v string) string {
 	return `"` + v + `"`
 }
 
+// quotePath quotes a file path with forward slashes, as MapServer handles
+// backslashes as escape characters, also on Windows.
+func quotePath(p string) string {
+	return quote(filepath.ToSlash(p))
+}
+
 func fmtKeyword(v mss.Value, ok bool) *string {
 	if !ok {
 		return nil
@@ -946,34 +1201,55 @@ func fmtColor(v color.RGBA, ok bool) *string {
 func fmtFilters(filters []mss.Filter) string {
 	parts := []string{}
 	for _, f := range filters {
-		field := "[" + f.Field + "]"
-
-		var value string
-		switch v := f.Value.(type) {
-		case nil:
-			value = "null"
-		case string:
-			// TODO quote " in string?!
-			value = `"` + v + `"`
-			// field needs to be quoted if we compare strings
-			// e.g. ('[field]' = "foo"), but ([field] = 5)
-			field = "'" + field + "'"
-		case float64:
-			value = string(*fmtFloat(v, true))
-		default:
-			log.Printf("unknown type of filter value: %s", v)
-			value = ""
+		var part string
+		if f.CompOp == mss.IN {
+			values := f.Value.([]mss.Value)
+			or := make([]string, len(values))
+			for i, v := range values {
+				or[i] = fmtFilter(f.Field, mss.EQ, v)
+			}
+			part = "(" + strings.Join(or, " OR ") + ")"
+		} else {
+			part = fmtFilter(f.Field, f.CompOp, f.Value)
 		}
-		parts = append(parts, "("+field+" "+f.CompOp.String()+" "+value+")")
+		if len(parts) > 0 && parts[len(parts)-1] == part {
+			// e.g. [field] != null and [field] != ''
+			continue
+		}
+		parts = append(parts, part)
 	}
 
 	s := strings.Join(parts, " AND ")
-	if len(filters) > 1 {
+	if len(parts) > 1 {
 		s = "(" + s + ")"
 	}
 	return s
 }
 
+func fmtFilter(field string, compOp mss.CompOp, v mss.Value) string {
+	field = "[" + field + "]"
+
+	var value string
+	switch v := v.(type) {
+	case nil:
+		// MapServer has no null values, missing values are empty strings
+		value = `""`
+		field = "'" + field + "'"
+	case string:
+		// TODO quote " in string?!
+		value = `"` + v + `"`
+		// field needs to be quoted if we compare strings
+		// e.g. ('[field]' = "foo"), but ([field] = 5)
+		field = "'" + field + "'"
+	case float64:
+		value = string(*fmtFloat(v, true))
+	default:
+		log.Printf("unknown type of filter value: %s", v)
+		value = ""
+	}
+	return "(" + field + " " + compOp.String() + " " + value + ")"
+}
+
 func fmtPattern(v []float64, ok bool) *Block {
 	if !ok {
 		return nil
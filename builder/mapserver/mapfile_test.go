@@ -1,8 +1,16 @@
 package mapserver
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -51,3 +59,175 @@ END`,
 			},
 		}.String())
 }
+
+func TestFmtFilters(t *testing.T) {
+	assert.Equal(t, `([type] = 1)`, fmtFilters([]mss.Filter{{Field: "type", CompOp: mss.EQ, Value: float64(1)}}))
+	assert.Equal(t, `(('[ref]' != "") AND ('[name]' = "foo"))`,
+		fmtFilters([]mss.Filter{
+			{Field: "ref", CompOp: mss.NEQ, Value: nil},
+			{Field: "ref", CompOp: mss.NEQ, Value: ""},
+			{Field: "name", CompOp: mss.EQ, Value: "foo"},
+		}))
+	assert.Equal(t, `((('[type]' = "a") OR ('[type]' = "b")) AND ([z] = 1))`,
+		fmtFilters([]mss.Filter{
+			{Field: "type", CompOp: mss.IN, Value: []mss.Value{"a", "b"}},
+			{Field: "z", CompOp: mss.EQ, Value: float64(1)},
+		}))
+}
+
+func TestShieldSymbolizer(t *testing.T) {
+	d := mss.New()
+	if err := d.ParseString(`#roads {
+		shield-file: url(shield.svg); shield-name: [ref]; shield-size: 10; shield-face-name: "Foo";
+		shield-text-dx: 2; shield-text-dy: -4; shield-dx: 1; shield-unlock-image: true;
+		shield-margin: 5; shield-avoid-edges: true; shield-opacity: 0.5;
+	}`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(&config.LookupLocator{})
+	b := NewBlock("CLASS")
+	assert.True(t, m.addShieldSymbolizer(&b, d.MSS().LayerRules("roads")[0]))
+	mapfile := b.String()
+	for _, e := range []string{
+		`OFFSET 2 -4`,
+		`BUFFER 5`,
+		`PARTIALS false`,
+		`GEOMTRANSFORM "labelpnt"`,
+		`OPACITY 0.5`,
+		`OFFSET -1 4`,
+	} {
+		if !strings.Contains(mapfile, e) {
+			t.Errorf("%s not found in\n%s", e, mapfile)
+		}
+	}
+}
+
+func TestLayerGroup(t *testing.T) {
+	d := mss.New()
+	if err := d.ParseString(`#roads { line-width: 1; }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(&config.LookupLocator{})
+	m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString, Active: true, Group: "streets", CompOp: "multiply"}, d.MSS().LayerRules("roads"))
+	mapfile := m.String()
+	for _, e := range []string{
+		`GROUP "streets"`,
+		`COMPOP "multiply"`,
+	} {
+		if !strings.Contains(mapfile, e) {
+			t.Errorf("%s not found in\n%s", e, mapfile)
+		}
+	}
+}
+
+func TestDEMLayers(t *testing.T) {
+	d := mss.New()
+	if err := d.ParseString(`
+		#hillshade { raster-opacity: 0.6; raster-comp-op: multiply; raster-scaling: bilinear; }
+		#contours { line-width: 1; }
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(&config.LookupLocator{})
+	m.AddLayer(mml.Layer{Name: "hillshade", Type: mml.Raster, Active: true,
+		Datasource: mml.GDAL{Filename: "hillshade.tif", SRID: "3857", Band: "1", Nodata: "0", Overview: "1"}},
+		d.MSS().LayerRules("hillshade"))
+	m.AddLayer(mml.Layer{Name: "contours", Type: mml.LineString, Active: true,
+		Datasource: mml.Contour{Filename: "contours.shp", SRID: "3857", ElevationField: "elev", Interval: "100"}},
+		d.MSS().LayerRules("contours"))
+	mapfile := m.String()
+	for _, e := range []string{
+		`TYPE RASTER`,
+		`DATA "hillshade.tif"`,
+		`PROCESSING "BANDS=1"`,
+		`PROCESSING "NODATA=0"`,
+		`PROCESSING "RESAMPLE=BILINEAR"`,
+		`"OVERVIEW_LEVEL" "1"`,
+		`OPACITY 60`,
+		`COMPOP "multiply"`,
+		`CONNECTIONTYPE ogr`,
+		`CONNECTION "contours.shp"`,
+		`DATA "SELECT * FROM \"contours\" WHERE \"elev\" % 100 = 0"`,
+	} {
+		if !strings.Contains(mapfile, e) {
+			t.Errorf("%s not found in\n%s", e, mapfile)
+		}
+	}
+	if strings.Contains(mapfile[:strings.Index(mapfile, "contours")], "CLASS") {
+		t.Errorf("raster layer with classes\n%s", mapfile)
+	}
+}
+
+func TestWriteSplitFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := mss.New()
+	if err := d.ParseString(`#roads { line-width: 1; ::fg { line-width: 2; } } #water { line-width: 2; }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	m := New(&config.LookupLocator{})
+	m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString, Active: true}, d.MSS().LayerRules("roads"))
+	m.AddLayer(mml.Layer{Name: "water", Type: mml.LineString, Active: true}, d.MSS().LayerRules("water"))
+	if err := m.WriteSplitFiles(filepath.Join(dir, "style.map")); err != nil {
+		t.Fatal(err)
+	}
+
+	master, err := ioutil.ReadFile(filepath.Join(dir, "style.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(master), "LAYER") || !strings.Contains(string(master),
+		"  INCLUDE \"style-layers/roads.map\"\n  INCLUDE \"style-layers/water.map\"") {
+		t.Errorf("unexpected master\n%s", master)
+	}
+	roads, err := ioutil.ReadFile(filepath.Join(dir, "style-layers", "roads.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(roads), "LAYER\n"); n != 2 || strings.Contains(string(roads), "water") {
+		t.Errorf("unexpected layer file\n%s", roads)
+	}
+	// String does not include the layers twice
+	if m.String() != m.String() {
+		t.Error("String modifies map")
+	}
+}
+
+func TestParseTransform(t *testing.T) {
+	tr, err := parseTransform("rotate([angle]) scale(0.5, 0.5) translate(2)")
+	assert.NoError(t, err)
+	assert.Equal(t, transformation{scale: 0.5, rotateField: "[angle]", dx: 2}, tr)
+	assert.Equal(t, "[angle]", *tr.angle())
+
+	tr, err = parseTransform("rotate(45, 5, 5) scale(2) scale(2)")
+	assert.NoError(t, err)
+	assert.Equal(t, transformation{scale: 4, rotate: 45}, tr)
+	assert.Equal(t, "-45", *tr.angle())
+
+	_, err = parseTransform("skewX(10)")
+	assert.Error(t, err)
+}
+
+func TestMetadata(t *testing.T) {
+	m := New(&config.LookupLocator{})
+	m.SetMetadata([]builder.Metadata{{Name: "magnacarto_version", Value: "0.1"}, {Name: "magnacarto_vars", Value: `name="foo"`}})
+	assert.Contains(t, m.String(), `      "magnacarto_version" "0.1"
+      "magnacarto_vars" "name=\"foo\""
+    END`)
+}
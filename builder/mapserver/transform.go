@@ -4,26 +4,77 @@ import (
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
+// transformation is the approximation of an SVG transform for MapServer
+// styles. MapServer only supports rotation, scaling and offsets for symbols.
 type transformation struct {
-	scale  float64
-	rotate float64
+	scale       float64
+	rotate      float64
+	rotateField string // rotate([field])
+	dx, dy      float64
 }
 
-var svgTransformRe = regexp.MustCompile(`(rotate|scale)\((-?\d*\.?\d+)\)`)
+var svgTransformRe = regexp.MustCompile(`(\w+)\s*\(([^()]*)\)`)
+var svgTransformArgsRe = regexp.MustCompile(`[\s,]+`)
 
 func parseTransform(transform string) (transformation, error) {
 	tr := transformation{}
 	for _, match := range svgTransformRe.FindAllStringSubmatch(transform, -1) {
+		args := svgTransformArgsRe.Split(strings.TrimSpace(match[2]), -1)
+		if len(args) == 1 && args[0] == "" {
+			return tr, fmt.Errorf("missing arguments for %s in %s", match[1], transform)
+		}
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			v, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				if match[1] == "rotate" && i == 0 && isField(arg) {
+					tr.rotateField = arg
+					continue
+				}
+				return tr, fmt.Errorf("unsupported argument %s for %s in %s", arg, match[1], transform)
+			}
+			values[i] = v
+		}
+
 		switch match[1] {
 		case "rotate":
-			tr.rotate, _ = strconv.ParseFloat(match[2], 64)
+			// rotate(a, cx, cy): rotation around cx/cy is not supported, the
+			// symbol is always rotated around its center.
+			tr.rotate += values[0]
 		case "scale":
-			tr.scale, _ = strconv.ParseFloat(match[2], 64)
+			// scale(sx, sy): MapServer only supports proportional scaling
+			if tr.scale == 0 {
+				tr.scale = 1
+			}
+			tr.scale *= values[0]
+		case "translate":
+			tr.dx += values[0]
+			if len(values) > 1 {
+				tr.dy += values[1]
+			}
 		default:
 			return tr, fmt.Errorf("unsupported transform function %s in %s", match[1], transform)
 		}
 	}
 	return tr, nil
 }
+
+func isField(v string) bool {
+	return len(v) > 2 && v[0] == '[' && v[len(v)-1] == ']'
+}
+
+// angle returns the MapServer ANGLE for the transformation. SVG rotates
+// clockwise, MapServer counter clockwise. Rotations from fields are passed
+// as attribute binding and can not be inverted.
+func (tr transformation) angle() *string {
+	if tr.rotateField != "" {
+		return &tr.rotateField
+	}
+	if tr.rotate != 0 {
+		return fmtFloat(-tr.rotate, true)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package builder
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omniscale/magnacarto"
+)
+
+// Metadata is a single item of the build metadata, e.g.
+// magnacarto_version=0.1.
+type Metadata struct {
+	Name  string
+	Value string
+}
+
+// EnableMetadata embeds the magnacarto version, the build time, the git
+// commit of the style and all variable overrides in maps that implement
+// MetadataSetter, so that renderings can be traced to a single build.
+func (b *Builder) EnableMetadata() {
+	b.metadata = true
+}
+
+// Metadata returns the build metadata. Only valid after Build with
+// EnableMetadata.
+func (b *Builder) Metadata() []Metadata {
+	return b.buildMetadata
+}
+
+// collectMetadata returns the metadata for the current build.
+func (b *Builder) collectMetadata() []Metadata {
+	md := []Metadata{{"magnacarto_version", magnacarto.Version}}
+
+	now := time.Now()
+	// reproducible builds, see https://reproducible-builds.org/specs/source-date-epoch/
+	if epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64); err == nil {
+		now = time.Unix(epoch, 0)
+	}
+	md = append(md, Metadata{"magnacarto_build_time", now.UTC().Format(time.RFC3339)})
+
+	styleFile := b.mml
+	if styleFile == "" && len(b.mss) > 0 {
+		styleFile = b.mss[0]
+	}
+	if styleFile != "" {
+		if b.mml != "" {
+			md = append(md, Metadata{"magnacarto_mml", filepath.Base(b.mml)})
+		}
+		if commit := gitCommit(filepath.Dir(styleFile)); commit != "" {
+			md = append(md, Metadata{"magnacarto_style_commit", commit})
+		}
+	}
+
+	if len(b.vars) > 0 {
+		vars := make([]string, 0, len(b.vars))
+		for name, value := range b.vars {
+			vars = append(vars, strings.TrimPrefix(name, "@")+"="+value)
+		}
+		sort.Strings(vars)
+		md = append(md, Metadata{"magnacarto_vars", strings.Join(vars, ";")})
+	}
+	return md
+}
+
+// gitCommit returns the commit of the git repository of dir, with a -dirty
+// suffix if tracked files are modified. Returns an empty string if dir is
+// not in a git repository, or if git is not installed.
+func gitCommit(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	commit := string(bytes.TrimSpace(out))
+	out, err = exec.Command("git", "-C", dir, "status", "--porcelain", "--untracked-files=no").Output()
+	if err == nil && len(bytes.TrimSpace(out)) > 0 {
+		commit += "-dirty"
+	}
+	return commit
+}
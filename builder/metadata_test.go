@@ -0,0 +1,96 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto"
+)
+
+func TestBuildMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "test.mml")
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"Stylesheet": ["test.mss"], "Layer": [{"name": "roads"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`@width: 1; #roads { line-width: @width; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SOURCE_DATE_EPOCH", "1500000000")
+	defer os.Unsetenv("SOURCE_DATE_EPOCH")
+
+	build := func(metadata bool) *testMap {
+		m := &testMap{}
+		b := New(m)
+		b.SetMML(mmlFile)
+		b.SetVar("width", "4")
+		if metadata {
+			b.EnableMetadata()
+		}
+		if err := b.Build(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(b.Metadata(), m.metadata) {
+			t.Errorf("metadata of builder and map differ: %v %v", b.Metadata(), m.metadata)
+		}
+		return m
+	}
+
+	if m := build(false); m.metadata != nil {
+		t.Error("unexpected metadata", m.metadata)
+	}
+
+	expected := []Metadata{
+		{"magnacarto_version", magnacarto.Version},
+		{"magnacarto_build_time", "2017-07-14T02:40:00Z"},
+		{"magnacarto_mml", "test.mml"},
+		{"magnacarto_vars", "width=4"},
+	}
+	if m := build(true); !reflect.DeepEqual(m.metadata, expected) {
+		t.Errorf("unexpected metadata %v", m.metadata)
+	}
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.org"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal(string(out), err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("add", "test.mml", "test.mss")
+	git("commit", "-q", "-m", "test")
+	commit := git("rev-parse", "HEAD")
+
+	commitOf := func() string {
+		for _, item := range build(true).metadata {
+			if item.Name == "magnacarto_style_commit" {
+				return item.Value
+			}
+		}
+		return ""
+	}
+	if c := commitOf(); c != commit {
+		t.Errorf("unexpected commit %q, expected %q", c, commit)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mss"), []byte(`#roads { line-width: 2; }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c := commitOf(); c != commit+"-dirty" {
+		t.Errorf("unexpected commit %q, expected %q", c, commit+"-dirty")
+	}
+}
@@ -0,0 +1,89 @@
+package builder
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// LayerOverride changes the status or the zoom range of all MML layers that
+// match Pattern (see path.Match, e.g. admin*).
+type LayerOverride struct {
+	Pattern string
+	// Active enables or disables the layers, nil keeps the status.
+	Active *bool
+	// Zoom limits the zoom levels of the layers, InvalidZoom keeps the zoom.
+	Zoom mss.ZoomRange
+}
+
+// ParseLayerZoom parses a zoom override like roads=8-18, roads=8- or
+// roads=-18.
+func ParseLayerZoom(s string) (LayerOverride, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return LayerOverride{}, fmt.Errorf("invalid layer zoom %q, expected layer=min-max", s)
+	}
+	min, max := 0, 30
+	zooms := strings.SplitN(parts[1], "-", 2)
+	var err error
+	if zooms[0] != "" {
+		if min, err = strconv.Atoi(zooms[0]); err != nil {
+			return LayerOverride{}, fmt.Errorf("invalid min zoom in %q", s)
+		}
+	}
+	if len(zooms) == 1 {
+		max = min
+	} else if zooms[1] != "" {
+		if max, err = strconv.Atoi(zooms[1]); err != nil {
+			return LayerOverride{}, fmt.Errorf("invalid max zoom in %q", s)
+		}
+	}
+	z := mss.NewZoomRange(min, max)
+	if z == mss.InvalidZoom {
+		return LayerOverride{}, fmt.Errorf("invalid zoom range in %q", s)
+	}
+	return LayerOverride{Pattern: parts[0], Zoom: z}, nil
+}
+
+// AddLayerOverride adds an override for the layers of the MML. Overrides
+// are applied in the order they are added, after the group status.
+func (b *Builder) AddLayerOverride(o LayerOverride) error {
+	if _, err := path.Match(o.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid layer pattern %q: %s", o.Pattern, err)
+	}
+	b.overrides = append(b.overrides, o)
+	return nil
+}
+
+// applyOverrides changes the status of the layers and adds the zoom limits
+// of all overridden layers to zoom. It returns an error if an override
+// matches no layer, as this is likely a typo.
+func (b *Builder) applyOverrides(layers []mml.Layer, zoom map[string]mss.ZoomRange) error {
+	for _, o := range b.overrides {
+		matched := false
+		for i := range layers {
+			if ok, _ := path.Match(o.Pattern, layers[i].Name); !ok {
+				continue
+			}
+			matched = true
+			if o.Active != nil {
+				layers[i].Active = *o.Active
+			}
+			if o.Zoom != mss.InvalidZoom {
+				if z, ok := zoom[layers[i].Name]; ok {
+					zoom[layers[i].Name] = z & o.Zoom
+				} else {
+					zoom[layers[i].Name] = o.Zoom
+				}
+			}
+		}
+		if !matched {
+			return fmt.Errorf("layer override %q matches no layer", o.Pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+// Package preview builds styles for the pure-Go preview renderer.
+//
+// Only layers with Shapefile or GeoJSON (OGR) datasources are included and
+// only the main properties of each symbolizer are converted. See package
+// github.com/omniscale/magnacarto/preview for the supported features.
+package preview
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/color"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+	"github.com/omniscale/magnacarto/preview"
+)
+
+type maker struct{}
+
+func (m maker) Type() string       { return "preview" }
+func (m maker) FileSuffix() string { return ".json" }
+func (m maker) New(locator config.Locator) builder.MapWriter {
+	return New(locator)
+}
+
+var Maker = maker{}
+
+type Map struct {
+	Style   preview.Style
+	locator config.Locator
+	logger  *logging.Logger
+}
+
+func New(locator config.Locator) *Map {
+	return &Map{locator: locator, logger: logging.Default()}
+}
+
+// SetLogger sets the logger for warnings, like unsupported datasources.
+func (m *Map) SetLogger(l *logging.Logger) {
+	m.logger = l
+}
+
+func (m *Map) SetBackgroundColor(c color.RGBA) {
+	m.Style.Background = &c
+}
+
+func (m *Map) Write(w io.Writer) error {
+	return m.Style.Write(w)
+}
+
+func (m *Map) WriteFiles(basename string) error {
+	f, err := os.Create(basename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.Write(f)
+}
+
+func (m *Map) AddLayer(l mml.Layer, rules []mss.Rule) {
+	if !l.Active {
+		return
+	}
+	var file string
+	switch ds := l.Datasource.(type) {
+	case mml.Shapefile:
+		file = ds.Filename
+	case mml.OGR:
+		switch strings.ToLower(filepath.Ext(ds.Filename)) {
+		case ".geojson", ".json":
+			file = ds.Filename
+		}
+	}
+	if file == "" {
+		m.logger.Warn(fmt.Sprintf("datasource of layer %s not supported by preview renderer, only Shapefiles and GeoJSON", l.Name))
+		return
+	}
+	if fname := m.locator.Shape(file); fname != "" {
+		file = fname
+	}
+
+	layer := preview.Layer{
+		Name: l.Name,
+		Type: string(l.Type),
+		File: file,
+		SRS:  l.SRS,
+	}
+	var style *preview.LayerStyle
+	for _, r := range rules {
+		name := r.Layer
+		if r.Attachment != "" {
+			name += "-" + r.Attachment
+		}
+		if style == nil || style.Name != name {
+			layer.Styles = append(layer.Styles, preview.LayerStyle{Name: name})
+			style = &layer.Styles[len(layer.Styles)-1]
+		}
+		if rule, ok := newRule(r); ok {
+			style.Rules = append(style.Rules, rule)
+		}
+	}
+	m.Style.Layers = append(m.Style.Layers, layer)
+}
+
+func newRule(r mss.Rule) (preview.Rule, bool) {
+	rule := preview.Rule{Zoom: r.Zoom}
+	for _, f := range r.Filters {
+		filter := preview.Filter{Field: f.Field, Op: f.CompOp.String(), Value: f.Value}
+		if values, ok := f.Value.([]mss.Value); ok {
+			list := make([]interface{}, len(values))
+			for i := range values {
+				list[i] = values[i]
+			}
+			filter.Value = list
+		}
+		rule.Filters = append(rule.Filters, filter)
+	}
+
+	prefixes := mss.SortedPrefixes(r.Properties, []string{"line-", "polygon-", "text-", "shield-", "marker-", "point-", "building-", "dot-"})
+	for _, p := range prefixes {
+		r.Properties.SetDefaultInstance(p.Instance)
+		if sym, ok := newSymbolizer(p.Name, r.Properties); ok {
+			rule.Symbolizers = append(rule.Symbolizers, sym)
+		}
+		r.Properties.SetDefaultInstance("")
+	}
+	return rule, len(rule.Symbolizers) > 0
+}
+
+func newSymbolizer(prefix string, p *mss.Properties) (preview.Symbolizer, bool) {
+	switch prefix {
+	case "line-":
+		width, ok := p.GetFloat("line-width")
+		if !ok {
+			return preview.Symbolizer{}, false
+		}
+		sym := preview.Symbolizer{Type: "line", Width: width, Stroke: &color.RGBA{A: 1}}
+		if c, ok := p.GetColor("line-color"); ok {
+			sym.Stroke = &c
+		}
+		sym.Opacity = opacity(p, "line-opacity")
+		sym.Dasharray, _ = p.GetFloatList("line-dasharray")
+		sym.Cap, _ = p.GetString("line-cap")
+		return sym, true
+	case "polygon-", "building-":
+		fill, ok := p.GetColor(prefix + "fill")
+		if !ok {
+			return preview.Symbolizer{}, false
+		}
+		sym := preview.Symbolizer{Type: "polygon", Fill: &fill}
+		if prefix == "polygon-" {
+			sym.Opacity = opacity(p, "polygon-opacity")
+		} else {
+			sym.Opacity = opacity(p, "building-fill-opacity")
+		}
+		return sym, true
+	case "text-", "shield-":
+		text, ok := p.GetFieldList(prefix + "name")
+		if !ok {
+			return preview.Symbolizer{}, false
+		}
+		sym := preview.Symbolizer{Type: "text", Size: 10}
+		for _, v := range text {
+			switch v := v.(type) {
+			case mss.Field:
+				field := strings.TrimSuffix(strings.TrimPrefix(string(v), "["), "]")
+				sym.Text = append(sym.Text, preview.TextPart{Field: field})
+			case string:
+				sym.Text = append(sym.Text, preview.TextPart{Text: v})
+			}
+		}
+		if size, ok := p.GetFloat(prefix + "size"); ok {
+			sym.Size = size
+		}
+		if c, ok := p.GetColor(prefix + "fill"); ok {
+			sym.Fill = &c
+		}
+		if c, ok := p.GetColor(prefix + "halo-fill"); ok {
+			sym.HaloFill = &c
+			sym.HaloRadius, _ = p.GetFloat(prefix + "halo-radius")
+		}
+		sym.Opacity = opacity(p, prefix+"opacity")
+		sym.AllowOverlap, _ = p.GetBool(prefix + "allow-overlap")
+		return sym, true
+	case "marker-":
+		_, hasFile := p.GetString("marker-file")
+		_, hasType := p.GetString("marker-type")
+		_, hasFill := p.GetColor("marker-fill")
+		if !hasFile && !hasType && !hasFill {
+			return preview.Symbolizer{}, false
+		}
+		// SVG files are not supported, all markers are rendered as circles
+		// with the defaults of Mapnik
+		sym := preview.Symbolizer{Type: "marker", Size: 10, Width: 0.5}
+		sym.Fill = &color.RGBA{B: 1, A: 1}
+		sym.Stroke = &color.RGBA{A: 1}
+		if c, ok := p.GetColor("marker-fill"); ok {
+			sym.Fill = &c
+		}
+		if c, ok := p.GetColor("marker-line-color"); ok {
+			sym.Stroke = &c
+		}
+		if w, ok := p.GetFloat("marker-line-width"); ok {
+			sym.Width = w
+		}
+		if size, ok := p.GetFloat("marker-width"); ok {
+			sym.Size = size
+		}
+		sym.Opacity = opacity(p, "marker-opacity")
+		return sym, true
+	case "point-":
+		if _, ok := p.GetString("point-file"); !ok {
+			return preview.Symbolizer{}, false
+		}
+		sym := preview.Symbolizer{Type: "marker", Size: 4, Fill: &color.RGBA{A: 1}}
+		sym.Opacity = opacity(p, "point-opacity")
+		return sym, true
+	case "dot-":
+		fill, ok := p.GetColor("dot-fill")
+		if !ok {
+			return preview.Symbolizer{}, false
+		}
+		sym := preview.Symbolizer{Type: "marker", Size: 1, Fill: &fill}
+		if w, ok := p.GetFloat("dot-width"); ok {
+			sym.Size = w
+		}
+		sym.Opacity = opacity(p, "dot-opacity")
+		return sym, true
+	}
+	return preview.Symbolizer{}, false
+}
+
+// opacity returns the opacity property or 1 if it is not set.
+func opacity(p *mss.Properties, property string) float64 {
+	if v, ok := p.GetFloat(property); ok {
+		return v
+	}
+	return 1
+}
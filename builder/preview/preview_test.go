@@ -0,0 +1,71 @@
+package preview
+
+import (
+	"testing"
+
+	"github.com/omniscale/magnacarto/color"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+	"github.com/omniscale/magnacarto/preview"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddLayer(t *testing.T) {
+	d := mss.New()
+	if err := d.ParseString(`
+		#roads[type='primary'][zoom>=10] { line-width: 2; line-color: red; line-dasharray: 4, 2; }
+		#roads::label[zoom>=12] { text-name: [name] + ' ' + [ref]; text-size: 20; text-halo-fill: white; text-halo-radius: 1; }
+		#pois { marker-fill: green; }
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(&config.LookupLocator{})
+	m.SetBackgroundColor(color.RGBA{R: 1, G: 1, B: 1, A: 1})
+	m.AddLayer(mml.Layer{Name: "roads", Type: mml.LineString, Active: true,
+		Datasource: mml.Shapefile{Filename: "roads.shp"}}, d.MSS().LayerRules("roads"))
+	m.AddLayer(mml.Layer{Name: "pois", Type: mml.Point, Active: true, SRS: "+init=epsg:3857",
+		Datasource: mml.OGR{Filename: "pois.geojson"}}, d.MSS().LayerRules("pois"))
+	m.AddLayer(mml.Layer{Name: "landuse", Type: mml.Polygon, Active: true,
+		Datasource: mml.PostGIS{Query: "landuse"}}, nil)
+	m.AddLayer(mml.Layer{Name: "inactive", Type: mml.Point, Active: false,
+		Datasource: mml.Shapefile{Filename: "inactive.shp"}}, d.MSS().LayerRules("pois"))
+
+	s := m.Style
+	assert.Equal(t, &color.RGBA{R: 1, G: 1, B: 1, A: 1}, s.Background)
+	if !assert.Len(t, s.Layers, 2) {
+		return
+	}
+
+	roads := s.Layers[0]
+	assert.Equal(t, "roads.shp", roads.File)
+	if assert.Len(t, roads.Styles, 2) {
+		assert.Equal(t, "roads", roads.Styles[0].Name)
+		assert.Equal(t, "roads-label", roads.Styles[1].Name)
+
+		line := roads.Styles[0].Rules[0]
+		assert.Equal(t, []preview.Filter{{Field: "type", Op: "=", Value: "primary"}}, line.Filters)
+		assert.Equal(t, mss.NewZoomRange(10, 30), line.Zoom)
+		assert.Equal(t, preview.Symbolizer{
+			Type: "line", Width: 2, Opacity: 1, Dasharray: []float64{4, 2},
+			Stroke: &color.RGBA{R: 1, A: 1},
+		}, line.Symbolizers[0])
+
+		label := roads.Styles[1].Rules[0].Symbolizers[0]
+		assert.Equal(t, []preview.TextPart{{Field: "name"}, {Text: " "}, {Field: "ref"}}, label.Text)
+		assert.Equal(t, 20.0, label.Size)
+		assert.Equal(t, 1.0, label.HaloRadius)
+	}
+
+	pois := s.Layers[1]
+	assert.Equal(t, "pois.geojson", pois.File)
+	assert.Equal(t, "+init=epsg:3857", pois.SRS)
+	marker := pois.Styles[0].Rules[0].Symbolizers[0]
+	assert.Equal(t, "marker", marker.Type)
+	assert.Equal(t, 10.0, marker.Size)
+	assert.Equal(t, color.RGBA{R: 0, G: 128.0 / 255, B: 0, A: 1}, *marker.Fill)
+}
@@ -0,0 +1,81 @@
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SplitWriter is implemented by maps that can write each layer into its own
+// file, next to a master file that includes all layer files.
+type SplitWriter interface {
+	WriteSplitFiles(basename string) error
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^\w.-]+`)
+
+// SplitFiles returns the dir for the layer files of basename (style.xml ->
+// style-layers) and a unique file name for each layer, relative to the dir
+// of basename.
+func SplitFiles(basename string, layers []string, suffix string) (string, []string) {
+	dir := splitDir(basename)
+	rel := filepath.Base(dir)
+	files := make([]string, len(layers))
+	seen := map[string]int{}
+	for i, l := range layers {
+		name := unsafeFileChars.ReplaceAllString(l, "_")
+		seen[name]++
+		if n := seen[name]; n > 1 {
+			name += "-" + strconv.Itoa(n)
+		}
+		// includes use / on all platforms
+		files[i] = rel + "/" + name + suffix
+	}
+	return dir, files
+}
+
+// WriteSplitFiles writes the master file and all layer files from
+// SplitFiles. Unchanged files are not rewritten, to keep their modification
+// time for partial deploys. Other files with suffix in the layers dir are
+// removed.
+func WriteSplitFiles(basename string, master []byte, files []string, layers [][]byte, suffix string) error {
+	dir := splitDir(basename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	written := map[string]bool{}
+	for i, f := range files {
+		fname := filepath.Join(filepath.Dir(basename), filepath.FromSlash(f))
+		if err := writeIfChanged(fname, layers[i]); err != nil {
+			return err
+		}
+		written[filepath.Base(fname)] = true
+	}
+	old, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		return err
+	}
+	for _, f := range old {
+		if !written[filepath.Base(f)] {
+			if err := os.Remove(f); err != nil {
+				return err
+			}
+		}
+	}
+	return writeIfChanged(basename, master)
+}
+
+func splitDir(basename string) string {
+	return strings.TrimSuffix(basename, filepath.Ext(basename)) + "-layers"
+}
+
+func writeIfChanged(fname string, content []byte) error {
+	if old, err := ioutil.ReadFile(fname); err == nil && bytes.Equal(old, content) {
+		return nil
+	}
+	return ioutil.WriteFile(fname, content, 0644)
+}
@@ -0,0 +1,54 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSplitFiles(t *testing.T) {
+	dir, files := SplitFiles("out/style.xml", []string{"roads", "roads", "land/water", "labels"}, ".xml")
+	if dir != filepath.Join("out", "style-layers") {
+		t.Error("unexpected dir", dir)
+	}
+	expected := []string{"style-layers/roads.xml", "style-layers/roads-2.xml", "style-layers/land_water.xml", "style-layers/labels.xml"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Error("unexpected files", files)
+	}
+}
+
+func TestWriteSplitFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basename := filepath.Join(dir, "style.xml")
+	_, files := SplitFiles(basename, []string{"roads", "water"}, ".xml")
+	if err := WriteSplitFiles(basename, []byte("master"), files, [][]byte{[]byte("roads"), []byte("water")}, ".xml"); err != nil {
+		t.Fatal(err)
+	}
+	roads := filepath.Join(dir, "style-layers", "roads.xml")
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(roads, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	_, files = SplitFiles(basename, []string{"roads"}, ".xml")
+	if err := WriteSplitFiles(basename, []byte("master2"), files, [][]byte{[]byte("roads")}, ".xml"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(roads); err != nil || !fi.ModTime().Equal(old) {
+		t.Error("unchanged file rewritten", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "style-layers", "water.xml")); !os.IsNotExist(err) {
+		t.Error("stale layer file not removed", err)
+	}
+	if content, _ := ioutil.ReadFile(basename); string(content) != "master2" {
+		t.Error("unexpected master", string(content))
+	}
+}
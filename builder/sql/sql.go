@@ -2,8 +2,10 @@
 package sql
 
 import (
+	"path/filepath"
 	"strings"
 
+	"github.com/omniscale/magnacarto/mml"
 	"github.com/omniscale/magnacarto/mss"
 )
 
@@ -18,18 +20,31 @@ func filterItems(rules []mss.Rule) map[string]map[string]struct{} {
 		// by matching at least one filter.
 		found := false
 		for _, f := range r.Filters {
-			if f.CompOp != mss.EQ {
+			var values []mss.Value
+			switch f.CompOp {
+			case mss.EQ:
+				values = []mss.Value{f.Value}
+			case mss.IN:
+				values = f.Value.([]mss.Value)
+			default:
 				continue
 			}
-			v, ok := f.Value.(string)
-			if !ok {
+			strs := make([]string, 0, len(values))
+			for _, v := range values {
+				if v, ok := v.(string); ok {
+					strs = append(strs, v)
+				}
+			}
+			if len(strs) != len(values) {
 				continue
 			}
 			found = true
 			if result[f.Field] == nil {
 				result[f.Field] = make(map[string]struct{})
 			}
-			result[f.Field][v] = struct{}{}
+			for _, v := range strs {
+				result[f.Field][v] = struct{}{}
+			}
 		}
 		if !found {
 			return nil
@@ -75,3 +90,18 @@ func WrapWhere(query, where string) string {
 	}
 	return "(SELECT * FROM " + query + " WHERE " + where + ") as filtered"
 }
+
+// ContourSelect returns an OGR SQL query for all contour lines of ds with an
+// elevation that is a multiple of the interval. Returns an empty string for
+// contour sources without an interval.
+func ContourSelect(ds mml.Contour) string {
+	if ds.Interval == "" {
+		return ""
+	}
+	layer := ds.Layer
+	if layer == "" {
+		// single layer sources (e.g. shapefiles) are named after the file
+		layer = strings.TrimSuffix(filepath.Base(ds.Filename), filepath.Ext(ds.Filename))
+	}
+	return "SELECT * FROM \"" + layer + "\" WHERE \"" + ds.ElevationField + "\" % " + ds.Interval + " = 0"
+}
@@ -0,0 +1,538 @@
+// Package cartodiff compares Mapnik XML of magnacarto with the output of
+// carto (https://github.com/mapbox/carto).
+//
+// The comparison is semantic: fontsets are resolved to their fonts, numbers,
+// colors, lists and filters are normalized, and styles and layers are
+// matched by name. Differences that do not change the rendering (e.g. map
+// parameters or the order of attributes) are not reported.
+package cartodiff
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/color"
+)
+
+// Difference of a single element, attribute or value.
+type Difference struct {
+	// Path of the element, e.g. Style[roads]/Rule[2]/LineSymbolizer[0]@stroke
+	Path       string
+	Carto      string
+	Magnacarto string
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%s: carto %s, magnacarto %s", d.Path, describe(d.Carto), describe(d.Magnacarto))
+}
+
+func describe(v string) string {
+	if v == "" {
+		return "<missing>"
+	}
+	return strconv.Quote(v)
+}
+
+// Report is the result of a comparison.
+type Report struct {
+	Styles      int
+	Layers      int
+	Rules       int
+	Symbolizers int
+	Differences []Difference
+}
+
+// Compatible returns whether no differences were found.
+func (r *Report) Compatible() bool {
+	return len(r.Differences) == 0
+}
+
+// Write writes the report in a human readable form.
+func (r *Report) Write(w io.Writer) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "compared %d layers, %d styles, %d rules and %d symbolizers\n",
+		r.Layers, r.Styles, r.Rules, r.Symbolizers)
+	if r.Compatible() {
+		fmt.Fprintln(buf, "no differences found")
+	} else {
+		fmt.Fprintf(buf, "%d differences found:\n", len(r.Differences))
+		for _, d := range r.Differences {
+			fmt.Fprintln(buf, "  "+d.String())
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (r *Report) add(path, carto, magnacarto string) {
+	r.Differences = append(r.Differences, Difference{Path: path, Carto: carto, Magnacarto: magnacarto})
+}
+
+// RunCarto calls the carto command for mml and returns the Mapnik XML.
+// carto is called from the directory of the mml file, as paths in the MML
+// are relative to this directory.
+func RunCarto(cartoBin string, mml string, args ...string) ([]byte, error) {
+	if cartoBin == "" {
+		cartoBin = "carto"
+	}
+	cmd := exec.Command(cartoBin, append(args, filepath.Base(mml))...)
+	cmd.Dir = filepath.Dir(mml)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// carto writes some errors to stdout
+		return nil, fmt.Errorf("error calling carto: %s\n%s%s", err, out, stderr.Bytes())
+	}
+	return out, nil
+}
+
+// Compare compares the Mapnik XML of carto and magnacarto.
+func Compare(carto, magnacarto []byte) (*Report, error) {
+	c, err := parse(carto)
+	if err != nil {
+		return nil, fmt.Errorf("parsing carto XML: %s", err)
+	}
+	m, err := parse(magnacarto)
+	if err != nil {
+		return nil, fmt.Errorf("parsing magnacarto XML: %s", err)
+	}
+	if c.name != "Map" || m.name != "Map" {
+		return nil, fmt.Errorf("missing Map element")
+	}
+	resolveFontSets(c)
+	resolveFontSets(m)
+
+	r := &Report{}
+	// other map attributes (srs, maximum-extent, font-directory, etc.) are
+	// set by the caller of the renderer
+	if cv, mv := c.attrs["background-color"], m.attrs["background-color"]; !equalValue("background-color", cv, mv) {
+		r.add("Map@background-color", cv, mv)
+	}
+	compareNamed(r, "Style", c, m, func(path string, c, m *node) {
+		r.Styles++
+		compareStyle(r, path, c, m)
+	})
+	compareNamed(r, "Layer", c, m, func(path string, c, m *node) {
+		r.Layers++
+		compareLayer(r, path, c, m)
+	})
+	return r, nil
+}
+
+type node struct {
+	name     string
+	attrs    map[string]string
+	text     string
+	children []*node
+}
+
+func (n *node) childs(name string) []*node {
+	var result []*node
+	for _, c := range n.children {
+		if c.name == name {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func (n *node) childText(name string) string {
+	for _, c := range n.children {
+		if c.name == name {
+			return c.text
+		}
+	}
+	return ""
+}
+
+func parse(b []byte) (*node, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var stack []*node
+	var root *node
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			n := &node{name: tok.Name.Local, attrs: make(map[string]string)}
+			for _, a := range tok.Attr {
+				n.attrs[a.Name.Local] = a.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			n := stack[len(stack)-1]
+			n.text = strings.TrimSpace(n.text)
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text += string(tok)
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("empty document")
+	}
+	return root, nil
+}
+
+// resolveFontSets replaces all fontset-name attributes with a face-name
+// attribute with all fonts of the fontset. Fontsets are named differently
+// by carto and magnacarto and carto uses face-name for single fonts.
+func resolveFontSets(m *node) {
+	fontSets := map[string]string{}
+	for _, fs := range m.childs("FontSet") {
+		var faces []string
+		for _, f := range fs.childs("Font") {
+			faces = append(faces, f.attrs["face-name"])
+		}
+		fontSets[fs.attrs["name"]] = strings.Join(faces, ", ")
+	}
+	var walk func(n *node)
+	walk = func(n *node) {
+		if name, ok := n.attrs["fontset-name"]; ok {
+			delete(n.attrs, "fontset-name")
+			n.attrs["face-name"] = fontSets[name]
+		}
+		for _, c := range n.children {
+			walk(c)
+		}
+	}
+	walk(m)
+}
+
+// compareNamed compares all elements of type elem, matched by their name.
+func compareNamed(r *Report, elem string, c, m *node, compare func(path string, c, m *node)) {
+	cartoElems := map[string]*node{}
+	var names []string
+	for _, n := range c.childs(elem) {
+		cartoElems[n.attrs["name"]] = n
+		names = append(names, n.attrs["name"])
+	}
+	magnacartoElems := map[string]*node{}
+	for _, n := range m.childs(elem) {
+		name := n.attrs["name"]
+		magnacartoElems[name] = n
+		if _, ok := cartoElems[name]; !ok {
+			r.add(elem+"["+name+"]", "", "present")
+		}
+	}
+	for _, name := range names {
+		path := elem + "[" + name + "]"
+		mn, ok := magnacartoElems[name]
+		if !ok {
+			r.add(path, "present", "")
+			continue
+		}
+		compare(path, cartoElems[name], mn)
+	}
+}
+
+func compareStyle(r *Report, path string, c, m *node) {
+	compareAttrs(r, path, c, m)
+	cRules, mRules := c.childs("Rule"), m.childs("Rule")
+	if len(cRules) != len(mRules) {
+		r.add(path+"/Rule", strconv.Itoa(len(cRules))+" rules", strconv.Itoa(len(mRules))+" rules")
+	}
+	for i := 0; i < len(cRules) && i < len(mRules); i++ {
+		r.Rules++
+		compareRule(r, fmt.Sprintf("%s/Rule[%d]", path, i), cRules[i], mRules[i])
+	}
+}
+
+func compareRule(r *Report, path string, c, m *node) {
+	for _, elem := range []string{"MaxScaleDenominator", "MinScaleDenominator"} {
+		if cv, mv := c.childText(elem), m.childText(elem); !equalValue(elem, cv, mv) {
+			r.add(path+"/"+elem, cv, mv)
+		}
+	}
+	if cv, mv := c.childText("Filter"), m.childText("Filter"); normFilter(cv) != normFilter(mv) {
+		r.add(path+"/Filter", cv, mv)
+	}
+
+	cSymbs, mSymbs := symbolizers(c), symbolizers(m)
+	if cOrder, mOrder := symbolizerNames(cSymbs), symbolizerNames(mSymbs); cOrder != mOrder {
+		r.add(path, cOrder, mOrder)
+	}
+	// match symbolizers by type, so that a single missing symbolizer does
+	// not result in differences for all following symbolizers
+	seen := map[string]int{}
+	for _, cs := range cSymbs {
+		i := seen[cs.name]
+		seen[cs.name]++
+		symbPath := fmt.Sprintf("%s/%s[%d]", path, cs.name, i)
+		same := named(mSymbs, cs.name)
+		if i >= len(same) {
+			continue // reported by order check
+		}
+		r.Symbolizers++
+		compareAttrs(r, symbPath, cs, same[i])
+		if normText(cs.text) != normText(same[i].text) {
+			r.add(symbPath, cs.text, same[i].text)
+		}
+	}
+}
+
+func compareLayer(r *Report, path string, c, m *node) {
+	compareAttrs(r, path, c, m)
+	cStyles, mStyles := layerStyles(c), layerStyles(m)
+	if cStyles != mStyles {
+		r.add(path+"/StyleName", cStyles, mStyles)
+	}
+	cParams, mParams := datasourceParams(c), datasourceParams(m)
+	var names []string
+	for name := range cParams {
+		names = append(names, name)
+	}
+	for name := range mParams {
+		if _, ok := cParams[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !equalValue(name, cParams[name], mParams[name]) {
+			r.add(path+"/Datasource@"+name, cParams[name], mParams[name])
+		}
+	}
+}
+
+func symbolizers(rule *node) []*node {
+	var result []*node
+	for _, c := range rule.children {
+		if strings.HasSuffix(c.name, "Symbolizer") {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func named(nodes []*node, name string) []*node {
+	var result []*node
+	for _, n := range nodes {
+		if n.name == name {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+func symbolizerNames(nodes []*node) string {
+	names := make([]string, len(nodes))
+	for i, n := range nodes {
+		names[i] = n.name
+	}
+	return strings.Join(names, ", ")
+}
+
+func layerStyles(layer *node) string {
+	var names []string
+	for _, s := range layer.childs("StyleName") {
+		names = append(names, s.text)
+	}
+	return strings.Join(names, ", ")
+}
+
+func datasourceParams(layer *node) map[string]string {
+	params := map[string]string{}
+	for _, ds := range layer.childs("Datasource") {
+		for _, p := range ds.childs("Parameter") {
+			params[p.attrs["name"]] = p.text
+		}
+	}
+	return params
+}
+
+func compareAttrs(r *Report, path string, c, m *node) {
+	var names []string
+	for name := range c.attrs {
+		names = append(names, name)
+	}
+	for name := range m.attrs {
+		if _, ok := c.attrs[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !equalValue(name, c.attrs[name], m.attrs[name]) {
+			r.add(path+"@"+name, c.attrs[name], m.attrs[name])
+		}
+	}
+}
+
+var colorAttrs = map[string]bool{
+	"background-color": true,
+	"color":            true,
+	"default-color":    true,
+	"fill":             true,
+	"halo-fill":        true,
+	"stroke":           true,
+}
+
+var fileAttrs = map[string]bool{
+	"file": true,
+	"base": true,
+}
+
+// equalValue compares a value of an attribute or parameter.
+func equalValue(name, a, b string) bool {
+	if a == b {
+		return true
+	}
+	if colorAttrs[name] {
+		ca, errA := parseColor(a)
+		cb, errB := parseColor(b)
+		if errA == nil && errB == nil {
+			return equalColor(ca, cb)
+		}
+	}
+	if fileAttrs[name] && a != "" && b != "" {
+		// carto and magnacarto resolve paths differently
+		return filepath.Base(a) == filepath.Base(b)
+	}
+	return equalList(a, b)
+}
+
+// equalList compares comma separated lists of numbers or strings. Single
+// values are lists with one element.
+func equalList(a, b string) bool {
+	as, bs := strings.Split(a, ","), strings.Split(b, ",")
+	if len(as) != len(bs) {
+		return false
+	}
+	for i := range as {
+		av, bv := strings.TrimSpace(as[i]), strings.TrimSpace(bs[i])
+		if av == bv {
+			continue
+		}
+		fa, errA := strconv.ParseFloat(av, 64)
+		fb, errB := strconv.ParseFloat(bv, 64)
+		if errA != nil || errB != nil || !equalFloat(fa, fb) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalFloat(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-6*math.Max(1, math.Max(math.Abs(a), math.Abs(b)))
+}
+
+var rgbaRe = regexp.MustCompile(`^rgba?\(\s*([\d.]+)\s*,\s*([\d.]+)\s*,\s*([\d.]+)\s*(?:,\s*([\d.]+)\s*)?\)$`)
+
+func parseColor(v string) (color.RGBA, error) {
+	if m := rgbaRe.FindStringSubmatch(v); m != nil {
+		c := color.RGBA{A: 1}
+		ch := make([]float64, 4)
+		for i := 1; i <= 4; i++ {
+			if m[i] == "" {
+				ch[i-1] = 1
+				continue
+			}
+			f, err := strconv.ParseFloat(m[i], 64)
+			if err != nil {
+				return c, err
+			}
+			ch[i-1] = f
+		}
+		c.R, c.G, c.B, c.A = ch[0]/255, ch[1]/255, ch[2]/255, ch[3]
+		return c, nil
+	}
+	return color.Parse(v)
+}
+
+// equalColor allows differences of one step per channel, magnacarto
+// truncates and carto rounds color values.
+func equalColor(a, b color.RGBA) bool {
+	const step = 1.0/255 + 1e-9
+	return math.Abs(a.R-b.R) <= step && math.Abs(a.G-b.G) <= step &&
+		math.Abs(a.B-b.B) <= step && math.Abs(a.A-b.A) <= 0.005
+}
+
+var spaceRe = regexp.MustCompile(`\s+`)
+
+func normText(s string) string {
+	s = spaceRe.ReplaceAllString(strings.TrimSpace(s), " ")
+	return strings.Replace(s, `"`, `'`, -1)
+}
+
+// normFilter normalizes whitespace, quotes, redundant parentheses and the
+// order of and-ed conditions of a filter expression.
+func normFilter(f string) string {
+	f = stripParens(normText(f))
+	parts := splitTopLevel(f, " and ")
+	if len(parts) == 1 {
+		return f
+	}
+	for i := range parts {
+		parts[i] = normFilter(parts[i])
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " and ")
+}
+
+// stripParens removes parentheses around the whole expression.
+func stripParens(f string) string {
+	for len(f) >= 2 && f[0] == '(' && f[len(f)-1] == ')' {
+		depth := 0
+		for i := 0; i < len(f); i++ {
+			switch f[i] {
+			case '(':
+				depth++
+			case ')':
+				depth--
+			}
+			if depth == 0 && i < len(f)-1 {
+				// first paren closes before the end, e.g. (a) and (b)
+				return f
+			}
+		}
+		f = strings.TrimSpace(f[1 : len(f)-1])
+	}
+	return f
+}
+
+// splitTopLevel splits f at sep outside of parentheses and quotes.
+func splitTopLevel(f, sep string) []string {
+	var parts []string
+	depth := 0
+	quoted := false
+	start := 0
+	for i := 0; i < len(f); i++ {
+		switch {
+		case f[i] == '\'':
+			quoted = !quoted
+		case quoted:
+		case f[i] == '(':
+			depth++
+		case f[i] == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(f[i:], sep):
+			parts = append(parts, f[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, f[start:])
+}
@@ -0,0 +1,139 @@
+package cartodiff
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const cartoXML = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE Map[]>
+<Map srs="+proj=merc +a=6378137 +b=6378137" background-color="#ffffff" maximum-extent="-20037508.34,-20037508.34,20037508.34,20037508.34">
+<Parameters>
+  <Parameter name="center">9.9604,53.544,10</Parameter>
+</Parameters>
+<FontSet name="fontset-0">
+  <Font face-name="Noto Sans Regular"/>
+  <Font face-name="DejaVu Sans Book"/>
+</FontSet>
+<Style name="roads" filter-mode="first">
+  <Rule>
+    <MaxScaleDenominator>50000</MaxScaleDenominator>
+    <Filter>([type] = 'primary') and ([tunnel] = 1)</Filter>
+    <LineSymbolizer stroke="rgba(255, 0, 0, 0.5)" stroke-width="2" stroke-dasharray="2, 4"/>
+    <TextSymbolizer fontset-name="fontset-0" size="12"><![CDATA[[name]]]></TextSymbolizer>
+  </Rule>
+</Style>
+<Layer name="roads" srs="+proj=longlat +datum=WGS84">
+  <StyleName>roads</StyleName>
+  <Datasource>
+    <Parameter name="file"><![CDATA[/home/carto/project/data.geojson]]></Parameter>
+    <Parameter name="type"><![CDATA[ogr]]></Parameter>
+  </Datasource>
+</Layer>
+</Map>`
+
+const magnacartoXML = `<Map srs="+init=epsg:3857" background-color="#ffffff">
+  <Parameters></Parameters>
+  <FontSet name="fontset-1">
+    <Font face-name="Noto Sans Regular"></Font>
+    <Font face-name="DejaVu Sans Book"></Font>
+  </FontSet>
+  <Style name="roads" filter-mode="first">
+    <Rule>
+      <MaxScaleDenominator>50000</MaxScaleDenominator>
+      <Filter>(([tunnel] = 1) and ([type] = "primary"))</Filter>
+      <LineSymbolizer stroke="rgba(254, 0, 0, 0.50000)" stroke-width="2.0" stroke-dasharray="2,4"></LineSymbolizer>
+      <TextSymbolizer fontset-name="fontset-1" size="12">[name]</TextSymbolizer>
+    </Rule>
+  </Style>
+  <Layer name="roads" srs="+proj=longlat +datum=WGS84">
+    <StyleName>roads</StyleName>
+    <Datasource>
+      <Parameter name="file">data.geojson</Parameter>
+      <Parameter name="type">ogr</Parameter>
+    </Datasource>
+  </Layer>
+</Map>`
+
+func TestCompareEqual(t *testing.T) {
+	r, err := Compare([]byte(cartoXML), []byte(magnacartoXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Compatible() {
+		t.Errorf("unexpected differences: %v", r.Differences)
+	}
+	if r.Layers != 1 || r.Styles != 1 || r.Rules != 1 || r.Symbolizers != 2 {
+		t.Errorf("unexpected counts %#v", r)
+	}
+}
+
+func TestCompareDifferences(t *testing.T) {
+	m := strings.Replace(magnacartoXML, `stroke-width="2.0"`, `stroke-width="3"`, 1)
+	m = strings.Replace(m, `<TextSymbolizer fontset-name="fontset-1" size="12">[name]</TextSymbolizer>`, ``, 1)
+	m = strings.Replace(m, `<Style name="roads"`, `<Style name="roads-casing"`, 1)
+	m = strings.Replace(m, `<StyleName>roads</StyleName>`, `<StyleName>roads-casing</StyleName>`, 1)
+
+	r, err := Compare([]byte(cartoXML), []byte(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Difference{
+		{"Style[roads-casing]", "", "present"},
+		{"Style[roads]", "present", ""},
+		{"Layer[roads]/StyleName", "roads", "roads-casing"},
+	}
+	if len(r.Differences) != len(expected) {
+		t.Fatalf("unexpected differences %v", r.Differences)
+	}
+	for i := range expected {
+		if r.Differences[i] != expected[i] {
+			t.Errorf("%v != %v", r.Differences[i], expected[i])
+		}
+	}
+
+	m = strings.Replace(magnacartoXML, `stroke-width="2.0"`, `stroke-width="3"`, 1)
+	m = strings.Replace(m, `<TextSymbolizer fontset-name="fontset-1" size="12">[name]</TextSymbolizer>`, ``, 1)
+	r, err = Compare([]byte(cartoXML), []byte(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Difference{
+		{"Style[roads]/Rule[0]", "LineSymbolizer, TextSymbolizer", "LineSymbolizer"},
+		{"Style[roads]/Rule[0]/LineSymbolizer[0]@stroke-width", "2", "3"},
+	}
+	if len(r.Differences) != len(expected) {
+		t.Fatalf("unexpected differences %v", r.Differences)
+	}
+	for i := range expected {
+		if r.Differences[i] != expected[i] {
+			t.Errorf("%v != %v", r.Differences[i], expected[i])
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := r.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `LineSymbolizer[0]@stroke-width: carto "2", magnacarto "3"`) {
+		t.Error(buf.String())
+	}
+}
+
+func TestNormFilter(t *testing.T) {
+	for _, tc := range []struct {
+		a, b  string
+		equal bool
+	}{
+		{`([a] = 1)`, `[a] = 1`, true},
+		{`(([a] = 1) and ([b] = 'x'))`, `([b] = "x") and ([a] = 1)`, true},
+		{`([a] = 1) or ([b] = 2)`, `([a] = 1) and ([b] = 2)`, false},
+		{`([a] = 'x and y')`, `([a] = 'x and y')`, true},
+		{`([a] = 1)`, `([a] = 2)`, false},
+	} {
+		if equal := normFilter(tc.a) == normFilter(tc.b); equal != tc.equal {
+			t.Errorf("%s %s: %q != %q", tc.a, tc.b, normFilter(tc.a), normFilter(tc.b))
+		}
+	}
+}
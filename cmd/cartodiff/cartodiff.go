@@ -0,0 +1,113 @@
+// The cartodiff command compares the Mapnik XML of magnacarto with the
+// output of carto for the same project and reports all differences.
+//
+//	cartodiff -mml project.mml
+//
+// carto (https://github.com/mapbox/carto) needs to be installed. Use
+// -carto-xml to compare with a file that was created with carto before.
+// cartodiff exits with 1 if there are differences and with 2 on errors.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/omniscale/magnacarto"
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/cartodiff"
+	"github.com/omniscale/magnacarto/config"
+)
+
+func main() {
+	mmlFilename := flag.String("mml", "", "mml file")
+	confFile := flag.String("config", "", "config")
+	builderType := flag.String("builder", "mapnik2", "builder type {mapnik2,mapnik3}")
+	cartoBin := flag.String("carto", "carto", "carto command")
+	cartoXML := flag.String("carto-xml", "", "compare with this carto output, instead of calling carto")
+	cartoCompat := flag.Bool("carto-compat", false, "use symbolizer defaults of carto (e.g. lines without line-width)")
+	deferEval := flag.Bool("deferred-eval", false, "defer variable/expression evaluation to the end")
+	outFile := flag.String("out", "", "write magnacarto XML to this file")
+	version := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(magnacarto.Version)
+		os.Exit(0)
+	}
+
+	log.SetFlags(0)
+	fatal := func(v ...interface{}) {
+		log.Print(v...)
+		os.Exit(2)
+	}
+
+	if *mmlFilename == "" {
+		fatal("missing -mml")
+	}
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			fatal(err)
+		}
+	}
+
+	m := mapnik.New(conf.Locator())
+	switch *builderType {
+	case "mapnik2":
+		m.SetMapnik2(true)
+	case "mapnik3":
+	default:
+		fatal("unknown -builder ", *builderType)
+	}
+	m.SetCartoCompat(*cartoCompat || conf.CartoCompat)
+
+	b := builder.New(m)
+	if *deferEval || conf.DeferEval {
+		b.EnableDeferredEval()
+	}
+	b.SetMML(*mmlFilename)
+	if err := b.Build(); err != nil {
+		fatal("error building map: ", err)
+	}
+	buf := &bytes.Buffer{}
+	if err := m.Write(buf); err != nil {
+		fatal("error writing map: ", err)
+	}
+	if *outFile != "" {
+		if err := ioutil.WriteFile(*outFile, buf.Bytes(), 0644); err != nil {
+			fatal("error writing map: ", err)
+		}
+	}
+
+	var carto []byte
+	var err error
+	if *cartoXML != "" {
+		carto, err = ioutil.ReadFile(*cartoXML)
+	} else {
+		var args []string
+		if *builderType == "mapnik3" {
+			args = []string{"-a", "3.0.0"}
+		}
+		carto, err = cartodiff.RunCarto(*cartoBin, *mmlFilename, args...)
+	}
+	if err != nil {
+		fatal(err)
+	}
+
+	report, err := cartodiff.Compare(carto, buf.Bytes())
+	if err != nil {
+		fatal(err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		fatal(err)
+	}
+	if !report.Compatible() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,231 @@
+// The magnaatlas command renders map books: a series of map sheets at a
+// fixed scale, as numbered PNG files or as a single PDF.
+//
+// Sheets are frames of a coverage grid over a bbox, either rows×cols or as
+// many pages as needed:
+//
+//	magnaatlas -mml project.mml -bbox 1100000,7000000,1120000,7015000 -scale 25000 -page 297x210 -out book.pdf
+//	magnaatlas -mml project.mml -bbox 1100000,7000000,1120000,7015000 -grid 2x3 -scale 25000 -out sheets
+//
+// or the bounding boxes of polygons from a GeoJSON file:
+//
+//	magnaatlas -mml project.mml -frames frames.geojson -scale 10000 -out book.pdf
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto"
+	"github.com/omniscale/magnacarto/atlas"
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mss"
+	"github.com/omniscale/magnacarto/output"
+	"github.com/omniscale/magnacarto/render"
+)
+
+// parseSize parses sizes like 297x210 or 2x3.
+func parseSize(s string) (float64, float64, error) {
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid size %q, expected WIDTHxHEIGHT", s)
+	}
+	w, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size %q: %s", s, err)
+	}
+	h, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid size %q: %s", s, err)
+	}
+	return w, h, nil
+}
+
+func parseBBOX(s string) ([4]float64, error) {
+	var bbox [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return bbox, fmt.Errorf("invalid bbox %q, expected minx,miny,maxx,maxy", s)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return bbox, fmt.Errorf("invalid bbox %q: %s", s, err)
+		}
+		bbox[i] = v
+	}
+	return bbox, nil
+}
+
+func frames(framesFile, bboxStr, grid, page string, scale, overlap float64) ([]atlas.Frame, error) {
+	if framesFile != "" {
+		f, err := os.Open(framesFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return atlas.LoadFrames(f, overlap)
+	}
+	if bboxStr == "" {
+		return nil, fmt.Errorf("-frames or -bbox required")
+	}
+	bbox, err := parseBBOX(bboxStr)
+	if err != nil {
+		return nil, err
+	}
+	if grid != "" {
+		rows, cols, err := parseSize(grid)
+		if err != nil {
+			return nil, err
+		}
+		return atlas.Grid(bbox, int(rows), int(cols), overlap)
+	}
+	w, h, err := parseSize(page)
+	if err != nil {
+		return nil, err
+	}
+	return atlas.PageGrid(bbox, w, h, scale, overlap)
+}
+
+func main() {
+	mmlFilename := flag.String("mml", "", "mml file")
+	confFile := flag.String("config", "", "config")
+	builderType := flag.String("builder", "mapnik3", "builder type {mapnik2,mapnik3}")
+	framesFile := flag.String("frames", "", "GeoJSON with a polygon for each sheet")
+	bbox := flag.String("bbox", "", "area of the grid minx,miny,maxx,maxy in the units of -srs")
+	grid := flag.String("grid", "", "divide -bbox into ROWSxCOLS sheets (e.g. 2x3)")
+	page := flag.String("page", "297x210", "page size WIDTHxHEIGHT in mm for grids without -grid")
+	scale := flag.Float64("scale", 25000, "scale denominator")
+	overlap := flag.Float64("overlap", 0.05, "overlap of neighbouring sheets, fraction of the sheet")
+	dpi := flag.Float64("dpi", 300, "resolution of the sheets")
+	srs := flag.Int("srs", 3857, "EPSG code of the map, needs to be in meters")
+	format := flag.String("format", "", "output format {png,pdf}, defaults to pdf for -out with .pdf")
+	outFile := flag.String("out", "", "PDF file or directory for numbered PNG sheets")
+	version := flag.Bool("version", false, "print version and exit")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(magnacarto.Version)
+		os.Exit(0)
+	}
+	if *mmlFilename == "" || *outFile == "" {
+		log.Fatal("-mml and -out required")
+	}
+	if *format == "" {
+		*format = "png"
+		if strings.HasSuffix(*outFile, ".pdf") {
+			*format = "pdf"
+		}
+	}
+	if *format != "png" && *format != "pdf" {
+		log.Fatal("unknown -format ", *format)
+	}
+
+	sheets, err := frames(*framesFile, *bbox, *grid, *page, *scale, *overlap)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := render.RegisterMapnik(conf.Mapnik); err != nil {
+		log.Fatal(err)
+	}
+
+	m := mapnik.New(conf.Locator())
+	switch *builderType {
+	case "mapnik2":
+		m.SetMapnik2(true)
+	case "mapnik3":
+	default:
+		log.Fatal("unknown -builder ", *builderType)
+	}
+	b := builder.New(m)
+	if conf.DeferEval {
+		b.EnableDeferredEval()
+	}
+	b.SetMML(*mmlFilename)
+	b.Define("target", *builderType)
+	b.Define("atlas", "true")
+	if err := b.Build(); err != nil {
+		log.Fatal("error building map: ", err)
+	}
+	tmp, err := ioutil.TempDir("", "magnaatlas")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	style := filepath.Join(tmp, "style.xml")
+	if err := m.WriteFiles(style); err != nil {
+		log.Fatal("error writing map: ", err)
+	}
+
+	if err := renderSheets(style, sheets, *format, *outFile, *scale, *dpi, *srs); err != nil {
+		os.RemoveAll(tmp)
+		log.Fatal(err)
+	}
+}
+
+func renderSheets(style string, sheets []atlas.Frame, format, out string, scale, dpi float64, srs int) error {
+	var book *atlas.PDF
+	buf := &bytes.Buffer{}
+	if format == "pdf" {
+		book = atlas.NewPDF(buf)
+	} else if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+
+	for i, sheet := range sheets {
+		w, h := atlas.PixelSize(sheet, scale, dpi)
+		log.Printf("rendering sheet %d/%d (%s) with %dx%d pixels", i+1, len(sheets), sheet.Name, w, h)
+		img, err := render.Mapnik(style, render.Request{
+			Width:    w,
+			Height:   h,
+			BBOX:     sheet.BBOX,
+			EPSGCode: srs,
+			Format:   "png",
+			// sizes of the style are pixels at 90.7 DPI
+			ScaleFactor: dpi / mss.DefaultDPI,
+		})
+		if err != nil {
+			return fmt.Errorf("error rendering sheet %s: %s", sheet.Name, err)
+		}
+
+		if book == nil {
+			fname := filepath.Join(out, fmt.Sprintf("sheet-%03d.png", i+1))
+			if err := output.Write(fname, img, output.None); err != nil {
+				return err
+			}
+			continue
+		}
+		decoded, err := png.Decode(bytes.NewReader(img))
+		if err != nil {
+			return err
+		}
+		pw, ph := atlas.PageSize(sheet, scale)
+		if err := book.AddPage(atlas.Page{Image: decoded, Width: pw, Height: ph, Label: "Sheet " + sheet.Name}); err != nil {
+			return err
+		}
+	}
+	if book == nil {
+		return nil
+	}
+	if err := book.Close(); err != nil {
+		return err
+	}
+	return output.Write(out, buf.Bytes(), output.None)
+}
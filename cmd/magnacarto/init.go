@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/omniscale/magnacarto/logging"
+)
+
+// projectTemplate are the files of a new project. The MML is always
+// project.mml, the MSS base.mss and the config magnacarto.tml.
+type projectTemplate struct {
+	description string
+	files       map[string]string
+	// data writes additional files into the data dir of the project
+	data func(dir string) error
+}
+
+// projectDirs are created for all templates.
+var projectDirs = []string{"icons", "data"}
+
+const configStub = `# magnacarto -config magnacarto.tml -mml project.mml
+# All paths are relative to the working dir.
+
+[datasources]
+shapefile_dirs = ["data"]
+sqlite_dirs = ["data"]
+image_dirs = ["icons"]
+
+[mapnik]
+# font_dirs = ["/usr/share/fonts/truetype/dejavu"]
+`
+
+var projectTemplates = map[string]projectTemplate{
+	"basic": {
+		description: "empty project with a background color",
+		files: map[string]string{
+			"project.mml": `{
+  "Stylesheet": ["base.mss"],
+  "Layer": []
+}
+`,
+			"base.mss": `@background: #f2efe9;
+@water: #b5d0d0;
+@text: #333;
+@halo: rgba(255, 255, 255, 0.8);
+@font: "DejaVu Sans Book";
+
+Map {
+  background-color: @background;
+}
+
+// Add a layer to project.mml and style it by its name:
+//
+// #roads[zoom>=10] {
+//   line-width: 1;
+//   line-color: #888;
+// }
+`,
+			"magnacarto.tml": configStub,
+		},
+	},
+	"shapefile-demo": {
+		description: "world map with cities and a graticule from Shapefiles in data/",
+		files: map[string]string{
+			"project.mml": `{
+  "Stylesheet": ["base.mss"],
+  "Layer": [
+    {
+      "name": "graticule",
+      "geometry": "linestring",
+      "srs": "+proj=longlat +datum=WGS84 +no_defs",
+      "Datasource": {"type": "shape", "file": "graticule.shp"}
+    },
+    {
+      "name": "cities",
+      "geometry": "point",
+      "srs": "+proj=longlat +datum=WGS84 +no_defs",
+      "Datasource": {"type": "shape", "file": "cities.shp"}
+    }
+  ]
+}
+`,
+			"base.mss": `@background: #f2efe9;
+@graticule: #c8c2b8;
+@city: #d04030;
+@text: #333;
+@halo: rgba(255, 255, 255, 0.8);
+@font: "DejaVu Sans Book";
+
+Map {
+  background-color: @background;
+}
+
+#graticule {
+  line-width: 0.5;
+  line-color: @graticule;
+  line-dasharray: 4, 2;
+}
+
+#cities {
+  marker-fill: @city;
+  marker-line-color: #fff;
+  marker-line-width: 1;
+  marker-width: 4;
+  [population > 10000000] { marker-width: 8; }
+  [population > 5000000][population <= 10000000] { marker-width: 6; }
+
+  [zoom>=3], [population > 10000000] {
+    text-name: [name];
+    text-face-name: @font;
+    text-size: 10;
+    text-fill: @text;
+    text-halo-fill: @halo;
+    text-halo-radius: 1;
+    text-dy: -8;
+  }
+}
+`,
+			"magnacarto.tml": configStub,
+		},
+		data: writeDemoData,
+	},
+	"osm-postgis": {
+		description: "OpenStreetMap style for a PostGIS database imported with imposm3",
+		files: map[string]string{
+			"project.mml": `{
+  "Stylesheet": ["base.mss", "roads.mss", "labels.mss"],
+  "Layer": [
+    {
+      "name": "landusages",
+      "geometry": "polygon",
+      "srs": "+init=epsg:3857",
+      "Datasource": {
+        "type": "postgis",
+        "table": "(SELECT geometry, type, area FROM osm_landusages ORDER BY area DESC) AS data"
+      }
+    },
+    {
+      "name": "waterareas",
+      "geometry": "polygon",
+      "srs": "+init=epsg:3857",
+      "Datasource": {
+        "type": "postgis",
+        "table": "(SELECT geometry, type FROM osm_waterareas) AS data"
+      }
+    },
+    {
+      "name": "buildings",
+      "geometry": "polygon",
+      "srs": "+init=epsg:3857",
+      "Datasource": {
+        "type": "postgis",
+        "table": "(SELECT geometry, type FROM osm_buildings) AS data"
+      }
+    },
+    {
+      "name": "roads",
+      "geometry": "linestring",
+      "srs": "+init=epsg:3857",
+      "Datasource": {
+        "type": "postgis",
+        "table": "(SELECT geometry, type, name, z_order FROM osm_roads ORDER BY z_order) AS data"
+      }
+    },
+    {
+      "name": "places",
+      "geometry": "point",
+      "srs": "+init=epsg:3857",
+      "Datasource": {
+        "type": "postgis",
+        "table": "(SELECT geometry, type, name, population FROM osm_places ORDER BY population DESC NULLS LAST) AS data"
+      }
+    }
+  ]
+}
+`,
+			"base.mss": `@background: #f2efe9;
+@water: #b5d0d0;
+@park: #c8facc;
+@forest: #add19e;
+@residential: #e0dfdf;
+@building: #d9d0c9;
+@text: #333;
+@halo: rgba(255, 255, 255, 0.8);
+@font: "DejaVu Sans Book";
+
+Map {
+  background-color: @background;
+}
+
+#landusages[zoom>=8] {
+  [type='park'] { polygon-fill: @park; }
+  [type='forest'], [type='wood'] { polygon-fill: @forest; }
+  [type='residential'] { polygon-fill: @residential; }
+}
+
+#waterareas {
+  polygon-fill: @water;
+}
+
+#buildings[zoom>=14] {
+  polygon-fill: @building;
+  line-color: darken(@building, 15%);
+  line-width: 0.5;
+}
+`,
+			"roads.mss": `@motorway: #e892a2;
+@primary: #fcd6a4;
+@minor: #fff;
+@casing: #bbb;
+
+#roads[zoom>=6] {
+  ::casing[zoom>=12] {
+    line-color: @casing;
+    line-cap: round;
+    line-join: round;
+    [type='motorway'], [type='trunk'] { line-width: 5; }
+    [type='primary'], [type='secondary'] { line-width: 4; }
+    [type='tertiary'], [type='residential'], [type='unclassified'] { line-width: 3; }
+  }
+  line-cap: round;
+  line-join: round;
+  [type='motorway'], [type='trunk'] {
+    line-color: @motorway;
+    line-width: 1.5;
+    [zoom>=12] { line-width: 3.5; }
+  }
+  [type='primary'], [type='secondary'] {
+    [zoom>=8] {
+      line-color: @primary;
+      line-width: 1;
+      [zoom>=12] { line-width: 2.5; }
+    }
+  }
+  [type='tertiary'], [type='residential'], [type='unclassified'] {
+    [zoom>=12] {
+      line-color: @minor;
+      line-width: 1.5;
+    }
+  }
+}
+`,
+			"labels.mss": `#places {
+  [type='city'][zoom>=5],
+  [type='town'][zoom>=9],
+  [type='village'][zoom>=12] {
+    text-name: [name];
+    text-face-name: @font;
+    text-size: 11;
+    text-fill: @text;
+    text-halo-fill: @halo;
+    text-halo-radius: 1.5;
+    [type='city'] { text-size: 14; }
+  }
+}
+
+#roads[zoom>=14] {
+  text-name: [name];
+  text-face-name: @font;
+  text-size: 10;
+  text-fill: @text;
+  text-halo-fill: @halo;
+  text-halo-radius: 1;
+  text-placement: line;
+}
+`,
+			"magnacarto.tml": configStub + `
+[postgis]
+host = "localhost"
+database = "osm"
+username = "osm"
+password = "osm"
+srid = "3857"
+`,
+		},
+	},
+}
+
+func templateNames() []string {
+	names := make([]string, 0, len(projectTemplates))
+	for name := range projectTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// initProject writes all files of the template into dir. Existing files are
+// only replaced with force.
+func initProject(dir, templateName string, force bool) error {
+	tmpl, ok := projectTemplates[templateName]
+	if !ok {
+		return fmt.Errorf("unknown template %q, available: %s", templateName, strings.Join(templateNames(), ", "))
+	}
+	if !force {
+		for name := range tmpl.files {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				return fmt.Errorf("%s already exists, use -force to replace it", filepath.Join(dir, name))
+			}
+		}
+	}
+	for _, d := range projectDirs {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return err
+		}
+	}
+	for name, content := range tmpl.files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+	if tmpl.data != nil {
+		if err := tmpl.data(filepath.Join(dir, "data")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func initCmd(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	templateName := flags.String("template", "basic", "project template {"+strings.Join(templateNames(), ",")+"}")
+	force := flags.Bool("force", false, "replace existing files")
+	list := flags.Bool("list", false, "list all templates")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: magnacarto init [-template name] [-force] [dir]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *list {
+		for _, name := range templateNames() {
+			fmt.Printf("%-16s %s\n", name, projectTemplates[name].description)
+		}
+		return
+	}
+
+	dir := "."
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		dir = flags.Arg(0)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if err := initProject(dir, *templateName, *force); err != nil {
+		log.Fatal(err)
+	}
+	logging.Default().Info(fmt.Sprintf("created %s project, build in %s with: magnacarto -config magnacarto.tml -mml project.mml", *templateName, dir))
+}
+
+// demoCities are the cities of the shapefile-demo template.
+var demoCities = []struct {
+	name       string
+	lon, lat   float64
+	population int
+}{
+	{"Tokyo", 139.69, 35.69, 37400000},
+	{"Delhi", 77.21, 28.61, 31000000},
+	{"Shanghai", 121.47, 31.23, 27100000},
+	{"São Paulo", -46.63, -23.55, 22000000},
+	{"Mexico City", -99.13, 19.43, 21800000},
+	{"Cairo", 31.24, 30.04, 21300000},
+	{"New York", -74.01, 40.71, 18800000},
+	{"Lagos", 3.38, 6.52, 14900000},
+	{"Moscow", 37.62, 55.76, 12600000},
+	{"Paris", 2.35, 48.86, 11100000},
+	{"London", -0.13, 51.51, 9500000},
+	{"Sydney", 151.21, -33.87, 5300000},
+	{"Cape Town", 18.42, -33.92, 4700000},
+	{"Berlin", 13.40, 52.52, 3600000},
+	{"Oldenburg", 8.21, 53.14, 170000},
+}
+
+const wgs84PRJ = `GEOGCS["GCS_WGS_1984",DATUM["D_WGS_1984",SPHEROID["WGS_1984",6378137.0,298.257223563]],PRIMEM["Greenwich",0.0],UNIT["Degree",0.0174532925199433]]`
+
+// writeDemoData writes the cities and graticule Shapefiles of the
+// shapefile-demo template.
+func writeDemoData(dir string) error {
+	cities := shapefile{shapeType: shapePoint, fields: []dbfField{{"name", 'C', 32}, {"population", 'N', 10}}}
+	for _, c := range demoCities {
+		cities.shapes = append(cities.shapes, shape{
+			coords: [][2]float64{{c.lon, c.lat}},
+			values: []string{c.name, fmt.Sprint(c.population)},
+		})
+	}
+	if err := cities.write(filepath.Join(dir, "cities")); err != nil {
+		return err
+	}
+
+	graticule := shapefile{shapeType: shapePolyLine, fields: []dbfField{{"direction", 'C', 3}, {"degrees", 'N', 4}}}
+	for lon := -180; lon <= 180; lon += 30 {
+		var line [][2]float64
+		for lat := -90; lat <= 90; lat += 10 {
+			line = append(line, [2]float64{float64(lon), float64(lat)})
+		}
+		graticule.shapes = append(graticule.shapes, shape{coords: line, values: []string{"lon", fmt.Sprint(lon)}})
+	}
+	for lat := -60; lat <= 60; lat += 30 {
+		var line [][2]float64
+		for lon := -180; lon <= 180; lon += 10 {
+			line = append(line, [2]float64{float64(lon), float64(lat)})
+		}
+		graticule.shapes = append(graticule.shapes, shape{coords: line, values: []string{"lat", fmt.Sprint(lat)}})
+	}
+	return graticule.write(filepath.Join(dir, "graticule"))
+}
+
+const (
+	shapePoint    = 1
+	shapePolyLine = 3
+)
+
+type dbfField struct {
+	name   string
+	typ    byte // C or N
+	length int
+}
+
+type shape struct {
+	coords [][2]float64 // a single point or a line
+	values []string
+}
+
+// shapefile is a minimal writer for Shapefiles with points or single part
+// lines.
+type shapefile struct {
+	shapeType int32
+	fields    []dbfField
+	shapes    []shape
+}
+
+// write writes the .shp, .shx, .dbf, .cpg and .prj files.
+func (s *shapefile) write(basename string) error {
+	shp := &bytes.Buffer{}
+	shx := &bytes.Buffer{}
+	bbox := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	offset := 100
+	for i, sh := range s.shapes {
+		content := &bytes.Buffer{}
+		binary.Write(content, binary.LittleEndian, s.shapeType)
+		if s.shapeType == shapePolyLine {
+			lineBBOX := [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+			for _, c := range sh.coords {
+				extend(&lineBBOX, c)
+			}
+			binary.Write(content, binary.LittleEndian, lineBBOX)
+			binary.Write(content, binary.LittleEndian, []int32{1, int32(len(sh.coords)), 0})
+		}
+		for _, c := range sh.coords {
+			extend(&bbox, c)
+			binary.Write(content, binary.LittleEndian, c)
+		}
+		binary.Write(shp, binary.BigEndian, []int32{int32(i + 1), int32(content.Len() / 2)})
+		shp.Write(content.Bytes())
+		binary.Write(shx, binary.BigEndian, []int32{int32(offset / 2), int32(content.Len() / 2)})
+		offset += 8 + content.Len()
+	}
+
+	header := func(length int) []byte {
+		h := &bytes.Buffer{}
+		binary.Write(h, binary.BigEndian, []int32{9994, 0, 0, 0, 0, 0, int32(length / 2)})
+		binary.Write(h, binary.LittleEndian, []int32{1000, s.shapeType})
+		binary.Write(h, binary.LittleEndian, bbox)
+		binary.Write(h, binary.LittleEndian, [4]float64{})
+		return h.Bytes()
+	}
+
+	for _, f := range []struct {
+		suffix  string
+		content []byte
+	}{
+		{".shp", append(header(100+shp.Len()), shp.Bytes()...)},
+		{".shx", append(header(100+shx.Len()), shx.Bytes()...)},
+		{".dbf", s.dbf()},
+		{".cpg", []byte("UTF-8")},
+		{".prj", []byte(wgs84PRJ)},
+	} {
+		if err := ioutil.WriteFile(basename+f.suffix, f.content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extend(bbox *[4]float64, c [2]float64) {
+	bbox[0] = math.Min(bbox[0], c[0])
+	bbox[1] = math.Min(bbox[1], c[1])
+	bbox[2] = math.Max(bbox[2], c[0])
+	bbox[3] = math.Max(bbox[3], c[1])
+}
+
+// dbf returns the attribute table in dBASE III format. Strings are encoded
+// as UTF-8 (see .cpg).
+func (s *shapefile) dbf() []byte {
+	recordLen := 1
+	for _, f := range s.fields {
+		recordLen += f.length
+	}
+	b := &bytes.Buffer{}
+	b.WriteByte(3)
+	b.Write([]byte{95, 1, 1}) // last update
+	binary.Write(b, binary.LittleEndian, int32(len(s.shapes)))
+	binary.Write(b, binary.LittleEndian, int16(32+32*len(s.fields)+1))
+	binary.Write(b, binary.LittleEndian, int16(recordLen))
+	b.Write(make([]byte, 20))
+	for _, f := range s.fields {
+		field := make([]byte, 32)
+		copy(field, f.name)
+		field[11] = f.typ
+		field[16] = byte(f.length)
+		b.Write(field)
+	}
+	b.WriteByte(0x0d)
+	for _, sh := range s.shapes {
+		b.WriteByte(' ')
+		for i, f := range s.fields {
+			v := sh.values[i]
+			if len(v) > f.length {
+				v = v[:f.length]
+			}
+			pad := strings.Repeat(" ", f.length-len(v))
+			if f.typ == 'N' {
+				b.WriteString(pad + v)
+			} else {
+				b.WriteString(v + pad)
+			}
+		}
+	}
+	b.WriteByte(0x1a)
+	return b.Bytes()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	buildpreview "github.com/omniscale/magnacarto/builder/preview"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/preview"
+)
+
+func TestInitProject(t *testing.T) {
+	for _, name := range templateNames() {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "magnacarto_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			if err := initProject(dir, name, false); err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range projectDirs {
+				if fi, err := os.Stat(filepath.Join(dir, d)); err != nil || !fi.IsDir() {
+					t.Errorf("missing dir %s", d)
+				}
+			}
+			conf, err := config.Load(filepath.Join(dir, "magnacarto.tml"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(conf.Datasources.ShapefileDirs) != 1 {
+				t.Errorf("unexpected config %#v", conf)
+			}
+			conf.Datasources.NoCheckFiles = true
+
+			m := mapnik.New(conf.Locator())
+			b := builder.New(m)
+			b.SetMML(filepath.Join(dir, "project.mml"))
+			if err := b.Build(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := initProject(dir, name, false); err == nil {
+				t.Error("expected error for existing project")
+			}
+			if err := initProject(dir, name, true); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	if err := initProject(os.TempDir(), "unknown", false); err == nil {
+		t.Error("expected error for unknown template")
+	}
+}
+
+func TestInitShapefileDemo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := initProject(dir, "shapefile-demo", false); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := config.Magnacarto{}
+	conf.Datasources.ShapefileDirs = []string{filepath.Join(dir, "data")}
+	m := buildpreview.New(conf.Locator())
+	b := builder.New(m)
+	b.SetMML(filepath.Join(dir, "project.mml"))
+	if err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	img, err := preview.Render(&m.Style, preview.Request{
+		Width: 360, Height: 180, BBOX: [4]float64{-180, -90, 180, 90}, EPSGCode: 4326,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// marker of Berlin
+	if c := img.RGBAAt(193, 37); c.R != 0xd0 || c.G != 0x40 || c.B != 0x30 {
+		t.Errorf("unexpected city color %v", c)
+	}
+	// graticule at 0°, 0°
+	if c := img.RGBAAt(180, 90); c.R == 0xf2 && c.G == 0xef && c.B == 0xe9 {
+		t.Errorf("graticule not rendered %v", c)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/lsp"
+)
+
+// lspCmd starts a language server for editors on stdin/stdout.
+func lspCmd(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	logLevel := flags.String("log-level", "warn", "log level {debug,info,warn,error}, logs are written to stderr")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: magnacarto lsp [-log-level level]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := lsp.NewServer(logging.New(os.Stderr, level, false))
+	if err := s.Serve(os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,18 +1,53 @@
 // The magnacarto command converts CartoCSS to Mapnik/MapServer styles.
+//
+//	magnacarto -mml project.mml > style.xml
+//
+// magnacarto serve-api starts a build service for CI and editors. Projects
+// are POSTed to /build as (gzipped) tarball, or referenced with
+// {"mml": "project.mml"} below -styles-dir. The response contains the style
+// and all warnings of the build. Builds are cached until the project changes.
+//
+//	magnacarto serve-api -listen localhost:7071 -styles-dir styles
+//
+// magnacarto stats reports the complexity of each layer: the number of
+// rules and filters, and the number of rules and the size of the generated
+// Mapnik XML. The layers with the most rules and the largest XML are listed
+// at the end.
+//
+//	magnacarto stats -mml project.mml -top 10
+//
+// magnacarto package bundles the project with all MSS files, images, fonts
+// and optionally (clipped) data files into a single archive.
+//
+//	magnacarto package -mml project.mml -clip 5.8,47.2,15.1,55.1 -out project.zip
+//
+// magnacarto init creates a new project from a template.
+//
+//	magnacarto init -template shapefile-demo myproject
+//
+// magnacarto lsp starts a language server on stdin/stdout that completes
+// properties, values, variables, layers and fields of MSS files in editors.
+//
+//	magnacarto lsp
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"runtime/pprof"
+	"strings"
 
 	"github.com/omniscale/magnacarto"
 	"github.com/omniscale/magnacarto/builder"
 	"github.com/omniscale/magnacarto/builder/mapnik"
 	"github.com/omniscale/magnacarto/builder/mapserver"
 	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/mss"
+	"github.com/omniscale/magnacarto/output"
 )
 
 type files []string
@@ -26,22 +61,128 @@ func (f *files) Set(value string) error {
 	return nil
 }
 
+// layerOverrides collects -enable-layer, -disable-layer and -layer-zoom in
+// the order of the command line.
+type layerOverrides []builder.LayerOverride
+
+type layerOverrideFlag struct {
+	overrides *layerOverrides
+	active    *bool
+}
+
+func (f layerOverrideFlag) String() string {
+	return ""
+}
+
+func (f layerOverrideFlag) Set(value string) error {
+	if f.active == nil {
+		o, err := builder.ParseLayerZoom(value)
+		if err != nil {
+			return err
+		}
+		*f.overrides = append(*f.overrides, o)
+		return nil
+	}
+	*f.overrides = append(*f.overrides, builder.LayerOverride{Pattern: value, Active: f.active})
+	return nil
+}
+
+// defines collects -define name=value flags, name without value is true.
+type defines map[string]string
+
+func (d defines) String() string {
+	return ""
+}
+
+func (d defines) Set(value string) error {
+	name, v := value, "true"
+	if i := strings.Index(value, "="); i >= 0 {
+		name, v = value[:i], value[i+1:]
+	}
+	if name == "" {
+		return fmt.Errorf("missing name in %q", value)
+	}
+	d[name] = v
+	return nil
+}
+
+// variables collects -var name=value flags.
+type variables map[string]string
+
+func (v variables) String() string {
+	return ""
+}
+
+func (v variables) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected name=value, got %q", value)
+	}
+	v[value[:i]] = value[i+1:]
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "serve-api" {
+		serveAPI(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		statsCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		initCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "package" {
+		packageCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		lspCmd(os.Args[2:])
+		return
+	}
+
 	mmlFilename := flag.String("mml", "", "mml file")
 	var mssFilenames files
 
 	flag.Var(&mssFilenames, "mss", "mss file")
+	var overrides layerOverrides
+	enable, disable := true, false
+	flag.Var(layerOverrideFlag{&overrides, &enable}, "enable-layer", "enable layers matching this pattern (e.g. admin*), can be repeated")
+	flag.Var(layerOverrideFlag{&overrides, &disable}, "disable-layer", "disable layers matching this pattern, can be repeated")
+	flag.Var(layerOverrideFlag{&overrides, nil}, "layer-zoom", "limit zoom levels of layers (e.g. roads=8-18), can be repeated")
+	flags := defines{}
+	flag.Var(flags, "define", "set flag for @if conditions (e.g. draft or scale=2), can be repeated. target is set to the -builder")
+	vars := variables{}
+	flag.Var(vars, "var", "override MSS variable (e.g. water=#a0c8f0), can be repeated. Logs the value and origin of all variables")
 	confFile := flag.String("config", "", "config")
 	sqliteDir := flag.String("sqlite-dir", "", "sqlite directory")
 	shapeDir := flag.String("shape-dir", "", "shapefile directory")
 	imageDir := flag.String("image-dir", "", "image/marker directory")
 	fontDir := flag.String("font-dir", "", "fonts directory")
 	dumpRules := flag.Bool("dumprules", false, "print calculated rules to stderr")
+	removeDeadRules := flag.Bool("remove-dead-rules", false, "remove rules that never match (contradictory filters, outside of layer zoom, shadowed by previous rules)")
+	mergeRules := flag.Bool("merge-rules", false, "merge adjacent rules that only differ in a filter value or their zoom levels")
+	optimizeReport := flag.Bool("optimize-report", false, "print all rules removed by the optimizer to stderr")
 	builderType := flag.String("builder", "mapnik2", "builder type {mapnik2,mapnik3,mapserver}")
-	outFile := flag.String("out", "", "out file")
+	outFile := flag.String("out", "", "out file, s3://bucket/key or http(s):// URL for HTTP PUT")
+	compression := flag.String("compress", "", "compress -out file {gzip,zstd}, defaults to gzip for .gz and zstd for .zst")
+	dpi := flag.Float64("dpi", mss.DefaultDPI, "resolution of the output, all sizes are scaled from 90.7 DPI (e.g. 300 for print)")
 	deferEval := flag.Bool("deferred-eval", false, "defer variable/expression evaluation to the end")
+	cartoCompat := flag.Bool("carto-compat", false, "use symbolizer defaults of carto (e.g. lines without line-width)")
+	debug := flag.Bool("debug", false, "render collision boxes of all labels (Mapnik only)")
+	metadata := flag.Bool("metadata", false, "embed build metadata (magnacarto version, build time, git commit of the style, -var overrides) in the output")
 	version := flag.Bool("version", false, "print version and exit")
 	noCheckFiles := flag.Bool("no-check-files", false, "do not check if images/shps/etc exists")
+	split := flag.Bool("split", false, "write each layer into its own file, included by the -out file")
+	watch := flag.Bool("watch", false, "rebuild -out file when the MML or MSS files change and run hooks from -config")
+	var tileConfigs tileConfigList
+	flag.Var(&tileConfigs, "tile-config", "write a tile server config for the -out style {renderd,mapproxy,tilestache}, comma separated (Mapnik only)")
+	tileSize := flag.Int("tile-size", 256, "tile size for -tile-config")
+	logLevel := flag.String("log-level", "info", "log level (debug, info, warn or error)")
+	logJSON := flag.Bool("log-json", false, "write log messages as JSON")
 
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
 
@@ -61,6 +202,15 @@ func main() {
 		os.Exit(0)
 	}
 
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := logging.New(os.Stderr, level, *logJSON)
+	// remaining messages, e.g. of the config
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.Warn))
+
 	conf := config.Magnacarto{}
 	if *confFile != "" {
 		if err := conf.Load(*confFile); err != nil {
@@ -88,43 +238,171 @@ func main() {
 
 	locator := conf.Locator()
 
-	var m builder.MapWriter
-
 	switch *builderType {
-	case "mapserver":
-		m = mapserver.New(locator)
-	case "mapnik2":
-		m = mapnik.New(locator)
-		m.(*mapnik.Map).SetMapnik2(true)
-	case "mapnik3":
-		m = mapnik.New(locator)
+	case "mapserver", "mapnik2", "mapnik3":
 	default:
 		log.Fatal("unknown -builder ", *builderType)
 	}
 
-	b := builder.New(m)
-	if *deferEval || conf.DeferEval {
-		b.EnableDeferredEval()
+	build := func() error {
+		var m builder.MapWriter
+
+		switch *builderType {
+		case "mapserver":
+			m = mapserver.New(locator)
+		case "mapnik2":
+			m = mapnik.New(locator)
+			m.(*mapnik.Map).SetMapnik2(true)
+		case "mapnik3":
+			m = mapnik.New(locator)
+		}
+
+		if s, ok := m.(builder.CartoCompatSetter); ok && (*cartoCompat || conf.CartoCompat) {
+			s.SetCartoCompat(true)
+		}
+		if s, ok := m.(builder.DebugSetter); ok && *debug {
+			s.SetDebug(true)
+		}
+		b := builder.New(m)
+		b.SetLogger(logger)
+		if *deferEval || conf.DeferEval {
+			b.EnableDeferredEval()
+		}
+		if *metadata {
+			b.EnableMetadata()
+		}
+		b.SetMML(*mmlFilename)
+		b.SetDPI(*dpi)
+		b.Define("target", *builderType)
+		for name, value := range flags {
+			b.Define(name, value)
+		}
+		for name, value := range vars {
+			b.SetVar(name, value)
+		}
+		for _, o := range overrides {
+			if err := b.AddLayerOverride(o); err != nil {
+				return err
+			}
+		}
+		for _, mss := range mssFilenames {
+			b.AddMSS(mss)
+		}
+		if *dumpRules {
+			b.SetDumpRulesDest(os.Stderr)
+		}
+		if *removeDeadRules {
+			b.EnableDeadRuleElimination()
+		}
+		if *mergeRules {
+			b.EnableRuleMerging()
+		}
+		if *optimizeReport {
+			b.SetOptimizeReportDest(os.Stderr)
+		}
+
+		if err := b.Build(); err != nil {
+			return fmt.Errorf("error building map: %s", err)
+		}
+
+		if (*outFile == "" || *outFile == "-") && *compression != "" {
+			buf := &bytes.Buffer{}
+			if err := m.Write(buf); err != nil {
+				return fmt.Errorf("error writing map: %s", err)
+			}
+			content, err := output.Compress(buf.Bytes(), *compression)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Stdout.Write(content); err != nil {
+				return fmt.Errorf("error writing map to stdout: %s", err)
+			}
+		} else if *outFile == "" || *outFile == "-" {
+			if err := m.Write(os.Stdout); err != nil {
+				return fmt.Errorf("error writing map to stdout: %s", err)
+			}
+		} else if *compression != "" || output.IsRemote(*outFile) {
+			buf := &bytes.Buffer{}
+			if err := m.Write(buf); err != nil {
+				return fmt.Errorf("error writing map: %s", err)
+			}
+			if err := output.Write(*outFile, buf.Bytes(), *compression); err != nil {
+				return fmt.Errorf("error writing map: %s", err)
+			}
+		} else if *split {
+			s, ok := m.(builder.SplitWriter)
+			if !ok {
+				return fmt.Errorf("-split not supported by %s builder", *builderType)
+			}
+			if err := s.WriteSplitFiles(*outFile); err != nil {
+				return fmt.Errorf("error writing map: %s", err)
+			}
+		} else {
+			if err := m.WriteFiles(*outFile); err != nil {
+				return fmt.Errorf("error writing map: %s", err)
+			}
+		}
+		if len(tileConfigs) > 0 {
+			c, err := newTileConfig(*mmlFilename, *outFile, *tileSize)
+			if err != nil {
+				return fmt.Errorf("error writing tile config: %s", err)
+			}
+			if err := writeTileConfigs(c, tileConfigs); err != nil {
+				return fmt.Errorf("error writing tile config: %s", err)
+			}
+		}
+		return nil
+	}
+
+	if *split && (*outFile == "" || *outFile == "-") {
+		log.Fatal("-split requires -out file")
 	}
-	b.SetMML(*mmlFilename)
-	for _, mss := range mssFilenames {
-		b.AddMSS(mss)
+	if *compression == "" {
+		*compression = output.CompressionFor(*outFile)
 	}
-	if *dumpRules {
-		b.SetDumpRulesDest(os.Stderr)
+	if *split && (*compression != "" || output.IsRemote(*outFile)) {
+		log.Fatal("-split only supports uncompressed local files")
+	}
+	if len(tileConfigs) > 0 {
+		if *outFile == "" || *outFile == "-" || *compression != "" || output.IsRemote(*outFile) {
+			log.Fatal("-tile-config requires an uncompressed local -out file")
+		}
+		if *builderType == "mapserver" {
+			log.Fatal("-tile-config requires a Mapnik style")
+		}
+		if *mmlFilename == "" {
+			log.Fatal("-tile-config requires -mml")
+		}
 	}
 
-	if err := b.Build(); err != nil {
-		log.Fatal("error building map: ", err)
+	if !*watch {
+		if err := build(); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
+	if *mmlFilename == "" {
+		// the watched files are collected from the MML
+		fmt.Fprintln(os.Stderr, "-watch requires -mml file")
+		flag.Usage()
+		os.Exit(2)
+	}
 	if *outFile == "" || *outFile == "-" {
-		if err := m.Write(os.Stdout); err != nil {
-			log.Fatal("error writing map to stdout: ", err)
-		}
-	} else {
-		if err := m.WriteFiles(*outFile); err != nil {
-			log.Fatal("error writing map: ", err)
+		log.Fatal("-watch requires -out file")
+	}
+	rebuild := func() {
+		err := build()
+		result := builder.BuildResult{MML: *mmlFilename, Builder: *builderType, Err: err}
+		if err != nil {
+			logger.Error("style build failed", "mml", *mmlFilename, "err", err)
+		} else {
+			result.File = *outFile
+			logger.Info("rebuild style", "mml", *mmlFilename, "file", *outFile)
 		}
+		builder.RunHooks(conf.Hooks, result, logger)
+	}
+	if err := watchFiles(*mmlFilename, mssFilenames, rebuild, logger); err != nil {
+		log.Fatal(err)
 	}
 }
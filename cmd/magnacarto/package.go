@@ -0,0 +1,633 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// Directories of the assets in the package. The MML and MSS files keep
+// their paths relative to the common directory of all project files.
+const (
+	packageDataDir  = "data"
+	packageImageDir = "images"
+	packageFontDir  = "fonts"
+	packageConfig   = "magnacarto.tml"
+)
+
+// packageConfigContent configures the locator to find all assets of the
+// package, when magnacarto runs in the root of the extracted package.
+const packageConfigContent = `[datasources]
+shapefile_dirs = ["data"]
+sqlite_dirs = ["data"]
+image_dirs = ["images"]
+
+[mapnik]
+font_dirs = ["fonts"]
+`
+
+// shapefileSuffixes are the optional files of a Shapefile.
+var shapefileSuffixes = []string{".shx", ".dbf", ".prj", ".cpg", ".qix", ".sbn", ".sbx"}
+
+// assetMap collects the images and fonts of all rules.
+type assetMap struct {
+	images []string
+	fonts  []string
+}
+
+func (a *assetMap) AddLayer(l mml.Layer, rules []mss.Rule) {
+	prefixes := []string{"marker-", "point-", "shield-", "line-pattern-", "polygon-pattern-", "text-"}
+	for _, r := range rules {
+		for _, p := range mss.SortedPrefixes(r.Properties, prefixes) {
+			r.Properties.SetDefaultInstance(p.Instance)
+			if file, ok := r.Properties.GetString(p.Name + "file"); ok {
+				a.images = append(a.images, file)
+			}
+			if fonts, ok := r.Properties.GetStringList(p.Name + "face-name"); ok {
+				a.fonts = append(a.fonts, fonts...)
+			}
+			r.Properties.SetDefaultInstance("")
+		}
+	}
+}
+
+// packageFile is a single file of the package, either copied from src or
+// with the generated content.
+type packageFile struct {
+	name    string // slash separated path in the package
+	src     string
+	content []byte
+}
+
+// packager collects the files of a project. Assets are renamed if their
+// reference is not relative to the project (e.g. /data/roads.shp or
+// ../icons/bus.svg) or if another file has the same name.
+type packager struct {
+	root    string // common directory of all MML and MSS files
+	locator config.Locator
+	clip    *[4]float64
+	tmpDir  string // for clipped data, see cleanup
+	logger  *logging.Logger
+
+	files []packageFile
+	// names maps the names of all files in the package to their source
+	names map[string]string
+	// dataRefs and imageRefs are the new references of renamed datasource
+	// files and images
+	dataRefs  map[string]string
+	imageRefs map[string]string
+	missing   []string
+}
+
+func newPackager(root string, locator config.Locator, logger *logging.Logger) *packager {
+	return &packager{
+		root:      root,
+		locator:   locator,
+		logger:    logger,
+		names:     make(map[string]string),
+		dataRefs:  make(map[string]string),
+		imageRefs: make(map[string]string),
+	}
+}
+
+// uniqueName returns name, or a numbered name if name is already used by
+// another file than src.
+func (p *packager) uniqueName(name, src string) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		if s, ok := p.names[name]; !ok || s == src {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d%s", stem, i, ext)
+	}
+}
+
+// add adds src with a unique name. Returns the name in the package.
+func (p *packager) add(name, src string) string {
+	name = p.uniqueName(name, src)
+	if _, ok := p.names[name]; !ok {
+		p.names[name] = src
+		p.files = append(p.files, packageFile{name: name, src: src})
+	}
+	return name
+}
+
+// assetName returns the name of an asset within dir. The reference is kept
+// if it is a relative path within the project.
+func assetName(dir, ref string) string {
+	name := filepath.ToSlash(ref)
+	if filepath.IsAbs(ref) || strings.HasPrefix(name, "/") || strings.HasPrefix(path.Clean(name), "..") {
+		name = path.Base(name)
+	}
+	return path.Join(dir, path.Clean(name))
+}
+
+// projectName returns the name of a MML or MSS file in the package.
+func (p *packager) projectName(filename string) (string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(p.root, abs)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (p *packager) addImage(ref string) {
+	if _, ok := p.imageRefs[ref]; ok {
+		return
+	}
+	src := p.locator.Image(ref)
+	if src == "" {
+		p.missing = append(p.missing, ref)
+		return
+	}
+	name := p.add(assetName(packageImageDir, ref), src)
+	p.imageRefs[ref] = strings.TrimPrefix(name, packageImageDir+"/")
+}
+
+func (p *packager) addFont(face string) {
+	src := p.locator.Font(face)
+	if src == "" {
+		p.missing = append(p.missing, "font "+face)
+		return
+	}
+	// fonts are found by their face name, keep the file name
+	p.add(path.Join(packageFontDir, filepath.Base(src)), src)
+}
+
+// addDatasource adds the data files of a layer. Shapefile and SQLite files
+// are found with the locator, the file of all other datasources is used as
+// is by Mapnik and MapServer and is relative to the working dir.
+func (p *packager) addDatasource(l mml.Layer) error {
+	var ref, src string
+	located := true
+	switch ds := l.Datasource.(type) {
+	case mml.Shapefile:
+		ref, src = ds.Filename, p.locator.Shape(ds.Filename)
+	case mml.SQLite:
+		ref, src = ds.Filename, p.locator.SQLite(ds.Filename)
+	case mml.OGR:
+		ref, src, located = ds.Filename, ds.Filename, false
+	case mml.GDAL:
+		ref, src, located = ds.Filename, ds.Filename, false
+	case mml.Contour:
+		ref, src, located = ds.Filename, ds.Filename, false
+	case mml.PostGIS:
+		p.logger.Warn("data of PostGIS layer is not included", "layer", l.Name)
+		return nil
+	default:
+		return nil
+	}
+	if _, ok := p.dataRefs[ref]; ok || ref == "" {
+		return nil
+	}
+	if fi, err := os.Stat(src); src == "" || err != nil || fi.IsDir() {
+		p.missing = append(p.missing, ref)
+		return nil
+	}
+
+	name := p.uniqueName(assetName(packageDataDir, ref), src)
+	if p.clip != nil {
+		clipped, err := p.clipData(l, src, name)
+		if err != nil {
+			return fmt.Errorf("clipping data of layer %s: %s", l.Name, err)
+		}
+		src = clipped
+	}
+	name = p.add(name, src)
+	if _, ok := l.Datasource.(mml.Shapefile); ok {
+		stem := strings.TrimSuffix(src, filepath.Ext(src))
+		nameStem := strings.TrimSuffix(name, path.Ext(name))
+		for _, suffix := range shapefileSuffixes {
+			if _, err := os.Stat(stem + suffix); err == nil {
+				p.add(nameStem+suffix, stem+suffix)
+			}
+		}
+	}
+
+	if located {
+		p.dataRefs[ref] = strings.TrimPrefix(name, packageDataDir+"/")
+	} else {
+		p.dataRefs[ref] = name
+	}
+	return nil
+}
+
+// cleanup removes all clipped data.
+func (p *packager) cleanup() {
+	if p.tmpDir != "" {
+		os.RemoveAll(p.tmpDir)
+	}
+}
+
+// ogrDrivers are the OGR drivers of all vector files that are clipped.
+var ogrDrivers = map[string]string{
+	".shp":     "ESRI Shapefile",
+	".geojson": "GeoJSON",
+	".json":    "GeoJSON",
+	".gpkg":    "GPKG",
+}
+
+// clipData clips src to the clip bbox with ogr2ogr or gdal_translate and
+// returns the clipped file. Files of other formats are included as is.
+func (p *packager) clipData(l mml.Layer, src, name string) (string, error) {
+	if p.tmpDir == "" {
+		dir, err := ioutil.TempDir("", "magnacarto-package")
+		if err != nil {
+			return "", err
+		}
+		p.tmpDir = dir
+	}
+	dst := filepath.Join(p.tmpDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	bbox := make([]string, 4)
+	for i, v := range p.clip {
+		bbox[i] = strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	var cmd *exec.Cmd
+	if _, ok := l.Datasource.(mml.GDAL); ok {
+		cmd = exec.Command("gdal_translate", "-q",
+			"-projwin", bbox[0], bbox[3], bbox[2], bbox[1], "-projwin_srs", "EPSG:4326",
+			src, dst)
+	} else if driver, ok := ogrDrivers[strings.ToLower(filepath.Ext(src))]; ok && l.Type != mml.Raster {
+		cmd = exec.Command("ogr2ogr", "-f", driver,
+			"-spat", bbox[0], bbox[1], bbox[2], bbox[3], "-spat_srs", "EPSG:4326",
+			"-clipsrc", "spat_extent",
+			dst, src)
+	} else {
+		p.logger.Warn("data of layer is not clipped, only Shapefile, GeoJSON, GeoPackage and GDAL files are supported", "layer", l.Name)
+		return src, nil
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s %s", cmd.Args[0], err, bytes.TrimSpace(out))
+	}
+	return dst, nil
+}
+
+// addMML adds the MML with rewritten datasource files. Absolute stylesheet
+// and extends paths are replaced with paths relative to the MML in the
+// package. The MML is copied as is, if nothing changed.
+func (p *packager) addMML(filename string) error {
+	name, err := p.projectName(filename)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	doc := map[string]interface{}{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	relRef := func(ref string) (string, error) {
+		refName, err := p.projectName(ref)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(path.Dir(name), refName)
+		return filepath.ToSlash(rel), err
+	}
+
+	changed := false
+	if layers, ok := doc["Layer"].([]interface{}); ok {
+		for _, l := range layers {
+			layer, _ := l.(map[string]interface{})
+			ds, _ := layer["Datasource"].(map[string]interface{})
+			file, _ := ds["file"].(string)
+			if ref, ok := p.dataRefs[file]; ok && ref != file {
+				ds["file"] = ref
+				changed = true
+			}
+		}
+	}
+	if stylesheets, ok := doc["Stylesheet"].([]interface{}); ok {
+		for i, s := range stylesheets {
+			if s, ok := s.(string); ok && filepath.IsAbs(s) {
+				if stylesheets[i], err = relRef(s); err != nil {
+					return err
+				}
+				changed = true
+			}
+		}
+	}
+	if base, ok := doc["extends"].(string); ok && filepath.IsAbs(base) {
+		if doc["extends"], err = relRef(base); err != nil {
+			return err
+		}
+		changed = true
+	}
+
+	if changed {
+		if content, err = json.MarshalIndent(doc, "", "  "); err != nil {
+			return err
+		}
+		content = append(content, '\n')
+	}
+	p.names[name] = filename
+	p.files = append(p.files, packageFile{name: name, content: content})
+	return nil
+}
+
+// mssRefs matches url() values and quoted strings.
+var mssRefs = regexp.MustCompile(`url\(\s*['"]?([^'")\s]+)['"]?\s*\)|"([^"]*)"|'([^']*)'`)
+
+// addMSS adds the MSS with all renamed image references replaced.
+func (p *packager) addMSS(filename string) error {
+	name, err := p.projectName(filename)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	content = mssRefs.ReplaceAllFunc(content, func(match []byte) []byte {
+		sub := mssRefs.FindSubmatch(match)
+		for _, ref := range sub[1:] {
+			if len(ref) == 0 {
+				continue
+			}
+			if renamed, ok := p.imageRefs[string(ref)]; ok && renamed != string(ref) {
+				return bytes.Replace(match, ref, []byte(renamed), 1)
+			}
+		}
+		return match
+	})
+	p.names[name] = filename
+	p.files = append(p.files, packageFile{name: name, content: content})
+	return nil
+}
+
+// commonDir returns the deepest directory that contains all files.
+func commonDir(files []string) string {
+	dir := filepath.Dir(files[0])
+	for _, f := range files[1:] {
+		for !strings.HasPrefix(f, dir+string(filepath.Separator)) && dir != filepath.Dir(dir) {
+			dir = filepath.Dir(dir)
+		}
+	}
+	return dir
+}
+
+// packageProject collects all files of the project. Images and fonts are
+// only included if they are referenced by rules that are active with the
+// defines. Warnings about files that are not included are logged to logger.
+func packageProject(mmlFilename string, locator config.Locator, defs map[string]string, withData bool, clip *[4]float64, logger *logging.Logger) (*packager, error) {
+	m, err := mml.Load(mmlFilename)
+	if err != nil {
+		return nil, err
+	}
+	mmlFiles := append([]string{mmlFilename}, m.BaseFiles...)
+	mssFiles := []string{}
+	for _, s := range m.Stylesheets {
+		if !filepath.IsAbs(s) {
+			s = filepath.Join(filepath.Dir(mmlFilename), s)
+		}
+		mssFiles = append(mssFiles, s)
+	}
+	projectFiles := []string{}
+	for _, f := range append(mmlFiles, mssFiles...) {
+		abs, err := filepath.Abs(f)
+		if err != nil {
+			return nil, err
+		}
+		projectFiles = append(projectFiles, abs)
+	}
+
+	assets := &assetMap{}
+	b := builder.New(assets)
+	b.SetMML(mmlFilename)
+	for name, value := range defs {
+		b.Define(name, value)
+	}
+	if err := b.Build(); err != nil {
+		return nil, fmt.Errorf("error building map: %s", err)
+	}
+
+	p := newPackager(commonDir(projectFiles), locator, logger)
+	p.clip = clip
+	// reserve names of project files, assets are renamed on conflicts
+	for _, f := range projectFiles {
+		name, err := p.projectName(f)
+		if err != nil {
+			return nil, err
+		}
+		p.names[name] = f
+	}
+	for _, img := range assets.images {
+		p.addImage(img)
+	}
+	for _, font := range assets.fonts {
+		p.addFont(font)
+	}
+	if err := p.addProject(m.Layers, mmlFiles, mssFiles, withData); err != nil {
+		p.cleanup()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *packager) addProject(layers []mml.Layer, mmlFiles, mssFiles []string, withData bool) error {
+	if withData {
+		for _, l := range layers {
+			if err := p.addDatasource(l); err != nil {
+				return err
+			}
+		}
+	}
+	if len(p.missing) > 0 {
+		return fmt.Errorf("referenced files not found: %s", strings.Join(p.missing, ", "))
+	}
+	for _, f := range mmlFiles {
+		if err := p.addMML(f); err != nil {
+			return err
+		}
+	}
+	for _, f := range mssFiles {
+		if err := p.addMSS(f); err != nil {
+			return err
+		}
+	}
+	p.files = append(p.files, packageFile{name: packageConfig, content: []byte(packageConfigContent)})
+	return nil
+}
+
+// writeArchive writes all files as zip, tar or gzipped tar, depending on
+// the suffix of filename.
+func writeArchive(filename string, files []packageFile) error {
+	var format string
+	switch lower := strings.ToLower(filename); {
+	case strings.HasSuffix(lower, ".zip"):
+		format = "zip"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		format = "tgz"
+	case strings.HasSuffix(lower, ".tar"):
+		format = "tar"
+	default:
+		return fmt.Errorf("unsupported archive %s, use .zip, .tar.gz or .tar", filename)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var zw *zip.Writer
+	var tw *tar.Writer
+	var gw *gzip.Writer
+	switch format {
+	case "zip":
+		zw = zip.NewWriter(f)
+	case "tgz":
+		gw = gzip.NewWriter(f)
+		tw = tar.NewWriter(gw)
+	case "tar":
+		tw = tar.NewWriter(f)
+	}
+
+	for _, pf := range files {
+		content, modTime := pf.content, time.Now()
+		if pf.src != "" {
+			fi, err := os.Stat(pf.src)
+			if err != nil {
+				return err
+			}
+			if content, err = ioutil.ReadFile(pf.src); err != nil {
+				return err
+			}
+			modTime = fi.ModTime()
+		}
+		if zw != nil {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: pf.name, Method: zip.Deflate, Modified: modTime})
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(content); err != nil {
+				return err
+			}
+			continue
+		}
+		hdr := &tar.Header{Name: pf.name, Mode: 0644, Size: int64(len(content)), ModTime: modTime, Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else {
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if gw != nil {
+			if err := gw.Close(); err != nil {
+				return err
+			}
+		}
+	}
+	return f.Close()
+}
+
+func parseBBOX(s string) ([4]float64, error) {
+	var bbox [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return bbox, fmt.Errorf("invalid bbox %q, expected minx,miny,maxx,maxy", s)
+	}
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return bbox, fmt.Errorf("invalid bbox %q: %s", s, err)
+		}
+		bbox[i] = v
+	}
+	return bbox, nil
+}
+
+func packageCmd(args []string) {
+	flags := flag.NewFlagSet("package", flag.ExitOnError)
+	mmlFilename := flags.String("mml", "", "mml file")
+	confFile := flags.String("config", "", "config")
+	outFile := flags.String("out", "", "archive file (.zip, .tar.gz or .tar)")
+	defs := defines{}
+	flags.Var(defs, "define", "set flag for @if conditions, can be repeated. only files of active rules are included")
+	withData := flags.Bool("data", false, "include Shapefile, SQLite, OGR and GDAL files of all layers")
+	clipBBOX := flags.String("clip", "", "clip data to minx,miny,maxx,maxy in EPSG:4326 with ogr2ogr/gdal_translate (implies -data)")
+	flags.Parse(args)
+
+	if *mmlFilename == "" || *outFile == "" {
+		log.Fatal("package requires -mml and -out")
+	}
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// the locator needs to find the files
+	conf.Datasources.NoCheckFiles = false
+
+	var clip *[4]float64
+	if *clipBBOX != "" {
+		bbox, err := parseBBOX(*clipBBOX)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clip = &bbox
+		*withData = true
+	}
+
+	logger := logging.Default()
+	p, err := packageProject(*mmlFilename, conf.Locator(), defs, *withData, clip, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = writeArchive(*outFile, p.files)
+	p.cleanup()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mmlName, _ := p.projectName(*mmlFilename)
+	logger.Info(fmt.Sprintf("packaged %d files to %s, build in the extracted directory with: magnacarto -config %s -mml %s",
+		len(p.files), *outFile, packageConfig, mmlName))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/config"
+)
+
+func TestPackageProject(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	shared := filepath.Join(dir, "shared", "poi.svg")
+	files := map[string]string{
+		"project/project.mml": `{"extends": "../base/base.mml", "Stylesheet": ["style.mss"], "Layer": [
+			{"name": "roads", "geometry": "linestring", "Datasource": {"file": "../data/roads.shp"}},
+			{"name": "pois", "geometry": "point", "Datasource": {"type": "ogr", "file": "` + filepath.ToSlash(filepath.Join(dir, "data", "pois.geojson")) + `"}}
+		]}`,
+		"project/style.mss": `
+			#roads { line-width: 1; text-name: [name]; text-face-name: "DejaVu Sans Book"; }
+			#pois { marker-file: url('icons/bus.svg'); }
+			#pois[type='shop'] { marker-file: url("` + filepath.ToSlash(shared) + `"); }
+		`,
+		"base/base.mml": `{"Stylesheet": ["base.mss"], "Layer": [
+			{"name": "water", "geometry": "polygon", "Datasource": {"type": "postgis", "table": "water"}}
+		]}`,
+		"base/base.mss":         `#water { polygon-fill: blue; }`,
+		"project/icons/bus.svg": `<svg/>`,
+		"shared/poi.svg":        `<svg/>`,
+		"data/roads.shp":        "shp",
+		"data/roads.dbf":        "dbf",
+		"data/pois.geojson":     `{"type": "FeatureCollection", "features": []}`,
+		"fonts/DejaVuSans.ttf":  "ttf",
+	}
+	for name, content := range files {
+		fname := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := config.Magnacarto{}
+	conf.Datasources.ImageDirs = []string{filepath.Join(dir, "project")}
+	conf.Mapnik.FontDirs = []string{filepath.Join(dir, "fonts")}
+	conf.Datasources.ShapefileDirs = []string{filepath.Join(dir, "project")}
+
+	p, err := packageProject(filepath.Join(dir, "project", "project.mml"), conf.Locator(), nil, true, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := map[string]string{}
+	names := []string{}
+	for _, f := range p.files {
+		names = append(names, f.name)
+		content[f.name] = string(f.content)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"base/base.mml",
+		"base/base.mss",
+		"data/pois.geojson",
+		"data/roads.dbf",
+		"data/roads.shp",
+		"fonts/DejaVuSans.ttf",
+		"images/icons/bus.svg",
+		"images/poi.svg",
+		"magnacarto.tml",
+		"project/project.mml",
+		"project/style.mss",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("unexpected files\n%v\n%v", names, expected)
+	}
+
+	if mss := content["project/style.mss"]; !strings.Contains(mss, `url('icons/bus.svg')`) || !strings.Contains(mss, `url("poi.svg")`) {
+		t.Error("unexpected image references in", mss)
+	}
+	mml := content["project/project.mml"]
+	for _, e := range []string{`"file": "roads.shp"`, `"file": "data/pois.geojson"`, `"extends": "../base/base.mml"`} {
+		if !strings.Contains(mml, e) {
+			t.Errorf("%s not found in\n%s", e, mml)
+		}
+	}
+	if content["base/base.mml"] != files["base/base.mml"] {
+		t.Error("unchanged MML was rewritten", content["base/base.mml"])
+	}
+
+	for _, archive := range []string{"project.tar.gz", "project.zip"} {
+		fname := filepath.Join(dir, archive)
+		if err := writeArchive(fname, p.files); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		if strings.HasSuffix(archive, ".zip") {
+			r, err := zip.OpenReader(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range r.File {
+				got = append(got, f.Name)
+			}
+			r.Close()
+		} else {
+			tarball, err := ioutil.ReadFile(fname)
+			if err != nil {
+				t.Fatal(err)
+			}
+			extracted := filepath.Join(dir, "extracted")
+			if err := untar(tarball, extracted, 1<<30); err != nil {
+				t.Fatal(err)
+			}
+			filepath.Walk(extracted, func(path string, fi os.FileInfo, err error) error {
+				if err == nil && !fi.IsDir() {
+					rel, _ := filepath.Rel(extracted, path)
+					got = append(got, filepath.ToSlash(rel))
+				}
+				return err
+			})
+			c, err := config.Load(filepath.Join(extracted, packageConfig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(c.Datasources.ImageDirs, []string{"images"}) || !reflect.DeepEqual(c.Mapnik.FontDirs, []string{"fonts"}) {
+				t.Errorf("unexpected config %#v", c)
+			}
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("unexpected files in %s\n%v", archive, got)
+		}
+	}
+	if err := writeArchive(filepath.Join(dir, "project.rar"), p.files); err == nil {
+		t.Error("expected error for unsupported archive")
+	}
+}
+
+func TestPackageMissingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "project.mml"), []byte(`{"Stylesheet": ["style.mss"], "Layer": [
+		{"name": "pois", "geometry": "point", "Datasource": {"file": "missing.shp"}}
+	]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "style.mss"), []byte(`#pois { marker-file: url(missing.svg); }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf := config.Magnacarto{}
+	_, err = packageProject(filepath.Join(dir, "project.mml"), conf.Locator(), nil, true, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "missing.svg") || !strings.Contains(err.Error(), "missing.shp") {
+		t.Error("expected error for missing files, got", err)
+	}
+}
+
+func TestAssetName(t *testing.T) {
+	for _, tc := range []struct {
+		ref, expected string
+	}{
+		{"icons/bus.svg", "images/icons/bus.svg"},
+		{"./icons/../bus.svg", "images/bus.svg"},
+		{"../icons/bus.svg", "images/bus.svg"},
+		{"/usr/share/icons/bus.svg", "images/bus.svg"},
+	} {
+		if got := assetName("images", tc.ref); got != tc.expected {
+			t.Errorf("assetName(%q) = %q, expected %q", tc.ref, got, tc.expected)
+		}
+	}
+}
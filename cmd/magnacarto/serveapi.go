@@ -0,0 +1,470 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+// apiServer builds styles for POST /build requests. Builds are cached and
+// only repeated if the project files change.
+type apiServer struct {
+	// mu serializes builds, so that the diagnostics of a build are stored
+	// before other requests get the cached build.
+	mu          sync.Mutex
+	cache       *builder.Cache
+	stylesDir   string
+	projectsDir string
+	maxProjects int
+	// projects are the extracted tarballs by hash, with the last use
+	projects map[string]time.Time
+	// inUse counts the running builds of each project, projects in use are
+	// not evicted
+	inUse map[string]int
+	// diagnostics of the last build of each style, returned again for
+	// cached builds
+	diagnostics map[string]styleDiagnostics
+	maxBodySize int64
+	// maxProjectSize limits the size of all extracted files of a project
+	maxProjectSize int64
+	logger         *logging.Logger
+}
+
+type styleDiagnostics struct {
+	mml      string
+	file     string
+	messages []string
+}
+
+type buildRequest struct {
+	MML     string `json:"mml"`
+	Builder string `json:"builder"`
+	// Vars override MSS variables, the value and origin of all variables
+	// are included in the diagnostics.
+	Vars map[string]string `json:"vars"`
+}
+
+type buildResponse struct {
+	Builder     string   `json:"builder"`
+	Style       string   `json:"style,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Diagnostics []string `json:"diagnostics"`
+}
+
+func mapMaker(builderType string) (builder.MapMaker, error) {
+	switch builderType {
+	case "", "mapnik2":
+		return mapnik.Maker2, nil
+	case "mapnik3":
+		return mapnik.Maker3, nil
+	case "mapserver":
+		return mapserver.Maker, nil
+	}
+	return nil, fmt.Errorf("unknown builder %s", builderType)
+}
+
+func (s *apiServer) build(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST project tarball or JSON file reference", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.maxBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	req := buildRequest{MML: r.URL.Query().Get("mml"), Builder: r.URL.Query().Get("builder")}
+	for _, v := range r.URL.Query()["var"] {
+		if req.Vars == nil {
+			req.Vars = make(map[string]string)
+		}
+		if err := variables(req.Vars).Set(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var mmlFile string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		mmlFile, err = s.stylePath(req.MML)
+	} else {
+		var release func()
+		mmlFile, release, err = s.extractProject(body, req.MML)
+		if release != nil {
+			defer release()
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Builder == "" {
+		req.Builder = "mapnik2"
+	}
+	mm, err := mapMaker(req.Builder)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Vars) > 0 {
+		mm = builder.VariantMaker(mm, builder.Variant{Vars: req.Vars})
+	}
+
+	resp := buildResponse{Builder: req.Builder}
+	status := http.StatusOK
+	logger := s.logger.With("request_id", logging.NewID())
+	style, diagnostics, err := s.buildStyle(mm, mmlFile, logger)
+	resp.Diagnostics = diagnostics
+	if err != nil {
+		resp.Error = err.Error()
+		status = http.StatusUnprocessableEntity
+	} else {
+		resp.Style = string(style)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(resp)
+}
+
+// buildStyle returns the style and all warnings and reports of the builder
+// as diagnostics. The builder messages are also logged to logger.
+func (s *apiServer) buildStyle(mm builder.MapMaker, mmlFile string, logger *logging.Logger) ([]byte, []string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	diagnostics := []string{}
+	logger = logger.Tee(logging.Info, func(e logging.Entry) {
+		if e.Field("component") == "builder" {
+			diagnostics = append(diagnostics, e.Msg)
+		}
+	})
+	file, err := s.cache.StyleFileWithLogger(mm, mmlFile, nil, logger)
+	if err != nil {
+		return nil, diagnostics, err
+	}
+	key := mm.Type() + ":" + mmlFile
+	if d, ok := s.diagnostics[key]; ok && d.file == file {
+		// cached build
+		diagnostics = d.messages
+	} else {
+		// replaces the diagnostics of the previous build
+		s.diagnostics[key] = styleDiagnostics{mml: mmlFile, file: file, messages: diagnostics}
+	}
+	style, err := ioutil.ReadFile(file)
+	return style, diagnostics, err
+}
+
+func (s *apiServer) stylePath(fname string) (string, error) {
+	if s.stylesDir == "" {
+		return "", fmt.Errorf("file references require -styles-dir")
+	}
+	if fname == "" {
+		return "", fmt.Errorf("missing mml")
+	}
+	path := filepath.Join(s.stylesDir, filepath.FromSlash(fname))
+	if !strings.HasPrefix(path, s.stylesDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("style file %s outside of styles dir", fname)
+	}
+	return path, nil
+}
+
+// extractProject extracts the (gzipped) tarball into its own dir and returns
+// the path of mmlFile. Tarballs with the same content are only extracted
+// once, so that the style cache is used for repeated builds. The project is
+// not evicted until release is called.
+func (s *apiServer) extractProject(tarball []byte, mmlFile string) (mmlPath string, release func(), err error) {
+	hash := sha256.Sum256(tarball)
+	id := hex.EncodeToString(hash[:])
+	dir := filepath.Join(s.projectsDir, id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.projects[id]; !ok {
+		if err := untar(tarball, dir, s.maxProjectSize); err != nil {
+			os.RemoveAll(dir)
+			return "", nil, fmt.Errorf("invalid project tarball: %s", err)
+		}
+		s.evictProjects()
+	}
+	s.projects[id] = time.Now()
+	s.inUse[id]++
+	release = func() {
+		s.mu.Lock()
+		s.inUse[id]--
+		if s.inUse[id] == 0 {
+			delete(s.inUse, id)
+		}
+		s.mu.Unlock()
+	}
+
+	if mmlFile == "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.mml"))
+		if err != nil {
+			return "", release, err
+		}
+		if len(files) != 1 {
+			return "", release, fmt.Errorf("found %d .mml files in project, select one with mml=", len(files))
+		}
+		mmlPath = files[0]
+	} else {
+		mmlPath = projectPath(dir, mmlFile)
+		if _, err := os.Stat(mmlPath); err != nil {
+			return "", release, fmt.Errorf("%s not found in project", mmlFile)
+		}
+	}
+	if err := checkProjectFiles(dir, mmlPath); err != nil {
+		return "", release, err
+	}
+	return mmlPath, release, nil
+}
+
+// checkProjectFiles returns an error if a project extended by mmlFile or a
+// stylesheet is outside of dir. Extended projects are checked before they
+// are read, so that no file outside of dir is opened.
+func checkProjectFiles(dir, mmlFile string) error {
+	seen := map[string]bool{}
+	for mmlFile != "" && !seen[mmlFile] {
+		seen[mmlFile] = true
+		f, err := os.Open(mmlFile)
+		if err != nil {
+			return err
+		}
+		project := struct {
+			Stylesheets []string `json:"Stylesheet"`
+			Extends     string   `json:"extends"`
+		}{}
+		err = json.NewDecoder(f).Decode(&project)
+		f.Close()
+		if err != nil {
+			// invalid MML files are reported by the build
+			return nil
+		}
+		for _, mss := range project.Stylesheets {
+			if !insideDir(dir, filepath.Dir(mmlFile), mss) {
+				return fmt.Errorf("stylesheet %s outside of project", mss)
+			}
+		}
+		if project.Extends == "" {
+			break
+		}
+		if !insideDir(dir, filepath.Dir(mmlFile), project.Extends) {
+			return fmt.Errorf("extends %s outside of project", project.Extends)
+		}
+		mmlFile = resolvePath(filepath.Dir(mmlFile), project.Extends)
+	}
+	return nil
+}
+
+// resolvePath returns fname relative to base, if fname is not absolute.
+func resolvePath(base, fname string) string {
+	if filepath.IsAbs(fname) {
+		return filepath.Clean(fname)
+	}
+	return filepath.Join(base, fname)
+}
+
+// insideDir returns whether fname (relative to base) is inside of dir.
+func insideDir(dir, base, fname string) bool {
+	return strings.HasPrefix(resolvePath(base, fname), filepath.Clean(dir)+string(filepath.Separator))
+}
+
+// evictProjects removes the least recently used projects that are not in use,
+// if there are more than maxProjects. Needs to be called with locked server.
+func (s *apiServer) evictProjects() {
+	if len(s.projects) < s.maxProjects {
+		return
+	}
+	ids := make([]string, 0, len(s.projects))
+	for id := range s.projects {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return s.projects[ids[i]].Before(s.projects[ids[j]]) })
+	n := len(ids) - s.maxProjects + 1
+	for _, id := range ids {
+		if n == 0 {
+			break
+		}
+		if s.inUse[id] > 0 {
+			// keep files of running builds
+			continue
+		}
+		n--
+		dir := filepath.Join(s.projectsDir, id)
+		if err := os.RemoveAll(dir); err != nil {
+			s.logger.Warn("cleanup error", "err", err)
+		}
+		delete(s.projects, id)
+		for key, d := range s.diagnostics {
+			if strings.HasPrefix(d.mml, dir+string(filepath.Separator)) {
+				delete(s.diagnostics, key)
+			}
+		}
+	}
+}
+
+// projectPath returns the path of the file name inside of dir. name is
+// always relative to dir, also for absolute names or names with "..".
+// Backslashes are treated as separators, so that names like `..\..\x` can
+// not escape dir on Windows.
+func projectPath(dir, name string) string {
+	name = path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+	return filepath.Join(dir, filepath.FromSlash(name))
+}
+
+// untar extracts all regular files and dirs of the tarball to dir. Other
+// files (e.g. symlinks) are skipped. Returns an error if the extracted files
+// are larger than maxSize bytes.
+func untar(tarball []byte, dir string, maxSize int64) error {
+	var r io.Reader = bytes.NewReader(tarball)
+	if bytes.HasPrefix(tarball, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fname := projectPath(dir, hdr.Name)
+		if fname == filepath.Clean(dir) {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(fname, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+				return err
+			}
+			f, err := os.Create(fname)
+			if err != nil {
+				return err
+			}
+			n, err := io.Copy(f, io.LimitReader(tr, maxSize+1))
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if maxSize -= n; maxSize < 0 {
+				return fmt.Errorf("extracted files larger than -max-project-size")
+			}
+		}
+	}
+}
+
+func serveAPI(args []string) {
+	flags := flag.NewFlagSet("serve-api", flag.ExitOnError)
+	listen := flags.String("listen", "localhost:7071", "listen address")
+	confFile := flags.String("config", "", "config")
+	stylesDir := flags.String("styles-dir", "", "dir for MML files referenced by JSON requests")
+	maxProjects := flags.Int("max-projects", 32, "number of uploaded projects to keep for cached builds")
+	maxBodySize := flags.Int64("max-body-size", 64<<20, "max size of uploaded projects in bytes")
+	maxProjectSize := flags.Int64("max-project-size", 256<<20, "max size of the extracted files of uploaded projects in bytes")
+	flags.Parse(args)
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *stylesDir == "" {
+		*stylesDir = conf.StylesDir
+	}
+	if *stylesDir != "" {
+		var err error
+		if *stylesDir, err = filepath.Abs(*stylesDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	projectsDir, err := ioutil.TempDir("", "magnacarto-api")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(projectsDir)
+
+	logger := logging.Default()
+	cache := builder.NewCache(conf.Locator(), conf.DeferEval)
+	cache.SetCartoCompat(conf.CartoCompat)
+	cache.SetLogger(logger)
+	defer cache.ClearAll()
+
+	s := &apiServer{
+		cache:          cache,
+		stylesDir:      *stylesDir,
+		projectsDir:    projectsDir,
+		maxProjects:    *maxProjects,
+		projects:       map[string]time.Time{},
+		inUse:          map[string]int{},
+		diagnostics:    map[string]styleDiagnostics{},
+		maxBodySize:    *maxBodySize,
+		maxProjectSize: *maxProjectSize,
+		logger:         logger,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/build", s.build)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok\n")) })
+	srv := &http.Server{Addr: *listen, Handler: mux}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	logger.Info("serving build API", "addr", *listen)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Error("server failed", "err", err)
+		cache.ClearAll()
+		os.RemoveAll(projectsDir)
+		os.Exit(1)
+	}
+	<-done
+}
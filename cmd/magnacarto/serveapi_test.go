@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+func testTarball(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func newTestAPIServer(t *testing.T, stylesDir string) *apiServer {
+	projectsDir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &apiServer{
+		cache:          builder.NewCache(&config.LookupLocator{}, false),
+		stylesDir:      stylesDir,
+		projectsDir:    projectsDir,
+		maxProjects:    2,
+		projects:       map[string]time.Time{},
+		inUse:          map[string]int{},
+		diagnostics:    map[string]styleDiagnostics{},
+		maxBodySize:    1 << 20,
+		maxProjectSize: 1 << 20,
+		logger:         logging.Default(),
+	}
+}
+
+func postBuild(t *testing.T, s *apiServer, url, contentType string, body []byte) (int, buildResponse) {
+	req := httptest.NewRequest("POST", url, bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.build(w, req)
+	resp := buildResponse{}
+	if w.Header().Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestServeAPITarball(t *testing.T) {
+	s := newTestAPIServer(t, "")
+	defer os.RemoveAll(s.projectsDir)
+	defer s.cache.ClearAll()
+
+	project := testTarball(t, map[string]string{
+		"project.mml": `{"Stylesheet": ["style/roads.mss"], "Layer": [
+			{"name": "roads", "geometry": "linestring", "Datasource": {"type": "shape", "file": "roads.shp"}}]}`,
+		"style/roads.mss": `#roads { line-width: 1; marker-file: url(missing.svg); }`,
+		"../evil.mss":     `outside`,
+	})
+	for i := 0; i < 2; i++ {
+		code, resp := postBuild(t, s, "/build?builder=mapnik3", "application/gzip", project)
+		if code != 200 {
+			t.Fatal(code, resp)
+		}
+		if resp.Builder != "mapnik3" || !strings.Contains(resp.Style, `<LineSymbolizer stroke-width="1"`) {
+			t.Errorf("unexpected response %#v", resp)
+		}
+		if len(resp.Diagnostics) != 1 || !strings.Contains(resp.Diagnostics[0], "missing.svg") {
+			t.Errorf("unexpected diagnostics %#v", resp.Diagnostics)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(s.projectsDir, "*", "evil.mss")); len(files) != 1 {
+		t.Error("file outside of project not extracted into project dir", files)
+	}
+	if _, err := os.Stat(filepath.Join(s.projectsDir, "evil.mss")); !os.IsNotExist(err) {
+		t.Error("file extracted outside of project")
+	}
+
+	code, resp := postBuild(t, s, "/build", "application/gzip", testTarball(t, map[string]string{
+		"project.mml": `{"Stylesheet": ["missing.mss"]}`,
+	}))
+	if code != 422 || resp.Error == "" {
+		t.Error("expected build error", code, resp)
+	}
+	if code, _ := postBuild(t, s, "/build", "application/gzip", testTarball(t, map[string]string{"a.mss": ""})); code != 400 {
+		t.Error("expected error for project without mml", code)
+	}
+	// third project evicts the first one
+	if dirs, _ := ioutil.ReadDir(s.projectsDir); len(dirs) != 2 {
+		t.Error("unexpected projects", len(dirs))
+	}
+	if len(s.diagnostics) != 0 {
+		t.Error("diagnostics of evicted project not removed", s.diagnostics)
+	}
+}
+
+func TestServeAPIProjectSize(t *testing.T) {
+	s := newTestAPIServer(t, "")
+	defer os.RemoveAll(s.projectsDir)
+	defer s.cache.ClearAll()
+
+	// compresses to a few KB, but extracts to 2MB
+	project := testTarball(t, map[string]string{
+		"project.mml": `{"Stylesheet": ["style.mss"]}`,
+		"style.mss":   strings.Repeat(" ", 2<<20),
+	})
+	if len(project) > int(s.maxBodySize) {
+		t.Fatal("tarball larger than max body size", len(project))
+	}
+	code, _ := postBuild(t, s, "/build", "application/gzip", project)
+	if code != 400 {
+		t.Error("expected error for large project", code)
+	}
+	if dirs, _ := ioutil.ReadDir(s.projectsDir); len(dirs) != 0 {
+		t.Error("large project not removed", len(dirs))
+	}
+}
+
+func TestServeAPIProjectFilesOutside(t *testing.T) {
+	s := newTestAPIServer(t, "")
+	defer os.RemoveAll(s.projectsDir)
+	defer s.cache.ClearAll()
+
+	outside, err := ioutil.TempFile("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside.WriteString("#secret { line-width: 1 }")
+	outside.Close()
+	defer os.Remove(outside.Name())
+
+	for _, files := range []map[string]string{
+		{"project.mml": `{"Stylesheet": ["` + outside.Name() + `"]}`},
+		{"project.mml": `{"Stylesheet": ["../../x.mss"]}`},
+		{"project.mml": `{"extends": "` + outside.Name() + `"}`},
+		{"project.mml": `{"extends": "base/base.mml"}`, "base/base.mml": `{"extends": "../../x.mml"}`},
+		{"project.mml": `{"extends": "base/base.mml"}`, "base/base.mml": `{"Stylesheet": ["../../x.mss"]}`},
+	} {
+		code, resp := postBuild(t, s, "/build", "application/gzip", testTarball(t, files))
+		if code != 400 {
+			t.Error("expected error for files outside of project", files, code, resp)
+		}
+	}
+
+	code, resp := postBuild(t, s, "/build", "application/gzip", testTarball(t, map[string]string{
+		"project.mml":    `{"extends": "base/base.mml", "Stylesheet": ["base/roads.mss"]}`,
+		"base/base.mml":  `{"Stylesheet": ["../style.mss"]}`,
+		"style.mss":      ``,
+		"base/roads.mss": ``,
+	}))
+	if code != 200 {
+		t.Error("unexpected error for files inside of project", code, resp)
+	}
+}
+
+func TestServeAPIEvictInUse(t *testing.T) {
+	s := newTestAPIServer(t, "")
+	defer os.RemoveAll(s.projectsDir)
+	defer s.cache.ClearAll()
+
+	project := map[string]string{"project.mml": `{}`}
+	mml, release, err := s.extractProject(testTarball(t, project), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		project["p.mss"] = strings.Repeat(" ", i)
+		code, resp := postBuild(t, s, "/build", "application/gzip", testTarball(t, project))
+		if code != 200 {
+			t.Fatal(code, resp)
+		}
+	}
+	if _, err := os.Stat(mml); err != nil {
+		t.Fatal("project in use evicted", err)
+	}
+	release()
+	code, resp := postBuild(t, s, "/build", "application/gzip", testTarball(t, map[string]string{"project.mml": `{"name": "new"}`}))
+	if code != 200 {
+		t.Fatal(code, resp)
+	}
+	if _, err := os.Stat(mml); !os.IsNotExist(err) {
+		t.Error("released project not evicted", err)
+	}
+	if len(s.inUse) != 0 {
+		t.Error("unexpected projects in use", s.inUse)
+	}
+}
+
+func TestServeAPIFileReference(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "project.mml"), []byte(`{"Stylesheet": ["roads.mss"], "Layer": [
+		{"name": "roads", "geometry": "linestring", "Datasource": {"type": "shape", "file": "roads.shp"}}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "roads.mss"), []byte(`@width: 1;
+#roads { line-width: @width; }`), 0644)
+
+	s := newTestAPIServer(t, dir)
+	defer os.RemoveAll(s.projectsDir)
+	defer s.cache.ClearAll()
+
+	code, resp := postBuild(t, s, "/build", "application/json", []byte(`{"mml": "project.mml", "builder": "mapserver"}`))
+	if code != 200 || !strings.Contains(resp.Style, "LAYER") {
+		t.Error("unexpected response", code, resp)
+	}
+	if len(resp.Diagnostics) != 0 {
+		t.Error("unexpected diagnostics", resp.Diagnostics)
+	}
+	code, resp = postBuild(t, s, "/build?var=width=3", "application/json", []byte(`{"mml": "project.mml", "builder": "mapnik3"}`))
+	if code != 200 || !strings.Contains(resp.Style, `stroke-width="3"`) {
+		t.Error("unexpected response", code, resp)
+	}
+	if len(resp.Diagnostics) != 1 || !strings.Contains(resp.Diagnostics[0], "variable @width: 3 (override, roads.mss:1)") {
+		t.Errorf("unexpected diagnostics %#v", resp.Diagnostics)
+	}
+	if code, _ := postBuild(t, s, "/build?var=width", "application/json", []byte(`{"mml": "project.mml"}`)); code != 400 {
+		t.Error("expected error for invalid var", code)
+	}
+	if code, _ := postBuild(t, s, "/build", "application/json", []byte(`{"mml": "../project.mml"}`)); code != 400 {
+		t.Error("expected error for file outside styles dir", code)
+	}
+	if code, _ := postBuild(t, s, "/build", "application/json", []byte(`{"mml": "project.mml", "builder": "foo"}`)); code != 400 {
+		t.Error("expected error for unknown builder", code)
+	}
+}
+
+func TestProjectPath(t *testing.T) {
+	dir := filepath.Join("projects", "1")
+	for _, tc := range []struct {
+		name string
+		want string
+	}{
+		{"project.mml", filepath.Join(dir, "project.mml")},
+		{"styles/roads.mss", filepath.Join(dir, "styles", "roads.mss")},
+		{`styles\roads.mss`, filepath.Join(dir, "styles", "roads.mss")},
+		{"/etc/passwd", filepath.Join(dir, "etc", "passwd")},
+		{"../../etc/passwd", filepath.Join(dir, "etc", "passwd")},
+		{`..\..\etc\passwd`, filepath.Join(dir, "etc", "passwd")},
+		{`C:\..\x`, filepath.Join(dir, "x")},
+		{`C:\windows\win.ini`, filepath.Join(dir, "C:", "windows", "win.ini")},
+		{"..", dir},
+	} {
+		if got := projectPath(dir, tc.name); got != tc.want {
+			t.Errorf("%q: %q != %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// layerStats are the complexity metrics of a single layer.
+type layerStats struct {
+	name       string
+	rules      int // evaluated MSS rules
+	filters    int // filters of all rules
+	maxFilters int // filters of the most complex rule
+	// mapnikRules and xmlSize of all styles of the layer
+	mapnikRules int
+	xmlSize     int
+}
+
+// statsMap collects the evaluated rules of each layer before they are added
+// to the Mapnik map.
+type statsMap struct {
+	*mapnik.Map
+	layers []layerStats
+}
+
+func (s *statsMap) AddLayer(l mml.Layer, rules []mss.Rule) {
+	st := layerStats{name: l.Name, rules: len(rules)}
+	for _, r := range rules {
+		st.filters += len(r.Filters)
+		if len(r.Filters) > st.maxFilters {
+			st.maxFilters = len(r.Filters)
+		}
+	}
+	s.layers = append(s.layers, st)
+	s.Map.AddLayer(l, rules)
+}
+
+// stats returns the layerStats of all layers, including the number of rules
+// and the size of the generated Mapnik XML.
+func (s *statsMap) stats() ([]layerStats, error) {
+	mapnikStats, err := s.Map.LayerStats()
+	if err != nil {
+		return nil, err
+	}
+	if len(mapnikStats) != len(s.layers) {
+		return nil, fmt.Errorf("got stats for %d of %d layers", len(mapnikStats), len(s.layers))
+	}
+	result := make([]layerStats, len(s.layers))
+	for i, st := range s.layers {
+		st.mapnikRules = mapnikStats[i].Rules
+		st.xmlSize = mapnikStats[i].Size
+		result[i] = st
+	}
+	return result, nil
+}
+
+func fmtSize(size int) string {
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	if size < 1024*1024 {
+		return fmt.Sprintf("%.1fkB", float64(size)/1024)
+	}
+	return fmt.Sprintf("%.1fMB", float64(size)/1024/1024)
+}
+
+// writeStats writes a table with the stats of all layers and the top layers
+// by number of Mapnik rules and by XML size.
+func writeStats(w io.Writer, layers []layerStats, top int) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "layer\trules\tfilters\tmax filters\tmapnik rules\txml size\t")
+	total := layerStats{name: "total"}
+	for _, l := range layers {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t\n", l.name, l.rules, l.filters, l.maxFilters, l.mapnikRules, fmtSize(l.xmlSize))
+		total.rules += l.rules
+		total.filters += l.filters
+		if l.maxFilters > total.maxFilters {
+			total.maxFilters = l.maxFilters
+		}
+		total.mapnikRules += l.mapnikRules
+		total.xmlSize += l.xmlSize
+	}
+	fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t\n", total.name, total.rules, total.filters, total.maxFilters, total.mapnikRules, fmtSize(total.xmlSize))
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if top <= 0 || len(layers) == 0 {
+		return nil
+	}
+	writeTop := func(title string, value func(layerStats) int, format func(int) string) {
+		sorted := make([]layerStats, len(layers))
+		copy(sorted, layers)
+		sort.SliceStable(sorted, func(i, j int) bool { return value(sorted[i]) > value(sorted[j]) })
+		if len(sorted) > top {
+			sorted = sorted[:top]
+		}
+		sum := value(total)
+		fmt.Fprintf(w, "\ntop %d layers by %s:\n", len(sorted), title)
+		for i, l := range sorted {
+			percent := 0.0
+			if sum > 0 {
+				percent = float64(value(l)) / float64(sum) * 100
+			}
+			fmt.Fprintf(w, "%3d. %s: %s (%.1f%%)\n", i+1, l.name, format(value(l)), percent)
+		}
+	}
+	writeTop("mapnik rules", func(l layerStats) int { return l.mapnikRules }, func(v int) string { return fmt.Sprint(v) })
+	writeTop("xml size", func(l layerStats) int { return l.xmlSize }, fmtSize)
+	return nil
+}
+
+func statsCmd(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	mmlFilename := flags.String("mml", "", "mml file")
+	var mssFilenames files
+	flags.Var(&mssFilenames, "mss", "mss file")
+	defs := defines{}
+	flags.Var(defs, "define", "set flag for @if conditions, can be repeated. target is set to the -builder")
+	confFile := flags.String("config", "", "config")
+	builderType := flags.String("builder", "mapnik2", "builder type {mapnik2,mapnik3}")
+	deferEval := flags.Bool("deferred-eval", false, "defer variable/expression evaluation to the end")
+	removeDeadRules := flags.Bool("remove-dead-rules", false, "remove rules that never match before counting")
+	mergeRules := flags.Bool("merge-rules", false, "merge adjacent rules before counting")
+	top := flags.Int("top", 5, "number of layers to highlight")
+	flags.Parse(args)
+
+	conf := config.Magnacarto{}
+	if *confFile != "" {
+		if err := conf.Load(*confFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	// only the size of the XML is relevant
+	conf.Datasources.NoCheckFiles = true
+
+	m := &statsMap{Map: mapnik.New(conf.Locator())}
+	switch *builderType {
+	case "mapnik2":
+		m.SetMapnik2(true)
+	case "mapnik3":
+	default:
+		log.Fatal("unknown -builder ", *builderType)
+	}
+	m.SetCartoCompat(conf.CartoCompat)
+
+	b := builder.New(m)
+	if *deferEval || conf.DeferEval {
+		b.EnableDeferredEval()
+	}
+	if *removeDeadRules {
+		b.EnableDeadRuleElimination()
+	}
+	if *mergeRules {
+		b.EnableRuleMerging()
+	}
+	b.SetMML(*mmlFilename)
+	b.Define("target", *builderType)
+	for name, value := range defs {
+		b.Define(name, value)
+	}
+	for _, mss := range mssFilenames {
+		b.AddMSS(mss)
+	}
+	if err := b.Build(); err != nil {
+		log.Fatal("error building map: ", err)
+	}
+
+	layers, err := m.stats()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeStats(os.Stdout, layers, *top); err != nil {
+		log.Fatal(err)
+	}
+}
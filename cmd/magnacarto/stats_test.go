@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/config"
+)
+
+func TestStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"project.mml": `{"Stylesheet": ["style.mss"], "Layer": [
+			{"name": "roads", "geometry": "linestring", "Datasource": {"type": "postgis", "table": "roads"}},
+			{"name": "water", "geometry": "polygon", "Datasource": {"type": "postgis", "table": "water"}}
+		]}`,
+		"style.mss": `
+			#roads[type='primary'][tunnel='no'] { line-width: 2; }
+			#roads[zoom>=10][type='secondary'] { line-width: 1; }
+			#water { polygon-fill: blue; }
+		`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := config.Magnacarto{}
+	m := &statsMap{Map: mapnik.New(conf.Locator())}
+	b := builder.New(m)
+	b.SetMML(filepath.Join(dir, "project.mml"))
+	if err := b.Build(); err != nil {
+		t.Fatal(err)
+	}
+	layers, err := m.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatal("unexpected layers", layers)
+	}
+	roads := layers[0]
+	if roads.name != "roads" || roads.rules != 2 || roads.filters != 3 || roads.maxFilters != 2 || roads.mapnikRules != 2 {
+		t.Errorf("unexpected stats %#v", roads)
+	}
+	if layers[1].xmlSize == 0 || layers[1].xmlSize >= roads.xmlSize {
+		t.Errorf("unexpected xml sizes %d %d", roads.xmlSize, layers[1].xmlSize)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeStats(buf, layers, 1); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, e := range []string{
+		"mapnik rules",
+		"total      3        3            2             3",
+		"top 1 layers by mapnik rules:\n  1. roads: 2 (66.7%)",
+		"top 1 layers by xml size:\n  1. roads:",
+	} {
+		if !strings.Contains(out, e) {
+			t.Errorf("%q not found in\n%s", e, out)
+		}
+	}
+}
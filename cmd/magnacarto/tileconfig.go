@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/omniscale/magnacarto/mml"
+)
+
+// tileConfig are the parameters of a tile server configuration for a built
+// Mapnik style. All tile configs use the spherical mercator grid
+// (EPSG:3857), like the Mapnik builder.
+type tileConfig struct {
+	// Name of the tileset, used as layer, cache and URL name
+	Name string
+	// Style is the absolute path of the Mapnik XML
+	Style    string
+	TileSize int
+	MinZoom  int
+	MaxZoom  int
+	// Bounds in EPSG:4326 (minx, miny, maxx, maxy)
+	Bounds [4]float64
+}
+
+// webMercatorBounds are the bounds of the spherical mercator grid in
+// EPSG:4326.
+var webMercatorBounds = [4]float64{-180, -85.0511287798, 180, 85.0511287798}
+
+var nameRe = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// newTileConfig returns the tileConfig for style, with the name, bounds and
+// zoom levels from the MML (defaults to the whole world and 0-18).
+func newTileConfig(mmlFile, style string, tileSize int) (tileConfig, error) {
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		return tileConfig{}, err
+	}
+	style, err = filepath.Abs(style)
+	if err != nil {
+		return tileConfig{}, err
+	}
+	name := strings.TrimSuffix(filepath.Base(mmlFile), filepath.Ext(mmlFile))
+	if name == "project" {
+		// default name of all projects, use the project dir instead
+		abs, err := filepath.Abs(mmlFile)
+		if err != nil {
+			return tileConfig{}, err
+		}
+		name = filepath.Base(filepath.Dir(abs))
+	}
+	name = strings.Trim(nameRe.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		name = "map"
+	}
+
+	c := tileConfig{
+		Name:     name,
+		Style:    style,
+		TileSize: tileSize,
+		MaxZoom:  18,
+		Bounds:   webMercatorBounds,
+	}
+	if m.MinZoom != nil {
+		c.MinZoom = *m.MinZoom
+	}
+	if m.MaxZoom != nil {
+		c.MaxZoom = *m.MaxZoom
+	}
+	if m.Bounds != nil {
+		c.Bounds = *m.Bounds
+	}
+	if c.MinZoom < 0 || c.MinZoom > c.MaxZoom {
+		return tileConfig{}, fmt.Errorf("invalid zoom levels %d-%d in %s", c.MinZoom, c.MaxZoom, mmlFile)
+	}
+	return c, nil
+}
+
+// tileConfigFormats are all supported tile servers with the suffix of their
+// config file.
+var tileConfigFormats = map[string]string{
+	"renderd":    "-renderd.conf",
+	"mapproxy":   "-mapproxy.yaml",
+	"tilestache": "-tilestache.cfg",
+}
+
+// tileConfigList collects the -tile-config formats, comma separated or
+// repeated.
+type tileConfigList []string
+
+func (l *tileConfigList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *tileConfigList) Set(value string) error {
+	for _, f := range strings.Split(value, ",") {
+		if _, ok := tileConfigFormats[f]; !ok {
+			return fmt.Errorf("unknown tile config %q, expected renderd, mapproxy or tilestache", f)
+		}
+		*l = append(*l, f)
+	}
+	return nil
+}
+
+// tileConfigFile returns the file name of the config in format for style
+// (e.g. style-renderd.conf for style.xml).
+func tileConfigFile(style, format string) string {
+	return strings.TrimSuffix(style, filepath.Ext(style)) + tileConfigFormats[format]
+}
+
+// writeTileConfigs writes the config of each format next to the style.
+func writeTileConfigs(c tileConfig, formats []string) error {
+	for _, format := range formats {
+		buf := &bytes.Buffer{}
+		if err := c.write(buf, format); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(tileConfigFile(c.Style, format), buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c tileConfig) write(buf *bytes.Buffer, format string) error {
+	switch format {
+	case "renderd":
+		return renderdTmpl.Execute(buf, c)
+	case "mapproxy":
+		return mapproxyTmpl.Execute(buf, c)
+	case "tilestache":
+		return c.writeTileStache(buf)
+	}
+	return fmt.Errorf("unknown tile config %q", format)
+}
+
+var tmplFuncs = template.FuncMap{
+	// quote returns v as JSON string, which is also a valid YAML string
+	"quote": func(v string) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"add": func(a, b int) int { return a + b },
+}
+
+var renderdTmpl = template.Must(template.New("renderd").Funcs(tmplFuncs).Parse(`; renderd/mod_tile map section for {{.Name}}, generated by magnacarto.
+; Add to renderd.conf and restart renderd. Tiles are served below /{{.Name}}/.
+; Pre-render all tiles with: render_list -a -m {{.Name}} -z {{.MinZoom}} -Z {{.MaxZoom}}
+; Bounds (EPSG:4326): {{index .Bounds 0}},{{index .Bounds 1}},{{index .Bounds 2}},{{index .Bounds 3}}
+[{{.Name}}]
+URI=/{{.Name}}/
+TILEDIR=/var/lib/mod_tile
+XML={{.Style}}
+HOST=localhost
+TILESIZE={{.TileSize}}
+MINZOOM={{.MinZoom}}
+MAXZOOM={{.MaxZoom}}
+`))
+
+var mapproxyTmpl = template.Must(template.New("mapproxy").Funcs(tmplFuncs).Parse(`# MapProxy configuration for {{.Name}}, generated by magnacarto.
+# Seed levels {{.MinZoom}}-{{.MaxZoom}} with mapproxy-seed and this seed.yaml:
+#
+# seeds:
+#   {{.Name}}:
+#     caches: [{{.Name}}_cache]
+#     levels:
+#       from: {{.MinZoom}}
+#       to: {{.MaxZoom}}
+#     coverages: [{{.Name}}]
+# coverages:
+#   {{.Name}}:
+#     bbox: [{{index .Bounds 0}}, {{index .Bounds 1}}, {{index .Bounds 2}}, {{index .Bounds 3}}]
+#     srs: 'EPSG:4326'
+
+services:
+  demo:
+  tms:
+    use_grid_names: true
+    origin: nw
+  wmts:
+  wms:
+    md:
+      title: {{quote .Name}}
+
+layers:
+  - name: {{quote .Name}}
+    title: {{quote .Name}}
+    sources: [{{.Name}}_cache]
+
+caches:
+  {{.Name}}_cache:
+    grids: [{{.Name}}_grid]
+    sources: [{{.Name}}_mapnik]
+    meta_size: [4, 4]
+    meta_buffer: 64
+
+sources:
+  {{.Name}}_mapnik:
+    type: mapnik
+    mapfile: {{quote .Style}}
+    transparent: true
+    coverage:
+      bbox: [{{index .Bounds 0}}, {{index .Bounds 1}}, {{index .Bounds 2}}, {{index .Bounds 3}}]
+      srs: 'EPSG:4326'
+
+grids:
+  {{.Name}}_grid:
+    base: GLOBAL_WEBMERCATOR
+    tile_size: [{{.TileSize}}, {{.TileSize}}]
+    num_levels: {{add .MaxZoom 1}}
+`))
+
+// writeTileStache writes a TileStache configuration with a disk cache.
+func (c tileConfig) writeTileStache(buf *bytes.Buffer) error {
+	conf := map[string]interface{}{
+		"cache": map[string]interface{}{
+			"name": "Disk",
+			"path": "/tmp/tilestache",
+		},
+		"layers": map[string]interface{}{
+			c.Name: map[string]interface{}{
+				"provider": map[string]interface{}{
+					"name":    "mapnik",
+					"mapfile": c.Style,
+				},
+				"projection":  "spherical mercator",
+				"tile height": c.TileSize,
+				"metatile": map[string]interface{}{
+					"rows":    4,
+					"columns": 4,
+					"buffer":  64,
+				},
+				"bounds": map[string]interface{}{
+					"low":   c.MinZoom,
+					"high":  c.MaxZoom,
+					"west":  c.Bounds[0],
+					"south": c.Bounds[1],
+					"east":  c.Bounds[2],
+					"north": c.Bounds[3],
+				},
+			},
+		},
+	}
+	b, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	buf.WriteByte('\n')
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTileConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mmlFile := filepath.Join(dir, "osm-de", "project.mml")
+	if err := os.Mkdir(filepath.Dir(mmlFile), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"bounds": [5.8, 47.2, 15.1, 55.1], "minzoom": 4, "maxzoom": 16, "Layer": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	style := filepath.Join(dir, "style.xml")
+	c, err := newTileConfig(mmlFile, style, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := tileConfig{Name: "osm_de", Style: style, TileSize: 512, MinZoom: 4, MaxZoom: 16, Bounds: [4]float64{5.8, 47.2, 15.1, 55.1}}
+	if c != expected {
+		t.Fatalf("unexpected config %#v", c)
+	}
+
+	var formats tileConfigList
+	if err := formats.Set("renderd,mapproxy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := formats.Set("tilestache"); err != nil {
+		t.Fatal(err)
+	}
+	if err := formats.Set("tilecache"); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if err := writeTileConfigs(c, formats); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	renderd := read("style-renderd.conf")
+	for _, e := range []string{"[osm_de]\n", "XML=" + style + "\n", "TILESIZE=512\n", "MINZOOM=4\n", "MAXZOOM=16\n"} {
+		if !strings.Contains(renderd, e) {
+			t.Errorf("%q not found in\n%s", e, renderd)
+		}
+	}
+	mapproxy := read("style-mapproxy.yaml")
+	for _, e := range []string{
+		"    mapfile: \"" + style + "\"\n",
+		"      bbox: [5.8, 47.2, 15.1, 55.1]\n",
+		"    tile_size: [512, 512]\n",
+		"    num_levels: 17\n",
+		"#       from: 4\n",
+	} {
+		if !strings.Contains(mapproxy, e) {
+			t.Errorf("%q not found in\n%s", e, mapproxy)
+		}
+	}
+	var tilestache struct {
+		Layers map[string]struct {
+			Provider   struct{ Name, Mapfile string }
+			TileHeight int `json:"tile height"`
+			Bounds     struct {
+				Low, High                int
+				North, West, South, East float64
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(read("style-tilestache.cfg")), &tilestache); err != nil {
+		t.Fatal(err)
+	}
+	l := tilestache.Layers["osm_de"]
+	if l.Provider.Name != "mapnik" || l.Provider.Mapfile != style || l.TileHeight != 512 || l.Bounds.Low != 4 || l.Bounds.High != 16 || l.Bounds.North != 55.1 {
+		t.Errorf("unexpected TileStache layer %#v", l)
+	}
+
+	if err := ioutil.WriteFile(mmlFile, []byte(`{"minzoom": 10, "maxzoom": 8, "Layer": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTileConfig(mmlFile, style, 256); err == nil {
+		t.Error("expected error for invalid zoom levels")
+	}
+}
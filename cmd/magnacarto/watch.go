@@ -0,0 +1,70 @@
+package main
+
+import (
+	"time"
+
+	"gopkg.in/fsnotify.v1"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+// debounce collects multiple file events (e.g. from editors that save
+// multiple files) into a single rebuild.
+const debounce = 200 * time.Millisecond
+
+// watchFiles calls rebuild once and again after each change of the MML or
+// MSS files. MSS files are read from the MML if mssFiles is empty.
+func watchFiles(mmlFile string, mssFiles []string, rebuild func(), logger *logging.Logger) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	watchAll := func() error {
+		files := append([]string{mmlFile}, mssFiles...)
+		stylesheets, baseFiles, err := builder.ProjectFiles(mmlFile)
+		if err != nil {
+			return err
+		}
+		if len(mssFiles) == 0 {
+			files = append(files, stylesheets...)
+		}
+		files = append(files, baseFiles...)
+		for _, f := range files {
+			if err := watcher.Add(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := watcher.Add(mmlFile); err != nil {
+		return err
+	}
+	if err := watchAll(); err != nil {
+		logger.Warn("unable to watch files", "err", err)
+	}
+
+	rebuild()
+	logger.Info("watching for changes", "mml", mmlFile)
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case evt := <-watcher.Events:
+			logger.Debug("file changed", "file", evt.Name, "op", evt.Op)
+			timer = time.After(debounce)
+		case err := <-watcher.Errors:
+			logger.Warn("watcher error", "err", err)
+		case <-timer:
+			timer = nil
+			// atomic saves of some editors remove the file from the
+			// watcher, and the MML can reference new MSS files
+			if err := watchAll(); err != nil {
+				logger.Warn("unable to watch files", "err", err)
+			}
+			rebuild()
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// envPrefix of the environment variables for all flags, e.g.
+// MAGNASERV_STYLES_DIR for -styles-dir.
+const envPrefix = "MAGNASERV_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// setFlagsFromEnv sets all flags of fs from the environment. Needs to be
+// called before fs.Parse, so that command line arguments take precedence.
+func setFlagsFromEnv(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		if v, ok := lookupEnv(envName(f.Name)); ok {
+			if e := fs.Set(f.Name, v); e != nil {
+				err = fmt.Errorf("invalid %s: %s", envName(f.Name), e)
+			}
+		}
+	})
+	return err
+}
+
+// pathList is a flag.Value for a list of paths, separated by the
+// os.PathListSeparator.
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, string(filepath.ListSeparator))
+}
+
+func (p *pathList) Set(v string) error {
+	*p = nil
+	for _, path := range filepath.SplitList(v) {
+		if path != "" {
+			*p = append(*p, path)
+		}
+	}
+	return nil
+}
+
+// overrideHost returns addr with the host replaced by host, if set.
+func overrideHost(addr, host string) (string, error) {
+	if host == "" {
+		return addr, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	listen := fs.String("listen", "localhost:7070", "")
+	stylesDir := fs.String("styles-dir", "", "")
+	colors := fs.Int("png-colors", 256, "")
+	var fontDirs pathList
+	fs.Var(&fontDirs, "font-dirs", "")
+
+	env := map[string]string{
+		"MAGNASERV_LISTEN":     ":8080",
+		"MAGNASERV_STYLES_DIR": "/styles",
+		"MAGNASERV_FONT_DIRS":  "/fonts:/usr/share/fonts",
+	}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+	if err := setFlagsFromEnv(fs, lookup); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Parse([]string{"-styles-dir", "/other"}); err != nil {
+		t.Fatal(err)
+	}
+	if *listen != ":8080" {
+		t.Error("unexpected listen", *listen)
+	}
+	if *stylesDir != "/other" {
+		t.Error("command line does not override env", *stylesDir)
+	}
+	if *colors != 256 {
+		t.Error("unexpected colors", *colors)
+	}
+	if !reflect.DeepEqual([]string(fontDirs), []string{"/fonts", "/usr/share/fonts"}) {
+		t.Error("unexpected font dirs", fontDirs)
+	}
+
+	env = map[string]string{"MAGNASERV_PNG_COLORS": "many"}
+	if err := setFlagsFromEnv(fs, lookup); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
+
+func TestOverrideHost(t *testing.T) {
+	for _, tc := range []struct {
+		addr, host, want string
+	}{
+		{"localhost:7070", "", "localhost:7070"},
+		{"localhost:7070", "0.0.0.0", "0.0.0.0:7070"},
+		{":8080", "::", "[::]:8080"},
+	} {
+		got, err := overrideHost(tc.addr, tc.host)
+		if err != nil || got != tc.want {
+			t.Error(tc, got, err)
+		}
+	}
+	if _, err := overrideHost("localhost", "0.0.0.0"); err == nil {
+		t.Error("expected error for address without port")
+	}
+}
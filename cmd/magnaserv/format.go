@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// supportedFormats in order of preference, if the client accepts multiple
+// formats with the same quality.
+var supportedFormats = []string{"image/webp", "image/png", "image/jpeg"}
+
+var formatAliases = map[string]string{
+	"webp": "image/webp",
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"jpg":  "image/jpeg",
+	"avif": "image/avif",
+}
+
+// negotiateFormat returns the mime type of the image format to render.
+// An explicit format takes precedence over the Accept header. Falls back to
+// PNG if the client does not accept any supported format.
+func negotiateFormat(format, accept string) (string, error) {
+	if format != "" {
+		format = strings.ToLower(format)
+		if alias, ok := formatAliases[format]; ok {
+			format = alias
+		}
+		if format == "image/avif" {
+			return "", fmt.Errorf("AVIF is not supported, use one of %s", strings.Join(supportedFormats, ", "))
+		}
+		for _, f := range supportedFormats {
+			if f == format {
+				return f, nil
+			}
+		}
+		return "", fmt.Errorf("unsupported format %s", format)
+	}
+
+	type candidate struct {
+		format string
+		q      float64
+		pref   int
+	}
+	var candidates []candidate
+	for pref, f := range supportedFormats {
+		if q := acceptQuality(accept, f); q > 0 {
+			candidates = append(candidates, candidate{f, q, pref})
+		}
+	}
+	if len(candidates) == 0 {
+		return "image/png", nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].q == candidates[j].q {
+			return candidates[i].pref < candidates[j].pref
+		}
+		return candidates[i].q > candidates[j].q
+	})
+	return candidates[0].format, nil
+}
+
+// acceptQuality returns the q value of mimeType in the Accept header. Exact
+// matches take precedence over image/* and */*. Wildcards only match PNG, as
+// clients are not required to support all image formats.
+func acceptQuality(accept, mimeType string) float64 {
+	q := 0.0
+	matched := 0 // 2 exact, 1 wildcard
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mt := strings.ToLower(strings.TrimSpace(fields[0]))
+		var m int
+		switch {
+		case mt == mimeType:
+			m = 2
+		case (mt == "image/*" || mt == "*/*") && mimeType == "image/png":
+			m = 1
+		default:
+			continue
+		}
+		pq := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					pq = v
+				}
+			}
+		}
+		if m > matched {
+			matched = m
+			q = pq
+		}
+	}
+	return q
+}
+
+// mapnikFormat returns the Mapnik format for mimeType.
+func mapnikFormat(mimeType string) string {
+	switch mimeType {
+	case "image/webp":
+		return "webp"
+	case "image/jpeg":
+		return "jpeg85"
+	default:
+		return "png"
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestNegotiateFormat(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		accept string
+		want   string
+		err    bool
+	}{
+		{"", "", "image/png", false},
+		{"", "*/*", "image/png", false},
+		{"", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "image/webp", false},
+		{"", "image/webp;q=0.5,image/png", "image/png", false},
+		{"", "image/jpeg", "image/jpeg", false},
+		{"", "image/png;q=0.5,image/jpeg;q=0.5", "image/png", false},
+		{"", "image/png;q=0,image/jpeg;q=0.1", "image/jpeg", false},
+		{"", "image/gif", "image/png", false},
+		{"", "image/*;q=0.5,image/png", "image/png", false},
+		{"", "image/avif", "image/png", false},
+		{"png", "image/webp", "image/png", false},
+		{"image/webp", "", "image/webp", false},
+		{"JPG", "", "image/jpeg", false},
+		{"avif", "", "", true},
+		{"image/gif", "", "", true},
+	} {
+		got, err := negotiateFormat(tc.format, tc.accept)
+		if tc.err {
+			if err == nil {
+				t.Errorf("expected error for %q/%q", tc.format, tc.accept)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q/%q: %s", tc.format, tc.accept, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q/%q: got %s, want %s", tc.format, tc.accept, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/preview"
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/render"
+)
+
+// thumbnails caches the rendered thumbnails of all projects. Thumbnails are
+// rendered with the same bbox for all projects, so that styles can be
+// compared, and they are rendered again when the style changes.
+type thumbnails struct {
+	bbox [4]float64
+	size int
+
+	mu sync.Mutex
+	// thumbnails by absolute MML path
+	images map[string]thumbnail
+}
+
+type thumbnail struct {
+	styleFile string
+	modTime   time.Time
+	png       []byte
+	etag      string
+}
+
+func newThumbnails(bbox [4]float64, size int) *thumbnails {
+	return &thumbnails{bbox: bbox, size: size, images: make(map[string]thumbnail)}
+}
+
+type galleryProject struct {
+	MML         string `json:"mml"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Thumbnail   string `json:"thumbnail,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// gallery lists all projects of the styles dir as JSON, with name,
+// description and the URL of their thumbnail. Missing or outdated
+// thumbnails are rendered before the response, so that clients can load all
+// thumbnails from the cache. Projects that fail to build are listed with
+// their error.
+func (s *magnaserv) gallery(w http.ResponseWriter, r *http.Request) {
+	files, err := findProjects(s.stylesDir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	projects := []galleryProject{}
+	for _, mmlFile := range files {
+		rel, _ := filepath.Rel(s.stylesDir, mmlFile)
+		rel = filepath.ToSlash(rel)
+		p := galleryProject{MML: rel, Name: rel}
+		if m, err := mml.Load(mmlFile); err != nil {
+			p.Error = err.Error()
+			projects = append(projects, p)
+			continue
+		} else if m.Name != "" {
+			p.Name = m.Name
+			p.Description = m.Description
+		}
+		t, err := s.thumbnail(r.Context(), mmlFile)
+		if err == context.Canceled {
+			return
+		}
+		if err != nil {
+			p.Error = err.Error()
+		} else {
+			// the etag changes with the style, clients can cache thumbnails
+			p.Thumbnail = s.basePath() + "api/gallery/thumbnail?" + url.Values{"mml": {rel}, "v": {t.etag}}.Encode()
+		}
+		projects = append(projects, p)
+	}
+	s.thumbnails.retain(files)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"projects": projects})
+}
+
+// galleryThumbnail serves the PNG thumbnail of a single project.
+func (s *magnaserv) galleryThumbnail(w http.ResponseWriter, r *http.Request) {
+	mmlFile, err := s.stylePath(r.URL.Query().Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := os.Stat(mmlFile); err != nil {
+		http.Error(w, "project not found", http.StatusNotFound)
+		return
+	}
+	t, err := s.thumbnail(r.Context(), mmlFile)
+	if err == context.Canceled {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(t.png)))
+	w.Header().Set("ETag", `"`+t.etag+`"`)
+	if r.URL.Query().Get("v") == t.etag {
+		w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if r.Header.Get("If-None-Match") == `"`+t.etag+`"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(t.png)
+}
+
+// thumbnail returns the thumbnail of mmlFile. The thumbnail is rendered if
+// it is missing or if the style changed.
+func (s *magnaserv) thumbnail(ctx context.Context, mmlFile string) (thumbnail, error) {
+	var mapMaker builder.MapMaker = mapnik.Maker2
+	if !render.MapnikAvailable {
+		mapMaker = preview.Maker
+	}
+	styleFile, err := s.builder.StyleFile(mapMaker, mmlFile, nil)
+	if err != nil {
+		return thumbnail{}, err
+	}
+	fi, err := os.Stat(styleFile)
+	if err != nil {
+		return thumbnail{}, err
+	}
+
+	s.thumbnails.mu.Lock()
+	t, ok := s.thumbnails.images[mmlFile]
+	s.thumbnails.mu.Unlock()
+	if ok && t.styleFile == styleFile && t.modTime.Equal(fi.ModTime()) {
+		return t, nil
+	}
+
+	mapReq := render.Request{
+		Width:    s.thumbnails.size,
+		Height:   s.thumbnails.size,
+		BBOX:     s.thumbnails.bbox,
+		EPSGCode: 3857,
+		Format:   "png",
+	}
+	start := time.Now()
+	var b []byte
+	if mapMaker == preview.Maker {
+		b, err = render.Preview(styleFile, mapReq)
+	} else if s.workers != nil {
+		b, err = s.workers.Render(ctx, styleFile, mapReq)
+	} else {
+		b, err = render.MapnikContext(ctx, styleFile, mapReq)
+	}
+	if err != nil {
+		if err != context.Canceled {
+			s.metrics.errors.inc(s.project(mmlFile), "render")
+		}
+		return thumbnail{}, err
+	}
+	s.metrics.renderDuration.observeDuration(start, mapMaker.Type())
+	s.metrics.renders.inc(s.project(mmlFile), mapMaker.Type(), "image/png")
+
+	hash := sha256.Sum256(b)
+	t = thumbnail{styleFile: styleFile, modTime: fi.ModTime(), png: b, etag: hex.EncodeToString(hash[:8])}
+	s.thumbnails.mu.Lock()
+	s.thumbnails.images[mmlFile] = t
+	s.thumbnails.mu.Unlock()
+	return t, nil
+}
+
+// retain removes the thumbnails of all projects that are not in mmlFiles.
+func (t *thumbnails) retain(mmlFiles []string) {
+	keep := make(map[string]bool, len(mmlFiles))
+	for _, f := range mmlFiles {
+		keep[f] = true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for f := range t.images {
+		if !keep[f] {
+			delete(t.images, f)
+		}
+	}
+}
+
+// findProjects returns all MML files in dir and its sub dirs, sorted by
+// path. Hidden dirs (e.g. .git) are skipped.
+func findProjects(dir string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if path != dir && strings.HasPrefix(fi.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) == ".mml" {
+			files = append(files, path)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+func TestGallery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.mml":         `{"name": "Style A", "description": "red", "Stylesheet": ["a.mss"], "Layer": []}`,
+		"a.mss":         "Map { background-color: red; }",
+		"sub/b.mml":     `{"Stylesheet": ["b.mss"], "Layer": []}`,
+		"sub/b.mss":     "Map { background-color: blue; }",
+		"broken.mml":    `{"Stylesheet": [`,
+		".hidden/c.mml": `{"Stylesheet": [], "Layer": []}`,
+	}
+	for name, content := range files {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newMagnaserv(&config.Magnacarto{StylesDir: dir}, "", serverOptions{
+		logger:        logging.Default(),
+		metrics:       newServerMetrics(),
+		thumbnailSize: 64,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	gallery := func() []galleryProject {
+		w := httptest.NewRecorder()
+		s.gallery(w, httptest.NewRequest("GET", "/api/gallery", nil))
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		var result struct{ Projects []galleryProject }
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result.Projects
+	}
+	projects := gallery()
+
+	var names []string
+	for _, p := range projects {
+		names = append(names, p.Name)
+	}
+	if expected := []string{"Style A", "broken.mml", "sub/b.mml"}; !reflect.DeepEqual(names, expected) {
+		t.Fatal("unexpected projects", names)
+	}
+	if projects[0].MML != "a.mml" || projects[0].Description != "red" || projects[0].Thumbnail == "" || projects[0].Error != "" {
+		t.Errorf("unexpected project %#v", projects[0])
+	}
+	if projects[1].Error == "" || projects[1].Thumbnail != "" {
+		t.Errorf("expected error for %#v", projects[1])
+	}
+
+	w := httptest.NewRecorder()
+	s.galleryThumbnail(w, httptest.NewRequest("GET", projects[0].Thumbnail, nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" || w.Header().Get("Cache-Control") != "max-age=31536000, immutable" {
+		t.Fatal("unexpected response", w.Code, w.Header())
+	}
+	etag := w.Header().Get("ETag")
+
+	r := httptest.NewRequest("GET", "/api/gallery/thumbnail?mml=a.mml", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	s.galleryThumbnail(w, r)
+	if w.Code != 304 {
+		t.Error("unexpected status for cached thumbnail", w.Code)
+	}
+
+	// thumbnails are rendered again after style changes
+	time.Sleep(10 * time.Millisecond)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.mss"), []byte("Map { background-color: green; }"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if p := gallery()[0]; p.Thumbnail == projects[0].Thumbnail {
+		t.Error("thumbnail not updated", p.Thumbnail)
+	}
+
+	for _, mml := range []string{"missing.mml", "../a.mml"} {
+		w = httptest.NewRecorder()
+		s.galleryThumbnail(w, httptest.NewRequest("GET", "/api/gallery/thumbnail?mml="+mml, nil))
+		if w.Code != 404 && w.Code != 400 {
+			t.Error("unexpected status for", mml, w.Code)
+		}
+	}
+}
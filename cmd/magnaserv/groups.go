@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/omniscale/magnacarto/mml"
+)
+
+type groupInfo struct {
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	MinZoom int      `json:"minzoom"`
+	MaxZoom int      `json:"maxzoom"`
+	CompOp  string   `json:"comp-op,omitempty"`
+	Layers  []string `json:"layers"`
+}
+
+// groups lists all layer groups of an MML as JSON. Clients can toggle the
+// groups with the groups parameter of /api/map (e.g. groups=roads:off).
+func (s *magnaserv) groups(w http.ResponseWriter, r *http.Request) {
+	mmlFile, err := s.stylePath(r.URL.Query().Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	groups := []groupInfo{}
+	for _, g := range m.Groups {
+		status := "on"
+		if !g.Active {
+			status = "off"
+		}
+		groups = append(groups, groupInfo{
+			Name:    g.Name,
+			Status:  status,
+			MinZoom: g.MinZoom,
+			MaxZoom: g.MaxZoom,
+			CompOp:  g.CompOp,
+			Layers:  g.Layers,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"groups": groups})
+}
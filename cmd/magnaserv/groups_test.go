@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mml"), []byte(`{
+		"groups": [{"name": "labels", "status": "off", "minzoom": 10}],
+		"Layer": [
+			{"name": "roads", "group": "roads"},
+			{"name": "places", "group": "labels"},
+			{"name": "water"},
+			{"name": "roads-labels", "group": "labels"}
+		]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &magnaserv{stylesDir: dir}
+	w := httptest.NewRecorder()
+	s.groups(w, httptest.NewRequest("GET", "/api/groups?mml=test.mml", nil))
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	var resp struct{ Groups []groupInfo }
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	expected := []groupInfo{
+		{Name: "roads", Status: "on", MaxZoom: 30, Layers: []string{"roads"}},
+		{Name: "labels", Status: "off", MinZoom: 10, MaxZoom: 30, Layers: []string{"places", "roads-labels"}},
+	}
+	if !reflect.DeepEqual(resp.Groups, expected) {
+		t.Errorf("unexpected groups %#v", resp.Groups)
+	}
+
+	w = httptest.NewRecorder()
+	s.groups(w, httptest.NewRequest("GET", "/api/groups?mml=../test.mml", nil))
+	if w.Code != 400 {
+		t.Error("unexpected status", w.Code)
+	}
+}
+
+func TestParseVariant(t *testing.T) {
+	v, err := parseVariant(url.Values{"groups": {"roads:on,labels:off"}, "debug": {"true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Debug || !reflect.DeepEqual(v.GroupStatus, map[string]bool{"roads": true, "labels": false}) {
+		t.Errorf("unexpected variant %#v", v)
+	}
+	v, err = parseVariant(url.Values{"var": {"water=#a0c8f0", "width=2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v.Vars, map[string]string{"water": "#a0c8f0", "width": "2"}) {
+		t.Errorf("unexpected variant %#v", v)
+	}
+	for _, q := range []url.Values{{"groups": {"roads"}}, {"groups": {"roads:yes"}}, {"debug": {"x"}}, {"var": {"water"}}} {
+		if _, err := parseVariant(q); err == nil {
+			t.Error("expected error for", q)
+		}
+	}
+}
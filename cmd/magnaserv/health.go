@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// health implements the /healthz and /readyz endpoints.
+type health struct {
+	ready      int32
+	stylesDirs []string
+}
+
+func (h *health) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&h.ready, v)
+}
+
+// healthz reports whether the server is running.
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "ok\n")
+}
+
+// readyz reports whether the server is initialized, not shutting down and
+// whether all styles dirs are accessible.
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if atomic.LoadInt32(&h.ready) == 0 {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	for _, dir := range h.stylesDirs {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			http.Error(w, "styles dir not accessible", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	io.WriteString(w, "ok\n")
+}
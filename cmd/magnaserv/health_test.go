@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &health{stylesDirs: []string{dir}}
+	status := func(handler func(w *httptest.ResponseRecorder)) int {
+		w := httptest.NewRecorder()
+		handler(w)
+		return w.Code
+	}
+	healthz := func(w *httptest.ResponseRecorder) { h.healthz(w, httptest.NewRequest("GET", "/healthz", nil)) }
+	readyz := func(w *httptest.ResponseRecorder) { h.readyz(w, httptest.NewRequest("GET", "/readyz", nil)) }
+
+	if s := status(healthz); s != 200 {
+		t.Error("unexpected healthz status", s)
+	}
+	if s := status(readyz); s != 503 {
+		t.Error("ready before setReady", s)
+	}
+	h.setReady(true)
+	if s := status(readyz); s != 200 {
+		t.Error("not ready", s)
+	}
+	h.stylesDirs = append(h.stylesDirs, filepath.Join(dir, "missing"))
+	if s := status(readyz); s != 503 {
+		t.Error("ready without styles dir", s)
+	}
+	h.stylesDirs = h.stylesDirs[:1]
+	h.setReady(false)
+	if s := status(readyz); s != 503 {
+		t.Error("ready after shutdown", s)
+	}
+}
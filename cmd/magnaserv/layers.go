@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+
+	"github.com/omniscale/magnacarto/mml"
+)
+
+type layerInfo struct {
+	Name    string `json:"name"`
+	Group   string `json:"group,omitempty"`
+	Status  string `json:"status"`
+	MinZoom int    `json:"minzoom"`
+	MaxZoom int    `json:"maxzoom"`
+}
+
+// layers lists all layers of an MML in render order as JSON. editable is
+// true if the layers can be changed with /api/layers/order and
+// /api/layers/zoom.
+func (s *magnaserv) layers(w http.ResponseWriter, r *http.Request) {
+	mmlFile, err := s.stylePath(r.URL.Query().Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.writeLayers(w, mmlFile)
+}
+
+func (s *magnaserv) writeLayers(w http.ResponseWriter, mmlFile string) {
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	layers := []layerInfo{}
+	for _, l := range m.Layers {
+		status := "on"
+		if !l.Active {
+			status = "off"
+		}
+		layers = append(layers, layerInfo{
+			Name:    l.Name,
+			Group:   l.Group,
+			Status:  status,
+			MinZoom: l.MinZoom,
+			MaxZoom: l.MaxZoom,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"layers": layers, "editable": s.edit})
+}
+
+// editLayers handles POST requests that change the MML file. The style is
+// rebuild with the next map request, as the MML changed. Responds with the
+// new layer list.
+//
+// Requests need to be JSON (Content-Type: application/json), so that
+// browsers send a CORS preflight for cross-site requests, and requests with
+// an Origin of another host are rejected. Other web pages can not change
+// files on disk.
+func (s *magnaserv) editLayers(w http.ResponseWriter, r *http.Request, req interface{}, edit func(mmlFile string) error) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.edit {
+		http.Error(w, "editing disabled, start magnaserv with -edit", http.StatusForbidden)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r) {
+		http.Error(w, "cross-origin requests are not allowed", http.StatusForbidden)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		http.Error(w, "Content-Type application/json required", http.StatusUnsupportedMediaType)
+		return
+	}
+	mmlFile, err := s.stylePath(r.URL.Query().Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.editMu.Lock()
+	err = edit(mmlFile)
+	s.editMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	requestLogger(r).Info("changed layers", "mml", s.project(mmlFile), "path", r.URL.Path)
+	s.writeLayers(w, mmlFile)
+}
+
+// sameOrigin returns whether the Origin header is the host of r (or of the
+// reverse proxy in front of magnaserv).
+func sameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = fwd
+	}
+	return u.Host == host
+}
+
+// layerOrder changes the order of the layers, e.g. {"layers": ["water",
+// "roads", "places"]}. All layers of the MML need to be listed.
+func (s *magnaserv) layerOrder(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Layers []string `json:"layers"`
+	}{}
+	s.editLayers(w, r, &req, func(mmlFile string) error {
+		return mml.ReorderLayers(mmlFile, req.Layers)
+	})
+}
+
+// layerZoom changes the zoom levels of a single layer, e.g. {"layer":
+// "roads", "minzoom": 8, "maxzoom": 18}. Missing levels are reset to 0 and
+// 30.
+func (s *magnaserv) layerZoom(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Layer   string `json:"layer"`
+		MinZoom *int   `json:"minzoom"`
+		MaxZoom *int   `json:"maxzoom"`
+	}{}
+	s.editLayers(w, r, &req, func(mmlFile string) error {
+		minZoom, maxZoom := 0, 30
+		if req.MinZoom != nil {
+			minZoom = *req.MinZoom
+		}
+		if req.MaxZoom != nil {
+			maxZoom = *req.MaxZoom
+		}
+		return mml.SetLayerZoom(mmlFile, req.Layer, minZoom, maxZoom)
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "test.mml"), []byte(`{
+		"Layer": [
+			{"name": "water"},
+			{"name": "roads", "group": "roads", "properties": {"minzoom": 8}},
+			{"name": "places", "status": "off"}
+		]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layers := func(w *httptest.ResponseRecorder) ([]layerInfo, bool) {
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		var resp struct {
+			Layers   []layerInfo
+			Editable bool
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Layers, resp.Editable
+	}
+
+	post := func(target, body string) *http.Request {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+
+	s := &magnaserv{stylesDir: dir}
+	w := httptest.NewRecorder()
+	s.layers(w, httptest.NewRequest("GET", "/api/layers?mml=test.mml", nil))
+	got, editable := layers(w)
+	expected := []layerInfo{
+		{Name: "water", Status: "on", MaxZoom: 30},
+		{Name: "roads", Group: "roads", Status: "on", MinZoom: 8, MaxZoom: 30},
+		{Name: "places", Status: "off", MaxZoom: 30},
+	}
+	if !reflect.DeepEqual(got, expected) || editable {
+		t.Errorf("unexpected layers %#v %v", got, editable)
+	}
+
+	w = httptest.NewRecorder()
+	s.layerOrder(w, post("/api/layers/order?mml=test.mml", `{"layers": ["roads", "water", "places"]}`))
+	if w.Code != 403 {
+		t.Error("unexpected status", w.Code)
+	}
+
+	s.edit = true
+	w = httptest.NewRecorder()
+	s.layerOrder(w, httptest.NewRequest("GET", "/api/layers/order?mml=test.mml", nil))
+	if w.Code != 405 {
+		t.Error("unexpected status", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.layerOrder(w, post("/api/layers/order?mml=test.mml", `{"layers": ["places", "water", "roads"]}`))
+	got, editable = layers(w)
+	if len(got) != 3 || got[0].Name != "places" || got[2].Name != "roads" || !editable {
+		t.Errorf("unexpected layers %#v %v", got, editable)
+	}
+
+	w = httptest.NewRecorder()
+	s.layerZoom(w, post("/api/layers/zoom?mml=test.mml", `{"layer": "water", "minzoom": 4, "maxzoom": 12}`))
+	got, _ = layers(w)
+	if got[1].Name != "water" || got[1].MinZoom != 4 || got[1].MaxZoom != 12 {
+		t.Errorf("unexpected layers %#v", got)
+	}
+
+	for _, body := range []string{
+		`{"layer": "water", "minzoom": 14, "maxzoom": 12}`,
+		`{"layer": "unknown", "minzoom": 4}`,
+		`{"layer": `,
+	} {
+		w = httptest.NewRecorder()
+		s.layerZoom(w, post("/api/layers/zoom?mml=test.mml", body))
+		if w.Code != 400 {
+			t.Error("unexpected status", w.Code, "for", body)
+		}
+	}
+	w = httptest.NewRecorder()
+	s.layerOrder(w, post("/api/layers/order?mml=test.mml", `{"layers": ["places", "water"]}`))
+	if w.Code != 400 {
+		t.Error("unexpected status", w.Code)
+	}
+
+	// cross-site form posts and requests from other origins are rejected
+	r := httptest.NewRequest("POST", "/api/layers/order?mml=test.mml", strings.NewReader(`{"layers": ["water", "places", "roads"]}`))
+	r.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	s.layerOrder(w, r)
+	if w.Code != 415 {
+		t.Error("unexpected status", w.Code)
+	}
+	r = post("http://localhost:7070/api/layers/order?mml=test.mml", `{"layers": ["water", "places", "roads"]}`)
+	r.Header.Set("Origin", "http://example.org")
+	w = httptest.NewRecorder()
+	s.layerOrder(w, r)
+	if w.Code != 403 {
+		t.Error("unexpected status", w.Code)
+	}
+	r = post("http://localhost:7070/api/layers/order?mml=test.mml", `{"layers": ["water", "places", "roads"]}`)
+	r.Header.Set("Origin", "http://localhost:7070")
+	w = httptest.NewRecorder()
+	s.layerOrder(w, r)
+	if got, _ = layers(w); got[0].Name != "water" {
+		t.Errorf("unexpected layers %#v", got)
+	}
+}
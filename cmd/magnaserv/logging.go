@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/omniscale/magnacarto/logging"
+)
+
+type loggerKey struct{}
+
+// requestLogger returns the logger of the request, with the request ID.
+func requestLogger(r *http.Request) *logging.Logger {
+	if l, ok := r.Context().Value(loggerKey{}).(*logging.Logger); ok {
+		return l
+	}
+	return logging.Default()
+}
+
+// requestID returns the X-Request-ID of the client, if it is a valid ID,
+// or a new random ID.
+func requestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" || len(id) > 64 {
+		return logging.NewID()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return logging.NewID()
+		}
+	}
+	return id
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+// logRequests adds a request ID and logger to each request and logs all
+// requests after they are served.
+func logRequests(logger *logging.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := requestID(r)
+		l := logger.With("request_id", id)
+		w.Header().Set("X-Request-ID", id)
+
+		sw := &statusWriter{ResponseWriter: w}
+		start := time.Now()
+		h.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), loggerKey{}, l)))
+
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		level := logging.Info
+		if sw.status >= 500 {
+			level = logging.Error
+		} else if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			// frequent requests from container orchestration
+			level = logging.Debug
+		}
+		l.Log(level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery,
+			"status", sw.status,
+			"size", sw.size,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/logging"
+)
+
+func TestLogRequests(t *testing.T) {
+	logs := &bytes.Buffer{}
+	var handlerID string
+	h := logRequests(logging.New(logs, logging.Info, false), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r).Info("handler")
+		handlerID = w.Header().Get("X-Request-ID")
+		http.Error(w, "failed", http.StatusInternalServerError)
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/map?mml=foo.mml", nil)
+	r.Header.Set("X-Request-ID", "client-id-1")
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get("X-Request-ID"); id != "client-id-1" || handlerID != id {
+		t.Error("unexpected request id", id, handlerID)
+	}
+	l := logs.String()
+	if !strings.Contains(l, "INFO handler request_id=client-id-1\n") {
+		t.Errorf("missing handler message in %q", l)
+	}
+	if !strings.Contains(l, "ERROR request request_id=client-id-1 method=GET path=/api/map query=\"mml=foo.mml\" status=500") {
+		t.Errorf("missing request message in %q", l)
+	}
+
+	// invalid ids are replaced
+	w = httptest.NewRecorder()
+	r.Header.Set("X-Request-ID", "foo bar")
+	h.ServeHTTP(w, r)
+	if id := w.Header().Get("X-Request-ID"); id == "" || id == "foo bar" {
+		t.Error("unexpected request id", id)
+	}
+}
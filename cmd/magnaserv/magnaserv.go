@@ -0,0 +1,532 @@
+// The magnaserv command serves map previews of CartoCSS styles.
+//
+// Styles are build on demand and rebuild when the MML or MSS files change.
+// Changed styles are rebuild in the background, requests are served with the
+// previous style until the new style is ready.
+//
+//	magnaserv -config magnacarto.tml
+//
+// Maps are available at /api/map?mml=project.mml&bbox=...&width=...&height=...
+// Add debug=true to render the collision boxes of all labels (Mapnik only).
+// Layer groups of the MML are listed at /api/groups?mml=project.mml and can
+// be toggled with groups=roads:on,labels:off.
+// All layers are listed at /api/layers?mml=project.mml. With -edit, the
+// layer order and the zoom levels of layers can be changed with POST
+// requests to /api/layers/order and /api/layers/zoom. Changes are written
+// to the MML file.
+// MSS variables are overridden with var=water=#a0c8f0 (can be repeated).
+// /api/variables?mml=project.mml lists the final value and the origin of
+// all variables.
+// Clients can POST MSS snippets to /api/session?mml=project.mml to override
+// the style without changing any file. The override is only used for map
+// requests with the returned session parameter.
+// With -metadata, the version of magnacarto, the build time and the git
+// commit of the style are embedded in all styles and are listed at
+// /api/metadata?mml=project.mml.
+// XYZ tiles are available at /api/tiles/{z}/{x}/{y}.png and the TileJSON of
+// a project at /api/tilejson?mml=project.mml. Projects with an
+// interactivity block get UTFGrids at /api/tiles/{z}/{x}/{y}.grid.json
+// (Mapnik only).
+// The image format is negotiated with the Accept header, if no explicit
+// format parameter is set. Prometheus metrics are available at /metrics.
+//
+// builder=preview renders an approximate preview with a pure-Go renderer
+// (Shapefile and GeoJSON layers only). The preview renderer is also used for
+// all Mapnik requests if magnaserv is built without Mapnik:
+//
+//	CGO_ENABLED=0 go install github.com/omniscale/magnacarto/cmd/magnaserv
+//
+// /api/gallery lists all projects of the styles dir with a thumbnail of
+// each style, rendered with the same -thumbnail-bbox.
+//
+// /api/zoomstrip?mml=project.mml&center=7.1,50.7 renders the same center at
+// each zoom level (z0-z20) into a single PNG, to review a style at all
+// zoom levels. Maps are rendered by the -render-workers and respect the
+// groups parameter.
+//
+// Multiple style roots with separate configs can be served below URL
+// prefixes:
+//
+//	magnaserv -root carto=carto/magnacarto.tml -root data=data/magnacarto.tml
+//
+// Maps of the carto root are available at /carto/api/map?mml=...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/omniscale/magnacarto"
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/builder/mapnik"
+	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/builder/preview"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/render"
+)
+
+type magnaserv struct {
+	config     *config.Magnacarto
+	builder    *builder.Cache
+	stylesDir  string
+	prefix     string
+	pngEncoder render.Encoder
+	workers    *render.Workers
+	metrics    *serverMetrics
+	edit       bool
+	editMu     sync.Mutex
+	metadata   bool
+	sessions   *sessions
+	thumbnails *thumbnails
+}
+
+// parseMapMaker returns the MapMaker of the builder parameter. Defaults to
+// mapnik2.
+func parseMapMaker(name string) (builder.MapMaker, error) {
+	switch name {
+	case "mapserver":
+		return mapserver.Maker, nil
+	case "", "mapnik2":
+		return mapnik.Maker2, nil
+	case "mapnik3":
+		return mapnik.Maker3, nil
+	case "preview":
+		return preview.Maker, nil
+	}
+	return nil, fmt.Errorf("unknown builder %s", name)
+}
+
+func (s *magnaserv) render(w http.ResponseWriter, r *http.Request) {
+	mapReq := render.Request{}
+	q := r.URL.Query()
+
+	var err error
+	if mapReq.BBOX, err = parseBBOX(q.Get("bbox")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if mapReq.Width, err = strconv.Atoi(q.Get("width")); err != nil || mapReq.Width <= 0 {
+		http.Error(w, "invalid width", http.StatusBadRequest)
+		return
+	}
+	if mapReq.Height, err = strconv.Atoi(q.Get("height")); err != nil || mapReq.Height <= 0 {
+		http.Error(w, "invalid height", http.StatusBadRequest)
+		return
+	}
+	mapReq.EPSGCode = 3857
+	if srs := q.Get("srs"); srs != "" {
+		srs = strings.TrimPrefix(strings.ToUpper(srs), "EPSG:")
+		if mapReq.EPSGCode, err = strconv.Atoi(srs); err != nil {
+			http.Error(w, "invalid srs", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mimeType, err := negotiateFormat(q.Get("format"), r.Header.Get("Accept"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	s.renderMap(w, r, mapReq, mimeType)
+}
+
+// renderMap renders mapReq with the style of the mml, mss, builder and
+// variant parameters of r and writes the result as mimeType.
+func (s *magnaserv) renderMap(w http.ResponseWriter, r *http.Request, mapReq render.Request, mimeType string) {
+	st, status, err := s.buildStyle(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	logger := requestLogger(r)
+	b, err := s.renderStyle(r.Context(), st, mapReq, mimeType)
+	if err == context.Canceled {
+		logger.Debug("map request cancelled", "mml", st.mml)
+		return
+	}
+	if err != nil {
+		logger.Error("error rendering map", "mml", st.mml, "style", st.file, "err", err)
+		http.Error(w, err.Error(), renderErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	w.Header().Add("Vary", "Accept")
+	if st.isPreview() {
+		w.Header().Set("X-Magnacarto-Renderer", "preview; approximate")
+	}
+	w.Write(b)
+}
+
+// mapStyle is a built style of a map request.
+type mapStyle struct {
+	mml      string
+	file     string
+	mapMaker builder.MapMaker
+	// renderer is the MapMaker without variant
+	renderer builder.MapMaker
+}
+
+func (st mapStyle) isPreview() bool { return st.renderer == preview.Maker }
+
+// buildStyle builds the style of the mml, mss, builder, variant and session
+// parameters of r. Returns the HTTP status for errors.
+func (s *magnaserv) buildStyle(r *http.Request) (mapStyle, int, error) {
+	q := r.URL.Query()
+	mml, err := s.stylePath(q.Get("mml"))
+	if err != nil {
+		return mapStyle{}, http.StatusBadRequest, err
+	}
+	var mss []string
+	for _, f := range q["mss"] {
+		fname, err := s.stylePath(f)
+		if err != nil {
+			return mapStyle{}, http.StatusBadRequest, err
+		}
+		mss = append(mss, fname)
+	}
+
+	mapMaker, err := parseMapMaker(q.Get("builder"))
+	if err != nil {
+		return mapStyle{}, http.StatusBadRequest, err
+	}
+	if !render.MapnikAvailable && (mapMaker == mapnik.Maker2 || mapMaker == mapnik.Maker3) {
+		mapMaker = preview.Maker
+	}
+	st := mapStyle{mml: mml, renderer: mapMaker}
+	variant, err := parseVariant(q)
+	if err != nil {
+		return mapStyle{}, http.StatusBadRequest, err
+	}
+	if id := q.Get("session"); id != "" {
+		if variant.MSS, err = s.sessions.overrides(id, mml); err != nil {
+			return mapStyle{}, http.StatusNotFound, err
+		}
+	}
+	if variant.Debug || len(variant.GroupStatus) > 0 || len(variant.MSS) > 0 || len(variant.Vars) > 0 {
+		// variants are build and cached separately
+		mapMaker = builder.VariantMaker(mapMaker, variant)
+	}
+	st.mapMaker = mapMaker
+
+	st.file, err = s.builder.StyleFileWithLogger(mapMaker, mml, mss, requestLogger(r))
+	if err != nil {
+		return mapStyle{}, http.StatusInternalServerError, err
+	}
+	return st, 0, nil
+}
+
+// renderStyle renders mapReq with the style as mimeType. Mapnik styles are
+// rendered by the render workers, if available.
+func (s *magnaserv) renderStyle(ctx context.Context, st mapStyle, mapReq render.Request, mimeType string) ([]byte, error) {
+	if mimeType == "image/png" && s.pngEncoder != nil {
+		mapReq.Encoder = timedEncoder{Encoder: s.pngEncoder, format: mimeType, metrics: s.metrics}
+	}
+
+	project := s.project(st.mml)
+	start := time.Now()
+	var b []byte
+	var err error
+	if st.renderer == mapserver.Maker {
+		mapReq.Format = mimeType
+		b, err = render.MapServer(s.config.MapServer.Bin, st.file, mapReq)
+	} else if st.isPreview() {
+		mapReq.Format = mimeType
+		b, err = render.Preview(st.file, mapReq)
+	} else if s.workers != nil {
+		mapReq.Format = mapnikFormat(mimeType)
+		b, err = s.workers.Render(ctx, st.file, mapReq)
+	} else {
+		mapReq.Format = mapnikFormat(mimeType)
+		b, err = render.MapnikContext(ctx, st.file, mapReq)
+	}
+	if err != nil {
+		if err != context.Canceled {
+			s.metrics.errors.inc(project, "render")
+		}
+		return nil, err
+	}
+	s.metrics.renderDuration.observeDuration(start, st.mapMaker.Type())
+	s.metrics.renders.inc(project, st.mapMaker.Type(), mimeType)
+	return b, nil
+}
+
+// renderErrorStatus returns the HTTP status for render errors.
+func renderErrorStatus(err error) int {
+	switch err {
+	case render.ErrGridUnsupported:
+		return http.StatusBadRequest
+	case render.ErrQueueFull:
+		return http.StatusServiceUnavailable
+	case context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// stylePath returns the absolute path of a MML/MSS file. Files outside of the
+// styles dir are not allowed.
+func (s *magnaserv) stylePath(fname string) (string, error) {
+	if fname == "" {
+		return "", fmt.Errorf("missing style file")
+	}
+	path := filepath.Join(s.stylesDir, filepath.FromSlash(fname))
+	if !strings.HasPrefix(path, s.stylesDir+string(filepath.Separator)) {
+		return "", fmt.Errorf("style file %s outside of styles dir", fname)
+	}
+	return path, nil
+}
+
+// parseVariant parses the debug, groups (e.g. groups=roads:on,labels:off)
+// and var (e.g. var=water=#a0c8f0, can be repeated) parameters.
+func parseVariant(q url.Values) (builder.Variant, error) {
+	v := builder.Variant{}
+	if debug := q.Get("debug"); debug != "" {
+		var err error
+		if v.Debug, err = strconv.ParseBool(debug); err != nil {
+			return v, fmt.Errorf("invalid debug '%s'", debug)
+		}
+	}
+	for _, g := range strings.Split(q.Get("groups"), ",") {
+		if g == "" {
+			continue
+		}
+		parts := strings.SplitN(g, ":", 2)
+		if len(parts) != 2 || (parts[1] != "on" && parts[1] != "off") {
+			return v, fmt.Errorf("invalid group '%s', expected name:on or name:off", g)
+		}
+		if v.GroupStatus == nil {
+			v.GroupStatus = make(map[string]bool)
+		}
+		v.GroupStatus[parts[0]] = parts[1] == "on"
+	}
+	for _, variable := range q["var"] {
+		i := strings.Index(variable, "=")
+		if i <= 0 {
+			return v, fmt.Errorf("invalid var '%s', expected name=value", variable)
+		}
+		if v.Vars == nil {
+			v.Vars = make(map[string]string)
+		}
+		v.Vars[variable[:i]] = variable[i+1:]
+	}
+	return v, nil
+}
+
+func parseBBOX(bbox string) ([4]float64, error) {
+	result := [4]float64{}
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return result, fmt.Errorf("invalid bbox '%s'", bbox)
+	}
+	for i := range parts {
+		v, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil {
+			return result, fmt.Errorf("invalid bbox '%s'", bbox)
+		}
+		result[i] = v
+	}
+	if result[0] >= result[2] || result[1] >= result[3] {
+		return result, fmt.Errorf("invalid bbox '%s'", bbox)
+	}
+	return result, nil
+}
+
+func main() {
+	listenAddr := flag.String("listen", "localhost:7070", "listen address")
+	configFile := flag.String("config", "", "config")
+	pngEncoders := flag.Int("png-encoders", 0, "encode PNGs with this number of parallel Go encoders, instead of the renderer")
+	pngColors := flag.Int("png-colors", 256, "number of colors for PNGs encoded with -png-encoders, 0 for true color")
+	renderWorkers := flag.Int("render-workers", 0, "number of parallel Mapnik renderers, defaults to the number of CPUs")
+	renderQueue := flag.Int("render-queue", 0, "number of Mapnik requests that wait for a free renderer, 0 for no limit (503 if full)")
+	renderTimeout := flag.Duration("render-timeout", 0, "timeout of Mapnik requests, including the time in the queue, 0 for no timeout (504 if exceeded)")
+	version := flag.Bool("version", false, "print version and exit")
+	logLevel := flag.String("log-level", "info", "log level (debug, info, warn or error)")
+	logJSON := flag.Bool("log-json", false, "write log messages as JSON")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to finish running requests on shutdown")
+	backgroundRebuild := flag.Bool("background-rebuild", true, "serve previous style while changed styles are rebuild")
+	sessionTimeout := flag.Duration("session-timeout", time.Hour, "remove style overrides of sessions without requests after this time")
+	edit := flag.Bool("edit", false, "allow changes of the layer order and zoom levels in MML files with /api/layers")
+	metadata := flag.Bool("metadata", false, "embed build metadata (magnacarto version, build time, git commit of the style, variable overrides) in all styles, available at /api/metadata")
+	thumbnailBBOX := flag.String("thumbnail-bbox", "", "EPSG:3857 bbox of the thumbnails of /api/gallery (minx,miny,maxx,maxy), defaults to the whole world")
+	thumbnailSize := flag.Int("thumbnail-size", 256, "width and height of the thumbnails of /api/gallery")
+	host := flag.String("host", "", "listen on this host/IP, overrides the host of -listen (e.g. 0.0.0.0)")
+	// magnaserv never opens a browser, -no-browser is only accepted for
+	// compatibility
+	flag.Bool("no-browser", false, "no effect, kept for compatibility (magnaserv never opens a browser)")
+	stylesDirFlag := flag.String("styles-dir", "", "styles dir, overrides styles_dir from -config")
+	outDir := flag.String("out-dir", "", "dir for built styles, overrides out_dir from -config")
+	mapserverBin := flag.String("mapserver-bin", "", "path to mapserv binary")
+	var roots rootList
+	flag.Var(&roots, "root", "serve styles of config.tml below /prefix/ (prefix=config.tml), can be repeated")
+	var fontDirs, pluginDirs pathList
+	flag.Var(&fontDirs, "font-dirs", "Mapnik font dirs, overrides font_dirs from -config")
+	flag.Var(&pluginDirs, "plugin-dirs", "Mapnik plugin dirs, overrides plugin_dirs from -config")
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nAll options can also be set with %s* environment variables (e.g. %s).\n",
+			envPrefix, envName("styles-dir"))
+	}
+	if err := setFlagsFromEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+	flag.Parse()
+
+	if *version {
+		fmt.Println(magnacarto.Version)
+		os.Exit(0)
+	}
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger := logging.New(os.Stderr, level, *logJSON)
+	// remaining messages of the builders and renderers
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logging.Warn))
+	fatal := func(msg string, err error) {
+		logger.Error(msg, "err", err)
+		os.Exit(1)
+	}
+
+	conf := &config.Magnacarto{BaseDir: "."}
+	if *configFile != "" {
+		if conf, err = config.Load(*configFile); err != nil {
+			fatal("unable to load config", err)
+		}
+	}
+	if *stylesDirFlag != "" {
+		if conf.StylesDir, err = filepath.Abs(*stylesDirFlag); err != nil {
+			fatal("invalid styles dir", err)
+		}
+	}
+	if *outDir != "" {
+		if conf.OutDir, err = filepath.Abs(*outDir); err != nil {
+			fatal("invalid out dir", err)
+		}
+	}
+	if len(fontDirs) > 0 {
+		conf.Mapnik.FontDirs = fontDirs
+	}
+	if len(pluginDirs) > 0 {
+		conf.Mapnik.PluginDirs = pluginDirs
+	}
+	if *mapserverBin != "" {
+		conf.MapServer.Bin = *mapserverBin
+	}
+	if len(roots) > 0 && *configFile != "" {
+		fatal("invalid options", fmt.Errorf("-config and -root are exclusive"))
+	}
+
+	opts := serverOptions{
+		logger:            logger,
+		metrics:           newServerMetrics(),
+		backgroundRebuild: *backgroundRebuild,
+		edit:              *edit,
+		metadata:          *metadata,
+		sessionTimeout:    *sessionTimeout,
+		thumbnailSize:     *thumbnailSize,
+	}
+	if *thumbnailBBOX != "" {
+		if opts.thumbnailBBOX, err = parseBBOX(*thumbnailBBOX); err != nil {
+			fatal("invalid -thumbnail-bbox", err)
+		}
+	}
+	if *pngEncoders > 0 {
+		opts.pngEncoder = render.NewPNGPool(*pngEncoders, *pngColors)
+	}
+
+	if !render.MapnikAvailable {
+		logger.Warn("built without Mapnik, rendering approximate previews with the pure-Go renderer")
+	} else {
+		opts.workers = render.NewMapnikWorkers(render.WorkerOptions{
+			Workers: *renderWorkers,
+			Queue:   *renderQueue,
+			Timeout: *renderTimeout,
+		})
+	}
+
+	var servers []*magnaserv
+	if len(roots) == 0 {
+		if err := render.RegisterMapnik(conf.Mapnik); err != nil {
+			fatal("unable to register Mapnik plugins and fonts", err)
+		}
+		s, err := newMagnaserv(conf, "", opts)
+		if err != nil {
+			fatal("unable to initialize styles", err)
+		}
+		servers = append(servers, s)
+	}
+	for _, root := range roots {
+		rootConf, err := config.Load(root.configFile)
+		if err != nil {
+			fatal("unable to load config", err)
+		}
+		// Mapnik plugins and fonts are registered globally and available
+		// for all roots
+		if err := render.RegisterMapnik(rootConf.Mapnik); err != nil {
+			fatal("unable to register Mapnik plugins and fonts", err)
+		}
+		s, err := newMagnaserv(rootConf, root.prefix, opts)
+		if err != nil {
+			fatal("unable to initialize styles", err)
+		}
+		logger.Info("serving root", "prefix", "/"+root.prefix+"/", "config", root.configFile, "styles_dir", s.stylesDir)
+		servers = append(servers, s)
+	}
+
+	health := &health{}
+	for _, s := range servers {
+		s.handle(http.DefaultServeMux)
+		health.stylesDirs = append(health.stylesDirs, s.stylesDir)
+	}
+	http.Handle("/metrics", opts.metrics.registry)
+	http.HandleFunc("/healthz", health.healthz)
+	http.HandleFunc("/readyz", health.readyz)
+
+	addr, err := overrideHost(*listenAddr, *host)
+	if err != nil {
+		fatal("invalid listen address", err)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fatal("unable to listen", err)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	srv := &http.Server{Handler: logRequests(logger, http.DefaultServeMux)}
+	srv.RegisterOnShutdown(func() { health.setReady(false) })
+	health.setReady(true)
+	logger.Info("listening", "url", "http://"+l.Addr().String(), "version", magnacarto.Version)
+	err = serve(srv, l, signals, *shutdownTimeout, logger)
+	for _, s := range servers {
+		s.close()
+	}
+	if opts.workers != nil {
+		opts.workers.Close()
+	}
+	if err != nil {
+		fatal("server stopped", err)
+	}
+	logger.Info("stopped")
+}
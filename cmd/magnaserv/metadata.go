@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/omniscale/magnacarto/builder"
+)
+
+// styleMetadata returns the build metadata of a style as JSON object (e.g.
+// {"magnacarto_version": "0.1", "magnacarto_style_commit": "2f1c..."}). The
+// style is build like for /api/map, with the same builder and var
+// parameters. Only available with -metadata.
+func (s *magnaserv) styleMetadata(w http.ResponseWriter, r *http.Request) {
+	if !s.metadata {
+		http.Error(w, "build metadata not enabled, start magnaserv with -metadata", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	mml, err := s.stylePath(q.Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mapMaker, err := parseMapMaker(q.Get("builder"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	variant, err := parseVariant(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(variant.GroupStatus) > 0 || len(variant.Vars) > 0 {
+		mapMaker = builder.VariantMaker(mapMaker, variant)
+	}
+
+	md, err := s.builder.StyleMetadata(mapMaker, mml, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := map[string]string{}
+	for _, item := range md {
+		result[item.Name] = item.Value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
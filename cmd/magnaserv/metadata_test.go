@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omniscale/magnacarto"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+func TestStyleMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"test.mml":  `{"Stylesheet": ["style.mss"], "Layer": [{"name": "roads"}]}`,
+		"style.mss": "@width: 1;\n#roads { line-width: @width; }",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, metadata := range []bool{false, true} {
+		s, err := newMagnaserv(&config.Magnacarto{StylesDir: dir}, "", serverOptions{
+			logger:   logging.Default(),
+			metrics:  newServerMetrics(),
+			metadata: metadata,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.close()
+
+		w := httptest.NewRecorder()
+		s.styleMetadata(w, httptest.NewRequest("GET", "/api/metadata?mml=test.mml&builder=mapserver&var=width=3", nil))
+		if !metadata {
+			if w.Code != 404 {
+				t.Error("unexpected status without -metadata", w.Code)
+			}
+			continue
+		}
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		var md map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &md); err != nil {
+			t.Fatal(err)
+		}
+		if md["magnacarto_version"] != magnacarto.Version || md["magnacarto_mml"] != "test.mml" || md["magnacarto_vars"] != "width=3" || md["magnacarto_build_time"] == "" {
+			t.Errorf("unexpected metadata %v", md)
+		}
+
+		w = httptest.NewRecorder()
+		s.styleMetadata(w, httptest.NewRequest("GET", "/api/metadata?mml=test.mml&builder=unknown", nil))
+		if w.Code != 400 {
+			t.Error("unexpected status for unknown builder", w.Code)
+		}
+	}
+}
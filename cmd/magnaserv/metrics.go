@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omniscale/magnacarto/render"
+)
+
+// Minimal metrics in the Prometheus text exposition format.
+// See https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type metric interface {
+	write(buf *bytes.Buffer)
+}
+
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	buf := &bytes.Buffer{}
+	r.mu.Lock()
+	for _, m := range r.metrics {
+		m.write(buf)
+	}
+	r.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// labelSet stores one value per label combination.
+type labelSet struct {
+	labels []string
+	keys   []string // sorted
+	values map[string][]string
+}
+
+func newLabelSet(labels []string) labelSet {
+	return labelSet{labels: labels, values: make(map[string][]string)}
+}
+
+// key returns the key for the label values, registers new combinations.
+func (l *labelSet) key(values []string) string {
+	if len(values) != len(l.labels) {
+		panic(fmt.Sprintf("expected %d label values, got %d", len(l.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := l.values[k]; !ok {
+		l.values[k] = append([]string(nil), values...)
+		i := sort.SearchStrings(l.keys, k)
+		l.keys = append(l.keys, "")
+		copy(l.keys[i+1:], l.keys[i:])
+		l.keys[i] = k
+	}
+	return k
+}
+
+// labelEscaper escapes label values for the Prometheus text format. Only
+// backslash, double quote and line feed are escaped, all other UTF-8 is
+// written as is.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// format returns the labels as {a="1",b="2"} with optional extra labels.
+func (l *labelSet) format(k string, extra ...string) string {
+	values := l.values[k]
+	if len(values) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(values)+len(extra)/2)
+	for i, v := range values {
+		parts = append(parts, l.labels[i]+`="`+labelEscaper.Replace(v)+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+type counterVec struct {
+	mu   sync.Mutex
+	name string
+	help string
+	set  labelSet
+	vals map[string]float64
+}
+
+func newCounterVec(r *metricsRegistry, name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, set: newLabelSet(labels), vals: make(map[string]float64)}
+	r.register(c)
+	return c
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+func (c *counterVec) add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	c.vals[c.set.key(labelValues)] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range c.set.keys {
+		fmt.Fprintf(buf, "%s%s %s\n", c.name, c.set.format(k), formatFloat(c.vals[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	buckets []float64
+	set     labelSet
+	vals    map[string]*histogram
+}
+
+// defaultBuckets in seconds, from 5ms to 30s.
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func newHistogramVec(r *metricsRegistry, name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, buckets: buckets, set: newLabelSet(labels), vals: make(map[string]*histogram)}
+	r.register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.set.key(labelValues)
+	hist, ok := h.vals[k]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.vals[k] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.buckets) {
+		hist.counts[i]++
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) observeDuration(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range h.set.keys {
+		hist := h.vals[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hist.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.set.format(k, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", h.name, h.set.format(k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", h.name, h.set.format(k), formatFloat(hist.sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", h.name, h.set.format(k), hist.count)
+	}
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serverMetrics are all metrics of magnaserv.
+type serverMetrics struct {
+	registry *metricsRegistry
+
+	renders        *counterVec
+	renderDuration *histogramVec
+	encodeDuration *histogramVec
+	cacheHits      *counterVec
+	builds         *counterVec
+	buildDuration  *histogramVec
+	errors         *counterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	r := &metricsRegistry{}
+	return &serverMetrics{
+		registry:       r,
+		renders:        newCounterVec(r, "magnaserv_renders_total", "Number of rendered maps.", "project", "renderer", "format"),
+		renderDuration: newHistogramVec(r, "magnaserv_render_duration_seconds", "Duration of map renderings, including encoding.", defaultBuckets, "renderer"),
+		encodeDuration: newHistogramVec(r, "magnaserv_encode_duration_seconds", "Duration of Go image encoding.", defaultBuckets, "format"),
+		cacheHits:      newCounterVec(r, "magnaserv_style_cache_hits_total", "Number of styles served from the cache.", "project"),
+		builds:         newCounterVec(r, "magnaserv_style_builds_total", "Number of style builds.", "project"),
+		buildDuration:  newHistogramVec(r, "magnaserv_style_build_duration_seconds", "Duration of style builds.", defaultBuckets, "project"),
+		errors:         newCounterVec(r, "magnaserv_errors_total", "Number of failed builds and renderings.", "project", "stage"),
+	}
+}
+
+// styleObserver implements builder.CacheObserver for the styles of a
+// magnaserv.
+type styleObserver struct {
+	metrics *serverMetrics
+	s       *magnaserv
+}
+
+func (o styleObserver) CacheHit(mml string) {
+	o.metrics.cacheHits.inc(o.s.project(mml))
+}
+
+func (o styleObserver) StyleBuild(mml string, duration time.Duration, err error) {
+	project := o.s.project(mml)
+	o.metrics.builds.inc(project)
+	o.metrics.buildDuration.observe(duration.Seconds(), project)
+	if err != nil {
+		o.metrics.errors.inc(project, "build")
+	}
+}
+
+// timedEncoder records the encoding duration of an Encoder.
+type timedEncoder struct {
+	render.Encoder
+	format  string
+	metrics *serverMetrics
+}
+
+func (e timedEncoder) Encode(w io.Writer, img image.Image) error {
+	defer e.metrics.encodeDuration.observeDuration(time.Now(), e.format)
+	return e.Encoder.Encode(w, img)
+}
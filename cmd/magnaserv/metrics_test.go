@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := newServerMetrics()
+	o := styleObserver{metrics: m, s: &magnaserv{stylesDir: "/styles"}}
+	o.CacheHit("/styles/osm/project.mml")
+	o.CacheHit("/styles/osm/project.mml")
+	o.StyleBuild("/styles/osm/project.mml", 20*time.Millisecond, nil)
+	o.StyleBuild("/styles/base.mml", 2*time.Second, errors.New("failed"))
+	m.renders.inc("osm/project.mml", "mapnik2", "image/png")
+	m.renderDuration.observe(0.3, "mapnik2")
+
+	w := httptest.NewRecorder()
+	m.registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Error("unexpected content type", ct)
+	}
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE magnaserv_renders_total counter",
+		`magnaserv_renders_total{project="osm/project.mml",renderer="mapnik2",format="image/png"} 1`,
+		`magnaserv_style_cache_hits_total{project="osm/project.mml"} 2`,
+		`magnaserv_style_builds_total{project="base.mml"} 1`,
+		`magnaserv_style_builds_total{project="osm/project.mml"} 1`,
+		`magnaserv_errors_total{project="base.mml",stage="build"} 1`,
+		"# TYPE magnaserv_render_duration_seconds histogram",
+		`magnaserv_render_duration_seconds_bucket{renderer="mapnik2",le="0.25"} 0`,
+		`magnaserv_render_duration_seconds_bucket{renderer="mapnik2",le="0.5"} 1`,
+		`magnaserv_render_duration_seconds_bucket{renderer="mapnik2",le="+Inf"} 1`,
+		`magnaserv_render_duration_seconds_sum{renderer="mapnik2"} 0.3`,
+		`magnaserv_render_duration_seconds_count{renderer="mapnik2"} 1`,
+		`magnaserv_style_build_duration_seconds_bucket{project="base.mml",le="1"} 0`,
+		`magnaserv_style_build_duration_seconds_bucket{project="base.mml",le="2.5"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing %q in\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `magnaserv_errors_total{project="osm/project.mml"`) {
+		t.Error("unexpected error for osm/project.mml")
+	}
+}
+
+func TestMetricsLabelEscaping(t *testing.T) {
+	m := newServerMetrics()
+	m.renders.inc("straßen/karte \"süd\".mml", `C:\styles`, "line\nbreak")
+
+	w := httptest.NewRecorder()
+	m.registry.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	line := `magnaserv_renders_total{project="straßen/karte \"süd\".mml",renderer="C:\\styles",format="line\nbreak"} 1`
+	if body := w.Body.String(); !strings.Contains(body, line+"\n") {
+		t.Errorf("missing %q in\n%s", line, body)
+	}
+}
+
+func TestProjectLabel(t *testing.T) {
+	s := &magnaserv{stylesDir: "/styles"}
+	if p := s.project("/styles/osm/project.mml"); p != "osm/project.mml" {
+		t.Error("unexpected project", p)
+	}
+	s.prefix = "carto"
+	if p := s.project("/styles/osm/project.mml"); p != "carto/osm/project.mml" {
+		t.Error("unexpected project", p)
+	}
+}
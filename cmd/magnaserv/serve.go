@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/omniscale/magnacarto/logging"
+)
+
+// serve serves srv on l until a signal is received. In-flight requests are
+// finished before serve returns, or until timeout is reached.
+func serve(srv *http.Server, l net.Listener, signals <-chan os.Signal, timeout time.Duration, logger *logging.Logger) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-signals:
+		logger.Info("shutting down", "signal", sig, "timeout", timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-errc; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
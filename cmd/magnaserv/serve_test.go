@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeGracefulShutdown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	})}
+
+	signals := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(srv, l, signals, 5*time.Second, nil)
+	}()
+
+	resp := make(chan string, 1)
+	go func() {
+		r, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			resp <- err.Error()
+			return
+		}
+		defer r.Body.Close()
+		b, _ := ioutil.ReadAll(r.Body)
+		resp <- string(b)
+	}()
+
+	<-started
+	signals <- syscall.SIGTERM
+
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if r := <-resp; r != "done" {
+		t.Error("in-flight request not finished:", r)
+	}
+	if _, err := http.Get("http://" + l.Addr().String() + "/"); err == nil {
+		t.Error("server still accepting requests")
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/omniscale/magnacarto/logging"
+)
+
+const (
+	maxSessions      = 1000
+	maxOverrideBytes = 1 << 20
+)
+
+var errUnknownSession = errors.New("unknown or expired session")
+
+// sessions keeps temporary MSS overrides of preview clients. The overrides
+// are written to a temp dir for each session and are parsed after the
+// stylesheets of the MML, only for map requests of the same session.
+// Sessions expire after ttl without requests.
+type sessions struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	byID map[string]*session
+	// evict is called for each removed override file
+	evict func(mss string)
+}
+
+type session struct {
+	dir      string
+	files    map[string]string // override file for each MML
+	created  int               // number of created files, for unique names
+	lastUsed time.Time
+}
+
+func newSessions(ttl time.Duration, evict func(mss string)) *sessions {
+	return &sessions{
+		ttl:   ttl,
+		byID:  make(map[string]*session),
+		evict: evict,
+	}
+}
+
+// setOverride sets the MSS override of mml. A new session is created if id
+// is empty. Returns the ID of the session.
+func (ss *sessions) setOverride(id, mml, content string) (string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.expire(time.Now())
+
+	var s *session
+	if id == "" {
+		if len(ss.byID) >= maxSessions {
+			return "", fmt.Errorf("too many sessions")
+		}
+		dir, err := ioutil.TempDir("", "magnaserv-session")
+		if err != nil {
+			return "", err
+		}
+		id = logging.NewID()
+		s = &session{dir: dir, files: make(map[string]string)}
+		ss.byID[id] = s
+	} else if s = ss.byID[id]; s == nil {
+		return "", errUnknownSession
+	}
+	s.lastUsed = time.Now()
+
+	fname, ok := s.files[mml]
+	if !ok {
+		s.created++
+		fname = filepath.Join(s.dir, fmt.Sprintf("override-%d.mss", s.created))
+	}
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		return "", err
+	}
+	s.files[mml] = fname
+	return id, nil
+}
+
+// override returns the content of the override of mml, or an empty string.
+func (ss *sessions) override(id, mml string) (string, error) {
+	files, err := ss.overrides(id, mml)
+	if err != nil || len(files) == 0 {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(files[0])
+	return string(content), err
+}
+
+// overrides returns the override files of mml for a map request.
+func (ss *sessions) overrides(id, mml string) ([]string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.expire(time.Now())
+	s := ss.byID[id]
+	if s == nil {
+		return nil, errUnknownSession
+	}
+	s.lastUsed = time.Now()
+	if fname, ok := s.files[mml]; ok {
+		return []string{fname}, nil
+	}
+	return nil, nil
+}
+
+// remove removes the override of mml, or the whole session if mml is empty.
+func (ss *sessions) remove(id, mml string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s := ss.byID[id]
+	if s == nil {
+		return errUnknownSession
+	}
+	if mml == "" {
+		ss.removeSession(id)
+		return nil
+	}
+	s.lastUsed = time.Now()
+	if fname, ok := s.files[mml]; ok {
+		ss.evict(fname)
+		delete(s.files, mml)
+		return os.Remove(fname)
+	}
+	return nil
+}
+
+// expire removes all sessions that were not used since ttl. Needs to be
+// called with locked sessions.
+func (ss *sessions) expire(now time.Time) {
+	for id, s := range ss.byID {
+		if now.Sub(s.lastUsed) > ss.ttl {
+			ss.removeSession(id)
+		}
+	}
+}
+
+func (ss *sessions) removeSession(id string) {
+	s := ss.byID[id]
+	for _, fname := range s.files {
+		ss.evict(fname)
+	}
+	os.RemoveAll(s.dir)
+	delete(ss.byID, id)
+}
+
+// close removes all sessions.
+func (ss *sessions) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for id := range ss.byID {
+		ss.removeSession(id)
+	}
+}
+
+// session handles the MSS overrides of a session. POST sets the override
+// of the MML to the MSS of the request body and creates a new session,
+// if there is no session parameter. GET returns the override and DELETE
+// removes the override, or the whole session without the mml parameter.
+func (s *magnaserv) session(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("session")
+	var mmlFile string
+	if r.Method != "DELETE" || q.Get("mml") != "" {
+		var err error
+		if mmlFile, err = s.stylePath(q.Get("mml")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	switch r.Method {
+	case "GET":
+		var content string
+		if content, err = s.sessions.override(id, mmlFile); err == nil {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(content))
+			return
+		}
+	case "POST":
+		var content []byte
+		content, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxOverrideBytes))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if id, err = s.sessions.setOverride(id, mmlFile, string(content)); err == nil {
+			requestLogger(r).Debug("set style override", "mml", s.project(mmlFile), "session", id)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"session": id})
+			return
+		}
+	case "DELETE":
+		if err = s.sessions.remove(id, mmlFile); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	default:
+		http.Error(w, "GET, POST or DELETE required", http.StatusMethodNotAllowed)
+		return
+	}
+	if err == errUnknownSession {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
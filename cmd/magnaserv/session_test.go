@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+func TestSessionOverrides(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	area := filepath.ToSlash(filepath.Join(dir, "area.geojson"))
+	files := map[string]string{
+		"area.geojson": `{"type": "Polygon", "coordinates": [[[-180, -80], [180, -80], [180, 80], [-180, 80], [-180, -80]]]}`,
+		"test.mml": `{"Stylesheet": ["style.mss"], "Layer": [
+			{"name": "area", "geometry": "polygon", "srs": "+init=epsg:4326", "Datasource": {"type": "ogr", "file": "` + area + `"}}
+		]}`,
+		"style.mss": `#area { polygon-fill: red; }`,
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newMagnaserv(&config.Magnacarto{StylesDir: dir}, "", serverOptions{
+		logger:         logging.Default(),
+		metrics:        newServerMetrics(),
+		sessionTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	color := func(session string) [3]uint32 {
+		w := httptest.NewRecorder()
+		s.render(w, httptest.NewRequest("GET", "/api/map?mml=test.mml&builder=preview&format=png&width=4&height=4&srs=4326&bbox=-10,-10,10,10&session="+session, nil))
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, g, b, _ := img.At(2, 2).RGBA()
+		return [3]uint32{r >> 8, g >> 8, b >> 8}
+	}
+	post := func(session, mss string) string {
+		w := httptest.NewRecorder()
+		s.session(w, httptest.NewRequest("POST", "/api/session?mml=test.mml&session="+session, strings.NewReader(mss)))
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		var resp struct{ Session string }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Session
+	}
+
+	id := post("", `#area { polygon-fill: blue; }`)
+	if id == "" {
+		t.Fatal("missing session")
+	}
+	if c := color(""); c != [3]uint32{255, 0, 0} {
+		t.Error("unexpected color without session", c)
+	}
+	if c := color(id); c != [3]uint32{0, 0, 255} {
+		t.Error("unexpected color with session", c)
+	}
+
+	other := post("", `#area { polygon-fill: white; }`)
+	if other == id {
+		t.Fatal("session reused")
+	}
+	if id := post(id, `#area { polygon-fill: lime; }`); id == other {
+		t.Fatal("unexpected session")
+	}
+	// changed overrides are rebuild, even within the same second
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(s.sessions.byID[id].files[filepath.Join(dir, "test.mml")], future, future)
+	if c := color(id); c != [3]uint32{0, 255, 0} {
+		t.Error("unexpected color for changed override", c)
+	}
+
+	w := httptest.NewRecorder()
+	s.session(w, httptest.NewRequest("GET", "/api/session?mml=test.mml&session="+id, nil))
+	if w.Body.String() != `#area { polygon-fill: lime; }` {
+		t.Error("unexpected override", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	s.session(w, httptest.NewRequest("DELETE", "/api/session?mml=test.mml&session="+id, nil))
+	if w.Code != 204 {
+		t.Error("unexpected status", w.Code)
+	}
+	if c := color(id); c != [3]uint32{255, 0, 0} {
+		t.Error("unexpected color after removing override", c)
+	}
+
+	w = httptest.NewRecorder()
+	s.session(w, httptest.NewRequest("DELETE", "/api/session?session="+other, nil))
+	if w.Code != 204 {
+		t.Error("unexpected status", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.render(w, httptest.NewRequest("GET", "/api/map?mml=test.mml&builder=preview&width=4&height=4&bbox=-10,-10,10,10&session="+other, nil))
+	if w.Code != 404 {
+		t.Error("unexpected status for removed session", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.session(w, httptest.NewRequest("POST", "/api/session?mml=test.mml&session=unknown", strings.NewReader("")))
+	if w.Code != 404 {
+		t.Error("unexpected status for unknown session", w.Code)
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	var evicted []string
+	ss := newSessions(time.Minute, func(mss string) { evicted = append(evicted, mss) })
+	id, err := ss.setOverride("", "/styles/test.mml", "#roads { line-width: 2; }")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := ss.byID[id].dir
+	ss.expire(time.Now())
+	if _, err := ss.overrides(id, "/styles/test.mml"); err != nil {
+		t.Fatal(err)
+	}
+	ss.expire(time.Now().Add(2 * time.Minute))
+	if _, err := ss.overrides(id, "/styles/test.mml"); err != errUnknownSession {
+		t.Error("session not expired", err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("session dir not removed", err)
+	}
+	if len(evicted) != 1 || filepath.Dir(evicted[0]) != dir {
+		t.Error("override not evicted", evicted)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/omniscale/magnacarto/builder"
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/render"
+)
+
+// root is a style root with its own config, served below /prefix/.
+type root struct {
+	prefix     string
+	configFile string
+}
+
+// rootList is a flag.Value for -root prefix=config.tml options.
+// Multiple roots can be separated by commas.
+type rootList []root
+
+func (l *rootList) String() string {
+	parts := make([]string, len(*l))
+	for i, r := range *l {
+		parts[i] = r.prefix + "=" + r.configFile
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *rootList) Set(v string) error {
+	for _, part := range strings.Split(v, ",") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return fmt.Errorf("expected prefix=config.tml, got '%s'", part)
+		}
+		if err := validPrefix(kv[0]); err != nil {
+			return err
+		}
+		for _, r := range *l {
+			if r.prefix == kv[0] {
+				return fmt.Errorf("duplicate prefix '%s'", kv[0])
+			}
+		}
+		*l = append(*l, root{prefix: kv[0], configFile: kv[1]})
+	}
+	return nil
+}
+
+var prefixRe = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var reservedPrefixes = map[string]bool{
+	"api": true, "metrics": true, "healthz": true, "readyz": true,
+}
+
+func validPrefix(prefix string) error {
+	if !prefixRe.MatchString(prefix) {
+		return fmt.Errorf("invalid prefix '%s', only letters, digits, - and _ are allowed", prefix)
+	}
+	if reservedPrefixes[prefix] {
+		return fmt.Errorf("prefix '%s' is reserved", prefix)
+	}
+	return nil
+}
+
+type serverOptions struct {
+	logger            *logging.Logger
+	metrics           *serverMetrics
+	pngEncoder        render.Encoder
+	backgroundRebuild bool
+	// edit allows changes of the MML files with /api/layers/...
+	edit bool
+	// metadata embeds the build metadata in all styles
+	metadata bool
+	// sessionTimeout after the last request of a session, before its
+	// overrides are removed
+	sessionTimeout time.Duration
+	// workers render Mapnik styles, styles are loaded for each request if
+	// nil
+	workers *render.Workers
+	// thumbnailBBOX in EPSG:3857 and thumbnailSize in pixels of the
+	// thumbnails of /api/gallery, defaults to the whole world with 256
+	// pixels
+	thumbnailBBOX [4]float64
+	thumbnailSize int
+}
+
+// newMagnaserv initializes a magnaserv for the styles of conf. Styles are
+// served below /prefix/, or / if prefix is empty.
+func newMagnaserv(conf *config.Magnacarto, prefix string, opts serverOptions) (*magnaserv, error) {
+	if conf.MapServer.Bin == "" {
+		conf.MapServer.Bin = "mapserv"
+	}
+
+	stylesDir := conf.StylesDir
+	if !filepath.IsAbs(stylesDir) {
+		stylesDir = filepath.Join(conf.BaseDir, stylesDir)
+	}
+	stylesDir, err := filepath.Abs(stylesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	builderCache := builder.NewCache(conf.Locator(), conf.DeferEval)
+	logger := opts.logger
+	if prefix != "" {
+		logger = logger.With("root", prefix)
+	}
+	builderCache.SetLogger(logger)
+	builderCache.SetBackgroundRebuild(opts.backgroundRebuild)
+	builderCache.SetHooks(conf.Hooks)
+	builderCache.SetCartoCompat(conf.CartoCompat)
+	builderCache.SetMetadata(opts.metadata)
+	if conf.OutDir != "" {
+		if err := os.MkdirAll(conf.OutDir, 0755); err != nil {
+			return nil, err
+		}
+		builderCache.SetDestination(conf.OutDir)
+	}
+
+	thumbnailBBOX := opts.thumbnailBBOX
+	if thumbnailBBOX == [4]float64{} {
+		thumbnailBBOX = worldBBOX
+	}
+	thumbnailSize := opts.thumbnailSize
+	if thumbnailSize <= 0 {
+		thumbnailSize = 256
+	}
+
+	s := &magnaserv{
+		config:     conf,
+		builder:    builderCache,
+		stylesDir:  stylesDir,
+		prefix:     prefix,
+		pngEncoder: opts.pngEncoder,
+		workers:    opts.workers,
+		metrics:    opts.metrics,
+		edit:       opts.edit,
+		metadata:   opts.metadata,
+		sessions:   newSessions(opts.sessionTimeout, builderCache.Evict),
+		thumbnails: newThumbnails(thumbnailBBOX, thumbnailSize),
+	}
+	builderCache.SetObserver(styleObserver{metrics: opts.metrics, s: s})
+	return s, nil
+}
+
+// handle registers all handlers of s.
+func (s *magnaserv) handle(mux *http.ServeMux) {
+	base := s.basePath()
+	mux.HandleFunc(base+"api/map", s.render)
+	mux.HandleFunc(base+"api/groups", s.groups)
+	mux.HandleFunc(base+"api/layers", s.layers)
+	mux.HandleFunc(base+"api/layers/order", s.layerOrder)
+	mux.HandleFunc(base+"api/layers/zoom", s.layerZoom)
+	mux.HandleFunc(base+"api/session", s.session)
+	mux.HandleFunc(base+"api/variables", s.variables)
+	mux.HandleFunc(base+"api/metadata", s.styleMetadata)
+	mux.HandleFunc(base+"api/tiles/", s.tile)
+	mux.HandleFunc(base+"api/tilejson", s.tileJSON)
+	mux.HandleFunc(base+"api/gallery", s.gallery)
+	mux.HandleFunc(base+"api/gallery/thumbnail", s.galleryThumbnail)
+	mux.HandleFunc(base+"api/zoomstrip", s.zoomStrip)
+}
+
+// basePath returns the URL path below which all handlers of s are
+// registered, with a trailing slash.
+func (s *magnaserv) basePath() string {
+	if s.prefix != "" {
+		return "/" + s.prefix + "/"
+	}
+	return "/"
+}
+
+// project returns the name of mml for logs and metrics, relative to the
+// styles dir and prefixed with the root prefix.
+func (s *magnaserv) project(mml string) string {
+	name := mml
+	if rel, err := filepath.Rel(s.stylesDir, mml); err == nil {
+		name = filepath.ToSlash(rel)
+	}
+	if s.prefix != "" {
+		name = path.Join(s.prefix, name)
+	}
+	return name
+}
+
+// close removes temporary styles and all session overrides. Styles in
+// out_dir are kept for inspection.
+func (s *magnaserv) close() {
+	s.sessions.close()
+	if s.config.OutDir == "" {
+		s.builder.ClearAll()
+	}
+}
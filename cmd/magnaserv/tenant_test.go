@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRootList(t *testing.T) {
+	var l rootList
+	if err := l.Set("carto=carto/magnacarto.tml,data=/srv/data.tml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Set("osm=osm.tml"); err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 3 || l[0] != (root{"carto", "carto/magnacarto.tml"}) || l[2] != (root{"osm", "osm.tml"}) {
+		t.Fatal("unexpected roots", l)
+	}
+	if s := l.String(); s != "carto=carto/magnacarto.tml,data=/srv/data.tml,osm=osm.tml" {
+		t.Error("unexpected string", s)
+	}
+
+	for _, v := range []string{"carto=other.tml", "carto", "x=", "a/b=c.tml", "api=api.tml", "=c.tml"} {
+		if err := l.Set(v); err == nil {
+			t.Error("expected error for", v)
+		}
+	}
+}
+
+func TestRootRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	(&magnaserv{prefix: "carto", stylesDir: "/carto"}).handle(mux)
+	(&magnaserv{stylesDir: "/default"}).handle(mux)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{"/carto/api/map", http.StatusBadRequest}, // invalid bbox
+		{"/api/map", http.StatusBadRequest},
+		{"/data/api/map", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.status {
+			t.Error(tc.path, w.Code)
+		}
+	}
+}
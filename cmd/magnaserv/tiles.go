@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/render"
+)
+
+const tileSize = 256
+
+// worldBBOX is the bbox of the spherical mercator grid in EPSG:3857.
+var worldBBOX = [4]float64{-20037508.342789244, -20037508.342789244, 20037508.342789244, 20037508.342789244}
+
+// webMercatorBounds are the bounds of the spherical mercator grid in
+// EPSG:4326.
+var webMercatorBounds = [4]float64{-180, -85.0511287798, 180, 85.0511287798}
+
+// tile serves XYZ tiles in EPSG:3857 at /api/tiles/{z}/{x}/{y}.{png,jpeg,webp}
+// and the UTFGrid of the interactivity layer of the project at
+// /api/tiles/{z}/{x}/{y}.grid.json. All other parameters are the same as for
+// /api/map.
+func (s *magnaserv) tile(w http.ResponseWriter, r *http.Request) {
+	tilePath := strings.TrimPrefix(r.URL.Path, s.basePath()+"api/tiles/")
+	z, x, y, ext, err := parseTilePath(tilePath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	bbox := tileBBOX(z, x, y)
+
+	if ext == "grid.json" {
+		s.grid(w, r, bbox)
+		return
+	}
+
+	// render like /api/map, the extension takes precedence over the format
+	// parameter and the Accept header
+	q := r.URL.Query()
+	q.Set("bbox", fmt.Sprintf("%f,%f,%f,%f", bbox[0], bbox[1], bbox[2], bbox[3]))
+	q.Set("width", strconv.Itoa(tileSize))
+	q.Set("height", strconv.Itoa(tileSize))
+	q.Set("srs", "EPSG:3857")
+	q.Set("format", ext)
+	r = r.Clone(r.Context())
+	r.URL.RawQuery = q.Encode()
+	s.render(w, r)
+}
+
+// grid renders the UTFGrid of the interactivity layer (Mapnik only).
+func (s *magnaserv) grid(w http.ResponseWriter, r *http.Request, bbox [4]float64) {
+	mmlFile, err := s.stylePath(r.URL.Query().Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.Interactivity == nil {
+		http.Error(w, "project has no interactivity", http.StatusNotFound)
+		return
+	}
+	mapReq := render.Request{
+		Width:    tileSize,
+		Height:   tileSize,
+		BBOX:     bbox,
+		EPSGCode: 3857,
+		Grid: &render.GridRequest{
+			Layer:  m.Interactivity.Layer,
+			Fields: m.Interactivity.Fields,
+		},
+	}
+	s.renderMap(w, r, mapReq, "application/json")
+}
+
+// parseTilePath parses z/x/y.ext. ext is grid.json or an image format.
+func parseTilePath(tilePath string) (z, x, y int, ext string, err error) {
+	parts := strings.Split(tilePath, "/")
+	if len(parts) != 3 {
+		return 0, 0, 0, "", fmt.Errorf("invalid tile %s, expected z/x/y.png", tilePath)
+	}
+	i := strings.Index(parts[2], ".")
+	if i < 0 {
+		return 0, 0, 0, "", fmt.Errorf("invalid tile %s, expected z/x/y.png", tilePath)
+	}
+	parts[2], ext = parts[2][:i], parts[2][i+1:]
+	if _, ok := formatAliases[ext]; !ok && ext != "grid.json" {
+		return 0, 0, 0, "", fmt.Errorf("unsupported tile format %s", ext)
+	}
+	var zxy [3]int
+	for i, p := range parts {
+		if zxy[i], err = strconv.Atoi(p); err != nil {
+			return 0, 0, 0, "", fmt.Errorf("invalid tile %s, expected z/x/y.png", tilePath)
+		}
+	}
+	z, x, y = zxy[0], zxy[1], zxy[2]
+	if z < 0 || z > 30 || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		return 0, 0, 0, "", fmt.Errorf("tile %s outside of the grid", tilePath)
+	}
+	return z, x, y, ext, nil
+}
+
+// tileBBOX returns the EPSG:3857 bbox of the XYZ tile.
+func tileBBOX(z, x, y int) [4]float64 {
+	const origin = 20037508.342789244
+	res := 2 * origin / float64(int(1)<<uint(z))
+	minx := -origin + float64(x)*res
+	maxy := origin - float64(y)*res
+	return [4]float64{minx, maxy - res, minx + res, maxy}
+}
+
+// tileJSON serves the TileJSON 2.2.0 of a project, with the tile URLs of
+// /api/tiles. The grids and template are only included for projects with
+// interactivity. All parameters (e.g. builder, groups or var) are passed to
+// the tile URLs. The format parameter selects the format of the tiles.
+func (s *magnaserv) tileJSON(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mmlFile, err := s.stylePath(q.Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ext := "png"
+	if f := q.Get("format"); f != "" {
+		mimeType, err := negotiateFormat(f, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ext = strings.TrimPrefix(mimeType, "image/")
+		q.Del("format")
+	}
+
+	tilesURL := requestOrigin(r) + s.basePath() + "api/tiles/{z}/{x}/{y}."
+	tj := tileJSONDoc{
+		TileJSON: "2.2.0",
+		Name:     s.project(mmlFile),
+		Scheme:   "xyz",
+		Tiles:    []string{tilesURL + ext + "?" + q.Encode()},
+		MaxZoom:  18,
+		Bounds:   webMercatorBounds,
+	}
+	if m.MinZoom != nil {
+		tj.MinZoom = *m.MinZoom
+	}
+	if m.MaxZoom != nil {
+		tj.MaxZoom = *m.MaxZoom
+	}
+	if m.Bounds != nil {
+		tj.Bounds = *m.Bounds
+	}
+	if m.Interactivity != nil {
+		tj.Grids = []string{tilesURL + "grid.json?" + q.Encode()}
+		tj.Template = m.Interactivity.Template
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tj)
+}
+
+type tileJSONDoc struct {
+	TileJSON string     `json:"tilejson"`
+	Name     string     `json:"name"`
+	Scheme   string     `json:"scheme"`
+	Tiles    []string   `json:"tiles"`
+	Grids    []string   `json:"grids,omitempty"`
+	Template string     `json:"template,omitempty"`
+	MinZoom  int        `json:"minzoom"`
+	MaxZoom  int        `json:"maxzoom"`
+	Bounds   [4]float64 `json:"bounds"`
+}
+
+// requestOrigin returns the scheme and host of r, e.g. http://localhost:7070.
+// X-Forwarded-Proto and X-Forwarded-Host of reverse proxies take
+// precedence.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if fwd := r.Header.Get("X-Forwarded-Host"); fwd != "" {
+		host = fwd
+	}
+	return scheme + "://" + host
+}
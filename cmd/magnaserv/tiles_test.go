@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+func TestParseTilePath(t *testing.T) {
+	for _, tc := range []struct {
+		path    string
+		z, x, y int
+		ext     string
+	}{
+		{"0/0/0.png", 0, 0, 0, "png"},
+		{"12/2138/1391.webp", 12, 2138, 1391, "webp"},
+		{"3/7/0.grid.json", 3, 7, 0, "grid.json"},
+	} {
+		z, x, y, ext, err := parseTilePath(tc.path)
+		if err != nil {
+			t.Error(tc.path, err)
+			continue
+		}
+		if z != tc.z || x != tc.x || y != tc.y || ext != tc.ext {
+			t.Error("unexpected tile", tc.path, z, x, y, ext)
+		}
+	}
+	for _, p := range []string{"0/0/0", "0/0.png", "1/2/0.png", "0/0/-1.png", "0/0/0.gif", "a/0/0.png"} {
+		if _, _, _, _, err := parseTilePath(p); err == nil {
+			t.Error("expected error for", p)
+		}
+	}
+}
+
+func TestTileBBOX(t *testing.T) {
+	const origin = 20037508.342789244
+	for _, tc := range []struct {
+		z, x, y  int
+		expected [4]float64
+	}{
+		{0, 0, 0, [4]float64{-origin, -origin, origin, origin}},
+		{1, 1, 0, [4]float64{0, 0, origin, origin}},
+		{1, 0, 1, [4]float64{-origin, -origin, 0, 0}},
+	} {
+		bbox := tileBBOX(tc.z, tc.x, tc.y)
+		for i := range bbox {
+			if math.Abs(bbox[i]-tc.expected[i]) > 1e-6 {
+				t.Error("unexpected bbox", tc.z, tc.x, tc.y, bbox)
+				break
+			}
+		}
+	}
+}
+
+func TestTileJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"plain.mml": `{"Stylesheet": ["style.mss"], "Layer": [{"name": "roads"}]}`,
+		"interactive.mml": `{"Stylesheet": ["style.mss"], "minzoom": 2, "maxzoom": 12, "bounds": [5, 47, 15, 55],
+			"interactivity": {"layer": "roads", "fields": "name", "template_teaser": "{{name}}"},
+			"Layer": [{"name": "roads"}]}`,
+		"style.mss": "#roads { line-width: 1; }",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newMagnaserv(&config.Magnacarto{StylesDir: dir}, "carto", serverOptions{
+		logger:  logging.Default(),
+		metrics: newServerMetrics(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	w := httptest.NewRecorder()
+	s.tileJSON(w, httptest.NewRequest("GET", "http://example.org/carto/api/tilejson?mml=plain.mml&format=webp", nil))
+	if w.Code != 200 {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	var tj tileJSONDoc
+	if err := json.Unmarshal(w.Body.Bytes(), &tj); err != nil {
+		t.Fatal(err)
+	}
+	if len(tj.Tiles) != 1 || tj.Tiles[0] != "http://example.org/carto/api/tiles/{z}/{x}/{y}.webp?mml=plain.mml" {
+		t.Error("unexpected tiles", tj.Tiles)
+	}
+	if tj.Grids != nil || tj.Template != "" || tj.MinZoom != 0 || tj.MaxZoom != 18 || tj.Bounds != webMercatorBounds {
+		t.Errorf("unexpected tilejson %#v", tj)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://example.org/carto/api/tilejson?mml=interactive.mml&builder=mapnik3", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	s.tileJSON(w, r)
+	tj = tileJSONDoc{}
+	if err := json.Unmarshal(w.Body.Bytes(), &tj); err != nil {
+		t.Fatal(err)
+	}
+	if len(tj.Grids) != 1 || tj.Grids[0] != "https://example.org/carto/api/tiles/{z}/{x}/{y}.grid.json?builder=mapnik3&mml=interactive.mml" {
+		t.Error("unexpected grids", tj.Grids)
+	}
+	if tj.Template != "{{#__teaser__}}{{name}}{{/__teaser__}}" || tj.MinZoom != 2 || tj.MaxZoom != 12 || tj.Bounds != [4]float64{5, 47, 15, 55} {
+		t.Errorf("unexpected tilejson %#v", tj)
+	}
+
+	w = httptest.NewRecorder()
+	s.tile(w, httptest.NewRequest("GET", "/carto/api/tiles/0/0/0.grid.json?mml=plain.mml", nil))
+	if w.Code != 404 {
+		t.Error("unexpected status for grid without interactivity", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.tile(w, httptest.NewRequest("GET", "/carto/api/tiles/0/0/0.grid.json?mml=interactive.mml&builder=mapserver", nil))
+	if w.Code != 400 {
+		t.Error("unexpected status for MapServer grid", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.tile(w, httptest.NewRequest("GET", "/carto/api/tiles/1/2/0.png?mml=plain.mml", nil))
+	if w.Code != 404 {
+		t.Error("unexpected status for tile outside of the grid", w.Code)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+type variableInfo struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Origin string `json:"origin"`
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line,omitempty"`
+}
+
+// variables lists all MSS variables of an MML with their final value and
+// origin (default, file or override) as JSON. Variables are overridden
+// with the same var parameters as /api/map (e.g. var=water=#a0c8f0).
+func (s *magnaserv) variables(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mmlFile, err := s.stylePath(q.Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	variant, err := parseVariant(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	target := q.Get("builder")
+	if target == "" {
+		target = "mapnik2"
+	}
+
+	vars, err := s.resolveVariables(mmlFile, target, variant.Vars)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	result := []variableInfo{}
+	for _, v := range vars {
+		info := variableInfo{
+			Name:   v.Name,
+			Value:  fmt.Sprint(v.Value),
+			Origin: string(v.Origin),
+			Line:   v.Line,
+		}
+		if v.File != "" {
+			info.File = s.project(v.File)
+		}
+		result = append(result, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"variables": result})
+}
+
+// resolveVariables parses all stylesheets of mmlFile, like the builder for
+// target.
+func (s *magnaserv) resolveVariables(mmlFile, target string, overrides map[string]string) ([]mss.Variable, error) {
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		return nil, err
+	}
+	d := mss.New()
+	if s.config.DeferEval {
+		d.EnableDeferredEval()
+	}
+	d.Define("target", target)
+	for name, value := range overrides {
+		if err := d.SetVar(name, value); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range m.Stylesheets {
+		if !filepath.IsAbs(f) {
+			f = filepath.Join(filepath.Dir(mmlFile), f)
+		}
+		if err := d.ParseFile(f); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.Evaluate(); err != nil {
+		return nil, err
+	}
+	return d.Variables(), nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/magnacarto/config"
+)
+
+func TestVariables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"test.mml":  `{"Stylesheet": ["base.mss", "style.mss"], "Layer": [{"name": "roads"}]}`,
+		"base.mss":  "@water: #a0c8f0 !default;\n@width: 1;",
+		"style.mss": "@if target = mapserver { @width: 2; }\n#roads { line-width: @width; }",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &magnaserv{stylesDir: dir, config: &config.Magnacarto{}}
+	for _, tc := range []struct {
+		query    string
+		expected []variableInfo
+	}{
+		{"mml=test.mml", []variableInfo{
+			{Name: "water", Value: "#a0c8f0", Origin: "default", File: "base.mss", Line: 1},
+			{Name: "width", Value: "1", Origin: "file", File: "base.mss", Line: 2},
+		}},
+		{"mml=test.mml&builder=mapserver&var=water=%23ff0000", []variableInfo{
+			{Name: "water", Value: "#ff0000", Origin: "override", File: "base.mss", Line: 1},
+			{Name: "width", Value: "2", Origin: "file", File: "style.mss", Line: 1},
+		}},
+	} {
+		w := httptest.NewRecorder()
+		s.variables(w, httptest.NewRequest("GET", "/api/variables?"+tc.query, nil))
+		if w.Code != 200 {
+			t.Fatal(w.Code, w.Body.String())
+		}
+		var resp struct{ Variables []variableInfo }
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(resp.Variables, tc.expected) {
+			t.Errorf("unexpected variables for %s: %#v", tc.query, resp.Variables)
+		}
+	}
+
+	for query, status := range map[string]int{
+		"mml=test.mml&var=width=(":     422,
+		"mml=test.mml&var=width":       400,
+		"mml=../test.mml":              400,
+		"mml=missing.mml&var=width=10": 422,
+	} {
+		w := httptest.NewRecorder()
+		s.variables(w, httptest.NewRequest("GET", "/api/variables?"+query, nil))
+		if w.Code != status {
+			t.Error("unexpected status", w.Code, "for", query)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/omniscale/magnacarto/mml"
+	"github.com/omniscale/magnacarto/preview"
+	"github.com/omniscale/magnacarto/render"
+)
+
+const (
+	// stripGap is the space between the maps of a zoom strip in pixels
+	stripGap = 4
+	// stripConcurrency is the number of concurrent renders of a zoom strip,
+	// so that a single strip does not fill the render queue
+	stripConcurrency = 4
+	maxStripSize     = 1024
+	// maxStripPixels limits the size of the contact sheet (32MB as RGBA)
+	maxStripPixels = 8 << 20
+)
+
+// zoomStrip renders the same center at each zoom level and combines all maps
+// into a single PNG contact sheet, row by row with the zoom level in the
+// top left corner of each map. Each map has the resolution of the XYZ tiles
+// of its zoom level.
+//
+// Parameters are center=lon,lat (defaults to the center of the bounds of the
+// MML), size (of each map in pixels, defaults to 256), minzoom and maxzoom
+// (default 0-20, maxzoom defaults to minzoom above 20) and cols (defaults to
+// 7). Sheets larger than maxStripPixels are rejected. All other parameters
+// (e.g. builder, groups, var or session) are the same as for /api/map.
+func (s *magnaserv) zoomStrip(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	mmlFile, err := s.stylePath(q.Get("mml"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var center [2]float64
+	if c := q.Get("center"); c != "" {
+		if center, err = parseCenter(c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if m.Bounds != nil {
+		center = [2]float64{(m.Bounds[0] + m.Bounds[2]) / 2, (m.Bounds[1] + m.Bounds[3]) / 2}
+	} else {
+		http.Error(w, "missing center, the project has no bounds", http.StatusBadRequest)
+		return
+	}
+
+	size, err := intParam(q.Get("size"), 256, 1, maxStripSize)
+	if err != nil {
+		http.Error(w, "invalid size: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	minZoom, err := intParam(q.Get("minzoom"), 0, 0, 30)
+	if err != nil {
+		http.Error(w, "invalid minzoom: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defaultMaxZoom := 20
+	if minZoom > defaultMaxZoom {
+		defaultMaxZoom = minZoom
+	}
+	maxZoom, err := intParam(q.Get("maxzoom"), defaultMaxZoom, minZoom, 30)
+	if err != nil {
+		http.Error(w, "invalid maxzoom: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cols, err := intParam(q.Get("cols"), 7, 1, 31)
+	if err != nil {
+		http.Error(w, "invalid cols: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if b := sheetBounds(maxZoom-minZoom+1, size, cols); b.Dx()*b.Dy() > maxStripPixels {
+		http.Error(w, fmt.Sprintf("zoom strip of %dx%d pixels is too large, reduce size or the number of zoom levels", b.Dx(), b.Dy()), http.StatusBadRequest)
+		return
+	}
+
+	st, status, err := s.buildStyle(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	logger := requestLogger(r)
+	maps, err := s.renderZooms(r.Context(), st, center, size, minZoom, maxZoom)
+	if err == context.Canceled {
+		logger.Debug("zoom strip request cancelled", "mml", st.mml)
+		return
+	}
+	if err != nil {
+		logger.Error("error rendering zoom strip", "mml", st.mml, "style", st.file, "err", err)
+		http.Error(w, err.Error(), renderErrorStatus(err))
+		return
+	}
+
+	sheet := contactSheet(maps, minZoom, size, cols)
+	buf := bytes.Buffer{}
+	if s.pngEncoder != nil {
+		err = timedEncoder{Encoder: s.pngEncoder, format: "image/png", metrics: s.metrics}.Encode(&buf, sheet)
+	} else {
+		err = png.Encode(&buf, sheet)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if st.isPreview() {
+		w.Header().Set("X-Magnacarto-Renderer", "preview; approximate")
+	}
+	w.Write(buf.Bytes())
+}
+
+// renderZooms renders center (EPSG:4326) at all zoom levels. The first error
+// cancels all other renders.
+func (s *magnaserv) renderZooms(ctx context.Context, st mapStyle, center [2]float64, size, minZoom, maxZoom int) ([]image.Image, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	maps := make([]image.Image, maxZoom-minZoom+1)
+	errs := make([]error, len(maps))
+	sem := make(chan struct{}, stripConcurrency)
+	wg := sync.WaitGroup{}
+	for i := range maps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if ctx.Err() != nil {
+				errs[i] = ctx.Err()
+				return
+			}
+			mapReq := render.Request{
+				Width:    size,
+				Height:   size,
+				BBOX:     zoomBBOX(center, minZoom+i, size),
+				EPSGCode: 3857,
+			}
+			b, err := s.renderStyle(ctx, st, mapReq, "image/png")
+			if err == nil {
+				maps[i], _, err = image.Decode(bytes.NewReader(b))
+			}
+			if err != nil {
+				errs[i] = err
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// return the error that cancelled the other renders
+	var result error
+	for _, err := range errs {
+		if err != nil && err != context.Canceled {
+			return nil, err
+		}
+		if err != nil {
+			result = err
+		}
+	}
+	return maps, result
+}
+
+// zoomBBOX returns the EPSG:3857 bbox of a map with size×size pixels around
+// center (EPSG:4326), with the resolution of the XYZ tiles of zoom.
+func zoomBBOX(center [2]float64, zoom, size int) [4]float64 {
+	const origin = 20037508.342789244
+	lat := math.Max(-webMercatorBounds[3], math.Min(webMercatorBounds[3], center[1]))
+	x := center[0] * origin / 180
+	y := math.Log(math.Tan((90+lat)*math.Pi/360)) / math.Pi * origin
+	res := 2 * origin / float64(tileSize) / math.Pow(2, float64(zoom))
+	half := float64(size) / 2 * res
+	return [4]float64{x - half, y - half, x + half, y + half}
+}
+
+// contactSheet combines maps into rows of cols maps, with the zoom level in
+// the top left corner of each map.
+func contactSheet(maps []image.Image, minZoom, size, cols int) *image.RGBA {
+	if cols > len(maps) {
+		cols = len(maps)
+	}
+	sheet := image.NewRGBA(sheetBounds(len(maps), size, cols))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{color.RGBA{204, 204, 204, 255}}, image.Point{}, draw.Src)
+	for i, m := range maps {
+		x := stripGap + (i%cols)*(size+stripGap)
+		y := stripGap + (i/cols)*(size+stripGap)
+		cell := image.Rect(x, y, x+size, y+size)
+		// maps are drawn over white, as styles can be transparent
+		draw.Draw(sheet, cell, image.White, image.Point{}, draw.Src)
+		draw.Draw(sheet, cell, m, m.Bounds().Min, draw.Over)
+		preview.DrawLabel(sheet, fmt.Sprintf("z%d", minZoom+i), x+4, y+4, 2)
+	}
+	return sheet
+}
+
+// sheetBounds returns the size of a contact sheet with n maps.
+func sheetBounds(n, size, cols int) image.Rectangle {
+	if cols > n {
+		cols = n
+	}
+	rows := (n + cols - 1) / cols
+	return image.Rect(0, 0, cols*(size+stripGap)+stripGap, rows*(size+stripGap)+stripGap)
+}
+
+// parseCenter parses lon,lat.
+func parseCenter(c string) ([2]float64, error) {
+	parts := strings.Split(c, ",")
+	if len(parts) == 2 {
+		lon, errLon := strconv.ParseFloat(parts[0], 64)
+		lat, errLat := strconv.ParseFloat(parts[1], 64)
+		if errLon == nil && errLat == nil && lon >= -180 && lon <= 180 && lat >= -90 && lat <= 90 {
+			return [2]float64{lon, lat}, nil
+		}
+	}
+	return [2]float64{}, fmt.Errorf("invalid center '%s', expected lon,lat", c)
+}
+
+// intParam parses v, or returns def if v is empty.
+func intParam(v string, def, min, max int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("'%s' is not a number", v)
+	}
+	if i < min || i > max {
+		return 0, fmt.Errorf("%d is not in %d-%d", i, min, max)
+	}
+	return i, nil
+}
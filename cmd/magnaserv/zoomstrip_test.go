@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omniscale/magnacarto/config"
+	"github.com/omniscale/magnacarto/logging"
+)
+
+func TestZoomStrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnaserv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"test.mml": `{"Stylesheet": ["test.mss"], "bounds": [5, 47, 15, 55], "Layer": [
+			{"name": "land", "group": "land", "srs": "+init=epsg:4326", "Datasource": {"inline": {"type": "Polygon", "coordinates": [[[0, 40], [20, 40], [20, 60], [0, 60], [0, 40]]]}}}
+		]}`,
+		"test.mss": "Map { background-color: red; } #land { polygon-fill: blue; }",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newMagnaserv(&config.Magnacarto{StylesDir: dir}, "", serverOptions{
+		logger:  logging.Default(),
+		metrics: newServerMetrics(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	strip := func(query string) image.Image {
+		w := httptest.NewRecorder()
+		s.zoomStrip(w, httptest.NewRequest("GET", "/api/zoomstrip?mml=test.mml&builder=preview&"+query, nil))
+		if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" {
+			t.Fatal("unexpected response", w.Code, w.Body.String())
+		}
+		img, err := png.Decode(bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	// 21 zoom levels in 7 columns
+	img := strip("size=32")
+	if b := img.Bounds(); b.Dx() != 7*(32+stripGap)+stripGap || b.Dy() != 3*(32+stripGap)+stripGap {
+		t.Fatal("unexpected size", b)
+	}
+
+	// all maps are centered on the center of the bounds, the polygon
+	// fills the z5 map but only the center of the z0 map
+	img = strip("size=64&minzoom=0&maxzoom=5&cols=2")
+	if b := img.Bounds(); b.Dx() != 2*(64+stripGap)+stripGap || b.Dy() != 3*(64+stripGap)+stripGap {
+		t.Fatal("unexpected size", b)
+	}
+	z0 := func(x, y int) color.Color { return img.At(stripGap+x, stripGap+y) }
+	z5 := func(x, y int) color.Color { return img.At(2*stripGap+64+x, 3*stripGap+2*64+y) }
+	assertColor(t, z5(32, 32), color.RGBA{0, 0, 255, 255})
+	assertColor(t, z0(2, 30), color.RGBA{255, 0, 0, 255})
+	assertColor(t, z0(32, 32), color.RGBA{0, 0, 255, 255})
+	assertColor(t, img.At(0, 0), color.RGBA{204, 204, 204, 255})
+
+	// layer groups can be toggled
+	img = strip("size=64&minzoom=5&maxzoom=5&groups=land:off&center=10,50")
+	assertColor(t, img.At(stripGap+32, stripGap+32), color.RGBA{255, 0, 0, 255})
+
+	// maxzoom defaults to minzoom above z20
+	img = strip("size=16&minzoom=22")
+	if b := img.Bounds(); b.Dx() != 16+2*stripGap || b.Dy() != 16+2*stripGap {
+		t.Fatal("unexpected size", b)
+	}
+	img = strip("size=16&minzoom=21&cols=3")
+	if b := img.Bounds(); b.Dx() != 16+2*stripGap || b.Dy() != 16+2*stripGap {
+		t.Fatal("unexpected size", b)
+	}
+
+	for _, query := range []string{"mml=test.mml&size=0", "mml=test.mml&minzoom=0&maxzoom=30&size=1024", "mml=test.mml&minzoom=22&maxzoom=21", "mml=test.mml&minzoom=10&maxzoom=5", "mml=test.mml&center=200,0", "mml=../test.mml"} {
+		w := httptest.NewRecorder()
+		s.zoomStrip(w, httptest.NewRequest("GET", "/api/zoomstrip?"+query, nil))
+		if w.Code != 400 {
+			t.Error("unexpected status for", query, w.Code)
+		}
+	}
+}
+
+func assertColor(t *testing.T, c color.Color, expected color.RGBA) {
+	t.Helper()
+	r, g, b, a := c.RGBA()
+	if (color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), uint8(a >> 8)}) != expected {
+		t.Errorf("unexpected color %v, expected %v", c, expected)
+	}
+}
+
+func TestZoomBBOX(t *testing.T) {
+	// a single tile at z0 covers the whole grid
+	bbox := zoomBBOX([2]float64{0, 0}, 0, tileSize)
+	for i := range bbox {
+		if d := bbox[i] - worldBBOX[i]; d > 1e-6 || d < -1e-6 {
+			t.Fatal("unexpected bbox", bbox)
+		}
+	}
+	bbox = zoomBBOX([2]float64{7.1, 50.7}, 10, 512)
+	if w := bbox[2] - bbox[0]; w < 78271.5 || w > 78271.6 {
+		t.Error("unexpected width", w)
+	}
+}
@@ -16,9 +16,11 @@ type Magnacarto struct {
 	MapServer   MapServer
 	StylesDir   string `toml:"styles_dir"`
 	DeferEval   bool   `toml:"deferred_eval"`
+	CartoCompat bool   `toml:"carto_compat"`
 	OutDir      string `toml:"out_dir"`
 	Datasources Datasource
 	PostGIS     PostGIS
+	Hooks       Hooks
 	BaseDir     string
 }
 
@@ -39,6 +41,13 @@ type Datasource struct {
 	ImageDirs     []string `toml:"image_dirs"`
 }
 
+// Hooks are shell commands that run after each style build in watch mode
+// and in magnaserv.
+type Hooks struct {
+	OnSuccess []string `toml:"on_success"`
+	OnFailure []string `toml:"on_failure"`
+}
+
 type PostGIS struct {
 	Host     string
 	Port     string
@@ -125,7 +134,10 @@ func (l *StaticLocator) path(basename, dir string) string {
 }
 
 func (l *StaticLocator) Font(basename string) string {
-	return filepath.Join(basename, l.fontDir)
+	if l.fontDir == "" {
+		return basename
+	}
+	return filepath.Join(l.fontDir, basename)
 }
 func (l *StaticLocator) SQLite(basename string) string {
 	return l.path(basename, l.sqliteDir)
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -19,3 +20,17 @@ func TestFontVariations(t *testing.T) {
 		t.Fatal(variations)
 	}
 }
+
+func TestStaticLocator(t *testing.T) {
+	l := &StaticLocator{baseDir: "base", fontDir: "fonts"}
+	if f := l.Font("DejaVuSans.ttf"); f != filepath.Join("fonts", "DejaVuSans.ttf") {
+		t.Error(f)
+	}
+	if f := l.Shape("roads.shp"); f != filepath.Join("base", "roads.shp") {
+		t.Error(f)
+	}
+	l = &StaticLocator{}
+	if f := l.Font("DejaVuSans.ttf"); f != "DejaVuSans.ttf" {
+		t.Error(f)
+	}
+}
@@ -0,0 +1,263 @@
+// Package logging implements a leveled logger with structured key-value
+// fields and optional JSON output.
+package logging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return "level(" + strconv.Itoa(int(l)) + ")"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level for debug, info, warn or error.
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(s, n) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return Warn, nil
+	}
+	return Info, fmt.Errorf("unknown log level '%s'", s)
+}
+
+// output is shared by a Logger and all loggers derived with With.
+type output struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+	now   func() time.Time
+}
+
+// Logger writes log lines with a level, a message and key-value fields.
+// Loggers are safe for concurrent use. All methods of a nil Logger are no-ops.
+type Logger struct {
+	out    *output
+	fields []interface{}
+	hooks  []hook
+}
+
+// Entry is a single message passed to the function of Tee.
+type Entry struct {
+	Level Level
+	Msg   string
+	// Fields are the key-value pairs of With and of the call.
+	Fields []interface{}
+}
+
+// Field returns the value of the first field with key, or nil.
+func (e Entry) Field(key string) interface{} {
+	for i := 0; i+1 < len(e.Fields); i += 2 {
+		if e.Fields[i] == key {
+			return e.Fields[i+1]
+		}
+	}
+	return nil
+}
+
+type hook struct {
+	level Level
+	fn    func(Entry)
+}
+
+// New creates a Logger that writes all messages with level or above to w.
+// Messages are written as JSON objects if json is true, otherwise as text
+// lines with key=value fields.
+func New(w io.Writer, level Level, json bool) *Logger {
+	return &Logger{out: &output{w: w, level: level, json: json, now: time.Now}}
+}
+
+var std = New(os.Stderr, Info, false)
+
+// Default returns the default Logger, writing text lines with level info and
+// above to stderr.
+func Default() *Logger {
+	return std
+}
+
+// With returns a Logger that adds the key-value pairs to each message.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, fields: fields, hooks: l.hooks}
+}
+
+// Tee returns a Logger that also passes all messages with level or above to
+// fn, independent of the level of l. Loggers derived with With keep calling
+// fn. fn is called before the message is written and it can be called
+// concurrently.
+func (l *Logger) Tee(level Level, fn func(Entry)) *Logger {
+	if l == nil {
+		return nil
+	}
+	hooks := make([]hook, 0, len(l.hooks)+1)
+	hooks = append(hooks, l.hooks...)
+	hooks = append(hooks, hook{level: level, fn: fn})
+	return &Logger{out: l.out, fields: l.fields, hooks: hooks}
+}
+
+// Enabled returns whether messages with level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.out.level
+}
+
+// Log writes a message with level.
+func (l *Logger) Log(level Level, msg string, keyvals ...interface{}) { l.log(level, msg, keyvals) }
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(Debug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(Info, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(Warn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(Error, msg, keyvals) }
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if l == nil {
+		return
+	}
+	enabled := l.Enabled(level)
+	if !enabled && len(l.hooks) == 0 {
+		return
+	}
+	fields := l.fields
+	if len(keyvals) > 0 {
+		fields = append(fields[:len(fields):len(fields)], keyvals...)
+	}
+	if len(fields)%2 != 0 {
+		fields = append(fields[:len(fields):len(fields)], "(MISSING)")
+	}
+	for _, h := range l.hooks {
+		if level >= h.level {
+			h.fn(Entry{Level: level, Msg: msg, Fields: fields})
+		}
+	}
+	if !enabled {
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	t := l.out.now().UTC().Format(time.RFC3339Nano)
+	if l.out.json {
+		writeJSON(buf, t, level, msg, fields)
+	} else {
+		writeText(buf, t, level, msg, fields)
+	}
+
+	l.out.mu.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.mu.Unlock()
+}
+
+func writeText(buf *bytes.Buffer, t string, level Level, msg string, fields []interface{}) {
+	buf.WriteString(t)
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(level.String()))
+	buf.WriteByte(' ')
+	buf.WriteString(msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+		v := fmt.Sprint(value(fields[i+1]))
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = strconv.Quote(v)
+		}
+		buf.WriteString(v)
+	}
+	buf.WriteByte('\n')
+}
+
+func writeJSON(buf *bytes.Buffer, t string, level Level, msg string, fields []interface{}) {
+	buf.WriteString(`{"time":`)
+	writeJSONValue(buf, t)
+	buf.WriteString(`,"level":`)
+	writeJSONValue(buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSONValue(buf, msg)
+	for i := 0; i < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		writeJSONValue(buf, value(fields[i+1]))
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// value converts errors, durations and other Stringers to strings.
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// Writer returns an io.Writer that logs each line with level. It can be used
+// to redirect the output of the standard log package.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{l: l, level: level}
+}
+
+type lineWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.l.log(w.level, line, nil)
+	}
+	return len(p), nil
+}
+
+// NewID returns a random ID to correlate log messages of requests and builds.
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+func testLogger(buf *bytes.Buffer, level Level, json bool) *Logger {
+	l := New(buf, level, json)
+	l.out.now = func() time.Time { return time.Date(2016, 3, 1, 12, 30, 0, 0, time.UTC) }
+	return l
+}
+
+func TestText(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := testLogger(buf, Info, false).With("request_id", "abc")
+
+	l.Debug("hidden")
+	l.Info("rendered map", "duration", 1500*time.Millisecond, "file", "my style.xml")
+	l.Error("failed", "err", errors.New("boom"), "empty", "", "odd")
+
+	want := `2016-03-01T12:30:00Z INFO rendered map request_id=abc duration=1.5s file="my style.xml"
+2016-03-01T12:30:00Z ERROR failed request_id=abc err=boom empty="" odd=(MISSING)
+`
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", buf.String(), want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := testLogger(buf, Debug, true).With("build_id", "123")
+	l.Debug("build", "layers", 4, "ok", true, "err", errors.New("x"))
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	want := map[string]interface{}{
+		"time":     "2016-03-01T12:30:00Z",
+		"level":    "debug",
+		"msg":      "build",
+		"build_id": "123",
+		"layers":   float64(4),
+		"ok":       true,
+		"err":      "x",
+	}
+	if len(got) != len(want) {
+		t.Fatal("unexpected fields", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("unexpected %s: %v != %v", k, got[k], v)
+		}
+	}
+}
+
+func TestWithDoesNotShareFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := testLogger(buf, Info, false).With("a", 1)
+	l1 := base.With("b", 2)
+	l2 := base.With("c", 3)
+	l1.Info("1")
+	l2.Info("2")
+	want := "2016-03-01T12:30:00Z INFO 1 a=1 b=2\n2016-03-01T12:30:00Z INFO 2 a=1 c=3\n"
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	l.With("a", 1).Error("ignored")
+	if l.Enabled(Error) {
+		t.Error("nil logger enabled")
+	}
+}
+
+func TestTee(t *testing.T) {
+	buf := &bytes.Buffer{}
+	var entries []Entry
+	l := testLogger(buf, Warn, false).Tee(Info, func(e Entry) {
+		entries = append(entries, e)
+	}).With("build_id", "123")
+
+	l.Debug("hidden")
+	l.Info("merged rules", "layer", "roads")
+	l.Warn("missing marker")
+
+	if want := "2016-03-01T12:30:00Z WARN missing marker build_id=123\n"; buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected entries %#v", entries)
+	}
+	if e := entries[0]; e.Level != Info || e.Msg != "merged rules" || e.Field("layer") != "roads" || e.Field("build_id") != "123" {
+		t.Errorf("unexpected entry %#v", e)
+	}
+	if e := entries[1]; e.Level != Warn || e.Msg != "missing marker" || e.Field("layer") != nil {
+		t.Errorf("unexpected entry %#v", e)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := testLogger(buf, Info, false)
+	std := log.New(l.Writer(Warn), "", 0)
+	std.Println("missing marker foo.svg")
+	want := "2016-03-01T12:30:00Z WARN missing marker foo.svg\n"
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, tc := range []struct {
+		s     string
+		level Level
+		err   bool
+	}{
+		{"debug", Debug, false},
+		{"INFO", Info, false},
+		{"warning", Warn, false},
+		{"error", Error, false},
+		{"verbose", Info, true},
+	} {
+		level, err := ParseLevel(tc.s)
+		if (err != nil) != tc.err || level != tc.level {
+			t.Error(tc.s, level, err)
+		}
+	}
+}
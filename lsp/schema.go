@@ -0,0 +1,331 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/omniscale/magnacarto/mml"
+)
+
+// project is an MML project with the names of all layers, classes and the
+// fields of the layer datasources.
+type project struct {
+	mmlFile string
+	modTime time.Time
+	// stylesheets are the absolute paths of all MSS files
+	stylesheets []string
+	layers      []layerSchema
+}
+
+type layerSchema struct {
+	name    string
+	classes []string
+	// source describes the datasource, e.g. the file name
+	source string
+	fields []field
+	// err is the error of reading the fields
+	err error
+}
+
+// field is an attribute of the features of a datasource, with the type of
+// the first value (string, number or boolean).
+type field struct {
+	name string
+	typ  string
+}
+
+// maxParents is the number of parent dirs of a stylesheet that are searched
+// for its project.
+const maxParents = 3
+
+// findProject returns the first MML file that includes mssFile. The dir of
+// mssFile and its parent dirs are searched. Returns an empty string if no
+// project includes mssFile.
+func findProject(mssFile string) string {
+	dir := filepath.Dir(mssFile)
+	for i := 0; i <= maxParents; i++ {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.mml"))
+		sort.Strings(files)
+		for _, f := range files {
+			m, err := mml.Load(f)
+			if err != nil {
+				continue
+			}
+			for _, s := range stylesheetFiles(f, m) {
+				if s == mssFile {
+					return f
+				}
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return ""
+}
+
+// loadProject loads the MML file and the fields of all layers. Relative
+// file names of datasources are resolved from the dir of the MML file.
+func loadProject(mmlFile string) (*project, error) {
+	fi, err := os.Stat(mmlFile)
+	if err != nil {
+		return nil, err
+	}
+	m, err := mml.Load(mmlFile)
+	if err != nil {
+		return nil, err
+	}
+	p := &project{mmlFile: mmlFile, modTime: fi.ModTime(), stylesheets: stylesheetFiles(mmlFile, m)}
+	for _, l := range m.Layers {
+		ls := layerSchema{name: l.Name, classes: l.Classes}
+		ls.source, ls.fields, ls.err = datasourceFields(l.Datasource, filepath.Dir(mmlFile))
+		p.layers = append(p.layers, ls)
+	}
+	return p, nil
+}
+
+// stylesheetFiles returns the absolute paths of all stylesheets of m.
+func stylesheetFiles(mmlFile string, m *mml.MML) []string {
+	var files []string
+	for _, s := range m.Stylesheets {
+		if !filepath.IsAbs(s) {
+			s = filepath.Join(filepath.Dir(mmlFile), s)
+		}
+		if abs, err := filepath.Abs(s); err == nil {
+			s = abs
+		}
+		files = append(files, s)
+	}
+	return files
+}
+
+// layer returns the layer with name.
+func (p *project) layer(name string) (layerSchema, bool) {
+	for _, l := range p.layers {
+		if l.name == name {
+			return l, true
+		}
+	}
+	return layerSchema{}, false
+}
+
+// fields returns the fields of all layers, or of all layers with one of
+// names.
+func (p *project) fields(names []string) []field {
+	seen := make(map[string]bool)
+	var result []field
+	for _, l := range p.layers {
+		if len(names) > 0 && !contains(names, l.name) {
+			continue
+		}
+		for _, f := range l.fields {
+			if !seen[f.name] {
+				seen[f.name] = true
+				result = append(result, f)
+			}
+		}
+	}
+	return result
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// datasourceFields returns the description and the fields of Shapefile,
+// GeoJSON, CSV and inline datasources. The fields of database datasources
+// are not available.
+func datasourceFields(ds mml.Datasource, dir string) (string, []field, error) {
+	var filename string
+	switch ds := ds.(type) {
+	case mml.Shapefile:
+		filename = ds.Filename
+	case mml.OGR:
+		filename = ds.Filename
+	case mml.Contour:
+		filename = ds.Filename
+	case mml.Inline:
+		fields, err := inlineFields(ds)
+		return "inline " + ds.Format, fields, err
+	case mml.PostGIS:
+		return "PostGIS", nil, nil
+	case mml.SQLite:
+		return "SQLite " + ds.Filename, nil, nil
+	case mml.GDAL:
+		return "GDAL " + ds.Filename, nil, nil
+	default:
+		return "", nil, nil
+	}
+	path := filename
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	var fields []field
+	var err error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".shp", ".dbf":
+		fields, err = readFile(strings.TrimSuffix(path, filepath.Ext(path))+".dbf", dbfFields)
+	case ".geojson", ".json":
+		fields, err = readFile(path, geoJSONFields)
+	case ".csv":
+		fields, err = readFile(path, csvFields)
+	}
+	return filename, fields, err
+}
+
+func readFile(filename string, fields func(io.Reader) ([]field, error)) ([]field, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return fields(f)
+}
+
+func inlineFields(ds mml.Inline) ([]field, error) {
+	if ds.Format == "csv" {
+		return csvFields(strings.NewReader(ds.Data))
+	}
+	return geoJSONFields(strings.NewReader(ds.Data))
+}
+
+// dbfFields returns the fields of the header of a dBASE file.
+func dbfFields(r io.Reader) ([]field, error) {
+	head := make([]byte, 32)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.New("not a dBASE file")
+	}
+	headerLength := int(binary.LittleEndian.Uint16(head[8:]))
+	if headerLength < 32 {
+		return nil, errors.New("invalid dBASE header")
+	}
+	b := make([]byte, headerLength-32)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, errors.New("invalid dBASE header")
+	}
+	var fields []field
+	for off := 0; off+32 <= len(b) && b[off] != 0x0d; off += 32 {
+		name := b[off : off+11]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		typ := "string"
+		switch b[off+11] {
+		case 'N', 'F', 'I', 'O', 'B':
+			typ = "number"
+		case 'L':
+			typ = "boolean"
+		}
+		fields = append(fields, field{string(name), typ})
+	}
+	return fields, nil
+}
+
+// maxFeatures is the number of GeoJSON features that are read for the
+// fields, as not all features need to have the same properties.
+const maxFeatures = 100
+
+// geoJSONFields returns the properties of the first features of a GeoJSON
+// FeatureCollection or Feature. The file is not read completely.
+func geoJSONFields(r io.Reader) ([]field, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil {
+		return nil, err
+	} else if t != json.Delim('{') {
+		return nil, errors.New("GeoJSON is not an object")
+	}
+	var fields []field
+	seen := make(map[string]bool)
+	add := func(props map[string]json.RawMessage) {
+		var names []string
+		for name := range props {
+			if !seen[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			seen[name] = true
+			fields = append(fields, field{name, jsonType(props[name])})
+		}
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "features":
+			if t, err := dec.Token(); err != nil {
+				return nil, err
+			} else if t != json.Delim('[') {
+				return nil, errors.New("GeoJSON features are not a list")
+			}
+			for n := 0; n < maxFeatures && dec.More(); n++ {
+				var f struct {
+					Properties map[string]json.RawMessage `json:"properties"`
+				}
+				if err := dec.Decode(&f); err != nil {
+					return nil, err
+				}
+				add(f.Properties)
+			}
+			return fields, nil
+		case "properties":
+			var props map[string]json.RawMessage
+			if err := dec.Decode(&props); err != nil {
+				return nil, err
+			}
+			add(props)
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return fields, nil
+}
+
+func jsonType(v json.RawMessage) string {
+	v = bytes.TrimSpace(v)
+	if len(v) == 0 {
+		return "string"
+	}
+	switch v[0] {
+	case 't', 'f':
+		return "boolean"
+	case '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return "number"
+	}
+	return "string"
+}
+
+// csvFields returns the fields of the header row of a CSV file.
+func csvFields(r io.Reader) ([]field, error) {
+	header, err := csv.NewReader(r).Read()
+	if err != nil {
+		return nil, err
+	}
+	var fields []field
+	for _, name := range header {
+		fields = append(fields, field{strings.TrimSpace(name), "string"})
+	}
+	return fields, nil
+}
@@ -0,0 +1,492 @@
+// Package lsp implements a Language Server Protocol server for CartoCSS.
+//
+// The server completes properties, values, variables, layers, classes and
+// fields of MSS documents. Layers and fields are read from the MML project
+// that includes the document, and from the Shapefile, GeoJSON and CSV
+// datasources of its layers. The server also provides hover documentation
+// and go-to-definition for variables.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/omniscale/magnacarto/logging"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// ErrExitWithoutShutdown is returned by Serve if the client sends exit
+// without a shutdown request.
+var ErrExitWithoutShutdown = errors.New("exit without shutdown")
+
+// Server is a language server for MSS documents. A Server handles a single
+// client.
+type Server struct {
+	logger *logging.Logger
+	out    io.Writer
+	// docs are the texts of all open documents by URI
+	docs map[string]string
+	// projects by MML file, loaded again if the MML file changes
+	projects map[string]*project
+	// projectFiles are the MML files of all stylesheets, empty if no
+	// project includes the stylesheet
+	projectFiles map[string]string
+	initialized  bool
+	shutdown     bool
+}
+
+// NewServer returns a new Server. Log messages are written to logger, as
+// stdout is used for the protocol.
+func NewServer(logger *logging.Logger) *Server {
+	return &Server{
+		logger:       logger,
+		docs:         make(map[string]string),
+		projects:     make(map[string]*project),
+		projectFiles: make(map[string]string),
+	}
+}
+
+// Serve reads requests from r and writes responses to w until the client
+// exits or r is closed.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.out = w
+	in := bufio.NewReader(r)
+	for {
+		b, err := readMessage(in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg message
+		if err := json.Unmarshal(b, &msg); err != nil {
+			if err := s.reply(nil, nil, &responseError{Code: codeParseError, Message: err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return ErrExitWithoutShutdown
+			}
+			return nil
+		}
+		result, rerr := s.handle(msg.Method, msg.Params)
+		if msg.ID == nil {
+			// notification
+			if rerr != nil {
+				s.logger.Warn("notification failed", "method", msg.Method, "err", rerr)
+			}
+			continue
+		}
+		if err := s.reply(msg.ID, result, rerr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, rerr *responseError) error {
+	msg := &message{ID: id, Result: result, Error: rerr}
+	if id == nil {
+		null := json.RawMessage("null")
+		msg.ID = &null
+	}
+	if rerr == nil && result == nil {
+		// result is required for successful responses
+		msg.Result = json.RawMessage("null")
+	}
+	return writeMessage(s.out, msg)
+}
+
+func (s *Server) handle(method string, params json.RawMessage) (interface{}, *responseError) {
+	if method == "initialize" {
+		s.initialized = true
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync": 1, // full
+				"completionProvider": map[string]interface{}{
+					"triggerCharacters": []string{"@", "#", ".", "[", ":", " "},
+				},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+			},
+			"serverInfo": map[string]interface{}{"name": "magnacarto"},
+		}, nil
+	}
+	if !s.initialized {
+		return nil, &responseError{Code: codeServerNotInitialized, Message: "server not initialized"}
+	}
+
+	switch method {
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, invalidParams(err)
+		}
+		s.docs[p.TextDocument.URI] = p.TextDocument.Text
+		return nil, nil
+	case "textDocument/didChange":
+		var p didChangeParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, invalidParams(err)
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			s.docs[p.TextDocument.URI] = p.ContentChanges[n-1].Text
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p didCloseParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return nil, nil
+	case "textDocument/completion", "textDocument/hover", "textDocument/definition":
+		var p textDocumentPositionParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, invalidParams(err)
+		}
+		src, ok := s.docs[p.TextDocument.URI]
+		if !ok {
+			return nil, &responseError{Code: codeInvalidParams, Message: "document not open: " + p.TextDocument.URI}
+		}
+		switch method {
+		case "textDocument/completion":
+			return s.completion(p.TextDocument.URI, src, p.Position), nil
+		case "textDocument/hover":
+			if h := s.hover(p.TextDocument.URI, src, p.Position); h != nil {
+				return h, nil
+			}
+			return nil, nil
+		default:
+			if l := s.definition(p.TextDocument.URI, src, p.Position); l != nil {
+				return l, nil
+			}
+			return nil, nil
+		}
+	}
+	if strings.HasPrefix(method, "$/") {
+		// optional notifications and requests
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: "method not found: " + method}
+}
+
+func invalidParams(err error) *responseError {
+	return &responseError{Code: codeInvalidParams, Message: err.Error()}
+}
+
+// completion returns all completions at pos. Only the items that start with
+// the prefix at pos are returned.
+func (s *Server) completion(uri, src string, pos Position) completionList {
+	line, column := toColumn(src, pos)
+	ctx := mss.CompletionAt(src, line, column)
+	items := []completionItem{}
+	add := func(item completionItem) {
+		if strings.HasPrefix(strings.ToLower(item.Label), strings.ToLower(ctx.Prefix)) {
+			items = append(items, item)
+		}
+	}
+	p := s.project(uri)
+
+	switch ctx.Kind {
+	case mss.CompleteProperty:
+		for _, prop := range mss.SupportedProperties() {
+			add(completionItem{Label: prop.Name, Kind: completionProperty, Detail: prop.Type, Documentation: propertyDoc(prop)})
+		}
+	case mss.CompleteValue:
+		prop, _ := mss.LookupProperty(ctx.Property)
+		keywords := prop.Keywords
+		if prop.Type == "boolean" {
+			keywords = []string{"true", "false"}
+		}
+		for _, k := range keywords {
+			add(completionItem{Label: k, Kind: completionValue, Detail: prop.Name})
+		}
+	case mss.CompleteVariable:
+		for _, v := range s.variables(uri, src) {
+			add(completionItem{Label: v.sym.Name, Kind: completionVariable, Detail: v.sym.Value})
+		}
+	case mss.CompleteLayer:
+		if p != nil {
+			for _, l := range p.layers {
+				add(completionItem{Label: l.name, Kind: completionModule, Detail: l.source})
+			}
+		}
+	case mss.CompleteClass:
+		if p != nil {
+			seen := make(map[string]bool)
+			for _, l := range p.layers {
+				if len(ctx.Layers) > 0 && !contains(ctx.Layers, l.name) {
+					continue
+				}
+				for _, c := range l.classes {
+					if !seen[c] {
+						seen[c] = true
+						add(completionItem{Label: c, Kind: completionClass})
+					}
+				}
+			}
+		}
+	case mss.CompleteField:
+		if ctx.Property == "" {
+			add(completionItem{Label: "zoom", Kind: completionKeyword, Detail: "zoom level"})
+		}
+		if p != nil {
+			for _, f := range p.fields(ctx.Layers) {
+				add(completionItem{Label: f.name, Kind: completionField, Detail: f.typ})
+			}
+		}
+	}
+
+	// replace the prefix, as editors do not include @, # and . in words
+	for i := range items {
+		items[i].TextEdit = &textEdit{
+			Range:   Range{Start: Position{Line: pos.Line, Character: pos.Character - utf16Count(ctx.Prefix)}, End: pos},
+			NewText: items[i].Label,
+		}
+	}
+	return completionList{Items: items}
+}
+
+func propertyDoc(p mss.Property) string {
+	if len(p.Keywords) == 0 {
+		return ""
+	}
+	return "Values: " + strings.Join(p.Keywords, ", ")
+}
+
+// hover returns the documentation of the property, variable, layer or field
+// at pos, or nil.
+func (s *Server) hover(uri, src string, pos Position) *hover {
+	line, column := toColumn(src, pos)
+	sym, ok := mss.SymbolAt(src, line, column)
+	if !ok {
+		return nil
+	}
+	var doc string
+	switch sym.Kind {
+	case mss.SymbolProperty:
+		prop, ok := mss.LookupProperty(sym.Name)
+		if !ok {
+			doc = fmt.Sprintf("**%s**\n\nUnknown property.", sym.Name)
+			break
+		}
+		doc = fmt.Sprintf("**%s** (%s)", prop.Name, prop.Type)
+		if len(prop.Keywords) > 0 {
+			doc += "\n\n" + propertyDoc(prop)
+		}
+	case mss.SymbolVariable:
+		def, ok := s.lookupVariable(uri, src, sym.Name)
+		if !ok {
+			doc = fmt.Sprintf("**@%s**\n\nUndefined variable.", sym.Name)
+			break
+		}
+		doc = fmt.Sprintf("**@%s**: `%s`\n\nDefined in %s:%d", sym.Name, def.sym.Value, displayName(def.uri), def.sym.Line)
+	case mss.SymbolLayer:
+		p := s.project(uri)
+		if p == nil {
+			return nil
+		}
+		l, ok := p.layer(sym.Name)
+		if !ok {
+			doc = fmt.Sprintf("**#%s**\n\nUnknown layer.", sym.Name)
+			break
+		}
+		doc = fmt.Sprintf("**#%s**", l.name)
+		if l.source != "" {
+			doc += " (" + l.source + ")"
+		}
+		if len(l.fields) > 0 {
+			names := make([]string, len(l.fields))
+			for i, f := range l.fields {
+				names[i] = f.name
+			}
+			doc += "\n\nFields: " + strings.Join(names, ", ")
+		} else if l.err != nil {
+			doc += "\n\nFields not available: " + l.err.Error()
+		}
+	case mss.SymbolField:
+		if sym.Name == "zoom" {
+			doc = "**zoom**\n\nThe zoom level of the map."
+			break
+		}
+		p := s.project(uri)
+		if p == nil {
+			return nil
+		}
+		var layers []string
+		typ := ""
+		for _, l := range p.layers {
+			for _, f := range l.fields {
+				if f.name == sym.Name {
+					layers = append(layers, "#"+l.name)
+					typ = f.typ
+				}
+			}
+		}
+		if len(layers) == 0 {
+			return nil
+		}
+		doc = fmt.Sprintf("**[%s]** (%s)\n\nField of %s", sym.Name, typ, strings.Join(layers, ", "))
+	default:
+		return nil
+	}
+	name := sym.Name
+	switch sym.Kind {
+	case mss.SymbolVariable:
+		name = "@" + name
+	case mss.SymbolLayer:
+		name = "#" + name
+	}
+	r := nameRange(src, sym.Line, sym.Column, name)
+	return &hover{Contents: markupContent{Kind: "markdown", Value: doc}, Range: &r}
+}
+
+// definition returns the location of the definition of the variable at pos,
+// or nil.
+func (s *Server) definition(uri, src string, pos Position) *Location {
+	line, column := toColumn(src, pos)
+	sym, ok := mss.SymbolAt(src, line, column)
+	if !ok || sym.Kind != mss.SymbolVariable {
+		return nil
+	}
+	def, ok := s.lookupVariable(uri, src, sym.Name)
+	if !ok {
+		return nil
+	}
+	return &Location{URI: def.uri, Range: nameRange(def.src, def.sym.Line, def.sym.Column, "@"+def.sym.Name)}
+}
+
+// variable is a variable definition of a document.
+type variable struct {
+	uri string
+	src string
+	sym mss.Symbol
+}
+
+// variables returns the variables of the document and of all other
+// stylesheets of its project, sorted by name. The definitions of the
+// document take precedence.
+func (s *Server) variables(uri, src string) []variable {
+	vars := make(map[string]variable)
+	if p := s.project(uri); p != nil {
+		for _, f := range p.stylesheets {
+			fURI := pathToURI(f)
+			if fURI == uri {
+				continue
+			}
+			fSrc, ok := s.docs[fURI]
+			if !ok {
+				b, err := ioutil.ReadFile(f)
+				if err != nil {
+					s.logger.Debug("reading stylesheet", "file", f, "err", err)
+					continue
+				}
+				fSrc = string(b)
+			}
+			for _, sym := range mss.VariableDefinitions(fSrc) {
+				vars[sym.Name] = variable{uri: fURI, src: fSrc, sym: sym}
+			}
+		}
+	}
+	for _, sym := range mss.VariableDefinitions(src) {
+		vars[sym.Name] = variable{uri: uri, src: src, sym: sym}
+	}
+	result := make([]variable, 0, len(vars))
+	for _, v := range vars {
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].sym.Name < result[j].sym.Name })
+	return result
+}
+
+func (s *Server) lookupVariable(uri, src, name string) (variable, bool) {
+	for _, v := range s.variables(uri, src) {
+		if v.sym.Name == name {
+			return v, true
+		}
+	}
+	return variable{}, false
+}
+
+// project returns the project of the document, or nil if the document is
+// not included in a project.
+func (s *Server) project(uri string) *project {
+	path, ok := uriToPath(uri)
+	if !ok {
+		return nil
+	}
+	mmlFile, ok := s.projectFiles[path]
+	if !ok {
+		mmlFile = findProject(path)
+		s.projectFiles[path] = mmlFile
+	}
+	if mmlFile == "" {
+		return nil
+	}
+	p := s.projects[mmlFile]
+	if p != nil {
+		if fi, err := os.Stat(mmlFile); err == nil && fi.ModTime().Equal(p.modTime) {
+			return p
+		}
+	}
+	p, err := loadProject(mmlFile)
+	if err != nil {
+		s.logger.Warn("loading project", "mml", mmlFile, "err", err)
+		delete(s.projects, mmlFile)
+		return nil
+	}
+	for _, l := range p.layers {
+		if l.err != nil {
+			s.logger.Debug("reading fields", "layer", l.name, "err", l.err)
+		}
+	}
+	s.projects[mmlFile] = p
+	return p
+}
+
+// uriToPath returns the absolute path of a file URI.
+func uriToPath(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	path := filepath.FromSlash(u.Path)
+	if len(u.Path) > 2 && u.Path[0] == '/' && u.Path[2] == ':' {
+		// Windows drive letter (file:///C:/...)
+		path = filepath.FromSlash(u.Path[1:])
+	}
+	return filepath.Clean(path), true
+}
+
+func pathToURI(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+// displayName returns the file name of uri.
+func displayName(uri string) string {
+	if path, ok := uriToPath(uri); ok {
+		return filepath.Base(path)
+	}
+	return uri
+}
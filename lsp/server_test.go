@@ -0,0 +1,258 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/omniscale/magnacarto/logging"
+)
+
+// session sends all requests to a new Server and returns the responses by
+// request ID.
+func session(t *testing.T, requests ...map[string]interface{}) (map[float64]map[string]interface{}, error) {
+	in := &bytes.Buffer{}
+	for _, r := range requests {
+		r["jsonrpc"] = "2.0"
+		b, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in.WriteString("Content-Length: " + itoa(len(b)) + "\r\n\r\n")
+		in.Write(b)
+	}
+	out := &bytes.Buffer{}
+	err := NewServer(logging.New(ioutil.Discard, logging.Error, false)).Serve(in, out)
+
+	responses := make(map[float64]map[string]interface{})
+	r := bufio.NewReader(out)
+	for {
+		b, err := readMessage(r)
+		if err != nil {
+			break
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(b, &resp); err != nil {
+			t.Fatal(err)
+		}
+		id, _ := resp["id"].(float64)
+		responses[id] = resp
+	}
+	return responses, err
+}
+
+func itoa(i int) string {
+	b, _ := json.Marshal(i)
+	return string(b)
+}
+
+func request(id int, method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"id": id, "method": method, "params": params}
+}
+
+func notification(method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"method": method, "params": params}
+}
+
+func position(uri string, line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri},
+		"position":     map[string]interface{}{"line": line, "character": character},
+	}
+}
+
+func labels(t *testing.T, resp map[string]interface{}) []string {
+	result, ok := resp["result"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("unexpected response %v", resp)
+	}
+	labels := []string{}
+	for _, item := range result["items"].([]interface{}) {
+		labels = append(labels, item.(map[string]interface{})["label"].(string))
+	}
+	return labels
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lsp_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"project.mml": `{"Stylesheet": ["style/base.mss", "style/roads.mss"], "Layer": [
+			{"id": "roads", "name": "roads", "class": "major minor", "Datasource": {"file": "data/roads.geojson", "type": "ogr", "layer": "roads"}},
+			{"id": "places", "name": "places", "Datasource": {"type": "csv", "inline": "name,population,lon,lat\nBonn,300000,7.1,50.7"}},
+			{"id": "db", "name": "db", "Datasource": {"type": "postgis", "table": "osm_roads"}}
+		]}`,
+		"data/roads.geojson": `{"type": "FeatureCollection", "features": [
+			{"type": "Feature", "geometry": null, "properties": {"highway": "primary", "lanes": 2}},
+			{"type": "Feature", "geometry": null, "properties": {"highway": "secondary", "bridge": true}}
+		]}`,
+		"style/base.mss": "@water: #a0c8f0;\n@font: \"DejaVu Sans\";\n",
+	}
+	for name, content := range files {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uri := pathToURI(filepath.Join(dir, "style", "roads.mss"))
+	src := "@width: 2;\n" + // line 0
+		"#roads[hi] {\n" + // line 1
+		"  line-width: @width;\n" + // line 2
+		"  line-cap: r;\n" + // line 3
+		"  line-color: @wa; polygon-fill: @water;\n" + // line 4
+		"  .ma { line-o }\n" + // line 5
+		"}\n" + // line 6
+		"#places { text-name: [p]; }\n" + // line 7
+		"#"
+
+	responses, err := session(t,
+		request(1, "initialize", map[string]interface{}{}),
+		notification("initialized", map[string]interface{}{}),
+		notification("textDocument/didOpen", map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": uri, "languageId": "carto", "version": 1, "text": src},
+		}),
+		request(2, "textDocument/completion", position(uri, 1, 9)),
+		request(3, "textDocument/completion", position(uri, 3, 13)),
+		request(4, "textDocument/completion", position(uri, 4, 17)),
+		request(5, "textDocument/completion", position(uri, 5, 5)),
+		request(6, "textDocument/completion", position(uri, 5, 14)),
+		request(7, "textDocument/completion", position(uri, 7, 23)),
+		request(8, "textDocument/completion", position(uri, 8, 1)),
+		request(9, "textDocument/hover", position(uri, 2, 5)),
+		request(10, "textDocument/hover", position(uri, 2, 17)),
+		request(11, "textDocument/definition", position(uri, 2, 17)),
+		request(12, "textDocument/definition", position(uri, 4, 35)),
+		request(13, "textDocument/hover", position(uri, 1, 3)),
+		request(14, "textDocument/unknown", position(uri, 1, 3)),
+		request(15, "shutdown", nil),
+		notification("exit", nil),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caps := responses[1]["result"].(map[string]interface{})["capabilities"].(map[string]interface{})
+	if caps["hoverProvider"] != true || caps["definitionProvider"] != true {
+		t.Error("unexpected capabilities", caps)
+	}
+
+	for id, expected := range map[float64][]string{
+		2: {"highway"},
+		3: {"round"},
+		4: {"water"},
+		5: {"major"},
+		6: {"line-offset", "line-opacity"},
+		7: {"population"},
+		8: {"roads", "places", "db"},
+	} {
+		if l := labels(t, responses[id]); !reflect.DeepEqual(l, expected) {
+			t.Errorf("unexpected completion %v for request %v, expected %v", l, id, expected)
+		}
+	}
+
+	hoverValue := func(id float64) string {
+		result, ok := responses[id]["result"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("unexpected hover %v", responses[id])
+		}
+		return result["contents"].(map[string]interface{})["value"].(string)
+	}
+	if v := hoverValue(9); v != "**line-width** (number)" {
+		t.Errorf("unexpected property hover %q", v)
+	}
+	if v := hoverValue(10); v != "**@width**: `2`\n\nDefined in roads.mss:1" {
+		t.Errorf("unexpected variable hover %q", v)
+	}
+	if v := hoverValue(13); v != "**#roads** (data/roads.geojson)\n\nFields: highway, lanes, bridge" {
+		t.Errorf("unexpected layer hover %q", v)
+	}
+
+	location := func(id float64) (string, interface{}) {
+		result, ok := responses[id]["result"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("unexpected definition %v", responses[id])
+		}
+		return result["uri"].(string), result["range"]
+	}
+	if u, r := location(11); u != uri || !reflect.DeepEqual(r, map[string]interface{}{
+		"start": map[string]interface{}{"line": 0.0, "character": 0.0},
+		"end":   map[string]interface{}{"line": 0.0, "character": 6.0},
+	}) {
+		t.Errorf("unexpected definition %s %v", u, r)
+	}
+	if u, _ := location(12); u != pathToURI(filepath.Join(dir, "style", "base.mss")) {
+		t.Errorf("unexpected definition %s", u)
+	}
+
+	if e, ok := responses[14]["error"].(map[string]interface{}); !ok || e["code"] != float64(codeMethodNotFound) {
+		t.Errorf("unexpected response %v", responses[14])
+	}
+	if _, ok := responses[15]["result"]; !ok {
+		t.Errorf("unexpected shutdown response %v", responses[15])
+	}
+}
+
+func TestExitWithoutShutdown(t *testing.T) {
+	_, err := session(t, request(1, "initialize", nil), notification("exit", nil))
+	if err != ErrExitWithoutShutdown {
+		t.Error("unexpected error", err)
+	}
+	responses, _ := session(t, request(1, "textDocument/hover", position("file:///a.mss", 0, 0)))
+	if e, ok := responses[1]["error"].(map[string]interface{}); !ok || e["code"] != float64(codeServerNotInitialized) {
+		t.Errorf("unexpected response %v", responses[1])
+	}
+}
+
+func TestPositions(t *testing.T) {
+	src := "a\n@bär: 𝄞x;\n"
+	for _, tc := range []struct {
+		pos          Position
+		line, column int
+	}{
+		{Position{0, 0}, 1, 1},
+		{Position{1, 4}, 2, 5},
+		{Position{1, 8}, 2, 8}, // after the surrogate pair of 𝄞
+		{Position{1, 20}, 2, 10},
+	} {
+		line, column := toColumn(src, tc.pos)
+		if line != tc.line || column != tc.column {
+			t.Errorf("unexpected column %d:%d for %v", line, column, tc.pos)
+		}
+		if tc.pos.Character <= 8 {
+			if pos := toPosition(src, line, column); pos != tc.pos {
+				t.Errorf("unexpected position %v for %d:%d", pos, line, column)
+			}
+		}
+	}
+}
+
+func TestDBFFields(t *testing.T) {
+	b := make([]byte, 32+2*32+1)
+	binary.LittleEndian.PutUint16(b[8:], uint16(len(b)))
+	copy(b[32:], "NAME")
+	b[32+11] = 'C'
+	copy(b[64:], "POP")
+	b[64+11] = 'N'
+	b[96] = 0x0d
+	fields, err := dbfFields(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fields, []field{{"NAME", "string"}, {"POP", "number"}}) {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
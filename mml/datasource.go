@@ -42,6 +42,36 @@ type GDAL struct {
 	SRID     string
 	Extent   string
 	Band     string
+	Nodata   string
+	// Overview is the GDAL overview level (0 for the first overview) that
+	// is used instead of the full resolution raster, e.g. for hillshades of
+	// small scale maps.
+	Overview string
+}
+
+// Contour is an OGR source with contour lines, e.g. from gdal_contour. Only
+// lines with an elevation that is a multiple of Interval are included if
+// Interval is set, so that the same source can be used for minor and major
+// contour layers.
+type Contour struct {
+	Id             string
+	Filename       string
+	SRID           string
+	Layer          string
+	Extent         string
+	ElevationField string
+	Interval       string
+}
+
+// Inline is a small datasource that is embedded in the MML, with the
+// "inline" parameter. Data is a GeoJSON object (Format geojson) or CSV with
+// a header row (Format csv). The builder writes Inline datasources to
+// GeoJSON files and passes them as OGR datasources to the Map.
+type Inline struct {
+	Id     string
+	Format string
+	Data   string
+	SRID   string
 }
 
 type Datasource interface{}
@@ -0,0 +1,285 @@
+package mml
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// object is a JSON object that keeps the order of its members, so that
+// edited MML files only differ in the changed values (and the indentation).
+type object []member
+
+type member struct {
+	key   string
+	value json.RawMessage
+}
+
+func parseObject(data []byte) (object, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	tok, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("expected JSON object")
+	}
+	o := object{}
+	for d.More() {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		o = append(o, member{key: tok.(string), value: v})
+	}
+	return o, nil
+}
+
+func (o object) get(key string) json.RawMessage {
+	for _, m := range o {
+		if m.key == key {
+			return m.value
+		}
+	}
+	return nil
+}
+
+func (o *object) set(key string, value interface{}) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	for i, m := range *o {
+		if m.key == key {
+			(*o)[i].value = v
+			return nil
+		}
+	}
+	*o = append(*o, member{key: key, value: v})
+	return nil
+}
+
+func (o *object) remove(key string) {
+	for i, m := range *o {
+		if m.key == key {
+			*o = append((*o)[:i], (*o)[i+1:]...)
+			return
+		}
+	}
+}
+
+func (o object) MarshalJSON() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(m.key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(m.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// editFile is a single MML file for editing. Changes are only written with
+// save.
+type editFile struct {
+	filename string
+	doc      object
+	layers   []object
+}
+
+func loadEditFile(filename string) (*editFile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseObject(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	f := &editFile{filename: filename, doc: doc}
+	if raw := doc.get("Layer"); raw != nil {
+		var layers []json.RawMessage
+		if err := json.Unmarshal(raw, &layers); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+		for _, l := range layers {
+			layer, err := parseObject(l)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", filename, err)
+			}
+			f.layers = append(f.layers, layer)
+		}
+	}
+	return f, nil
+}
+
+// layerKey returns the name or id of the layer, like auxLayer.key.
+func layerKey(l object) string {
+	var name, id string
+	json.Unmarshal(l.get("name"), &name)
+	json.Unmarshal(l.get("id"), &id)
+	if name != "" {
+		return name
+	}
+	return id
+}
+
+func (f *editFile) extends() bool {
+	var base string
+	json.Unmarshal(f.doc.get("extends"), &base)
+	return base != ""
+}
+
+// save writes the file atomically, so that builders never read a partial
+// MML.
+func (f *editFile) save() error {
+	if len(f.layers) > 0 || f.doc.get("Layer") != nil {
+		if err := f.doc.set("Layer", f.layers); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(f.doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(f.filename); err == nil {
+		mode = fi.Mode()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.filename), "."+filepath.Base(f.filename))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.filename)
+}
+
+// ReorderLayers changes the order of all layers in the MML file. names
+// needs to contain the name of each layer exactly once. The layers of
+// projects that extend other projects can not be reordered, as they keep the
+// position of the base layers.
+func ReorderLayers(filename string, names []string) error {
+	f, err := loadEditFile(filename)
+	if err != nil {
+		return err
+	}
+	if f.extends() {
+		return fmt.Errorf("unable to reorder layers of %s, it extends another project", filename)
+	}
+	if len(names) != len(f.layers) {
+		return fmt.Errorf("expected %d layers, got %d", len(f.layers), len(names))
+	}
+	byKey := make(map[string]object, len(f.layers))
+	for _, l := range f.layers {
+		byKey[layerKey(l)] = l
+	}
+	layers := make([]object, 0, len(names))
+	for _, name := range names {
+		l, ok := byKey[name]
+		if !ok {
+			return fmt.Errorf("unknown or duplicate layer %q", name)
+		}
+		delete(byKey, name)
+		layers = append(layers, l)
+	}
+	f.layers = layers
+	return f.save()
+}
+
+// SetLayerZoom sets the minzoom and maxzoom properties of a layer in the
+// MML file. Layers of extended projects are overridden in the MML file.
+func SetLayerZoom(filename, name string, minZoom, maxZoom int) error {
+	if minZoom < 0 || maxZoom > 30 || minZoom > maxZoom {
+		return fmt.Errorf("invalid zoom range %d-%d", minZoom, maxZoom)
+	}
+	f, err := loadEditFile(filename)
+	if err != nil {
+		return err
+	}
+
+	var layer *object
+	for i := range f.layers {
+		if layerKey(f.layers[i]) == name {
+			layer = &f.layers[i]
+			break
+		}
+	}
+	if layer == nil {
+		m, err := Load(filename)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, l := range m.Layers {
+			if l.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown layer %q", name)
+		}
+		override := object{}
+		if err := override.set("name", name); err != nil {
+			return err
+		}
+		f.layers = append(f.layers, override)
+		layer = &f.layers[len(f.layers)-1]
+	}
+
+	props := object{}
+	if raw := layer.get("properties"); raw != nil {
+		if props, err = parseObject(raw); err != nil {
+			return fmt.Errorf("properties of layer %s: %s", name, err)
+		}
+	}
+	// defaults are removed, unless they need to override a base layer
+	for _, p := range []struct {
+		key          string
+		value, unset int
+	}{
+		{"minzoom", minZoom, 0},
+		{"maxzoom", maxZoom, 30},
+	} {
+		if p.value == p.unset && !f.extends() {
+			props.remove(p.key)
+		} else if err := props.set(p.key, p.value); err != nil {
+			return err
+		}
+	}
+	if len(props) == 0 {
+		layer.remove("properties")
+	} else if err := layer.set("properties", props); err != nil {
+		return err
+	}
+	return f.save()
+}
@@ -0,0 +1,137 @@
+package mml
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReorderLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"project.mml": `{"Stylesheet": ["style.mss"], "name": "test", "Layer": [
+			{"name": "water", "Datasource": {"file": "water.shp"}, "advanced": {}},
+			{"name": "roads", "id": "r", "geometry": "linestring"},
+			{"name": "places", "geometry": "point"}
+		], "interactivity": false}`,
+		"extends.mml": `{"extends": "project.mml", "Layer": []}`,
+	})
+	fname := filepath.Join(dir, "project.mml")
+
+	if err := ReorderLayers(fname, []string{"places", "water", "roads"}); err != nil {
+		t.Fatal(err)
+	}
+	m, err := Load(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range m.Layers {
+		names = append(names, l.Name)
+	}
+	if expected := []string{"places", "water", "roads"}; !reflect.DeepEqual(names, expected) {
+		t.Error("unexpected layers", names)
+	}
+
+	content, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// order of keys is kept
+	c := string(content)
+	if !(strings.Index(c, `"Stylesheet"`) < strings.Index(c, `"name": "test"`) &&
+		strings.Index(c, `"name": "test"`) < strings.Index(c, `"Layer"`) &&
+		strings.Index(c, `"Layer"`) < strings.Index(c, `"interactivity"`) &&
+		strings.Index(c, `"Datasource"`) < strings.Index(c, `"advanced"`)) {
+		t.Error("order of keys changed\n", c)
+	}
+
+	for _, names := range [][]string{
+		{"places", "water"},
+		{"places", "water", "water"},
+		{"places", "water", "unknown"},
+	} {
+		if err := ReorderLayers(fname, names); err == nil {
+			t.Error("expected error for", names)
+		}
+	}
+	if err := ReorderLayers(filepath.Join(dir, "extends.mml"), []string{"places", "water", "roads"}); err == nil {
+		t.Error("expected error for extended project")
+	}
+}
+
+func TestSetLayerZoom(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"base.mml": `{"Layer": [
+			{"name": "water"},
+			{"name": "roads", "properties": {"group-by": "layer", "minzoom": 5}}
+		]}`,
+		"project.mml": `{"extends": "base.mml", "Layer": [{"name": "places"}]}`,
+	})
+	base := filepath.Join(dir, "base.mml")
+	project := filepath.Join(dir, "project.mml")
+
+	zoom := func(fname string) map[string][2]int {
+		m, err := Load(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := map[string][2]int{}
+		for _, l := range m.Layers {
+			result[l.Name] = [2]int{l.MinZoom, l.MaxZoom}
+		}
+		return result
+	}
+	if z := zoom(base); z["water"] != [2]int{0, 30} || z["roads"] != [2]int{5, 30} {
+		t.Error("unexpected zoom", z)
+	}
+
+	if err := SetLayerZoom(base, "water", 2, 12); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLayerZoom(base, "roads", 0, 30); err != nil {
+		t.Fatal(err)
+	}
+	if z := zoom(base); z["water"] != [2]int{2, 12} || z["roads"] != [2]int{0, 30} {
+		t.Error("unexpected zoom", z)
+	}
+	m, _ := Load(base)
+	if m.Layers[1].GroupBy != "layer" {
+		t.Error("other properties removed")
+	}
+
+	// layers of base projects are overridden
+	if err := SetLayerZoom(project, "water", 0, 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetLayerZoom(project, "places", 14, 30); err != nil {
+		t.Fatal(err)
+	}
+	if z := zoom(project); z["water"] != [2]int{0, 30} || z["places"] != [2]int{14, 30} {
+		t.Error("unexpected zoom", z)
+	}
+	if z := zoom(base); z["water"] != [2]int{2, 12} {
+		t.Error("base project changed", z)
+	}
+
+	if err := SetLayerZoom(project, "unknown", 0, 30); err == nil {
+		t.Error("expected error for unknown layer")
+	}
+	if err := SetLayerZoom(project, "water", 10, 5); err == nil {
+		t.Error("expected error for invalid zoom")
+	}
+}
@@ -0,0 +1,101 @@
+package mml
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// auxDatasource are the parameters of a datasource. All values are strings,
+// only inline data can be any JSON value and is kept as JSON.
+type auxDatasource map[string]string
+
+func (d *auxDatasource) UnmarshalJSON(data []byte) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	result := make(auxDatasource, len(raw))
+	for k, v := range raw {
+		var s string
+		if err := json.Unmarshal(v, &s); err == nil {
+			result[k] = s
+			continue
+		}
+		if k != "inline" {
+			return fmt.Errorf("datasource parameter %s is not a string: %s", k, v)
+		}
+		buf := &bytes.Buffer{}
+		if err := json.Compact(buf, v); err != nil {
+			return err
+		}
+		result[k] = buf.String()
+	}
+	*d = result
+	return nil
+}
+
+// newInline returns the inline datasource of d, with type geojson (the
+// default for JSON objects) or csv.
+func newInline(d map[string]string) (Inline, error) {
+	ds := Inline{Format: d["type"], Data: d["inline"], SRID: d["srid"]}
+	if ds.Format == "" && strings.HasPrefix(ds.Data, "{") {
+		ds.Format = "geojson"
+	}
+	switch ds.Format {
+	case "geojson":
+		if !json.Valid([]byte(ds.Data)) {
+			return ds, fmt.Errorf("inline GeoJSON is not valid JSON")
+		}
+	case "csv":
+		if strings.HasPrefix(ds.Data, "[") {
+			data, err := csvRows(ds.Data)
+			if err != nil {
+				return ds, err
+			}
+			ds.Data = data
+		}
+	default:
+		return ds, fmt.Errorf("unsupported type %q for inline datasource, expected geojson or csv", ds.Format)
+	}
+	return ds, nil
+}
+
+// csvRows converts a JSON list of CSV rows to CSV. Each row is a string
+// (e.g. "name,lon,lat") or a list of values (e.g. ["Bonn", 7.1, 50.7]).
+func csvRows(data string) (string, error) {
+	var rows []json.RawMessage
+	if err := json.Unmarshal([]byte(data), &rows); err != nil {
+		return "", fmt.Errorf("inline CSV: %s", err)
+	}
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	for _, r := range rows {
+		var line string
+		if err := json.Unmarshal(r, &line); err == nil {
+			w.Flush()
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+			continue
+		}
+		var values []interface{}
+		d := json.NewDecoder(bytes.NewReader(r))
+		d.UseNumber()
+		if err := d.Decode(&values); err != nil {
+			return "", fmt.Errorf("inline CSV: row is not a string or list: %s", r)
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			if v != nil {
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		if err := w.Write(record); err != nil {
+			return "", err
+		}
+	}
+	w.Flush()
+	return buf.String(), w.Error()
+}
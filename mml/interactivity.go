@@ -0,0 +1,86 @@
+package mml
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Interactivity is the interactivity of a TileMill project: the features of
+// a single layer are available as UTFGrid with the given fields.
+type Interactivity struct {
+	// Layer is the name of the interactive layer.
+	Layer string
+	// Fields are the feature attributes included in the UTFGrid.
+	Fields []string
+	// Template is the Mustache template of the TileJSON, with the
+	// __location__, __teaser__ and __full__ sections of TileMill.
+	Template string
+}
+
+type auxInteractivity struct {
+	Layer            string          `json:"layer"`
+	Fields           json.RawMessage `json:"fields"`
+	Template         string          `json:"template"`
+	TemplateLocation string          `json:"template_location"`
+	TemplateTeaser   string          `json:"template_teaser"`
+	TemplateFull     string          `json:"template_full"`
+}
+
+// UnmarshalJSON ignores "interactivity": false, which TileMill writes for
+// projects without interactivity.
+func (i *auxInteractivity) UnmarshalJSON(data []byte) error {
+	if string(data) == "false" || string(data) == "null" {
+		*i = auxInteractivity{}
+		return nil
+	}
+	type plain auxInteractivity
+	return json.Unmarshal(data, (*plain)(i))
+}
+
+// newInteractivity returns the interactivity of aux, or nil if no layer is
+// set. The layer is referenced by its name or ID.
+func newInteractivity(aux *auxInteractivity, layers []auxLayer) (*Interactivity, error) {
+	if aux == nil || aux.Layer == "" {
+		return nil, nil
+	}
+	i := &Interactivity{}
+	for _, l := range layers {
+		if l.Name == aux.Layer || l.Id == aux.Layer {
+			i.Layer = l.key()
+			break
+		}
+	}
+	if i.Layer == "" {
+		return nil, fmt.Errorf("unknown interactivity layer %s", aux.Layer)
+	}
+
+	if len(aux.Fields) > 0 {
+		// TileMill uses a comma separated string
+		var fields string
+		if err := json.Unmarshal(aux.Fields, &fields); err == nil {
+			for _, f := range strings.Split(fields, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					i.Fields = append(i.Fields, f)
+				}
+			}
+		} else if err := json.Unmarshal(aux.Fields, &i.Fields); err != nil {
+			return nil, fmt.Errorf("invalid interactivity fields %s, expected string or list of strings", aux.Fields)
+		}
+	}
+
+	if aux.Template != "" {
+		i.Template = aux.Template
+	} else {
+		for _, t := range []struct{ section, tmpl string }{
+			{"__location__", aux.TemplateLocation},
+			{"__teaser__", aux.TemplateTeaser},
+			{"__full__", aux.TemplateFull},
+		} {
+			if t.tmpl != "" {
+				i.Template += "{{#" + t.section + "}}" + t.tmpl + "{{/" + t.section + "}}"
+			}
+		}
+	}
+	return i, nil
+}
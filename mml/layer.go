@@ -7,6 +7,7 @@ const (
 	LineString GeometryType = "LineString"
 	Polygon    GeometryType = "Polygon"
 	Point      GeometryType = "Point"
+	Raster     GeometryType = "Raster"
 )
 
 type Layer struct {
@@ -17,4 +18,25 @@ type Layer struct {
 	Type       GeometryType
 	Active     bool
 	GroupBy    string
+	Debug      bool   // render label collision boxes
+	Group      string // name of the layer group
+	CompOp     string // comp-op of the layer group
+	// If is a build condition (e.g. `target = mapserver`), layers are only
+	// included if it is true.
+	If string
+	// MinZoom and MaxZoom limit the zoom levels of all rules of the layer
+	// (minzoom and maxzoom of the layer properties).
+	MinZoom int
+	MaxZoom int
+}
+
+// Group is a group of layers. The builder disables all layers of inactive
+// groups and limits the zoom levels of all layers to MinZoom-MaxZoom.
+type Group struct {
+	Name    string
+	Active  bool
+	MinZoom int
+	MaxZoom int
+	CompOp  string
+	Layers  []string
 }
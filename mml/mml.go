@@ -5,27 +5,67 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 	"strings"
 )
 
 type MML struct {
+	// Name and Description of the project, not inherited from extended
+	// projects.
+	Name        string
+	Description string
 	Layers      []Layer
 	Stylesheets []string
+	// Groups of all layers, in the order of the first layer of each group.
+	Groups []Group
+	// BaseFiles are the MML files of all extended projects, starting with
+	// the direct base of this project. The paths are relative to the
+	// working dir (or absolute), like the filename passed to Load.
+	BaseFiles []string
+	// Bounds of the project in EPSG:4326 (minx, miny, maxx, maxy), nil if
+	// not set.
+	Bounds *[4]float64
+	// MinZoom and MaxZoom of the project, nil if not set.
+	MinZoom *int
+	MaxZoom *int
+	// Interactivity of the project, nil if not set.
+	Interactivity *Interactivity
 }
 
 type auxMML struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
 	Stylesheets []string   `json:"Stylesheet"`
 	Layers      []auxLayer `json:"Layer"`
+	Extends     string     `json:"extends"`
+	Groups      []auxGroup `json:"groups"`
+	Bounds      []float64  `json:"bounds"`
+	MinZoom     *int       `json:"minzoom"`
+	MaxZoom     *int       `json:"maxzoom"`
+	// Interactivity is a pointer, so that extending projects can disable
+	// the interactivity of their base.
+	Interactivity *auxInteractivity `json:"interactivity"`
+}
+
+type auxGroup struct {
+	Name    string
+	Status  string
+	MinZoom *int   `json:"minzoom"`
+	MaxZoom *int   `json:"maxzoom"`
+	CompOp  string `json:"comp-op"`
 }
 
 type auxLayer struct {
-	Datasource map[string]string
+	Datasource auxDatasource
 	Geometry   string
 	Id         string
 	Name       string
 	Class      string
 	SRS        string
 	Status     string
+	Group      string
+	If         string `json:"if"`
 	Properties map[string]interface{}
 }
 
@@ -41,14 +81,27 @@ func newLayer(l auxLayer) (*Layer, error) {
 	}
 	classes := strings.Split(l.Class, " ")
 	groupBy, _ := l.Properties["group-by"].(string)
+	debug, _ := l.Properties["debug"].(bool)
+	minZoom, maxZoom := 0, 30
+	if z, ok := l.Properties["minzoom"].(float64); ok {
+		minZoom = int(z)
+	}
+	if z, ok := l.Properties["maxzoom"].(float64); ok {
+		maxZoom = int(z)
+	}
 	return &Layer{
 		Name:       l.Name,
 		Classes:    classes,
 		Datasource: ds,
 		SRS:        l.SRS,
-		Type:       parseGeometryType(l.Geometry),
+		Type:       layerType(l.Geometry, ds),
 		Active:     isActive,
 		GroupBy:    groupBy,
+		Debug:      debug,
+		Group:      l.Group,
+		If:         l.If,
+		MinZoom:    minZoom,
+		MaxZoom:    maxZoom,
 	}, nil
 }
 
@@ -60,13 +113,32 @@ func parseGeometryType(t string) GeometryType {
 		return LineString
 	case "point":
 		return Point
+	case "raster":
+		return Raster
 	default:
 		return Unknown
 	}
 }
 
+// layerType returns the geometry type of the layer, with defaults for
+// datasources that only contain a single type.
+func layerType(geometry string, ds Datasource) GeometryType {
+	if t := parseGeometryType(geometry); t != Unknown {
+		return t
+	}
+	switch ds.(type) {
+	case GDAL:
+		return Raster
+	case Contour:
+		return LineString
+	}
+	return Unknown
+}
+
 func newDatasource(d map[string]string) (Datasource, error) {
-	if d["type"] == "postgis" {
+	if d["inline"] != "" {
+		return newInline(d)
+	} else if d["type"] == "postgis" {
 		return PostGIS{
 			Username:      d["user"],
 			Password:      d["password"],
@@ -104,6 +176,21 @@ func newDatasource(d map[string]string) (Datasource, error) {
 			SRID:     d["srid"],
 			Extent:   d["extent"],
 			Band:     d["band"],
+			Nodata:   d["nodata"],
+			Overview: d["overview"],
+		}, nil
+	} else if d["type"] == "contour" {
+		field := d["elevation_field"]
+		if field == "" {
+			field = "elev" // as in gdal_contour -a elev
+		}
+		return Contour{
+			Filename:       d["file"],
+			SRID:           d["srid"],
+			Layer:          d["layer"],
+			Extent:         d["extent"],
+			ElevationField: field,
+			Interval:       d["interval"],
 		}, nil
 	} else if d["type"] == "" {
 		return nil, nil
@@ -112,6 +199,7 @@ func newDatasource(d map[string]string) (Datasource, error) {
 	}
 }
 
+// Parse parses a single MML. Use Load for projects that extend other projects.
 func Parse(r io.Reader) (*MML, error) {
 	aux := auxMML{}
 	d := json.NewDecoder(r)
@@ -119,7 +207,243 @@ func Parse(r io.Reader) (*MML, error) {
 	if err != nil {
 		return nil, err
 	}
+	if aux.Extends != "" {
+		return nil, fmt.Errorf("unable to resolve extends %s without a file name", aux.Extends)
+	}
+	return newMML(aux)
+}
+
+// Load parses the MML file and all projects it extends.
+//
+// A project with "extends": "../base/project.mml" inherits all layers and
+// stylesheets of the base project. Layers with the same name as a base layer
+// override the parameters they set (e.g. only the table of the Datasource),
+// and stay at the position of the base layer. Other layers are appended.
+// Stylesheets are appended to the stylesheets of the base project and are
+// relative to the directory of filename.
+func Load(filename string) (*MML, error) {
+	aux, baseFiles, err := loadAux(filename, nil)
+	if err != nil {
+		return nil, err
+	}
+	m, err := newMML(*aux)
+	if err != nil {
+		return nil, err
+	}
+	m.BaseFiles = baseFiles
+	return m, nil
+}
+
+// loadAux loads filename and merges it with all extended projects. seen
+// contains the absolute paths of all extending projects to detect cycles.
+func loadAux(filename string, seen []string) (*auxMML, []string, error) {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, s := range seen {
+		if s == abs {
+			return nil, nil, fmt.Errorf("cyclic extends of %s", filename)
+		}
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	aux := &auxMML{}
+	if err := json.NewDecoder(f).Decode(aux); err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	if aux.Extends == "" {
+		return aux, nil, nil
+	}
+
+	// base paths are relative to filename
+	dir := filepath.Dir(filename)
+	baseFile := aux.Extends
+	if !filepath.IsAbs(baseFile) {
+		baseFile = filepath.Join(dir, baseFile)
+	}
+	base, baseFiles, err := loadAux(baseFile, append(seen, abs))
+	if err != nil {
+		return nil, nil, err
+	}
+	baseDir := filepath.Dir(aux.Extends)
+	for i, s := range base.Stylesheets {
+		if !filepath.IsAbs(s) {
+			base.Stylesheets[i] = filepath.Join(baseDir, s)
+		}
+	}
+	baseFiles = append([]string{baseFile}, baseFiles...)
+
+	return extend(base, aux), baseFiles, nil
+}
+
+// extend returns base with all stylesheets and layers of project.
+func extend(base, project *auxMML) *auxMML {
+	result := &auxMML{
+		Name:        project.Name,
+		Description: project.Description,
+		Stylesheets: append(base.Stylesheets, project.Stylesheets...),
+		Layers:      base.Layers,
+		Groups:      base.Groups,
+		Bounds:      base.Bounds,
+		MinZoom:     base.MinZoom,
+		MaxZoom:     base.MaxZoom,
+
+		Interactivity: base.Interactivity,
+	}
+	if project.Interactivity != nil {
+		result.Interactivity = project.Interactivity
+	}
+	if project.Bounds != nil {
+		result.Bounds = project.Bounds
+	}
+	if project.MinZoom != nil {
+		result.MinZoom = project.MinZoom
+	}
+	if project.MaxZoom != nil {
+		result.MaxZoom = project.MaxZoom
+	}
+	for _, g := range project.Groups {
+		overridden := false
+		for i, b := range result.Groups {
+			if b.Name == g.Name {
+				result.Groups[i] = mergeGroup(b, g)
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			result.Groups = append(result.Groups, g)
+		}
+	}
+	for _, l := range project.Layers {
+		overridden := false
+		for i, b := range result.Layers {
+			if b.key() != "" && b.key() == l.key() {
+				result.Layers[i] = mergeLayer(b, l)
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			result.Layers = append(result.Layers, l)
+		}
+	}
+	return result
+}
+
+func (l auxLayer) key() string {
+	if l.Name != "" {
+		return l.Name
+	}
+	return l.Id
+}
+
+// mergeLayer returns base with all parameters that are set in override.
+func mergeLayer(base, override auxLayer) auxLayer {
+	result := base
+	for _, v := range []struct{ dst, src *string }{
+		{&result.Geometry, &override.Geometry},
+		{&result.Id, &override.Id},
+		{&result.Name, &override.Name},
+		{&result.Class, &override.Class},
+		{&result.SRS, &override.SRS},
+		{&result.Status, &override.Status},
+		{&result.Group, &override.Group},
+		{&result.If, &override.If},
+	} {
+		if *v.src != "" {
+			*v.dst = *v.src
+		}
+	}
+	if len(override.Datasource) > 0 {
+		result.Datasource = make(map[string]string, len(base.Datasource))
+		for k, v := range base.Datasource {
+			result.Datasource[k] = v
+		}
+		for k, v := range override.Datasource {
+			result.Datasource[k] = v
+		}
+	}
+	if len(override.Properties) > 0 {
+		result.Properties = make(map[string]interface{}, len(base.Properties))
+		for k, v := range base.Properties {
+			result.Properties[k] = v
+		}
+		for k, v := range override.Properties {
+			result.Properties[k] = v
+		}
+	}
+	return result
+}
 
+// mergeGroup returns base with all options that are set in override.
+func mergeGroup(base, override auxGroup) auxGroup {
+	if override.Status != "" {
+		base.Status = override.Status
+	}
+	if override.MinZoom != nil {
+		base.MinZoom = override.MinZoom
+	}
+	if override.MaxZoom != nil {
+		base.MaxZoom = override.MaxZoom
+	}
+	if override.CompOp != "" {
+		base.CompOp = override.CompOp
+	}
+	return base
+}
+
+// newGroups returns all groups of the layers. Groups without definition use
+// the defaults.
+func newGroups(aux auxMML) ([]Group, error) {
+	defs := map[string]auxGroup{}
+	for _, g := range aux.Groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("missing name of group %v", g)
+		}
+		defs[g.Name] = g
+	}
+	groups := []Group{}
+	idx := map[string]int{}
+	for _, l := range aux.Layers {
+		if l.Group == "" {
+			continue
+		}
+		i, ok := idx[l.Group]
+		if !ok {
+			def := defs[l.Group]
+			g := Group{Name: l.Group, Active: def.Status != "off", MaxZoom: 30, CompOp: def.CompOp}
+			if def.MinZoom != nil {
+				g.MinZoom = *def.MinZoom
+			}
+			if def.MaxZoom != nil {
+				g.MaxZoom = *def.MaxZoom
+			}
+			i = len(groups)
+			idx[l.Group] = i
+			groups = append(groups, g)
+		}
+		groups[i].Layers = append(groups[i].Layers, l.Name)
+	}
+	return groups, nil
+}
+
+// Group returns the group with name.
+func (m *MML) Group(name string) (Group, bool) {
+	for _, g := range m.Groups {
+		if g.Name == name {
+			return g, true
+		}
+	}
+	return Group{}, false
+}
+
+func newMML(aux auxMML) (*MML, error) {
 	layers := []Layer{}
 	for _, l := range aux.Layers {
 		layer, err := newLayer(l)
@@ -129,9 +453,33 @@ func Parse(r io.Reader) (*MML, error) {
 		layers = append(layers, *layer)
 	}
 
+	groups, err := newGroups(aux)
+	if err != nil {
+		return nil, err
+	}
+
 	m := MML{
+		Name:        aux.Name,
+		Description: aux.Description,
 		Layers:      layers,
 		Stylesheets: aux.Stylesheets,
+		Groups:      groups,
+		MinZoom:     aux.MinZoom,
+		MaxZoom:     aux.MaxZoom,
+	}
+	if aux.Bounds != nil {
+		if len(aux.Bounds) != 4 || aux.Bounds[0] >= aux.Bounds[2] || aux.Bounds[1] >= aux.Bounds[3] {
+			return nil, fmt.Errorf("invalid bounds %v, expected [minx, miny, maxx, maxy]", aux.Bounds)
+		}
+		m.Bounds = &[4]float64{aux.Bounds[0], aux.Bounds[1], aux.Bounds[2], aux.Bounds[3]}
+	}
+	if m.Interactivity, err = newInteractivity(aux.Interactivity, aux.Layers); err != nil {
+		return nil, err
+	}
+	for i, l := range m.Layers {
+		if g, ok := m.Group(l.Group); ok {
+			m.Layers[i].CompOp = g.CompOp
+		}
 	}
 
 	return &m, nil
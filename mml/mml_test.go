@@ -0,0 +1,253 @@
+package mml
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		fname := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadExtends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"base/common.mml": `{"Stylesheet": ["common.mss"], "Layer": [
+			{"name": "land", "Datasource": {"file": "land.shp", "type": "shape"}}
+		]}`,
+		"base/project.mml": `{"extends": "common.mml", "name": "Base", "description": "Base style", "bounds": [-180, -85, 180, 85], "maxzoom": 18, "Stylesheet": ["base.mss"], "Layer": [
+			{"name": "roads", "geometry": "linestring", "Datasource": {"type": "postgis", "table": "roads", "dbname": "osm"}},
+			{"name": "labels", "geometry": "point", "Datasource": {"file": "labels.shp", "type": "shape"}}
+		]}`,
+		"de/project.mml": `{"extends": "../base/project.mml", "name": "Germany", "interactivity": {"layer": "borders", "fields": "name"}, "bounds": [5.8, 47.2, 15.1, 55.1], "Stylesheet": ["de.mss"], "Layer": [
+			{"name": "roads", "Datasource": {"table": "roads_de"}},
+			{"name": "land", "status": "off"},
+			{"name": "borders", "geometry": "linestring", "Datasource": {"file": "borders.shp", "type": "shape"}}
+		]}`,
+	})
+
+	m, err := Load(filepath.Join(dir, "de", "project.mml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []string{"../base/common.mss", "../base/base.mss", "de.mss"}; !reflect.DeepEqual(m.Stylesheets, expected) {
+		t.Error("unexpected stylesheets", m.Stylesheets)
+	}
+	if expected := []string{filepath.Join(dir, "base/project.mml"), filepath.Join(dir, "base/common.mml")}; !reflect.DeepEqual(m.BaseFiles, expected) {
+		t.Error("unexpected base files", m.BaseFiles)
+	}
+
+	if m.Bounds == nil || *m.Bounds != [4]float64{5.8, 47.2, 15.1, 55.1} {
+		t.Error("unexpected bounds", m.Bounds)
+	}
+	if m.MinZoom != nil || m.MaxZoom == nil || *m.MaxZoom != 18 {
+		t.Error("unexpected zoom levels", m.MinZoom, m.MaxZoom)
+	}
+	if m.Name != "Germany" || m.Description != "" {
+		t.Error("unexpected name and description", m.Name, m.Description)
+	}
+	if m.Interactivity == nil || m.Interactivity.Layer != "borders" {
+		t.Error("unexpected interactivity", m.Interactivity)
+	}
+
+	var names []string
+	for _, l := range m.Layers {
+		names = append(names, l.Name)
+	}
+	if expected := []string{"land", "roads", "labels", "borders"}; !reflect.DeepEqual(names, expected) {
+		t.Fatal("unexpected layers", names)
+	}
+	if m.Layers[0].Active {
+		t.Error("land not disabled")
+	}
+	roads := m.Layers[1]
+	if ds, ok := roads.Datasource.(PostGIS); !ok || ds.Query != "roads_de" || ds.Database != "osm" {
+		t.Errorf("unexpected datasource %#v", roads.Datasource)
+	}
+	if roads.Type != LineString {
+		t.Error("geometry type not inherited", roads.Type)
+	}
+}
+
+func TestLoadExtendsErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"a.mml":       `{"extends": "b.mml"}`,
+		"b.mml":       `{"extends": "a.mml"}`,
+		"missing.mml": `{"extends": "unknown.mml"}`,
+	})
+
+	if _, err := Load(filepath.Join(dir, "a.mml")); err == nil || !strings.Contains(err.Error(), "cyclic") {
+		t.Error("expected cyclic error, got", err)
+	}
+	if _, err := Load(filepath.Join(dir, "missing.mml")); err == nil {
+		t.Error("expected error for missing base")
+	}
+	if _, err := Parse(strings.NewReader(`{"extends": "a.mml"}`)); err == nil {
+		t.Error("expected error for extends without file name")
+	}
+}
+
+func TestLoadGroups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"base.mml": `{"groups": [{"name": "labels", "minzoom": 10, "comp-op": "multiply"}], "Layer": [
+			{"name": "roads", "group": "roads"},
+			{"name": "places", "group": "labels"},
+			{"name": "water"}
+		]}`,
+		"project.mml": `{"extends": "base.mml", "groups": [{"name": "labels", "status": "off"}], "Layer": [
+			{"name": "roads-labels", "group": "labels"}
+		]}`,
+	})
+
+	m, err := Load(filepath.Join(dir, "project.mml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Group{
+		{Name: "roads", Active: true, MaxZoom: 30, Layers: []string{"roads"}},
+		{Name: "labels", Active: false, MinZoom: 10, MaxZoom: 30, CompOp: "multiply", Layers: []string{"places", "roads-labels"}},
+	}
+	if !reflect.DeepEqual(m.Groups, expected) {
+		t.Errorf("unexpected groups %#v", m.Groups)
+	}
+	if m.Layers[1].CompOp != "multiply" || m.Layers[2].CompOp != "" {
+		t.Error("comp-op of group not set", m.Layers)
+	}
+	if !m.Layers[1].Active {
+		t.Error("status of group should not change layer status")
+	}
+
+	if _, err := Parse(strings.NewReader(`{"groups": [{"status": "off"}]}`)); err == nil {
+		t.Error("expected error for group without name")
+	}
+}
+
+func TestParseDEMDatasources(t *testing.T) {
+	m, err := Parse(strings.NewReader(`{"Layer": [
+		{"name": "hillshade", "Datasource": {"type": "gdal", "file": "hillshade.tif", "band": "1", "nodata": "0", "overview": "2"}},
+		{"name": "contours", "Datasource": {"type": "contour", "file": "contours.gpkg", "layer": "contour", "interval": "50"}},
+		{"name": "contour-points", "geometry": "point", "Datasource": {"type": "contour", "file": "contours.gpkg", "elevation_field": "height"}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Type != Raster {
+		t.Error("gdal layer not a raster", m.Layers[0].Type)
+	}
+	if ds := m.Layers[0].Datasource; ds != (GDAL{Filename: "hillshade.tif", Band: "1", Nodata: "0", Overview: "2"}) {
+		t.Errorf("unexpected datasource %#v", ds)
+	}
+	if m.Layers[1].Type != LineString {
+		t.Error("contour layer not a linestring", m.Layers[1].Type)
+	}
+	if ds := m.Layers[1].Datasource; ds != (Contour{Filename: "contours.gpkg", Layer: "contour", ElevationField: "elev", Interval: "50"}) {
+		t.Errorf("unexpected datasource %#v", ds)
+	}
+	if m.Layers[2].Type != Point {
+		t.Error("geometry not used for contour layer", m.Layers[2].Type)
+	}
+	if ds := m.Layers[2].Datasource.(Contour); ds.ElevationField != "height" {
+		t.Errorf("unexpected datasource %#v", ds)
+	}
+}
+
+func TestParseInlineDatasources(t *testing.T) {
+	m, err := Parse(strings.NewReader(`{"Layer": [
+		{"name": "marker", "Datasource": {"inline": {"type": "Point", "coordinates": [7.1, 50.7]}}},
+		{"name": "cities", "Datasource": {"type": "csv", "inline": "name,lon,lat\nBonn,7.1,50.7\n"}},
+		{"name": "rows", "Datasource": {"type": "csv", "inline": ["name,wkt", ["Bonn, \"DE\"", "POINT(7.1 50.7)"], ["x", 1.5]]}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []Inline{
+		{Format: "geojson", Data: `{"type":"Point","coordinates":[7.1,50.7]}`},
+		{Format: "csv", Data: "name,lon,lat\nBonn,7.1,50.7\n"},
+		{Format: "csv", Data: "name,wkt\n\"Bonn, \"\"DE\"\"\",POINT(7.1 50.7)\nx,1.5\n"},
+	} {
+		if ds := m.Layers[i].Datasource; ds != expected {
+			t.Errorf("unexpected datasource %#v", ds)
+		}
+	}
+
+	for _, mml := range []string{
+		`{"Layer": [{"name": "a", "Datasource": {"type": "shape", "inline": "a,b"}}]}`,
+		`{"Layer": [{"name": "a", "Datasource": {"type": "csv", "inline": [{"a": 1}]}}]}`,
+		`{"Layer": [{"name": "a", "Datasource": {"type": "postgis", "port": 5432}}]}`,
+	} {
+		if _, err := Parse(strings.NewReader(mml)); err == nil {
+			t.Error("expected error for", mml)
+		}
+	}
+}
+
+func TestParseInteractivity(t *testing.T) {
+	layers := `"Layer": [{"id": "countries", "Datasource": {"file": "countries.shp", "type": "shape"}}]`
+	for _, tc := range []struct {
+		mml      string
+		expected *Interactivity
+	}{
+		{`{` + layers + `}`, nil},
+		{`{"interactivity": false, ` + layers + `}`, nil},
+		{
+			`{"interactivity": {"layer": "countries", "fields": "NAME, POP2005", "template_teaser": "{{{NAME}}}", "template_full": "{{{POP2005}}}"}, ` + layers + `}`,
+			&Interactivity{
+				Layer:    "countries",
+				Fields:   []string{"NAME", "POP2005"},
+				Template: "{{#__teaser__}}{{{NAME}}}{{/__teaser__}}{{#__full__}}{{{POP2005}}}{{/__full__}}",
+			},
+		},
+		{
+			`{"interactivity": {"layer": "countries", "fields": ["NAME"], "template": "{{NAME}}"}, ` + layers + `}`,
+			&Interactivity{Layer: "countries", Fields: []string{"NAME"}, Template: "{{NAME}}"},
+		},
+	} {
+		m, err := Parse(strings.NewReader(tc.mml))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if !reflect.DeepEqual(m.Interactivity, tc.expected) {
+			t.Errorf("unexpected interactivity %#v for %s", m.Interactivity, tc.mml)
+		}
+	}
+
+	for _, mml := range []string{
+		`{"interactivity": {"layer": "unknown"}, ` + layers + `}`,
+		`{"interactivity": {"layer": "countries", "fields": 1}, ` + layers + `}`,
+	} {
+		if _, err := Parse(strings.NewReader(mml)); err == nil {
+			t.Error("expected error for", mml)
+		}
+	}
+}
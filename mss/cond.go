@@ -0,0 +1,157 @@
+package mss
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Define sets a build flag for @if conditions, e.g. Define("target",
+// "mapserver").
+func (d *Decoder) Define(name, value string) {
+	if d.defines == nil {
+		d.defines = make(map[string]string)
+	}
+	d.defines[name] = value
+}
+
+// isConditional returns whether the token is an @if block and not the
+// definition of a variable named if.
+func (d *Decoder) isConditional(tok *token) bool {
+	if tok.t != tokenAtKeyword || tok.value != "@if" {
+		return false
+	}
+	next := d.next()
+	d.backup()
+	return next.t != tokenColon
+}
+
+// conditional decodes @if blocks with optional @else or @else @if blocks,
+// e.g.
+//
+//	@if target = mapserver { #roads { line-width: 2; } }
+//	@else @if hires and not draft { ... }
+//	@else { ... }
+//
+// Only the block of the first matching condition is inserted. skip is true
+// if a previous condition already matched.
+func (d *Decoder) conditional(skip bool) {
+	cond := d.condition()
+	d.expect(tokenLBrace)
+	body := d.blockTokens("@if")
+	use := cond && !skip
+
+	next := d.next()
+	if next.t == tokenAtKeyword && next.value == "@else" {
+		elseTok := d.next()
+		if elseTok.t == tokenAtKeyword && elseTok.value == "@if" {
+			d.conditional(skip || cond)
+		} else {
+			d.backup()
+			d.expect(tokenLBrace)
+			elseBody := d.blockTokens("@else")
+			if !skip && !cond {
+				d.expansions = append(d.expansions, &expansion{tokens: elseBody})
+			}
+		}
+	} else {
+		// re-queue, the body needs to be read first
+		d.unread(next)
+	}
+	if use {
+		d.expansions = append(d.expansions, &expansion{tokens: body})
+	}
+}
+
+// condition decodes `cond {or cond}`.
+func (d *Decoder) condition() bool {
+	result := d.andCondition()
+	for {
+		tok := d.next()
+		if tok.t != tokenIdent || tok.value != "or" {
+			d.backup()
+			return result
+		}
+		if d.andCondition() {
+			result = true
+		}
+	}
+}
+
+// andCondition decodes `cond {and cond}`.
+func (d *Decoder) andCondition() bool {
+	result := d.notCondition()
+	for {
+		tok := d.next()
+		if tok.t != tokenIdent || tok.value != "and" {
+			d.backup()
+			return result
+		}
+		if !d.notCondition() {
+			result = false
+		}
+	}
+}
+
+// notCondition decodes `[not] flag [(=|!=) value]` or a condition in
+// parenthesis. Flags without comparison are true if they are defined and
+// not empty, false or 0.
+func (d *Decoder) notCondition() bool {
+	tok := d.next()
+	if tok.t == tokenIdent && tok.value == "not" {
+		return !d.notCondition()
+	}
+	if tok.t == tokenLParen {
+		result := d.condition()
+		d.expect(tokenRParen)
+		return result
+	}
+	if tok.t != tokenIdent {
+		d.error(d.pos(tok), "expected flag in condition, got %v", tok)
+	}
+	value := d.defines[tok.value]
+
+	comp := d.next()
+	if comp.t != tokenComp {
+		d.backup()
+		return value != "" && value != "false" && value != "0"
+	}
+	if comp.value != "=" && comp.value != "!=" {
+		d.error(d.pos(comp), "only = and != supported in conditions, got %v", comp)
+	}
+	other := d.next()
+	var otherValue string
+	switch other.t {
+	case tokenIdent, tokenNumber:
+		otherValue = other.value
+	case tokenString:
+		otherValue = other.value[1 : len(other.value)-1]
+	default:
+		d.error(d.pos(other), "expected value in condition, got %v", other)
+	}
+	return (value == otherValue) == (comp.value == "=")
+}
+
+// EvalCondition evaluates an @if condition (e.g. `target = mapserver`) with
+// the defined build flags.
+func EvalCondition(cond string, defines map[string]string) (result bool, err error) {
+	d := New()
+	d.defines = defines
+	d.scanner = newScanner(cond)
+	defer func() {
+		if r := recover(); r != nil {
+			switch x := r.(type) {
+			case *ParseError:
+				err = errors.New(x.Err)
+			case error:
+				err = x
+			default:
+				err = fmt.Errorf("unexpected error: %v, %T", r, r)
+			}
+		}
+	}()
+	result = d.condition()
+	if tok := d.next(); tok.t != tokenEOF {
+		d.error(d.pos(tok), "unexpected %v after condition", tok)
+	}
+	return result, nil
+}
@@ -0,0 +1,82 @@
+package mss
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditional(t *testing.T) {
+	for _, tc := range []struct {
+		defines map[string]string
+		width   float64
+		color   bool
+	}{
+		{map[string]string{"target": "mapserver"}, 1, false},
+		{map[string]string{"target": "mapnik3", "hires": "true"}, 4, true},
+		{map[string]string{"target": "mapnik3", "hires": "true", "draft": "1"}, 3, true},
+		{map[string]string{"target": "mapnik2"}, 3, true},
+	} {
+		d := New()
+		for k, v := range tc.defines {
+			d.Define(k, v)
+		}
+		err := d.ParseString(`
+@if: 3;
+@if target = mapserver {
+	#roads { line-width: 1; }
+} @else @if hires and not draft {
+	#roads { line-width: 4; }
+} @else {
+	#roads { line-width: @if; }
+}
+#roads {
+	@if target != 'mapserver' { line-color: red; }
+	line-cap: round;
+}
+`)
+		assert.NoError(t, err)
+		rules := d.MSS().LayerRules("roads")
+		if len(rules) != 1 {
+			t.Fatal("unexpected rules", rules)
+		}
+		v, _ := rules[0].Properties.get("line-width")
+		assert.Equal(t, tc.width, v, "%v", tc.defines)
+		_, ok := rules[0].Properties.get("line-color")
+		assert.Equal(t, tc.color, ok, "%v", tc.defines)
+		v, _ = rules[0].Properties.get("line-cap")
+		assert.Equal(t, "round", v)
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	defines := map[string]string{"target": "mapserver", "draft": "false", "scale": "2"}
+	for _, tc := range []struct {
+		cond   string
+		result bool
+		err    string
+	}{
+		{"target = mapserver", true, ""},
+		{"target = 'mapserver'", true, ""},
+		{"target != mapserver", false, ""},
+		{"draft", false, ""},
+		{"not draft", true, ""},
+		{"missing", false, ""},
+		{"scale = 2 and (draft or target = mapserver)", true, ""},
+		{"target = mapnik2 or target = mapnik3", false, ""},
+		{"target > mapnik", false, "only = and != supported"},
+		{"target = ", false, "expected value"},
+		{"target mapserver", false, "unexpected IDENT"},
+	} {
+		result, err := EvalCondition(tc.cond, defines)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q for %s, got %v", tc.err, tc.cond, err)
+			}
+			continue
+		}
+		assert.NoError(t, err, tc.cond)
+		assert.Equal(t, tc.result, result, tc.cond)
+	}
+}
@@ -18,6 +18,7 @@ import (
 type Decoder struct {
 	mss           *MSS
 	vars          *Properties
+	varOrigins    map[string]*Variable
 	scanner       *scanner
 	nextTok       *token
 	lastTok       *token
@@ -28,6 +29,10 @@ type Decoder struct {
 	filename      string // for warnings/errors only
 	filesParsed   int
 	propertyIndex int
+	mixins        map[string]*mixin
+	expansions    []*expansion
+	defines       map[string]string
+	scale         float64 // of sizes for the output DPI, 0 for DefaultDPI
 }
 
 type warning struct {
@@ -62,7 +67,7 @@ func (w *warning) String() string {
 // New will allocate a new MSS Decoder
 func New() *Decoder {
 	mss := newMSS()
-	return &Decoder{mss: mss, vars: &Properties{}, expr: &expression{}}
+	return &Decoder{mss: mss, vars: &Properties{}, expr: &expression{}, mixins: make(map[string]*mixin)}
 }
 
 func (d *Decoder) EnableDeferredEval() {
@@ -81,6 +86,16 @@ func (d *Decoder) next() *token {
 		d.lastTok = tok
 		return tok
 	}
+	for len(d.expansions) > 0 {
+		e := d.expansions[len(d.expansions)-1]
+		if e.pos < len(e.tokens) {
+			tok := e.tokens[e.pos]
+			e.pos++
+			d.lastTok = tok
+			return tok
+		}
+		d.expansions = d.expansions[:len(d.expansions)-1]
+	}
 	for {
 		tok := d.scanner.Next()
 		if tok.t == tokenError {
@@ -121,6 +136,7 @@ func (d *Decoder) ParseFile(filename string) error {
 func (d *Decoder) ParseString(content string) (err error) {
 	d.filesParsed += 1
 	d.scanner = newScanner(content)
+	d.expansions = nil
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -217,6 +233,8 @@ func (d *Decoder) valueType(v interface{}) codeType {
 		return typeColor
 	case []Value:
 		return typeList // TODO convert v to typeList?
+	case relativeSize:
+		return typeRelativeSize
 	default:
 		return typeUnknown
 	}
@@ -229,8 +247,11 @@ func (d *Decoder) evaluateProperties(properties *Properties, validate bool) {
 	for _, k := range properties.keys() {
 		if expr, ok := properties.getKey(k).(*expression); ok {
 			v := d.evaluateExpression(expr)
-			if validate && !validProperty(k.name, v) {
-				d.warn(properties.pos(k), "invalid property %v %v", k.name, v)
+			if validate {
+				if !validProperty(k.name, v) {
+					d.warn(properties.pos(k), "invalid property %v %v", k.name, v)
+				}
+				v = d.scaleSize(k.name, v)
 			}
 			attr := properties.values[k]
 			properties.setPos(k, v, attr.pos)
@@ -241,12 +262,33 @@ func (d *Decoder) evaluateProperties(properties *Properties, validate bool) {
 func (d *Decoder) topLevel(tok *token) {
 	switch tok.t {
 	case tokenAtKeyword:
+		if d.isEach(tok) {
+			d.each()
+			return
+		}
+		if d.isConditional(tok) {
+			d.conditional(false)
+			return
+		}
 		keyword := tok.value[1:]
 		d.expect(tokenColon)
+		if m, ok := d.mapDefinition(); ok {
+			isDefault := d.isDefaultFlag()
+			d.expect(tokenSemicolon)
+			d.setVar(keyword, m, isDefault, tok)
+			return
+		}
 		d.expressionList()
+		isDefault := d.isDefaultFlag()
 		d.expect(tokenSemicolon)
-		d.vars.set(keyword, d.lastValue)
-	case tokenHash, tokenAttachment, tokenClass, tokenLBracket:
+		d.setVar(keyword, d.lastValue, isDefault, tok)
+	case tokenClass:
+		if d.isMixin(tok) {
+			d.mixinDefinition(tok)
+		} else {
+			d.rule(tok)
+		}
+	case tokenHash, tokenAttachment, tokenLBracket:
 		d.rule(tok)
 	case tokenIdent:
 		if tok.value != "Map" {
@@ -274,8 +316,22 @@ func (d *Decoder) block() {
 	for {
 		tok := d.next()
 		switch tok.t {
-		case tokenHash, tokenAttachment, tokenClass, tokenLBracket:
+		case tokenClass:
+			if d.isMixin(tok) {
+				d.mixinCall(tok)
+			} else {
+				d.rule(tok)
+			}
+		case tokenHash, tokenAttachment, tokenLBracket:
 			d.rule(tok)
+		case tokenAtKeyword:
+			if d.isEach(tok) {
+				d.each()
+			} else if d.isConditional(tok) {
+				d.conditional(false)
+			} else {
+				d.error(d.pos(tok), "unexpected token %v", tok)
+			}
 		case tokenIdent, tokenInstance:
 			keyword := tok.value
 			if tok.t == tokenInstance {
@@ -288,8 +344,11 @@ func (d *Decoder) block() {
 			}
 			d.expect(tokenColon)
 			d.expressionList()
-			if !d.deferEval && !validProperty(keyword, d.lastValue) {
-				d.warn(d.pos(tok), "invalid property %v %v", keyword, d.lastValue)
+			if !d.deferEval {
+				if !validProperty(keyword, d.lastValue) {
+					d.warn(d.pos(tok), "invalid property %v %v", keyword, d.lastValue)
+				}
+				d.lastValue = d.scaleSize(keyword, d.lastValue)
 			}
 			d.mss.setProperty(keyword, d.lastValue,
 				position{line: tok.line, column: tok.column, filename: d.filename, filenum: d.filesParsed, index: d.propertyIndex},
@@ -407,6 +466,13 @@ func (d *Decoder) filter() {
 		value = tok.value[1 : len(tok.value)-1]
 	case tokenNumber:
 		value, _ = strconv.ParseFloat(tok.value, 64)
+	case tokenValue:
+		switch v := tok.v.(type) {
+		case string, float64:
+			value = v
+		default:
+			d.error(d.pos(tok), "unexpected value in filter '%v'", v)
+		}
 	case tokenIdent:
 		if tok.value == "null" {
 			value = nil
@@ -550,6 +616,12 @@ func (d *Decoder) value(tok *token) {
 			d.error(d.pos(tok), "invalid float %v: %s", v, err)
 		}
 		d.expr.addValue(v, typeNum)
+	case tokenDimension:
+		v, err := parseDimension(tok.value)
+		if err != nil {
+			d.error(d.pos(tok), "%s", err)
+		}
+		d.expr.addValue(v, d.valueType(v))
 	case tokenPercentage:
 		v, err := strconv.ParseFloat(tok.value[:len(tok.value)-1], 64)
 		if err != nil {
@@ -580,17 +652,25 @@ func (d *Decoder) value(tok *token) {
 		}
 		d.expr.addValue(c, typeColor)
 	case tokenAtKeyword:
+		varname := tok.value[1:] // strip @
+		if m := d.mapVar(varname); m != nil {
+			// maps are already evaluated, also with deferred evaluation
+			v := d.mapLookup(varname, m, tok)
+			d.expr.addValue(v, d.valueType(v))
+			return
+		}
 		if d.deferEval {
-			d.expr.addValue(tok.value[1:], typeVar)
+			d.expr.addValue(varname, typeVar)
 			return
 		}
-		varname := tok.value[1:] // strip @
 		v, _ := d.vars.get(varname)
 		if v == nil {
 			d.error(d.pos(tok), "missing var %s at %v", varname, tok)
 		}
 		t := d.valueType(v)
 		d.expr.addValue(v, t)
+	case tokenValue:
+		d.expr.addValue(tok.v, d.valueType(tok.v))
 	case tokenURI:
 		match := urlPath.FindStringSubmatch(tok.value)
 		d.expr.addValue(match[1], typeURL)
@@ -279,6 +279,74 @@ func TestParseNull(t *testing.T) {
 	assert.Equal(t, Filter{"type", NEQ, nil}, d.MSS().root.blocks[0].selectors[0].Filters[0])
 }
 
+func TestParseLabelExpression(t *testing.T) {
+	d, err := decodeString(`#foo {
+		text-name: [ref] + " " + ([name] + "'s");
+		shield-name: "Nr. " + [ref];
+	}`)
+	assert.NoError(t, err)
+	assert.Empty(t, d.warnings)
+	rules := allRules(d.MSS())
+	assert.Equal(t, []Value{Field("[ref]"), " ", Field("[name]"), "'s"}, rules[0].Properties.getKey(key{name: "text-name"}))
+	assert.Equal(t, []Value{"Nr. ", Field("[ref]")}, rules[0].Properties.getKey(key{name: "shield-name"}))
+
+	_, err = decodeString(`#foo { text-name: if("ref", [ref], [name]); }`)
+	assert.Error(t, err)
+}
+
+func TestParseTransform(t *testing.T) {
+	d, err := decodeString(`#foo {
+		marker-transform: rotate([angle]) scale(0.5);
+		point-transform: translate(2, -2.5);
+		polygon-pattern-transform: "rotate(45)";
+	}`)
+	assert.NoError(t, err)
+	assert.Empty(t, d.warnings)
+	rules := allRules(d.MSS())
+	assert.Equal(t, "rotate([angle]) scale(0.5)", rules[0].Properties.getKey(key{name: "marker-transform"}))
+	assert.Equal(t, "translate(2, -2.5)", rules[0].Properties.getKey(key{name: "point-transform"}))
+	assert.Equal(t, "rotate(45)", rules[0].Properties.getKey(key{name: "polygon-pattern-transform"}))
+
+	_, err = decodeString(`#foo { marker-transform: rotate("45"); }`)
+	assert.Error(t, err)
+
+	d, err = decodeString(`#foo { marker-transform: "spin(45)"; }`)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, d.warnings)
+}
+
+func TestParseConditionalLabel(t *testing.T) {
+	d, err := decodeString(`#foo[type=1] {
+		text-name: if([ref], [ref] + " " + [name], [name]);
+		shield-name: if([ref], [ref]);
+		line-width: 1;
+	}
+	#bar[ref=null] { text-name: if([ref], [ref], if([name], [name], "?")); }
+	`)
+	assert.NoError(t, err)
+	assert.Empty(t, d.warnings)
+	rules := d.MSS().LayerRules("foo")
+	assert.Len(t, rules, 2)
+
+	refFilters := []Filter{{"ref", NEQ, nil}, {"ref", NEQ, ""}}
+	assert.Equal(t, append(refFilters, Filter{"type", EQ, float64(1)}), rules[0].Filters)
+	assert.Equal(t, []Value{Field("[ref]"), " ", Field("[name]")}, rules[0].Properties.getKey(key{name: "text-name"}))
+	assert.Equal(t, "[ref]", rules[0].Properties.getKey(key{name: "shield-name"}))
+	assert.Equal(t, float64(1), rules[0].Properties.getKey(key{name: "line-width"}))
+
+	assert.Equal(t, []Filter{{"type", EQ, float64(1)}}, rules[1].Filters)
+	assert.Equal(t, "[name]", rules[1].Properties.getKey(key{name: "text-name"}))
+	assert.Equal(t, "", rules[1].Properties.getKey(key{name: "shield-name"}))
+
+	// [ref] is always null, nested condition
+	rules = d.MSS().LayerRules("bar")
+	assert.Len(t, rules, 2)
+	assert.Equal(t, []Filter{{"name", NEQ, nil}, {"name", NEQ, ""}, {"ref", EQ, nil}}, rules[0].Filters)
+	assert.Equal(t, "[name]", rules[0].Properties.getKey(key{name: "text-name"}))
+	assert.Equal(t, []Filter{{"ref", EQ, nil}}, rules[1].Filters)
+	assert.Equal(t, "?", rules[1].Properties.getKey(key{name: "text-name"}))
+}
+
 func TestParseMapBlock(t *testing.T) {
 	d, err := decodeString(`
 	#foo {line-width: 1}
@@ -0,0 +1,229 @@
+package mss
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// varMap is the value of map variables, e.g.
+//
+//	@widths: (motorway: 4, trunk: 3, primary: 2);
+//
+// Entries are accessed with @widths[motorway] or iterated with @each.
+type varMap struct {
+	keys   []string
+	values map[string]Value
+}
+
+func (m *varMap) String() string {
+	s := "("
+	for i, k := range m.keys {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s: %v", k, m.values[k])
+	}
+	return s + ")"
+}
+
+// unread re-queues tokens to read them again with next.
+func (d *Decoder) unread(tokens ...*token) {
+	d.expansions = append(d.expansions, &expansion{tokens: tokens})
+}
+
+// mapDefinition decodes a map after the colon of a variable definition. It
+// returns false (and nothing is consumed) if the value is not a map.
+func (d *Decoder) mapDefinition() (*varMap, bool) {
+	lparen := d.next()
+	if lparen.t != tokenLParen {
+		d.backup()
+		return nil, false
+	}
+	key := d.next()
+	if key.t != tokenIdent && key.t != tokenString && key.t != tokenNumber {
+		d.unread(lparen, key)
+		return nil, false
+	}
+	colon := d.next()
+	if colon.t != tokenColon {
+		d.unread(lparen, key, colon)
+		return nil, false
+	}
+
+	m := &varMap{values: make(map[string]Value)}
+	for {
+		k := d.mapKey(key)
+		if _, ok := m.values[k]; ok {
+			d.error(d.pos(key), "duplicate key %s in map", k)
+		}
+		d.expr.pos = d.pos(key)
+		d.expression()
+		m.keys = append(m.keys, k)
+		m.values[k] = d.evaluateExpression(d.expr)
+		d.expr = &expression{}
+
+		tok := d.next()
+		if tok.t == tokenRParen {
+			return m, true
+		}
+		if tok.t != tokenComma {
+			d.error(d.pos(tok), "expected comma or end of map, got %v", tok)
+		}
+		key = d.next()
+		d.expect(tokenColon)
+	}
+}
+
+// mapKey returns the key for ident, string, number or value tokens.
+func (d *Decoder) mapKey(tok *token) string {
+	switch tok.t {
+	case tokenIdent:
+		return tok.value
+	case tokenString:
+		return tok.value[1 : len(tok.value)-1]
+	case tokenNumber:
+		v, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			d.error(d.pos(tok), "invalid float %v: %s", tok.value, err)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case tokenValue:
+		switch v := tok.v.(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+	}
+	d.error(d.pos(tok), "expected map key, got %v", tok)
+	return ""
+}
+
+// mapLookup decodes the key of @map[key] and returns the value.
+func (d *Decoder) mapLookup(name string, m *varMap, tok *token) Value {
+	lbracket := d.next()
+	if lbracket.t != tokenLBracket {
+		d.error(d.pos(tok), "map @%s requires key, e.g. @%s[%s]", name, name, firstKey(m))
+	}
+	key := d.mapKey(d.next())
+	d.expect(tokenRBracket)
+	v, ok := m.values[key]
+	if !ok {
+		d.error(d.pos(tok), "missing key %s in map @%s", key, name)
+	}
+	return v
+}
+
+func firstKey(m *varMap) string {
+	if len(m.keys) == 0 {
+		return "key"
+	}
+	return m.keys[0]
+}
+
+// mapVar returns the map of the variable, or nil if it is not a map.
+func (d *Decoder) mapVar(name string) *varMap {
+	v, _ := d.vars.get(name)
+	m, _ := v.(*varMap)
+	return m
+}
+
+// each decodes iterations over lists or maps, e.g.
+//
+//	@each @type in @roadtypes { #roads[type=@type] { .casing(@widths[@type]); } }
+//	@each @type, @width in @widths { ... }
+//	@each @type in motorway, trunk { ... }
+//
+// The body is inserted once for each entry, with the variables replaced by
+// the value (and key) of the entry. Lists and maps are evaluated when @each
+// is decoded, also with deferred evaluation.
+func (d *Decoder) each() {
+	var names []*token
+	for {
+		name := d.next()
+		if name.t != tokenAtKeyword {
+			d.error(d.pos(name), "expected variable for @each, got %v", name)
+		}
+		names = append(names, name)
+		sep := d.next()
+		if sep.t == tokenIdent && sep.value == "in" {
+			break
+		}
+		if sep.t != tokenComma || len(names) == 2 {
+			d.error(d.pos(sep), "expected 'in' after variables of @each, got %v", sep)
+		}
+	}
+
+	// entries as key/value pairs, keys are nil for lists
+	var keys, values []Value
+	src := d.next()
+	if m := d.mapVarToken(src); m != nil && d.next().t == tokenLBrace {
+		for _, k := range m.keys {
+			keys = append(keys, k)
+			values = append(values, m.values[k])
+		}
+		d.backup()
+	} else {
+		if m != nil {
+			// @map[key] lookup
+			d.unread(src, d.lastTok)
+		} else {
+			d.unread(src)
+		}
+		d.expressionList()
+		v := d.lastValue
+		if expr, ok := v.(*expression); ok {
+			v = d.evaluateExpression(expr)
+		}
+		if list, ok := v.([]Value); ok {
+			values = list
+		} else {
+			values = []Value{v}
+		}
+		keys = make([]Value, len(values))
+		if len(names) == 2 {
+			d.error(d.pos(names[1]), "@each over list requires single variable, got %s, %s", names[0].value, names[1].value)
+		}
+	}
+	d.expect(tokenLBrace)
+	body := d.blockTokens("@each")
+
+	// push in reverse order, the last expansion is read first
+	for i := len(values) - 1; i >= 0; i-- {
+		entry := []Value{values[i]}
+		if keys[i] != nil {
+			entry = []Value{keys[i], values[i]}
+		}
+		tokens := make([]*token, len(body))
+		for j, t := range body {
+			tokens[j] = t
+			if t.t != tokenAtKeyword {
+				continue
+			}
+			for n, name := range names {
+				if t.value == name.value {
+					tokens[j] = &token{t: tokenValue, value: fmt.Sprint(entry[n]), v: entry[n], line: t.line, column: t.column}
+				}
+			}
+		}
+		d.expansions = append(d.expansions, &expansion{tokens: tokens})
+	}
+}
+
+func (d *Decoder) mapVarToken(tok *token) *varMap {
+	if tok.t != tokenAtKeyword {
+		return nil
+	}
+	return d.mapVar(tok.value[1:])
+}
+
+// isEach returns whether the token is an @each iteration and not the
+// definition of a variable named each.
+func (d *Decoder) isEach(tok *token) bool {
+	if tok.t != tokenAtKeyword || tok.value != "@each" {
+		return false
+	}
+	next := d.next()
+	d.backup()
+	return next.t == tokenAtKeyword
+}
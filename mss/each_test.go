@@ -0,0 +1,88 @@
+package mss
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/color"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEach(t *testing.T) {
+	for _, deferEval := range []bool{false, true} {
+		d := New()
+		if deferEval {
+			d.EnableDeferredEval()
+		}
+		err := d.ParseString(`
+@roadtypes: motorway, trunk, 'living street';
+@base: 2;
+@widths: (motorway: @base * 2, trunk: 3, 'living street': 1);
+@colors: (motorway: red, trunk: #00f);
+.casing(@width) { line-width: @width; }
+
+@each @type in @roadtypes {
+	#roads[type=@type] { .casing(@widths[@type]); }
+}
+#roads {
+	@each @type, @color in @colors {
+		[type=@type] { line-color: @color; }
+	}
+	@each @z in 14, 16 {
+		[zoom>=14][lanes=@z] { line-width: @z / 2; }
+	}
+}
+`)
+		assert.NoError(t, err)
+		assert.NoError(t, d.Evaluate())
+
+		rules := d.MSS().LayerRules("roads")
+		widths := map[string]interface{}{}
+		colors := map[string]interface{}{}
+		lanes := map[interface{}]interface{}{}
+		for _, r := range rules {
+			if len(r.Filters) != 1 {
+				continue
+			}
+			if r.Filters[0].Field == "lanes" {
+				lanes[r.Filters[0].Value], _ = r.Properties.get("line-width")
+				continue
+			}
+			typ := r.Filters[0].Value.(string)
+			if v, ok := r.Properties.get("line-width"); ok {
+				widths[typ] = v
+			}
+			if v, ok := r.Properties.get("line-color"); ok {
+				colors[typ] = v
+			}
+		}
+		assert.Equal(t, map[string]interface{}{"motorway": 4.0, "trunk": 3.0, "living street": 1.0}, widths)
+		assert.Equal(t, map[string]interface{}{"motorway": color.MustParse("red"), "trunk": color.MustParse("#00f")}, colors)
+		assert.Equal(t, map[interface{}]interface{}{14.0: 7.0, 16.0: 8.0}, lanes)
+	}
+}
+
+func TestEachErrors(t *testing.T) {
+	for _, tc := range []struct {
+		mss string
+		err string
+	}{
+		{`@m: (a: 1); #roads { line-width: @m; }`, "map @m requires key"},
+		{`@m: (a: 1); #roads { line-width: @m[b]; }`, "missing key b in map @m"},
+		{`@m: (a: 1, a: 2);`, "duplicate key a"},
+		{`@l: a, b; @each @k, @v in @l { }`, "@each over list requires single variable"},
+		{`@each @t of a, b { }`, "expected 'in'"},
+		{`@each @t in a, b { #roads { line-width: 1; }`, "unexpected end of @each"},
+	} {
+		_, err := decodeString(tc.mss)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error %q for %s, got %v", tc.err, tc.mss, err)
+		}
+	}
+
+	// variables named each and expressions in parenthesis are not affected
+	d, err := decodeString(`@each: 2; @w: (@each + 1) * 2; #roads { line-width: @w; }`)
+	assert.NoError(t, err)
+	v, _ := d.MSS().LayerRules("roads")[0].Properties.get("line-width")
+	assert.Equal(t, 6.0, v)
+}
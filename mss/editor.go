@@ -0,0 +1,319 @@
+package mss
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// CompletionKind is the kind of name that is expected at a position of an
+// MSS document.
+type CompletionKind int
+
+const (
+	CompleteNone CompletionKind = iota
+	CompleteProperty
+	CompleteValue
+	CompleteVariable
+	CompleteLayer
+	CompleteClass
+	CompleteField
+)
+
+// CompletionContext describes a position of an MSS document for editor
+// completions.
+type CompletionContext struct {
+	Kind CompletionKind
+	// Prefix is the partial name before the position, without the @, # or
+	// . of variables, layers and classes.
+	Prefix string
+	// Property of CompleteValue, and of CompleteField for fields in values
+	// (e.g. text-name). Empty for values of variables and for filters.
+	Property string
+	// Layers are the #layer selectors of all enclosing rules.
+	Layers []string
+}
+
+// SymbolKind is the kind of a Symbol.
+type SymbolKind int
+
+const (
+	SymbolProperty SymbolKind = iota + 1
+	SymbolVariable
+	SymbolLayer
+	SymbolClass
+	SymbolField
+)
+
+// Symbol is a name in an MSS document.
+type Symbol struct {
+	Kind SymbolKind
+	// Name without the @, # or . of variables, layers and classes.
+	Name string
+	// Line and Column of the first character, starting at 1. Columns
+	// count characters, not bytes.
+	Line, Column int
+	// Value of variable definitions, as written in the document.
+	Value string
+}
+
+// editorToken is a token with its position in the statements of the
+// document. Whitespace and comments are not included.
+type editorToken struct {
+	*token
+	// offset of the token in the document
+	offset int
+	// depth of the rules after the token
+	depth int
+	// index in the current statement
+	index int
+	// inValue is true for tokens after the colon of a declaration
+	inValue bool
+	// inBracket is true for tokens in filters and fields
+	inBracket bool
+	// layers of the enclosing rules and of the current selector
+	layers []string
+}
+
+// scanEditorTokens returns all tokens of src. The second return value is
+// the last token, including whitespace and comments. Returns false if src
+// ends in an unclosed string or comment.
+func scanEditorTokens(src string) ([]editorToken, *token, bool) {
+	s := newScanner(src)
+	var result []editorToken
+	var stack [][]string // layers of each enclosing rule
+	var layers []string  // layers of the current statement
+	var last *token
+	index := 0
+	inValue := false
+	brackets := 0
+	for {
+		t := s.Next()
+		if t.t == tokenEOF {
+			return result, last, true
+		}
+		if t.t == tokenError {
+			return result, last, false
+		}
+		last = t
+		offset := s.pos - len(t.value)
+		switch t.t {
+		case tokenS, tokenComment, tokenBOM:
+			continue
+		}
+		et := editorToken{token: t, offset: offset, index: index, inValue: inValue, inBracket: brackets > 0}
+		switch t.t {
+		case tokenLBrace:
+			stack = append(stack, layers)
+			index, inValue, brackets = 0, false, 0
+		case tokenRBrace, tokenSemicolon:
+			if t.t == tokenRBrace && len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+			layers = nil
+			if len(stack) > 0 {
+				layers = stack[len(stack)-1]
+			}
+			index, inValue, brackets = 0, false, 0
+		default:
+			index++
+			switch t.t {
+			case tokenColon:
+				inValue = true
+			case tokenLBracket:
+				brackets++
+			case tokenRBracket:
+				if brackets > 0 {
+					brackets--
+				}
+			case tokenHash:
+				if !inValue && brackets == 0 {
+					layers = append(layers[:len(layers):len(layers)], t.value[1:])
+				}
+			}
+		}
+		et.depth = len(stack)
+		et.layers = layers
+		result = append(result, et)
+	}
+}
+
+// CompletionAt returns the completion context at line and column (starting
+// at 1, columns count characters) of src.
+func CompletionAt(src string, line, column int) CompletionContext {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	tokens, last, ok := scanEditorTokens(src[:offset(src, line, column)])
+	if !ok {
+		// in string or comment
+		return CompletionContext{}
+	}
+	var prev *editorToken
+	if len(tokens) > 0 {
+		prev = &tokens[len(tokens)-1]
+	}
+	if prev == nil || last != prev.token {
+		// after whitespace or at the beginning
+		switch {
+		case prev == nil:
+			return CompletionContext{}
+		case prev.t == tokenSemicolon, prev.t == tokenLBrace, prev.t == tokenRBrace:
+			if prev.depth > 0 {
+				return CompletionContext{Kind: CompleteProperty, Layers: prev.layers}
+			}
+			return CompletionContext{}
+		case prev.t == tokenColon || prev.inValue:
+			return valueContext(tokens, "", prev.layers)
+		}
+		return CompletionContext{}
+	}
+
+	switch prev.t {
+	case tokenAtKeyword:
+		return CompletionContext{Kind: CompleteVariable, Prefix: prev.value[1:], Layers: prev.layers}
+	case tokenChar:
+		switch prev.value {
+		case "@":
+			return CompletionContext{Kind: CompleteVariable, Layers: prev.layers}
+		case "#":
+			if !prev.inValue && !prev.inBracket {
+				return CompletionContext{Kind: CompleteLayer, Layers: prev.layers}
+			}
+		case ".":
+			if !prev.inValue && !prev.inBracket {
+				return CompletionContext{Kind: CompleteClass, Layers: prev.layers}
+			}
+		}
+	case tokenHash:
+		if !prev.inValue && !prev.inBracket {
+			// without the partial layer
+			var layers []string
+			if len(prev.layers) > 1 {
+				layers = prev.layers[:len(prev.layers)-1]
+			}
+			return CompletionContext{Kind: CompleteLayer, Prefix: prev.value[1:], Layers: layers}
+		}
+	case tokenClass:
+		if !prev.inValue && !prev.inBracket {
+			return CompletionContext{Kind: CompleteClass, Prefix: prev.value[1:], Layers: prev.layers}
+		}
+	case tokenLBracket:
+		return fieldContext(tokens, "", prev)
+	case tokenIdent:
+		if len(tokens) > 1 && tokens[len(tokens)-2].t == tokenLBracket {
+			return fieldContext(tokens, prev.value, prev)
+		}
+		if prev.inValue {
+			return valueContext(tokens, prev.value, prev.layers)
+		}
+		if prev.depth > 0 && (prev.index == 0 || (prev.index == 1 && tokens[len(tokens)-2].t == tokenInstance)) {
+			return CompletionContext{Kind: CompleteProperty, Prefix: prev.value, Layers: prev.layers}
+		}
+	case tokenColon, tokenComma, tokenLParen:
+		if prev.inValue || prev.t == tokenColon {
+			return valueContext(tokens, "", prev.layers)
+		}
+	}
+	return CompletionContext{}
+}
+
+// valueContext returns the context of a value of the current declaration.
+func valueContext(tokens []editorToken, prefix string, layers []string) CompletionContext {
+	ctx := CompletionContext{Kind: CompleteValue, Prefix: prefix, Layers: layers}
+	for i := len(tokens) - 1; i > 0; i-- {
+		if tokens[i].t == tokenColon && tokens[i].index > 0 && !tokens[i].inValue {
+			if tokens[i-1].t == tokenIdent {
+				ctx.Property = tokens[i-1].value
+			}
+			break
+		}
+	}
+	return ctx
+}
+
+// fieldContext returns the context of a field of a filter or value.
+func fieldContext(tokens []editorToken, prefix string, prev *editorToken) CompletionContext {
+	ctx := CompletionContext{Kind: CompleteField, Prefix: prefix, Layers: prev.layers}
+	if prev.inValue {
+		ctx.Property = valueContext(tokens, "", nil).Property
+	}
+	return ctx
+}
+
+// SymbolAt returns the property, variable, layer, class or field at line
+// and column (starting at 1, columns count characters) of src.
+func SymbolAt(src string, line, column int) (Symbol, bool) {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	tokens, _, _ := scanEditorTokens(src)
+	for i, t := range tokens {
+		if t.line != line || column < t.column || column > t.column+utf8.RuneCountInString(t.value) {
+			continue
+		}
+		sym := Symbol{Line: t.line, Column: t.column}
+		switch t.t {
+		case tokenAtKeyword:
+			sym.Kind, sym.Name = SymbolVariable, t.value[1:]
+		case tokenHash:
+			if t.inValue || t.inBracket {
+				continue
+			}
+			sym.Kind, sym.Name = SymbolLayer, t.value[1:]
+		case tokenClass:
+			if t.inValue || t.inBracket {
+				continue
+			}
+			sym.Kind, sym.Name = SymbolClass, t.value[1:]
+		case tokenIdent:
+			if i > 0 && tokens[i-1].t == tokenLBracket {
+				sym.Kind, sym.Name = SymbolField, t.value
+			} else if !t.inValue && t.depth > 0 && i+1 < len(tokens) && tokens[i+1].t == tokenColon {
+				sym.Kind, sym.Name = SymbolProperty, t.value
+			} else {
+				continue
+			}
+		default:
+			continue
+		}
+		return sym, true
+	}
+	return Symbol{}, false
+}
+
+// VariableDefinitions returns all variable definitions of src, with their
+// value as written in the document.
+func VariableDefinitions(src string) []Symbol {
+	src = strings.Replace(src, "\r\n", "\n", -1)
+	tokens, _, _ := scanEditorTokens(src)
+	var defs []Symbol
+	for i, t := range tokens {
+		if t.t != tokenAtKeyword || t.index != 0 || i+1 >= len(tokens) || tokens[i+1].t != tokenColon {
+			continue
+		}
+		start := tokens[i+1].offset + 1
+		end := len(src)
+		for _, n := range tokens[i+1:] {
+			if n.index == 0 {
+				end = n.offset
+				break
+			}
+		}
+		value := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(src[start:end]), ";"))
+		defs = append(defs, Symbol{Kind: SymbolVariable, Name: t.value[1:], Line: t.line, Column: t.column, Value: value})
+	}
+	return defs
+}
+
+// offset returns the byte offset of line and column in src.
+func offset(src string, line, column int) int {
+	off := 0
+	for l := 1; l < line; l++ {
+		i := strings.IndexByte(src[off:], '\n')
+		if i < 0 {
+			return len(src)
+		}
+		off += i + 1
+	}
+	for c := 1; c < column && off < len(src) && src[off] != '\n'; c++ {
+		_, w := utf8.DecodeRuneInString(src[off:])
+		off += w
+	}
+	return off
+}
@@ -0,0 +1,103 @@
+package mss
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// cursor returns src without the | and the line and column of the |.
+func cursor(src string) (string, int, int) {
+	i := strings.Index(src, "|")
+	before := src[:i]
+	line := strings.Count(before, "\n") + 1
+	column := len([]rune(before[strings.LastIndex(before, "\n")+1:])) + 1
+	return before + src[i+1:], line, column
+}
+
+func TestCompletionAt(t *testing.T) {
+	for _, tc := range []struct {
+		src      string
+		expected CompletionContext
+	}{
+		{`|`, CompletionContext{}},
+		{`#roads { | }`, CompletionContext{Kind: CompleteProperty, Layers: []string{"roads"}}},
+		{`#roads { line-w| }`, CompletionContext{Kind: CompleteProperty, Prefix: "line-w", Layers: []string{"roads"}}},
+		{`#roads { a/line-w| }`, CompletionContext{Kind: CompleteProperty, Prefix: "line-w", Layers: []string{"roads"}}},
+		{"#roads {\n  line-width: 1;\n  line-cap: |\n}", CompletionContext{Kind: CompleteValue, Property: "line-cap", Layers: []string{"roads"}}},
+		{`#roads { line-cap: ro| }`, CompletionContext{Kind: CompleteValue, Prefix: "ro", Property: "line-cap", Layers: []string{"roads"}}},
+		{`#roads { line-color: @wa| }`, CompletionContext{Kind: CompleteVariable, Prefix: "wa", Layers: []string{"roads"}}},
+		{`@water: @|`, CompletionContext{Kind: CompleteVariable}},
+		{`@water: |`, CompletionContext{Kind: CompleteValue}},
+		{`#ro|`, CompletionContext{Kind: CompleteLayer, Prefix: "ro"}},
+		{`#roads { #|`, CompletionContext{Kind: CompleteLayer, Layers: []string{"roads"}}},
+		{`#roads.ma|`, CompletionContext{Kind: CompleteClass, Prefix: "ma", Layers: []string{"roads"}}},
+		{`#roads[hi|`, CompletionContext{Kind: CompleteField, Prefix: "hi", Layers: []string{"roads"}}},
+		{`#roads, #rail { [|`, CompletionContext{Kind: CompleteField, Layers: []string{"roads", "rail"}}},
+		{`#roads { text-name: [na|`, CompletionContext{Kind: CompleteField, Prefix: "na", Property: "text-name", Layers: []string{"roads"}}},
+		{`#roads { line-color: #ab|`, CompletionContext{}},
+		{`#roads { text-name: "[na|`, CompletionContext{}},
+		{`#roads { } #water { } |`, CompletionContext{}},
+		{"#roads { [zoom>=10] { line-width: 2; } |", CompletionContext{Kind: CompleteProperty, Layers: []string{"roads"}}},
+	} {
+		src, line, column := cursor(tc.src)
+		if ctx := CompletionAt(src, line, column); !reflect.DeepEqual(ctx, tc.expected) {
+			t.Errorf("unexpected context for %q\n%#v\n%#v", tc.src, ctx, tc.expected)
+		}
+	}
+}
+
+func TestSymbolAt(t *testing.T) {
+	for _, tc := range []struct {
+		src      string
+		expected Symbol
+		found    bool
+	}{
+		{"@water: #abc;\n#roads { line-color: @wa|ter; }", Symbol{Kind: SymbolVariable, Name: "water", Line: 2, Column: 22}, true},
+		{`#ro|ads { line-color: red; }`, Symbol{Kind: SymbolLayer, Name: "roads", Line: 1, Column: 1}, true},
+		{`#roads { line-co|lor: red; }`, Symbol{Kind: SymbolProperty, Name: "line-color", Line: 1, Column: 10}, true},
+		{`#roads[high|way=primary] { }`, Symbol{Kind: SymbolField, Name: "highway", Line: 1, Column: 8}, true},
+		{`#roads.ma|jor { }`, Symbol{Kind: SymbolClass, Name: "major", Line: 1, Column: 7}, true},
+		{`#roads { line-color: r|ed; }`, Symbol{}, false},
+		{`#roads { line-color: #ab|c; }`, Symbol{}, false},
+	} {
+		src, line, column := cursor(tc.src)
+		sym, found := SymbolAt(src, line, column)
+		if found != tc.found || sym != tc.expected {
+			t.Errorf("unexpected symbol for %q: %#v", tc.src, sym)
+		}
+	}
+}
+
+func TestVariableDefinitions(t *testing.T) {
+	defs := VariableDefinitions("@water: #a0c8f0;\n@font: \"DejaVu Sans\", \"Unifont\";\n#roads { line-color: @water; }\n@last: 1")
+	expected := []Symbol{
+		{Kind: SymbolVariable, Name: "water", Line: 1, Column: 1, Value: "#a0c8f0"},
+		{Kind: SymbolVariable, Name: "font", Line: 2, Column: 1, Value: `"DejaVu Sans", "Unifont"`},
+		{Kind: SymbolVariable, Name: "last", Line: 4, Column: 1, Value: "1"},
+	}
+	if !reflect.DeepEqual(defs, expected) {
+		t.Errorf("unexpected definitions %#v", defs)
+	}
+}
+
+func TestSupportedProperties(t *testing.T) {
+	props := SupportedProperties()
+	if len(props) != len(attributeTypes) {
+		t.Fatal("unexpected number of properties", len(props))
+	}
+	for i := 1; i < len(props); i++ {
+		if props[i-1].Name >= props[i].Name {
+			t.Fatal("properties not sorted", props[i-1].Name, props[i].Name)
+		}
+	}
+	if p, ok := LookupProperty("line-cap"); !ok || p.Type != "keyword" || !reflect.DeepEqual(p.Keywords, []string{"round", "butt", "square"}) {
+		t.Errorf("unexpected property %#v", p)
+	}
+	if p, ok := LookupProperty("line-color"); !ok || p.Type != "color" || p.Keywords != nil {
+		t.Errorf("unexpected property %#v", p)
+	}
+	if _, ok := LookupProperty("line-colour"); ok {
+		t.Error("unexpected property line-colour")
+	}
+}
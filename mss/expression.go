@@ -2,6 +2,8 @@ package mss
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/omniscale/magnacarto/color"
 )
@@ -24,6 +26,9 @@ const (
 	typeString
 	typeList
 	typeStop
+	typeConditional
+	typeTransform
+	typeRelativeSize
 
 	typeNegation
 	typeAdd
@@ -70,6 +75,12 @@ func (t codeType) String() string {
 		return "\""
 	case typeStop:
 		return "S"
+	case typeConditional:
+		return "if"
+	case typeTransform:
+		return "T"
+	case typeRelativeSize:
+		return "u"
 	case typeUnknown:
 		return "?"
 	default:
@@ -99,6 +110,14 @@ func (e *expression) evaluate() (Value, error) {
 	if err != nil {
 		return nil, err
 	}
+	if len(codes) > 1 && isTransformList(codes) {
+		// rotate(45) scale(2)
+		l := make([]string, 0, len(codes))
+		for _, c := range codes {
+			l = append(l, c.Value.(string))
+		}
+		return strings.Join(l, " "), nil
+	}
 	if len(codes) > 1 {
 		// create copy since c points to internal code slice
 		l := make([]Value, 0, len(codes))
@@ -117,13 +136,18 @@ func evaluate(codes []code) ([]code, int, error) {
 	for i := 0; i < len(codes); i++ {
 		c := codes[i]
 		switch c.T {
-		case typeNum, typeColor, typePercent, typeString, typeKeyword, typeURL, typeBool, typeField, typeList:
+		case typeNum, typeColor, typePercent, typeString, typeKeyword, typeURL, typeBool, typeField, typeList, typeRelativeSize:
 			codes[top] = c
 			top++
 			continue
 		case typeNegation:
 			a := codes[top-1]
-			a.Value = -a.Value.(float64)
+			if s, ok := a.Value.(relativeSize); ok {
+				s.value = -s.value
+				a.Value = s
+			} else {
+				a.Value = -a.Value.(float64)
+			}
 			codes[top-1] = a
 			continue
 		case typeFunction:
@@ -207,6 +231,38 @@ func evaluate(codes []code) ([]code, int, error) {
 					Value: Stop{Value: val, Color: c},
 					T:     typeStop},
 				}
+			} else if c.Value.(string) == "if" {
+				if len(v) != 2 && len(v) != 3 {
+					return nil, 0, fmt.Errorf("if takes two or three arguments, got %d", len(v))
+				}
+				if v[0].T != typeField {
+					return nil, 0, fmt.Errorf("if takes field as first argument only, got %v", v[0])
+				}
+				cond := Conditional{Field: fieldName(v[0].Value.(string)), Else: ""}
+				for i, arg := range v[1:] {
+					if !isLabelPart(arg) && arg.T != typeConditional {
+						return nil, 0, fmt.Errorf("if takes strings, fields or expressions as values, got %v", arg)
+					}
+					if i == 0 {
+						cond.Then = arg.Value
+					} else {
+						cond.Else = arg.Value
+					}
+				}
+				v = []code{{Value: cond, T: typeConditional}}
+			} else if transformFuncs[c.Value.(string)] {
+				args := make([]string, 0, len(v))
+				for _, arg := range v {
+					switch arg.T {
+					case typeNum:
+						args = append(args, strconv.FormatFloat(arg.Value.(float64), 'f', -1, 64))
+					case typeField:
+						args = append(args, arg.Value.(string))
+					default:
+						return nil, 0, fmt.Errorf("%s takes numbers or fields as arguments only, got %v", c.Value.(string), arg)
+					}
+				}
+				v = []code{{Value: c.Value.(string) + "(" + strings.Join(args, ", ") + ")", T: typeTransform}}
 			} else if c.Value.(string) == "__echo__" {
 				// pass
 			} else {
@@ -235,16 +291,12 @@ func evaluate(codes []code) ([]code, int, error) {
 			} else if c.T == typeAdd && a.T == typeString && b.T == typeString {
 				// string concatenation
 				codes[top] = code{T: typeString, Value: a.Value.(string) + b.Value.(string)}
-			} else if c.T == typeAdd && a.T == typeString && b.T == typeField {
-				codes[top] = code{T: typeFieldExpr, Value: []Value{a.Value.(string), Field(b.Value.(string))}}
-			} else if c.T == typeAdd && a.T == typeField && b.T == typeString {
-				codes[top] = code{T: typeFieldExpr, Value: []Value{Field(a.Value.(string)), b.Value.(string)}}
-			} else if c.T == typeAdd && a.T == typeField && b.T == typeField {
-				codes[top] = code{T: typeFieldExpr, Value: []Value{Field(a.Value.(string)), Field(b.Value.(string))}}
-			} else if c.T == typeAdd && a.T == typeFieldExpr && b.T == typeField {
-				codes[top] = code{T: typeFieldExpr, Value: append(a.Value.([]Value), Field(b.Value.(string)))}
-			} else if c.T == typeAdd && a.T == typeFieldExpr && b.T == typeString {
-				codes[top] = code{T: typeFieldExpr, Value: append(a.Value.([]Value), b.Value.(string))}
+			} else if c.T == typeAdd && isLabelPart(a) && isLabelPart(b) {
+				// concatenation of fields and strings, e.g. [ref] + " " + [name]
+				codes[top] = code{T: typeFieldExpr, Value: append(labelParts(a), labelParts(b)...)}
+			} else if v, ok := relativeSizeOp(c.T, a, b); ok {
+				// e.g. 2m * 3 or 1em + 0.5em
+				codes[top] = v
 			} else if c.T == typeMultiply && a.T == typeColor && b.T == typeNum {
 				c := a.Value.(color.RGBA)
 				f := b.Value.(float64)
@@ -259,6 +311,63 @@ func evaluate(codes []code) ([]code, int, error) {
 	return codes[:top], 0, nil
 }
 
+// transformFuncs are the SVG transform functions that are supported by
+// Mapnik for marker-transform, point-transform, etc.
+var transformFuncs = map[string]bool{
+	"matrix":    true,
+	"translate": true,
+	"scale":     true,
+	"rotate":    true,
+	"skewX":     true,
+	"skewY":     true,
+}
+
+// isTransformList returns whether all codes are transform functions.
+func isTransformList(codes []code) bool {
+	for _, c := range codes {
+		if c.T != typeTransform {
+			return false
+		}
+	}
+	return true
+}
+
+// isLabelPart returns whether c can be part of a concatenated label.
+func isLabelPart(c code) bool {
+	return c.T == typeString || c.T == typeField || c.T == typeFieldExpr
+}
+
+// labelParts returns c as a list of strings and Fields.
+func labelParts(c code) []Value {
+	switch c.T {
+	case typeField:
+		return []Value{Field(c.Value.(string))}
+	case typeFieldExpr:
+		// copy, a might be appended to multiple times
+		return append([]Value{}, c.Value.([]Value)...)
+	default:
+		return []Value{c.Value}
+	}
+}
+
+// fieldName returns the name of a field without brackets.
+func fieldName(field string) string {
+	if len(field) > 2 && field[0] == '[' && field[len(field)-1] == ']' {
+		return field[1 : len(field)-1]
+	}
+	return field
+}
+
+// Conditional is a value that depends on a field, e.g.
+// if([ref], [ref] + " " + [name], [name]). Then is used if the field is
+// neither null nor empty. Rules with conditional properties are split into
+// one rule for each case.
+type Conditional struct {
+	Field string
+	Then  Value
+	Else  Value
+}
+
 type Stop struct {
 	Value int
 	Color color.RGBA
@@ -0,0 +1,243 @@
+package mss
+
+// mixin is a parametrized block that is defined once and included into rules:
+//
+//	.casing(@color, @width: 2) {
+//	  line-color: @color;
+//	  line-width: @width;
+//	  [zoom>=14] { line-width: @width * 2; }
+//	}
+//	#roads[type='primary'] { .casing(#e8a300); }
+//
+// The tokens of the body are inserted at each call, with all parameters
+// replaced by the arguments of the call.
+type mixin struct {
+	name   string
+	params []mixinParam
+	body   []*token
+}
+
+type mixinParam struct {
+	name string
+	def  []*token // default tokens, nil if required
+}
+
+// expansion of a mixin call. The decoder reads tokens from the last
+// expansion before it continues with the scanner.
+type expansion struct {
+	name   string // name of the mixin, empty for tokens that are re-queued
+	tokens []*token
+	pos    int
+}
+
+// mixinDefinition decodes a mixin after its name, e.g.
+// `.casing(@color, @width: 2) { ... }`
+func (d *Decoder) mixinDefinition(tok *token) {
+	m := &mixin{name: tok.value[1:]} // strip .
+	if _, ok := d.mixins[m.name]; ok {
+		d.warn(d.pos(tok), "mixin %s redefined", m.name)
+	}
+	d.expect(tokenLParen)
+
+	for {
+		tok := d.next()
+		if tok.t == tokenRParen && len(m.params) == 0 {
+			break
+		}
+		if tok.t != tokenAtKeyword {
+			d.error(d.pos(tok), "expected parameter of mixin %s, got %v", m.name, tok)
+		}
+		p := mixinParam{name: tok.value[1:]}
+		for _, other := range m.params {
+			if other.name == p.name {
+				d.error(d.pos(tok), "duplicate parameter @%s of mixin %s", p.name, m.name)
+			}
+		}
+		tok = d.next()
+		if tok.t == tokenColon {
+			var end *token
+			p.def, end = d.mixinArg()
+			if len(p.def) == 0 {
+				d.error(d.pos(end), "missing default of parameter @%s", p.name)
+			}
+			tok = end
+		}
+		m.params = append(m.params, p)
+		if tok.t == tokenRParen {
+			break
+		}
+		if tok.t != tokenComma {
+			d.error(d.pos(tok), "expected comma or end of parameters, got %v", tok)
+		}
+	}
+
+	d.expect(tokenLBrace)
+	m.body = d.blockTokens("mixin " + m.name)
+	d.mixins[m.name] = m
+}
+
+// blockTokens returns all tokens till the end of the current block. The
+// closing brace is consumed but not returned.
+func (d *Decoder) blockTokens(name string) []*token {
+	var tokens []*token
+	depth := 0
+	for {
+		tok := d.next()
+		switch tok.t {
+		case tokenEOF:
+			d.error(d.pos(tok), "unexpected end of %s", name)
+		case tokenLBrace:
+			depth++
+		case tokenRBrace:
+			if depth == 0 {
+				return tokens
+			}
+			depth--
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+// mixinArg returns the tokens till the next comma or closing parenthesis
+// outside of function calls or parenthesis. The comma or parenthesis is
+// returned as end.
+func (d *Decoder) mixinArg() (arg []*token, end *token) {
+	depth := 0
+	for {
+		tok := d.next()
+		switch tok.t {
+		case tokenEOF, tokenLBrace, tokenRBrace, tokenSemicolon:
+			d.error(d.pos(tok), "expected end of mixin arguments, got %v", tok)
+		case tokenLParen, tokenFunction:
+			depth++
+		case tokenRParen:
+			if depth == 0 {
+				return arg, tok
+			}
+			depth--
+		case tokenComma:
+			if depth == 0 {
+				return arg, tok
+			}
+		}
+		arg = append(arg, tok)
+	}
+}
+
+// mixinCall decodes arguments of a mixin call, e.g. `.casing(#fff, 3);`,
+// and inserts the body of the mixin.
+func (d *Decoder) mixinCall(tok *token) {
+	name := tok.value[1:] // strip .
+	m, ok := d.mixins[name]
+	if !ok {
+		d.error(d.pos(tok), "unknown mixin %s", name)
+	}
+	for _, e := range d.expansions {
+		if e.name == name {
+			d.error(d.pos(tok), "recursive call of mixin %s", name)
+		}
+	}
+	d.expect(tokenLParen)
+
+	args := make([][]*token, len(m.params))
+	i := 0
+	for {
+		arg, end := d.mixinArg()
+		if len(arg) == 0 && end.t == tokenRParen && i == 0 {
+			break
+		}
+		if len(arg) == 0 {
+			d.error(d.pos(end), "missing argument for mixin %s", name)
+		}
+		idx := i
+		if len(arg) > 2 && arg[0].t == tokenAtKeyword && arg[1].t == tokenColon {
+			// named argument, e.g. @width: 3
+			idx = -1
+			for j, p := range m.params {
+				if p.name == arg[0].value[1:] {
+					idx = j
+				}
+			}
+			if idx == -1 {
+				d.error(d.pos(arg[0]), "unknown parameter %s of mixin %s", arg[0].value, name)
+			}
+			arg = arg[2:]
+		} else {
+			i++
+		}
+		if idx >= len(m.params) {
+			d.error(d.pos(arg[0]), "too many arguments for mixin %s", name)
+		}
+		args[idx] = arg
+		if end.t == tokenRParen {
+			break
+		}
+	}
+	for i, p := range m.params {
+		if args[i] == nil {
+			if p.def == nil {
+				d.error(d.pos(tok), "missing argument @%s for mixin %s", p.name, name)
+			}
+			args[i] = p.def
+		}
+	}
+
+	// tokens of the mixin take the position of the call for the order of
+	// properties and for error messages
+	body := make([]*token, 0, len(m.body))
+	for _, t := range m.body {
+		if t.t == tokenAtKeyword {
+			if arg := m.arg(t.value[1:], args); arg != nil {
+				body = append(body, restamp(arg, tok)...)
+				continue
+			}
+		}
+		body = append(body, restamp([]*token{t}, tok)...)
+	}
+
+	end := d.next()
+	if end.t == tokenRBrace {
+		// call without semicolon at the end of a block
+		d.expansions = append(d.expansions, &expansion{tokens: []*token{end}})
+	} else if end.t != tokenSemicolon {
+		d.error(d.pos(end), "expected %v found %v", tokenSemicolon, end)
+	}
+	d.expansions = append(d.expansions, &expansion{name: name, tokens: body})
+}
+
+// arg returns the tokens of the argument for param. Arguments with multiple
+// tokens are enclosed in parenthesis, so that `@width * 2` with `1 + 1` is
+// `(1 + 1) * 2`.
+func (m *mixin) arg(param string, args [][]*token) []*token {
+	for i, p := range m.params {
+		if p.name != param {
+			continue
+		}
+		arg := args[i]
+		if len(arg) == 1 {
+			return arg
+		}
+		result := []*token{{t: tokenLParen, value: "("}}
+		result = append(result, arg...)
+		return append(result, &token{t: tokenRParen, value: ")"})
+	}
+	return nil
+}
+
+func restamp(tokens []*token, pos *token) []*token {
+	result := make([]*token, len(tokens))
+	for i, t := range tokens {
+		result[i] = &token{t: t.t, value: t.value, v: t.v, line: pos.line, column: pos.column}
+	}
+	return result
+}
+
+// isMixin returns whether the class token is followed by a parenthesis.
+func (d *Decoder) isMixin(tok *token) bool {
+	if tok.t != tokenClass {
+		return false
+	}
+	next := d.next()
+	d.backup()
+	return next.t == tokenLParen
+}
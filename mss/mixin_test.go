@@ -0,0 +1,80 @@
+package mss
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/omniscale/magnacarto/color"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMixin(t *testing.T) {
+	for _, deferEval := range []bool{false, true} {
+		d := New()
+		if deferEval {
+			d.EnableDeferredEval()
+		}
+		err := d.ParseString(`
+@base: 2;
+.casing(@color, @width: @base, @type: 'primary') {
+	line-color: @color;
+	line-width: @width;
+	[type=@type] { line-width: @width * 2; }
+}
+#roads {
+	.casing(darken(red, 10%), 1 + 2);
+	line-cap: round;
+}
+#roads::minor { .casing(#fff, @type: 'minor') }
+`)
+		assert.NoError(t, err)
+		assert.NoError(t, d.Evaluate())
+
+		rules := d.MSS().LayerRules("roads")
+		if len(rules) != 4 {
+			t.Fatal("unexpected rules", rules)
+		}
+		v, _ := rules[0].Properties.get("line-width")
+		assert.Equal(t, 6.0, v) // (1 + 2) * 2
+		assert.Equal(t, "type", rules[0].Filters[0].Field)
+		assert.Equal(t, "primary", rules[0].Filters[0].Value)
+		v, _ = rules[1].Properties.get("line-width")
+		assert.Equal(t, 3.0, v)
+		v, _ = rules[1].Properties.get("line-color")
+		assert.Equal(t, color.MustParse("#cc0000"), v)
+		v, _ = rules[1].Properties.get("line-cap")
+		assert.Equal(t, "round", v)
+
+		assert.Equal(t, "minor", rules[2].Attachment)
+		assert.Equal(t, "minor", rules[2].Filters[0].Value)
+		v, _ = rules[2].Properties.get("line-width")
+		assert.Equal(t, 4.0, v)
+		v, _ = rules[3].Properties.get("line-width")
+		assert.Equal(t, 2.0, v) // default from var
+	}
+}
+
+func TestMixinErrors(t *testing.T) {
+	for _, tc := range []struct {
+		mss string
+		err string
+	}{
+		{`#roads { .casing(red); }`, "unknown mixin casing"},
+		{`.casing(@c) { line-color: @c; } #roads { .casing(); }`, "missing argument @c"},
+		{`.casing(@c) { line-color: @c; } #roads { .casing(red, 2); }`, "too many arguments"},
+		{`.casing(@c) { line-color: @c; } #roads { .casing(@w: 2); }`, "unknown parameter @w"},
+		{`.casing(@c, @c) { line-color: @c; }`, "duplicate parameter @c"},
+		{`.a() { .b(); } .b() { .a(); } #roads { .a(); }`, "recursive call of mixin a"},
+		{`.a() { line-width: 1;`, "unexpected end of mixin a"},
+	} {
+		_, err := decodeString(tc.mss)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error %q for %s, got %v", tc.err, tc.mss, err)
+		}
+	}
+
+	// class rules are not affected
+	d, err := decodeString(`#roads { .major { line-width: 1; } }`)
+	assert.NoError(t, err)
+	assert.Len(t, d.MSS().LayerRules("roads", "major"), 1)
+}
@@ -9,6 +9,7 @@ type MSS struct {
 	root  block
 	stack []*block
 	base  block
+	scale float64 // of sizes for the output DPI, 0 for DefaultDPI
 }
 
 // Map returns properties of the root Map{} block.
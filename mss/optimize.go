@@ -0,0 +1,211 @@
+package mss
+
+import "fmt"
+
+// DeadRule is a rule that was removed by RemoveDeadRules.
+type DeadRule struct {
+	Rule   Rule
+	Reason string
+}
+
+func (d DeadRule) String() string {
+	return fmt.Sprintf("%s: %s", d.Reason, d.Rule.String())
+}
+
+// RemoveDeadRules returns all rules of a layer that can match any feature,
+// and the removed rules with the reason why they never match. Rules are
+// limited to the zoom levels of the layer (AllZoom for layers without
+// limits). Rules are dead if:
+//   - they are outside of the zoom levels of the layer,
+//   - their filters are contradictory (e.g. [type='a'][type='b'] or
+//     [pop>1000][pop<500]),
+//   - or they are shadowed for all their zoom levels by previous rules of the
+//     same attachment with a subset of their filters, as styles are
+//     evaluated with filter-mode first.
+func RemoveDeadRules(rules []Rule, layerZoom ZoomRange) ([]Rule, []DeadRule) {
+	var result []Rule
+	var dead []DeadRule
+	var attachment []Rule // rules of the current attachment
+
+	for i, r := range rules {
+		if i == 0 || r.Attachment != rules[i-1].Attachment {
+			attachment = attachment[:0]
+		}
+
+		r.Zoom &= layerZoom
+		if r.Zoom == InvalidZoom {
+			dead = append(dead, DeadRule{Rule: rules[i], Reason: "outside of layer zoom " + layerZoom.String()})
+			continue
+		}
+		if f, ok := contradictoryFilters(r.Filters); ok {
+			dead = append(dead, DeadRule{Rule: r, Reason: "contradictory filters " + f})
+			continue
+		}
+		covered := InvalidZoom
+		for _, o := range attachment {
+			if filterIsSubset(o.Filters, r.Filters) {
+				covered |= o.Zoom
+			}
+		}
+		if r.Zoom&^covered == 0 {
+			dead = append(dead, DeadRule{Rule: r, Reason: "shadowed by previous rules"})
+			continue
+		}
+		attachment = append(attachment, r)
+		result = append(result, r)
+	}
+	return result, dead
+}
+
+// contradictoryFilters checks whether filters can never match, and returns
+// the conflicting filters.
+func contradictoryFilters(filters []Filter) (string, bool) {
+	for i, a := range filters {
+		for _, b := range filters[i+1:] {
+			if a.Field == b.Field && !filtersCompatible(a, b) {
+				return fmt.Sprintf("[%s] and [%s]", a, b), true
+			}
+		}
+	}
+	return "", false
+}
+
+// filtersCompatible returns false if a and b of the same field can not
+// match at the same time.
+func filtersCompatible(a, b Filter) bool {
+	if a.CompOp == NEQ || b.CompOp == NEQ {
+		if a.CompOp == EQ || b.CompOp == EQ {
+			return a.Value != b.Value
+		}
+		return true
+	}
+	if a.CompOp == EQ && b.CompOp == EQ {
+		return a.Value == b.Value
+	}
+
+	av, aok := a.Value.(float64)
+	bv, bok := b.Value.(float64)
+	if !aok || !bok {
+		// only compare numbers
+		return true
+	}
+	if a.CompOp == EQ {
+		return numberMatches(av, b.CompOp, bv)
+	}
+	if b.CompOp == EQ {
+		return numberMatches(bv, a.CompOp, av)
+	}
+	// a and b are both ranges, they are compatible if one is a lower and
+	// the other an upper bound that overlap, or if both bound the same side
+	lower, upper := a, b
+	if a.CompOp == LT || a.CompOp == LTE {
+		lower, upper = b, a
+	}
+	if lower.CompOp == LT || lower.CompOp == LTE || upper.CompOp == GT || upper.CompOp == GTE {
+		return true
+	}
+	lv, uv := lower.Value.(float64), upper.Value.(float64)
+	if lower.CompOp == GTE && upper.CompOp == LTE {
+		return lv <= uv
+	}
+	return lv < uv
+}
+
+// numberMatches returns whether v matches the filter `compOp value`.
+func numberMatches(v float64, compOp CompOp, value float64) bool {
+	switch compOp {
+	case GT:
+		return v > value
+	case GTE:
+		return v >= value
+	case LT:
+		return v < value
+	case LTE:
+		return v <= value
+	}
+	return true
+}
+
+// MergeRules merges adjacent rules with the same properties and returns the
+// merged rules and the number of removed rules. Rules are merged if they
+// differ only in
+//   - the value of a single [field=value] filter, into a [field in values]
+//     filter,
+//   - or their zoom levels, if the combined zoom levels are continuous.
+//
+// Only adjacent rules of the same attachment are merged, so that the
+// result is the same with filter-mode first.
+func MergeRules(rules []Rule) ([]Rule, int) {
+	if len(rules) == 0 {
+		return rules, 0
+	}
+	result := []Rule{rules[0]}
+	for _, r := range rules[1:] {
+		last := &result[len(result)-1]
+		if last.Layer != r.Layer || last.Attachment != r.Attachment || !last.Properties.sameValues(r.Properties) {
+			result = append(result, r)
+			continue
+		}
+		if last.Zoom == r.Zoom {
+			if filters, ok := mergeValueFilters(last.Filters, r.Filters); ok {
+				last.Filters = filters
+				continue
+			}
+		} else if filterEqual(last.Filters, r.Filters) {
+			if z := last.Zoom | r.Zoom; z.continuous() {
+				last.Zoom = z
+				continue
+			}
+		}
+		result = append(result, r)
+	}
+	return result, len(rules) - len(result)
+}
+
+// mergeValueFilters merges two sorted filter lists that only differ in the
+// value of a single EQ/IN filter.
+func mergeValueFilters(a, b []Filter) ([]Filter, bool) {
+	if len(a) != len(b) {
+		return nil, false
+	}
+	diff := -1
+	for i := range a {
+		if a[i].Field != b[i].Field {
+			return nil, false
+		}
+		if a[i].CompOp == IN || a[i].CompOp != b[i].CompOp || a[i].Value != b[i].Value {
+			if diff >= 0 {
+				return nil, false
+			}
+			diff = i
+		}
+	}
+	if diff < 0 {
+		// same filters
+		return a, true
+	}
+	if b[diff].CompOp != EQ || (a[diff].CompOp != EQ && a[diff].CompOp != IN) {
+		return nil, false
+	}
+	var values []Value
+	if a[diff].CompOp == IN {
+		values = a[diff].Value.([]Value)
+	} else {
+		values = []Value{a[diff].Value}
+	}
+	for _, v := range values {
+		if v == b[diff].Value {
+			return a, true
+		}
+	}
+
+	result := make([]Filter, len(a))
+	copy(result, a)
+	result[diff] = Filter{
+		Field:  a[diff].Field,
+		CompOp: IN,
+		// copy, values of the previous filter are shared with other rules
+		Value: append(append([]Value{}, values...), b[diff].Value),
+	}
+	return result, true
+}
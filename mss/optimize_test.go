@@ -0,0 +1,136 @@
+package mss
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoveDeadRules(t *testing.T) {
+	d := New()
+	if err := d.ParseString(`
+		#roads[type='primary'] { line-width: 3; }
+		#roads[type='primary'][tunnel='yes'] { line-color: red; }
+		#roads[pop>1000][pop<500] { line-width: 4; }
+		#roads[type='motorway'][type!='motorway'] { line-width: 2; }
+		#roads[zoom<5] { line-width: 1; }
+		#roads::casing[type='primary'] { line-width: 6; }
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Evaluate(); err != nil {
+		t.Fatal(err)
+	}
+	rules := d.MSS().LayerRules("roads")
+
+	result, dead := RemoveDeadRules(rules, NewZoomRange(8, 22))
+	assert.Equal(t, len(rules), len(result)+len(dead))
+	for _, r := range result {
+		assert.True(t, r.Zoom.First() >= 8, "%v", r)
+		_, ok := contradictoryFilters(r.Filters)
+		assert.False(t, ok, "%v", r)
+	}
+	reasons := map[string]bool{}
+	for _, d := range dead {
+		reasons[strings.SplitN(d.Reason, " [", 2)[0]] = true
+	}
+	assert.Equal(t, map[string]bool{
+		"outside of layer zoom Zoom{8 9 10 11 12 13 14 15 16 17 18 19 20 21 22}": true,
+		"contradictory filters": true,
+	}, reasons)
+
+	// type=primary is shadowed by the more specific rules, but not the
+	// rule of the casing attachment
+	shadowed := []Rule{
+		{Layer: "roads", Filters: []Filter{{"type", EQ, "primary"}}, Zoom: AllZoom},
+		{Layer: "roads", Filters: []Filter{{"tunnel", EQ, "yes"}, {"type", EQ, "primary"}}, Zoom: NewZoomRange(10, 12)},
+		{Layer: "roads", Filters: []Filter{{"type", EQ, "secondary"}}, Zoom: AllZoom},
+		{Layer: "roads", Attachment: "casing", Filters: []Filter{{"type", EQ, "primary"}}, Zoom: AllZoom},
+	}
+	result, dead = RemoveDeadRules(shadowed, AllZoom)
+	if assert.Len(t, dead, 1) {
+		assert.Equal(t, "shadowed by previous rules", dead[0].Reason)
+		assert.Equal(t, shadowed[1].Filters, dead[0].Rule.Filters)
+	}
+	assert.Len(t, result, 3)
+}
+
+func TestFiltersCompatible(t *testing.T) {
+	for _, tc := range []struct {
+		a, b       Filter
+		compatible bool
+	}{
+		{Filter{"type", EQ, "a"}, Filter{"type", EQ, "a"}, true},
+		{Filter{"type", EQ, "a"}, Filter{"type", EQ, "b"}, false},
+		{Filter{"type", EQ, "a"}, Filter{"type", NEQ, "a"}, false},
+		{Filter{"type", NEQ, "a"}, Filter{"type", NEQ, "b"}, true},
+		{Filter{"pop", GT, 5.0}, Filter{"pop", LT, 5.0}, false},
+		{Filter{"pop", GTE, 5.0}, Filter{"pop", LTE, 5.0}, true},
+		{Filter{"pop", GT, 5.0}, Filter{"pop", LTE, 5.0}, false},
+		{Filter{"pop", LT, 10.0}, Filter{"pop", GT, 5.0}, true},
+		{Filter{"pop", GT, 5.0}, Filter{"pop", GT, 10.0}, true},
+		{Filter{"pop", EQ, 3.0}, Filter{"pop", GT, 5.0}, false},
+		{Filter{"pop", LTE, 3.0}, Filter{"pop", EQ, 3.0}, true},
+		{Filter{"pop", EQ, "3"}, Filter{"pop", GT, 5.0}, true},
+	} {
+		assert.Equal(t, tc.compatible, filtersCompatible(tc.a, tc.b), "%v %v", tc.a, tc.b)
+	}
+}
+
+func TestMergeRules(t *testing.T) {
+	parse := func(content string) []Rule {
+		d := New()
+		if err := d.ParseString(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Evaluate(); err != nil {
+			t.Fatal(err)
+		}
+		return d.MSS().LayerRules("roads")
+	}
+
+	rules := parse(`
+		#roads[type='primary'][zoom>=10] { line-width: 2; }
+		#roads[type='secondary'][zoom>=10] { line-width: 2; }
+		#roads[type='tertiary'][zoom>=10] { line-width: 2; }
+		#roads[type='residential'][zoom>=10] { line-width: 1; }
+	`)
+	result, merged := MergeRules(rules)
+	assert.Equal(t, 2, merged)
+	if assert.Len(t, result, 2) {
+		assert.Equal(t, []Filter{{"type", IN, []Value{"tertiary", "secondary", "primary"}}}, result[1].Filters)
+		assert.Equal(t, NewZoomRange(10, 30), result[1].Zoom)
+	}
+
+	rules = parse(`
+		#roads[zoom>=12] { line-color: red; }
+		#roads[zoom>=8][zoom<12] { line-color: red; }
+	`)
+	result, merged = MergeRules(rules)
+	assert.Equal(t, 1, merged)
+	if assert.Len(t, result, 1) {
+		assert.Equal(t, NewZoomRange(8, 30), result[0].Zoom)
+	}
+
+	// not adjacent
+	rules = []Rule{
+		{Layer: "roads", Filters: []Filter{{"type", EQ, "a"}}, Zoom: AllZoom, Properties: newProperties("line-width", 1.0)},
+		{Layer: "roads", Filters: []Filter{{"type", EQ, "b"}}, Zoom: AllZoom, Properties: newProperties("line-width", 2.0)},
+		{Layer: "roads", Filters: []Filter{{"type", EQ, "c"}}, Zoom: AllZoom, Properties: newProperties("line-width", 1.0)},
+		{Layer: "roads", Attachment: "casing", Filters: []Filter{{"type", EQ, "d"}}, Zoom: AllZoom, Properties: newProperties("line-width", 1.0)},
+		// not continuous
+		{Layer: "roads", Attachment: "casing", Filters: []Filter{{"type", EQ, "d"}}, Zoom: NewZoomRange(0, 5), Properties: newProperties("line-width", 3.0)},
+		{Layer: "roads", Attachment: "casing", Filters: []Filter{{"type", EQ, "d"}}, Zoom: NewZoomRange(8, 10), Properties: newProperties("line-width", 3.0)},
+	}
+	result, merged = MergeRules(rules)
+	assert.Equal(t, 0, merged)
+	assert.Len(t, result, len(rules))
+}
+
+func TestZoomRangeContinuous(t *testing.T) {
+	assert.True(t, AllZoom.continuous())
+	assert.True(t, NewZoomRange(3, 7).continuous())
+	assert.False(t, (NewZoomRange(3, 7) | NewZoomRange(9, 10)).continuous())
+	assert.False(t, InvalidZoom.continuous())
+}
@@ -3,6 +3,7 @@ package mss
 import (
 	"bytes"
 	"math"
+	"reflect"
 	"sort"
 	"strings"
 
@@ -117,6 +118,48 @@ func (p *Properties) clone() *Properties {
 	return &result
 }
 
+// withValue returns a copy with a new value for property.
+func (p *Properties) withValue(property key, val Value) *Properties {
+	result := &Properties{values: make(map[key]attr, len(p.values))}
+	for k, v := range p.values {
+		result.values[k] = v
+	}
+	a := result.values[property]
+	a.value = val
+	result.values[property] = a
+	return result
+}
+
+// sameValues returns true if p and o have the same values, in the same
+// order of the mss files (which defines the order of the symbolizers).
+func (p *Properties) sameValues(o *Properties) bool {
+	if len(p.values) != len(o.values) {
+		return false
+	}
+	pk, ok := p.keysByPos(), o.keysByPos()
+	for i := range pk {
+		if pk[i] != ok[i] || !reflect.DeepEqual(p.values[pk[i]].value, o.values[ok[i]].value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Properties) keysByPos() []key {
+	keys := p.keys()
+	sort.Slice(keys, func(i, j int) bool {
+		pi, pj := p.values[keys[i]].pos.index, p.values[keys[j]].pos.index
+		if pi != pj {
+			return pi < pj
+		}
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].instance < keys[j].instance
+	})
+	return keys
+}
+
 func (p *Properties) sameKeys(o *Properties) bool {
 	if len(p.values) != len(o.values) {
 		return false
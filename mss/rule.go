@@ -291,7 +291,8 @@ func (m *MSS) Layers() []string {
 	return layerNames
 }
 
-// LayerRules returns all Rules for this layer.
+// LayerRules returns all Rules for this layer. Sizes in em and m are
+// converted to pixels.
 func (m *MSS) LayerRules(layer string, classes ...string) []Rule {
 	attachments := make(map[string]int) // store order of first appearance
 	rules := []Rule{}
@@ -400,7 +401,101 @@ func (m *MSS) LayerRules(layer string, classes ...string) []Rule {
 		}
 	}
 
-	return rules
+	return convertRelativeSizes(expandConditionals(rules), m.scale)
+}
+
+// expandConditionals splits all rules with Conditional properties into a
+// rule for the then-value, with additional filters for the condition, and
+// the original rule with the else-value. Styles are evaluated with
+// filter-mode first, so the else-rule does not need inverted filters.
+func expandConditionals(rules []Rule) []Rule {
+	var result []Rule
+	for _, r := range rules {
+		result = append(result, expandConditional(r, nil)...)
+	}
+	return result
+}
+
+// expandConditional expands r recursively. emptyFields are known to be empty
+// for r, as r is an else-rule of a previous rule for these fields.
+func expandConditional(r Rule, emptyFields []string) []Rule {
+	if r.Properties == nil {
+		return []Rule{r}
+	}
+	// expand the first conditional property (by name), for a stable order
+	var k key
+	var cond Conditional
+	found := false
+	for pk, v := range r.Properties.values {
+		if c, ok := v.value.(Conditional); ok {
+			if !found || pk.name < k.name || (pk.name == k.name && pk.instance < k.instance) {
+				k, cond, found = pk, c, true
+			}
+		}
+	}
+	if !found {
+		return []Rule{r}
+	}
+	filters, match := conditionFilters(r.Filters, cond.Field)
+	for _, f := range emptyFields {
+		if f == cond.Field {
+			match = matchNever
+		}
+	}
+	var result []Rule
+	if match != matchNever {
+		then := r
+		then.Filters = filters
+		then.Properties = r.Properties.withValue(k, cond.Then)
+		result = append(result, expandConditional(then, emptyFields)...)
+	}
+	if match != matchAlways {
+		r.Properties = r.Properties.withValue(k, cond.Else)
+		if match == matchMaybe {
+			emptyFields = append(emptyFields[:len(emptyFields):len(emptyFields)], cond.Field)
+		}
+		result = append(result, expandConditional(r, emptyFields)...)
+	}
+	return result
+}
+
+type condMatch int
+
+const (
+	matchMaybe condMatch = iota
+	matchAlways
+	matchNever
+)
+
+// conditionFilters returns filters with additional filters for a non-empty
+// field. Also returns whether the filters already match only non-empty or
+// empty fields.
+func conditionFilters(filters []Filter, field string) ([]Filter, condMatch) {
+	result := append([]Filter{}, filters...)
+	added := false
+	for _, cond := range []Filter{{field, NEQ, nil}, {field, NEQ, ""}} {
+		found := false
+		for _, f := range filters {
+			if f.Field != field {
+				continue
+			}
+			if f.CompOp == EQ && f.Value == cond.Value {
+				return nil, matchNever
+			}
+			if f.CompOp == cond.CompOp && f.Value == cond.Value {
+				found = true
+			}
+		}
+		if !found {
+			result = append(result, cond)
+			added = true
+		}
+	}
+	if !added {
+		return result, matchAlways
+	}
+	sort.Stable(byField(result))
+	return result, matchMaybe
 }
 
 // combineRules creates a new rule: based on a, missing properties from b, and combined filters
@@ -55,6 +55,7 @@ type token struct {
 	value  string
 	line   int
 	column int
+	v      Value // evaluated value of tokenValue
 }
 
 // String returns a string representation of the token.
@@ -109,6 +110,8 @@ const (
 	tokenSubstringMatch
 	tokenChar
 	tokenBOM
+	// values of @each iterations, not returned by the scanner
+	tokenValue
 )
 
 // tokenNames maps tokenType's to their names. Used for conversion to string.
@@ -151,6 +154,7 @@ var tokenNames = map[tokenType]string{
 	tokenSubstringMatch: "SUBSTRINGMATCH",
 	tokenChar:           "CHAR",
 	tokenBOM:            "BOM",
+	tokenValue:          "VALUE",
 }
 
 // Macros and productions -----------------------------------------------------
@@ -271,7 +275,7 @@ func (s *scanner) Next() *token {
 		return s.err
 	}
 	if s.pos >= len(s.input) {
-		s.err = &token{tokenEOF, "", s.row, s.col}
+		s.err = &token{t: tokenEOF, value: "", line: s.row, column: s.col}
 		return s.err
 	}
 	if s.pos == 0 {
@@ -354,7 +358,7 @@ func (s *scanner) Next() *token {
 		if match != "" {
 			return s.emitToken(tokenString, match)
 		} else {
-			s.err = &token{tokenError, "unclosed quotation mark", s.row, s.col}
+			s.err = &token{t: tokenError, value: "unclosed quotation mark", line: s.row, column: s.col}
 			return s.err
 		}
 	case '/':
@@ -364,7 +368,7 @@ func (s *scanner) Next() *token {
 			if match != "" {
 				return s.emitToken(tokenComment, match)
 			} else {
-				s.err = &token{tokenError, "unclosed comment", s.row, s.col}
+				s.err = &token{t: tokenError, value: "unclosed comment", line: s.row, column: s.col}
 				return s.err
 			}
 		} else if len(input) > 1 && input[1] == '/' {
@@ -386,7 +390,7 @@ func (s *scanner) Next() *token {
 	// We already handled unclosed quotation marks and comments,
 	// so this can only be a Char.
 	r, width := utf8.DecodeRuneInString(input)
-	token := &token{tokenChar, string(r), s.row, s.col}
+	token := &token{t: tokenChar, value: string(r), line: s.row, column: s.col}
 	s.col += width
 	s.pos += width
 	return token
@@ -407,7 +411,7 @@ func (s *scanner) updatePosition(text string) {
 
 // emitToken returns a token for the string v and updates the scanner position.
 func (s *scanner) emitToken(t tokenType, v string) *token {
-	token := &token{t, v, s.row, s.col}
+	token := &token{t: t, value: v, line: s.row, column: s.col}
 	s.updatePosition(v)
 	return token
 }
@@ -417,7 +421,7 @@ func (s *scanner) emitToken(t tokenType, v string) *token {
 //
 // The string is known to have only ASCII characters and to not have a newline.
 func (s *scanner) emitSimple(t tokenType, v string) *token {
-	token := &token{t, v, s.row, s.col}
+	token := &token{t: t, value: v, line: s.row, column: s.col}
 	s.col += len(v)
 	s.pos += len(v)
 	return token
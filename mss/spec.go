@@ -1,14 +1,49 @@
 package mss
 
-import "github.com/omniscale/magnacarto/color"
+import (
+	"regexp"
+	"sort"
 
-var attributeTypes map[string]isValid
+	"github.com/omniscale/magnacarto/color"
+)
+
+var attributeTypes map[string]propertyType
 
 type isValid func(interface{}) bool
 
+// propertyType describes the valid values of a property.
+type propertyType struct {
+	name     string
+	valid    isValid
+	keywords []string
+}
+
+var (
+	colorType         = propertyType{name: "color", valid: isColor}
+	numberType        = propertyType{name: "number", valid: isNumber}
+	numbersType       = propertyType{name: "numbers", valid: isNumbers}
+	numberOrFieldType = propertyType{name: "number or field", valid: isNumberOrField}
+	boolType          = propertyType{name: "boolean", valid: isBool}
+	stringType        = propertyType{name: "string", valid: isString}
+	stringsType       = propertyType{name: "string or strings", valid: isStringOrStrings}
+	labelType         = propertyType{name: "label", valid: isLabel}
+	transformType     = propertyType{name: "transform", valid: isTransform}
+	stopsType         = propertyType{name: "stops", valid: isStops}
+	compOpType        = keywordType(compOps...)
+	scalingType       = keywordType(scalings...)
+)
+
+func keywordType(keywords ...string) propertyType {
+	return propertyType{name: "keyword", valid: isKeyword(keywords...), keywords: keywords}
+}
+
+// isNumber checks for numbers, also with em or m unit.
 func isNumber(val interface{}) bool {
-	_, ok := val.(float64)
-	return ok
+	switch val.(type) {
+	case float64, relativeSize:
+		return true
+	}
+	return false
 }
 
 func isNumbers(val interface{}) bool {
@@ -42,10 +77,37 @@ func isStrings(val interface{}) bool {
 	return true
 }
 
+// isNumberOrField checks for numbers and single fields, e.g. [height].
+func isNumberOrField(val interface{}) bool {
+	if isNumber(val) {
+		return true
+	}
+	s, ok := val.(string)
+	return ok && len(s) > 2 && s[0] == '[' && s[len(s)-1] == ']'
+}
+
 func isStringOrStrings(val interface{}) bool {
 	return isString(val) || isStrings(val)
 }
 
+// isLabel checks for strings, fields, concatenations and conditionals of these.
+func isLabel(val interface{}) bool {
+	switch v := val.(type) {
+	case string:
+		return true
+	case Conditional:
+		return isLabel(v.Then) && isLabel(v.Else)
+	case []Value:
+		for _, part := range v {
+			if _, ok := part.(Field); !ok && !isString(part) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func isColor(val interface{}) bool {
 	_, ok := val.(color.RGBA)
 	return ok
@@ -71,6 +133,25 @@ func isKeyword(keywords ...string) func(interface{}) bool {
 	}
 }
 
+var transformFuncRe = regexp.MustCompile(`^\s*(\w+)\s*\(([^()]*)\)\s*,?`)
+
+// isTransform checks for a list of SVG transform functions, e.g.
+// "rotate([angle]) scale(2)".
+func isTransform(val interface{}) bool {
+	s, ok := val.(string)
+	if !ok || s == "" {
+		return false
+	}
+	for len(s) > 0 {
+		match := transformFuncRe.FindStringSubmatch(s)
+		if match == nil || !transformFuncs[match[1]] {
+			return false
+		}
+		s = s[len(match[0]):]
+	}
+	return true
+}
+
 func isStops(val interface{}) bool {
 	vals, ok := val.([]Value)
 	if !ok {
@@ -84,177 +165,226 @@ func isStops(val interface{}) bool {
 	return true
 }
 
-func isCompOp(val interface{}) bool {
-	return isKeyword(
-		"src",
-		"dst",
-		"src-over",
-		"dst-over",
-		"src-in",
-		"dst-in",
-		"src-out",
-		"dst-out",
-		"src-atop",
-		"dst-atop",
-		"xor",
-		"plus",
-		"minus",
-		"multiply",
-		"screen",
-		"overlay",
-		"darken",
-		"lighten",
-		"color-dodge",
-		"color-burn",
-		"hard-light",
-		"soft-light",
-		"difference",
-		"exclusion",
-		"contrast",
-		"invert",
-		"invert-rgb",
-		"grain-merge",
-		"grain-extract",
-		"hue",
-		"saturation",
-		"color",
-		"value",
-	)(val)
+var compOps = []string{
+	"src",
+	"dst",
+	"src-over",
+	"dst-over",
+	"src-in",
+	"dst-in",
+	"src-out",
+	"dst-out",
+	"src-atop",
+	"dst-atop",
+	"xor",
+	"plus",
+	"minus",
+	"multiply",
+	"screen",
+	"overlay",
+	"darken",
+	"lighten",
+	"color-dodge",
+	"color-burn",
+	"hard-light",
+	"soft-light",
+	"difference",
+	"exclusion",
+	"contrast",
+	"invert",
+	"invert-rgb",
+	"grain-merge",
+	"grain-extract",
+	"hue",
+	"saturation",
+	"color",
+	"value",
 }
 
-func isScaling(val interface{}) bool {
-	return isKeyword(
-		"near",
-		"fast",
-		"bilinear",
-		"bicubic",
-		"spline16",
-		"spline36",
-		"hanning",
-		"hamming",
-		"hermite",
-		"kaiser",
-		"quadric",
-		"catrom",
-		"gaussian",
-		"bessel",
-		"mitchell",
-		"sinc",
-		"lanczos",
-		"blackman",
-	)(val)
+var scalings = []string{
+	"near",
+	"fast",
+	"bilinear",
+	"bicubic",
+	"spline16",
+	"spline36",
+	"hanning",
+	"hamming",
+	"hermite",
+	"kaiser",
+	"quadric",
+	"catrom",
+	"gaussian",
+	"bessel",
+	"mitchell",
+	"sinc",
+	"lanczos",
+	"blackman",
 }
+
 func init() {
-	attributeTypes = map[string]isValid{
-		"background-color": isColor,
-
-		"building-fill":   isColor,
-		"building-height": isNumber,
-
-		"line-cap":          isKeyword("round", "butt", "square"),
-		"line-clip":         isBool,
-		"line-color":        isColor,
-		"line-dasharray":    isNumbers,
-		"line-gamma-method": isKeyword("power", "linear", "none", "threshold", "multiply"),
-		"line-join":         isKeyword("miter", "round", "bevel"),
-		"line-offset":       isNumber,
-		"line-opacity":      isNumber,
-		"line-rastersizer":  isKeyword("full", "fast"),
-		"line-simplify":     isNumber,
-		"line-smooth":       isNumber,
-		"line-width":        isNumber,
-
-		"marker-allow-overlap": isBool,
-		"marker-file":          isString,
-		"marker-fill":          isColor,
-		"marker-height":        isNumber,
-		"marker-line-color":    isColor,
-		"marker-line-width":    isNumber,
-		"marker-opacity":       isNumber,
-		"marker-placement":     isKeyword("point", "interior", "line"),
-		"marker-spacing":       isNumber,
-		"marker-transform":     isString,
-		"marker-type":          isKeyword("arrow", "ellipse"),
-		"marker-width":         isNumber,
-
-		"point-file":             isString,
-		"point-allow-overlap":    isBool,
-		"point-opacity":          isNumber,
-		"point-transform":        isString,
-		"point-ignore-placement": isBool,
-
-		"polygon-fill":              isColor,
-		"polygon-gamma":             isNumber,
-		"polygon-gamma-method":      isKeyword("power", "linear", "none", "threshold", "multiply"),
-		"polygon-opacity":           isNumber,
-		"polygon-pattern-alignment": isKeyword("global", "local"),
-		"polygon-pattern-file":      isString,
-
-		"shield-allow-overlap":     isBool,
-		"shield-avoid-edges":       isBool,
-		"shield-character-spacing": isNumber,
-		"shield-clip":              isBool,
-		"shield-dx":                isNumber,
-		"shield-dy":                isNumber,
-		"shield-face-name":         isStringOrStrings,
-		"shield-file":              isString,
-		"shield-fill":              isColor,
-		"shield-halo-fill":         isColor,
-		"shield-halo-radius":       isNumber,
-		"shield-line-spacing":      isNumber,
-		"shield-min-distance":      isNumber,
-		"shield-min-padding":       isNumber,
-		"shield-name":              isString,
-		"shield-opacity":           isNumber,
-		"shield-placement":         isKeyword("line", "point", "vertex", "interior"),
-		"shield-size":              isNumber,
-		"shield-spacing":           isNumber,
-		"shield-text-dx":           isNumber,
-		"shield-text-dy":           isNumber,
-		"shield-transform":         isKeyword("none", "uppercase", "lowercase", "capitalize"),
-		"shield-wrap-before":       isBool,
-		"shield-wrap-character":    isString,
-		"shield-wrap-width":        isNumber,
-
-		"text-allow-overlap":     isBool,
-		"text-avoid-edges":       isBool,
-		"text-character-spacing": isNumber,
-		"text-clip":              isBool,
-		"text-dx":                isNumber,
-		"text-dy":                isNumber,
-		"text-face-name":         isStringOrStrings,
-		"text-fill":              isColor,
-		"text-halo-fill":         isColor,
-		"text-halo-radius":       isNumber,
-		"text-line-spacing":      isNumber,
-		"text-min-distance":      isNumber,
-		"text-min-padding":       isNumber,
-		"text-name":              isString,
-		"text-opacity":           isNumber,
-		"text-placement":         isKeyword("line", "point", "vertex", "interior"),
-		"text-size":              isNumber,
-		"text-spacing":           isNumber,
-		"text-transform":         isKeyword("none", "uppercase", "lowercase", "capitalize"),
-		"text-wrap-before":       isBool,
-		"text-wrap-character":    isString,
-		"text-wrap-width":        isNumber,
-
-		"raster-opacity":                 isNumber,
-		"raster-scaling":                 isScaling,
-		"raster-colorizer-default-mode":  isKeyword("discrete", "linear", "exact"),
-		"raster-colorizer-default-color": isColor,
-		"raster-colorizer-stops":         isStops,
-		"raster-comp-op":                 isCompOp,
-		"raster-filter-factor":           isNumber,
-		"raster-mesh-size":               isNumber,
-		"raster-epsilon":                 isNumber,
+	attributeTypes = map[string]propertyType{
+		"background-color": colorType,
+
+		"building-fill":         colorType,
+		"building-fill-opacity": numberType,
+		"building-height":       numberOrFieldType,
+
+		"debug-mode": keywordType("collision", "vertex"),
+
+		"dot-comp-op": compOpType,
+		"dot-fill":    colorType,
+		"dot-height":  numberType,
+		"dot-opacity": numberType,
+		"dot-width":   numberType,
+
+		"line-cap":          keywordType("round", "butt", "square"),
+		"line-clip":         boolType,
+		"line-color":        colorType,
+		"line-dasharray":    numbersType,
+		"line-gamma-method": keywordType("power", "linear", "none", "threshold", "multiply"),
+		"line-join":         keywordType("miter", "round", "bevel"),
+		"line-offset":       numberType,
+		"line-opacity":      numberType,
+		"line-rastersizer":  keywordType("full", "fast"),
+		"line-simplify":     numberType,
+		"line-smooth":       numberType,
+		"line-width":        numberType,
+
+		"marker-allow-overlap": boolType,
+		"marker-file":          stringType,
+		"marker-fill":          colorType,
+		"marker-height":        numberType,
+		"marker-line-color":    colorType,
+		"marker-line-width":    numberType,
+		"marker-opacity":       numberType,
+		"marker-placement":     keywordType("point", "interior", "line"),
+		"marker-spacing":       numberType,
+		"marker-transform":     transformType,
+		"marker-type":          keywordType("arrow", "ellipse"),
+		"marker-width":         numberType,
+
+		"point-file":             stringType,
+		"point-allow-overlap":    boolType,
+		"point-opacity":          numberType,
+		"point-transform":        transformType,
+		"point-ignore-placement": boolType,
+
+		"polygon-fill":              colorType,
+		"polygon-gamma":             numberType,
+		"polygon-gamma-method":      keywordType("power", "linear", "none", "threshold", "multiply"),
+		"polygon-opacity":           numberType,
+		"polygon-pattern-alignment": keywordType("global", "local"),
+		"polygon-pattern-file":      stringType,
+		"polygon-pattern-transform": transformType,
+
+		"shield-allow-overlap":            boolType,
+		"shield-avoid-edges":              boolType,
+		"shield-character-spacing":        numberType,
+		"shield-clip":                     boolType,
+		"shield-dx":                       numberType,
+		"shield-dy":                       numberType,
+		"shield-face-name":                stringsType,
+		"shield-file":                     stringType,
+		"shield-fill":                     colorType,
+		"shield-halo-fill":                colorType,
+		"shield-halo-radius":              numberType,
+		"shield-horizontal-alignment":     keywordType("left", "middle", "right", "auto"),
+		"shield-justify-alignment":        keywordType("left", "center", "right", "auto"),
+		"shield-label-position-tolerance": numberType,
+		"shield-line-spacing":             numberType,
+		"shield-margin":                   numberType,
+		"shield-min-distance":             numberType,
+		"shield-min-padding":              numberType,
+		"shield-name":                     labelType,
+		"shield-opacity":                  numberType,
+		"shield-placement":                keywordType("line", "point", "vertex", "interior"),
+		"shield-repeat-distance":          numberType,
+		"shield-size":                     numberType,
+		"shield-spacing":                  numberType,
+		"shield-text-dx":                  numberType,
+		"shield-text-dy":                  numberType,
+		"shield-text-opacity":             numberType,
+		"shield-text-transform":           keywordType("none", "uppercase", "lowercase", "capitalize"),
+		"shield-transform":                transformType,
+		"shield-unlock-image":             boolType,
+		"shield-vertical-alignment":       keywordType("top", "middle", "bottom", "auto"),
+		"shield-wrap-before":              boolType,
+		"shield-wrap-character":           stringType,
+		"shield-wrap-width":               numberType,
+
+		"text-allow-overlap":            boolType,
+		"text-avoid-edges":              boolType,
+		"text-character-spacing":        numberType,
+		"text-clip":                     boolType,
+		"text-dx":                       numberType,
+		"text-dy":                       numberType,
+		"text-face-name":                stringsType,
+		"text-fill":                     colorType,
+		"text-halo-fill":                colorType,
+		"text-halo-radius":              numberType,
+		"text-label-position-tolerance": numberType,
+		"text-line-spacing":             numberType,
+		"text-margin":                   numberType,
+		"text-min-distance":             numberType,
+		"text-min-padding":              numberType,
+		"text-name":                     labelType,
+		"text-opacity":                  numberType,
+		"text-placement":                keywordType("line", "point", "vertex", "interior"),
+		"text-repeat-distance":          numberType,
+		"text-size":                     numberType,
+		"text-spacing":                  numberType,
+		"text-transform":                keywordType("none", "uppercase", "lowercase", "capitalize"),
+		"text-wrap-before":              boolType,
+		"text-wrap-character":           stringType,
+		"text-wrap-width":               numberType,
+
+		"raster-opacity":                 numberType,
+		"raster-scaling":                 scalingType,
+		"raster-colorizer-default-mode":  keywordType("discrete", "linear", "exact"),
+		"raster-colorizer-default-color": colorType,
+		"raster-colorizer-stops":         stopsType,
+		"raster-comp-op":                 compOpType,
+		"raster-filter-factor":           numberType,
+		"raster-mesh-size":               numberType,
+		"raster-epsilon":                 numberType,
 	}
 }
 
 func validProperty(property string, value interface{}) bool {
-	checkFunc, ok := attributeTypes[property]
+	typ, ok := attributeTypes[property]
 	if !ok {
 		return false
 	}
-	return checkFunc(value)
+	return typ.valid(value)
+}
+
+// Property describes a property supported by magnacarto.
+type Property struct {
+	Name string
+	// Type of the values, e.g. color, number, string or keyword.
+	Type string
+	// Keywords are all valid values of keyword properties.
+	Keywords []string
+}
+
+// SupportedProperties returns all properties supported by magnacarto,
+// sorted by name.
+func SupportedProperties() []Property {
+	props := make([]Property, 0, len(attributeTypes))
+	for name := range attributeTypes {
+		p, _ := LookupProperty(name)
+		props = append(props, p)
+	}
+	sort.Slice(props, func(i, j int) bool { return props[i].Name < props[j].Name })
+	return props
+}
+
+// LookupProperty returns the description of a supported property.
+func LookupProperty(name string) (Property, bool) {
+	typ, ok := attributeTypes[name]
+	if !ok {
+		return Property{}, false
+	}
+	return Property{Name: name, Type: typ.name, Keywords: typ.keywords}, true
 }
@@ -0,0 +1,264 @@
+package mss
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultDPI is the resolution of sizes without unit. Mapnik renders one
+// pixel as 0.28mm, which is 90.7 DPI.
+const DefaultDPI = 90.7
+
+// defaultEm is the size of 1em in pixels for rules without text-size or
+// shield-size, the default text-size of Mapnik.
+const defaultEm = 10
+
+// metersPerPixel is the resolution of zoom level 0 in EPSG:3857. Sizes in m
+// are converted with the resolution at the equator.
+const metersPerPixel = 156543.03392804097
+
+// pixelsPer are the pixels at DefaultDPI for each absolute unit.
+var pixelsPer = map[string]float64{
+	"px": 1,
+	"pt": DefaultDPI / 72,
+	"in": DefaultDPI,
+	"cm": DefaultDPI / 2.54,
+	"mm": DefaultDPI / 25.4,
+}
+
+// relativeSize is a size in em or m. em are relative to the text-size or
+// shield-size of the rule, m are ground meters that depend on the zoom
+// level. Both are converted to pixels by LayerRules.
+type relativeSize struct {
+	value float64
+	unit  string
+}
+
+var dimension = regexp.MustCompile(`^([-+]?[0-9]*\.?[0-9]+)([a-zA-Z]+)$`)
+
+// parseDimension returns the pixels at DefaultDPI of a number with an
+// absolute unit, e.g. 0.5mm, or a relativeSize for em and m.
+func parseDimension(s string) (Value, error) {
+	match := dimension.FindStringSubmatch(s)
+	if match == nil {
+		return nil, fmt.Errorf("invalid dimension %s", s)
+	}
+	v, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return nil, err
+	}
+	if match[2] == "em" || match[2] == "m" {
+		return relativeSize{value: v, unit: match[2]}, nil
+	}
+	factor, ok := pixelsPer[match[2]]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit %s, expected px, pt, in, cm, mm, em or m", match[2])
+	}
+	return v * factor, nil
+}
+
+// relativeSizeOp returns the result of the operation of a and b, if one is a
+// relativeSize. Sizes of the same unit can be added and subtracted, and sizes
+// can be multiplied and divided by numbers.
+func relativeSizeOp(op codeType, a, b code) (code, bool) {
+	as, aok := a.Value.(relativeSize)
+	bs, bok := b.Value.(relativeSize)
+	switch {
+	case aok && bok && as.unit == bs.unit && op == typeAdd:
+		as.value += bs.value
+	case aok && bok && as.unit == bs.unit && op == typeSubtract:
+		as.value -= bs.value
+	case aok && b.T == typeNum && op == typeMultiply:
+		as.value *= b.Value.(float64)
+	case aok && b.T == typeNum && op == typeDivide:
+		as.value /= b.Value.(float64)
+	case bok && a.T == typeNum && op == typeMultiply:
+		as = relativeSize{value: a.Value.(float64) * bs.value, unit: bs.unit}
+	default:
+		return code{}, false
+	}
+	return code{T: typeRelativeSize, Value: as}, true
+}
+
+// sizeProperties are all properties in pixels that are scaled for the
+// output DPI.
+var sizeProperties = map[string]bool{
+	"dot-height": true,
+	"dot-width":  true,
+
+	"line-dasharray": true,
+	"line-offset":    true,
+	"line-width":     true,
+
+	"marker-height":     true,
+	"marker-line-width": true,
+	"marker-spacing":    true,
+	"marker-width":      true,
+
+	"shield-character-spacing":        true,
+	"shield-dx":                       true,
+	"shield-dy":                       true,
+	"shield-halo-radius":              true,
+	"shield-label-position-tolerance": true,
+	"shield-line-spacing":             true,
+	"shield-margin":                   true,
+	"shield-min-distance":             true,
+	"shield-min-padding":              true,
+	"shield-repeat-distance":          true,
+	"shield-size":                     true,
+	"shield-spacing":                  true,
+	"shield-text-dx":                  true,
+	"shield-text-dy":                  true,
+	"shield-wrap-width":               true,
+
+	"text-character-spacing":        true,
+	"text-dx":                       true,
+	"text-dy":                       true,
+	"text-halo-radius":              true,
+	"text-label-position-tolerance": true,
+	"text-line-spacing":             true,
+	"text-margin":                   true,
+	"text-min-distance":             true,
+	"text-min-padding":              true,
+	"text-repeat-distance":          true,
+	"text-size":                     true,
+	"text-spacing":                  true,
+	"text-wrap-width":               true,
+}
+
+// SetDPI sets the resolution of the output. All sizes are scaled from
+// DefaultDPI, e.g. by 3.3 for 300 DPI print styles.
+func (d *Decoder) SetDPI(dpi float64) {
+	d.scale = dpi / DefaultDPI
+	d.mss.scale = d.scale
+}
+
+// scaleSize returns v scaled for the output DPI, if property is a size.
+// Fields and other non-numeric values are not scaled. Sizes in em are not
+// scaled, as they are relative to the scaled text-size or shield-size.
+func (d *Decoder) scaleSize(property string, v Value) Value {
+	if d.scale == 0 || d.scale == 1 || !sizeProperties[property] {
+		return v
+	}
+	return convertSizes(v, func(v Value) Value {
+		switch v := v.(type) {
+		case float64:
+			return v * d.scale
+		case relativeSize:
+			if v.unit == "m" {
+				v.value *= d.scale
+			}
+			return v
+		}
+		return v
+	})
+}
+
+// convertSizes returns v converted by f. Lists are converted element-wise.
+func convertSizes(v Value, f func(Value) Value) Value {
+	if l, ok := v.([]Value); ok {
+		result := make([]Value, len(l))
+		for i := range l {
+			result[i] = f(l[i])
+		}
+		return result
+	}
+	return f(v)
+}
+
+// convertRelativeSizes converts all sizes in em and m of rules to pixels.
+// Rules with sizes in m are split into one rule for each zoom level. scale is
+// the scale of the output DPI (0 for DefaultDPI).
+func convertRelativeSizes(rules []Rule, scale float64) []Rule {
+	if scale == 0 {
+		scale = 1
+	}
+	var result []Rule
+	for _, r := range rules {
+		if r.Properties == nil || !r.Properties.hasUnit("em") && !r.Properties.hasUnit("m") {
+			result = append(result, r)
+			continue
+		}
+		if !r.Properties.hasUnit("m") {
+			r.Properties = r.Properties.convertEms(scale)
+			result = append(result, r)
+			continue
+		}
+		for z := 0; z <= 30; z++ {
+			if !r.Zoom.validFor(z) {
+				continue
+			}
+			zr := r
+			zr.Zoom = NewZoomRange(z, z)
+			zr.Properties = r.Properties.convertMeters(z).convertEms(scale)
+			result = append(result, zr)
+		}
+	}
+	return result
+}
+
+// hasUnit returns whether a property is a relativeSize with unit.
+func (p *Properties) hasUnit(unit string) bool {
+	found := false
+	for _, a := range p.values {
+		convertSizes(a.value, func(v Value) Value {
+			if s, ok := v.(relativeSize); ok && s.unit == unit {
+				found = true
+			}
+			return v
+		})
+	}
+	return found
+}
+
+// convertMeters returns a copy with all sizes in m converted to pixels at
+// zoom level.
+func (p *Properties) convertMeters(zoom int) *Properties {
+	pixels := math.Pow(2, float64(zoom)) / metersPerPixel
+	return p.convertUnit("m", func(k key, v float64) float64 { return v * pixels })
+}
+
+// convertEms returns a copy with all sizes in em converted to pixels. 1em is
+// the text-size for text properties and the shield-size for shield
+// properties, or the default text-size of Mapnik (scaled for the output DPI).
+// text-size and shield-size in em are relative to the default text-size.
+func (p *Properties) convertEms(scale float64) *Properties {
+	em := func(k key) float64 {
+		var size string
+		if strings.HasPrefix(k.name, "text-") && k.name != "text-size" {
+			size = "text-size"
+		} else if strings.HasPrefix(k.name, "shield-") && k.name != "shield-size" {
+			size = "shield-size"
+		}
+		if size != "" {
+			switch v := p.values[key{name: size, instance: k.instance}].value.(type) {
+			case float64:
+				return v
+			case relativeSize:
+				if v.unit == "em" {
+					return v.value * defaultEm * scale
+				}
+			}
+		}
+		return defaultEm * scale
+	}
+	return p.convertUnit("em", func(k key, v float64) float64 { return v * em(k) })
+}
+
+// convertUnit returns a copy with all sizes in unit converted by f.
+func (p *Properties) convertUnit(unit string, f func(key, float64) float64) *Properties {
+	result := &Properties{values: make(map[key]attr, len(p.values)), defaultInstance: p.defaultInstance}
+	for k, a := range p.values {
+		a.value = convertSizes(a.value, func(v Value) Value {
+			if s, ok := v.(relativeSize); ok && s.unit == unit {
+				return f(k, s.value)
+			}
+			return v
+		})
+		result.values[k] = a
+	}
+	return result
+}
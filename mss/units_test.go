@@ -0,0 +1,145 @@
+package mss
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDimension(t *testing.T) {
+	for _, tc := range []struct {
+		s   string
+		v   Value
+		err string
+	}{
+		{"2px", 2.0, ""},
+		{"72pt", DefaultDPI, ""},
+		{"1in", DefaultDPI, ""},
+		{"25.4mm", DefaultDPI, ""},
+		{"2.54cm", DefaultDPI, ""},
+		{"1.5em", relativeSize{1.5, "em"}, ""},
+		{"5m", relativeSize{5, "m"}, ""},
+		{"5km", nil, "unknown unit km"},
+	} {
+		v, err := parseDimension(tc.s)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("expected error %q for %s, got %v", tc.err, tc.s, err)
+			}
+			continue
+		}
+		assert.NoError(t, err)
+		if f, ok := tc.v.(float64); ok {
+			assert.InDelta(t, f, v, 1e-9, tc.s)
+		} else {
+			assert.Equal(t, tc.v, v, tc.s)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	for _, deferEval := range []bool{false, true} {
+		for _, dpi := range []float64{0, DefaultDPI * 2} {
+			d := New()
+			if deferEval {
+				d.EnableDeferredEval()
+			}
+			if dpi != 0 {
+				d.SetDPI(dpi)
+			}
+			err := d.ParseString(`
+@casing: 0.5mm;
+#roads {
+	line-width: 2px + @casing * 2;
+	line-dasharray: 4, 2pt;
+	line-opacity: 0.5;
+	text-size: 1.2em;
+	text-name: [name];
+	text-wrap-width: [wrap];
+}`)
+			assert.NoError(t, err)
+			assert.NoError(t, d.Evaluate())
+
+			scale := 1.0
+			if dpi != 0 {
+				scale = 2
+			}
+			r := d.MSS().LayerRules("roads")[0]
+			v, _ := r.Properties.GetFloat("line-width")
+			assert.InDelta(t, (2+DefaultDPI/25.4)*scale, v, 1e-9)
+			dashes, _ := r.Properties.GetFloatList("line-dasharray")
+			if assert.Len(t, dashes, 2) {
+				assert.InDelta(t, 4*scale, dashes[0], 1e-9)
+				assert.InDelta(t, 2*DefaultDPI/72*scale, dashes[1], 1e-9)
+			}
+			v, _ = r.Properties.GetFloat("line-opacity")
+			assert.Equal(t, 0.5, v)
+			v, _ = r.Properties.GetFloat("text-size")
+			assert.InDelta(t, 12*scale, v, 1e-9)
+			s, _ := r.Properties.get("text-wrap-width")
+			assert.Equal(t, "[wrap]", s)
+		}
+	}
+}
+
+func TestRelativeUnits(t *testing.T) {
+	for _, deferEval := range []bool{false, true} {
+		for _, dpi := range []float64{0, DefaultDPI * 2} {
+			d := New()
+			if deferEval {
+				d.EnableDeferredEval()
+			}
+			if dpi != 0 {
+				d.SetDPI(dpi)
+			}
+			err := d.ParseString(`
+@road: 5m;
+#roads {
+	text-name: [name];
+	text-size: 20;
+	text-dy: 0.5em;
+	text-wrap-width: 4em;
+	shield-file: url(shield.svg);
+	shield-name: [ref];
+	shield-dy: 1em;
+	line-dasharray: 1em, 2px;
+	[zoom>=15][zoom<=16] { line-width: @road * 2 + 1m; }
+}`)
+			assert.NoError(t, err)
+			assert.NoError(t, d.Evaluate())
+
+			scale := 1.0
+			if dpi != 0 {
+				scale = 2
+			}
+			rules := d.MSS().LayerRules("roads")
+			if !assert.Len(t, rules, 3) {
+				continue
+			}
+			for i, zoom := range []int{15, 16} {
+				r := rules[i]
+				assert.Equal(t, NewZoomRange(zoom, zoom), r.Zoom)
+				v, _ := r.Properties.GetFloat("line-width")
+				assert.InDelta(t, 11*math.Pow(2, float64(zoom))/metersPerPixel*scale, v, 1e-9)
+			}
+			r := rules[2]
+			v, _ := r.Properties.GetFloat("text-dy")
+			assert.InDelta(t, 10*scale, v, 1e-9)
+			v, _ = r.Properties.GetFloat("text-wrap-width")
+			assert.InDelta(t, 80*scale, v, 1e-9)
+			// without shield-size
+			v, _ = r.Properties.GetFloat("shield-dy")
+			assert.InDelta(t, 10*scale, v, 1e-9)
+			dashes, _ := r.Properties.GetFloatList("line-dasharray")
+			if assert.Len(t, dashes, 2) {
+				assert.InDelta(t, 10*scale, dashes[0], 1e-9)
+				assert.InDelta(t, 2*scale, dashes[1], 1e-9)
+			}
+		}
+	}
+
+	d := New()
+	assert.Error(t, d.ParseString(`#roads { line-width: 1m + 1px; }`))
+}
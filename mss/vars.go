@@ -0,0 +1,114 @@
+package mss
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// VarOrigin is the source of the final value of a variable.
+type VarOrigin string
+
+const (
+	// VarDefault is a declaration with !default, e.g. `@water: blue !default;`.
+	// It is only used if the variable was not set before.
+	VarDefault VarOrigin = "default"
+	// VarFile is a regular declaration in a MSS file.
+	VarFile VarOrigin = "file"
+	// VarOverride is set with SetVar, declarations in MSS files are ignored.
+	VarOverride VarOrigin = "override"
+)
+
+// Variable is the resolved value of a top-level variable.
+type Variable struct {
+	Name   string
+	Value  Value
+	Origin VarOrigin
+	// File and Line of the declaration. For overrides, this is the last
+	// declaration that was ignored, if any.
+	File string
+	Line int
+}
+
+func (v Variable) String() string {
+	s := fmt.Sprintf("@%s: %v (%s", v.Name, v.Value, v.Origin)
+	if v.File != "" {
+		s += fmt.Sprintf(", %s:%d", filepath.Base(v.File), v.Line)
+	}
+	return s + ")"
+}
+
+// SetVar overrides the variable name with value, e.g. SetVar("water",
+// "#a0c8f0"). value is a single MSS value or list, it can not refer to other
+// variables. Declarations of the variable in all MSS files are ignored.
+func (d *Decoder) SetVar(name, value string) error {
+	name = strings.TrimPrefix(name, "@")
+	tmp := New()
+	if err := tmp.ParseString("@" + name + ": " + value + ";"); err != nil {
+		return fmt.Errorf("invalid value for @%s: %s", name, err)
+	}
+	v, _ := tmp.vars.get(name)
+	d.vars.set(name, v)
+	d.varInfo()[name] = &Variable{Name: name, Origin: VarOverride}
+	return nil
+}
+
+func (d *Decoder) varInfo() map[string]*Variable {
+	if d.varOrigins == nil {
+		d.varOrigins = make(map[string]*Variable)
+	}
+	return d.varOrigins
+}
+
+// isDefaultFlag consumes an optional !default after the value of a
+// variable.
+func (d *Decoder) isDefaultFlag() bool {
+	tok := d.next()
+	if tok.t != tokenChar || tok.value != "!" {
+		d.backup()
+		return false
+	}
+	tok = d.next()
+	if tok.t != tokenIdent || tok.value != "default" {
+		d.error(d.pos(tok), "expected !default, got %v", tok)
+	}
+	return true
+}
+
+// setVar sets the variable from a declaration at tok, unless it is
+// overridden or a default for an existing variable.
+func (d *Decoder) setVar(name string, v Value, isDefault bool, tok *token) {
+	info := d.varInfo()
+	if prev, ok := info[name]; ok && prev.Origin == VarOverride {
+		prev.File, prev.Line = d.filename, tok.line
+		return
+	}
+	if isDefault {
+		if prev, _ := d.vars.get(name); prev != nil {
+			return
+		}
+	}
+	d.vars.set(name, v)
+	origin := VarFile
+	if isDefault {
+		origin = VarDefault
+	}
+	info[name] = &Variable{Name: name, Origin: origin, File: d.filename, Line: tok.line}
+}
+
+// Variables returns all top-level variables with their final values, sorted
+// by name. Values are only evaluated after Evaluate.
+func (d *Decoder) Variables() []Variable {
+	vars := []Variable{}
+	for name, info := range d.varOrigins {
+		v := *info
+		v.Value, _ = d.vars.get(name)
+		if m, ok := v.Value.(*varMap); ok {
+			v.Value = m.String()
+		}
+		vars = append(vars, v)
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Name < vars[j].Name })
+	return vars
+}
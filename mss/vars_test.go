@@ -0,0 +1,56 @@
+package mss
+
+import (
+	"testing"
+
+	"github.com/omniscale/magnacarto/color"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVariables(t *testing.T) {
+	for _, deferEval := range []bool{false, true} {
+		d := New()
+		if deferEval {
+			d.EnableDeferredEval()
+		}
+		assert.NoError(t, d.SetVar("@width", "3"))
+		assert.NoError(t, d.SetVar("water", "#0000ff"))
+		assert.Error(t, d.SetVar("water", "#xyz"))
+
+		d.filename = "base.mss"
+		assert.NoError(t, d.ParseString(`
+@width: 1;
+@casing: @width + 2;
+@land: #eeeeee !default;
+@water: red;
+@names: (de: 'name_de', en: 'name_en') !default;
+`))
+		d.filename = "style.mss"
+		assert.NoError(t, d.ParseString(`
+@land: white;
+@casing: 10 !default;
+@label: 'name';
+#roads { line-width: @width; }
+`))
+		assert.NoError(t, d.Evaluate())
+
+		rules := d.MSS().LayerRules("roads")
+		v, _ := rules[0].Properties.get("line-width")
+		assert.Equal(t, 3.0, v)
+
+		assert.Equal(t, []Variable{
+			{Name: "casing", Value: 5.0, Origin: VarFile, File: "base.mss", Line: 3},
+			{Name: "label", Value: "name", Origin: VarFile, File: "style.mss", Line: 4},
+			{Name: "land", Value: color.MustParse("white"), Origin: VarFile, File: "style.mss", Line: 2},
+			{Name: "names", Value: "(de: name_de, en: name_en)", Origin: VarDefault, File: "base.mss", Line: 6},
+			{Name: "water", Value: color.MustParse("#0000ff"), Origin: VarOverride, File: "base.mss", Line: 5},
+			{Name: "width", Value: 3.0, Origin: VarOverride, File: "base.mss", Line: 2},
+		}, d.Variables(), "deferEval %v", deferEval)
+	}
+
+	assert.Equal(t, "@width: 3 (override, style.mss:2)", Variable{Name: "width", Value: 3.0, Origin: VarOverride, File: "/styles/style.mss", Line: 2}.String())
+	assert.Equal(t, "@width: 3 (override)", Variable{Name: "width", Value: 3.0, Origin: VarOverride}.String())
+
+	d := New()
+	assert.Error(t, d.ParseString(`@width: 1 !important;`))
+}
@@ -18,6 +18,20 @@ func newZoomRange(comp CompOp, zoom int64) ZoomRange {
 	return AllZoom.add(comp, int8(zoom))
 }
 
+// NewZoomRange returns the ZoomRange for all levels from min to max.
+func NewZoomRange(min, max int) ZoomRange {
+	if min < 0 {
+		min = 0
+	}
+	if max > 30 {
+		max = 30
+	}
+	if min > max {
+		return InvalidZoom
+	}
+	return AllZoom.add(GTE, int8(min)).add(LTE, int8(max))
+}
+
 type CompOp int
 
 const (
@@ -28,6 +42,9 @@ const (
 	LTE
 	EQ
 	NEQ
+	// IN matches any value of a []Value. Only used for filters of merged
+	// rules (see MergeRules).
+	IN
 )
 
 func (c CompOp) String() string {
@@ -44,6 +61,8 @@ func (c CompOp) String() string {
 		return "<"
 	case NEQ:
 		return "!="
+	case IN:
+		return "in"
 	default:
 		return "?"
 	}
@@ -101,6 +120,15 @@ func (z ZoomRange) combine(other ZoomRange) ZoomRange {
 	return ZoomRange(other & z)
 }
 
+// continuous returns true if all zoom levels of z are adjacent.
+func (z ZoomRange) continuous() bool {
+	if z == InvalidZoom {
+		return false
+	}
+	z >>= uint(z.First())
+	return z&(z+1) == 0
+}
+
 func (z ZoomRange) Levels() (n int) {
 	// n accumulates the total bits set in x, counting only set bits
 	for ; z > 0; n++ {
@@ -0,0 +1,171 @@
+// Package output writes generated styles to local files, S3 or HTTP
+// targets, optionally compressed with gzip or zstd.
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Compression of the output.
+const (
+	None = ""
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// CompressionFor returns the compression for the suffix of target (.gz or
+// .zst).
+func CompressionFor(target string) string {
+	switch {
+	case strings.HasSuffix(target, ".gz"):
+		return Gzip
+	case strings.HasSuffix(target, ".zst"):
+		return Zstd
+	}
+	return None
+}
+
+// IsRemote returns whether target is an S3 or HTTP URL.
+func IsRemote(target string) bool {
+	for _, prefix := range []string{"s3://", "http://", "https://"} {
+		if strings.HasPrefix(target, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Write compresses content and writes it to target. Targets are local files,
+// s3://bucket/key or http(s):// URLs (with HTTP PUT). Existing targets are
+// only replaced after the complete content was written: local files are
+// renamed from a temporary file, and remote targets receive the content in
+// a single request.
+func Write(target string, content []byte, compression string) error {
+	content, err := Compress(content, compression)
+	if err != nil {
+		return err
+	}
+	contentType := contentType(target, compression)
+	switch {
+	case strings.HasPrefix(target, "s3://"):
+		return putS3(target, content, contentType)
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return put(target, content, contentType)
+	}
+	return writeFile(target, content)
+}
+
+// Compress returns content compressed with gzip or zstd. The zstd command
+// needs to be installed for zstd.
+func Compress(content []byte, compression string) ([]byte, error) {
+	switch compression {
+	case None:
+		return content, nil
+	case Gzip:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		// there is no zstd in the standard library, use the zstd command
+		cmd := exec.Command("zstd", "-q", "-c")
+		cmd.Stdin = bytes.NewReader(content)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return nil, fmt.Errorf("zstd compression failed: %s: %s", err, msg)
+			}
+			return nil, fmt.Errorf("zstd compression failed: %s", err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q, expected gzip or zstd", compression)
+}
+
+func contentType(target, compression string) string {
+	switch compression {
+	case Gzip:
+		return "application/gzip"
+	case Zstd:
+		return "application/zstd"
+	}
+	if strings.HasSuffix(target, ".xml") {
+		return "application/xml"
+	}
+	return "text/plain"
+}
+
+func writeFile(target string, content []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// keep the mode of an existing target, TempFile creates files with 0600
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(target); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err := os.Chmod(f.Name(), mode); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), target); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// put uploads content with HTTP PUT. User and password from the URL are
+// used for basic auth.
+func put(target string, content []byte, contentType string) error {
+	req, err := http.NewRequest("PUT", target, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return do(req)
+}
+
+func do(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("uploading to %s failed: %s %s", req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package preview
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type geometryType int
+
+const (
+	pointGeometry geometryType = iota + 1
+	lineGeometry
+	polygonGeometry
+)
+
+type point struct {
+	X, Y float64
+}
+
+// Feature is a single geometry with its attributes. Multi geometries are
+// stored as multiple parts. Polygons contain all rings as parts.
+type Feature struct {
+	typ   geometryType
+	parts [][]point
+	attrs map[string]interface{}
+	bbox  [4]float64
+}
+
+func newFeature(typ geometryType, parts [][]point, attrs map[string]interface{}) *Feature {
+	f := &Feature{typ: typ, parts: parts, attrs: attrs}
+	f.bbox = [4]float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	for _, part := range parts {
+		for _, p := range part {
+			f.bbox[0] = math.Min(f.bbox[0], p.X)
+			f.bbox[1] = math.Min(f.bbox[1], p.Y)
+			f.bbox[2] = math.Max(f.bbox[2], p.X)
+			f.bbox[3] = math.Max(f.bbox[3], p.Y)
+		}
+	}
+	return f
+}
+
+func (f *Feature) intersects(bbox [4]float64) bool {
+	return f.bbox[0] <= bbox[2] && f.bbox[2] >= bbox[0] &&
+		f.bbox[1] <= bbox[3] && f.bbox[3] >= bbox[1]
+}
+
+// attr returns the value of an attribute. mapnik::geometry_type returns
+// 1, 2 or 3 for points, lines and polygons, like in Mapnik.
+func (f *Feature) attr(name string) interface{} {
+	if name == "mapnik::geometry_type" {
+		return float64(f.typ)
+	}
+	return f.attrs[name]
+}
+
+// text returns the label of the feature.
+func (f *Feature) text(parts []TextPart) string {
+	s := ""
+	for _, p := range parts {
+		if p.Field == "" {
+			s += p.Text
+			continue
+		}
+		switch v := f.attr(p.Field).(type) {
+		case nil:
+		case float64:
+			s += strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			s += fmt.Sprint(v)
+		}
+	}
+	return s
+}
+
+func (r *Rule) matches(f *Feature, zoom int) bool {
+	if zoom < 0 || zoom > 30 || r.Zoom>>uint(zoom)&1 == 0 {
+		return false
+	}
+	for _, filter := range r.Filters {
+		if !filter.matches(f.attr(filter.Field)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (filter *Filter) matches(v interface{}) bool {
+	if filter.Op == "in" {
+		values, _ := filter.Value.([]interface{})
+		for _, fv := range values {
+			if compare(v, fv) == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	c := compare(v, filter.Value)
+	switch filter.Op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c == -1
+	case "<=":
+		return c == -1 || c == 0
+	case ">":
+		return c == 1
+	case ">=":
+		return c == 1 || c == 0
+	}
+	return false
+}
+
+// compare returns -1, 0, 1 if a is less, equal or greater than b and 2 if
+// a and b are not comparable. Strings are compared as numbers if the other
+// value is a number. nil only equals nil.
+func compare(a, b interface{}) int {
+	if a == nil || b == nil {
+		if a == nil && b == nil {
+			return 0
+		}
+		return 2
+	}
+	if isNumber(a) || isNumber(b) {
+		af, aok := toFloat(a)
+		bf, bok := toFloat(b)
+		if aok && bok {
+			switch {
+			case af < bf:
+				return -1
+			case af > bf:
+				return 1
+			}
+			return 0
+		}
+	}
+	as, bs := fmt.Sprint(a), fmt.Sprint(b)
+	switch {
+	case as < bs:
+		return -1
+	case as > bs:
+		return 1
+	}
+	return 0
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case float64, bool:
+		return true
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
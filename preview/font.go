@@ -0,0 +1,200 @@
+package preview
+
+import (
+	"image"
+	"math"
+
+	"github.com/omniscale/magnacarto/color"
+)
+
+const (
+	glyphWidth   = 5
+	glyphHeight  = 7
+	glyphAdvance = 6
+)
+
+// glyphs is a 5x7 bitmap font for ASCII 0x20-0x7e. Each glyph has five
+// columns, bit 0 is the top row.
+var glyphs = [95][glyphWidth]uint8{
+	{0x00, 0x00, 0x00, 0x00, 0x00}, // space
+	{0x00, 0x00, 0x5f, 0x00, 0x00}, // !
+	{0x00, 0x07, 0x00, 0x07, 0x00}, // "
+	{0x14, 0x7f, 0x14, 0x7f, 0x14}, // #
+	{0x24, 0x2a, 0x7f, 0x2a, 0x12}, // $
+	{0x23, 0x13, 0x08, 0x64, 0x62}, // %
+	{0x36, 0x49, 0x55, 0x22, 0x50}, // &
+	{0x00, 0x05, 0x03, 0x00, 0x00}, // '
+	{0x00, 0x1c, 0x22, 0x41, 0x00}, // (
+	{0x00, 0x41, 0x22, 0x1c, 0x00}, // )
+	{0x14, 0x08, 0x3e, 0x08, 0x14}, // *
+	{0x08, 0x08, 0x3e, 0x08, 0x08}, // +
+	{0x00, 0x50, 0x30, 0x00, 0x00}, // ,
+	{0x08, 0x08, 0x08, 0x08, 0x08}, // -
+	{0x00, 0x60, 0x60, 0x00, 0x00}, // .
+	{0x20, 0x10, 0x08, 0x04, 0x02}, // /
+	{0x3e, 0x51, 0x49, 0x45, 0x3e}, // 0
+	{0x00, 0x42, 0x7f, 0x40, 0x00}, // 1
+	{0x42, 0x61, 0x51, 0x49, 0x46}, // 2
+	{0x21, 0x41, 0x45, 0x4b, 0x31}, // 3
+	{0x18, 0x14, 0x12, 0x7f, 0x10}, // 4
+	{0x27, 0x45, 0x45, 0x45, 0x39}, // 5
+	{0x3c, 0x4a, 0x49, 0x49, 0x30}, // 6
+	{0x01, 0x71, 0x09, 0x05, 0x03}, // 7
+	{0x36, 0x49, 0x49, 0x49, 0x36}, // 8
+	{0x06, 0x49, 0x49, 0x29, 0x1e}, // 9
+	{0x00, 0x36, 0x36, 0x00, 0x00}, // :
+	{0x00, 0x56, 0x36, 0x00, 0x00}, // ;
+	{0x08, 0x14, 0x22, 0x41, 0x00}, // <
+	{0x14, 0x14, 0x14, 0x14, 0x14}, // =
+	{0x00, 0x41, 0x22, 0x14, 0x08}, // >
+	{0x02, 0x01, 0x51, 0x09, 0x06}, // ?
+	{0x32, 0x49, 0x79, 0x41, 0x3e}, // @
+	{0x7e, 0x11, 0x11, 0x11, 0x7e}, // A
+	{0x7f, 0x49, 0x49, 0x49, 0x36}, // B
+	{0x3e, 0x41, 0x41, 0x41, 0x22}, // C
+	{0x7f, 0x41, 0x41, 0x22, 0x1c}, // D
+	{0x7f, 0x49, 0x49, 0x49, 0x41}, // E
+	{0x7f, 0x09, 0x09, 0x09, 0x01}, // F
+	{0x3e, 0x41, 0x49, 0x49, 0x7a}, // G
+	{0x7f, 0x08, 0x08, 0x08, 0x7f}, // H
+	{0x00, 0x41, 0x7f, 0x41, 0x00}, // I
+	{0x20, 0x40, 0x41, 0x3f, 0x01}, // J
+	{0x7f, 0x08, 0x14, 0x22, 0x41}, // K
+	{0x7f, 0x40, 0x40, 0x40, 0x40}, // L
+	{0x7f, 0x02, 0x0c, 0x02, 0x7f}, // M
+	{0x7f, 0x04, 0x08, 0x10, 0x7f}, // N
+	{0x3e, 0x41, 0x41, 0x41, 0x3e}, // O
+	{0x7f, 0x09, 0x09, 0x09, 0x06}, // P
+	{0x3e, 0x41, 0x51, 0x21, 0x5e}, // Q
+	{0x7f, 0x09, 0x19, 0x29, 0x46}, // R
+	{0x46, 0x49, 0x49, 0x49, 0x31}, // S
+	{0x01, 0x01, 0x7f, 0x01, 0x01}, // T
+	{0x3f, 0x40, 0x40, 0x40, 0x3f}, // U
+	{0x1f, 0x20, 0x40, 0x20, 0x1f}, // V
+	{0x3f, 0x40, 0x38, 0x40, 0x3f}, // W
+	{0x63, 0x14, 0x08, 0x14, 0x63}, // X
+	{0x07, 0x08, 0x70, 0x08, 0x07}, // Y
+	{0x61, 0x51, 0x49, 0x45, 0x43}, // Z
+	{0x00, 0x7f, 0x41, 0x41, 0x00}, // [
+	{0x02, 0x04, 0x08, 0x10, 0x20}, // backslash
+	{0x00, 0x41, 0x41, 0x7f, 0x00}, // ]
+	{0x04, 0x02, 0x01, 0x02, 0x04}, // ^
+	{0x40, 0x40, 0x40, 0x40, 0x40}, // _
+	{0x00, 0x01, 0x02, 0x04, 0x00}, // `
+	{0x20, 0x54, 0x54, 0x54, 0x78}, // a
+	{0x7f, 0x48, 0x44, 0x44, 0x38}, // b
+	{0x38, 0x44, 0x44, 0x44, 0x20}, // c
+	{0x38, 0x44, 0x44, 0x48, 0x7f}, // d
+	{0x38, 0x54, 0x54, 0x54, 0x18}, // e
+	{0x08, 0x7e, 0x09, 0x01, 0x02}, // f
+	{0x0c, 0x52, 0x52, 0x52, 0x3e}, // g
+	{0x7f, 0x08, 0x04, 0x04, 0x78}, // h
+	{0x00, 0x44, 0x7d, 0x40, 0x00}, // i
+	{0x20, 0x40, 0x44, 0x3d, 0x00}, // j
+	{0x7f, 0x10, 0x28, 0x44, 0x00}, // k
+	{0x00, 0x41, 0x7f, 0x40, 0x00}, // l
+	{0x7c, 0x04, 0x18, 0x04, 0x78}, // m
+	{0x7c, 0x08, 0x04, 0x04, 0x78}, // n
+	{0x38, 0x44, 0x44, 0x44, 0x38}, // o
+	{0x7c, 0x14, 0x14, 0x14, 0x08}, // p
+	{0x08, 0x14, 0x14, 0x18, 0x7c}, // q
+	{0x7c, 0x08, 0x04, 0x04, 0x08}, // r
+	{0x48, 0x54, 0x54, 0x54, 0x20}, // s
+	{0x04, 0x3f, 0x44, 0x40, 0x20}, // t
+	{0x3c, 0x40, 0x40, 0x20, 0x7c}, // u
+	{0x1c, 0x20, 0x40, 0x20, 0x1c}, // v
+	{0x3c, 0x40, 0x30, 0x40, 0x3c}, // w
+	{0x44, 0x28, 0x10, 0x28, 0x44}, // x
+	{0x0c, 0x50, 0x50, 0x50, 0x3c}, // y
+	{0x44, 0x64, 0x54, 0x4c, 0x44}, // z
+	{0x00, 0x08, 0x36, 0x41, 0x00}, // {
+	{0x00, 0x00, 0x7f, 0x00, 0x00}, // |
+	{0x00, 0x41, 0x36, 0x08, 0x00}, // }
+	{0x08, 0x04, 0x08, 0x10, 0x08}, // ~
+}
+
+// glyphFallbacks maps common non-ASCII letters to ASCII.
+var glyphFallbacks = map[rune]rune{
+	'ä': 'a', 'á': 'a', 'à': 'a', 'â': 'a', 'å': 'a',
+	'Ä': 'A', 'Á': 'A', 'À': 'A', 'Â': 'A', 'Å': 'A',
+	'é': 'e', 'è': 'e', 'ê': 'e', 'É': 'E', 'È': 'E',
+	'í': 'i', 'ì': 'i', 'î': 'i',
+	'ö': 'o', 'ó': 'o', 'ò': 'o', 'ô': 'o', 'ø': 'o',
+	'Ö': 'O', 'Ó': 'O', 'Ø': 'O',
+	'ü': 'u', 'ú': 'u', 'ù': 'u', 'û': 'u', 'Ü': 'U', 'Ú': 'U',
+	'ß': 's', 'ç': 'c', 'Ç': 'C', 'ñ': 'n', 'Ñ': 'N',
+}
+
+func glyph(r rune) [glyphWidth]uint8 {
+	if f, ok := glyphFallbacks[r]; ok {
+		r = f
+	}
+	if r < 0x20 || r > 0x7e {
+		r = '?'
+	}
+	return glyphs[r-0x20]
+}
+
+// textScale returns the pixel size of the glyph dots for a text-size.
+func textScale(size float64) int {
+	return int(math.Max(1, math.Floor(size/10+0.5)))
+}
+
+// textBox returns the size of text in pixels.
+func textBox(text string, scale int) (int, int) {
+	n := len([]rune(text))
+	if n == 0 {
+		return 0, 0
+	}
+	return (n*glyphAdvance - 1) * scale, glyphHeight * scale
+}
+
+// drawText draws text with the top left corner at x, y. The halo is drawn
+// first, if haloRadius is > 0.
+func drawText(dst *image.RGBA, text string, x, y, scale int, fill color.RGBA, halo *color.RGBA, haloRadius int) {
+	if halo != nil && haloRadius > 0 {
+		drawGlyphs(dst, text, x, y, scale, *halo, haloRadius)
+	}
+	drawGlyphs(dst, text, x, y, scale, fill, 0)
+}
+
+// DrawLabel draws text with the bitmap font in dark gray with a white halo,
+// with the top left corner at x, y. scale is the size of each dot in pixels.
+// Returns the size of the text, without the halo.
+func DrawLabel(dst *image.RGBA, text string, x, y, scale int) (int, int) {
+	drawText(dst, text, x, y, scale,
+		color.RGBA{R: 0.2, G: 0.2, B: 0.2, A: 1}, &color.RGBA{R: 1, G: 1, B: 1, A: 0.8}, scale)
+	return textBox(text, scale)
+}
+
+// drawGlyphs draws the dots of all glyphs, grown by grow pixels in each
+// direction. Each pixel is drawn once, so that overlapping dots do not
+// increase the opacity.
+func drawGlyphs(dst *image.RGBA, text string, x, y, scale int, c color.RGBA, grow int) {
+	w, h := textBox(text, scale)
+	w += 2 * grow
+	h += 2 * grow
+	mask := make([]bool, w*h)
+	for i, r := range []rune(text) {
+		g := glyph(r)
+		for col := 0; col < glyphWidth; col++ {
+			for row := 0; row < glyphHeight; row++ {
+				if g[col]>>uint(row)&1 == 0 {
+					continue
+				}
+				px := (i*glyphAdvance + col) * scale
+				py := row * scale
+				for dy := 0; dy < scale+2*grow; dy++ {
+					for dx := 0; dx < scale+2*grow; dx++ {
+						mask[(py+dy)*w+px+dx] = true
+					}
+				}
+			}
+		}
+	}
+	for i, set := range mask {
+		if set {
+			blend(dst, x-grow+i%w, y-grow+i/w, c, 1)
+		}
+	}
+}
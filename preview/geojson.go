@@ -0,0 +1,125 @@
+package preview
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+type geoJSON struct {
+	Type        string
+	Features    []geoJSON
+	Geometry    *geoJSON
+	Geometries  []geoJSON
+	Properties  map[string]interface{}
+	Coordinates json.RawMessage
+}
+
+// readGeoJSON reads all features of a FeatureCollection, a single Feature or
+// a single geometry.
+func readGeoJSON(r io.Reader) ([]*Feature, error) {
+	doc := geoJSON{}
+	if err := json.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, err
+	}
+	var features []*Feature
+	switch doc.Type {
+	case "FeatureCollection":
+		for _, f := range doc.Features {
+			if f.Geometry == nil {
+				continue
+			}
+			fs, err := geoJSONFeatures(*f.Geometry, f.Properties)
+			if err != nil {
+				return nil, err
+			}
+			features = append(features, fs...)
+		}
+	case "Feature":
+		if doc.Geometry != nil {
+			return geoJSONFeatures(*doc.Geometry, doc.Properties)
+		}
+	default:
+		return geoJSONFeatures(doc, nil)
+	}
+	return features, nil
+}
+
+// geoJSONFeatures returns the features of a geometry. GeometryCollections
+// return one feature for each geometry type.
+func geoJSONFeatures(g geoJSON, props map[string]interface{}) ([]*Feature, error) {
+	var err error
+	var typ geometryType
+	var parts [][]point
+	switch g.Type {
+	case "Point":
+		var c []float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil {
+			typ, parts = pointGeometry, [][]point{{coord(c)}}
+		}
+	case "MultiPoint", "LineString":
+		var c [][]float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil {
+			if g.Type == "MultiPoint" {
+				typ = pointGeometry
+				for _, p := range c {
+					parts = append(parts, []point{coord(p)})
+				}
+			} else {
+				typ, parts = lineGeometry, [][]point{coords(c)}
+			}
+		}
+	case "MultiLineString", "Polygon":
+		var c [][][]float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil {
+			typ = lineGeometry
+			if g.Type == "Polygon" {
+				typ = polygonGeometry
+			}
+			for _, l := range c {
+				parts = append(parts, coords(l))
+			}
+		}
+	case "MultiPolygon":
+		var c [][][][]float64
+		if err = json.Unmarshal(g.Coordinates, &c); err == nil {
+			typ = polygonGeometry
+			for _, poly := range c {
+				for _, ring := range poly {
+					parts = append(parts, coords(ring))
+				}
+			}
+		}
+	case "GeometryCollection":
+		var features []*Feature
+		for _, child := range g.Geometries {
+			fs, err := geoJSONFeatures(child, props)
+			if err != nil {
+				return nil, err
+			}
+			features = append(features, fs...)
+		}
+		return features, nil
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON type %s", g.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid coordinates of %s: %s", g.Type, err)
+	}
+	return []*Feature{newFeature(typ, parts, props)}, nil
+}
+
+func coord(c []float64) point {
+	if len(c) < 2 {
+		return point{}
+	}
+	return point{c[0], c[1]}
+}
+
+func coords(cs [][]float64) []point {
+	ps := make([]point, len(cs))
+	for i, c := range cs {
+		ps[i] = coord(c)
+	}
+	return ps
+}
@@ -0,0 +1,265 @@
+package preview
+
+import (
+	"image"
+	"math"
+	"sort"
+
+	"github.com/omniscale/magnacarto/color"
+)
+
+// subsamples is the number of scanlines per pixel row for anti-aliasing.
+const subsamples = 4
+
+// rasterizer fills paths with anti-aliased edges. Paths are collected with
+// addPath and drawn with fill.
+type rasterizer struct {
+	width, height int
+	cover         []float32
+	paths         [][]point
+	evenOdd       bool
+}
+
+func newRasterizer(width, height int) *rasterizer {
+	return &rasterizer{
+		width:  width,
+		height: height,
+		cover:  make([]float32, width*height),
+	}
+}
+
+// addPath adds a closed path in pixel coordinates.
+func (r *rasterizer) addPath(p []point) {
+	if len(p) > 2 {
+		r.paths = append(r.paths, p)
+	}
+}
+
+// edge is a path segment from a to b with a.Y < b.Y. dir is -1 if the
+// segment was reversed.
+type edge struct {
+	a, b point
+	dir  int
+}
+
+type crossing struct {
+	x   float64
+	dir int
+}
+
+// fill draws all paths with c and removes them. Overlapping paths are
+// combined with the non-zero winding rule, or with the even-odd rule if
+// evenOdd is set (e.g. for polygons with holes of unknown orientation).
+func (r *rasterizer) fill(dst *image.RGBA, c color.RGBA, opacity float64) {
+	defer func() { r.paths = r.paths[:0] }()
+	var edges []edge
+	for _, p := range r.paths {
+		for i := range p {
+			a, b := p[i], p[(i+1)%len(p)]
+			if a.Y == b.Y {
+				continue
+			}
+			dir := 1
+			if b.Y < a.Y {
+				a, b = b, a
+				dir = -1
+			}
+			edges = append(edges, edge{a, b, dir})
+		}
+	}
+	if len(edges) == 0 {
+		return
+	}
+	sort.Slice(edges, func(i, j int) bool { return edges[i].a.Y < edges[j].a.Y })
+	maxY := math.Inf(-1)
+	for _, e := range edges {
+		maxY = math.Max(maxY, e.b.Y)
+	}
+	y0 := int(math.Max(0, math.Floor(edges[0].a.Y)))
+	y1 := int(math.Min(float64(r.height), math.Ceil(maxY)))
+
+	var active []edge
+	var crossings []crossing
+	next := 0
+	for y := y0; y < y1; y++ {
+		row := r.cover[y*r.width : (y+1)*r.width]
+		for s := 0; s < subsamples; s++ {
+			sy := float64(y) + (float64(s)+0.5)/subsamples
+			for next < len(edges) && edges[next].a.Y <= sy {
+				active = append(active, edges[next])
+				next++
+			}
+			crossings = crossings[:0]
+			n := 0
+			for _, e := range active {
+				if e.b.Y <= sy {
+					continue // remove
+				}
+				active[n] = e
+				n++
+				crossings = append(crossings, crossing{e.a.X + (sy-e.a.Y)*(e.b.X-e.a.X)/(e.b.Y-e.a.Y), e.dir})
+			}
+			active = active[:n]
+			sort.Slice(crossings, func(i, j int) bool { return crossings[i].x < crossings[j].x })
+			winding := 0
+			for i, c := range crossings {
+				if r.evenOdd {
+					winding ^= 1
+				} else {
+					winding += c.dir
+				}
+				if winding != 0 && i+1 < len(crossings) {
+					addSpan(row, c.x, crossings[i+1].x, 1.0/subsamples)
+				}
+			}
+		}
+	}
+	for y := y0; y < y1; y++ {
+		row := r.cover[y*r.width : (y+1)*r.width]
+		for x, cov := range row {
+			if cov == 0 {
+				continue
+			}
+			blend(dst, x, y, c, math.Min(1, float64(cov))*opacity)
+			row[x] = 0
+		}
+	}
+}
+
+// addSpan adds the coverage w for the pixels between x0 and x1.
+func addSpan(row []float32, x0, x1 float64, w float32) {
+	x0 = math.Max(0, x0)
+	x1 = math.Min(float64(len(row)), x1)
+	if x0 >= x1 {
+		return
+	}
+	i0, i1 := int(x0), int(x1)
+	if i0 == i1 {
+		row[i0] += float32(x1-x0) * w
+		return
+	}
+	row[i0] += float32(float64(i0+1)-x0) * w
+	for i := i0 + 1; i < i1; i++ {
+		row[i] += w
+	}
+	if i1 < len(row) {
+		row[i1] += float32(x1-float64(i1)) * w
+	}
+}
+
+// blend draws c with the opacity a over the pixel x, y.
+func blend(dst *image.RGBA, x, y int, c color.RGBA, a float64) {
+	a *= c.A
+	if a <= 0 || !(image.Point{x, y}.In(dst.Rect)) {
+		return
+	}
+	i := dst.PixOffset(x, y)
+	p := dst.Pix[i : i+4]
+	p[0] = uint8(c.R*255*a + float64(p[0])*(1-a) + 0.5)
+	p[1] = uint8(c.G*255*a + float64(p[1])*(1-a) + 0.5)
+	p[2] = uint8(c.B*255*a + float64(p[2])*(1-a) + 0.5)
+	p[3] = uint8(255*a + float64(p[3])*(1-a) + 0.5)
+}
+
+// addStroke adds the outline of a line with the given width. Segments and
+// joins are added as separate paths, that are combined by the non-zero
+// winding rule.
+func (r *rasterizer) addStroke(line []point, width float64, lineCap string) {
+	if len(line) < 2 || width <= 0 {
+		return
+	}
+	hw := width / 2
+	for i := 0; i+1 < len(line); i++ {
+		a, b := line[i], line[i+1]
+		dx, dy := b.X-a.X, b.Y-a.Y
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			continue
+		}
+		dx, dy = dx/l, dy/l
+		if lineCap == "square" {
+			if i == 0 {
+				a = point{a.X - dx*hw, a.Y - dy*hw}
+			}
+			if i+2 == len(line) {
+				b = point{b.X + dx*hw, b.Y + dy*hw}
+			}
+		}
+		nx, ny := -dy*hw, dx*hw
+		r.addPath([]point{
+			{a.X + nx, a.Y + ny},
+			{b.X + nx, b.Y + ny},
+			{b.X - nx, b.Y - ny},
+			{a.X - nx, a.Y - ny},
+		})
+		if i > 0 {
+			// round joins
+			r.addPath(circle(a, hw))
+		}
+	}
+	if lineCap == "round" {
+		r.addPath(circle(line[0], hw))
+		r.addPath(circle(line[len(line)-1], hw))
+	}
+}
+
+// circle returns a polygon with the same orientation as the segments of
+// addStroke.
+func circle(c point, radius float64) []point {
+	n := int(math.Max(8, math.Min(64, radius*4)))
+	p := make([]point, n)
+	for i := range p {
+		a := -2 * math.Pi * float64(i) / float64(n)
+		p[i] = point{c.X + radius*math.Cos(a), c.Y + radius*math.Sin(a)}
+	}
+	return p
+}
+
+// dash splits line into the dashes of the pattern. Pattern contains
+// alternating dash and gap lengths.
+func dash(line []point, pattern []float64) [][]point {
+	total := 0.0
+	for _, v := range pattern {
+		total += v
+	}
+	if total <= 0 || len(pattern)%2 != 0 {
+		return [][]point{line}
+	}
+	var dashes [][]point
+	var current []point
+	idx, left := 0, pattern[0]
+	for i := 0; i+1 < len(line); i++ {
+		a, b := line[i], line[i+1]
+		l := math.Hypot(b.X-a.X, b.Y-a.Y)
+		pos := 0.0
+		for pos < l {
+			step := math.Min(left, l-pos)
+			p0 := lerp(a, b, pos/l)
+			p1 := lerp(a, b, (pos+step)/l)
+			if idx%2 == 0 {
+				if len(current) == 0 {
+					current = append(current, p0)
+				}
+				current = append(current, p1)
+			}
+			pos += step
+			left -= step
+			if left <= 0 {
+				if idx%2 == 0 && len(current) > 1 {
+					dashes = append(dashes, current)
+				}
+				current = nil
+				idx = (idx + 1) % len(pattern)
+				left = pattern[idx]
+			}
+		}
+	}
+	if len(current) > 1 {
+		dashes = append(dashes, current)
+	}
+	return dashes
+}
+
+func lerp(a, b point, t float64) point {
+	return point{a.X + (b.X-a.X)*t, a.Y + (b.Y-a.Y)*t}
+}
@@ -0,0 +1,82 @@
+package preview
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/omniscale/magnacarto/color"
+)
+
+func TestRasterizerFill(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	r := newRasterizer(10, 10)
+	r.addPath([]point{{2, 2}, {8, 2}, {8, 8}, {2, 8}})
+	// hole with the same orientation
+	r.addPath([]point{{4, 4}, {6, 4}, {6, 6}, {4, 6}})
+	r.evenOdd = true
+	r.fill(img, color.RGBA{R: 1, A: 1}, 1)
+
+	if c := rgba(img, 3, 3); c != [4]uint8{255, 0, 0, 255} {
+		t.Error("expected fill", c)
+	}
+	if c := rgba(img, 5, 5); c != [4]uint8{} {
+		t.Error("expected hole", c)
+	}
+	if c := rgba(img, 1, 1); c != [4]uint8{} {
+		t.Error("expected empty", c)
+	}
+	for _, v := range r.cover {
+		if v != 0 {
+			t.Fatal("coverage not reset")
+		}
+	}
+
+	// half covered pixels
+	img = image.NewRGBA(image.Rect(0, 0, 10, 10))
+	r.evenOdd = false
+	r.addPath([]point{{2.5, 2}, {8, 2}, {8, 8}, {2.5, 8}})
+	r.fill(img, color.RGBA{R: 1, A: 1}, 1)
+	if c := rgba(img, 2, 4); c[3] < 126 || c[3] > 129 {
+		t.Error("expected half coverage", c)
+	}
+}
+
+func TestStroke(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	r := newRasterizer(20, 20)
+	r.addStroke([]point{{2, 10}, {10, 10}, {10, 18}}, 4, "butt")
+	r.fill(img, color.RGBA{G: 1, A: 1}, 1)
+
+	for _, p := range []image.Point{{4, 10}, {10, 10}, {10, 15}, {9, 11}} {
+		if c := rgba(img, p.X, p.Y); c != [4]uint8{0, 255, 0, 255} {
+			t.Error("expected line at", p, c)
+		}
+	}
+	for _, p := range []image.Point{{1, 10}, {4, 14}, {15, 10}} {
+		if c := rgba(img, p.X, p.Y); c != [4]uint8{} {
+			t.Error("expected no line at", p, c)
+		}
+	}
+}
+
+func TestDash(t *testing.T) {
+	dashes := dash([]point{{0, 0}, {10, 0}, {10, 10}}, []float64{4, 2})
+	expected := [][]point{
+		{{0, 0}, {4, 0}},
+		{{6, 0}, {10, 0}},
+		{{10, 2}, {10, 6}},
+		{{10, 8}, {10, 10}},
+	}
+	if len(dashes) != len(expected) {
+		t.Fatal("unexpected dashes", dashes)
+	}
+	for i := range dashes {
+		d := dashes[i]
+		e := expected[i]
+		if math.Abs(d[0].X-e[0].X) > 1e-9 || math.Abs(d[0].Y-e[0].Y) > 1e-9 ||
+			math.Abs(d[len(d)-1].X-e[1].X) > 1e-9 || math.Abs(d[len(d)-1].Y-e[1].Y) > 1e-9 {
+			t.Error("unexpected dash", i, d, e)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package preview
+
+import (
+	"fmt"
+	"image"
+	imagecolor "image/color"
+	"image/draw"
+	"math"
+
+	"github.com/omniscale/magnacarto/color"
+)
+
+// Request describes the map to render.
+type Request struct {
+	Width    int
+	Height   int
+	BBOX     [4]float64
+	EPSGCode int
+	// ScaleFactor scales all sizes of the style.
+	ScaleFactor float64
+}
+
+// watermark is drawn in the lower right corner of all maps.
+const watermark = "approximate preview"
+
+// scaleDenominators are the maximum scale denominators of each zoom level,
+// as used by the builders.
+var scaleDenominators = []float64{
+	1000000000, 500000000, 200000000, 100000000, 50000000, 25000000,
+	12500000, 6500000, 3000000, 1500000, 750000, 400000, 200000, 100000,
+	50000, 25000, 12500, 5000, 2500, 1500, 750, 500, 250, 100,
+}
+
+// zoomLevel returns the zoom level of the style rules for req.
+func zoomLevel(req Request) int {
+	res := (req.BBOX[2] - req.BBOX[0]) / float64(req.Width)
+	if req.EPSGCode == 4326 {
+		res *= 2 * math.Pi * earthRadius / 360
+	}
+	denom := res / 0.00028
+	if req.ScaleFactor > 0 {
+		// like Mapnik, to keep the zoom level of maps with larger sizes
+		denom *= req.ScaleFactor
+	}
+	z := 0
+	for z+1 < len(scaleDenominators) && denom < scaleDenominators[z+1] {
+		z++
+	}
+	return z
+}
+
+type renderer struct {
+	req    Request
+	img    *image.RGBA
+	raster *rasterizer
+	scale  float64
+	labels []image.Rectangle
+}
+
+// Render renders the style. Layers are loaded from their files on the first
+// request and cached until the files change.
+func Render(s *Style, req Request) (*image.RGBA, error) {
+	if req.Width <= 0 || req.Height <= 0 {
+		return nil, fmt.Errorf("invalid image size %dx%d", req.Width, req.Height)
+	}
+	r := &renderer{
+		req:    req,
+		img:    image.NewRGBA(image.Rect(0, 0, req.Width, req.Height)),
+		raster: newRasterizer(req.Width, req.Height),
+		scale:  req.ScaleFactor,
+	}
+	if r.scale <= 0 {
+		r.scale = 1
+	}
+	if s.Background != nil {
+		bg := *s.Background
+		draw.Draw(r.img, r.img.Rect, image.NewUniform(imagecolor.NRGBA{
+			uint8(bg.R*255 + 0.5), uint8(bg.G*255 + 0.5), uint8(bg.B*255 + 0.5), uint8(bg.A*255 + 0.5),
+		}), image.Point{}, draw.Src)
+	}
+
+	zoom := zoomLevel(req)
+	// include features next to the map for labels and wide lines
+	bufX := (req.BBOX[2] - req.BBOX[0]) / float64(req.Width) * 64
+	bufY := (req.BBOX[3] - req.BBOX[1]) / float64(req.Height) * 64
+	bbox := [4]float64{req.BBOX[0] - bufX, req.BBOX[1] - bufY, req.BBOX[2] + bufX, req.BBOX[3] + bufY}
+
+	for _, l := range s.Layers {
+		features, err := cache.load(l.File, l.SRS, req.EPSGCode)
+		if err != nil {
+			return nil, fmt.Errorf("layer %s: %s", l.Name, err)
+		}
+		for _, style := range l.Styles {
+			for _, f := range features {
+				if !f.intersects(bbox) {
+					continue
+				}
+				for i := range style.Rules {
+					if !style.Rules[i].matches(f, zoom) {
+						continue
+					}
+					for _, sym := range style.Rules[i].Symbolizers {
+						r.draw(f, sym)
+					}
+				}
+			}
+		}
+	}
+
+	w, h := textBox(watermark, 1)
+	drawText(r.img, watermark, req.Width-w-4, req.Height-h-4, 1,
+		color.RGBA{R: 0.2, G: 0.2, B: 0.2, A: 1}, &color.RGBA{R: 1, G: 1, B: 1, A: 0.8}, 1)
+	return r.img, nil
+}
+
+// pixels returns the parts of f in pixel coordinates.
+func (r *renderer) pixels(f *Feature) [][]point {
+	b := r.req.BBOX
+	sx := float64(r.req.Width) / (b[2] - b[0])
+	sy := float64(r.req.Height) / (b[3] - b[1])
+	parts := make([][]point, len(f.parts))
+	for i, part := range f.parts {
+		parts[i] = make([]point, len(part))
+		for j, p := range part {
+			parts[i][j] = point{(p.X - b[0]) * sx, (b[3] - p.Y) * sy}
+		}
+	}
+	return parts
+}
+
+func (r *renderer) draw(f *Feature, sym Symbolizer) {
+	opacity := sym.Opacity
+	switch sym.Type {
+	case "polygon":
+		if f.typ != polygonGeometry || sym.Fill == nil {
+			return
+		}
+		for _, ring := range r.pixels(f) {
+			r.raster.addPath(ring)
+		}
+		r.raster.evenOdd = true
+		r.raster.fill(r.img, *sym.Fill, opacity)
+		r.raster.evenOdd = false
+	case "line":
+		if f.typ == pointGeometry || sym.Stroke == nil {
+			return
+		}
+		for _, part := range r.pixels(f) {
+			if f.typ == polygonGeometry && len(part) > 0 {
+				part = append(part, part[0])
+			}
+			lines := [][]point{part}
+			if len(sym.Dasharray) > 0 {
+				pattern := make([]float64, len(sym.Dasharray))
+				for i, v := range sym.Dasharray {
+					pattern[i] = v * r.scale
+				}
+				lines = dash(part, pattern)
+			}
+			for _, l := range lines {
+				r.raster.addStroke(l, sym.Width*r.scale, sym.Cap)
+			}
+		}
+		r.raster.fill(r.img, *sym.Stroke, opacity)
+	case "marker":
+		p, ok := r.anchor(f)
+		if !ok {
+			return
+		}
+		radius := sym.Size * r.scale / 2
+		if sym.Fill != nil {
+			r.raster.addPath(circle(p, radius))
+			r.raster.fill(r.img, *sym.Fill, opacity)
+		}
+		if sym.Stroke != nil && sym.Width > 0 {
+			outline := circle(p, radius)
+			r.raster.addStroke(append(outline, outline[0]), sym.Width*r.scale, "round")
+			r.raster.fill(r.img, *sym.Stroke, opacity)
+		}
+	case "text":
+		r.drawLabel(f, sym)
+	}
+}
+
+// anchor returns the pixel position for markers and labels: the first point
+// of points, the middle of the longest line or the center of the largest
+// polygon ring.
+func (r *renderer) anchor(f *Feature) (point, bool) {
+	parts := r.pixels(f)
+	if len(parts) == 0 || len(parts[0]) == 0 {
+		return point{}, false
+	}
+	switch f.typ {
+	case lineGeometry:
+		var best []point
+		bestLen := -1.0
+		for _, part := range parts {
+			if l := length(part); l > bestLen {
+				best, bestLen = part, l
+			}
+		}
+		return along(best, bestLen/2), true
+	case polygonGeometry:
+		var best []point
+		bestArea := -1.0
+		for _, part := range parts {
+			if a := math.Abs(area(part)); a > bestArea {
+				best, bestArea = part, a
+			}
+		}
+		return centroid(best), true
+	}
+	return parts[0][0], true
+}
+
+func (r *renderer) drawLabel(f *Feature, sym Symbolizer) {
+	text := f.text(sym.Text)
+	if text == "" {
+		return
+	}
+	p, ok := r.anchor(f)
+	if !ok {
+		return
+	}
+	scale := textScale(sym.Size * r.scale)
+	w, h := textBox(text, scale)
+	x, y := int(p.X)-w/2, int(p.Y)-h/2
+	halo := int(math.Ceil(sym.HaloRadius * r.scale))
+	box := image.Rect(x-halo, y-halo, x+w+halo, y+h+halo)
+	if !box.In(r.img.Rect) {
+		return
+	}
+	if !sym.AllowOverlap {
+		for _, l := range r.labels {
+			if l.Overlaps(box) {
+				return
+			}
+		}
+	}
+	r.labels = append(r.labels, box)
+	fill := color.RGBA{A: 1}
+	if sym.Fill != nil {
+		fill = *sym.Fill
+	}
+	fill.A *= sym.Opacity
+	drawText(r.img, text, x, y, scale, fill, sym.HaloFill, halo)
+}
+
+func length(line []point) float64 {
+	l := 0.0
+	for i := 0; i+1 < len(line); i++ {
+		l += math.Hypot(line[i+1].X-line[i].X, line[i+1].Y-line[i].Y)
+	}
+	return l
+}
+
+// along returns the point at distance d along line.
+func along(line []point, d float64) point {
+	for i := 0; i+1 < len(line); i++ {
+		l := math.Hypot(line[i+1].X-line[i].X, line[i+1].Y-line[i].Y)
+		if d <= l && l > 0 {
+			return lerp(line[i], line[i+1], d/l)
+		}
+		d -= l
+	}
+	return line[len(line)-1]
+}
+
+func area(ring []point) float64 {
+	a := 0.0
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		a += ring[i].X*ring[j].Y - ring[j].X*ring[i].Y
+	}
+	return a / 2
+}
+
+// centroid returns the centroid of ring, or the center of the bounding box
+// for rings without area.
+func centroid(ring []point) point {
+	a := area(ring)
+	if a == 0 {
+		minX, minY := math.Inf(1), math.Inf(1)
+		maxX, maxY := math.Inf(-1), math.Inf(-1)
+		for _, p := range ring {
+			minX, minY = math.Min(minX, p.X), math.Min(minY, p.Y)
+			maxX, maxY = math.Max(maxX, p.X), math.Max(maxY, p.Y)
+		}
+		return point{(minX + maxX) / 2, (minY + maxY) / 2}
+	}
+	var cx, cy float64
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		cross := ring[i].X*ring[j].Y - ring[j].X*ring[i].Y
+		cx += (ring[i].X + ring[j].X) * cross
+		cy += (ring[i].Y + ring[j].Y) * cross
+	}
+	return point{cx / (6 * a), cy / (6 * a)}
+}
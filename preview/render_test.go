@@ -0,0 +1,141 @@
+package preview
+
+import (
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omniscale/magnacarto/color"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+const testGeoJSON = `{"type": "FeatureCollection", "features": [
+	{"type": "Feature", "properties": {"type": "water"},
+	 "geometry": {"type": "Polygon", "coordinates": [[[-170, -60], [-10, -60], [-10, 60], [-170, 60], [-170, -60]]]}},
+	{"type": "Feature", "properties": {"type": "forest"},
+	 "geometry": {"type": "Polygon", "coordinates": [[[10, -60], [170, -60], [170, 60], [10, 60], [10, -60]]]}},
+	{"type": "Feature", "properties": {"name": "HQ"},
+	 "geometry": {"type": "Point", "coordinates": [90, 0]}}
+]}`
+
+func writeTestFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "magnacarto_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fname := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname, func() { os.RemoveAll(dir) }
+}
+
+func rgba(img *image.RGBA, x, y int) [4]uint8 {
+	i := img.PixOffset(x, y)
+	return [4]uint8{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+}
+
+func TestRender(t *testing.T) {
+	fname, cleanup := writeTestFile(t, "test.geojson", testGeoJSON)
+	defer cleanup()
+
+	blue := color.MustParse("#0000ff")
+	red := color.MustParse("#ff0000")
+	white := color.MustParse("#ffffff")
+	style := &Style{
+		Background: &white,
+		Layers: []Layer{{
+			Name: "landuse",
+			File: fname,
+			SRS:  "+init=epsg:4326",
+			Styles: []LayerStyle{{Rules: []Rule{
+				{
+					Zoom:        mss.AllZoom,
+					Filters:     []Filter{{Field: "type", Op: "=", Value: "water"}},
+					Symbolizers: []Symbolizer{{Type: "polygon", Fill: &blue, Opacity: 1}},
+				},
+				{
+					Zoom:        mss.NewZoomRange(5, 30),
+					Filters:     []Filter{{Field: "type", Op: "=", Value: "forest"}},
+					Symbolizers: []Symbolizer{{Type: "polygon", Fill: &red, Opacity: 1}},
+				},
+				{
+					Zoom:        mss.AllZoom,
+					Filters:     []Filter{{Field: "mapnik::geometry_type", Op: "=", Value: 1.0}},
+					Symbolizers: []Symbolizer{{Type: "marker", Fill: &red, Size: 10, Opacity: 1}},
+				},
+			}}},
+		}},
+	}
+
+	req := Request{
+		Width:    256,
+		Height:   256,
+		BBOX:     [4]float64{-20037508.34, -20037508.34, 20037508.34, 20037508.34},
+		EPSGCode: 3857,
+	}
+	img, err := Render(style, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := rgba(img, 64, 128); c != [4]uint8{0, 0, 255, 255} {
+		t.Error("expected water", c)
+	}
+	// forest only from zoom 5
+	if c := rgba(img, 160, 100); c != [4]uint8{255, 255, 255, 255} {
+		t.Error("expected background", c)
+	}
+	if c := rgba(img, 192, 128); c != [4]uint8{255, 0, 0, 255} {
+		t.Error("expected marker", c)
+	}
+	// anti-aliased edge
+	if c := rgba(img, 120, 128); c[0] == 0 || c[0] == 255 {
+		t.Error("expected anti-aliased edge", c)
+	}
+
+	req.EPSGCode = 25832
+	if _, err := Render(style, req); err == nil {
+		t.Error("expected error for unsupported SRS")
+	}
+}
+
+func TestZoomLevel(t *testing.T) {
+	for _, tc := range []struct {
+		req  Request
+		zoom int
+	}{
+		{Request{Width: 256, BBOX: [4]float64{-20037508.34, 0, 20037508.34, 0}, EPSGCode: 3857}, 0},
+		{Request{Width: 256, BBOX: [4]float64{0, 0, 20037508.34 / 512, 0}, EPSGCode: 3857}, 10},
+		{Request{Width: 512, BBOX: [4]float64{0, 0, 20037508.34 / 512, 0}, EPSGCode: 3857, ScaleFactor: 2}, 10},
+		{Request{Width: 256, BBOX: [4]float64{-180, 0, 180, 0}, EPSGCode: 4326}, 0},
+	} {
+		if z := zoomLevel(tc.req); z != tc.zoom {
+			t.Errorf("%v: %d != %d", tc.req, z, tc.zoom)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	for _, tc := range []struct {
+		filter Filter
+		value  interface{}
+		match  bool
+	}{
+		{Filter{Op: "=", Value: "foo"}, "foo", true},
+		{Filter{Op: "=", Value: "foo"}, nil, false},
+		{Filter{Op: "=", Value: nil}, nil, true},
+		{Filter{Op: "!=", Value: nil}, "foo", true},
+		{Filter{Op: "=", Value: 5.0}, "5", true},
+		{Filter{Op: ">", Value: 5.0}, 10.0, true},
+		{Filter{Op: "<=", Value: 5.0}, 10.0, false},
+		{Filter{Op: "<", Value: "b"}, "a", true},
+		{Filter{Op: "in", Value: []interface{}{"a", "b"}}, "b", true},
+		{Filter{Op: "in", Value: []interface{}{"a", "b"}}, "c", false},
+	} {
+		if m := tc.filter.matches(tc.value); m != tc.match {
+			t.Errorf("%v %v: %v != %v", tc.filter, tc.value, m, tc.match)
+		}
+	}
+}
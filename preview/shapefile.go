@@ -0,0 +1,200 @@
+package preview
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// readShapefile reads all features of a Shapefile with the attributes from
+// the .dbf file. Z and M values are ignored.
+func readShapefile(filename string) ([]*Feature, error) {
+	base := strings.TrimSuffix(filename, ".shp")
+	shp, err := ioutil.ReadFile(base + ".shp")
+	if err != nil {
+		return nil, err
+	}
+	var records []map[string]interface{}
+	dbf, err := ioutil.ReadFile(base + ".dbf")
+	if err == nil {
+		if records, err = parseDBF(dbf); err != nil {
+			return nil, fmt.Errorf("%s.dbf: %s", base, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	features, err := parseSHP(shp, records)
+	if err != nil {
+		return nil, fmt.Errorf("%s.shp: %s", base, err)
+	}
+	return features, nil
+}
+
+var errShortShapefile = errors.New("unexpected end of file")
+
+func parseSHP(b []byte, records []map[string]interface{}) ([]*Feature, error) {
+	if len(b) < 100 || binary.BigEndian.Uint32(b) != 9994 {
+		return nil, errors.New("not a Shapefile")
+	}
+	le := binary.LittleEndian
+	var features []*Feature
+	for n, off := 0, 100; off+8 <= len(b); n++ {
+		length := int(binary.BigEndian.Uint32(b[off+4:])) * 2
+		off += 8
+		if off+length > len(b) || length < 4 {
+			return nil, errShortShapefile
+		}
+		rec := b[off : off+length]
+		off += length
+
+		var attrs map[string]interface{}
+		if n < len(records) {
+			attrs = records[n]
+		}
+		if attrs == nil && records != nil {
+			continue // deleted
+		}
+
+		float := func(i int) float64 { return math.Float64frombits(le.Uint64(rec[i:])) }
+		switch shapeType := le.Uint32(rec); shapeType {
+		case 0: // null
+		case 1, 11, 21: // point
+			if len(rec) < 20 {
+				return nil, errShortShapefile
+			}
+			features = append(features, newFeature(pointGeometry, [][]point{{{float(4), float(12)}}}, attrs))
+		case 8, 18, 28: // multipoint
+			if len(rec) < 40 {
+				return nil, errShortShapefile
+			}
+			num := int(le.Uint32(rec[36:]))
+			if len(rec) < 40+num*16 {
+				return nil, errShortShapefile
+			}
+			parts := make([][]point, num)
+			for i := range parts {
+				parts[i] = []point{{float(40 + i*16), float(48 + i*16)}}
+			}
+			features = append(features, newFeature(pointGeometry, parts, attrs))
+		case 3, 13, 23, 5, 15, 25: // polyline, polygon
+			if len(rec) < 44 {
+				return nil, errShortShapefile
+			}
+			numParts := int(le.Uint32(rec[36:]))
+			numPoints := int(le.Uint32(rec[40:]))
+			pointsOff := 44 + numParts*4
+			if len(rec) < pointsOff+numPoints*16 {
+				return nil, errShortShapefile
+			}
+			parts := make([][]point, 0, numParts)
+			for i := 0; i < numParts; i++ {
+				start := int(le.Uint32(rec[44+i*4:]))
+				end := numPoints
+				if i+1 < numParts {
+					end = int(le.Uint32(rec[48+i*4:]))
+				}
+				if start > end || end > numPoints {
+					return nil, fmt.Errorf("invalid part in record %d", n+1)
+				}
+				part := make([]point, end-start)
+				for j := range part {
+					p := pointsOff + (start+j)*16
+					part[j] = point{float(p), float(p + 8)}
+				}
+				parts = append(parts, part)
+			}
+			typ := lineGeometry
+			if shapeType%10 == 5 {
+				typ = polygonGeometry
+			}
+			features = append(features, newFeature(typ, parts, attrs))
+		default:
+			return nil, fmt.Errorf("unsupported shape type %d", shapeType)
+		}
+	}
+	return features, nil
+}
+
+// parseDBF returns the attributes of all records. Deleted records are nil.
+// Numeric fields are returned as float64, all other fields as strings.
+// Strings that are not valid UTF-8 are decoded as Latin-1.
+func parseDBF(b []byte) ([]map[string]interface{}, error) {
+	if len(b) < 32 {
+		return nil, errors.New("not a dBASE file")
+	}
+	le := binary.LittleEndian
+	numRecords := int(le.Uint32(b[4:]))
+	headerLength := int(le.Uint16(b[8:]))
+	recordLength := int(le.Uint16(b[10:]))
+	if headerLength > len(b) {
+		return nil, errors.New("invalid header")
+	}
+
+	type field struct {
+		name   string
+		typ    byte
+		length int
+	}
+	var fields []field
+	for off := 32; off+32 <= headerLength && b[off] != 0x0d; off += 32 {
+		name := b[off : off+11]
+		if i := bytes.IndexByte(name, 0); i >= 0 {
+			name = name[:i]
+		}
+		fields = append(fields, field{string(name), b[off+11], int(b[off+16])})
+	}
+
+	records := make([]map[string]interface{}, numRecords)
+	for i := range records {
+		off := headerLength + i*recordLength
+		end := off + recordLength
+		if end > len(b) {
+			return nil, errShortShapefile
+		}
+		if b[off] == '*' {
+			continue
+		}
+		off++
+		attrs := make(map[string]interface{}, len(fields))
+		for _, f := range fields {
+			if off+f.length > end {
+				break
+			}
+			v := strings.TrimSpace(decodeDBFString(b[off : off+f.length]))
+			off += f.length
+			switch f.typ {
+			case 'N', 'F':
+				if n, err := strconv.ParseFloat(v, 64); err == nil {
+					attrs[f.name] = n
+				} else {
+					attrs[f.name] = nil
+				}
+			default:
+				attrs[f.name] = v
+			}
+		}
+		records[i] = attrs
+	}
+	return records, nil
+}
+
+func decodeDBFString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,122 @@
+package preview
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// featureCache caches the features of all files until they change.
+type featureCache struct {
+	mu    sync.Mutex
+	files map[string]cachedFile
+}
+
+type cachedFile struct {
+	modTime  time.Time
+	features []*Feature
+}
+
+var cache = &featureCache{files: make(map[string]cachedFile)}
+
+// load returns the features of a Shapefile or GeoJSON file, projected from
+// srs to the EPSG code.
+func (c *featureCache) load(filename string, srs string, epsg int) ([]*Feature, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s:%s:%d", filename, srs, epsg)
+
+	c.mu.Lock()
+	cached, ok := c.files[key]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(fi.ModTime()) {
+		return cached.features, nil
+	}
+
+	src, err := parseSRS(srs)
+	if err != nil {
+		return nil, err
+	}
+	if epsg == 900913 {
+		epsg = 3857
+	}
+	if epsg != 3857 && epsg != 4326 {
+		return nil, fmt.Errorf("unsupported map SRS EPSG:%d, only EPSG:4326 and EPSG:3857 are supported", epsg)
+	}
+
+	var features []*Feature
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".shp":
+		features, err = readShapefile(filename)
+	case ".geojson", ".json":
+		var f *os.File
+		if f, err = os.Open(filename); err == nil {
+			features, err = readGeoJSON(f)
+			f.Close()
+		}
+	default:
+		err = fmt.Errorf("unsupported file type, only Shapefiles and GeoJSON are supported")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if src != epsg {
+		for i, f := range features {
+			for _, part := range f.parts {
+				for j := range part {
+					if epsg == 3857 {
+						part[j] = toMercator(part[j])
+					} else {
+						part[j] = toLonLat(part[j])
+					}
+				}
+			}
+			features[i] = newFeature(f.typ, f.parts, f.attrs)
+		}
+	}
+
+	c.mu.Lock()
+	c.files[key] = cachedFile{modTime: fi.ModTime(), features: features}
+	c.mu.Unlock()
+	return features, nil
+}
+
+// parseSRS returns 4326 or 3857 for Proj4 definitions or SRIDs of
+// geographic and web mercator coordinates. Defaults to 4326 for empty srs,
+// like GeoJSON.
+func parseSRS(srs string) (int, error) {
+	s := strings.ToLower(srs)
+	switch {
+	case s == "" || s == "4326" || strings.Contains(s, "epsg:4326") || strings.Contains(s, "+proj=longlat"):
+		return 4326, nil
+	case s == "3857" || s == "900913" ||
+		strings.Contains(s, "epsg:3857") || strings.Contains(s, "epsg:900913") ||
+		(strings.Contains(s, "+proj=merc") && strings.Contains(s, "+a=6378137")):
+		return 3857, nil
+	}
+	return 0, fmt.Errorf("unsupported SRS %q, only EPSG:4326 and EPSG:3857 are supported", srs)
+}
+
+const earthRadius = 6378137.0
+
+func toMercator(p point) point {
+	lat := math.Max(-85.0511287798, math.Min(85.0511287798, p.Y))
+	return point{
+		X: p.X * math.Pi / 180 * earthRadius,
+		Y: math.Log(math.Tan(math.Pi/4+lat*math.Pi/360)) * earthRadius,
+	}
+}
+
+func toLonLat(p point) point {
+	return point{
+		X: p.X / earthRadius * 180 / math.Pi,
+		Y: (2*math.Atan(math.Exp(p.Y/earthRadius)) - math.Pi/2) * 180 / math.Pi,
+	}
+}
@@ -0,0 +1,150 @@
+package preview
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testShapefile returns a .shp with two lines and a .dbf with the fields
+// name (C) and lanes (N). The first record is deleted.
+func testShapefile() ([]byte, []byte) {
+	le := binary.LittleEndian
+	records := [][]point{{{0, 0}, {10, 10}}, {{5, 5}, {6, 6}, {7, 5}}}
+
+	shp := &bytes.Buffer{}
+	shp.Write(make([]byte, 100))
+	for i, line := range records {
+		content := &bytes.Buffer{}
+		binary.Write(content, le, int32(3))
+		binary.Write(content, le, [4]float64{})
+		binary.Write(content, le, int32(1))
+		binary.Write(content, le, int32(len(line)))
+		binary.Write(content, le, int32(0))
+		for _, p := range line {
+			binary.Write(content, le, [2]float64{p.X, p.Y})
+		}
+		binary.Write(shp, binary.BigEndian, int32(i+1))
+		binary.Write(shp, binary.BigEndian, int32(content.Len()/2))
+		shp.Write(content.Bytes())
+	}
+	b := shp.Bytes()
+	binary.BigEndian.PutUint32(b, 9994)
+	binary.BigEndian.PutUint32(b[24:], uint32(len(b)/2))
+
+	dbf := &bytes.Buffer{}
+	header := make([]byte, 32)
+	header[0] = 3
+	le.PutUint32(header[4:], 2)
+	le.PutUint16(header[8:], 32+2*32+1)
+	le.PutUint16(header[10:], 1+10+4)
+	dbf.Write(header)
+	for _, f := range []struct {
+		name   string
+		typ    byte
+		length byte
+	}{{"name", 'C', 10}, {"lanes", 'N', 4}} {
+		field := make([]byte, 32)
+		copy(field, f.name)
+		field[11] = f.typ
+		field[16] = f.length
+		dbf.Write(field)
+	}
+	dbf.WriteByte(0x0d)
+	dbf.WriteString("*deleted      1")
+	dbf.WriteString(" Stra\xdfe       2")
+	return b, dbf.Bytes()
+}
+
+func TestReadShapefile(t *testing.T) {
+	shp, dbf := testShapefile()
+	fname, cleanup := writeTestFile(t, "roads.shp", string(shp))
+	defer cleanup()
+	if err := ioutil.WriteFile(strings.TrimSuffix(fname, ".shp")+".dbf", dbf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	features, err := readShapefile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 1 {
+		t.Fatal("expected one feature", features)
+	}
+	f := features[0]
+	if f.typ != lineGeometry || !reflect.DeepEqual(f.parts, [][]point{{{5, 5}, {6, 6}, {7, 5}}}) {
+		t.Error("unexpected geometry", f.typ, f.parts)
+	}
+	if !reflect.DeepEqual(f.attrs, map[string]interface{}{"name": "Straße", "lanes": 2.0}) {
+		t.Error("unexpected attributes", f.attrs)
+	}
+	if f.bbox != [4]float64{5, 5, 7, 6} {
+		t.Error("unexpected bbox", f.bbox)
+	}
+}
+
+func TestReadGeoJSON(t *testing.T) {
+	features, err := readGeoJSON(strings.NewReader(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"name": "a"}, "geometry": {"type": "MultiLineString", "coordinates": [[[0, 0], [1, 1]], [[2, 2], [3, 3]]]}},
+		{"type": "Feature", "properties": {}, "geometry": null},
+		{"type": "Feature", "properties": {"name": "b"}, "geometry": {"type": "GeometryCollection", "geometries": [
+			{"type": "Point", "coordinates": [1, 2]},
+			{"type": "MultiPolygon", "coordinates": [[[[0, 0], [1, 0], [1, 1], [0, 0]]]]}
+		]}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(features) != 3 {
+		t.Fatal("unexpected features", features)
+	}
+	for i, tc := range []struct {
+		typ   geometryType
+		parts int
+		name  string
+	}{
+		{lineGeometry, 2, "a"},
+		{pointGeometry, 1, "b"},
+		{polygonGeometry, 1, "b"},
+	} {
+		if f := features[i]; f.typ != tc.typ || len(f.parts) != tc.parts || f.attrs["name"] != tc.name {
+			t.Errorf("unexpected feature %d: %v", i, f)
+		}
+	}
+
+	if _, err := readGeoJSON(strings.NewReader(`{"type": "Circle"}`)); err == nil {
+		t.Error("expected error for unknown type")
+	}
+}
+
+func TestLoadReprojects(t *testing.T) {
+	fname, cleanup := writeTestFile(t, "points.geojson", `{"type": "Point", "coordinates": [180, 0]}`)
+	defer cleanup()
+
+	c := &featureCache{files: make(map[string]cachedFile)}
+	features, err := c.load(fname, "", 3857)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := features[0].parts[0][0]; math.Abs(p.X-20037508.34) > 0.01 || math.Abs(p.Y) > 0.01 {
+		t.Error("unexpected point", p)
+	}
+	features, err = c.load(fname, "+proj=longlat +datum=WGS84", 4326)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := features[0].parts[0][0]; p != (point{180, 0}) {
+		t.Error("unexpected point", p)
+	}
+	if _, err := c.load(fname, "+init=epsg:25832", 3857); err == nil {
+		t.Error("expected error for unsupported SRS")
+	}
+	if _, err := c.load(filepath.Join(filepath.Dir(fname), "missing.geojson"), "", 3857); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
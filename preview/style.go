@@ -0,0 +1,112 @@
+// Package preview implements a simple pure-Go renderer for map previews.
+//
+// The renderer supports polygon fills, lines with dash arrays, circle
+// markers and basic point labels of Shapefile and GeoJSON layers in
+// EPSG:4326 or EPSG:3857. It does not support patterns, SVG files, fonts or
+// line labels and the output is only an approximation of Mapnik or
+// MapServer. Use it for quick style sketches on systems without Mapnik.
+//
+// Styles are built with builder/preview.
+package preview
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/omniscale/magnacarto/color"
+	"github.com/omniscale/magnacarto/mss"
+)
+
+// Style is a simplified map style with only the properties supported by the
+// renderer.
+type Style struct {
+	Background *color.RGBA `json:",omitempty"`
+	Layers     []Layer
+}
+
+// Layer is a single data layer with the rules of all attachments.
+type Layer struct {
+	Name string
+	// Type is the geometry type of the layer (Point, LineString or
+	// Polygon).
+	Type string
+	// File is the Shapefile or GeoJSON file of the layer.
+	File string
+	// SRS is the Proj4 definition or SRID of the data.
+	SRS    string
+	Styles []LayerStyle
+}
+
+// LayerStyle are all rules of an attachment.
+type LayerStyle struct {
+	Name  string
+	Rules []Rule
+}
+
+// Rule renders all features that match Filters within Zoom with
+// Symbolizers.
+type Rule struct {
+	Zoom        mss.ZoomRange
+	Filters     []Filter `json:",omitempty"`
+	Symbolizers []Symbolizer
+}
+
+// Filter compares the value of Field with Value. Op is one of
+// =, !=, <, <=, >, >= or in. Value is a list of values for in.
+type Filter struct {
+	Field string
+	Op    string
+	Value interface{}
+}
+
+// Symbolizer describes how a feature is drawn. Type is one of polygon, line,
+// marker or text. Sizes are in pixels. Opacity is applied to all colors.
+type Symbolizer struct {
+	Type      string
+	Fill      *color.RGBA `json:",omitempty"`
+	Stroke    *color.RGBA `json:",omitempty"`
+	Width     float64     `json:",omitempty"`
+	Opacity   float64     `json:",omitempty"`
+	Dasharray []float64   `json:",omitempty"`
+	Cap       string      `json:",omitempty"`
+	Size      float64     `json:",omitempty"`
+	// Text is the label of text symbolizers, as a list of literal strings
+	// and [field] references.
+	Text         []TextPart  `json:",omitempty"`
+	HaloFill     *color.RGBA `json:",omitempty"`
+	HaloRadius   float64     `json:",omitempty"`
+	AllowOverlap bool        `json:",omitempty"`
+}
+
+// TextPart is either a literal Text or the value of Field.
+type TextPart struct {
+	Text  string `json:",omitempty"`
+	Field string `json:",omitempty"`
+}
+
+// Write writes the style as JSON.
+func (s *Style) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// Decode reads a JSON style.
+func Decode(r io.Reader) (*Style, error) {
+	s := &Style{}
+	if err := json.NewDecoder(r).Decode(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads the JSON style from filename.
+func Load(filename string) (*Style, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Decode(f)
+}
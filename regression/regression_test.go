@@ -3,6 +3,7 @@
 package regression
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,6 +19,7 @@ import (
 	"github.com/omniscale/magnacarto/builder"
 	"github.com/omniscale/magnacarto/builder/mapnik"
 	"github.com/omniscale/magnacarto/builder/mapserver"
+	"github.com/omniscale/magnacarto/cartodiff"
 	"github.com/omniscale/magnacarto/config"
 	"github.com/omniscale/magnacarto/render"
 
@@ -35,6 +37,7 @@ type testCase struct {
 	Width            int
 	Height           int
 	CartoCompare     bool
+	CartoCompat      bool
 	CartoFuzz        float64
 	CartoPxDiff      int64
 	MapServerCompare bool
@@ -261,7 +264,9 @@ func buildMagnacarto(t *testing.T, c testCase, mapfile bool) {
 	if mapfile {
 		m = mapserver.New(locator)
 	} else {
-		m = mapnik.New(locator)
+		mm := mapnik.New(locator)
+		mm.SetCartoCompat(c.CartoCompat)
+		m = mm
 	}
 
 	b := builder.New(m)
@@ -281,6 +286,7 @@ func compare(t *testing.T, c testCase) {
 	dir := filepath.Join("build", c.Name)
 
 	if c.CartoCompare {
+		compareXML(t, dir)
 		compareImg(t, dir, "render-carto.png", "render-magnacarto.png", c.CartoFuzz, c.CartoPxDiff)
 	}
 	if c.MapServerCompare {
@@ -288,6 +294,27 @@ func compare(t *testing.T, c testCase) {
 	}
 }
 
+// compareXML logs semantic differences of the carto and magnacarto XML.
+func compareXML(t *testing.T, dir string) {
+	carto, err := ioutil.ReadFile(filepath.Join(dir, "carto.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	magnacarto, err := ioutil.ReadFile(filepath.Join(dir, "magnacarto.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := cartodiff.Compare(carto, magnacarto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Compatible() {
+		buf := &bytes.Buffer{}
+		report.Write(buf)
+		t.Log(buf.String())
+	}
+}
+
 func compareImg(t *testing.T, dir, fileA, fileB string, fuzz float64, expected int64) {
 	fileDiff := "diff-" + fileA + "-" + fileB + ".png"
 	cmd := exec.Command(
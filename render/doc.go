@@ -1,2 +1,10 @@
-// Package render implements map renderers baseed on Mapnik and MapServer.
+// Package render implements map renderers baseed on Mapnik and MapServer,
+// and a pure-Go renderer for approximate previews.
+//
+// Mapnik is not available if magnacarto is built with CGO_ENABLED=0 or with
+// the nomapnik build tag.
+//
+// Mapnik maps are not safe for concurrent use. Workers render with a fixed
+// number of workers, each with its own maps, and support queue limits,
+// timeouts and cancellation with context.Context.
 package render
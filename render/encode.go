@@ -0,0 +1,297 @@
+package render
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Encoder encodes rendered images. Encoders need to be safe for concurrent use.
+type Encoder interface {
+	Encode(w io.Writer, img image.Image) error
+}
+
+// WebPEncoder encodes images as lossless WebP.
+type WebPEncoder struct{}
+
+func (WebPEncoder) Encode(w io.Writer, img image.Image) error {
+	return EncodeWebP(w, img)
+}
+
+// PNGPool encodes PNG images with a limited number of concurrent encoders.
+// It reuses the encoder buffers between calls.
+type PNGPool struct {
+	// Colors reduces the image to a palette with this number of colors
+	// (2-256). Images are encoded as true color PNGs if Colors is 0.
+	Colors int
+	// CompressionLevel of the PNG encoder.
+	CompressionLevel png.CompressionLevel
+
+	sem     chan struct{}
+	buffers pngBufferPool
+}
+
+// NewPNGPool initializes a new PNGPool with the given number of concurrent
+// encoders.
+func NewPNGPool(encoders int, colors int) *PNGPool {
+	if encoders < 1 {
+		encoders = 1
+	}
+	return &PNGPool{
+		Colors: colors,
+		sem:    make(chan struct{}, encoders),
+	}
+}
+
+func (p *PNGPool) Encode(w io.Writer, img image.Image) error {
+	p.sem <- struct{}{}
+	defer func() { <-p.sem }()
+
+	if p.Colors > 0 {
+		img = Quantize(img, p.Colors)
+	}
+	enc := png.Encoder{
+		CompressionLevel: p.CompressionLevel,
+		BufferPool:       &p.buffers,
+	}
+	return enc.Encode(w, img)
+}
+
+type pngBufferPool struct {
+	pool sync.Pool
+}
+
+func (p *pngBufferPool) Get() *png.EncoderBuffer {
+	if b, ok := p.pool.Get().(*png.EncoderBuffer); ok {
+		return b
+	}
+	return nil
+}
+
+func (p *pngBufferPool) Put(b *png.EncoderBuffer) {
+	p.pool.Put(b)
+}
+
+// Quantize reduces the colors of img to a palette of at most n colors.
+// Images with n or less colors are converted without loss. Other images are
+// reduced with a median cut of the color histogram.
+func Quantize(img image.Image, n int) *image.Paletted {
+	if n > 256 {
+		n = 256
+	}
+	if n < 2 {
+		n = 2
+	}
+	b := img.Bounds()
+
+	at := func(x, y int) color.NRGBA {
+		return color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+	}
+	if nrgba, ok := img.(*image.NRGBA); ok {
+		at = func(x, y int) color.NRGBA {
+			p := nrgba.Pix[nrgba.PixOffset(x, y):]
+			return color.NRGBA{p[0], p[1], p[2], p[3]}
+		}
+	}
+
+	hist := make(map[color.NRGBA]int)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			hist[at(x, y)]++
+		}
+	}
+
+	var palette color.Palette
+	index := make(map[color.NRGBA]uint8, len(hist))
+	if len(hist) <= n {
+		colors := make([]color.NRGBA, 0, len(hist))
+		for c := range hist {
+			colors = append(colors, c)
+		}
+		// sort by frequency for stable and better compressible palettes
+		sort.Slice(colors, func(i, j int) bool {
+			if hist[colors[i]] == hist[colors[j]] {
+				return colorLess(colors[i], colors[j])
+			}
+			return hist[colors[i]] > hist[colors[j]]
+		})
+		for i, c := range colors {
+			palette = append(palette, c)
+			index[c] = uint8(i)
+		}
+	} else {
+		// reduce the precision of large histograms, the median cut is
+		// too slow otherwise
+		key := func(c color.NRGBA) color.NRGBA { return c }
+		cutHist := hist
+		if len(hist) > maxMedianCutColors {
+			key = func(c color.NRGBA) color.NRGBA {
+				return color.NRGBA{c.R &^ 7, c.G &^ 7, c.B &^ 7, c.A &^ 7}
+			}
+			cutHist = make(map[color.NRGBA]int)
+			for c, count := range hist {
+				cutHist[key(c)] += count
+			}
+		}
+		boxIndex := make(map[color.NRGBA]uint8, len(cutHist))
+		boxes := medianCut(cutHist, n)
+		for i, box := range boxes {
+			for _, cc := range box.colors {
+				boxIndex[cc.c] = uint8(i)
+			}
+		}
+		// palette is the average of the original colors of each box
+		sums := make([]colorSum, len(boxes))
+		for c, count := range hist {
+			i := boxIndex[key(c)]
+			index[c] = i
+			sums[i].add(c, count)
+		}
+		for _, sum := range sums {
+			palette = append(palette, sum.average())
+		}
+	}
+
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			dst.Pix[(y-b.Min.Y)*dst.Stride+(x-b.Min.X)] = index[at(x, y)]
+		}
+	}
+	return dst
+}
+
+func colorLess(a, b color.NRGBA) bool {
+	if a.R != b.R {
+		return a.R < b.R
+	}
+	if a.G != b.G {
+		return a.G < b.G
+	}
+	if a.B != b.B {
+		return a.B < b.B
+	}
+	return a.A < b.A
+}
+
+const maxMedianCutColors = 4096
+
+type colorCount struct {
+	c     color.NRGBA
+	count int
+}
+
+type colorBox struct {
+	colors []colorCount
+	// channel (R, G, B, A) with the largest range
+	channel int
+	width   int
+}
+
+func newColorBox(colors []colorCount) colorBox {
+	min := [4]uint8{255, 255, 255, 255}
+	max := [4]uint8{}
+	for _, cc := range colors {
+		v := [4]uint8{cc.c.R, cc.c.G, cc.c.B, cc.c.A}
+		for i := range v {
+			if v[i] < min[i] {
+				min[i] = v[i]
+			}
+			if v[i] > max[i] {
+				max[i] = v[i]
+			}
+		}
+	}
+	b := colorBox{colors: colors}
+	for i := range min {
+		if w := int(max[i]) - int(min[i]); w > b.width {
+			b.channel, b.width = i, w
+		}
+	}
+	return b
+}
+
+// colorSum sums colors weighted by the pixel count.
+type colorSum struct {
+	r, g, b, a, total int
+}
+
+func (s *colorSum) add(c color.NRGBA, count int) {
+	s.r += int(c.R) * count
+	s.g += int(c.G) * count
+	s.b += int(c.B) * count
+	s.a += int(c.A) * count
+	s.total += count
+}
+
+func (s *colorSum) average() color.NRGBA {
+	return color.NRGBA{
+		uint8((s.r + s.total/2) / s.total),
+		uint8((s.g + s.total/2) / s.total),
+		uint8((s.b + s.total/2) / s.total),
+		uint8((s.a + s.total/2) / s.total),
+	}
+}
+
+func channelValue(c color.NRGBA, channel int) uint8 {
+	switch channel {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	case 2:
+		return c.B
+	default:
+		return c.A
+	}
+}
+
+// medianCut splits the colors of hist into n boxes.
+func medianCut(hist map[color.NRGBA]int, n int) []colorBox {
+	all := make([]colorCount, 0, len(hist))
+	for c, count := range hist {
+		all = append(all, colorCount{c, count})
+	}
+
+	boxes := []colorBox{newColorBox(all)}
+	for len(boxes) < n {
+		// split the box with the widest channel range
+		split := -1
+		for i, b := range boxes {
+			if len(b.colors) > 1 && (split < 0 || b.width > boxes[split].width) {
+				split = i
+			}
+		}
+		if split < 0 {
+			break
+		}
+		b := boxes[split]
+		colors := b.colors
+		sort.Slice(colors, func(i, j int) bool {
+			vi, vj := channelValue(colors[i].c, b.channel), channelValue(colors[j].c, b.channel)
+			if vi == vj {
+				return colorLess(colors[i].c, colors[j].c)
+			}
+			return vi < vj
+		})
+		total := 0
+		for _, cc := range colors {
+			total += cc.count
+		}
+		// split at the median pixel, but keep at least one color per box
+		median, sum := len(colors)-1, 0
+		for i, cc := range colors[:len(colors)-1] {
+			sum += cc.count
+			if sum*2 >= total {
+				median = i + 1
+				break
+			}
+		}
+		boxes[split] = newColorBox(colors[:median])
+		boxes = append(boxes, newColorBox(colors[median:]))
+	}
+	return boxes
+}
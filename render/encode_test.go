@@ -0,0 +1,96 @@
+package render
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestQuantizeLossless(t *testing.T) {
+	palette := []color.NRGBA{
+		{0x46, 0x82, 0xb4, 0xff},
+		{0xff, 0x00, 0x00, 0x80},
+		{0x00, 0x00, 0x00, 0x00},
+	}
+	img := filledImage(64, 64, func(x, y int) color.NRGBA { return palette[(x+y)%len(palette)] })
+
+	q := Quantize(img, 256)
+	if len(q.Palette) != 3 {
+		t.Fatal("unexpected palette", q.Palette)
+	}
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if c := color.NRGBAModel.Convert(q.At(x, y)); c != img.At(x, y) {
+				t.Fatal("unexpected color", x, y, c)
+			}
+		}
+	}
+}
+
+func TestQuantizeMedianCut(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	img := filledImage(128, 128, func(x, y int) color.NRGBA {
+		return color.NRGBA{uint8(x * 2), uint8(y * 2), uint8(rnd.Intn(256)), 255}
+	})
+
+	q := Quantize(img, 16)
+	if len(q.Palette) != 16 {
+		t.Fatal("unexpected palette size", len(q.Palette))
+	}
+	// colors should stay close to the original
+	var diff int
+	for y := 0; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			c := color.NRGBAModel.Convert(q.At(x, y)).(color.NRGBA)
+			o := img.NRGBAAt(x, y)
+			diff += abs(int(c.R)-int(o.R)) + abs(int(c.G)-int(o.G))
+		}
+	}
+	if avg := diff / (128 * 128); avg > 64 {
+		t.Error("average difference too large", avg)
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func TestPNGPool(t *testing.T) {
+	img := filledImage(256, 256, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), 0, 255} })
+
+	for _, colors := range []int{0, 256} {
+		pool := NewPNGPool(2, colors)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				buf := &bytes.Buffer{}
+				if err := pool.Encode(buf, img); err != nil {
+					t.Error(err)
+					return
+				}
+				dec, err := png.Decode(buf)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if colors > 0 {
+					if _, ok := dec.(*image.Paletted); !ok {
+						t.Errorf("expected paletted image, got %T", dec)
+					}
+				} else if c := color.NRGBAModel.Convert(dec.At(10, 20)); c != img.At(10, 20) {
+					t.Error("unexpected color", c)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
@@ -0,0 +1,28 @@
+package render
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrAVIFUnsupported is returned for requests of AVIF images. Neither Mapnik
+// nor MapServer are able to encode AVIF and there is no pure-Go encoder.
+var ErrAVIFUnsupported = errors.New("AVIF encoding is not supported")
+
+// ErrMapnikUnavailable is returned by Mapnik if magnacarto was built
+// without Mapnik.
+var ErrMapnikUnavailable = errors.New("magnacarto was built without Mapnik")
+
+// ErrGridUnsupported is returned for UTFGrid requests of renderers other than
+// Mapnik.
+var ErrGridUnsupported = errors.New("UTFGrid is only supported by Mapnik")
+
+func isWebP(format string) bool {
+	format = strings.ToLower(format)
+	return format == "webp" || format == "image/webp"
+}
+
+func isAVIF(format string) bool {
+	format = strings.ToLower(format)
+	return format == "avif" || format == "image/avif"
+}
@@ -1,33 +1,204 @@
+//go:build cgo && !nomapnik
+// +build cgo,!nomapnik
+
 package render
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-
-	"path/filepath"
+	"image"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/omniscale/go-mapnik"
+	"github.com/omniscale/magnacarto/config"
 )
 
+// MapnikAvailable is false if magnacarto was built without Mapnik (with
+// CGO_ENABLED=0 or with the nomapnik build tag).
+const MapnikAvailable = true
+
+// RegisterMapnik registers the plugin and font directories from the
+// configuration with Mapnik. Font directories are scanned recursively.
+func RegisterMapnik(conf config.Mapnik) error {
+	for _, dir := range conf.PluginDirs {
+		if err := mapnik.RegisterDatasources(dir); err != nil {
+			return err
+		}
+	}
+	for _, dir := range conf.FontDirs {
+		if err := mapnik.RegisterFontsRecursive(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func Mapnik(mapfile string, mapReq Request) ([]byte, error) {
-	style := filepath.Base(mapfile)
-	style = style[:len(style)-len(filepath.Ext(style))] // wihout suffix
+	return MapnikContext(context.Background(), mapfile, mapReq)
+}
+
+// MapnikContext is like Mapnik, but returns the error of ctx if ctx is done
+// before the map is rendered. The render is not interrupted, but its result
+// is discarded.
+func MapnikContext(ctx context.Context, mapfile string, mapReq Request) ([]byte, error) {
+	if mapReq.Grid == nil && isAVIF(mapReq.Format) {
+		return nil, ErrAVIFUnsupported
+	}
 
 	m := mapnik.New()
-	err := m.Load(mapfile)
-	if err != nil {
+	if err := m.Load(mapfile); err != nil {
+		m.Free()
 		return nil, err
 	}
+	b, err := renderMapnik(ctx, m, mapReq)
+	if m.Busy() {
+		// free after the cancelled render
+		go m.Free()
+	} else {
+		m.Free()
+	}
+	return b, err
+}
 
+// renderMapnik renders mapReq with the loaded map m.
+func renderMapnik(ctx context.Context, m *mapnik.Map, mapReq Request) ([]byte, error) {
 	m.Resize(mapReq.Width, mapReq.Height)
 	m.SetSRS(fmt.Sprintf("+init=epsg:%d", mapReq.EPSGCode))
 	m.ZoomTo(mapReq.BBOX[0], mapReq.BBOX[1], mapReq.BBOX[2], mapReq.BBOX[3])
 
+	if mapReq.Grid != nil {
+		g, err := m.RenderGridContext(ctx, mapReq.Grid.Layer, mapnik.GridOpts{
+			Fields:      mapReq.Grid.Fields,
+			Resolution:  mapReq.Grid.Resolution,
+			ScaleFactor: mapReq.ScaleFactor,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return g.UTFGrid()
+	}
+
 	renderOpts := mapnik.RenderOpts{}
 	renderOpts.Format = mapReq.Format
+	renderOpts.ScaleFactor = mapReq.ScaleFactor
 
-	b, err := m.Render(renderOpts)
+	encoder := mapReq.Encoder
+	if encoder == nil && isWebP(mapReq.Format) {
+		if mapnikSupportsWebP() {
+			renderOpts.Format = "webp"
+		} else {
+			encoder = WebPEncoder{}
+		}
+	}
+	if encoder != nil {
+		img, err := m.RenderImageContext(ctx, renderOpts)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.Buffer{}
+		if err := encoder.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	b, err := m.RenderContext(ctx, renderOpts)
 	if err != nil {
 		return nil, err
 	}
 	return b, nil
 }
+
+// mapnikRenderer renders with the maps of the last maxStyles styles.
+type mapnikRenderer struct {
+	maxStyles int
+	// maps in the order of their last use
+	maps []loadedMap
+}
+
+type loadedMap struct {
+	style   string
+	modTime time.Time
+	m       *mapnik.Map
+}
+
+func newMapnikRenderer(maxStyles int) workerRenderer {
+	return &mapnikRenderer{maxStyles: maxStyles}
+}
+
+func (r *mapnikRenderer) render(ctx context.Context, style string, req Request) ([]byte, error) {
+	if req.Grid == nil && isAVIF(req.Format) {
+		return nil, ErrAVIFUnsupported
+	}
+	m, err := r.load(style)
+	if err != nil {
+		return nil, err
+	}
+	return renderMapnik(ctx, m, req)
+}
+
+func (r *mapnikRenderer) busy() bool {
+	for _, l := range r.maps {
+		if l.m.Busy() {
+			return true
+		}
+	}
+	return false
+}
+
+// load returns the map of style. Maps are reloaded if the style changed.
+func (r *mapnikRenderer) load(style string) (*mapnik.Map, error) {
+	fi, err := os.Stat(style)
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range r.maps {
+		if l.style != style {
+			continue
+		}
+		r.maps = append(r.maps[:i], r.maps[i+1:]...)
+		if l.modTime.Equal(fi.ModTime()) {
+			r.maps = append(r.maps, l)
+			return l.m, nil
+		}
+		l.m.Free()
+		break
+	}
+
+	m := mapnik.New()
+	if err := m.Load(style); err != nil {
+		m.Free()
+		return nil, err
+	}
+	if len(r.maps) >= r.maxStyles {
+		r.maps[0].m.Free()
+		r.maps = r.maps[1:]
+	}
+	r.maps = append(r.maps, loadedMap{style: style, modTime: fi.ModTime(), m: m})
+	return m, nil
+}
+
+func (r *mapnikRenderer) free() {
+	for _, l := range r.maps {
+		l.m.Free()
+	}
+	r.maps = nil
+}
+
+var (
+	mapnikWebPOnce sync.Once
+	mapnikWebP     bool
+)
+
+// mapnikSupportsWebP checks whether Mapnik was compiled with WebP support.
+func mapnikSupportsWebP() bool {
+	mapnikWebPOnce.Do(func() {
+		img := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+		_, err := mapnik.Encode(img, "webp")
+		mapnikWebP = err == nil
+	})
+	return mapnikWebP
+}
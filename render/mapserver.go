@@ -3,6 +3,7 @@ package render
 import (
 	"bytes"
 	"fmt"
+	"image/png"
 	"net/http"
 	"net/http/cgi"
 	"net/http/httptest"
@@ -13,6 +14,35 @@ import (
 )
 
 func MapServer(bin, mapfile string, mapReq Request) ([]byte, error) {
+	if mapReq.Grid != nil {
+		return nil, ErrGridUnsupported
+	}
+	if isAVIF(mapReq.Format) {
+		return nil, ErrAVIFUnsupported
+	}
+	encoder := mapReq.Encoder
+	if encoder == nil && isWebP(mapReq.Format) {
+		// MapServer needs an explicit OUTPUTFORMAT for WebP, convert PNG instead
+		encoder = WebPEncoder{}
+	}
+	if encoder != nil {
+		mapReq.Format = "image/png"
+		mapReq.Encoder = nil
+		b, err := MapServer(bin, mapfile, mapReq)
+		if err != nil {
+			return nil, err
+		}
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.Buffer{}
+		if err := encoder.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
 	if !filepath.IsAbs(mapfile) {
 		if wd, err := os.Getwd(); err == nil {
 			mapfile = filepath.Join(wd, mapfile)
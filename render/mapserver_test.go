@@ -0,0 +1,52 @@
+package render
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestMapServerRelativeMapfile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires sh")
+	}
+	dir, err := ioutil.TempDir("", "render_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fake mapserv that returns its query string
+	bin := filepath.Join(dir, "mapserv")
+	script := "#!/bin/sh\nprintf 'Content-Type: image/png\\r\\n\\r\\n'\nprintf '%s' \"$QUERY_STRING\"\n"
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapfile := filepath.Join(dir, "style.map")
+	rel, err := filepath.Rel(wd, mapfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := MapServer(bin, rel, Request{
+		Width: 10, Height: 10, BBOX: [4]float64{0, 0, 1, 1}, EPSGCode: 3857, Format: "image/png",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := url.ParseQuery(string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mapserv runs in the dir of the mapfile, the path needs to be absolute
+	if q.Get("MAP") != mapfile {
+		t.Errorf("unexpected MAP %q, expected %q", q.Get("MAP"), mapfile)
+	}
+}
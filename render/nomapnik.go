@@ -0,0 +1,41 @@
+//go:build !cgo || nomapnik
+// +build !cgo nomapnik
+
+package render
+
+import (
+	"context"
+
+	"github.com/omniscale/magnacarto/config"
+)
+
+// MapnikAvailable is false if magnacarto was built without Mapnik (with
+// CGO_ENABLED=0 or with the nomapnik build tag).
+const MapnikAvailable = false
+
+// RegisterMapnik does nothing without Mapnik.
+func RegisterMapnik(conf config.Mapnik) error {
+	return nil
+}
+
+// Mapnik returns ErrMapnikUnavailable without Mapnik.
+func Mapnik(mapfile string, mapReq Request) ([]byte, error) {
+	return nil, ErrMapnikUnavailable
+}
+
+// MapnikContext returns ErrMapnikUnavailable without Mapnik.
+func MapnikContext(ctx context.Context, mapfile string, mapReq Request) ([]byte, error) {
+	return nil, ErrMapnikUnavailable
+}
+
+type unavailableRenderer struct{}
+
+func (unavailableRenderer) render(ctx context.Context, style string, req Request) ([]byte, error) {
+	return nil, ErrMapnikUnavailable
+}
+func (unavailableRenderer) busy() bool { return false }
+func (unavailableRenderer) free()      {}
+
+func newMapnikRenderer(maxStyles int) workerRenderer {
+	return unavailableRenderer{}
+}
@@ -0,0 +1,54 @@
+package render
+
+import (
+	"bytes"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"github.com/omniscale/magnacarto/preview"
+)
+
+// Preview renders a style of builder/preview with the pure-Go renderer. The
+// result is only an approximation of Mapnik and MapServer and the image
+// contains a watermark.
+func Preview(stylefile string, mapReq Request) ([]byte, error) {
+	if mapReq.Grid != nil {
+		return nil, ErrGridUnsupported
+	}
+	if isAVIF(mapReq.Format) {
+		return nil, ErrAVIFUnsupported
+	}
+	style, err := preview.Load(stylefile)
+	if err != nil {
+		return nil, err
+	}
+	img, err := preview.Render(style, preview.Request{
+		Width:       mapReq.Width,
+		Height:      mapReq.Height,
+		BBOX:        mapReq.BBOX,
+		EPSGCode:    mapReq.EPSGCode,
+		ScaleFactor: mapReq.ScaleFactor,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.Buffer{}
+	encoder := mapReq.Encoder
+	if encoder == nil && isWebP(mapReq.Format) {
+		encoder = WebPEncoder{}
+	}
+	switch {
+	case encoder != nil:
+		err = encoder.Encode(&buf, img)
+	case strings.Contains(strings.ToLower(mapReq.Format), "jpeg"):
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
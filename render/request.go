@@ -6,4 +6,22 @@ type Request struct {
 	BBOX     [4]float64
 	EPSGCode int
 	Format   string
+	// ScaleFactor scales all sizes of the style, e.g. for print resolutions
+	// (Mapnik only).
+	ScaleFactor float64
+	// Encoder encodes the rendered image, instead of the encoder of the
+	// renderer. Format is ignored if Encoder is set.
+	Encoder Encoder
+	// Grid renders the UTFGrid of a single layer instead of an image
+	// (Mapnik only). Format and Encoder are ignored.
+	Grid *GridRequest
+}
+
+// GridRequest are the options of an UTFGrid.
+type GridRequest struct {
+	Layer string
+	// Fields are the feature attributes included in the UTFGrid.
+	Fields []string
+	// Resolution is the size of each grid cell in pixels. Defaults to 4.
+	Resolution int
 }
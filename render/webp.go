@@ -0,0 +1,431 @@
+package render
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"math/bits"
+)
+
+// EncodeWebP writes img as lossless WebP (VP8L) to w.
+//
+// This is a simple pure-Go encoder used when Mapnik is compiled without
+// WebP support. It only uses prefix coding and backward references to the
+// left and upper pixels (no transforms and no color cache), which is
+// sufficient for map tiles with large uniform areas.
+func EncodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return errors.New("webp: invalid image size")
+	}
+
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(nrgba, nrgba.Rect, img, b.Min, draw.Src)
+	}
+
+	argb := make([]uint32, 0, width*height)
+	hasAlpha := false
+	for y := 0; y < height; y++ {
+		row := nrgba.Pix[nrgba.PixOffset(nrgba.Rect.Min.X, nrgba.Rect.Min.Y+y):]
+		for x := 0; x < width; x++ {
+			p := row[x*4 : x*4+4]
+			if p[3] != 0xff {
+				hasAlpha = true
+			}
+			argb = append(argb, uint32(p[3])<<24|uint32(p[0])<<16|uint32(p[1])<<8|uint32(p[2]))
+		}
+	}
+
+	bw := &bitWriter{}
+	bw.writeBits(0x2f, 8) // VP8L signature
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3) // version
+	bw.writeBits(0, 1) // no transform
+	bw.writeBits(0, 1) // no color cache
+	bw.writeBits(0, 1) // no meta prefix codes
+
+	writeVP8LImage(bw, argb, width)
+	data := bw.flush()
+
+	chunkSize := len(data)
+	riffSize := 4 + 8 + chunkSize + chunkSize&1
+	hdr := make([]byte, 20)
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(riffSize))
+	copy(hdr[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(chunkSize))
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	if chunkSize&1 == 1 {
+		data = append(data, 0)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+const (
+	vp8lNumLiterals     = 256
+	vp8lNumLengthCodes  = 24
+	vp8lNumDistanceCode = 40
+	vp8lMaxLength       = 4096
+	vp8lMinLength       = 3
+
+	// distance codes of the first two entries of the VP8L distance map
+	vp8lDistCodeUp   = 1
+	vp8lDistCodeLeft = 2
+)
+
+type vp8lToken struct {
+	argb     uint32
+	length   int // 0 for literals
+	distCode int
+}
+
+func writeVP8LImage(bw *bitWriter, argb []uint32, width int) {
+	tokens := vp8lTokens(argb, width)
+
+	green := make([]int, vp8lNumLiterals+vp8lNumLengthCodes)
+	red := make([]int, vp8lNumLiterals)
+	blue := make([]int, vp8lNumLiterals)
+	alpha := make([]int, vp8lNumLiterals)
+	dist := make([]int, vp8lNumDistanceCode)
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[(t.argb>>8)&0xff]++
+			red[(t.argb>>16)&0xff]++
+			blue[t.argb&0xff]++
+			alpha[t.argb>>24]++
+		} else {
+			code, _, _ := prefixEncode(t.length)
+			green[vp8lNumLiterals+code]++
+			code, _, _ = prefixEncode(t.distCode)
+			dist[code]++
+		}
+	}
+
+	greenCode := writeHuffmanCode(bw, green)
+	redCode := writeHuffmanCode(bw, red)
+	blueCode := writeHuffmanCode(bw, blue)
+	alphaCode := writeHuffmanCode(bw, alpha)
+	distCode := writeHuffmanCode(bw, dist)
+
+	for _, t := range tokens {
+		if t.length == 0 {
+			greenCode.write(bw, int((t.argb>>8)&0xff))
+			redCode.write(bw, int((t.argb>>16)&0xff))
+			blueCode.write(bw, int(t.argb&0xff))
+			alphaCode.write(bw, int(t.argb>>24))
+		} else {
+			code, n, extra := prefixEncode(t.length)
+			greenCode.write(bw, vp8lNumLiterals+code)
+			bw.writeBits(uint32(extra), n)
+			code, n, extra = prefixEncode(t.distCode)
+			distCode.write(bw, code)
+			bw.writeBits(uint32(extra), n)
+		}
+	}
+}
+
+// vp8lTokens splits argb into literals and backward references to runs of
+// the left or upper pixel.
+func vp8lTokens(argb []uint32, width int) []vp8lToken {
+	tokens := make([]vp8lToken, 0, len(argb)/4)
+	for i := 0; i < len(argb); {
+		length, distCode := 0, 0
+		if i > 0 {
+			length = matchLength(argb, i, i-1)
+			distCode = vp8lDistCodeLeft
+		}
+		if i >= width {
+			if l := matchLength(argb, i, i-width); l > length {
+				length = l
+				distCode = vp8lDistCodeUp
+			}
+		}
+		if length >= vp8lMinLength {
+			tokens = append(tokens, vp8lToken{length: length, distCode: distCode})
+			i += length
+		} else {
+			tokens = append(tokens, vp8lToken{argb: argb[i]})
+			i++
+		}
+	}
+	return tokens
+}
+
+func matchLength(argb []uint32, i, ref int) int {
+	n := 0
+	for i+n < len(argb) && n < vp8lMaxLength && argb[i+n] == argb[ref+n] {
+		n++
+	}
+	return n
+}
+
+// prefixEncode returns the prefix code and the extra bits for the
+// length or distance code v (>= 1).
+func prefixEncode(v int) (code int, nExtra uint, extra int) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := bits.Len(uint(d)) - 1
+	s := (d >> uint(h-1)) & 1
+	return 2*h + s, uint(h - 1), d & (1<<uint(h-1) - 1)
+}
+
+// huffmanCode contains the bit-reversed codes and lengths of all symbols.
+type huffmanCode struct {
+	codes []uint16
+	lens  []uint8
+}
+
+func (h huffmanCode) write(bw *bitWriter, symbol int) {
+	bw.writeBits(uint32(h.codes[symbol]), uint(h.lens[symbol]))
+}
+
+var codeLengthCodeOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// writeHuffmanCode writes the prefix code for the symbol frequencies freq and
+// returns the code.
+func writeHuffmanCode(bw *bitWriter, freq []int) huffmanCode {
+	var used []int
+	for s, f := range freq {
+		if f > 0 {
+			used = append(used, s)
+		}
+	}
+
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		// simple code. empty codes are written as single symbol 0
+		if len(used) == 0 {
+			used = []int{0}
+		}
+		bw.writeBits(1, 1)
+		bw.writeBits(uint32(len(used)-1), 1)
+		if used[0] < 2 {
+			bw.writeBits(0, 1)
+			bw.writeBits(uint32(used[0]), 1)
+		} else {
+			bw.writeBits(1, 1)
+			bw.writeBits(uint32(used[0]), 8)
+		}
+		lens := make([]uint8, len(freq))
+		if len(used) == 2 {
+			bw.writeBits(uint32(used[1]), 8)
+			lens[used[0]] = 1
+			lens[used[1]] = 1
+		}
+		return canonicalCode(lens)
+	}
+
+	lens := huffmanLengths(freq, 15)
+
+	// code lengths with zero runs
+	type clToken struct{ sym, extra int }
+	var clTokens []clToken
+	clFreq := make([]int, 19)
+	for i := 0; i < len(lens); {
+		if lens[i] == 0 {
+			run := 1
+			for i+run < len(lens) && lens[i+run] == 0 && run < 138 {
+				run++
+			}
+			if run >= 11 {
+				clTokens = append(clTokens, clToken{18, run - 11})
+				clFreq[18]++
+				i += run
+				continue
+			} else if run >= 3 {
+				clTokens = append(clTokens, clToken{17, run - 3})
+				clFreq[17]++
+				i += run
+				continue
+			}
+		}
+		clTokens = append(clTokens, clToken{int(lens[i]), 0})
+		clFreq[lens[i]]++
+		i++
+	}
+
+	clLens := huffmanLengths(clFreq, 7)
+	clCode := canonicalCode(clLens)
+
+	numCodes := 4
+	for i := range codeLengthCodeOrder {
+		if clLens[codeLengthCodeOrder[i]] != 0 && i+1 > numCodes {
+			numCodes = i + 1
+		}
+	}
+	bw.writeBits(0, 1) // normal code
+	bw.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		bw.writeBits(uint32(clLens[codeLengthCodeOrder[i]]), 3)
+	}
+	bw.writeBits(0, 1) // max_symbol is alphabet size
+	for _, t := range clTokens {
+		clCode.write(bw, t.sym)
+		switch t.sym {
+		case 17:
+			bw.writeBits(uint32(t.extra), 3)
+		case 18:
+			bw.writeBits(uint32(t.extra), 7)
+		}
+	}
+	return canonicalCode(lens)
+}
+
+// canonicalCode assigns canonical codes to the code lengths. Codes with a
+// single symbol are encoded with zero bits.
+func canonicalCode(lens []uint8) huffmanCode {
+	h := huffmanCode{
+		codes: make([]uint16, len(lens)),
+		lens:  make([]uint8, len(lens)),
+	}
+	var count [16]int
+	used := 0
+	for _, l := range lens {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used <= 1 {
+		return h
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	for s, l := range lens {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		h.codes[s] = uint16(bits.Reverse16(uint16(c)) >> (16 - l))
+		h.lens[s] = l
+	}
+	return h
+}
+
+type huffmanNode struct {
+	freq   int
+	symbol int // -1 for inner nodes
+	left   *huffmanNode
+	right  *huffmanNode
+}
+
+type huffmanHeap []*huffmanNode
+
+func (h huffmanHeap) Len() int { return len(h) }
+func (h huffmanHeap) Less(i, j int) bool {
+	if h[i].freq == h[j].freq {
+		return h[i].symbol < h[j].symbol
+	}
+	return h[i].freq < h[j].freq
+}
+func (h huffmanHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *huffmanHeap) Push(x interface{}) { *h = append(*h, x.(*huffmanNode)) }
+func (h *huffmanHeap) Pop() interface{} {
+	old := *h
+	n := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return n
+}
+
+// huffmanLengths returns the code lengths for freq, limited to maxLen.
+// The frequencies are flattened till the code fits into maxLen.
+func huffmanLengths(freq []int, maxLen int) []uint8 {
+	freq = append([]int(nil), freq...)
+	for {
+		lens, ok := buildHuffmanLengths(freq, maxLen)
+		if ok {
+			return lens
+		}
+		for i, f := range freq {
+			if f > 0 {
+				freq[i] = (f + 1) / 2
+			}
+		}
+	}
+}
+
+func buildHuffmanLengths(freq []int, maxLen int) ([]uint8, bool) {
+	lens := make([]uint8, len(freq))
+	h := &huffmanHeap{}
+	for s, f := range freq {
+		if f > 0 {
+			*h = append(*h, &huffmanNode{freq: f, symbol: s})
+		}
+	}
+	if h.Len() == 0 {
+		return lens, true
+	}
+	if h.Len() == 1 {
+		lens[(*h)[0].symbol] = 1
+		return lens, true
+	}
+	heap.Init(h)
+	for h.Len() > 1 {
+		a := heap.Pop(h).(*huffmanNode)
+		b := heap.Pop(h).(*huffmanNode)
+		heap.Push(h, &huffmanNode{freq: a.freq + b.freq, symbol: -1, left: a, right: b})
+	}
+
+	ok := true
+	var walk func(n *huffmanNode, depth int)
+	walk = func(n *huffmanNode, depth int) {
+		if n.symbol >= 0 {
+			if depth > maxLen {
+				ok = false
+			}
+			lens[n.symbol] = uint8(depth)
+			return
+		}
+		walk(n.left, depth+1)
+		walk(n.right, depth+1)
+	}
+	walk((*h)[0], 0)
+	return lens, ok
+}
+
+// bitWriter writes bits LSB first, as required by VP8L.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	w.acc |= uint64(v) << w.nacc
+	w.nacc += n
+	for w.nacc >= 8 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc >>= 8
+		w.nacc -= 8
+	}
+}
+
+func (w *bitWriter) flush() []byte {
+	if w.nacc > 0 {
+		w.buf = append(w.buf, byte(w.acc))
+		w.acc = 0
+		w.nacc = 0
+	}
+	return w.buf
+}
@@ -0,0 +1,125 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebP(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	palette := []color.NRGBA{
+		{0x46, 0x82, 0xb4, 0xff},
+		{0xff, 0x00, 0x00, 0x80},
+		{0x00, 0xaa, 0x00, 0xff},
+		{0x00, 0x00, 0x00, 0x00},
+	}
+
+	tests := []struct {
+		name string
+		img  *image.NRGBA
+	}{
+		{"uniform", filledImage(256, 256, func(x, y int) color.NRGBA { return palette[0] })},
+		{"single pixel", filledImage(1, 1, func(x, y int) color.NRGBA { return palette[1] })},
+		{"stripes", filledImage(100, 37, func(x, y int) color.NRGBA { return palette[(x/7+y/3)%len(palette)] })},
+		{"noise", filledImage(64, 64, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))}
+		})},
+		{"noisy palette", filledImage(256, 256, func(x, y int) color.NRGBA {
+			if rnd.Intn(10) == 0 {
+				return palette[rnd.Intn(len(palette))]
+			}
+			return palette[(x/50)%len(palette)]
+		})},
+	}
+
+	for _, tc := range tests {
+		buf := &bytes.Buffer{}
+		if err := EncodeWebP(buf, tc.img); err != nil {
+			t.Fatal(tc.name, err)
+		}
+		img, err := decodeTestWebP(buf.Bytes())
+		if err != nil {
+			t.Fatal(tc.name, err)
+		}
+		if img.Rect != tc.img.Rect {
+			t.Fatal(tc.name, "unexpected size", img.Rect)
+		}
+		if !bytes.Equal(img.Pix, tc.img.Pix) {
+			t.Error(tc.name, "decoded image differs")
+		}
+	}
+}
+
+func TestEncodeWebPSubImage(t *testing.T) {
+	src := filledImage(20, 20, func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), 0, 255} })
+	sub := src.SubImage(image.Rect(5, 5, 15, 12)).(*image.NRGBA)
+
+	buf := &bytes.Buffer{}
+	if err := EncodeWebP(buf, sub); err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodeTestWebP(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Rect.Dx() != 10 || img.Rect.Dy() != 7 {
+		t.Fatal("unexpected size", img.Rect)
+	}
+	if c := img.NRGBAAt(0, 0); c != (color.NRGBA{5, 5, 0, 255}) {
+		t.Error("unexpected color", c)
+	}
+	if c := img.NRGBAAt(9, 6); c != (color.NRGBA{14, 11, 0, 255}) {
+		t.Error("unexpected color", c)
+	}
+}
+
+func TestPrefixEncode(t *testing.T) {
+	for v := 1; v <= 4096; v++ {
+		code, nExtra, extra := prefixEncode(v)
+		// decoding as described in the VP8L spec
+		var got int
+		if code < 4 {
+			got = code + 1
+		} else {
+			extraBits := uint(code-2) >> 1
+			if extraBits != nExtra {
+				t.Fatal("unexpected extra bits for", v)
+			}
+			offset := (2 + code&1) << extraBits
+			got = offset + extra + 1
+		}
+		if got != v {
+			t.Fatal("prefix encoding of", v, "decodes to", got)
+		}
+	}
+}
+
+func filledImage(w, h int, f func(x, y int) color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, f(x, y))
+		}
+	}
+	return img
+}
+
+// decodeTestWebP decodes b with the WebP decoder of golang.org/x/image, so
+// that EncodeWebP is checked against an independent implementation.
+func decodeTestWebP(b []byte) (*image.NRGBA, error) {
+	img, err := webp.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		return nil, fmt.Errorf("decoded %T, expected lossless *image.NRGBA", img)
+	}
+	return nrgba, nil
+}
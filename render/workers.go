@@ -0,0 +1,199 @@
+package render
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrQueueFull is returned by Workers.Render if all workers are busy and the
+// queue is full.
+var ErrQueueFull = errors.New("render queue is full")
+
+// ErrWorkersClosed is returned by Workers.Render after Close.
+var ErrWorkersClosed = errors.New("render workers are closed")
+
+// WorkerOptions configure Workers.
+type WorkerOptions struct {
+	// Workers is the number of concurrent renderers. Defaults to the
+	// number of CPUs.
+	Workers int
+	// Queue is the number of requests that wait for a free worker.
+	// Additional requests fail with ErrQueueFull. Requests wait without
+	// limit if Queue is 0.
+	Queue int
+	// Timeout of each request, including the time in the queue. No
+	// timeout if 0.
+	Timeout time.Duration
+	// MaxStyles is the number of styles that each worker keeps loaded.
+	// Defaults to 4.
+	MaxStyles int
+}
+
+// workerRenderer renders maps for a single worker. It is only used by one
+// goroutine at a time and can keep state (e.g. loaded styles) between
+// requests.
+type workerRenderer interface {
+	// render returns the error of ctx if ctx is done before the map is
+	// rendered.
+	render(ctx context.Context, style string, req Request) ([]byte, error)
+	// busy returns whether a cancelled render still runs in the
+	// background.
+	busy() bool
+	// free frees all resources, after all background renders finished.
+	free()
+}
+
+// Workers render maps with a fixed number of workers. Each worker has its own
+// renderer, as Mapnik maps are not safe for concurrent use. Workers keep the
+// last styles loaded, so that styles are not parsed for each request.
+// Workers are safe for concurrent use.
+//
+// Mapnik renders can not be interrupted. A worker continues with a new
+// renderer if a request is cancelled or times out during the render, and the
+// old renderer is freed when its render finished. The number of these
+// abandoned renders is limited to the number of workers, workers wait for
+// their render if the limit is reached.
+type Workers struct {
+	jobs        chan *renderJob
+	admit       chan struct{}
+	abandoned   chan struct{}
+	newRenderer func() workerRenderer
+	timeout     time.Duration
+	closed      chan struct{}
+	closing     sync.Once
+	wg          sync.WaitGroup
+}
+
+type renderJob struct {
+	ctx    context.Context
+	style  string
+	req    Request
+	result chan renderResult
+}
+
+type renderResult struct {
+	b   []byte
+	err error
+}
+
+// NewMapnikWorkers starts Workers that render Mapnik styles. Requests fail
+// with ErrMapnikUnavailable if magnacarto was built without Mapnik.
+func NewMapnikWorkers(opts WorkerOptions) *Workers {
+	maxStyles := opts.MaxStyles
+	if maxStyles <= 0 {
+		maxStyles = 4
+	}
+	return newWorkers(opts, func() workerRenderer {
+		return newMapnikRenderer(maxStyles)
+	})
+}
+
+func newWorkers(opts WorkerOptions, newRenderer func() workerRenderer) *Workers {
+	n := opts.Workers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	w := &Workers{
+		jobs:        make(chan *renderJob),
+		abandoned:   make(chan struct{}, n),
+		newRenderer: newRenderer,
+		timeout:     opts.Timeout,
+		closed:      make(chan struct{}),
+	}
+	if opts.Queue > 0 {
+		w.admit = make(chan struct{}, n+opts.Queue)
+	}
+	for i := 0; i < n; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	return w
+}
+
+// Render renders the map of style. Render returns the error of ctx if ctx is
+// done before the map is rendered. Requests that are cancelled while they
+// wait in the queue are not rendered. A running render is not interrupted,
+// but its result is discarded.
+func (w *Workers) Render(ctx context.Context, style string, req Request) ([]byte, error) {
+	select {
+	case <-w.closed:
+		return nil, ErrWorkersClosed
+	default:
+	}
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.timeout)
+		defer cancel()
+	}
+	if w.admit != nil {
+		select {
+		case w.admit <- struct{}{}:
+			defer func() { <-w.admit }()
+		default:
+			return nil, ErrQueueFull
+		}
+	}
+
+	j := &renderJob{ctx: ctx, style: style, req: req, result: make(chan renderResult, 1)}
+	select {
+	case w.jobs <- j:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-w.closed:
+		return nil, ErrWorkersClosed
+	}
+	select {
+	case r := <-j.result:
+		return r.b, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (w *Workers) work() {
+	defer w.wg.Done()
+	r := w.newRenderer()
+	defer func() { r.free() }()
+	for {
+		select {
+		case j := <-w.jobs:
+			if j.ctx.Err() != nil {
+				// cancelled before the worker was free
+				j.result <- renderResult{err: j.ctx.Err()}
+				continue
+			}
+			b, err := r.render(j.ctx, j.style, j.req)
+			j.result <- renderResult{b: b, err: err}
+			if r.busy() {
+				w.abandon(r)
+				r = w.newRenderer()
+			}
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+// abandon frees r in the background after its cancelled render finished.
+// Waits for the render if there are too many abandoned renders.
+func (w *Workers) abandon(r workerRenderer) {
+	select {
+	case w.abandoned <- struct{}{}:
+		go func() {
+			r.free()
+			<-w.abandoned
+		}()
+	default:
+		r.free()
+	}
+}
+
+// Close stops all workers after their current request and frees all loaded
+// styles.
+func (w *Workers) Close() {
+	w.closing.Do(func() { close(w.closed) })
+	w.wg.Wait()
+}
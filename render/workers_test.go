@@ -0,0 +1,195 @@
+package render
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRenderer returns the style name and blocks until release is closed.
+type testRenderer struct {
+	mu      *sync.Mutex
+	active  *int
+	max     *int
+	release chan struct{}
+	freed   *int
+}
+
+func (r testRenderer) render(ctx context.Context, style string, req Request) ([]byte, error) {
+	r.mu.Lock()
+	*r.active++
+	if *r.active > *r.max {
+		*r.max = *r.active
+	}
+	r.mu.Unlock()
+	<-r.release
+	r.mu.Lock()
+	*r.active--
+	r.mu.Unlock()
+	return []byte(style), nil
+}
+
+func (r testRenderer) busy() bool { return false }
+
+func (r testRenderer) free() {
+	r.mu.Lock()
+	*r.freed++
+	r.mu.Unlock()
+}
+
+func newTestWorkers(opts WorkerOptions) (*Workers, testRenderer) {
+	r := testRenderer{mu: &sync.Mutex{}, active: new(int), max: new(int), freed: new(int), release: make(chan struct{})}
+	return newWorkers(opts, func() workerRenderer { return r }), r
+}
+
+func TestWorkers(t *testing.T) {
+	w, r := newTestWorkers(WorkerOptions{Workers: 2})
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := w.Render(context.Background(), "style.xml", Request{})
+			if err != nil || string(b) != "style.xml" {
+				t.Error("unexpected result", string(b), err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(r.release)
+	wg.Wait()
+	if *r.max != 2 {
+		t.Error("expected two concurrent renders, got", *r.max)
+	}
+
+	w.Close()
+	if *r.freed != 2 {
+		t.Error("renderers not freed", *r.freed)
+	}
+	if _, err := w.Render(context.Background(), "style.xml", Request{}); err != ErrWorkersClosed {
+		t.Error("expected ErrWorkersClosed, got", err)
+	}
+}
+
+func TestWorkersQueue(t *testing.T) {
+	w, r := newTestWorkers(WorkerOptions{Workers: 1, Queue: 1})
+	defer w.Close()
+
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := w.Render(context.Background(), "style.xml", Request{})
+			errc <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	if _, err := w.Render(context.Background(), "style.xml", Request{}); err != ErrQueueFull {
+		t.Error("expected ErrQueueFull, got", err)
+	}
+	close(r.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestWorkersCancel(t *testing.T) {
+	w, r := newTestWorkers(WorkerOptions{Workers: 1, Timeout: 20 * time.Millisecond})
+	defer w.Close()
+
+	start := time.Now()
+	if _, err := w.Render(context.Background(), "style.xml", Request{}); err != context.DeadlineExceeded {
+		t.Error("expected timeout, got", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error("timeout took", d)
+	}
+
+	// worker is still busy, request is cancelled in the queue
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := w.Render(ctx, "style.xml", Request{}); err != context.Canceled {
+		t.Error("expected cancel, got", err)
+	}
+	close(r.release)
+	if b, err := w.Render(context.Background(), "next.xml", Request{}); err != nil || string(b) != "next.xml" {
+		t.Error("unexpected result after cancel", string(b), err)
+	}
+}
+
+// cancelRenderer returns on cancel, but stays busy until release is closed,
+// like a Mapnik render that continues in the background.
+type cancelRenderer struct {
+	release chan struct{}
+	freed   chan struct{}
+	running bool
+}
+
+func (r *cancelRenderer) render(ctx context.Context, style string, req Request) ([]byte, error) {
+	if style == "fast.xml" {
+		return []byte(style), nil
+	}
+	r.running = true
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.release:
+		r.running = false
+		return []byte(style), nil
+	}
+}
+
+func (r *cancelRenderer) busy() bool {
+	if !r.running {
+		return false
+	}
+	select {
+	case <-r.release:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r *cancelRenderer) free() {
+	if r.running {
+		<-r.release
+	}
+	r.freed <- struct{}{}
+}
+
+func TestWorkersAbandon(t *testing.T) {
+	release := make(chan struct{})
+	freed := make(chan struct{}, 10)
+	w := newWorkers(WorkerOptions{Workers: 1, Timeout: 20 * time.Millisecond}, func() workerRenderer {
+		return &cancelRenderer{release: release, freed: freed}
+	})
+
+	if _, err := w.Render(context.Background(), "slow.xml", Request{}); err != context.DeadlineExceeded {
+		t.Error("expected timeout, got", err)
+	}
+	// worker continues with a new renderer
+	if b, err := w.Render(context.Background(), "fast.xml", Request{}); err != nil || string(b) != "fast.xml" {
+		t.Error("unexpected result", string(b), err)
+	}
+	select {
+	case <-freed:
+		t.Fatal("renderer freed before its render finished")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-freed:
+	case <-time.After(time.Second):
+		t.Fatal("abandoned renderer not freed")
+	}
+	w.Close()
+	if len(freed) != 1 {
+		t.Error("renderer of worker not freed", len(freed))
+	}
+}